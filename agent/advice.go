@@ -0,0 +1,65 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+)
+
+const (
+	// adviceSampleInterval is how often the advisor observes the agent's
+	// metrics.
+	adviceSampleInterval = 15 * time.Second
+
+	// adviceObservations is the number of observations the advisor's
+	// recommendations are based on, i.e. the last ten minutes.
+	adviceObservations = 40
+)
+
+// registerAdvisorMetrics exports the settings the advisor compares the other
+// metrics against.
+func (a *Agent) registerAdvisorMetrics() {
+	metrics.DefaultRegistry.GaugeFunc("wal_readahead_bytes", "Maximum number of bytes of WAL read ahead of PostgreSQL.",
+		func() float64 { return float64(a.walCache.ReadaheadBytes()) })
+}
+
+// runAdvisor feeds the advisor a snapshot of the agent's metrics every
+// adviceSampleInterval and logs its recommendations every AdviseInterval.
+func (a *Agent) runAdvisor() {
+	sample := time.NewTicker(adviceSampleInterval)
+	defer sample.Stop()
+
+	var advise <-chan time.Time
+	if a.cfg.AdviseInterval > 0 {
+		t := time.NewTicker(a.cfg.AdviseInterval)
+		defer t.Stop()
+		advise = t.C
+	}
+
+	for {
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case now := <-sample.C:
+			a.advisor.Observe(now, metrics.DefaultRegistry.Snapshot())
+		case now := <-advise:
+			for _, advice := range a.advisor.Report(now).Advice {
+				a.log.Info().Str("check", advice.Check).Str("finding", advice.Finding).
+					Msg("tuning advice: " + advice.Recommendation)
+			}
+		}
+	}
+}
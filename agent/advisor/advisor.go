@@ -0,0 +1,327 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package advisor correlates the agent's metrics over a window of recent
+// observations and recommends changes to its configuration, e.g. more IO
+// workers when IOs are always queued but reads are fast.
+package advisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	// minObservations is the number of observations needed before any advice
+	// is given.
+	minObservations = 4
+
+	// mostly is the fraction of observations in which a condition must hold
+	// for it to be considered persistent rather than a burst.
+	mostly = 0.8
+
+	// saturationFactor is the number of IOs pending per IO worker above which
+	// IOs are considered queued.
+	saturationFactor = 2
+
+	// slowRead is the 99th percentile read latency above which the storage,
+	// rather than the number of IO workers, is considered the bottleneck.
+	slowRead = 20 * time.Millisecond
+
+	// decoderWaitRatio is the fraction of decoder invocations delayed by the
+	// limit on concurrent decoders above which more decoders are advised.
+	decoderWaitRatio = 0.5
+)
+
+// Names of the metrics the advisor reads, without the metrics.Namespace.
+const (
+	metricDecoderInvocations = "wal_decoder_invocations_total"
+	metricDecoderTimeouts    = "wal_decoder_timeouts_total"
+	metricDecoderWaits       = "wal_decoder_waits_total"
+	metricHooksDropped       = "hooks_dropped_total"
+	metricIOPending          = "io_pending"
+	metricIOWorkers          = "io_workers"
+	metricLag                = "lag_bytes"
+	metricReadP99            = `prefault_read_seconds{quantile="0.99"}`
+	metricReadahead          = "wal_readahead_bytes"
+	metricSegmentsSkipped    = "wal_segments_skipped_total"
+)
+
+// Advice is a single recommendation.
+type Advice struct {
+	// Check names the condition detected, e.g. "io-saturated".
+	Check string `json:"check"`
+
+	// Finding describes what was observed and Recommendation what to change.
+	Finding        string `json:"finding"`
+	Recommendation string `json:"recommendation"`
+}
+
+// Report is the advice given for a window of observations.
+type Report struct {
+	Time         time.Time `json:"time"`
+	Window       string    `json:"window"`
+	Observations int       `json:"observations"`
+	Advice       []Advice  `json:"advice"`
+}
+
+// observation is the value of each metric at a point in time, keyed by the
+// metric's name without the metrics.Namespace.  Series of the same metric are
+// summed unless they are distinguished by a quantile.
+type observation struct {
+	time   time.Time
+	values map[string]float64
+}
+
+// Advisor keeps a window of observations of the agent's metrics.
+type Advisor struct {
+	lock         sync.Mutex
+	size         int
+	observations []observation
+}
+
+// New returns an Advisor that bases its advice on the size most recent
+// observations.
+func New(size int) *Advisor {
+	if size < minObservations {
+		size = minObservations
+	}
+
+	return &Advisor{size: size}
+}
+
+// Observe records a snapshot of the metrics taken at now.
+func (a *Advisor) Observe(now time.Time, samples []metrics.Sample) {
+	o := observation{
+		time:   now,
+		values: make(map[string]float64, len(samples)),
+	}
+	prefix := metrics.Namespace + "_"
+	for _, s := range samples {
+		key := strings.TrimPrefix(s.Name, prefix)
+		for _, l := range s.Labels {
+			if l.Name == "quantile" {
+				key += fmt.Sprintf("{quantile=%q}", l.Value)
+			}
+		}
+		o.values[key] += s.Value
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.observations = append(a.observations, o)
+	if len(a.observations) > a.size {
+		a.observations = append(a.observations[:0], a.observations[len(a.observations)-a.size:]...)
+	}
+}
+
+// Report returns the advice for the current window of observations.
+func (a *Advisor) Report(now time.Time) Report {
+	a.lock.Lock()
+	w := window(append([]observation(nil), a.observations...))
+	a.lock.Unlock()
+
+	r := Report{
+		Time:         now,
+		Observations: len(w),
+		Advice:       []Advice{},
+	}
+	if len(w) > 0 {
+		r.Window = w[len(w)-1].time.Sub(w[0].time).String()
+	}
+	if len(w) < minObservations {
+		return r
+	}
+
+	saturated := w.count(func(o observation) bool {
+		workers := o.values[metricIOWorkers]
+		return workers > 0 && o.values[metricIOPending] >= saturationFactor*workers
+	})
+	readP99 := time.Duration(w.last(metricReadP99) * float64(time.Second))
+	ioBound := w.mostly(saturated)
+	switch {
+	case ioBound && readP99 >= slowRead:
+		r.Advice = append(r.Advice, Advice{
+			Check: "storage-saturated",
+			Finding: fmt.Sprintf("IOs were queued in %d of %d observations and the p99 read latency is %s",
+				saturated, len(w), readP99),
+			Recommendation: "the storage is the bottleneck, more IO workers would only add queueing: check the device's utilization or limit the IO workers (--num-io-threads)",
+		})
+	case ioBound:
+		r.Advice = append(r.Advice, Advice{
+			Check: "io-saturated",
+			Finding: fmt.Sprintf("IOs were queued in %d of %d observations while the p99 read latency is only %s",
+				saturated, len(w), readP99),
+			Recommendation: "increase the IO workers (--num-io-threads, or PUT /io-workers on the running agent)",
+		})
+	}
+
+	clamped := w.count(func(o observation) bool {
+		readahead := o.values[metricReadahead]
+		return readahead > 0 && o.values[metricLag] > readahead
+	})
+	readaheadBound := w.mostly(clamped)
+	if readaheadBound && !ioBound {
+		r.Advice = append(r.Advice, Advice{
+			Check: "readahead-clamped",
+			Finding: fmt.Sprintf("the lag exceeded the %s readahead in %d of %d observations",
+				units.Base2Bytes(w.last(metricReadahead)), clamped, len(w)),
+			Recommendation: "raise the readahead (--wal-readahead-bytes, or PUT /readahead on the running agent)",
+		})
+	}
+
+	if first, last := w[0].values[metricLag], w.last(metricLag); last > first && w.rising(metricLag) && !ioBound && !readaheadBound {
+		r.Advice = append(r.Advice, Advice{
+			Check: "lag-rising",
+			Finding: fmt.Sprintf("the lag rose from %s to %s while neither IO nor the readahead was limiting prefaulting",
+				units.Base2Bytes(first), units.Base2Bytes(last)),
+			Recommendation: "replay is limited by something other than reads: check replay_stalled_seconds and recovery_conflicts_total",
+		})
+	}
+
+	if invocations, waits := w.delta(metricDecoderInvocations), w.delta(metricDecoderWaits); invocations > 0 && waits/invocations >= decoderWaitRatio {
+		r.Advice = append(r.Advice, Advice{
+			Check:          "decoders-limited",
+			Finding:        fmt.Sprintf("%.0f of %.0f WAL decodes waited for a decoder", waits, invocations),
+			Recommendation: "raise the limit on concurrent decoders (--wal-max-decoders)",
+		})
+	}
+
+	if timeouts := w.delta(metricDecoderTimeouts); timeouts > 0 {
+		r.Advice = append(r.Advice, Advice{
+			Check:          "decode-timeouts",
+			Finding:        fmt.Sprintf("%.0f WAL decodes were killed after the decode timeout", timeouts),
+			Recommendation: "check the storage holding pg_wal or raise --wal-decode-timeout",
+		})
+	}
+
+	if skipped := w.delta(metricSegmentsSkipped); skipped > 0 {
+		r.Advice = append(r.Advice, Advice{
+			Check:          "segments-skipped",
+			Finding:        fmt.Sprintf("%.0f WAL segments were skipped because replay overtook prefaulting", skipped),
+			Recommendation: "add IO workers or raise --wal-segment-budget",
+		})
+	}
+
+	if dropped := w.delta(metricHooksDropped); dropped > 0 {
+		r.Advice = append(r.Advice, Advice{
+			Check:          "hook-events-dropped",
+			Finding:        fmt.Sprintf("%.0f hook events were dropped because too many were waiting to be delivered", dropped),
+			Recommendation: "make the hook command or webhook respond faster or lower hooks.timeout",
+		})
+	}
+
+	return r
+}
+
+// window is a series of observations, oldest first.
+type window []observation
+
+// count returns the number of observations for which fn is true.
+func (w window) count(fn func(observation) bool) int {
+	var n int
+	for _, o := range w {
+		if fn(o) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// mostly returns true if n of the observations is enough for a condition to
+// be persistent.
+func (w window) mostly(n int) bool {
+	return float64(n) >= mostly*float64(len(w))
+}
+
+// last returns the most recent value of metric.
+func (w window) last(metric string) float64 {
+	return w[len(w)-1].values[metric]
+}
+
+// delta returns how much counter increased over the window.  A counter that
+// went backwards was reset and only its increase since the reset is counted.
+func (w window) delta(counter string) float64 {
+	var d float64
+	for i := 1; i < len(w); i++ {
+		prev, cur := w[i-1].values[counter], w[i].values[counter]
+		if cur < prev {
+			prev = 0
+		}
+		d += cur - prev
+	}
+
+	return d
+}
+
+// rising returns true if metric increased between most consecutive
+// observations.
+func (w window) rising(metric string) bool {
+	var n int
+	for i := 1; i < len(w); i++ {
+		if w[i].values[metric] > w[i-1].values[metric] {
+			n++
+		}
+	}
+
+	return float64(n) >= mostly*float64(len(w)-1)
+}
+
+// URL returns the URL of the advice endpoint of the agent listening on addr.
+// addr is either a host:port or a base URL.
+func URL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	return strings.TrimSuffix(addr, "/") + "/advice"
+}
+
+// Fetch retrieves the current advice of the agent listening on addr.
+func Fetch(ctx context.Context, client *http.Client, addr string) (Report, error) {
+	req, err := http.NewRequest(http.MethodGet, URL(addr), nil)
+	if err != nil {
+		return Report{}, errors.Wrap(err, "unable to create advice request")
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Report{}, errors.Wrapf(err, "unable to reach agent at %s", addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return Report{}, fmt.Errorf("agent at %s: %s: %s", addr, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var r Report
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return Report{}, errors.Wrap(err, "unable to parse advice")
+	}
+
+	return r, nil
+}
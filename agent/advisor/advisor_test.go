@@ -0,0 +1,161 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package advisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// samples builds a snapshot from values keyed by the name the advisor reads
+// them by.
+func samples(values map[string]float64) []metrics.Sample {
+	s := make([]metrics.Sample, 0, len(values))
+	for name, v := range values {
+		sample := metrics.Sample{Name: metrics.Namespace + "_" + name, Value: v}
+		if name == metricReadP99 {
+			sample.Name = metrics.Namespace + "_prefault_read_seconds"
+			sample.Labels = []metrics.Label{{Name: "quantile", Value: "0.99"}}
+		}
+		s = append(s, sample)
+	}
+
+	return s
+}
+
+func TestAdvisorReport(t *testing.T) {
+	tests := []struct {
+		name         string
+		observations []map[string]float64
+		checks       []string
+	}{
+		{ // 0
+			name: "too few observations",
+			observations: []map[string]float64{
+				{metricIOWorkers: 4, metricIOPending: 100},
+				{metricIOWorkers: 4, metricIOPending: 100},
+			},
+			checks: []string{},
+		},
+		{ // 1
+			name: "idle",
+			observations: []map[string]float64{
+				{metricIOWorkers: 4, metricLag: 100, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 100, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 100, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 100, metricReadahead: 1 << 20},
+			},
+			checks: []string{},
+		},
+		{ // 2
+			name: "queued with fast reads",
+			observations: []map[string]float64{
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.001},
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.001},
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.001},
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.001},
+			},
+			checks: []string{"io-saturated"},
+		},
+		{ // 3
+			name: "queued with slow reads",
+			observations: []map[string]float64{
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.05},
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.05},
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.05},
+				{metricIOWorkers: 4, metricIOPending: 20, metricReadP99: 0.05},
+			},
+			checks: []string{"storage-saturated"},
+		},
+		{ // 4
+			name: "readahead clamped and lag rising",
+			observations: []map[string]float64{
+				{metricIOWorkers: 4, metricLag: 2 << 20, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 3 << 20, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 4 << 20, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 5 << 20, metricReadahead: 1 << 20},
+			},
+			checks: []string{"readahead-clamped"},
+		},
+		{ // 5
+			name: "lag rising for another reason",
+			observations: []map[string]float64{
+				{metricIOWorkers: 4, metricLag: 1 << 10, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 2 << 10, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 3 << 10, metricReadahead: 1 << 20},
+				{metricIOWorkers: 4, metricLag: 4 << 10, metricReadahead: 1 << 20},
+			},
+			checks: []string{"lag-rising"},
+		},
+		{ // 6
+			name: "counters",
+			observations: []map[string]float64{
+				{metricDecoderInvocations: 10, metricDecoderWaits: 0, metricDecoderTimeouts: 1, metricSegmentsSkipped: 0, metricHooksDropped: 3},
+				{metricDecoderInvocations: 20, metricDecoderWaits: 8, metricDecoderTimeouts: 1, metricSegmentsSkipped: 2, metricHooksDropped: 3},
+				{metricDecoderInvocations: 30, metricDecoderWaits: 16, metricDecoderTimeouts: 2, metricSegmentsSkipped: 2, metricHooksDropped: 3},
+				{metricDecoderInvocations: 40, metricDecoderWaits: 24, metricDecoderTimeouts: 2, metricSegmentsSkipped: 2, metricHooksDropped: 3},
+			},
+			checks: []string{"decoders-limited", "decode-timeouts", "segments-skipped"},
+		},
+		{ // 7
+			name: "counter reset",
+			observations: []map[string]float64{
+				{metricHooksDropped: 5},
+				{metricHooksDropped: 5},
+				{metricHooksDropped: 0},
+				{metricHooksDropped: 0},
+			},
+			checks: []string{},
+		},
+	}
+
+	start := time.Date(2019, 3, 5, 0, 0, 0, 0, time.UTC)
+	for n, test := range tests {
+		a := New(len(test.observations))
+		for i, o := range test.observations {
+			a.Observe(start.Add(time.Duration(i)*time.Minute), samples(o))
+		}
+
+		r := a.Report(start)
+		checks := []string{}
+		for _, advice := range r.Advice {
+			checks = append(checks, advice.Check)
+		}
+		if diff := pretty.Compare(checks, test.checks); diff != "" {
+			t.Fatalf("%d: %s: checks diff: (-got +want)\n%s", n, test.name, diff)
+		}
+		if r.Observations != len(test.observations) {
+			t.Fatalf("%d: %s: got %d observations, want %d", n, test.name, r.Observations, len(test.observations))
+		}
+	}
+}
+
+func TestAdvisorWindow(t *testing.T) {
+	a := New(minObservations)
+	start := time.Date(2019, 3, 5, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3*minObservations; i++ {
+		a.Observe(start.Add(time.Duration(i)*time.Minute), nil)
+	}
+
+	r := a.Report(start)
+	if r.Observations != minObservations {
+		t.Fatalf("got %d observations, want %d", r.Observations, minObservations)
+	}
+	if want := (minObservations - 1) * time.Minute; r.Window != want.String() {
+		t.Fatalf("got window %s, want %s", r.Window, want)
+	}
+}
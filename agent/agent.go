@@ -18,59 +18,313 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/advisor"
+	"github.com/bschofield/pg_prefaulter/agent/alert"
+	"github.com/bschofield/pg_prefaulter/agent/cloudwatch"
+	"github.com/bschofield/pg_prefaulter/agent/consul"
 	"github.com/bschofield/pg_prefaulter/agent/fhcache"
+	"github.com/bschofield/pg_prefaulter/agent/hooks"
+	"github.com/bschofield/pg_prefaulter/agent/indexcache"
 	"github.com/bschofield/pg_prefaulter/agent/iocache"
+	"github.com/bschofield/pg_prefaulter/agent/maintenance"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/pglog"
+	"github.com/bschofield/pg_prefaulter/agent/stallhist"
+	"github.com/bschofield/pg_prefaulter/agent/state"
 	"github.com/bschofield/pg_prefaulter/agent/walcache"
+	"github.com/bschofield/pg_prefaulter/agent/warmset"
 	"github.com/bschofield/pg_prefaulter/buildtime"
 	"github.com/bschofield/pg_prefaulter/config"
 	"github.com/bschofield/pg_prefaulter/lib"
 	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/waldump"
 	"github.com/jackc/pgx"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	log "github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 )
 
+// Agent prefaults the pages PostgreSQL is about to read while replaying WAL.
+// An Agent can be embedded in another program: create it with New, run it with
+// Start, and shut it down with Stop.
 type Agent struct {
 	cfg *config.Agent
+	log zerolog.Logger
 
-	signalCh chan os.Signal
+	// handlesSignals is true if the agent handles the process's signals.
+	handlesSignals bool
+	signalCh       chan os.Signal
 
 	shutdown    func()
 	shutdownCtx context.Context
 
-	// pgStateLock protects the following values.  lastWALLog and lastTimelineID
-	// are the WAL filename and timeline ID from previous call to queryLastLog()
-	// operation.
+	// exitErr is the error that caused the agent to shut down, if any, and is
+	// returned by Wait().
+	exitErrOnce sync.Once
+	exitErr     error
+
+	// dialLock serializes ensureDBPool's connection attempts so that the
+	// database is dialed without holding pgStateLock.
+	dialLock sync.Mutex
+
+	// walPosition holds the most recent _WALPosition observed by
+	// getWALFilesDB().  walPosition is replaced, never mutated, so the scan
+	// loop and status readers do not contend on pgStateLock.
+	walPosition atomic.Value
+
+	// pgStateLock protects the following values.
 	pgStateLock    sync.RWMutex
 	pgConnCtx      context.Context
 	pgConnShutdown func()
 	pool           *pgx.ConnPool
 	poolConfig     *config.DBPool
-	lastWALLog     pg.WALFilename
-	lastTimelineID pg.TimelineID
+
+	// upstreamPool is a connection pool to this follower's upstream (e.g. as
+	// discovered via repmgr).  upstreamPool is nil when the upstream is unknown.
+	upstreamPool     *pgx.ConnPool
+	upstreamConninfo string
+	upstreamNodeName string
+	upstreamRole     _DBState
+
+	// upstreamTranslations are the queries for the upstream's
+	// server_version_num.  upstreamTranslations is nil until the upstream's
+	// version is known.
+	upstreamTranslations *pg.WALTranslations
+
+	lastDBState _DBState
+	lastLag     units.Base2Bytes
+
+	// lagObserved is true once lastLag has been measured in the current role.
+	lagObserved bool
+
+	// roleObserved is true while lastDBState is current, i.e. until the role
+	// watcher fails monitorMaxFailures times in a row.
+	roleObserved bool
+
+	// lagExceeded is true while lastLag is above the hooks' lag threshold.
+	lagExceeded bool
+
+	// lastSlotCheck is when the upstream's replication slots were last queried.
+	lastSlotCheck time.Time
+
+	// lastSlotWarning is the replication slot warning last logged.
+	lastSlotWarning string
+
+	// lastRetentionWarning is the WAL retention warning last logged.
+	lastRetentionWarning string
+
+	// pitrDone is why prefaulting stopped in "pitr" mode, or an empty string
+	// while recovery is in progress.
+	pitrDone string
+
+	// walDir is the absolute path of the WAL directory found in PGDATA.
+	walDir string
+
+	// bootstrapped is true once the bootstrap warmup has run.
+	bootstrapped bool
+
+	// lastRecovery is the follower's most recently observed replay state.
+	// replayStalled is how long replay had been stalled as of lastRecovery.
+	lastRecovery     pg.RecoveryState
+	recoveryObserved bool
+	replayTracker    replayTracker
+	replayStalled    time.Duration
+
+	// stallDetector flags replay stalls and slowdowns, which are attributed to
+	// the relations in stallHistory.  stallHistory is nil when stall-driven
+	// prioritization is disabled.
+	stallDetector stallhist.Detector
+	stallHistory  *stallhist.History
+
+	// warmSet remembers the most recently prefaulted blocks so they can be
+	// prefaulted again at startup.  warmSet is nil when disabled.
+	warmSet *warmset.Set
+
+	// advisor recommends configuration changes based on the agent's metrics.
+	advisor *advisor.Advisor
+
+	// maintenance is when prefaulting is paused or throttled.  maintenance is
+	// nil when no maintenance windows are configured.  inMaintenance is true
+	// while a maintenance window is open.
+	maintenance   *maintenance.Schedule
+	inMaintenance bool
+
+	// stateStore persists the agent's accumulated state across restarts.
+	// stateStore is nil when disabled.  stateWG tracks the goroutines that save
+	// state so that the store is only closed once they have finished.
+	stateStore *state.Store
+	stateWG    sync.WaitGroup
+
+	// controlData is the storage geometry the caches were initialized with.
+	// controlDataVerified is true once it has been read from pg_control or
+	// confirmed by the database.
+	controlData         pg.ControlData
+	controlDataVerified bool
+
+	// verifyChecksums is true when page checksum verification was requested.
+	verifyChecksums bool
+
+	// subscriptionLSNs is the received LSN of each subscription as of the last
+	// poll, used to prefault logical replication apply.  logicalTailBlocks is
+	// the number of blocks prefaulted from the end of each replicated table and
+	// index.
+	subscriptionLSNs  map[pg.OID]pg.LSN
+	logicalTailBlocks uint
+
+	// ready, draining, and lastScan are accessed atomically.  lastScan is the
+	// time, in nanoseconds since the epoch, of the last successful WAL scan.
+	ready    uint32
+	draining uint32
+	lastScan int64
+
+	// serverVersionNum is the server_version_num of the database as of the
+	// most recent connection, or zero if the agent hasn't connected yet.
+	// serverVersionNum is accessed atomically.  queryVersion is the version
+	// the current queries were generated for.
+	serverVersionNum uint64
+	queryVersion     uint64
+
+	consulRegistrar *consul.Registrar
+
+	// hooks is notified of significant events.  hooks is nil when no hook is
+	// configured.  failuresNotified is true once the current streak of
+	// prefault failures has been reported to hooks.
+	hooks            *hooks.Runner
+	hooksCfg         config.HooksConfig
+	failuresNotified bool
+
+	// recentEvents are the events fired most recently, reported by the
+	// diagnostic dump.
+	recentEvents eventRing
+
+	// alerter raises an alert when the lag stays above a threshold.  alerter is
+	// nil when alerting is disabled.
+	alerter *alert.Alerter
+
+	// metricSinks publish the agent's metrics to monitoring systems that don't
+	// scrape the http listener.
+	metricSinks []metricSink
+
+	// scanScheduler, restartpointCh, walArrivedCh, pgLogCh, and observedCh
+	// control the delay between WAL scans.
+	scanScheduler  *scanScheduler
+	restartpointCh chan struct{}
+	walArrivedCh   chan struct{}
+	pgLogCh        chan struct{}
+	observedCh     chan struct{}
+
+	// lagCh wakes the lag monitor.  monitorsOnce starts the role watcher and
+	// the lag monitor.
+	lagCh        chan struct{}
+	monitorsOnce sync.Once
+
+	// pgLog tails the server's log and is nil unless configured.  pgLogLock
+	// guards the events it found.
+	pgLog       *pglog.Tailer
+	pgLogLock   sync.Mutex
+	pgLogCounts map[pglog.Kind]uint64
+	pgLogLast   *pglog.Event
 
 	fileHandleCache *fhcache.FileHandleCache
 	ioCache         *iocache.IOCache
 	walCache        *walcache.WALCache
 	walTranslations *pg.WALTranslations
+
+	// indexCache is nil when index and TOAST prefaulting are disabled.
+	indexCache *indexcache.IndexCache
 }
 
-func New(cfg *config.Config) (a *Agent, err error) {
+// New creates an agent from cfg, e.g. as returned by config.NewDefault.  The
+// agent only reads its configuration from cfg, never from viper, and logs to the
+// global logger unless WithLogger is given.
+func New(cfg *config.Config, opts ...Option) (a *Agent, err error) {
 	a = &Agent{
 		cfg:             &cfg.Agent,
+		log:             log.Logger,
+		verifyChecksums: cfg.FHCacheConfig.VerifyChecksums,
 		walTranslations: &pg.WALTranslations{},
+		scanScheduler:   newScanScheduler(cfg.PollInterval, cfg.PollMaxInterval),
+		restartpointCh:  make(chan struct{}, 1),
+		walArrivedCh:    make(chan struct{}, 1),
+		pgLogCh:         make(chan struct{}, 1),
+		observedCh:      make(chan struct{}, 1),
+		lagCh:           make(chan struct{}, 1),
 	}
+	a.logicalTailBlocks = cfg.IndexCacheConfig.TailBlocks
 
-	a.setupSignals()
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	// Labels also apply to a logger given by WithLogger
+	a.log = lib.LabelLogger(a.log, cfg.Agent.Labels)
+	if len(cfg.Agent.Labels) > 0 {
+		metrics.DefaultRegistry.SetConstLabels(metrics.SortedLabels(cfg.Agent.Labels))
+	}
+	for _, s := range a.metricSinks {
+		if s.interval <= 0 {
+			return nil, fmt.Errorf("metrics sink %q has a non-positive interval (%s)", s.sink.Name(), s.interval)
+		}
+	}
+
+	// The caches log to the logger carried by shutdownCtx.
+	a.shutdownCtx, a.shutdown = context.WithCancel(lib.WithLogger(context.Background(), &a.log))
+	a.pgConnCtx, a.pgConnShutdown = context.WithCancel(a.shutdownCtx)
+
+	if a.handlesSignals {
+		a.setupSignals()
+	}
+
+	if faults := cfg.FaultConfig; faults.Enabled() {
+		a.log.Warn().Dur("pread-delay", faults.PreadDelay).Float64("pread-delay-rate", faults.PreadDelayRate).
+			Float64("pread-eio-rate", faults.PreadEIORate).Float64("decode-failure-rate", faults.DecodeFailRate).
+			Msg("fault injection enabled, do not use in production")
+	}
 
 	if err := a.initDBPool(cfg); err != nil {
 		return nil, errors.Wrap(err, "unable to initialize db connection pool")
 	}
 
+	if err := a.loadControlData(cfg); err != nil {
+		return nil, errors.Wrap(err, "unable to load pg_control")
+	}
+	a.loadRecordSize(cfg)
+
+	if cfg.StatePath != "" {
+		stateStore, err := state.Open(cfg.StatePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open state store")
+		}
+		a.stateStore = stateStore
+
+		if err := a.restoreState(); err != nil {
+			a.log.Warn().Err(err).Str("path", cfg.StatePath).
+				Str("next step", "starting without a WAL position").Msg("unable to restore agent state")
+		}
+	}
+
+	if blob := a.stateBlob(cfg.StallHistoryPath, state.BucketStallHistory, "relations"); blob != nil {
+		a.stallHistory = stallhist.New(blob)
+		if err := a.stallHistory.Load(); err != nil {
+			a.log.Warn().Err(err).Str("state", blob.String()).
+				Str("next step", "starting with an empty stall history").Msg("unable to load stall history")
+		}
+	}
+
+	if blob := a.stateBlob(cfg.WarmSetPath, state.BucketWarmSet, "manifest"); blob != nil {
+		a.warmSet = warmset.New(blob, cfg.WarmSetBudget, a.controlData.BlockSize)
+		if err := a.warmSet.Load(a.shutdownCtx); err != nil {
+			a.log.Warn().Err(err).Str("state", blob.String()).
+				Str("next step", "starting with an empty warm set").Msg("unable to load warm set")
+		}
+	}
+
 	{
 		fhCache, err := fhcache.New(a.shutdownCtx, cfg)
 		if err != nil {
@@ -78,10 +332,30 @@ func New(cfg *config.Config) (a *Agent, err error) {
 		}
 
 		a.fileHandleCache = fhCache
+
+		if a.stateStore != nil {
+			if err := a.restoreMissingFiles(); err != nil {
+				a.log.Warn().Err(err).Str("path", cfg.StatePath).
+					Str("next step", "starting without missing files").Msg("unable to restore missing files")
+			}
+		}
+
+		if a.controlDataVerified {
+			a.setDataChecksumVersion(a.controlData.DataChecksumVersion)
+		}
+	}
+
+	if a.maintenance = maintenance.NewSchedule(cfg.MaintenanceWindows, cfg.MaintenanceIOPS); a.maintenance != nil {
+		windows := make([]string, len(cfg.MaintenanceWindows))
+		for i, w := range cfg.MaintenanceWindows {
+			windows[i] = w.String()
+		}
+		a.log.Info().Strs("maintenance-windows", windows).Uint("maintenance-iops", cfg.MaintenanceIOPS).
+			Msg("prefaulting is paused or throttled during maintenance windows")
 	}
 
 	{
-		ioCache, err := iocache.New(a.shutdownCtx, cfg, a.fileHandleCache)
+		ioCache, err := iocache.New(a.shutdownCtx, cfg, a.fileHandleCache, a.stallHistory, a.warmSet, a.maintenance)
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to initialize IO Cache")
 		}
@@ -89,13 +363,57 @@ func New(cfg *config.Config) (a *Agent, err error) {
 		a.ioCache = ioCache
 	}
 
+	if cfg.IndexCacheConfig.Enable || cfg.IndexCacheConfig.Toast {
+		a.indexCache = indexcache.New(a.shutdownCtx, cfg, a.ioCache, a)
+	}
+
 	{
-		walCache, err := walcache.New(a, a.shutdownCtx, cfg, a.ioCache, a.walTranslations)
+		walCache, err := walcache.New(a, a.shutdownCtx, cfg, a.ioCache, a.walTranslations, a.stallHistory, a.indexCache)
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to initialize WAL cache")
 		}
 
 		a.walCache = walCache
+
+		if a.controlDataVerified {
+			a.walCache.SetTrackCommitTimestamp(a.controlData.TrackCommitTimestamp)
+		}
+	}
+
+	a.registerCacheMetrics()
+	registerProcessMetrics()
+	registerBuildInfo()
+	a.advisor = advisor.New(adviceObservations)
+	a.registerAdvisorMetrics()
+
+	if cfg.ConsulConfig.Enable {
+		a.consulRegistrar = consul.New(&cfg.ConsulConfig, a.consulHealth)
+	}
+
+	if a.hooks = hooks.New(cfg.HooksConfig.Config, a.log); a.hooks != nil {
+		a.hooksCfg = cfg.HooksConfig
+		a.log.Info().Str("command", cfg.HooksConfig.Command).Str("url", cfg.HooksConfig.URL).
+			Strs("events", cfg.HooksConfig.Events).Msg("notifying hooks of events")
+	}
+
+	if a.alerter = alert.New(&cfg.AlertConfig, a.log); a.alerter != nil {
+		a.log.Info().Str("lag-threshold", cfg.AlertConfig.LagThreshold.String()).
+			Dur("for", cfg.AlertConfig.For).Str("format", cfg.AlertConfig.Format).
+			Msg("alerting when the lag stays above the threshold")
+	}
+
+	if cfg.PGLogPath != "" {
+		a.pgLog = pglog.New(cfg.PGLogPath, cfg.PGLogFormat, a.log)
+		a.pgLogCounts = make(map[pglog.Kind]uint64, len(pglog.Kinds))
+		a.log.Info().Str("pg-log", cfg.PGLogPath).Str("format", cfg.PGLogFormat).
+			Msg("tailing the server log for recovery conflicts and stalls")
+	}
+
+	if cfg.CloudWatchConfig.Enable {
+		a.metricSinks = append(a.metricSinks, metricSink{
+			sink:     cloudwatch.New(&cfg.CloudWatchConfig),
+			interval: cfg.CloudWatchConfig.Interval,
+		})
 	}
 
 	return a, nil
@@ -110,13 +428,24 @@ func (a *Agent) AcquireConnContext() context.Context {
 	return a.pgConnCtx
 }
 
-// Loop forever between two modes of operation: sleeping or primary, and a
-// follower (the follower mode has its own criterium to figure out if it
-// needs to do work).
-func (a *Agent) Start() {
+// AcquirePool returns the current connection pool to PostgreSQL, which is nil
+// while the agent isn't connected.
+func (a *Agent) AcquirePool() *pgx.ConnPool {
+	a.pgStateLock.RLock()
+	defer a.pgStateLock.RUnlock()
+
+	return a.pool
+}
+
+// Start runs the agent until ctx is cancelled or Stop is called.  Start loops
+// forever between two modes of operation: sleeping or primary, and a follower
+// (the follower mode has its own criterium to figure out if it needs to do
+// work).  Cancelling ctx shuts the agent down as SIGTERM would, draining
+// outstanding work if configured to.
+func (a *Agent) Start(ctx context.Context) {
 	var err error
 
-	log.Info().Str("date", buildtime.DATE).
+	a.log.Info().Str("date", buildtime.DATE).
 		Str("version", buildtime.VERSION).
 		Str("commit", buildtime.COMMIT).
 		Str("tag", buildtime.TAG).
@@ -132,17 +461,116 @@ func (a *Agent) Start() {
 	}
 	a.pgStateLock.Unlock()
 
-	go a.handleSignals()
+	if a.handlesSignals {
+		go a.handleSignals()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.requestShutdown()
+		case <-a.shutdownCtx.Done():
+		}
+	}()
+
+	a.startHTTP()
+
+	if a.consulRegistrar != nil {
+		go a.consulRegistrar.Run(a.shutdownCtx)
+	}
+
+	if a.hooks != nil {
+		go a.hooks.Run(a.shutdownCtx)
+	}
+
+	if a.alerter != nil {
+		go a.alerter.Run(a.shutdownCtx)
+	}
 
-	// The main event loop for the run command.  The run event loop runs through
-	// the following six steps:
+	for _, s := range a.metricSinks {
+		go a.runSink(s)
+	}
+
+	if a.cfg.Sidecar {
+		if err := a.waitForPGData(a.cfg.PGData, a.cfg.StartupTimeout); err != nil {
+			if lib.IsShuttingDown(a.shutdownCtx) {
+				return
+			}
+			a.log.Error().Err(err).Str("next step", "exiting").Msg("unable to find PGDATA")
+			a.fail(lib.TransientDBError(errors.Wrap(err, "unable to find PGDATA")))
+			return
+		}
+	}
+
+	go a.watchRestartpoints(a.cfg.PGData)
+	if a.pgLog != nil {
+		go a.pgLog.Run(a.shutdownCtx, pgLogPollInterval, a.observePGLog)
+	}
+	if a.cfg.WatchWAL {
+		go a.watchWALDir()
+	}
+	switch {
+	case a.cfg.WALTailInterval == 0 || a.cfg.PGMode == "pitr":
+	case !a.walCache.CanTail():
+		a.log.Info().Msg("tailing the WAL segment being written requires pg_waldump(1), not tailing")
+	default:
+		go a.tailWAL()
+	}
+
+	if a.stateStore != nil {
+		a.stateWG.Add(1)
+		go func() {
+			defer a.stateWG.Done()
+			a.runStateStore()
+		}()
+	}
+
+	if a.stallHistory != nil {
+		a.stateWG.Add(1)
+		go func() {
+			defer a.stateWG.Done()
+			a.stallHistory.Run(a.shutdownCtx, stallHistorySaveInterval)
+		}()
+	}
+
+	if a.warmSet != nil {
+		a.stateWG.Add(1)
+		go func() {
+			defer a.stateWG.Done()
+			a.warmSet.Run(a.shutdownCtx, warmSetSaveInterval)
+		}()
+		go a.replayWarmSet()
+	}
+
+	switch {
+	case len(a.cfg.Peers) == 0:
+	case a.warmSet == nil:
+		a.log.Warn().Strs("peers", a.cfg.Peers).Msg("peer exchange requires the warm set, ignoring peers")
+	default:
+		go a.runPeerExchange()
+	}
+
+	if a.cfg.BufferCacheConninfo != "" {
+		go a.runBufferCacheMirror()
+	}
+
+	go a.runAdvisor()
+
+	if a.cfg.IOWorkersAutoscale {
+		go a.scaleIOWorkers()
+	}
+
+	// The main event loop for the run command is the WAL scanner, see
+	// monitor.go for the components it works with.  The run event loop runs
+	// through the following six steps:
 	//
 	// 1) Shutdown if we've been told to shutdown.
 	// 2) Sleep if we've been told to sleep in the previous iteration.
 	// 3) Dump caches if a cache-invalidation event occurred.
 	// 4) Determine version of postgres and translate WAL interactions
 	// 5) Attempt to find WAL files.
-	// 5a) Attempt to query the DB to find the WAL files.
+	// 5a) Attempt to query the DB to find the WAL files, predicting from the
+	//     role and lag most recently observed by the role watcher and the lag
+	//     monitor.
 	// 5b) Attempt to query the process args to find the WAL files.
 	// 6) Fault pages in from the heap if we have found any WAL files.
 	// 6a) Fault into PG using pg_prewarm() if detected.
@@ -153,25 +581,25 @@ func (a *Agent) Start() {
 	var purgeCache bool
 
 	// Use a closure to reduce the boiler plate in controlling the event loop.
+	// Transient database errors are retried once the agent has completed a
+	// scan, or during initialization if configured to.  Configuration,
+	// permission, and fatal errors shut the agent down.
 	handleErrors := func(rawErr error, msg string) (retry bool) {
-		// FIXME(seanc@): BFS traverse rawErr to find the following error types.
-		// This could/should be errwrap.Contains().
-		if err, ok := rawErr.(retryableError); ok {
-			retry = err.retry()
-		}
+		category := lib.CategoryOf(rawErr)
 
 		if err, ok := rawErr.(purgeEventError); ok {
 			purgeCache = err.purgeCache()
 		}
 
+		scanned := atomic.LoadInt64(&a.lastScan) != 0
 		switch {
-		case retry && a.cfg.RetryInit:
-			log.Error().Err(rawErr).Str("next step", "retrying").Msg(msg)
+		case category.Retryable() && (a.cfg.RetryInit || scanned):
+			a.log.Error().Err(rawErr).Str("category", category.String()).Str("next step", "retrying").Msg(msg)
 			sleepBetweenIterations = false
 			return true
 		default:
-			log.Error().Err(rawErr).Str("next step", "exiting").Msg(msg)
-			a.shutdown()
+			a.log.Error().Err(rawErr).Str("category", category.String()).Str("next step", "exiting").Msg(msg)
+			a.fail(errors.Wrap(rawErr, msg))
 			return false
 		}
 	}
@@ -182,14 +610,26 @@ RETRY:
 			break RETRY
 		}
 
+		// While draining, let the queued work complete but don't schedule
+		// anything new.
+		if a.isDraining() {
+			time.Sleep(a.cfg.PollInterval)
+			continue
+		}
+
+		// Don't look for new WAL while a maintenance window pauses prefaulting.
+		if a.checkMaintenance() {
+			a.waitForScan(a.cfg.PollInterval)
+			continue
+		}
+
 		// 2) Sleep.  Sleep before purging the WALCache in order to allow processes
 		//    in flight to complete.  If the sleep is not called before the purge,
 		//    it's possible that an in-flight pg_waldump(1) would be cancelled
 		//    before it completed a run.  This means that during an unexpected
 		//    shutdown, FDs won't be closed for up to config.KeyPGPollInterval.
 		if !sleepBetweenIterations {
-			d := viper.GetDuration(config.KeyPGPollInterval)
-			time.Sleep(d)
+			a.waitForScan(a.scanScheduler.interval())
 			sleepBetweenIterations = false
 		}
 
@@ -211,9 +651,22 @@ RETRY:
 			}
 		}
 
-		// 5) Get WAL files
+		// The role watcher and lag monitor query the database in the
+		// background once the queries for its version are known.
+		if a.cfg.PGMode != "pitr" {
+			a.startMonitors()
+		}
+
+		// Before the first scan, prefault what the WAL already in pg_wal needs.
+		if a.cfg.BootstrapWarm && !a.bootstrapped {
+			a.bootstrapWarm()
+			a.bootstrapped = true
+		}
+
+		// 5) Get WAL files and 6) fault in PostgreSQL heap pages identified in
+		//    the WAL files.  WAL files are faulted as they are found.
 		var walFiles []pg.WALFilename
-		walFiles, err = a.getWALFiles()
+		walFiles, sleepBetweenIterations, err = a.scanWALFiles()
 		if err != nil {
 			retry := handleErrors(err, "unable to find WAL files")
 			if retry {
@@ -222,16 +675,9 @@ RETRY:
 				break RETRY
 			}
 		}
-
-		// 6) Fault in PostgreSQL heap pages identified in the WAL files
-		if sleepBetweenIterations, err = a.prefaultWALFiles(walFiles); err != nil {
-			retry := handleErrors(err, "unable to prefault WAL files")
-			if retry {
-				goto RETRY
-			} else {
-				break RETRY
-			}
-		}
+		a.markScanned()
+		a.checkPrefaultFailures()
+		a.scanScheduler.observe(walFiles, a.lag())
 	}
 }
 
@@ -239,6 +685,7 @@ RETRY:
 func (a *Agent) Stop() {
 	a.stopSignalHandler()
 	a.shutdown()
+	a.pushMetrics()
 
 	a.pgStateLock.Lock()
 	defer a.pgStateLock.Unlock()
@@ -252,47 +699,148 @@ func (a *Agent) Stop() {
 		//a.pool = nil
 	}
 
-	log.Debug().Msg("Stopped " + buildtime.PROGNAME + " agent")
+	if a.upstreamPool != nil {
+		a.upstreamPool.Close()
+		a.upstreamPool = nil
+		a.upstreamConninfo = ""
+	}
+
+	a.log.Debug().Msg("Stopped " + buildtime.PROGNAME + " agent")
 }
 
-// Wait blocks until shutdown
+// fail records err as the reason the agent is exiting and shuts down the
+// agent.  Only the first error is recorded.
+func (a *Agent) fail(err error) {
+	a.exitErrOnce.Do(func() {
+		a.exitErr = err
+	})
+	a.shutdown()
+}
+
+// Wait blocks until shutdown.  Wait returns the error that caused the agent to
+// shut down, if any.
 func (a *Agent) Wait() error {
-	log.Debug().Msg("Starting wait")
+	a.log.Debug().Msg("Starting wait")
 	<-a.shutdownCtx.Done()
 
 	// Drain work from the WAL cache before returning
 	a.walCache.Wait()
 
-	return nil
+	// Close the file handles once the IO workers have finished their reads
+	a.log.Debug().Int("file-handles", a.fileHandleCache.Statistics().Entries).Msg("closing file handles")
+	a.fileHandleCache.Purge()
+
+	// Wait for the final saves before closing the state store
+	a.stateWG.Wait()
+	if a.stateStore != nil {
+		if err := a.stateStore.Close(); err != nil {
+			a.log.Warn().Err(err).Msg("unable to close state store")
+		}
+	}
+
+	return a.exitErr
 }
 
 func (a *Agent) setWALTranslations() error {
-	pgDataPath := viper.GetString(config.KeyPGData)
+	pgDataPath := a.cfg.PGData
 	pgVersion, err := a.getPostgresVersion(pgDataPath)
 
 	if err != nil {
-		return newVersionError(err, true)
+		return newVersionError(err, dbErrorCategory(err))
+	}
+
+	if err := a.findWALDump(pgVersion); err != nil {
+		return newVersionError(err, lib.ErrorCategoryConfig)
+	}
+
+	// PG_VERSION only holds the major version, prefer the server's own
+	// version once the agent has connected.
+	queryVersion := pgVersion
+	if serverVersion := atomic.LoadUint64(&a.serverVersionNum); serverVersion != 0 {
+		queryVersion = serverVersion
+	}
+	translations := pg.Translate(queryVersion)
+	translations.Override(a.cfg.QueryOverrides)
+	if queryVersion != a.queryVersion {
+		a.queryVersion = queryVersion
+		a.log.Info().Uint64("server-version-num", queryVersion).Int("query-overrides", len(a.cfg.QueryOverrides)).
+			Msg("generated queries for the PostgreSQL version")
 	}
 
-	*a.walTranslations = pg.Translate(pgVersion)
+	// Trust the layout of PGDATA over the directory implied by PG_VERSION.
+	walDir, err := pg.FindWALDirectory(pgDataPath)
+	if err != nil {
+		return newVersionError(errors.Wrap(err, "unable to find the WAL directory"), dbErrorCategory(err))
+	}
+	translations.Directory = walDir
+	walDirAbs := path.Join(pgDataPath, walDir)
+
+	a.pgStateLock.Lock()
+	// The role watcher and lag monitor read the queries concurrently so they
+	// are only replaced when they change.
+	if translations != *a.walTranslations {
+		*a.walTranslations = translations
+	}
+	prevWALDir := a.walDir
+	a.walDir = walDirAbs
+	a.pgStateLock.Unlock()
+
+	if walDirAbs != prevWALDir {
+		a.log.Info().Str("wal-directory", walDirAbs).Uint64("pg-version", pgVersion).Msg("found WAL directory")
+
+		if pgVersion > pg.LatestVersion {
+			a.log.Warn().Uint64("pg-version", pgVersion).Uint64("latest-version", pg.LatestVersion).
+				Msg("PostgreSQL is newer than the latest supported version, WAL may not be decoded fully")
+		}
+	}
+
+	return nil
+}
+
+// findWALDump finds the pg_waldump(1) for pgVersion if it wasn't found at
+// startup because PG_VERSION couldn't be read.
+func (a *Agent) findWALDump(pgVersion uint64) error {
+	if a.walCache.WalDumpPath() != "" {
+		return nil
+	}
+
+	p, err := waldump.Find(a.shutdownCtx, pgVersion)
+	if err != nil {
+		return errors.Wrapf(err, "%s is unset", config.KeyXLogPath)
+	}
+	a.walCache.SetWalDumpPath(p)
+	if a.cfg.ControlDataPath == "" {
+		// pg_controldata(1) is installed alongside pg_waldump(1)
+		a.cfg.ControlDataPath = path.Join(path.Dir(p), "pg_controldata")
+	}
+	a.log.Info().Str(config.KeyXLogPath, p).Uint64("pg-version", pgVersion).Msg("found pg_waldump(1)")
 
 	return nil
 }
 
 // getWALFiles returns a list of WAL files to be processed for prefaulting.
-// getWALFiles attempts to connect to the database to find the active WAL file
-// being applied.  If the database is starting up and can not accept new
+// WAL files are passed to emit as they are found.  getWALFiles attempts to
+// connect to the database to find the active WAL file being applied.  If the database is starting up and can not accept new
 // connections, attempt to extract the WAL file from the process args.  If the
 // database socket is unavailable, do nothing and do not attempt to process the
 // ps(1) args.
 //
 // FIXME(seanc@): Create a WALFaulter interface that can be DB-backed or
 // process-arg backed.
-func (a *Agent) getWALFiles() (pg.WALFiles, error) {
+func (a *Agent) getWALFiles(emit func(pg.WALFiles)) (pg.WALFiles, error) {
+	if a.cfg.PGMode == "pitr" {
+		walFiles, err := a.getWALFilesPITR()
+		if err != nil {
+			return nil, err
+		}
+		emit(walFiles)
+
+		return walFiles, nil
+	}
 
 	var dbErr error
 	var walFiles pg.WALFiles
-	walFiles, dbErr = a.getWALFilesDB()
+	walFiles, dbErr = a.getWALFilesDB(emit)
 	if dbErr == nil {
 		return walFiles, nil
 	}
@@ -322,16 +870,16 @@ func (a *Agent) getWALFiles() (pg.WALFiles, error) {
 				// in order to help improve performance when the database restarts.
 				processPSArgs = true
 			default:
-				// An unknown PG error happened and we were unable to connect.  Assume
-				// that this is a permanent failure and we need to get attention
-				// (e.g. wrong credentials).
-				return nil, newWALError(pgErr, false, false)
+				// An unknown PG error happened and we were unable to connect.  Unless
+				// its SQLSTATE says otherwise, assume that this is a permanent failure
+				// and we need to get attention (e.g. wrong credentials).
+				return nil, newWALError(pgErr, pgErrorCategory(pgErr), false)
 			}
 		default:
 			// An unknown error happened (not a PgError) and we were unable to fetch the
 			// WAL files.  Assume PG has disappeared out from under us.  In response to
 			// this, dump cache and attempt to retry.
-			return nil, newWALError(dbErr, true, true)
+			return nil, newWALError(dbErr, dbErrorCategory(dbErr), true)
 		}
 	}
 
@@ -342,32 +890,14 @@ func (a *Agent) getWALFiles() (pg.WALFiles, error) {
 			// Return a retriable error since processPSArgs returned true indicating
 			// the database was starting up.
 			raisedErr := fmt.Errorf("unable to query the DB (%+v) or process arguments (%+v)", dbErr, psErr)
-			return nil, newWALError(raisedErr, true, true)
+			return nil, newWALError(raisedErr, lib.ErrorCategoryTransientDB, true)
 		}
+		emit(walFiles)
 	}
 
 	return walFiles, nil
 }
 
-// prefaultWALFiles pre-faults the heap pages referenced in WAL files.  When
-// moreWork is set to true it indicates the caller should loop immediately.
-func (a *Agent) prefaultWALFiles(walFiles pg.WALFiles) (moreWork bool, err error) {
-	uniqueWALFiles := walFiles.Unique()
-
-	// Read through the cache to prefault a given WAL file.  The cache
-	// begins to fault the WAL file as soon as requested in the event of
-	// a cache miss.  FaultWALFile() dedupes requests and prevents a WAL
-	// file from concurrent prefault operations.
-	waitWALFiles := make(pg.WALFiles, 0, len(walFiles))
-	for _, walFile := range uniqueWALFiles {
-		if faulting, _ := a.walCache.FaultWALFile(walFile); faulting {
-			waitWALFiles = append(waitWALFiles, walFile)
-		}
-	}
-
-	return len(waitWALFiles) > pg.NumOldLSNs, nil
-}
-
 // resetPGConnCtx resets the PostgreSQL connection context.
 func (a *Agent) resetPGConnCtx() {
 	a.pgStateLock.Lock()
@@ -379,5 +909,7 @@ func (a *Agent) resetPGConnCtx() {
 
 // stopSignalHandler disables the signal handler
 func (a *Agent) stopSignalHandler() {
-	signal.Stop(a.signalCh)
+	if a.signalCh != nil {
+		signal.Stop(a.signalCh)
+	}
 }
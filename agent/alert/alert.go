@@ -0,0 +1,325 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alert raises an alert when a follower's lag stays above a threshold
+// despite prefaulting, and clears it once the lag has recovered.  Alerts are
+// sent to a generic JSON webhook, a Slack incoming webhook, or the PagerDuty
+// Events API v2.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// StatusFiring and StatusResolved are the status of an alert as sent in
+	// generic JSON alerts.
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+
+	// maxAttempts bounds the attempts to send each alert, retryDelay is the
+	// delay between attempts.
+	maxAttempts = 3
+	retryDelay  = 5 * time.Second
+)
+
+var (
+	alertFiring = metrics.NewGauge("lag_alert_firing", "1 while the lag alert is firing, otherwise 0.")
+	alertsSent  = metrics.NewCounter("lag_alerts_sent_total", "Number of lag alerts and resolutions sent.")
+	alertsFail  = metrics.NewCounter("lag_alerts_failed_total", "Number of lag alerts and resolutions that could not be sent.")
+)
+
+// state is where the lag stands relative to the alert.
+type state int
+
+const (
+	// stateOK: the lag is at or below the threshold.
+	stateOK state = iota
+
+	// statePending: the lag is above the threshold, but hasn't been for long
+	// enough to alert.
+	statePending
+
+	// stateFiring: the alert has been raised.
+	stateFiring
+
+	// stateClearing: the alert has been raised and the lag has fallen back to
+	// the threshold, but hasn't stayed there long enough to clear the alert.
+	stateClearing
+)
+
+// notification is an alert or a resolution waiting to be sent.
+type notification struct {
+	status    string
+	lag       units.Base2Bytes
+	threshold units.Base2Bytes
+	since     time.Time
+	time      time.Time
+}
+
+// Alerter tracks the lag and sends alerts.  A nil Alerter ignores the lag.
+type Alerter struct {
+	cfg    *config.AlertConfig
+	log    zerolog.Logger
+	client *http.Client
+	host   string
+	queue  chan notification
+
+	// lock protects the following values.  since is when the lag first exceeded
+	// the threshold while pending or firing, and when the lag fell back to the
+	// threshold while clearing.  firedAt is when the lag first exceeded the
+	// threshold for the alert currently raised.
+	lock    sync.Mutex
+	state   state
+	since   time.Time
+	firedAt time.Time
+}
+
+// New returns an Alerter for cfg, or nil if alerting is disabled.
+func New(cfg *config.AlertConfig, log zerolog.Logger) *Alerter {
+	if cfg.LagThreshold <= 0 {
+		return nil
+	}
+
+	a := &Alerter{
+		cfg:    cfg,
+		log:    log,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan notification, 16),
+	}
+	a.host, _ = os.Hostname()
+
+	return a
+}
+
+// Observe records the lag observed at now and queues an alert, or its
+// resolution, without blocking.
+func (a *Alerter) Observe(now time.Time, lag units.Base2Bytes) {
+	if a == nil {
+		return
+	}
+
+	n, found := a.observe(now, lag)
+	if !found {
+		return
+	}
+
+	select {
+	case a.queue <- n:
+	default:
+		alertsFail.Inc()
+		a.log.Warn().Str("status", n.status).Msg("too many lag alerts waiting to be sent, dropping alert")
+	}
+}
+
+// observe advances the alert's state and returns the notification to send, if
+// any.  The lag returning above the threshold while clearing puts the alert
+// back to firing without notifying again, and the lag falling back to the
+// threshold while pending cancels the alert before it was sent.
+func (a *Alerter) observe(now time.Time, lag units.Base2Bytes) (notification, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	above := lag > a.cfg.LagThreshold
+	n := notification{
+		lag:       lag,
+		threshold: a.cfg.LagThreshold,
+		time:      now,
+	}
+
+	switch {
+	case a.state == stateOK && above:
+		a.state, a.since = statePending, now
+		fallthrough
+	case a.state == statePending && above:
+		if now.Sub(a.since) < a.cfg.For {
+			return notification{}, false
+		}
+		a.state, a.firedAt = stateFiring, a.since
+		alertFiring.Set(1)
+		n.status, n.since = StatusFiring, a.firedAt
+		return n, true
+	case a.state == statePending:
+		a.state = stateOK
+	case a.state == stateFiring && !above:
+		a.state, a.since = stateClearing, now
+		fallthrough
+	case a.state == stateClearing && !above:
+		if now.Sub(a.since) < a.cfg.ClearAfter {
+			return notification{}, false
+		}
+		a.state = stateOK
+		alertFiring.Set(0)
+		n.status, n.since = StatusResolved, a.firedAt
+		return n, true
+	case a.state == stateClearing:
+		a.state = stateFiring
+	}
+
+	return notification{}, false
+}
+
+// Run sends alerts until ctx is cancelled.
+func (a *Alerter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-a.queue:
+			a.send(ctx, n)
+		}
+	}
+}
+
+// send sends n, retrying a few times in case the receiver is briefly
+// unavailable.
+func (a *Alerter) send(ctx context.Context, n notification) {
+	for attempt := 1; ; attempt++ {
+		err := a.post(ctx, n)
+		if err == nil {
+			alertsSent.Inc()
+			a.log.Info().Str("status", n.status).Str("lag", n.lag.String()).
+				Str("threshold", n.threshold.String()).Msg("sent lag alert")
+			return
+		}
+
+		if attempt == maxAttempts {
+			alertsFail.Inc()
+			a.log.Warn().Err(err).Str("status", n.status).Msg("unable to send lag alert")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func (a *Alerter) post(ctx context.Context, n notification) error {
+	payload, err := json.Marshal(a.payload(n))
+	if err != nil {
+		return errors.Wrap(err, "unable to encode alert")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "unable to create alert request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "unable to post alert")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("alert receiver returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+// payload returns the body of n in the configured format.
+func (a *Alerter) payload(n notification) interface{} {
+	summary := a.summary(n)
+
+	switch a.cfg.Format {
+	case config.AlertFormatSlack:
+		return map[string]interface{}{
+			"text": summary,
+		}
+	case config.AlertFormatPagerDuty:
+		action := "trigger"
+		if n.status == StatusResolved {
+			action = "resolve"
+		}
+		details := map[string]interface{}{
+			"lag-bytes":       uint64(n.lag),
+			"threshold-bytes": uint64(n.threshold),
+			"since":           n.since.UTC(),
+		}
+		if len(a.cfg.Labels) > 0 {
+			details["labels"] = a.cfg.Labels
+		}
+		return map[string]interface{}{
+			"routing_key":  a.cfg.RoutingKey,
+			"event_action": action,
+			"dedup_key":    buildtime.PROGNAME + "/" + a.host + "/lag",
+			"payload": map[string]interface{}{
+				"summary":        summary,
+				"source":         a.host,
+				"severity":       "warning",
+				"component":      buildtime.PROGNAME,
+				"custom_details": details,
+			},
+		}
+	default:
+		payload := map[string]interface{}{
+			"alert":           "lag",
+			"status":          n.status,
+			"host":            a.host,
+			"summary":         summary,
+			"lag-bytes":       uint64(n.lag),
+			"threshold-bytes": uint64(n.threshold),
+			"since":           n.since.UTC(),
+			"time":            n.time.UTC(),
+		}
+		if len(a.cfg.Labels) > 0 {
+			payload["labels"] = a.cfg.Labels
+		}
+		return payload
+	}
+}
+
+func (a *Alerter) summary(n notification) string {
+	source := a.host
+	if len(a.cfg.Labels) > 0 {
+		labels := make([]string, 0, len(a.cfg.Labels))
+		for name, value := range a.cfg.Labels {
+			labels = append(labels, name+"="+value)
+		}
+		sort.Strings(labels)
+		source += " (" + strings.Join(labels, ", ") + ")"
+	}
+
+	if n.status == StatusResolved {
+		return fmt.Sprintf("%s on %s: lag recovered to %s (threshold %s)",
+			buildtime.PROGNAME, source, n.lag, n.threshold)
+	}
+
+	return fmt.Sprintf("%s on %s: lag %s has exceeded %s since %s",
+		buildtime.PROGNAME, source, n.lag, n.threshold, n.since.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,170 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/rs/zerolog"
+)
+
+func TestObserve(t *testing.T) {
+	start := time.Date(2019, 3, 5, 1, 0, 0, 0, time.UTC)
+
+	type observation struct {
+		at  time.Duration
+		lag units.Base2Bytes
+	}
+
+	tests := []struct {
+		name         string
+		observations []observation
+		want         []string
+	}{
+		{ // 0
+			name: "below threshold",
+			observations: []observation{
+				{0, 10 * units.MiB},
+				{time.Hour, 100 * units.MiB},
+			},
+		},
+		{ // 1
+			name: "brief spike",
+			observations: []observation{
+				{0, 200 * units.MiB},
+				{4 * time.Minute, 200 * units.MiB},
+				{5 * time.Minute, 10 * units.MiB},
+				{20 * time.Minute, 10 * units.MiB},
+			},
+		},
+		{ // 2
+			name: "sustained lag then recovery",
+			observations: []observation{
+				{0, 200 * units.MiB},
+				{5 * time.Minute, 200 * units.MiB},
+				{6 * time.Minute, 200 * units.MiB},
+				{7 * time.Minute, 10 * units.MiB},
+				{11 * time.Minute, 10 * units.MiB},
+				{12 * time.Minute, 10 * units.MiB},
+			},
+			want: []string{StatusFiring, StatusResolved},
+		},
+		{ // 3
+			name: "flapping while firing",
+			observations: []observation{
+				{0, 200 * units.MiB},
+				{5 * time.Minute, 200 * units.MiB},
+				{6 * time.Minute, 10 * units.MiB},
+				{9 * time.Minute, 200 * units.MiB},
+				{10 * time.Minute, 10 * units.MiB},
+				{14 * time.Minute, 200 * units.MiB},
+				{15 * time.Minute, 10 * units.MiB},
+				{20 * time.Minute, 10 * units.MiB},
+			},
+			want: []string{StatusFiring, StatusResolved},
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := New(&config.AlertConfig{
+				LagThreshold: 100 * units.MiB,
+				For:          5 * time.Minute,
+				ClearAfter:   5 * time.Minute,
+			}, zerolog.Nop())
+
+			var got []string
+			for _, o := range test.observations {
+				if n, found := a.observe(start.Add(o.at), o.lag); found {
+					got = append(got, n.status)
+					if !n.since.Equal(start) {
+						t.Errorf("alert since %s, want %s", n.since, start)
+					}
+				}
+			}
+
+			if diff := pretty.Compare(got, test.want); diff != "" {
+				t.Fatalf("%d: notifications diff: (-got +want)\n%s", n, diff)
+			}
+		})
+	}
+}
+
+func TestPagerDuty(t *testing.T) {
+	var got []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	a := New(&config.AlertConfig{
+		LagThreshold: 100 * units.MiB,
+		Format:       config.AlertFormatPagerDuty,
+		URL:          srv.URL,
+		RoutingKey:   "R0UT1NGK3Y",
+		Timeout:      5 * time.Second,
+		Labels:       map[string]string{"cluster": "orders", "role": "replica"},
+	}, zerolog.Nop())
+	a.host = "replica-1"
+
+	since := time.Date(2019, 3, 5, 1, 0, 0, 0, time.UTC)
+	for _, status := range []string{StatusFiring, StatusResolved} {
+		n := notification{
+			status:    status,
+			lag:       200 * units.MiB,
+			threshold: 100 * units.MiB,
+			since:     since,
+			time:      since,
+		}
+		if err := a.post(context.Background(), n); err != nil {
+			t.Fatalf("unable to post %s: %v", status, err)
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("received %d events, want 2", len(got))
+	}
+	for i, action := range []string{"trigger", "resolve"} {
+		e := got[i]
+		if e["event_action"] != action || e["routing_key"] != "R0UT1NGK3Y" || e["dedup_key"] != "pg_prefaulter/replica-1/lag" {
+			t.Errorf("event %d: %v", i, e)
+		}
+
+		payload, _ := e["payload"].(map[string]interface{})
+		summary, _ := payload["summary"].(string)
+		if !strings.Contains(summary, "replica-1 (cluster=orders, role=replica)") {
+			t.Errorf("event %d: labels missing from summary %q", i, summary)
+		}
+		details, _ := payload["custom_details"].(map[string]interface{})
+		want := map[string]interface{}{"cluster": "orders", "role": "replica"}
+		if diff := pretty.Compare(details["labels"], want); diff != "" {
+			t.Errorf("event %d: labels diff: (-got +want)\n%s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// Fetcher retrieves a WAL segment from a WAL archive so that it can be
+// decoded before PostgreSQL's restore_command fetches it.  Segments fetched by
+// a Fetcher are only ever used to find the heap pages that need to be
+// prefaulted and are never handed to PostgreSQL.
+type Fetcher interface {
+	// Name returns the human readable name of the Fetcher.
+	Name() string
+
+	// Fetch copies walFile from the archive to dst.
+	Fetch(ctx context.Context, walFile pg.WALFilename, dst string) error
+}
+
+// PoolAcquirer is implemented by the agent and returns its connection pool to
+// PostgreSQL, which is nil while the agent isn't connected.
+type PoolAcquirer interface {
+	AcquirePool() *pgx.ConnPool
+}
+
+// New returns the Fetcher described by cfg.  A nil Fetcher is returned when
+// archive fetching is disabled.  pools is only used by the SQL fetcher.
+func New(cfg *config.ArchiveConfig, pools PoolAcquirer) (Fetcher, error) {
+	switch cfg.Fetcher {
+	case config.ArchiveFetcherNone:
+		return nil, nil
+	case config.ArchiveFetcherWALG:
+		binPath, err := lookPath(cfg.BinPath, "wal-g")
+		if err != nil {
+			return nil, err
+		}
+		return &walgFetcher{binPath: binPath}, nil
+	case config.ArchiveFetcherPGBackRest:
+		binPath, err := lookPath(cfg.BinPath, "pgbackrest")
+		if err != nil {
+			return nil, err
+		}
+		if cfg.PGBackRestStanza == "" {
+			return nil, errors.New("pgbackrest fetcher requires a stanza")
+		}
+		return &pgBackRestFetcher{binPath: binPath, stanza: cfg.PGBackRestStanza}, nil
+	case config.ArchiveFetcherCommand:
+		if !strings.Contains(cfg.Command, "%f") || !strings.Contains(cfg.Command, "%p") {
+			return nil, fmt.Errorf("archive command must contain %%f and %%p: %q", cfg.Command)
+		}
+		return &commandFetcher{command: cfg.Command}, nil
+	case config.ArchiveFetcherSQL:
+		return &sqlFetcher{pools: pools}, nil
+	default:
+		panic(fmt.Sprintf("unsupported archive fetcher: %v", cfg.Fetcher))
+	}
+}
+
+// lookPath returns binPath if set, otherwise the path of name found in PATH.
+func lookPath(binPath, name string) (string, error) {
+	if binPath != "" {
+		if _, err := os.Stat(binPath); err != nil {
+			return "", errors.Wrapf(err, "unable to stat %s", name)
+		}
+		return binPath, nil
+	}
+
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to find %s", name)
+	}
+
+	return p, nil
+}
+
+// run executes cmd and wraps any failure with its stderr.
+func run(ctx context.Context, cmd *exec.Cmd, name string, walFile pg.WALFilename) error {
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s unable to fetch %s: %q", name, walFile, errbuf.String())
+	}
+
+	if errbuf.Len() > 0 {
+		lib.Logger(ctx).Debug().Str("fetcher", name).Str("walfile", string(walFile)).
+			Str("stderr", errbuf.String()).Msg("archive fetch stderr")
+	}
+
+	return nil
+}
+
+// walgFetcher fetches segments using "wal-g wal-fetch".  wal-g(1) is
+// configured via its environment (e.g. WALG_S3_PREFIX), which is inherited
+// from the agent.
+type walgFetcher struct {
+	binPath string
+}
+
+func (f *walgFetcher) Name() string { return "wal-g" }
+
+func (f *walgFetcher) Fetch(ctx context.Context, walFile pg.WALFilename, dst string) error {
+	cmd := exec.CommandContext(ctx, f.binPath, "wal-fetch", string(walFile), dst)
+	return run(ctx, cmd, f.Name(), walFile)
+}
+
+// pgBackRestFetcher fetches segments using "pgbackrest archive-get".
+type pgBackRestFetcher struct {
+	binPath string
+	stanza  string
+}
+
+func (f *pgBackRestFetcher) Name() string { return "pgbackrest" }
+
+func (f *pgBackRestFetcher) Fetch(ctx context.Context, walFile pg.WALFilename, dst string) error {
+	cmd := exec.CommandContext(ctx, f.binPath, "--stanza="+f.stanza, "archive-get", string(walFile), dst)
+	return run(ctx, cmd, f.Name(), walFile)
+}
+
+// commandFetcher runs a restore_command-style shell command where %f is
+// replaced with the WAL filename and %p with the destination path.
+type commandFetcher struct {
+	command string
+}
+
+func (f *commandFetcher) Name() string { return "command" }
+
+func (f *commandFetcher) Fetch(ctx context.Context, walFile pg.WALFilename, dst string) error {
+	shellCmd := strings.NewReplacer("%f", string(walFile), "%p", dst, "%%", "%").Replace(f.command)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", shellCmd)
+	return run(ctx, cmd, f.Name(), walFile)
+}
+
+// sqlFetcher reads segments from PostgreSQL's own WAL directory with
+// pg_read_binary_file(), for hosts that can reach PostgreSQL but see pg_wal
+// late, partially, or not at all.  The agent's role must be a superuser or, as
+// of PostgreSQL 11, a member of pg_read_server_files.
+type sqlFetcher struct {
+	pools PoolAcquirer
+}
+
+// sqlFetchChunkSize is the most read by a single call to
+// pg_read_binary_file().
+const sqlFetchChunkSize = 1 * units.MiB
+
+// readWALChunkSQL reads $3 bytes at offset $2 of segment $1, or returns NULL if
+// the segment doesn't exist.  The WAL directory was renamed in PostgreSQL 10.
+const readWALChunkSQL = `SELECT pg_read_binary_file(
+	    (CASE WHEN current_setting('server_version_num')::INT >= 100000 THEN 'pg_wal/' ELSE 'pg_xlog/' END) || $1,
+	    $2, $3, true)`
+
+func (f *sqlFetcher) Name() string { return "sql" }
+
+func (f *sqlFetcher) Fetch(ctx context.Context, walFile pg.WALFilename, dst string) error {
+	pool := f.pools.AcquirePool()
+	if pool == nil {
+		return fmt.Errorf("sql unable to fetch %s: not connected to PostgreSQL", walFile)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to create the fetched WAL file")
+	}
+	defer out.Close()
+
+	// A chunk shorter than requested is the end of the segment
+	for offset := int64(0); ; offset += int64(sqlFetchChunkSize) {
+		var chunk pgtype.Bytea
+		if err := pool.QueryRowEx(ctx, readWALChunkSQL, nil, string(walFile), offset, int64(sqlFetchChunkSize)).Scan(&chunk); err != nil {
+			return errors.Wrapf(err, "sql unable to fetch %s", walFile)
+		}
+		if chunk.Status == pgtype.Null {
+			return fmt.Errorf("sql unable to fetch %s: not found", walFile)
+		}
+
+		if _, err := out.Write(chunk.Bytes); err != nil {
+			return errors.Wrap(err, "unable to write the fetched WAL file")
+		}
+		if len(chunk.Bytes) < int(sqlFetchChunkSize) {
+			break
+		}
+	}
+
+	return errors.Wrap(out.Close(), "unable to write the fetched WAL file")
+}
+
+// ScratchPath returns the path inside of scratchDir where walFile is fetched
+// to.
+func ScratchPath(scratchDir string, walFile pg.WALFilename) string {
+	return path.Join(scratchDir, string(walFile))
+}
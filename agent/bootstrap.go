@@ -0,0 +1,226 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/stallhist"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+var (
+	bootstrapSegments = metrics.NewCounter("bootstrap_wal_segments_total", "Number of WAL segments in pg_wal decoded by the bootstrap warmup.")
+	bootstrapBlocks   = metrics.NewCounter("bootstrap_blocks_prefaulted_total", "Number of blocks scheduled for prefaulting by the bootstrap warmup.")
+)
+
+// bootstrapRelation is a relation referenced by the WAL waiting in pg_wal.
+// refs is the number of block references to the relation.
+type bootstrapRelation struct {
+	refs   uint64
+	blocks map[pg.HeapBlockNumber]struct{}
+}
+
+// bootstrapPlan accumulates the blocks referenced by the WAL waiting in pg_wal,
+// grouped by relation.
+type bootstrapPlan map[stallhist.Relation]*bootstrapRelation
+
+// add records a block reference.
+func (p bootstrapPlan) add(key structs.IOCacheKey) {
+	rel := stallhist.RelationOf(key)
+	r, found := p[rel]
+	if !found {
+		r = &bootstrapRelation{blocks: make(map[pg.HeapBlockNumber]struct{})}
+		p[rel] = r
+	}
+
+	r.refs++
+	r.blocks[key.Block] = struct{}{}
+}
+
+// order returns the blocks of the plan in the order they are prefaulted: the
+// relations with the most pending WAL first, and each relation's blocks in
+// ascending order.
+func (p bootstrapPlan) order() []structs.IOCacheKey {
+	rels := make([]stallhist.Relation, 0, len(p))
+	for rel := range p {
+		rels = append(rels, rel)
+	}
+	sort.Slice(rels, func(i, j int) bool {
+		a, b := rels[i], rels[j]
+		if p[a].refs != p[b].refs {
+			return p[a].refs > p[b].refs
+		}
+		if a.Tablespace != b.Tablespace {
+			return a.Tablespace < b.Tablespace
+		}
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Relation < b.Relation
+	})
+
+	var keys []structs.IOCacheKey
+	for _, rel := range rels {
+		blocks := make([]pg.HeapBlockNumber, 0, len(p[rel].blocks))
+		for block := range p[rel].blocks {
+			blocks = append(blocks, block)
+		}
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+
+		for _, block := range blocks {
+			keys = append(keys, structs.IOCacheKey{
+				Tablespace: rel.Tablespace,
+				Database:   rel.Database,
+				Relation:   rel.Relation,
+				Block:      block,
+			})
+		}
+	}
+
+	return keys
+}
+
+// bootstrapWALFiles returns the WAL segments in walDir that recovery, resuming
+// from replayLSN, has yet to replay, in ascending order.  Segments before the
+// one containing replayLSN were already replayed and are skipped along with
+// partial segments, history files, backup labels, and segments whose first
+// page wasn't written for them, i.e. preallocated or recycled segments.
+// replayLSN may be pg.InvalidLSN if it is unknown.
+func bootstrapWALFiles(walDir string, replayLSN pg.LSN) ([]pg.WALFilename, error) {
+	entries, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the WAL directory")
+	}
+
+	var walFiles []pg.WALFilename
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		walFile := pg.WALFilename(entry.Name())
+		_, lsn, err := pg.ParseWalfile(walFile)
+		if err != nil {
+			continue
+		}
+
+		segStart := lsn - pg.LSN(lsn.ByteOffset())
+		if replayLSN != pg.InvalidLSN && segStart.AddBytes(pg.WALSegmentSize) <= replayLSN {
+			continue
+		}
+
+		if !bootstrapValidSegment(path.Join(walDir, entry.Name()), segStart) {
+			continue
+		}
+		walFiles = append(walFiles, walFile)
+	}
+
+	return walFiles, nil
+}
+
+// bootstrapValidSegment returns true if the first page of the WAL segment at
+// filename was written for segStart.
+func bootstrapValidSegment(filename string, segStart pg.LSN) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	hdr := make([]byte, pg.WALPageHeaderSize)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return false
+	}
+
+	return pg.ValidWALPage(hdr, segStart)
+}
+
+// bootstrapReplayLSN returns where recovery resumes from: the replay LSN last
+// observed or, before the database has been queried, the position recorded in
+// pg_control.  pg.InvalidLSN is returned if neither is known.
+func (a *Agent) bootstrapReplayLSN() pg.LSN {
+	a.pgStateLock.RLock()
+	observed := a.recoveryObserved
+	replayLSN := a.lastRecovery.ReplayLSN
+	a.pgStateLock.RUnlock()
+	if observed && replayLSN != pg.InvalidLSN {
+		return replayLSN
+	}
+
+	progress, err := readRecoveryProgress(a.cfg.ControlDataPath, a.cfg.PGData)
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to read recovery progress, decoding all of pg_wal")
+		return pg.InvalidLSN
+	}
+
+	_, lsn := progress.Position()
+	return lsn
+}
+
+// bootstrapWarm prefaults the relations referenced by the WAL already present
+// in pg_wal, e.g. after pg_basebackup(1), before normal operation begins.
+// Decoding reads each segment into the page cache ahead of PostgreSQL, then
+// the referenced blocks are prefaulted with the relations that have the most
+// pending WAL first.
+func (a *Agent) bootstrapWarm() {
+	start := time.Now()
+
+	a.pgStateLock.RLock()
+	walDir := a.walDir
+	a.pgStateLock.RUnlock()
+
+	replayLSN := a.bootstrapReplayLSN()
+	walFiles, err := bootstrapWALFiles(walDir, replayLSN)
+	if err != nil {
+		a.log.Warn().Err(err).Str("wal-directory", walDir).Msg("skipping bootstrap warmup")
+		return
+	}
+
+	plan := make(bootstrapPlan)
+	for _, walFile := range walFiles {
+		if lib.IsShuttingDown(a.shutdownCtx) {
+			return
+		}
+
+		if err := a.walCache.ScanBlocks(a.shutdownCtx, walFile, replayLSN, plan.add); err != nil {
+			a.log.Warn().Err(err).Str("walfile", string(walFile)).Msg("unable to decode WAL file for bootstrap warmup")
+			continue
+		}
+		bootstrapSegments.Inc()
+	}
+
+	keys := plan.order()
+	for _, key := range keys {
+		if !a.prefaultThrottled(key) {
+			return
+		}
+		bootstrapBlocks.Inc()
+
+		if a.indexCache != nil {
+			a.indexCache.Observe(key)
+		}
+	}
+
+	a.log.Info().Int("segments", len(walFiles)).Int("relations", len(plan)).
+		Int("blocks", len(keys)).Dur("duration", time.Since(start)).Msg("finished bootstrap warmup")
+}
@@ -0,0 +1,122 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestBootstrapPlan(t *testing.T) {
+	rel := func(relation pg.OID, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: relation, Block: block}
+	}
+
+	plan := make(bootstrapPlan)
+	for _, key := range []structs.IOCacheKey{
+		rel(16390, 4),
+		rel(16385, 9),
+		rel(16385, 2),
+		rel(16385, 9),
+		rel(16400, 1),
+		rel(16390, 4),
+	} {
+		plan.add(key)
+	}
+
+	// 16385 has three pending references, 16390 two, and 16400 one.
+	want := []structs.IOCacheKey{
+		rel(16385, 2), rel(16385, 9),
+		rel(16390, 4),
+		rel(16400, 1),
+	}
+	if diff := pretty.Compare(plan.order(), want); diff != "" {
+		t.Fatalf("order diff: (-got +want)\n%s", diff)
+	}
+}
+
+func TestBootstrapWALFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootstrap")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// header returns the first page header of a segment written for the
+	// segment starting at segStart.
+	header := func(segStart pg.LSN) []byte {
+		hdr := make([]byte, pg.WALPageHeaderSize)
+		binary.LittleEndian.PutUint16(hdr, 0xD101)
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(segStart))
+		return hdr
+	}
+
+	for name, buf := range map[string][]byte{
+		"000000010000000000000003": header(pg.MustParseLSN("0/3000000")),
+		"000000010000000000000002": header(pg.MustParseLSN("0/2000000")),
+		"000000010000000000000001": header(pg.MustParseLSN("0/1000000")),
+		// Recycled from 0/1000000 and preallocated
+		"000000010000000000000005":                 header(pg.MustParseLSN("0/1000000")),
+		"000000010000000000000006":                 make([]byte, pg.WALPageHeaderSize),
+		"000000010000000000000004.partial":         nil,
+		"00000002.history":                         nil,
+		"000000010000000000000002.00000028.backup": nil,
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, name), buf, 0600); err != nil {
+			t.Fatalf("unable to create %s: %v", name, err)
+		}
+	}
+	if err := os.Mkdir(path.Join(dir, "archive_status"), 0700); err != nil {
+		t.Fatalf("unable to create archive_status: %v", err)
+	}
+
+	tests := []struct {
+		replayLSN pg.LSN
+		walFiles  []pg.WALFilename
+	}{
+		{ // 0
+			replayLSN: pg.InvalidLSN,
+			walFiles:  []pg.WALFilename{"000000010000000000000001", "000000010000000000000002", "000000010000000000000003"},
+		},
+		{ // 1
+			replayLSN: pg.MustParseLSN("0/2000028"),
+			walFiles:  []pg.WALFilename{"000000010000000000000002", "000000010000000000000003"},
+		},
+		{ // 2
+			replayLSN: pg.MustParseLSN("0/3000000"),
+			walFiles:  []pg.WALFilename{"000000010000000000000003"},
+		},
+	}
+
+	for n, test := range tests {
+		walFiles, err := bootstrapWALFiles(dir, test.replayLSN)
+		if err != nil {
+			t.Fatalf("%d: unable to list WAL files: %v", n, err)
+		}
+		if diff := pretty.Compare(walFiles, test.walFiles); diff != "" {
+			t.Fatalf("%d: WAL files diff: (-got +want)\n%s", n, diff)
+		}
+	}
+
+	if _, err := bootstrapWALFiles(path.Join(dir, "missing"), pg.InvalidLSN); err == nil {
+		t.Fatalf("expected a missing WAL directory to fail")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+var (
+	bufferCacheSnapshots = metrics.NewCounter("buffercache_snapshots_total", "Number of snapshots of the primary's shared buffers.")
+	bufferCacheFailures  = metrics.NewCounter("buffercache_snapshot_failures_total", "Number of snapshots of the primary's shared buffers that failed.")
+	bufferCacheBlocks    = metrics.NewCounter("buffercache_blocks_total", "Number of blocks in the primary's shared buffers prefaulted.")
+)
+
+// runBufferCacheMirror periodically prefaults the blocks in the primary's
+// shared buffers.  The first snapshot is taken immediately so that a rebuilt
+// follower starts warming the primary's working set right away.
+func (a *Agent) runBufferCacheMirror() {
+	ticker := time.NewTicker(a.cfg.BufferCacheInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.mirrorBufferCache(); err != nil {
+			bufferCacheFailures.Inc()
+			a.log.Warn().Err(err).Msg("unable to mirror the primary's shared buffers")
+		}
+
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mirrorBufferCache prefaults the blocks in the primary's shared buffers once.
+// Nothing is prefaulted unless this database is a follower.  The snapshot uses
+// its own connection, separate from the connection to the upstream.
+func (a *Agent) mirrorBufferCache() error {
+	a.pgStateLock.RLock()
+	state := a.lastDBState
+	a.pgStateLock.RUnlock()
+	if state != _DBStateFollower || a.isDraining() {
+		return nil
+	}
+
+	connConfig, err := pgx.ParseConnectionString(a.cfg.BufferCacheConninfo)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse the primary's conninfo")
+	}
+
+	poolConfig := *a.poolConfig
+	poolConfig.ConnConfig = a.poolConfig.ConnConfig.Merge(connConfig)
+	poolConfig.MaxConnections = 1
+	// The primary's version and query overrides are of no interest.
+	poolConfig.AfterConnect = nil
+	pool, err := newConnPool(poolConfig, a.cfg.DBConnectTimeout)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to the primary")
+	}
+	defer pool.Close()
+
+	bufferCacheSnapshots.Inc()
+	start := time.Now()
+	var prefaulted uint64
+	n, err := pg.QueryBufferCache(a.shutdownCtx, pool, func(b pg.BufferCacheBlock) {
+		if a.prefaultThrottled(structs.IOCacheKey{
+			Tablespace: b.Tablespace,
+			Database:   b.Database,
+			Relation:   b.Relation,
+			Block:      b.Block,
+		}) {
+			prefaulted++
+		}
+	})
+	bufferCacheBlocks.Add(prefaulted)
+	if err != nil {
+		return err
+	}
+
+	a.log.Debug().Str("primary-host", connConfig.Host).Uint64("blocks", n).Uint64("prefaulted", prefaulted).
+		Dur("duration", time.Since(start)).Msg("mirrored the primary's shared buffers")
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/bschofield/pg_prefaulter/agent/fhcache"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/sandbox"
+	"github.com/bschofield/pg_prefaulter/agent/sched"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// Optional features compiled into the agent, depending on the platform.
+const (
+	// FeatureMapPopulate is the mmap prefault backend populating mappings with
+	// MAP_POPULATE.
+	FeatureMapPopulate = "map-populate"
+
+	// FeatureSandbox is the IO workers being sandboxed, with seccomp-bpf on
+	// Linux or capsicum(4) on FreeBSD.
+	FeatureSandbox = "sandbox"
+
+	// FeatureThreadPriorities is the IO workers' nice(1) and ionice(1)
+	// priorities.
+	FeatureThreadPriorities = "thread-priorities"
+)
+
+// BuildInfo describes how the agent was built and what it is capable of.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	Tag       string `json:"tag"`
+	GoVersion string `json:"go-version"`
+	Platform  string `json:"platform"`
+
+	// PostgreSQLVersions are the major versions of PostgreSQL whose WAL is
+	// understood.  WALDecoders are the programs WAL is decoded with, WAL is
+	// never decoded by the agent itself.
+	PostgreSQLVersions []string `json:"postgresql-versions"`
+	WALDecoders        []string `json:"wal-decoders"`
+
+	PrefaultBackends []string `json:"prefault-backends"`
+	Features         []string `json:"features"`
+}
+
+// Build returns the BuildInfo of the running binary.
+func Build() BuildInfo {
+	b := BuildInfo{
+		Version:          buildtime.VERSION,
+		Commit:           buildtime.COMMIT,
+		Date:             buildtime.DATE,
+		Tag:              buildtime.TAG,
+		GoVersion:        runtime.Version(),
+		Platform:         runtime.GOOS + "/" + runtime.GOARCH,
+		WALDecoders:      []string{"pg_waldump", "pg_xlogdump"},
+		PrefaultBackends: config.AvailablePrefaultBackends(),
+		Features:         []string{},
+	}
+
+	for _, v := range pg.SupportedVersions() {
+		b.PostgreSQLVersions = append(b.PostgreSQLVersions, pg.MajorVersionString(v))
+	}
+
+	if fhcache.MmapPopulates {
+		b.Features = append(b.Features, FeatureMapPopulate)
+	}
+	if sandbox.Supported {
+		b.Features = append(b.Features, FeatureSandbox)
+	}
+	if sched.Supported {
+		b.Features = append(b.Features, FeatureThreadPriorities)
+	}
+
+	return b
+}
+
+// registerBuildInfo exports the BuildInfo as the labels of a build_info gauge
+// that is always 1.  Lists are comma separated.
+func registerBuildInfo() {
+	b := Build()
+	metrics.NewGauge("build_info", "Always 1, labeled with the version of "+buildtime.PROGNAME+" and the features it was built with.",
+		metrics.Label{Name: "version", Value: b.Version},
+		metrics.Label{Name: "commit", Value: b.Commit},
+		metrics.Label{Name: "tag", Value: b.Tag},
+		metrics.Label{Name: "goversion", Value: b.GoVersion},
+		metrics.Label{Name: "platform", Value: b.Platform},
+		metrics.Label{Name: "postgresql_versions", Value: strings.Join(b.PostgreSQLVersions, ",")},
+		metrics.Label{Name: "wal_decoders", Value: strings.Join(b.WALDecoders, ",")},
+		metrics.Label{Name: "prefault_backends", Value: strings.Join(b.PrefaultBackends, ",")},
+		metrics.Label{Name: "features", Value: strings.Join(b.Features, ",")},
+	).Set(1)
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/config"
+)
+
+func TestRegisterBuildInfo(t *testing.T) {
+	registerBuildInfo()
+
+	b := Build()
+	if len(b.PostgreSQLVersions) == 0 || b.PostgreSQLVersions[0] != "9.6" {
+		t.Fatalf("postgresql versions %v, want 9.6 first", b.PostgreSQLVersions)
+	}
+	if b.PrefaultBackends[0] != config.PrefaultBackendPread {
+		t.Fatalf("prefault backends %v, want %s first", b.PrefaultBackends, config.PrefaultBackendPread)
+	}
+
+	for _, s := range metrics.DefaultRegistry.Snapshot() {
+		if s.Name != metrics.Namespace+"_build_info" {
+			continue
+		}
+		if s.Value != 1 {
+			t.Fatalf("build_info is %v, want 1", s.Value)
+		}
+
+		labels := make(map[string]string)
+		for _, l := range s.Labels {
+			labels[l.Name] = l.Value
+		}
+		if labels["platform"] != b.Platform || labels["postgresql_versions"] == "" || labels["prefault_backends"] == "" {
+			t.Fatalf("build_info labels %v", labels)
+		}
+		return
+	}
+
+	t.Fatal("build_info not registered")
+}
@@ -0,0 +1,175 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+)
+
+// CacheStatus describes the capacity, TTL, and effectiveness of one of the
+// agent's caches.  TTL is omitted for caches whose entries don't expire.  The
+// counters are totals since the agent started.
+type CacheStatus struct {
+	Size      int     `json:"size"`
+	TTL       string  `json:"ttl,omitempty"`
+	Entries   int     `json:"entries"`
+	Lookups   uint64  `json:"lookups"`
+	Hits      uint64  `json:"hits"`
+	Evictions uint64  `json:"evictions"`
+	HitRatio  float64 `json:"hit-ratio"`
+}
+
+// CacheTuning changes the capacity and TTL of one of the agent's caches.  Unset
+// fields are left unchanged.
+type CacheTuning struct {
+	Size int    `json:"size,omitempty"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+// tunableCache is implemented by the caches whose capacity can be changed at
+// runtime.
+type tunableCache interface {
+	Size() int
+	Resize(size int) error
+	Statistics() lib.CacheStatistics
+}
+
+// expiringCache is implemented by the caches whose TTL can also be changed at
+// runtime.
+type expiringCache interface {
+	tunableCache
+	TTL() time.Duration
+	SetTTL(ttl time.Duration) error
+}
+
+// caches returns the agent's running caches by name.
+func (a *Agent) caches() map[string]tunableCache {
+	caches := make(map[string]tunableCache, 3)
+	if a.ioCache != nil {
+		caches["iocache"] = a.ioCache
+	}
+	if a.fileHandleCache != nil {
+		caches["fhcache"] = a.fileHandleCache
+	}
+	if a.walCache != nil {
+		caches["walcache"] = a.walCache
+	}
+
+	return caches
+}
+
+// cacheStatus returns the current capacity and TTL of the agent's caches.
+func (a *Agent) cacheStatus() map[string]CacheStatus {
+	caches := a.caches()
+	status := make(map[string]CacheStatus, len(caches))
+	for name, c := range caches {
+		stats := c.Statistics()
+		s := CacheStatus{
+			Size:      c.Size(),
+			Entries:   stats.Entries,
+			Lookups:   stats.Lookups(),
+			Hits:      stats.Hits,
+			Evictions: stats.Evictions,
+			HitRatio:  stats.HitRatio(),
+		}
+		if ec, ok := c.(expiringCache); ok {
+			s.TTL = ec.TTL().String()
+		}
+		status[name] = s
+	}
+
+	return status
+}
+
+// registerCacheMetrics exports the statistics of the agent's caches, labeled
+// by cache name.
+func (a *Agent) registerCacheMetrics() {
+	r := metrics.DefaultRegistry
+	for name, c := range a.caches() {
+		c := c
+		label := metrics.Label{Name: "cache", Value: name}
+
+		r.CounterFunc("cache_lookups_total", "Number of cache lookups.",
+			func() float64 { return float64(c.Statistics().Lookups()) }, label)
+		r.CounterFunc("cache_hits_total", "Number of cache lookups that found an entry.",
+			func() float64 { return float64(c.Statistics().Hits) }, label)
+		r.CounterFunc("cache_evictions_total", "Number of entries evicted from the cache, including expired entries.",
+			func() float64 { return float64(c.Statistics().Evictions) }, label)
+		r.GaugeFunc("cache_hit_ratio", "Ratio of cache hits to lookups since the agent started.",
+			func() float64 { return c.Statistics().HitRatio() }, label)
+		r.GaugeFunc("cache_entries", "Number of entries in the cache.",
+			func() float64 { return float64(c.Statistics().Entries) }, label)
+		r.GaugeFunc("cache_capacity", "Maximum number of entries in the cache.",
+			func() float64 { return float64(c.Size()) }, label)
+	}
+}
+
+// tuneCaches applies tunings, keyed by cache name.  Every tuning is validated
+// before any is applied.  Existing entries are kept wherever they still fit.
+func (a *Agent) tuneCaches(tunings map[string]CacheTuning) error {
+	caches := a.caches()
+
+	names := make([]string, 0, len(tunings))
+	ttls := make(map[string]time.Duration, len(tunings))
+	for name, t := range tunings {
+		c, found := caches[name]
+		if !found {
+			return fmt.Errorf("unknown cache %q", name)
+		}
+		if t.Size < 0 {
+			return fmt.Errorf("%s: size must be at least 1 (%d)", name, t.Size)
+		}
+		if t.TTL != "" {
+			if _, ok := c.(expiringCache); !ok {
+				return fmt.Errorf("%s: entries do not expire", name)
+			}
+
+			ttl, err := time.ParseDuration(t.TTL)
+			if err != nil {
+				return errors.Wrapf(err, "%s: invalid ttl", name)
+			}
+			if ttl <= 0 {
+				return fmt.Errorf("%s: ttl must be positive (%s)", name, ttl)
+			}
+			ttls[name] = ttl
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := caches[name]
+		if ttl, found := ttls[name]; found {
+			if err := c.(expiringCache).SetTTL(ttl); err != nil {
+				return errors.Wrapf(err, "%s: unable to change ttl", name)
+			}
+			a.log.Info().Str("cache", name).Dur("ttl", ttl).Msg("changed cache ttl")
+		}
+
+		if size := tunings[name].Size; size > 0 && size != c.Size() {
+			if err := c.Resize(size); err != nil {
+				return errors.Wrapf(err, "%s: unable to resize", name)
+			}
+			a.log.Info().Str("cache", name).Int("size", size).Msg("resized cache")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cgroup reads the IO limits the cgroup v2 io controller imposes on the
+// agent.  A process exceeding its cgroup's io.max is throttled by the kernel,
+// which delays every IO issued from the cgroup, including PostgreSQL's when the
+// two share a cgroup.
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// procSelf and sysDevBlock are the locations of the calling process'
+	// /proc directory and the block devices in sysfs.
+	procSelf    = "/proc/self"
+	sysDevBlock = "/sys/dev/block"
+)
+
+// IOLimit is a device's read limits in io.max.  Zero is unlimited.
+type IOLimit struct {
+	ReadBPS  uint64
+	ReadIOPS uint64
+}
+
+// ReadIOMax returns the read limits that apply to the calling process, keyed by
+// device number.  Limits are inherited, so the tightest limit set by the
+// process' cgroup or any of its ancestors is returned.  ReadIOMax returns an
+// empty map when the process is not in a cgroup v2 hierarchy.
+func ReadIOMax() (map[uint64]IOLimit, error) {
+	limits := make(map[uint64]IOLimit)
+
+	mount, err := mountPoint()
+	if err != nil || mount == "" {
+		return limits, err
+	}
+
+	cgroup, err := cgroupPath()
+	if err != nil || cgroup == "" {
+		return limits, err
+	}
+
+	for dir := filepath.Join(mount, cgroup); ; dir = filepath.Dir(dir) {
+		parsed, err := readIOMax(filepath.Join(dir, "io.max"))
+		if err != nil {
+			return nil, err
+		}
+		for dev, l := range parsed {
+			limits[dev] = tightest(limits[dev], l)
+		}
+
+		if dir == mount || !strings.HasPrefix(dir, mount) {
+			break
+		}
+	}
+
+	return limits, nil
+}
+
+// Disk returns the device number of the disk containing dev, which io.max
+// limits are set on, or dev if dev is not a partition.
+func Disk(dev uint64) uint64 {
+	sysDev, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))))
+	if err != nil {
+		return dev
+	}
+	if _, err := os.Stat(filepath.Join(sysDev, "partition")); err != nil {
+		return dev
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(filepath.Dir(sysDev), "dev"))
+	if err != nil {
+		return dev
+	}
+	disk, err := parseDevice(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return dev
+	}
+
+	return disk
+}
+
+// readIOMax reads the io.max file at p, which only exists in non-root cgroups
+// with the io controller enabled.
+func readIOMax(p string) (map[uint64]IOLimit, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open io.max")
+	}
+	defer f.Close()
+
+	limits, err := parseIOMax(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s", p)
+	}
+
+	return limits, nil
+}
+
+// mountPoint returns where the cgroup v2 hierarchy is mounted, or an empty
+// string if it isn't.
+func mountPoint() (string, error) {
+	f, err := os.Open(filepath.Join(procSelf, "mountinfo"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "unable to open mountinfo")
+	}
+	defer f.Close()
+
+	// 35 24 0:30 / /sys/fs/cgroup rw,nosuid shared:9 - cgroup2 cgroup2 rw
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+
+	return "", s.Err()
+}
+
+// cgroupPath returns the process' cgroup relative to the cgroup v2 mount point,
+// or an empty string if it isn't in one.
+func cgroupPath() (string, error) {
+	f, err := os.Open(filepath.Join(procSelf, "cgroup"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "unable to open cgroup")
+	}
+	defer f.Close()
+
+	// The cgroup v2 hierarchy has ID 0 and no controllers: 0::/system.slice
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "0::") {
+			return strings.TrimPrefix(s.Text(), "0::"), nil
+		}
+	}
+
+	return "", s.Err()
+}
+
+// parseIOMax parses an io.max file, e.g.:
+//
+// 8:16 rbps=2097152 wbps=max riops=max wiops=120
+func parseIOMax(r io.Reader) (map[uint64]IOLimit, error) {
+	limits := make(map[uint64]IOLimit)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		dev, err := parseDevice(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		var l IOLimit
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid limit %q", field)
+			}
+			if kv[1] == "max" {
+				continue
+			}
+
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid limit %q", field)
+			}
+			switch kv[0] {
+			case "rbps":
+				l.ReadBPS = v
+			case "riops":
+				l.ReadIOPS = v
+			}
+		}
+		limits[dev] = l
+	}
+
+	return limits, s.Err()
+}
+
+// parseDevice parses a MAJ:MIN device number.
+func parseDevice(s string) (uint64, error) {
+	var major, minor uint32
+	if _, err := fmt.Sscanf(s, "%d:%d", &major, &minor); err != nil {
+		return 0, errors.Wrapf(err, "invalid device %q", s)
+	}
+
+	return unix.Mkdev(major, minor), nil
+}
+
+// tightest returns the lower of each of a's and b's limits.
+func tightest(a, b IOLimit) IOLimit {
+	min := func(x, y uint64) uint64 {
+		switch {
+		case x == 0:
+			return y
+		case y == 0, x < y:
+			return x
+		default:
+			return y
+		}
+	}
+
+	return IOLimit{
+		ReadBPS:  min(a.ReadBPS, b.ReadBPS),
+		ReadIOPS: min(a.ReadIOPS, b.ReadIOPS),
+	}
+}
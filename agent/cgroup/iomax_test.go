@@ -0,0 +1,95 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadIOMax(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(p, s string) { procSelf, sysDevBlock = p, s }(procSelf, sysDevBlock)
+	procSelf = filepath.Join(root, "proc/self")
+	sysDevBlock = filepath.Join(root, "sys/dev/block")
+	mount := filepath.Join(root, "sys/fs/cgroup")
+
+	// The service's limits are tightened by its slice's
+	files := map[string]string{
+		"proc/self/mountinfo": "24 1 0:22 / /sys rw - sysfs sysfs rw\n" +
+			"35 24 0:30 / " + mount + " rw,nosuid shared:9 - cgroup2 cgroup2 rw\n",
+		"proc/self/cgroup":                                    "0::/db.slice/pg_prefaulter.service\n",
+		"sys/fs/cgroup/db.slice/io.max":                       "8:0 rbps=104857600 wbps=max riops=1000 wiops=max\n259:0 rbps=max wbps=max riops=5000 wiops=max\n",
+		"sys/fs/cgroup/db.slice/pg_prefaulter.service/io.max": "8:0 rbps=max wbps=max riops=2000 wiops=max\n8:16 rbps=max wbps=1048576 riops=max wiops=max\n",
+	}
+	for p, contents := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limits, err := ReadIOMax()
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	want := map[uint64]IOLimit{
+		unix.Mkdev(8, 0):   {ReadBPS: 104857600, ReadIOPS: 1000},
+		unix.Mkdev(8, 16):  {},
+		unix.Mkdev(259, 0): {ReadIOPS: 5000},
+	}
+	if diff := pretty.Compare(limits, want); diff != "" {
+		t.Fatalf("limits diff: (-got +want)\n%s", diff)
+	}
+
+	// Partitions are limited by their disk
+	sda := filepath.Join(root, "sys/devices/sda")
+	if err := os.MkdirAll(filepath.Join(sda, "sda1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for p, contents := range map[string]string{"dev": "8:0\n", "sda1/dev": "8:1\n", "sda1/partition": "1\n"} {
+		if err := ioutil.WriteFile(filepath.Join(sda, p), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(sysDevBlock, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for dev, target := range map[string]string{"8:0": sda, "8:1": filepath.Join(sda, "sda1")} {
+		if err := os.Symlink(target, filepath.Join(sysDevBlock, dev)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if disk := Disk(unix.Mkdev(8, 1)); disk != unix.Mkdev(8, 0) {
+		t.Fatalf("disk of 8:1 is %d:%d", unix.Major(disk), unix.Minor(disk))
+	}
+	if disk := Disk(unix.Mkdev(8, 0)); disk != unix.Mkdev(8, 0) {
+		t.Fatalf("disk of 8:0 is %d:%d", unix.Major(disk), unix.Minor(disk))
+	}
+}
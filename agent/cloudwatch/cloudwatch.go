@@ -0,0 +1,256 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloudwatch publishes the agent's metrics to Amazon CloudWatch.
+package cloudwatch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxMetricData is the number of metrics sent per PutMetricData request.
+	maxMetricData = 20
+
+	apiVersion = "2010-08-01"
+	service    = "monitoring"
+)
+
+// Publisher publishes a subset of the agent's metrics to CloudWatch.  Gauges
+// are published as they are.  Counters are published as their rate per second
+// since the previous publication, named with a "_per_second" suffix in place
+// of "_total".  Each metric's labels are added to the configured dimensions.
+type Publisher struct {
+	cfg    *config.CloudWatchConfig
+	client *http.Client
+	creds  *credentialSource
+	wanted map[string]bool
+
+	// endpoint, if set, replaces the regional CloudWatch endpoint.
+	endpoint string
+
+	// now is replaced in tests.
+	now func() time.Time
+
+	lock     sync.Mutex
+	region   string
+	counters map[string]counterValue
+}
+
+// counterValue is a counter's value when it was last published.
+type counterValue struct {
+	value float64
+	at    time.Time
+}
+
+// datum is a single metric sent to CloudWatch.
+type datum struct {
+	name       string
+	unit       string
+	value      float64
+	dimensions []metrics.Label
+}
+
+// New creates a new Publisher.
+func New(cfg *config.CloudWatchConfig) *Publisher {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	wanted := make(map[string]bool, len(cfg.Metrics))
+	for _, name := range cfg.Metrics {
+		wanted[metrics.Namespace+"_"+name] = true
+	}
+
+	return &Publisher{
+		cfg:    cfg,
+		client: client,
+		creds: &credentialSource{
+			client:      client,
+			metadataURL: defaultMetadataURL,
+		},
+		wanted:   wanted,
+		now:      time.Now,
+		region:   cfg.Region,
+		counters: make(map[string]counterValue),
+	}
+}
+
+// Name identifies the Publisher in logs.
+func (p *Publisher) Name() string {
+	return "cloudwatch"
+}
+
+// Publish sends the configured metrics among samples to CloudWatch.
+func (p *Publisher) Publish(ctx context.Context, samples []metrics.Sample) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+	data := p.data(samples, now)
+	if len(data) == 0 {
+		return nil
+	}
+
+	if p.region == "" {
+		region, err := p.creds.region(ctx)
+		if err != nil {
+			return err
+		}
+		p.region = region
+	}
+
+	creds, err := p.creds.get(ctx, now)
+	if err != nil {
+		return errors.Wrap(err, "unable to find AWS credentials")
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxMetricData {
+			n = maxMetricData
+		}
+		if err := p.put(ctx, creds, data[:n], now); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// data selects the configured metrics from samples and converts counters to
+// rates.  A counter is first published once its rate can be computed.
+func (p *Publisher) data(samples []metrics.Sample, now time.Time) []datum {
+	var data []datum
+	for _, s := range samples {
+		if !p.wanted[s.Name] {
+			continue
+		}
+
+		d := datum{
+			name:       strings.TrimPrefix(s.Name, metrics.Namespace+"_"),
+			value:      s.Value,
+			dimensions: p.dimensions(s.Labels),
+		}
+
+		switch s.Type {
+		case metrics.TypeCounter:
+			key := s.Name + fmt.Sprint(s.Labels)
+			prev, found := p.counters[key]
+			p.counters[key] = counterValue{value: s.Value, at: now}
+
+			elapsed := now.Sub(prev.at).Seconds()
+			if !found || elapsed <= 0 || s.Value < prev.value {
+				continue
+			}
+
+			d.name = strings.TrimSuffix(d.name, "_total") + "_per_second"
+			d.unit = "Count/Second"
+			d.value = (s.Value - prev.value) / elapsed
+		default:
+			d.unit = unit(d.name)
+		}
+
+		data = append(data, d)
+	}
+
+	return data
+}
+
+// dimensions returns the configured dimensions and labels, sorted by name.
+func (p *Publisher) dimensions(labels []metrics.Label) []metrics.Label {
+	dims := make([]metrics.Label, 0, len(p.cfg.Dimensions)+len(labels))
+	for name, value := range p.cfg.Dimensions {
+		dims = append(dims, metrics.Label{Name: name, Value: value})
+	}
+	dims = append(dims, labels...)
+	sort.Slice(dims, func(i, j int) bool { return dims[i].Name < dims[j].Name })
+
+	return dims
+}
+
+// unit returns the CloudWatch unit of a gauge, based on the suffix of its name.
+func unit(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_bytes"):
+		return "Bytes"
+	case strings.HasSuffix(name, "_seconds"):
+		return "Seconds"
+	default:
+		return "None"
+	}
+}
+
+// put sends data to CloudWatch in a single PutMetricData request.
+func (p *Publisher) put(ctx context.Context, creds credentials, data []datum, now time.Time) error {
+	form := url.Values{}
+	form.Set("Action", "PutMetricData")
+	form.Set("Version", apiVersion)
+	form.Set("Namespace", p.cfg.Namespace)
+	for i, d := range data {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"MetricName", d.name)
+		form.Set(prefix+"Unit", d.unit)
+		form.Set(prefix+"Value", strconv.FormatFloat(d.value, 'g', -1, 64))
+		form.Set(prefix+"Timestamp", now.UTC().Format(time.RFC3339))
+		for j, dim := range d.dimensions {
+			dimPrefix := prefix + "Dimensions.member." + strconv.Itoa(j+1) + "."
+			form.Set(dimPrefix+"Name", dim.Name)
+			form.Set(dimPrefix+"Value", dim.Value)
+		}
+	}
+	body := []byte(form.Encode())
+
+	endpoint := p.endpoint
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + p.region + ".amazonaws.com/"
+		if strings.HasPrefix(p.region, "cn-") {
+			endpoint = "https://" + service + "." + p.region + ".amazonaws.com.cn/"
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to create PutMetricData request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sign(req, body, creds, p.region, service, now)
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "unable to publish metrics to CloudWatch")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("CloudWatch returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudwatch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestPublish(t *testing.T) {
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		if v, found := os.LookupEnv(env); found {
+			defer os.Setenv(env, v)
+		}
+		os.Unsetenv(env)
+	}
+
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("session"))
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/placement/region":
+			w.Write([]byte("eu-west-1"))
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("replica\n"))
+		case "/latest/meta-data/iam/security-credentials/replica":
+			w.Write([]byte(`{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"token","Expiration":"2099-01-01T00:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer imds.Close()
+
+	var requests []url.Values
+	var auth []string
+	cw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, r.PostForm)
+		auth = append(auth, r.Header.Get("Authorization"), r.Header.Get("X-Amz-Security-Token"))
+	}))
+	defer cw.Close()
+
+	p := New(&config.CloudWatchConfig{
+		Namespace:  "pg_prefaulter",
+		Dimensions: map[string]string{"Cluster": "orders"},
+		Metrics:    []string{"lag_bytes", "prefault_pages_total"},
+	})
+	p.creds.metadataURL = imds.URL
+	p.endpoint = cw.URL
+
+	start := time.Date(2019, 3, 5, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return start }
+
+	r := metrics.NewRegistry()
+	lag := r.Gauge("lag_bytes", "Lag.")
+	pages := r.Counter("prefault_pages_total", "Pages.")
+	r.Gauge("io_workers", "Workers.").Set(4)
+
+	// The counter's rate is unknown after the first snapshot.
+	lag.Set(1024)
+	pages.Add(100)
+	if err := p.Publish(context.Background(), r.Snapshot()); err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	p.now = func() time.Time { return start.Add(10 * time.Second) }
+	pages.Add(50)
+	if err := p.Publish(context.Background(), r.Snapshot()); err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(requests))
+	}
+
+	want := []url.Values{
+		{
+			"Action":                         {"PutMetricData"},
+			"Version":                        {"2010-08-01"},
+			"Namespace":                      {"pg_prefaulter"},
+			"MetricData.member.1.MetricName": {"lag_bytes"},
+			"MetricData.member.1.Unit":       {"Bytes"},
+			"MetricData.member.1.Value":      {"1024"},
+			"MetricData.member.1.Timestamp":  {"2019-03-05T12:00:00Z"},
+			"MetricData.member.1.Dimensions.member.1.Name":  {"Cluster"},
+			"MetricData.member.1.Dimensions.member.1.Value": {"orders"},
+		},
+		{
+			"Action":                         {"PutMetricData"},
+			"Version":                        {"2010-08-01"},
+			"Namespace":                      {"pg_prefaulter"},
+			"MetricData.member.1.MetricName": {"lag_bytes"},
+			"MetricData.member.1.Unit":       {"Bytes"},
+			"MetricData.member.1.Value":      {"1024"},
+			"MetricData.member.1.Timestamp":  {"2019-03-05T12:00:10Z"},
+			"MetricData.member.1.Dimensions.member.1.Name":  {"Cluster"},
+			"MetricData.member.1.Dimensions.member.1.Value": {"orders"},
+			"MetricData.member.2.MetricName":                {"prefault_pages_per_second"},
+			"MetricData.member.2.Unit":                      {"Count/Second"},
+			"MetricData.member.2.Value":                     {"5"},
+			"MetricData.member.2.Timestamp":                 {"2019-03-05T12:00:10Z"},
+			"MetricData.member.2.Dimensions.member.1.Name":  {"Cluster"},
+			"MetricData.member.2.Dimensions.member.1.Value": {"orders"},
+		},
+	}
+	if diff := pretty.Compare(requests, want); diff != "" {
+		t.Fatalf("requests diff: (-got +want)\n%s", diff)
+	}
+
+	if !strings.HasPrefix(auth[0], "AWS4-HMAC-SHA256 Credential=AKID/20190305/eu-west-1/monitoring/aws4_request, ") {
+		t.Fatalf("unexpected Authorization: %s", auth[0])
+	}
+	if auth[1] != "token" {
+		t.Fatalf("unexpected X-Amz-Security-Token: %s", auth[1])
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudwatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultMetadataURL is the EC2 instance metadata service (IMDSv2).
+	defaultMetadataURL = "http://169.254.169.254"
+
+	// metadataTokenTTL is how long an IMDSv2 session token is requested for.
+	metadataTokenTTL = "21600"
+
+	// credentialsExpiryWindow is how long before they expire instance profile
+	// credentials are refreshed.
+	credentialsExpiryWindow = 5 * time.Minute
+)
+
+// credentials sign requests to AWS.
+type credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expires         time.Time
+}
+
+// credentialSource returns the credentials in the environment
+// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN) or, failing
+// that, the credentials of the EC2 instance profile.
+type credentialSource struct {
+	client      *http.Client
+	metadataURL string
+
+	lock   sync.Mutex
+	cached credentials
+}
+
+func (c *credentialSource) get(ctx context.Context, now time.Time) (credentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return credentials{
+			accessKeyID:     id,
+			secretAccessKey: secret,
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cached.accessKeyID != "" && now.Add(credentialsExpiryWindow).Before(c.cached.expires) {
+		return c.cached, nil
+	}
+
+	token, err := c.metadataToken(ctx)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	roles, err := c.metadata(ctx, token, "/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return credentials{}, errors.Wrap(err, "unable to find the instance profile")
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return credentials{}, errors.New("no instance profile attached")
+	}
+
+	doc, err := c.metadata(ctx, token, "/latest/meta-data/iam/security-credentials/"+role)
+	if err != nil {
+		return credentials{}, errors.Wrapf(err, "unable to get the credentials of instance profile %q", role)
+	}
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(doc, &creds); err != nil {
+		return credentials{}, errors.Wrapf(err, "unable to parse the credentials of instance profile %q", role)
+	}
+
+	c.cached = credentials{
+		accessKeyID:     creds.AccessKeyID,
+		secretAccessKey: creds.SecretAccessKey,
+		sessionToken:    creds.Token,
+		expires:         creds.Expiration,
+	}
+
+	return c.cached, nil
+}
+
+// region returns the region of the EC2 instance.
+func (c *credentialSource) region(ctx context.Context) (string, error) {
+	token, err := c.metadataToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	region, err := c.metadata(ctx, token, "/latest/meta-data/placement/region")
+	if err != nil {
+		return "", errors.Wrap(err, "unable to determine the instance's region")
+	}
+
+	return strings.TrimSpace(string(region)), nil
+}
+
+// metadataToken starts an IMDSv2 session.
+func (c *credentialSource) metadataToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, c.metadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create instance metadata request")
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", metadataTokenTTL)
+
+	token, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to start an instance metadata session")
+	}
+
+	return string(token), nil
+}
+
+func (c *credentialSource) metadata(ctx context.Context, token, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.metadataURL+path, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create instance metadata request")
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+
+	return c.do(req.WithContext(ctx))
+}
+
+func (c *credentialSource) do(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance metadata service returned %s", resp.Status)
+	}
+
+	return body, nil
+}
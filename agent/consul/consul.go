@@ -0,0 +1,226 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+)
+
+// Health is the agent's progress as reported to Consul.
+type Health struct {
+	Role     string
+	Ready    bool
+	LastScan time.Time
+	LagBytes units.Base2Bytes
+}
+
+// HealthFunc returns the agent's current Health.
+type HealthFunc func() Health
+
+// Check status values understood by Consul.
+const (
+	statusPassing  = "passing"
+	statusWarning  = "warning"
+	statusCritical = "critical"
+)
+
+// Registrar registers the agent as a Consul service and keeps a TTL check
+// updated with the agent's progress.
+type Registrar struct {
+	cfg    *config.ConsulConfig
+	health HealthFunc
+	client *http.Client
+
+	lastTags []string
+}
+
+// New creates a new Registrar.
+func New(cfg *config.ConsulConfig, health HealthFunc) *Registrar {
+	return &Registrar{
+		cfg:    cfg,
+		health: health,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run registers the service and updates its check until ctx is cancelled, at
+// which point the service is deregistered.
+func (r *Registrar) Run(ctx context.Context) {
+	interval := r.cfg.CheckTTL / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.update(ctx); err != nil {
+			lib.Logger(ctx).Warn().Err(err).Str("consul-addr", r.cfg.Address).Msg("unable to update consul")
+			// Force a re-registration on the next pass in case the Consul agent
+			// was restarted and lost our registration.
+			r.lastTags = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			// ctx has been cancelled, use a fresh context to deregister.
+			dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := r.put(dctx, "/v1/agent/service/deregister/"+url.PathEscape(r.cfg.ServiceID), nil); err != nil {
+				lib.Logger(ctx).Warn().Err(err).Msg("unable to deregister from consul")
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update (re-)registers the service if its tags changed and updates the TTL
+// check.
+func (r *Registrar) update(ctx context.Context) error {
+	h := r.health()
+
+	tags := r.tags(h)
+	if !equalTags(tags, r.lastTags) {
+		if err := r.register(ctx, tags); err != nil {
+			return err
+		}
+		r.lastTags = tags
+	}
+
+	status, output := r.checkStatus(h, time.Now())
+	body := map[string]string{
+		"Status": status,
+		"Output": output,
+	}
+
+	return r.put(ctx, "/v1/agent/check/update/"+url.PathEscape(r.checkID()), body)
+}
+
+func (r *Registrar) register(ctx context.Context, tags []string) error {
+	reg := map[string]interface{}{
+		"ID":   r.cfg.ServiceID,
+		"Name": r.cfg.ServiceName,
+		"Tags": tags,
+		"Check": map[string]interface{}{
+			"CheckID":                        r.checkID(),
+			"Name":                           r.cfg.ServiceName + " progress",
+			"TTL":                            r.cfg.CheckTTL.String(),
+			"DeregisterCriticalServiceAfter": r.cfg.DeregisterAfter.String(),
+		},
+	}
+
+	if err := r.put(ctx, "/v1/agent/service/register", reg); err != nil {
+		return errors.Wrap(err, "unable to register service")
+	}
+
+	lib.Logger(ctx).Info().Str("service-id", r.cfg.ServiceID).Strs("tags", tags).Msg("registered with consul")
+	return nil
+}
+
+// checkStatus maps the agent's Health to a Consul check status.
+func (r *Registrar) checkStatus(h Health, now time.Time) (status, output string) {
+	if h.LastScan.IsZero() {
+		return statusCritical, "no successful WAL scan yet"
+	}
+
+	scanAge := now.Sub(h.LastScan)
+	switch {
+	case scanAge > r.cfg.MaxScanAge:
+		return statusCritical, fmt.Sprintf("last successful WAL scan %s ago (max %s)", scanAge.Truncate(time.Millisecond), r.cfg.MaxScanAge)
+	case r.cfg.MaxLag > 0 && h.LagBytes > r.cfg.MaxLag:
+		return statusWarning, fmt.Sprintf("lag %s exceeds %s", h.LagBytes, r.cfg.MaxLag)
+	default:
+		return statusPassing, fmt.Sprintf("role %s, last WAL scan %s ago, lag %s", h.Role, scanAge.Truncate(time.Millisecond), h.LagBytes)
+	}
+}
+
+func (r *Registrar) checkID() string {
+	return "service:" + r.cfg.ServiceID
+}
+
+// tags returns the configured tags plus the current role.
+func (r *Registrar) tags(h Health) []string {
+	tags := make([]string, 0, len(r.cfg.Tags)+1)
+	tags = append(tags, r.cfg.Tags...)
+	if h.Role != "" {
+		tags = append(tags, h.Role)
+	}
+	sort.Strings(tags)
+
+	return tags
+}
+
+func (r *Registrar) put(ctx context.Context, path string, body interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "unable to encode consul request")
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimRight(r.cfg.Address, "/")+path, reqBody)
+	if err != nil {
+		return errors.Wrap(err, "unable to create consul request")
+	}
+	req = req.WithContext(ctx)
+	if r.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", r.cfg.Token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to reach consul")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("consul %s returned %s: %q", path, resp.Status, msg)
+	}
+
+	return nil
+}
+
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,59 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestRegistrar_checkStatus(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := New(&config.ConsulConfig{
+		MaxScanAge: time.Minute,
+		MaxLag:     1024,
+	}, nil)
+
+	tests := []struct {
+		in  Health
+		out string
+	}{
+		{ // 0
+			in:  Health{},
+			out: statusCritical,
+		},
+		{ // 1
+			in:  Health{Role: "follower", LastScan: now.Add(-2 * time.Minute)},
+			out: statusCritical,
+		},
+		{ // 2
+			in:  Health{Role: "follower", LastScan: now.Add(-time.Second), LagBytes: 2048},
+			out: statusWarning,
+		},
+		{ // 3
+			in:  Health{Role: "follower", LastScan: now.Add(-time.Second), LagBytes: 512},
+			out: statusPassing,
+		},
+	}
+
+	for n, test := range tests {
+		status, _ := r.checkStatus(test.in, now)
+		if diff := pretty.Compare(status, test.out); diff != "" {
+			t.Fatalf("%d: checkStatus diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
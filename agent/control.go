@@ -0,0 +1,173 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// controlDataTimeout bounds how long pg_controldata(1) may run.
+const controlDataTimeout = 10 * time.Second
+
+// loadControlData reads the cluster's storage geometry from pg_control and
+// threads it through the cache configuration.  If pg_control can't be read
+// (e.g. PGDATA has not been provisioned yet), the build's defaults are used
+// and verified once a database connection is established.
+func (a *Agent) loadControlData(cfg *config.Config) error {
+	cd := pg.DefaultControlData()
+
+	switch found, err := readControlData(a.cfg.ControlDataPath, cfg.FHCacheConfig.PGDataPath); {
+	case err != nil:
+		a.log.Warn().Err(err).Str("pg_controldata", a.cfg.ControlDataPath).
+			Str("next step", "verifying after connecting to the database").
+			Msg("unable to read pg_control, using default storage geometry")
+	default:
+		if err := found.Check(); err != nil {
+			return errors.Wrap(err, "unsupported pg_control")
+		}
+		cd = found
+		a.controlDataVerified = true
+	}
+
+	a.controlData = cd
+	cfg.FHCacheConfig.BlockSize = cd.BlockSize
+	cfg.FHCacheConfig.BlocksPerSegment = cd.BlocksPerSegment
+	cfg.WALCacheConfig.SegmentSize = cd.WALSegmentSize
+
+	a.log.Debug().
+		Str("block-size", cd.BlockSize.String()).
+		Uint64("blocks-per-segment", cd.BlocksPerSegment).
+		Str("wal-block-size", cd.WALBlockSize.String()).
+		Str("wal-segment-size", cd.WALSegmentSize.String()).
+		Uint32("data-checksum-version", cd.DataChecksumVersion).
+		Bool("track-commit-timestamp", cd.TrackCommitTimestamp).
+		Msg("storage geometry")
+
+	return nil
+}
+
+// verifyControlData compares the running database's storage geometry against
+// the geometry the caches were initialized with.  A mismatch is not
+// retryable.
+func (a *Agent) verifyControlData() error {
+	a.pgStateLock.RLock()
+	verified := a.controlDataVerified
+	a.pgStateLock.RUnlock()
+	if verified {
+		return nil
+	}
+
+	cd, err := pg.QueryControlData(a.shutdownCtx, a.pool)
+	if err != nil {
+		return newWALError(err, dbErrorCategory(err), false)
+	}
+
+	if err := cd.Check(); err != nil {
+		return newWALError(errors.Wrap(err, "unsupported database"), lib.ErrorCategoryFatal, false)
+	}
+
+	// The caches' buffers and offset math were sized for the startup block
+	// size, which is the build's default when pg_control couldn't be read.
+	if cd.BlockSize != a.controlData.BlockSize {
+		err := fmt.Errorf("database block size is %s but the agent started with %s, %s must be able to read pg_control at startup",
+			cd.BlockSize, a.controlData.BlockSize, a.cfg.ControlDataPath)
+		return newWALError(err, lib.ErrorCategoryFatal, false)
+	}
+
+	// The default geometry can't know whether or not checksums are enabled.
+	if cd.Geometry() != a.controlData.Geometry() {
+		err := fmt.Errorf("database storage geometry (%+v) does not match the startup geometry (%+v)", cd, a.controlData)
+		return newWALError(err, lib.ErrorCategoryFatal, false)
+	}
+
+	a.pgStateLock.Lock()
+	a.controlData.DataChecksumVersion = cd.DataChecksumVersion
+	a.controlDataVerified = true
+	a.pgStateLock.Unlock()
+
+	a.setDataChecksumVersion(cd.DataChecksumVersion)
+	a.walCache.SetTrackCommitTimestamp(cd.TrackCommitTimestamp)
+
+	return nil
+}
+
+// setDataChecksumVersion enables page checksum verification in the filehandle
+// cache if it was requested and the cluster has data checksums enabled.
+func (a *Agent) setDataChecksumVersion(version uint32) {
+	if !a.verifyChecksums {
+		return
+	}
+
+	if version == 0 {
+		a.log.Warn().Msg("data checksums are not enabled, page checksums will not be verified")
+		return
+	}
+
+	a.log.Info().Uint32("data-checksum-version", version).Msg("verifying page checksums")
+	a.fileHandleCache.SetDataChecksumVersion(version)
+}
+
+// readControlData runs pg_controldata(1) against pgdata.
+func readControlData(binPath, pgdata string) (pg.ControlData, error) {
+	stdout, err := runControlData(binPath, pgdata)
+	if err != nil {
+		return pg.ControlData{}, err
+	}
+
+	return pg.ParseControlData(stdout)
+}
+
+// readRecoveryProgress runs pg_controldata(1) against pgdata and returns the
+// progress of recovery.
+func readRecoveryProgress(binPath, pgdata string) (pg.RecoveryProgress, error) {
+	stdout, err := runControlData(binPath, pgdata)
+	if err != nil {
+		return pg.RecoveryProgress{}, err
+	}
+
+	return pg.ParseRecoveryProgress(stdout)
+}
+
+// runControlData runs pg_controldata(1) against pgdata and returns its output.
+func runControlData(binPath, pgdata string) (*bytes.Buffer, error) {
+	if binPath == "" {
+		return nil, errors.New("pg_controldata(1) has yet to be found")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), controlDataTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binPath, "-D", pgdata)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// pg_controldata(1)'s labels and timestamps are localized, force
+	// untranslated output.
+	cmd.Env = append(os.Environ(), "LC_ALL=C", "LANG=C")
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "unable to run pg_controldata: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return &stdout, nil
+}
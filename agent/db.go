@@ -19,9 +19,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
-	"path"
 	"strconv"
-	"strings"
+	"sync/atomic"
 
 	"github.com/alecthomas/units"
 	"github.com/bschofield/pg_prefaulter/agent/proc"
@@ -29,8 +28,6 @@ import (
 	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/jackc/pgx"
 	"github.com/pkg/errors"
-	log "github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 )
 
 type (
@@ -80,11 +77,13 @@ func (s _DBState) String() string {
 // dbState returns a constant indicating the state of the database
 // (i.e. primary, follower).
 func (a *Agent) dbState() (_DBState, error) {
-	switch mode := viper.GetString(config.KeyPGMode); mode {
+	switch mode := a.cfg.PGMode; mode {
 	case "primary":
 		return _DBStatePrimary, nil
 	case "follower":
 		return _DBStateFollower, nil
+	case "repmgr":
+		return a.repmgrDBState()
 	case "auto":
 		break
 	default:
@@ -92,7 +91,7 @@ func (a *Agent) dbState() (_DBState, error) {
 	}
 
 	var inRecovery bool
-	if err := a.pool.QueryRowEx(a.shutdownCtx, "SELECT pg_is_in_recovery()", nil).Scan(&inRecovery); err != nil {
+	if err := a.pool.QueryRowEx(a.shutdownCtx, a.walTranslations.Queries.Role, nil).Scan(&inRecovery); err != nil {
 		return _DBStateUnknown, errors.Wrap(err, "unable to execute primary check")
 	}
 
@@ -104,8 +103,13 @@ func (a *Agent) dbState() (_DBState, error) {
 }
 
 // ensureDBPool creates a new database connection pool.  If the connection fails
-// to be established, ensureDBPool will return an error.
+// to be established, ensureDBPool will return an error.  The database is
+// dialed without holding pgStateLock so that readers of the agent's state,
+// e.g. the WAL scanner, aren't blocked for the connect timeout.
 func (a *Agent) ensureDBPool() (err error) {
+	a.dialLock.Lock()
+	defer a.dialLock.Unlock()
+
 	a.pgStateLock.RLock()
 	if a.pool != nil {
 		a.pgStateLock.RUnlock()
@@ -113,19 +117,15 @@ func (a *Agent) ensureDBPool() (err error) {
 	}
 	a.pgStateLock.RUnlock()
 
-	a.pgStateLock.Lock()
-	if a.pool != nil {
-		a.pgStateLock.Unlock()
-		return nil
-	}
-	defer a.pgStateLock.Unlock()
-
 	var pool *pgx.ConnPool
-	if pool, err = pgx.NewConnPool(*a.poolConfig); err != nil {
+	if pool, err = a.connectDB(); err != nil {
 		return errors.Wrap(err, "unable to create a new DB connection pool")
 	}
 
+	a.pgStateLock.Lock()
 	a.pool = pool
+	a.pgStateLock.Unlock()
+
 	return nil
 }
 
@@ -156,12 +156,18 @@ func (a *Agent) findPostgreSQLPostmasterPID() (pid proc.PID, err error) {
 	return proc.PID(pid64), nil
 }
 
-// getWALFilesDB returns a list of WAL files according to PostgreSQL
-func (a *Agent) getWALFilesDB() (pg.WALFiles, error) {
+// getWALFilesDB returns a list of WAL files according to PostgreSQL.  The WAL
+// files predicted from each LSN are passed to emit as soon as they are
+// predicted.
+func (a *Agent) getWALFilesDB(emit func(pg.WALFiles)) (pg.WALFiles, error) {
 	if err := a.ensureDBPool(); err != nil {
 		return nil, errors.Wrap(err, "unable to get WAL db files")
 	}
 
+	if err := a.verifyControlData(); err != nil {
+		return nil, errors.Wrap(err, "unable to verify storage geometry")
+	}
+
 	timelineID, oldLSNs, err := pg.QueryOldestLSNs(a.shutdownCtx, a.pool, a.walCache, a.walTranslations)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to query PostgreSQL checkpoint information")
@@ -169,46 +175,40 @@ func (a *Agent) getWALFilesDB() (pg.WALFiles, error) {
 
 	var numWALFiles uint64
 
-	func() {
-		// If the timeline changed, purge the walCache assuming we're going to need
-		// to prefault in new heap data.
-		a.pgStateLock.Lock()
-		defer a.pgStateLock.Unlock()
-		if a.lastTimelineID != timelineID {
-			if a.lastTimelineID != 0 {
-				a.walCache.Purge()
-			}
-			a.lastTimelineID = timelineID
-		}
-	}()
+	a.switchTimeline(timelineID)
+	lastWALLog := a.loadWALPosition().walFile
 
 	walFiles := make(pg.WALFiles, 0, len(oldLSNs))
 	for _, oldLSN := range oldLSNs {
 		walFile := oldLSN.WALFilename(timelineID)
-		func() {
-			a.pgStateLock.Lock()
-			defer a.pgStateLock.Unlock()
-
-			if a.lastWALLog != walFile {
-				if a.lastWALLog != "" {
-					// Only increment the counter once we've initialized ourself to have a
-					// last log
-					numWALFiles++
-				}
-				a.lastWALLog = walFile
+		if oldLSN.IsSegmentBoundary() {
+			// WALFilename() maps a boundary LSN to the segment that just ended, but
+			// the next record to be replayed is in the following segment.
+			walFile = oldLSN.AddBytes(1).WALFilename(timelineID)
+		}
+
+		if lastWALLog != walFile {
+			if lastWALLog != "" {
+				// Only increment the counter once we've initialized ourself to have a
+				// last log
+				numWALFiles++
 			}
-		}()
+			lastWALLog = walFile
+		}
 
 		predictedWALFiles, err := a.predictDBWALFilenames(walFile)
 		if err != nil {
-			log.Debug().Err(err).
+			a.log.Debug().Err(err).
 				Str("walfile", string(walFile)).
 				Msg("unable to predict DB WAL filenames")
 			continue
 		}
+		emit(predictedWALFiles)
 		walFiles = append(walFiles, predictedWALFiles...)
 	}
 
+	a.storeWALPosition(_WALPosition{timelineID: timelineID, walFile: lastWALLog})
+
 	return walFiles, nil
 }
 
@@ -218,12 +218,18 @@ func (a *Agent) getWALFilesDB() (pg.WALFiles, error) {
 func (a *Agent) initDBPool(cfg *config.Config) (err error) {
 	cfg.DBPool.AfterConnect = func(conn *pgx.Conn) error {
 		var version string
-		sql := `SELECT VERSION()`
-		if err := conn.QueryRowEx(a.shutdownCtx, sql, nil).Scan(&version); err != nil {
+		var versionNum int64
+		sql := `SELECT VERSION(), current_setting('server_version_num')::INT8`
+		if err := conn.QueryRowEx(a.shutdownCtx, sql, nil).Scan(&version, &versionNum); err != nil {
 			return errors.Wrap(err, "unable to query DB version")
 		}
+		atomic.StoreUint64(&a.serverVersionNum, uint64(versionNum))
 
-		log.Debug().Uint32("backend-pid", conn.PID()).Str("version", version).Msg("established DB connection")
+		if err := pg.CheckQueryOverrides(a.shutdownCtx, conn, pg.Translate(uint64(versionNum)), a.cfg.QueryOverrides); err != nil {
+			return errors.Wrap(err, "invalid query override")
+		}
+
+		a.log.Debug().Uint32("backend-pid", conn.PID()).Str("version", version).Msg("established DB connection")
 
 		return nil
 	}
@@ -239,26 +245,44 @@ const (
 	_QueryLagUnknown _QueryLag = iota
 	_QueryLagPrimary
 	_QueryLagFollower
+	_QueryLagUpstream
+	_QueryLagCascade
 )
 
-// queryLag queries the database for its understanding of lag.
-func (a *Agent) queryLag(lagQuery _QueryLag) (units.Base2Bytes, error) {
+// queryLag queries the database for its understanding of lag.  args are
+// passed through to the _QueryLagCascade query.
+func (a *Agent) queryLag(lagQuery _QueryLag, args ...interface{}) (units.Base2Bytes, error) {
 	// FIXME(seanc@): units.Base2Bytes is an int64
 	const unknownLag = units.Base2Bytes(math.MaxInt64)
 
 	var sql string
+	pool := a.pool
 	switch lagQuery {
 	case _QueryLagPrimary:
 		sql = a.walTranslations.Queries.LagPrimary
 	case _QueryLagFollower:
 		sql = a.walTranslations.Queries.LagFollower
+	case _QueryLagUpstream:
+		// Ask the upstream how far behind it thinks we are.  repmgr sets the
+		// application_name of the replication connection to the node name.
+		a.pgStateLock.RLock()
+		pool = a.upstreamPool
+		args = []interface{}{a.upstreamNodeName}
+		a.pgStateLock.RUnlock()
+		if pool == nil {
+			return unknownLag, errors.New("no upstream configured")
+		}
+		sql = a.walTranslations.Queries.LagUpstream
+	case _QueryLagCascade:
+		// Run locally against the LSN reported by the upstream.
+		sql = a.walTranslations.Queries.LagCascade
 	default:
 		panic(fmt.Sprintf("unsupported query: %v", lagQuery))
 	}
 
 	var err error
 	var rows *pgx.Rows
-	rows, err = a.pool.QueryEx(a.shutdownCtx, sql, nil)
+	rows, err = pool.QueryEx(a.shutdownCtx, sql, nil, args...)
 	if err != nil {
 		return unknownLag, errors.Wrapf(err, "unable to query lag: %v", lagQuery)
 	}
@@ -280,9 +304,47 @@ func (a *Agent) queryLag(lagQuery _QueryLag) (units.Base2Bytes, error) {
 		return unknownLag, errors.Wrap(err, "unable to process lag")
 	}
 
+	if numRows == 0 && lagQuery == _QueryLagUpstream {
+		return unknownLag, errors.New("upstream is not replicating to this node")
+	}
+
 	return units.Base2Bytes(visibilityLagBytes), nil
 }
 
+// queryFollowerLag returns the visibility lag of this follower.  When the
+// follower's upstream is known (e.g. via repmgr or pg_stat_wal_receiver), the
+// upstream is asked first.  Otherwise the lag is computed from the WAL
+// receiver's position, falling back to the local lag query when the WAL
+// receiver's position is unavailable.
+func (a *Agent) queryFollowerLag() (units.Base2Bytes, error) {
+	if a.cfg.PGMode != "repmgr" {
+		if err := a.discoverWALReceiverUpstream(); err != nil {
+			a.log.Debug().Err(err).Msg("unable to discover the WAL receiver's upstream")
+		}
+	}
+
+	a.pgStateLock.RLock()
+	hasUpstream := a.upstreamPool != nil
+	a.pgStateLock.RUnlock()
+
+	if hasUpstream {
+		lag, err := a.queryUpstreamLag()
+		if err == nil {
+			return lag, nil
+		}
+		a.log.Debug().Err(err).Msg("unable to query upstream lag, falling back to local lag")
+	}
+
+	switch walReceiver, found, err := pg.QueryWALReceiver(a.shutdownCtx, a.pool, a.walTranslations); {
+	case err != nil:
+		a.log.Debug().Err(err).Msg("unable to query the WAL receiver, falling back to the lag query")
+	case found:
+		return walReceiver.VisibilityLag(), nil
+	}
+
+	return a.queryLag(_QueryLagFollower)
+}
+
 type LSNQuery int
 
 const (
@@ -296,41 +358,45 @@ const (
 // filenames where N is the configured level of WAL readahead.  Errors are
 // logged, but the return will always include at least one WAL file.
 //
-// Unlike predictProcWALFilenames(), predictDBWALFilenames() queries the
-// database to figure out the current lag and recovery state (versus naively
-// assuming the derived LSN from the WAL segment is authoritative).
+// Unlike predictProcWALFilenames(), predictDBWALFilenames() uses the role and
+// lag most recently observed by the role watcher and the lag monitor (versus
+// naively assuming the derived LSN from the WAL segment is authoritative).
+// Nothing is predicted until both have been observed.
 func (a *Agent) predictDBWALFilenames(walFile pg.WALFilename) ([]pg.WALFilename, error) {
 	// If the apply lag of the DB exceeds a threshold, anticipate the correct
 	// number of WAL filenames.
 
-	dbState, err := a.dbState()
-	if err != nil {
-		log.Error().Err(err).Msg("unable to determine if database is primary or not, retrying")
-		return []pg.WALFilename{walFile}, err
-	}
-
-	switch state := dbState; state {
+	state, visibilityLagBytes, lagObserved := a.observedDB()
+	switch state {
 	case _DBStatePrimary:
 		// "Always return at least the current WAL file," ... unless we're the
 		// primary.  If we're the primary, there's nothing to fault in so return an
 		// empty list.
+		if a.cfg.LogicalApply {
+			a.prefaultLogicalApply()
+		}
 		return []pg.WALFilename{}, nil
 	case _DBStateFollower:
-		break
+		if !lagObserved {
+			return nil, errors.New("follower lag has not been measured yet")
+		}
+	case _DBStateUnknown:
+		return nil, errors.New("database role has not been observed yet")
 	default:
 		panic(fmt.Sprintf("unknown state: %+v", state))
 	}
 
-	visibilityLagBytes, err := a.queryLag(_QueryLagFollower)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to query follower lag")
-	}
-
 	timelineID, lsn, err := pg.ParseWalfile(walFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to parse WAL file while predicting names from the DB")
 	}
 
+	// A segment ending in an XLOG_SWITCH has already been decoded and the
+	// remainder of it is padding, start the readahead at the next segment.
+	if a.walCache.Switched(walFile) {
+		lsn = lsn.AddBytes(pg.WALSegmentSize)
+	}
+
 	// Clamp the number of bytes we'll readahead in order to prevent reading into
 	// the future.
 	maxBytes := a.walCache.ReadaheadBytes()
@@ -352,40 +418,5 @@ func (a *Agent) predictDBWALFilenames(walFile pg.WALFilename) ([]pg.WALFilename,
 // this function will not return the exact version (i.e. the minor) of the database; it will
 // look like the minor version is always 0.
 func (a *Agent) getPostgresVersion(pgDataPath string) (pgMajor uint64, err error) {
-	versionFileAbs := path.Join(pgDataPath, "PG_VERSION")
-	buf, err := ioutil.ReadFile(versionFileAbs)
-	if err != nil {
-		return pgMajor, errors.Wrap(err, "unable to read PG_VERSION")
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(buf))
-	var versionStringRaw string
-	for scanner.Scan() {
-		versionStringRaw = scanner.Text()
-		break
-	}
-	if err := scanner.Err(); err != nil {
-		return pgMajor, errors.Wrap(err, "unable to extract PostgreSQL's version string")
-	}
-
-	parts := strings.Split(versionStringRaw, ".")
-	first, err := strconv.ParseUint(parts[0], 10, 32)
-	if err != nil {
-		return pgMajor, errors.Wrap(err, "unable to parse first section of version")
-	}
-
-	var pgVersionString string
-	if first < 10 {
-		second := parts[1]
-		pgVersionString = fmt.Sprintf("%d%s00", (first * 10), second)
-	} else {
-		pgVersionString = fmt.Sprintf("%d0000", first)
-	}
-
-	pgMajor, err = strconv.ParseUint(pgVersionString, 10, 32)
-	if err != nil {
-		return pgMajor, errors.Wrap(err, "unable to parse version back to integer")
-	}
-
-	return pgMajor, nil
+	return pg.ReadVersion(pgDataPath)
 }
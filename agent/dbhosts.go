@@ -0,0 +1,110 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+var (
+	dbConnectFailures = metrics.NewCounter("db_connect_failures_total", "Number of PostgreSQL listeners that failed to accept a connection.")
+	dbHostFallbacks   = metrics.NewCounter("db_host_fallbacks_total", "Number of connections made to a PostgreSQL listener other than the first one configured.")
+)
+
+// dbKeepAlive matches the TCP keepalive pgx uses when no dialer is configured.
+const dbKeepAlive = 5 * time.Minute
+
+// connectDB returns a connection pool to the first of the configured listeners
+// that accepts a connection within the connect timeout.  Listeners are tried
+// in order every time so the agent returns to the first listener once it
+// recovers.
+func (a *Agent) connectDB() (*pgx.ConnPool, error) {
+	hosts := a.cfg.DBHosts
+	if len(hosts) == 0 {
+		hosts = []config.DBHost{{Host: a.poolConfig.Host, Port: a.poolConfig.Port}}
+	}
+
+	errs := make([]string, 0, len(hosts))
+	for i, host := range hosts {
+		poolConfig := *a.poolConfig
+		poolConfig.Host = host.Host
+		poolConfig.Port = host.Port
+
+		pool, err := newConnPool(poolConfig, a.cfg.DBConnectTimeout)
+		if err != nil {
+			dbConnectFailures.Inc()
+			a.log.Warn().Err(err).Str("db-host", host.String()).Msg("unable to connect to PostgreSQL")
+			errs = append(errs, fmt.Sprintf("%s: %v", host, err))
+			continue
+		}
+
+		if i > 0 {
+			dbHostFallbacks.Inc()
+			a.log.Info().Str("db-host", host.String()).Str("preferred-db-host", hosts[0].String()).
+				Msg("connected to a fallback PostgreSQL listener")
+		}
+
+		return pool, nil
+	}
+
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// newConnPool creates a connection pool, giving up after timeout.  The timeout
+// covers both dialing and the startup of the first connection so that a
+// listener that accepts connections but never answers doesn't wedge the agent.
+// A zero timeout waits forever.
+func newConnPool(poolConfig pgx.ConnPoolConfig, timeout time.Duration) (*pgx.ConnPool, error) {
+	if timeout == 0 {
+		return pgx.NewConnPool(poolConfig)
+	}
+
+	if poolConfig.Dial == nil {
+		poolConfig.Dial = (&net.Dialer{Timeout: timeout, KeepAlive: dbKeepAlive}).Dial
+	}
+
+	type result struct {
+		pool *pgx.ConnPool
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		pool, err := pgx.NewConnPool(poolConfig)
+		done <- result{pool: pool, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.pool, r.err
+	case <-timer.C:
+		// Close the pool if the connection is eventually established.
+		go func() {
+			if r := <-done; r.pool != nil {
+				r.pool.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
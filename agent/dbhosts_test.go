@@ -0,0 +1,89 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/jackc/pgx"
+	"github.com/rs/zerolog"
+)
+
+func TestConnectDB(t *testing.T) {
+	// A listener that accepts connections but never answers the startup message
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	// A port nothing is listening on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+	hungAddr := hung.Addr().(*net.TCPAddr)
+
+	a := &Agent{
+		cfg: &config.Agent{
+			DBHosts: []config.DBHost{
+				{Host: "127.0.0.1", Port: uint16(hungAddr.Port)},
+				{Host: "127.0.0.1", Port: uint16(closedAddr.Port)},
+			},
+			DBConnectTimeout: 100 * time.Millisecond,
+		},
+		poolConfig: &pgx.ConnPoolConfig{MaxConnections: 1},
+		log:        zerolog.Nop(),
+	}
+
+	start := time.Now()
+	_, err = a.connectDB()
+	if err == nil {
+		t.Fatal("connected without a PostgreSQL listener")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("took %s to give up", elapsed)
+	}
+
+	// Every listener is tried and reported
+	for _, host := range a.cfg.DBHosts {
+		if !strings.Contains(err.Error(), host.String()) {
+			t.Errorf("%q not reported in %q", host, err)
+		}
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("hung listener not timed out: %q", err)
+	}
+}
@@ -13,49 +13,57 @@
 
 package agent
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
 
 type purgeEventError interface {
 	purgeCache() bool
 }
 
-type retryableError interface {
-	retry() bool
-}
-
 type walError struct {
 	_err        error
-	_retry      bool
+	_category   lib.ErrorCategory
 	_purgeCache bool
 }
 
 type versionError struct {
-	_err    error
-	_retry  bool
+	_err      error
+	_category lib.ErrorCategory
 }
 
-func newWALError(err error, retry bool, purge bool) walError {
+func newWALError(err error, category lib.ErrorCategory, purge bool) walError {
 	return walError{
 		_err:        err,
-		_retry:      retry,
+		_category:   category,
 		_purgeCache: purge,
 	}
 }
 
-func newVersionError(err error, retry bool) versionError {
+func newVersionError(err error, category lib.ErrorCategory) versionError {
 	return versionError{
-		_err:    err,
-		_retry:  retry,
+		_err:      err,
+		_category: category,
 	}
 }
 
 // Error returns the error message
 func (walErr walError) Error() string {
-	return fmt.Sprintf("%v: (retriable: %t, purge cache: %t", walErr._err, walErr._retry, walErr._purgeCache)
+	return fmt.Sprintf("%v (category: %s, purge cache: %t)", walErr._err, walErr._category, walErr._purgeCache)
+}
+
+// ErrorCategory returns the category of the error
+func (walErr walError) ErrorCategory() lib.ErrorCategory {
+	return walErr._category
 }
 
-func (walErr walError) retry() bool {
-	return walErr._retry
+func (walErr walError) Unwrap() error {
+	return walErr._err
 }
 
 func (walErr walError) purgeCache() bool {
@@ -63,9 +71,51 @@ func (walErr walError) purgeCache() bool {
 }
 
 func (versionErr versionError) Error() string {
-	return fmt.Sprintf("%v (retriable: %t)", versionErr._err, versionErr._retry)
+	return fmt.Sprintf("%v (category: %s)", versionErr._err, versionErr._category)
+}
+
+// ErrorCategory returns the category of the error
+func (versionErr versionError) ErrorCategory() lib.ErrorCategory {
+	return versionErr._category
+}
+
+func (versionErr versionError) Unwrap() error {
+	return versionErr._err
+}
+
+// pgErrorCategory classifies an error reported by the database by its SQLSTATE
+// class.  See PostgreSQL's src/backend/utils/errcodes.txt.
+func pgErrorCategory(pgErr pgx.PgError) lib.ErrorCategory {
+	switch {
+	case strings.HasPrefix(pgErr.Code, "28"), pgErr.Code == "42501":
+		// invalid_authorization_specification or insufficient_privilege
+		return lib.ErrorCategoryPermission
+	case pgErr.Code == "3D000":
+		// invalid_catalog_name, i.e. the configured database doesn't exist
+		return lib.ErrorCategoryConfig
+	case strings.HasPrefix(pgErr.Code, "08"),
+		strings.HasPrefix(pgErr.Code, "53"),
+		strings.HasPrefix(pgErr.Code, "57P"):
+		// connection_exception, insufficient_resources, or the database is
+		// starting up or shutting down
+		return lib.ErrorCategoryTransientDB
+	default:
+		return lib.ErrorCategoryFatal
+	}
 }
 
-func (versionErr versionError) retry() bool {
-	return versionErr._retry
+// dbErrorCategory classifies an error encountered while inspecting the
+// database.  Errors not reported by the database itself are assumed to be the
+// database going away (e.g. a refused connection), unless permission was
+// denied.
+func dbErrorCategory(err error) lib.ErrorCategory {
+	if pgErr, ok := errors.Cause(err).(pgx.PgError); ok {
+		return pgErrorCategory(pgErr)
+	}
+
+	if category := lib.CategoryOf(err); category != lib.ErrorCategoryFatal {
+		return category
+	}
+
+	return lib.ErrorCategoryTransientDB
 }
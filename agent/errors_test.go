@@ -0,0 +1,85 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		err      error
+		category lib.ErrorCategory
+		exitCode int
+	}{
+		{ // 0
+			err:      pgx.PgError{Code: "28P01", Message: "password authentication failed"},
+			category: lib.ErrorCategoryPermission,
+			exitCode: lib.ExitCodePermission,
+		},
+		{ // 1
+			err:      pgx.PgError{Code: "3D000", Message: `database "missing" does not exist`},
+			category: lib.ErrorCategoryConfig,
+			exitCode: lib.ExitCodeConfig,
+		},
+		{ // 2
+			err:      errors.Wrap(pgx.PgError{Code: "57P01", Message: "terminating connection due to administrator command"}, "query"),
+			category: lib.ErrorCategoryTransientDB,
+			exitCode: lib.ExitCodeTransientDB,
+		},
+		{ // 3
+			err:      pgx.PgError{Code: "XX000", Message: "internal error"},
+			category: lib.ErrorCategoryFatal,
+			exitCode: lib.ExitCodeFatal,
+		},
+		{ // 4
+			err:      errors.Wrap(syscall.ECONNREFUSED, "dial"),
+			category: lib.ErrorCategoryTransientDB,
+			exitCode: lib.ExitCodeTransientDB,
+		},
+		{ // 5
+			err:      &os.PathError{Op: "open", Path: "/pgdata/PG_VERSION", Err: syscall.EACCES},
+			category: lib.ErrorCategoryPermission,
+			exitCode: lib.ExitCodePermission,
+		},
+	}
+
+	for n, test := range tests {
+		if category := dbErrorCategory(test.err); category != test.category {
+			t.Fatalf("%d: category %s, want %s", n, category, test.category)
+		}
+
+		// The category survives wrapping on its way up to main
+		err := errors.Wrap(newWALError(test.err, dbErrorCategory(test.err), false), "unable to find WAL files")
+		if category := lib.CategoryOf(err); category != test.category {
+			t.Fatalf("%d: wrapped category %s, want %s", n, category, test.category)
+		}
+		if exitCode := lib.CategoryOf(err).ExitCode(); exitCode != test.exitCode {
+			t.Fatalf("%d: exit code %d, want %d", n, exitCode, test.exitCode)
+		}
+	}
+
+	if category := lib.CategoryOf(errors.New("unexpected")); category != lib.ErrorCategoryFatal {
+		t.Fatalf("uncategorized error is %s, want fatal", category)
+	}
+	if lib.ConfigError(nil) != nil {
+		t.Fatalf("categorized a nil error")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// recentEventsSize is the number of events kept for the diagnostic dump.
+const recentEventsSize = 32
+
+// recentEvent is a significant event observed by the agent.
+type recentEvent struct {
+	Time    time.Time              `json:"time"`
+	Name    string                 `json:"event"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// eventRing remembers the most recent events.  The zero value is ready to use.
+type eventRing struct {
+	lock   sync.Mutex
+	events []recentEvent
+	next   int
+}
+
+// add records e, forgetting the oldest event once the ring is full.
+func (r *eventRing) add(e recentEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.events) < recentEventsSize {
+		r.events = append(r.events, e)
+		return
+	}
+
+	r.events[r.next] = e
+	r.next = (r.next + 1) % recentEventsSize
+}
+
+// list returns the remembered events, oldest first.
+func (r *eventRing) list() []recentEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	events := make([]recentEvent, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	events = append(events, r.events[:r.next]...)
+
+	return events
+}
+
+// fireEvent remembers the event name for the diagnostic dump and notifies
+// hooks.
+func (a *Agent) fireEvent(name string, details map[string]interface{}) {
+	a.recentEvents.add(recentEvent{
+		Time:    time.Now().UTC(),
+		Name:    name,
+		Details: details,
+	})
+	a.hooks.Fire(name, details)
+}
+
+// dumpDiagnostics logs a snapshot of the agent's state and its most recent
+// events, a lightweight alternative to attaching a debugger.
+func (a *Agent) dumpDiagnostics() {
+	a.log.Info().Int("goroutines", runtime.NumGoroutine()).
+		Interface("status", a.Status()).
+		Interface("recent-events", a.recentEvents.list()).
+		Msg("diagnostic dump")
+}
@@ -0,0 +1,48 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestEventRing(t *testing.T) {
+	a := &Agent{}
+	if got := a.recentEvents.list(); len(got) != 0 {
+		t.Fatalf("got %d events from an empty ring", len(got))
+	}
+
+	// Events are remembered without hooks, and the oldest are forgotten once
+	// the ring is full.
+	const extra = 5
+	for i := 0; i < recentEventsSize+extra; i++ {
+		a.fireEvent("role-change", map[string]interface{}{"n": i})
+	}
+
+	events := a.recentEvents.list()
+	got := make([]interface{}, 0, len(events))
+	want := make([]interface{}, 0, recentEventsSize)
+	for i, e := range events {
+		got = append(got, e.Details["n"])
+		want = append(want, extra+i)
+	}
+	if len(events) != recentEventsSize {
+		t.Fatalf("got %d events, want %d", len(events), recentEventsSize)
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("event diff: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package faults injects artificial pread(2) latency, pread(2) EIOs, and WAL
+// decoding failures at configured rates.  Fault injection is a developer mode
+// for exercising the agent's backpressure, cache eviction, and retry behavior
+// without slow or failing hardware.  It is configured via hidden flags and
+// must never be enabled in production.
+package faults
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/config"
+)
+
+var (
+	injectedDelays   = metrics.NewCounter("faults_injected_pread_delays_total", "Number of pread(2)s delayed by fault injection.")
+	injectedEIOs     = metrics.NewCounter("faults_injected_pread_errors_total", "Number of pread(2)s failed with EIO by fault injection.")
+	injectedDecodes  = metrics.NewCounter("faults_injected_decode_failures_total", "Number of WAL decodes failed by fault injection.")
+	errDecodeFailure = errors.New("injected pg_waldump(1) failure")
+)
+
+// Injector decides which operations fail.  A nil *Injector injects nothing, so
+// callers don't need to check whether fault injection is enabled.
+type Injector struct {
+	cfg config.FaultConfig
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// New returns an Injector for cfg, or nil if cfg doesn't inject any faults.
+func New(cfg config.FaultConfig) *Injector {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	return &Injector{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// hit returns true with probability rate.
+func (i *Injector) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.rand.Float64() < rate
+}
+
+// Pread is called before reading from the file named name.  Pread may sleep
+// and may return an EIO error in lieu of performing the read.
+func (i *Injector) Pread(name string) error {
+	if i == nil {
+		return nil
+	}
+
+	if i.cfg.PreadDelay > 0 && i.hit(i.cfg.PreadDelayRate) {
+		injectedDelays.Inc()
+		time.Sleep(i.cfg.PreadDelay)
+	}
+
+	if i.hit(i.cfg.PreadEIORate) {
+		injectedEIOs.Inc()
+		return &os.PathError{Op: "pread", Path: name, Err: syscall.EIO}
+	}
+
+	return nil
+}
+
+// Decode is called before decoding WAL files and returns an error if the
+// decode should fail.
+func (i *Injector) Decode() error {
+	if i == nil || !i.hit(i.cfg.DecodeFailRate) {
+		return nil
+	}
+
+	injectedDecodes.Inc()
+	return errDecodeFailure
+}
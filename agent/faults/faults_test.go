@@ -0,0 +1,77 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package faults
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+)
+
+func TestInjector(t *testing.T) {
+	// Disabled fault injection injects nothing
+	if i := New(config.FaultConfig{PreadDelay: time.Second}); i != nil {
+		t.Fatalf("a delay without a rate enabled fault injection")
+	}
+	var disabled *Injector
+	if err := disabled.Pread("16384"); err != nil {
+		t.Fatalf("nil injector failed a pread: %v", err)
+	}
+	if err := disabled.Decode(); err != nil {
+		t.Fatalf("nil injector failed a decode: %v", err)
+	}
+
+	tests := []struct {
+		cfg       config.FaultConfig
+		preadEIO  bool
+		decodeErr bool
+		delayed   bool
+	}{
+		{ // 0
+			cfg:      config.FaultConfig{PreadEIORate: 1},
+			preadEIO: true,
+		},
+		{ // 1
+			cfg:       config.FaultConfig{DecodeFailRate: 1},
+			decodeErr: true,
+		},
+		{ // 2
+			cfg:     config.FaultConfig{PreadDelay: 10 * time.Millisecond, PreadDelayRate: 1},
+			delayed: true,
+		},
+	}
+
+	for n, test := range tests {
+		i := New(test.cfg)
+		if i == nil {
+			t.Fatalf("%d: fault injection disabled", n)
+		}
+
+		start := time.Now()
+		err := i.Pread("16384")
+		if eio := errors.Is(err, syscall.EIO); eio != test.preadEIO {
+			t.Fatalf("%d: pread error %v, want EIO %t", n, err, test.preadEIO)
+		}
+		if delayed := time.Since(start) >= test.cfg.PreadDelay && test.cfg.PreadDelay > 0; delayed != test.delayed {
+			t.Fatalf("%d: pread delayed %t, want %t", n, delayed, test.delayed)
+		}
+
+		if err := i.Decode(); (err != nil) != test.decodeErr {
+			t.Fatalf("%d: decode error %v, want %t", n, err, test.decodeErr)
+		}
+	}
+}
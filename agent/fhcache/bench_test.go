@@ -0,0 +1,115 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/fhcache"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+const (
+	benchDatabase = 16384
+	benchRelation = 16385
+	benchBlocks   = 128
+)
+
+// newBenchCache creates a FileHandleCache over a scratch PGDATA containing a
+// single relation of benchBlocks pages.
+func newBenchCache(b *testing.B) (*fhcache.FileHandleCache, func()) {
+	pgdata, err := ioutil.TempDir("", "fhcache")
+	if err != nil {
+		b.Fatalf("unable to create PGDATA: %v", err)
+	}
+
+	dbDir := path.Join(pgdata, "base", "16384")
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		b.Fatalf("unable to create database directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dbDir, "16385"), make([]byte, benchBlocks*pg.HeapPageSize), 0600); err != nil {
+		b.Fatalf("unable to create relation: %v", err)
+	}
+
+	geometry := pg.DefaultControlData()
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &config.Config{
+		FHCacheConfig: config.FHCacheConfig{
+			MaxOpenFiles:     16,
+			Size:             16,
+			TTL:              time.Hour,
+			PGDataPath:       pgdata,
+			BlockSize:        geometry.BlockSize,
+			BlocksPerSegment: geometry.BlocksPerSegment,
+		},
+	}
+
+	fhc, err := fhcache.New(ctx, cfg)
+	if err != nil {
+		b.Fatalf("unable to create file handle cache: %v", err)
+	}
+
+	return fhc, func() {
+		fhc.Purge()
+		cancel()
+		os.RemoveAll(pgdata)
+	}
+}
+
+func BenchmarkPrefaultPage(b *testing.B) {
+	fhc, cleanup := newBenchCache(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ioReq := structs.IOCacheKey{
+			Database: benchDatabase,
+			Relation: benchRelation,
+			Block:    pg.HeapBlockNumber(i % benchBlocks),
+		}
+		if err := fhc.PrefaultPage(ioReq); err != nil {
+			b.Fatalf("unable to prefault page: %v", err)
+		}
+	}
+}
+
+func BenchmarkPrefaultPageParallel(b *testing.B) {
+	fhc, cleanup := newBenchCache(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			ioReq := structs.IOCacheKey{
+				Database: benchDatabase,
+				Relation: benchRelation,
+				Block:    pg.HeapBlockNumber(i % benchBlocks),
+			}
+			if err := fhc.PrefaultPage(ioReq); err != nil {
+				b.Fatalf("unable to prefault page: %v", err)
+			}
+			i++
+		}
+	})
+}
@@ -15,17 +15,24 @@ package fhcache
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/faults"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
 	"github.com/bschofield/pg_prefaulter/agent/structs"
 	"github.com/bschofield/pg_prefaulter/config"
 	"github.com/bschofield/pg_prefaulter/lib"
 	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/pkg/errors"
-	log "github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
 )
 
 var (
@@ -35,63 +42,105 @@ var (
 
 	closeLock    sync.RWMutex
 	closeFDCount uint64
+
+	pagesVerified    = metrics.NewCounter("checksum_pages_verified_total", "Number of pages whose checksum was verified.")
+	checksumFailures = metrics.NewCounter("checksum_failures_total", "Number of pages that failed checksum verification.")
 )
 
 // FileHandleCache is a file descriptor cache to prevent re-open(2)'ing files
 // continually.
 type FileHandleCache struct {
 	ctx context.Context
+	log zerolog.Logger
 	cfg *config.FHCacheConfig
 
 	purgeLock sync.Mutex
-	c         gcache.Cache
+	c         *lib.TunableCache
+
+	// bufPool holds page-sized read buffers.  The page size is only known at
+	// runtime.  recordPool holds record-sized read buffers and is nil unless
+	// relations are read in records of blocksPerRecord pages.
+	bufPool         *pagePool
+	recordPool      *pagePool
+	blocksPerRecord uint64
+
+	// devices caches the device ID of the directories containing relation and
+	// SLRU segments.
+	devicesLock sync.Mutex
+	devices     map[_DeviceKey]uint64
+
+	// missing remembers the segments that recently failed to open because they
+	// don't exist.
+	missing *_NegativeCache
+
+	// faults is nil unless fault injection is enabled.
+	faults *faults.Injector
+
+	// dataChecksumVersion is accessed atomically and is non-zero once the
+	// cluster is known to have data checksums enabled.
+	dataChecksumVersion uint32
 }
 
 // New creates a new FileHandleCache
 func New(ctx context.Context, cfg *config.Config) (*FileHandleCache, error) {
 	fhc := &FileHandleCache{
 		ctx: ctx,
+		log: *lib.Logger(ctx),
 		cfg: &cfg.FHCacheConfig,
+
+		devices: make(map[_DeviceKey]uint64),
+		missing: newNegativeCache(),
+		faults:  faults.New(cfg.FaultConfig),
 	}
 
-	fhc.c = gcache.New(int(fhc.cfg.Size)).
-		ARC().
-		LoaderExpireFunc(func(fhCacheKeyRaw interface{}) (interface{}, *time.Duration, error) {
-			fhCacheKey, ok := fhCacheKeyRaw.(_Key)
-			if !ok {
-				log.Panic().Msgf("unable to type assert key in file handle cache: %T %+v", fhCacheKeyRaw, fhCacheKeyRaw)
-			}
+	fhc.bufPool = newPagePool(fhc.cfg.BlockSize)
+	if fhc.cfg.RecordSize > fhc.cfg.BlockSize {
+		fhc.recordPool = newPagePool(fhc.cfg.RecordSize)
+		fhc.blocksPerRecord = uint64(fhc.cfg.RecordSize / fhc.cfg.BlockSize)
+	}
 
-			fhCacheVal := _Value{
-				_Key: fhCacheKey,
+	// Open file handles are carried over when the cache is resized.  Handles
+	// that expired or no longer fit are closed when they are evicted.
+	fhc.c = lib.NewTunableCache(int(fhc.cfg.Size), fhc.cfg.TTL, func(size int) *gcache.CacheBuilder {
+		return gcache.New(size).
+			ARC().
+			LoaderExpireFunc(func(fhCacheKeyRaw interface{}) (interface{}, *time.Duration, error) {
+				fhCacheKey, ok := fhCacheKeyRaw.(_Key)
+				if !ok {
+					fhc.log.Panic().Msgf("unable to type assert key in file handle cache: %T %+v", fhCacheKeyRaw, fhCacheKeyRaw)
+				}
 
-				lock: &sync.RWMutex{},
-				f:    nil,
-			}
-			return &fhCacheVal, &fhc.cfg.TTL, nil
-		}).
-		EvictedFunc(func(fhCacheKeyRaw, fhCacheValueRaw interface{}) {
-			fhCacheValue, ok := fhCacheValueRaw.(*_Value)
-			if !ok {
-				log.Panic().Msgf("bad, evicting something not a file handle: %+v", fhCacheValue)
-			}
-			defer fhCacheValue.close()
-		}).
-		PurgeVisitorFunc(func(fhCacheKeyRaw, fhCacheValueRaw interface{}) {
-			fhCacheValue, ok := fhCacheValueRaw.(*_Value)
-			if !ok {
-				log.Panic().Msgf("bad, purging something not a file handle: %+v", fhCacheValue)
-			}
-			defer fhCacheValue.close()
-		}).
-		Build()
+				fhCacheVal := _Value{
+					_Key: fhCacheKey,
+
+					lock: &sync.RWMutex{},
+					f:    nil,
+				}
+				return &fhCacheVal, fhc.c.TTL(), nil
+			}).
+			PurgeVisitorFunc(func(fhCacheKeyRaw, fhCacheValueRaw interface{}) {
+				fhCacheValue, ok := fhCacheValueRaw.(*_Value)
+				if !ok {
+					fhc.log.Panic().Msgf("bad, purging something not a file handle: %+v", fhCacheValue)
+				}
+				defer fhCacheValue.close(&fhc.log)
+			})
+	}, func(fhCacheKeyRaw, fhCacheValueRaw interface{}) {
+		fhCacheValue, ok := fhCacheValueRaw.(*_Value)
+		if !ok {
+			fhc.log.Panic().Msgf("bad, evicting something not a file handle: %+v", fhCacheValue)
+		}
+		defer fhCacheValue.close(&fhc.log)
+	})
 
 	go lib.LogCacheStats(fhc.ctx, fhc.c, "filehandle-stats")
 
-	log.Debug().
+	fhc.log.Debug().
 		Uint("rlimit-nofile", fhc.cfg.MaxOpenFiles).
 		Uint("filehandle-cache-size", fhc.cfg.Size).
 		Dur("filehandle-cache-ttl", fhc.cfg.TTL).
+		Str("block-size", fhc.cfg.BlockSize.String()).
+		Str("record-size", fhc.cfg.RecordSize.String()).
 		Msg("filehandle cache initialized")
 	return fhc, nil
 }
@@ -104,8 +153,17 @@ var (
 // PrefaultPage uses the given IOCacheKey to:
 //
 // 1) open a relation's segment, if necessary
-// 2) pre-fault a given heap page into the OS's filesystem cache using pread(2)
+// 2) pre-fault a given heap page into the OS's filesystem cache using pread(2) or mmap(2)
+//
+// Relation pages are faulted in along with the rest of their record when
+// reading records.
 func (fhc *FileHandleCache) PrefaultPage(ioCacheKey structs.IOCacheKey) error {
+	pool := fhc.bufPool
+	if fhc.recordPool != nil && ioCacheKey.SLRU == pg.SLRUNone {
+		pool = fhc.recordPool
+		ioCacheKey.Block -= ioCacheKey.Block % pg.HeapBlockNumber(fhc.blocksPerRecord)
+	}
+
 	fhcValue, err := fhc.getLocked(ioCacheKey)
 	if err != nil {
 		return errors.Wrap(err, "unable to obtain file handle")
@@ -121,9 +179,23 @@ func (fhc *FileHandleCache) PrefaultPage(ioCacheKey structs.IOCacheKey) error {
 		numConcurrentReadLock.Unlock()
 	}()
 
-	var buf [pg.HeapPageSize]byte
-	pageNum := pg.HeapSegmentPageNum(ioCacheKey.Block)
-	_, err = fhcValue.f.ReadAt(buf[:], int64(uint64(pageNum)*uint64(pg.HeapPageSize)))
+	pageNum := ioCacheKey.Block.SegmentPageNum(fhc.blocksPerSegment(ioCacheKey))
+	offset := int64(uint64(pageNum) * uint64(fhc.cfg.BlockSize))
+	if err := fhc.faults.Pread(fhcValue.f.Name()); err != nil {
+		return errors.Wrap(err, "unable to pread(2)")
+	}
+
+	switch fhc.cfg.Backend {
+	case config.PrefaultBackendMmap:
+		return fhc.prefaultMmap(fhcValue, ioCacheKey, offset, pool)
+	case config.PrefaultBackendRdadvise:
+		return fhc.prefaultRdadvise(fhcValue, offset, pool)
+	}
+
+	buf := pool.get()
+	defer pool.put(buf)
+
+	n, err := fhcValue.f.ReadAt(*buf, offset)
 	if err != nil {
 		// TODO(seanc@): Figure out why there are any EOFs being returned.  They
 		// seem harmless, but indicate a different problem that requires
@@ -133,17 +205,145 @@ func (fhc *FileHandleCache) PrefaultPage(ioCacheKey structs.IOCacheKey) error {
 			return errors.Wrap(err, "unable to pread(2)")
 		}
 
-		return nil
+		// The last record of a segment is usually only partially filled, its
+		// pages are still verified below.
+		if n < int(fhc.cfg.BlockSize) {
+			return nil
+		}
+	}
+
+	// SLRU pages do not carry a checksum
+	if fhc.cfg.VerifyChecksums && ioCacheKey.SLRU == pg.SLRUNone && atomic.LoadUint32(&fhc.dataChecksumVersion) != 0 {
+		fhc.verifyPages(fhcValue, ioCacheKey, (*buf)[:n], offset)
 	}
 
 	return nil
 }
 
+// ReadPage reads the page referenced by ioCacheKey with pread(2).  Unlike
+// PrefaultPage the page is neither verified nor faulted in with the rest of its
+// record, so ReadPage can time the read of a page that is already resident.
+func (fhc *FileHandleCache) ReadPage(ioCacheKey structs.IOCacheKey) error {
+	fhcValue, err := fhc.getLocked(ioCacheKey)
+	if err != nil {
+		return errors.Wrap(err, "unable to obtain file handle")
+	}
+	defer fhcValue.lock.RUnlock()
+
+	pageNum := ioCacheKey.Block.SegmentPageNum(fhc.blocksPerSegment(ioCacheKey))
+	offset := int64(uint64(pageNum) * uint64(fhc.cfg.BlockSize))
+
+	buf := fhc.bufPool.get()
+	defer fhc.bufPool.put(buf)
+
+	if _, err := fhcValue.f.ReadAt(*buf, offset); err != nil && err != io.EOF {
+		return errors.Wrap(err, "unable to pread(2)")
+	}
+
+	return nil
+}
+
+// blocksPerSegment returns the number of pages in each segment of the file
+// referenced by ioCacheKey.
+func (fhc *FileHandleCache) blocksPerSegment(ioCacheKey structs.IOCacheKey) uint64 {
+	if ioCacheKey.SLRU != pg.SLRUNone {
+		return pg.SLRUPagesPerSegment
+	}
+
+	return fhc.cfg.BlocksPerSegment
+}
+
+// _DeviceKey identifies the directory containing a relation or SLRU segment.
+type _DeviceKey struct {
+	tablespace pg.OID
+	database   pg.OID
+	slru       pg.SLRU
+}
+
+// Device returns the ID of the device containing the file referenced by
+// ioCacheKey.
+func (fhc *FileHandleCache) Device(ioCacheKey structs.IOCacheKey) (uint64, error) {
+	devKey := _DeviceKey{
+		tablespace: ioCacheKey.Tablespace,
+		database:   ioCacheKey.Database,
+		slru:       ioCacheKey.SLRU,
+	}
+
+	fhc.devicesLock.Lock()
+	dev, found := fhc.devices[devKey]
+	fhc.devicesLock.Unlock()
+	if found {
+		return dev, nil
+	}
+
+	key := _NewKey(ioCacheKey, fhc.blocksPerSegment(ioCacheKey))
+	dir := path.Dir(key.filename(fhc.cfg.PGDataPath))
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return 0, errors.Wrapf(err, "unable to stat %q", dir)
+	}
+	dev = uint64(st.Dev)
+
+	fhc.devicesLock.Lock()
+	fhc.devices[devKey] = dev
+	fhc.devicesLock.Unlock()
+
+	return dev, nil
+}
+
+// SetDataChecksumVersion records the cluster's data page checksum version.
+// Page checksums are only verified when verification was requested and the
+// version is non-zero.
+func (fhc *FileHandleCache) SetDataChecksumVersion(version uint32) {
+	atomic.StoreUint32(&fhc.dataChecksumVersion, version)
+}
+
+// verifyPages verifies the checksum of each whole page in buf, read from a
+// relation segment at offset starting with the page of ioCacheKey.
+func (fhc *FileHandleCache) verifyPages(fhcValue *_Value, ioCacheKey structs.IOCacheKey, buf []byte, offset int64) {
+	blockSize := int(fhc.cfg.BlockSize)
+	for i := 0; i+blockSize <= len(buf); i += blockSize {
+		fhc.verifyPage(fhcValue, ioCacheKey, buf[i:i+blockSize], offset+int64(i))
+		ioCacheKey.Block++
+	}
+}
+
+// verifyPage verifies the checksum of a page read from a relation segment.  A
+// page that fails verification is re-read once before it is reported in order
+// to tolerate a torn read of a page PostgreSQL was concurrently writing.
+func (fhc *FileHandleCache) verifyPage(fhcValue *_Value, ioCacheKey structs.IOCacheKey, page []byte, offset int64) {
+	pagesVerified.Inc()
+
+	err := pg.VerifyPage(page, ioCacheKey.Block)
+	if err == nil {
+		return
+	}
+
+	if _, rerr := fhcValue.f.ReadAt(page, offset); rerr == nil {
+		err = pg.VerifyPage(page, ioCacheKey.Block)
+		if err == nil {
+			return
+		}
+	}
+
+	checksumFailures.Inc()
+	fhc.log.Error().Err(err).
+		Uint64("tablespace", uint64(ioCacheKey.Tablespace)).
+		Uint64("database", uint64(ioCacheKey.Database)).
+		Uint64("relation", uint64(ioCacheKey.Relation)).
+		Uint64("block", uint64(ioCacheKey.Block)).
+		Msg("page checksum verification failed")
+}
+
 // getLocked returns a read-locked _Value.  Upon success, callers MUST call
 // RUnlock().  On error _Value will return nil and the caller will not have to
 // release any outstanding locks.
 func (fhc *FileHandleCache) getLocked(ioReq structs.IOCacheKey) (*_Value, error) {
-	key := _NewKey(ioReq)
+	key := _NewKey(ioReq, fhc.blocksPerSegment(ioReq))
+	if fhc.missing.missing(key, time.Now()) {
+		negativeHits.Inc()
+		return nil, errors.Wrapf(errMissing, "segment %+v", key)
+	}
 
 	valueRaw, err := fhc.c.Get(key)
 	if err != nil {
@@ -152,7 +352,7 @@ func (fhc *FileHandleCache) getLocked(ioReq structs.IOCacheKey) (*_Value, error)
 
 	value, ok := valueRaw.(*_Value)
 	if !ok {
-		log.Panic().Msgf("unable to type assert file handle in IO Cache: %+v", valueRaw)
+		fhc.log.Panic().Msgf("unable to type assert file handle in IO Cache: %+v", valueRaw)
 	}
 
 	// Loop until we exit this with an error or the read lock held.
@@ -172,17 +372,92 @@ func (fhc *FileHandleCache) getLocked(ioReq structs.IOCacheKey) (*_Value, error)
 			continue
 		}
 
-		f, err := value.open(fhc.cfg.PGDataPath)
+		f, err := value.open(fhc.cfg.PGDataPath, fhc.cfg.Sandbox)
 		if err != nil {
-			log.Warn().Err(err).Msgf("unable to open relation file: %+v", key)
+			if os.IsNotExist(errors.Cause(err)) {
+				fhc.missing.add(key, time.Now())
+			}
+			fhc.log.Warn().Err(err).
+				Uint64("tablespace", uint64(key.tablespace)).
+				Uint64("database", uint64(key.database)).
+				Uint64("relation", uint64(key.relation)).
+				Uint64("segment", uint64(key.segment)).
+				Msg("unable to open relation file")
 			value.lock.Unlock()
 			return nil, errors.Wrapf(err, "unable to re-open file: %+v", value._Key)
 		}
+		if fhc.cfg.Backend == config.PrefaultBackendRdadvise {
+			if err := disableReadahead(f); err != nil {
+				fhc.log.Debug().Err(err).Str("file", f.Name()).Msg("unable to disable readahead")
+			}
+		}
 		value.f = f
 		value.lock.Unlock()
 	}
 }
 
+// Size returns the capacity of the FileHandleCache.
+func (fhc *FileHandleCache) Size() int {
+	return fhc.c.Size()
+}
+
+// Resize changes the capacity of the FileHandleCache without closing the file
+// handles that still fit.  The capacity can't exceed the file descriptors
+// available to the cache.
+func (fhc *FileHandleCache) Resize(size int) error {
+	if limit := int(fhc.cfg.MaxOpenFiles) - config.NumReservedFDs; fhc.cfg.MaxOpenFiles > 0 && size > limit {
+		return fmt.Errorf("size must not exceed the open files limit less %d reserved (%d > %d)", config.NumReservedFDs, size, limit)
+	}
+
+	return fhc.c.Resize(size)
+}
+
+// TTL returns the expiration of newly opened file handles.
+func (fhc *FileHandleCache) TTL() time.Duration {
+	return *fhc.c.TTL()
+}
+
+// SetTTL changes the expiration of newly opened file handles.
+func (fhc *FileHandleCache) SetTTL(ttl time.Duration) error {
+	return fhc.c.SetTTL(ttl)
+}
+
+// Statistics returns the FileHandleCache's number of entries and counters.
+func (fhc *FileHandleCache) Statistics() lib.CacheStatistics {
+	return fhc.c.Statistics()
+}
+
+// Invalidate closes the file handles of the segments of rels, whose files were
+// dropped or truncated, and returns the number of handles closed.
+func (fhc *FileHandleCache) Invalidate(rels map[pg.RelFileNode]struct{}) int {
+	fhc.missing.invalidate(rels)
+
+	return fhc.c.RemoveIf(func(k interface{}) bool {
+		key := k.(_Key)
+		if key.slru != pg.SLRUNone {
+			return false
+		}
+
+		_, found := rels[pg.RelFileNode{
+			Tablespace: key.tablespace,
+			Database:   key.database,
+			Relation:   key.relation,
+		}]
+		return found
+	})
+}
+
+// MissingFiles returns the segments recently found missing.
+func (fhc *FileHandleCache) MissingFiles() []MissingFile {
+	return fhc.missing.entries(time.Now())
+}
+
+// RestoreMissingFiles remembers the unexpired files, as returned by
+// MissingFiles, as missing.
+func (fhc *FileHandleCache) RestoreMissingFiles(files []MissingFile) {
+	fhc.missing.restore(files, time.Now())
+}
+
 // Purge purges the FileHandleCache of its cache (and all downstream caches)
 func (fhc *FileHandleCache) Purge() {
 	fhc.purgeLock.Lock()
@@ -190,13 +465,17 @@ func (fhc *FileHandleCache) Purge() {
 
 	fhc.c.Purge()
 
+	fhc.devicesLock.Lock()
+	fhc.devices = make(map[_DeviceKey]uint64)
+	fhc.devicesLock.Unlock()
+
 	openLock.RLock()
 	defer openLock.RUnlock()
 	closeLock.RLock()
 	defer closeLock.RUnlock()
 	if openFDCount != closeFDCount {
 		// Open vs close accountancy errors are considered fatal
-		log.Panic().
+		fhc.log.Panic().
 			Uint64("close-count", closeFDCount).Uint64("open-count", openFDCount).
 			Msgf("bad, open vs close count not the same after purge")
 	}
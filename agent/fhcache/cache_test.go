@@ -0,0 +1,87 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestReadPage(t *testing.T) {
+	const blockSize = 8192
+
+	pgdata, err := ioutil.TempDir("", "pgdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pgdata)
+
+	// A page of garbage fails checksum verification
+	dbDir := filepath.Join(pgdata, "base", "5")
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	page := make([]byte, blockSize)
+	for i := range page {
+		page[i] = 0xA5
+	}
+	if err := ioutil.WriteFile(filepath.Join(dbDir, "16384"), page, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fhc, err := New(ctx, &config.Config{
+		FHCacheConfig: config.FHCacheConfig{
+			PGDataPath:       pgdata,
+			Size:             4,
+			TTL:              time.Minute,
+			BlockSize:        blockSize,
+			BlocksPerSegment: 131072,
+			VerifyChecksums:  true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fhc.Purge()
+	fhc.SetDataChecksumVersion(1)
+
+	key := structs.IOCacheKey{Tablespace: pg.DefaultTablespaceOID, Database: 5, Relation: 16384}
+
+	verified, failed := pagesVerified.Value(), checksumFailures.Value()
+	if err := fhc.PrefaultPage(key); err != nil {
+		t.Fatal(err)
+	}
+	if pagesVerified.Value() != verified+1 || checksumFailures.Value() != failed+1 {
+		t.Fatalf("prefaulted page wasn't verified")
+	}
+
+	// Reading the page again neither verifies it nor reports it
+	verified, failed = pagesVerified.Value(), checksumFailures.Value()
+	if err := fhc.ReadPage(key); err != nil {
+		t.Fatal(err)
+	}
+	if pagesVerified.Value() != verified || checksumFailures.Value() != failed {
+		t.Fatalf("read page was verified")
+	}
+}
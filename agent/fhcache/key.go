@@ -30,14 +30,16 @@ type _Key struct {
 	database   pg.OID
 	relation   pg.OID
 	segment    pg.HeapSegmentNumber
+	slru       pg.SLRU
 }
 
-func _NewKey(ioCacheKey structs.IOCacheKey) _Key {
+func _NewKey(ioCacheKey structs.IOCacheKey, blocksPerSegment uint64) _Key {
 	return _Key{
 		tablespace: ioCacheKey.Tablespace,
 		database:   ioCacheKey.Database,
 		relation:   ioCacheKey.Relation,
-		segment:    ioCacheKey.Block.SegmentNumber(),
+		segment:    ioCacheKey.Block.SegmentNumberOf(blocksPerSegment),
+		slru:       ioCacheKey.SLRU,
 	}
 }
 
@@ -46,6 +48,10 @@ func (key *_Key) filename(pgdataPath string) string {
 	// FIXME(seanc@): Move this logic to the pg package.  Create an "LSN"
 	// interface that requires the necessary helper functions so that a
 	// fhcache.Key can be used to pg.* methods.
+	if key.slru != pg.SLRUNone {
+		return path.Join(pgdataPath, key.slru.Directory(pgdataPath), pg.SLRUSegmentFilename(pg.HeapBlockNumber(uint64(key.segment)*pg.SLRUPagesPerSegment)))
+	}
+
 	var filename string
 	if key.segment > 0 {
 		// It's easier to abuse Relation here than to support a parallel refilno
@@ -3,6 +3,9 @@ package fhcache
 import (
 	"testing"
 
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/kylelemons/godebug/pretty"
 )
 
@@ -22,6 +25,14 @@ func Test_Key_filename(t *testing.T) {
 			path:     "/test/path/pgdata",
 			filename: "/test/path/pgdata/base/16398/24576",
 		},
+		{
+			key: _Key{
+				segment: 0x1F,
+				slru:    pg.SLRUXact,
+			},
+			path:     "/test/path/pgdata",
+			filename: "/test/path/pgdata/pg_xact/001F",
+		},
 	}
 
 	for n, test := range tests {
@@ -30,3 +41,50 @@ func Test_Key_filename(t *testing.T) {
 		}
 	}
 }
+
+func Test_NewKeySegment(t *testing.T) {
+	const segmentSize = 1 * units.GiB
+
+	tests := []struct {
+		blockSize units.Base2Bytes
+		block     pg.HeapBlockNumber
+		segment   pg.HeapSegmentNumber
+		pageNum   pg.HeapPageNumber
+	}{
+		{ // 0
+			blockSize: 8 * units.KiB,
+			block:     131073,
+			segment:   1,
+			pageNum:   1,
+		},
+		{ // 1
+			blockSize: 16 * units.KiB,
+			block:     131073,
+			segment:   2,
+			pageNum:   1,
+		},
+		{ // 2
+			blockSize: 32 * units.KiB,
+			block:     131073,
+			segment:   4,
+			pageNum:   1,
+		},
+		{ // 3
+			blockSize: 32 * units.KiB,
+			block:     32767,
+			segment:   0,
+			pageNum:   32767,
+		},
+	}
+
+	for n, test := range tests {
+		blocksPerSegment := uint64(segmentSize / test.blockSize)
+		key := _NewKey(structs.IOCacheKey{Relation: 24576, Block: test.block}, blocksPerSegment)
+		if key.segment != test.segment {
+			t.Errorf("%d: segment %d, want %d", n, key.segment, test.segment)
+		}
+		if pageNum := test.block.SegmentPageNum(blocksPerSegment); pageNum != test.pageNum {
+			t.Errorf("%d: page %d, want %d", n, pageNum, test.pageNum)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// MmapPopulates is true when the mmap backend has mmap(2) populate the mapping
+// rather than touching each page.
+const MmapPopulates = mmapPopulates
+
+// prefaultMmap faults in the pages at offset, as many as fit in one of pool's
+// buffers, by mapping them.  Where mmap(2) can't populate the mapping itself,
+// each OS page of the mapping is touched instead.
+func (fhc *FileHandleCache) prefaultMmap(fhcValue *_Value, ioCacheKey structs.IOCacheKey, offset int64, pool *pagePool) error {
+	fd := int(fhcValue.f.Fd())
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return errors.Wrap(err, "unable to fstat(2)")
+	}
+
+	// Like pread(2)'s EOF, a page past the end of the segment isn't an error.
+	if offset >= st.Size {
+		return nil
+	}
+
+	// Mappings start on an OS page boundary and must not extend past the end of
+	// the file.
+	pageSize := int64(os.Getpagesize())
+	start := offset &^ (pageSize - 1)
+	end := offset + int64(pool.size)
+	if end > st.Size {
+		end = st.Size
+	}
+
+	data, err := unix.Mmap(fd, start, int(end-start), unix.PROT_READ, mmapFlags)
+	if err != nil {
+		return errors.Wrap(err, "unable to mmap(2)")
+	}
+	defer unix.Munmap(data)
+
+	if !mmapPopulates {
+		if err := touch(data, int(pageSize)); err != nil {
+			return err
+		}
+	}
+
+	// SLRU pages do not carry a checksum
+	if fhc.cfg.VerifyChecksums && ioCacheKey.SLRU == pg.SLRUNone && atomic.LoadUint32(&fhc.dataChecksumVersion) != 0 {
+		buf := pool.get()
+		defer pool.put(buf)
+
+		mapped := data[offset-start:]
+		if err := copyMapped(*buf, mapped); err != nil {
+			return err
+		}
+		fhc.verifyPages(fhcValue, ioCacheKey, (*buf)[:len(mapped)], offset)
+	}
+
+	return nil
+}
+
+// touched keeps the reads made by touch from being optimized away.
+var touched uint32
+
+// touch reads a byte of every OS page in data.  A segment truncated while it
+// is mapped raises SIGBUS, which is reported as an error.
+func touch(data []byte, pageSize int) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("unable to fault in mapping: %v", r)
+		}
+	}()
+
+	var sum uint32
+	for i := 0; i < len(data); i += pageSize {
+		sum += uint32(data[i])
+	}
+	atomic.AddUint32(&touched, sum)
+
+	return nil
+}
+
+// copyMapped copies the mapping src to dst, reporting a segment truncated while
+// it is mapped as an error.
+func copyMapped(dst, src []byte) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("unable to read mapping: %v", r)
+		}
+	}()
+
+	copy(dst, src)
+
+	return nil
+}
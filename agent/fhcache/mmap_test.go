@@ -0,0 +1,74 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"golang.org/x/sys/unix"
+)
+
+func TestPrefaultMmap(t *testing.T) {
+	const blockSize = 8192
+
+	f, err := ioutil.TempFile("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Two full pages followed by a partial page
+	if _, err := f.Write(make([]byte, 2*blockSize+100)); err != nil {
+		t.Fatal(err)
+	}
+
+	fhc := &FileHandleCache{
+		cfg: &config.FHCacheConfig{
+			BlockSize: blockSize,
+			Backend:   config.PrefaultBackendMmap,
+		},
+	}
+	value := &_Value{f: f}
+
+	for n, offset := range []int64{0, blockSize, 2 * blockSize, 3 * blockSize, 10 * blockSize} {
+		if err := fhc.prefaultMmap(value, structs.IOCacheKey{}, offset, newPagePool(blockSize)); err != nil {
+			t.Errorf("%d: unable to prefault offset %d: %v", n, offset, err)
+		}
+	}
+
+	// A segment truncated while it is mapped is reported rather than crashing
+	data, err := unix.Mmap(int(f.Fd()), 0, 2*blockSize, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(data)
+
+	if err := touch(data, os.Getpagesize()); err != nil {
+		t.Errorf("unable to touch: %v", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch(data, os.Getpagesize()); err == nil {
+		t.Error("touching a truncated segment succeeded")
+	}
+	if err := copyMapped(make([]byte, blockSize), data); err == nil {
+		t.Error("copying a truncated segment succeeded")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+const (
+	// negativeTTL is how long a segment that could not be found is remembered
+	// as missing.  Relations are created and extended while the agent runs, so
+	// a miss is only trusted for a short while.
+	negativeTTL = time.Minute
+
+	// maxMissingFiles bounds the number of segments remembered as missing.
+	maxMissingFiles = 10000
+)
+
+// errMissing is returned for segments that were recently found missing.
+var errMissing = errors.New("segment recently found missing")
+
+var (
+	negativeHits    = metrics.NewCounter("fhcache_negative_hits_total", "Number of opens skipped because the segment was recently found missing.")
+	missingFilesNum = metrics.NewGauge("fhcache_missing_files", "Number of segments remembered as missing.")
+)
+
+// MissingFile is a relation or SLRU segment that did not exist when it was
+// last opened.  MissingFiles are persisted so the agent doesn't retry opening
+// them after a restart.
+type MissingFile struct {
+	Tablespace pg.OID               `json:"tablespace"`
+	Database   pg.OID               `json:"database"`
+	Relation   pg.OID               `json:"relation"`
+	Segment    pg.HeapSegmentNumber `json:"segment"`
+	SLRU       pg.SLRU              `json:"slru,omitempty"`
+	Expires    time.Time            `json:"expires"`
+}
+
+// IsMissing returns true if err was returned because the segment was recently
+// found missing.
+func IsMissing(err error) bool {
+	return errors.Cause(err) == errMissing
+}
+
+// _NegativeCache remembers the segments that could not be opened because they
+// don't exist, each for at most negativeTTL.
+type _NegativeCache struct {
+	lock    sync.Mutex
+	expires map[_Key]time.Time
+}
+
+func newNegativeCache() *_NegativeCache {
+	return &_NegativeCache{
+		expires: make(map[_Key]time.Time),
+	}
+}
+
+// add remembers key as missing until now+negativeTTL.  Expired entries are
+// dropped to make room, and key is not remembered if the cache is still full.
+func (nc *_NegativeCache) add(key _Key, now time.Time) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	if len(nc.expires) >= maxMissingFiles {
+		nc.expireLocked(now)
+		if len(nc.expires) >= maxMissingFiles {
+			return
+		}
+	}
+
+	nc.expires[key] = now.Add(negativeTTL)
+	missingFilesNum.Set(float64(len(nc.expires)))
+}
+
+// missing returns true if key was found missing less than negativeTTL ago.
+func (nc *_NegativeCache) missing(key _Key, now time.Time) bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	expires, found := nc.expires[key]
+	if !found {
+		return false
+	}
+
+	if !now.Before(expires) {
+		delete(nc.expires, key)
+		missingFilesNum.Set(float64(len(nc.expires)))
+		return false
+	}
+
+	return true
+}
+
+// invalidate forgets the segments of rels.
+func (nc *_NegativeCache) invalidate(rels map[pg.RelFileNode]struct{}) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	for key := range nc.expires {
+		rel := pg.RelFileNode{Tablespace: key.tablespace, Database: key.database, Relation: key.relation}
+		if _, found := rels[rel]; found && key.slru == pg.SLRUNone {
+			delete(nc.expires, key)
+		}
+	}
+	missingFilesNum.Set(float64(len(nc.expires)))
+}
+
+// expireLocked drops the entries that expired before now.  nc.lock must be
+// held.
+func (nc *_NegativeCache) expireLocked(now time.Time) {
+	for key, expires := range nc.expires {
+		if !now.Before(expires) {
+			delete(nc.expires, key)
+		}
+	}
+}
+
+// entries returns the unexpired entries.
+func (nc *_NegativeCache) entries(now time.Time) []MissingFile {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	nc.expireLocked(now)
+	missingFilesNum.Set(float64(len(nc.expires)))
+
+	files := make([]MissingFile, 0, len(nc.expires))
+	for key, expires := range nc.expires {
+		files = append(files, MissingFile{
+			Tablespace: key.tablespace,
+			Database:   key.database,
+			Relation:   key.relation,
+			Segment:    key.segment,
+			SLRU:       key.slru,
+			Expires:    expires,
+		})
+	}
+
+	return files
+}
+
+// restore remembers the unexpired files as missing.
+func (nc *_NegativeCache) restore(files []MissingFile, now time.Time) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	for _, f := range files {
+		if !now.Before(f.Expires) || len(nc.expires) >= maxMissingFiles {
+			continue
+		}
+
+		// Don't trust an entry for longer than negativeTTL, whatever the clock
+		// did while the agent wasn't running.
+		expires := f.Expires
+		if limit := now.Add(negativeTTL); expires.After(limit) {
+			expires = limit
+		}
+
+		nc.expires[_Key{
+			tablespace: f.Tablespace,
+			database:   f.Database,
+			relation:   f.Relation,
+			segment:    f.Segment,
+			slru:       f.SLRU,
+		}] = expires
+	}
+	missingFilesNum.Set(float64(len(nc.expires)))
+}
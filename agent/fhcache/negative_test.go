@@ -0,0 +1,77 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestNegativeCache(t *testing.T) {
+	now := time.Now()
+	nc := newNegativeCache()
+	key := _Key{tablespace: 1663, database: 16398, relation: 24576, segment: 2}
+
+	if nc.missing(key, now) {
+		t.Fatalf("%+v missing before it was added", key)
+	}
+
+	nc.add(key, now)
+	if !nc.missing(key, now.Add(negativeTTL-time.Second)) {
+		t.Fatalf("%+v not missing within the TTL", key)
+	}
+	if nc.missing(key, now.Add(negativeTTL)) {
+		t.Fatalf("%+v still missing after the TTL", key)
+	}
+
+	nc.add(key, now)
+	nc.invalidate(map[pg.RelFileNode]struct{}{{Tablespace: 1663, Database: 16398, Relation: 24576}: {}})
+	if nc.missing(key, now) {
+		t.Fatalf("%+v still missing after its relation was invalidated", key)
+	}
+
+	for i := 0; i < maxMissingFiles+1; i++ {
+		nc.add(_Key{relation: pg.OID(i)}, now)
+	}
+	if len(nc.expires) != maxMissingFiles {
+		t.Fatalf("bad number of missing files: %d", len(nc.expires))
+	}
+}
+
+func TestNegativeCacheRestore(t *testing.T) {
+	now := time.Now()
+	saved := newNegativeCache()
+	saved.add(_Key{relation: 1}, now.Add(-negativeTTL))
+	saved.add(_Key{relation: 2, slru: pg.SLRUXact}, now)
+
+	files := saved.entries(now)
+	if len(files) != 1 || files[0].Relation != 2 || files[0].SLRU != pg.SLRUXact {
+		t.Fatalf("bad entries: %+v", files)
+	}
+
+	// An entry isn't trusted for longer than the TTL, even if the clock went
+	// backwards.
+	files = append(files, MissingFile{Relation: 3, Expires: now.Add(time.Hour)})
+
+	restored := newNegativeCache()
+	restored.restore(files, now)
+	if !restored.missing(_Key{relation: 2, slru: pg.SLRUXact}, now) {
+		t.Fatalf("restored entry not missing")
+	}
+	if restored.missing(_Key{relation: 3}, now.Add(negativeTTL)) {
+		t.Fatalf("restored entry outlived the TTL")
+	}
+}
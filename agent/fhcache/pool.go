@@ -0,0 +1,52 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"sync"
+
+	"github.com/alecthomas/units"
+)
+
+// pagePool recycles page-sized read buffers across IO workers so that a
+// pread(2) does not allocate.  Buffers are handed out as *[]byte to avoid
+// allocating when a slice header is stored in the sync.Pool.
+type pagePool struct {
+	size int
+	pool sync.Pool
+}
+
+func newPagePool(pageSize units.Base2Bytes) *pagePool {
+	p := &pagePool{size: int(pageSize)}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+
+	return p
+}
+
+// get returns a page-sized buffer.  The contents of the buffer are undefined.
+func (p *pagePool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns buf to the pool.  buf must not be used after calling put.
+func (p *pagePool) put(buf *[]byte) {
+	if len(*buf) != p.size {
+		return
+	}
+
+	p.pool.Put(buf)
+}
@@ -0,0 +1,97 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestPagePool(t *testing.T) {
+	p := newPagePool(pg.HeapPageSize)
+
+	buf := p.get()
+	if len(*buf) != int(pg.HeapPageSize) {
+		t.Fatalf("bad buffer size: got %d, want %d", len(*buf), pg.HeapPageSize)
+	}
+	p.put(buf)
+
+	// Buffers of the wrong size are not recycled
+	short := make([]byte, 1)
+	p.put(&short)
+	for i := 0; i < 8; i++ {
+		if buf := p.get(); len(*buf) != int(pg.HeapPageSize) {
+			t.Fatalf("bad buffer size: got %d, want %d", len(*buf), pg.HeapPageSize)
+		}
+	}
+}
+
+// benchPage returns a scratch file containing a single page.
+func benchPage(b *testing.B) (*os.File, func()) {
+	f, err := ioutil.TempFile("", "fhcache")
+	if err != nil {
+		b.Fatalf("unable to create page: %v", err)
+	}
+	if _, err := f.Write(make([]byte, pg.HeapPageSize)); err != nil {
+		b.Fatalf("unable to write page: %v", err)
+	}
+
+	return f, func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// pageSize is a variable, not a constant, because the page size is only known
+// at runtime.  A constant-sized make(2) may be stack allocated.
+var pageSize = pg.HeapPageSize
+
+// BenchmarkPageAlloc is the baseline for BenchmarkPagePool: one allocation
+// per pread(2).
+func BenchmarkPageAlloc(b *testing.B) {
+	f, cleanup := benchPage(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := make([]byte, pageSize)
+			if _, err := f.ReadAt(buf, 0); err != nil {
+				b.Fatalf("unable to read: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkPagePool(b *testing.B) {
+	f, cleanup := benchPage(b)
+	defer cleanup()
+	p := newPagePool(pageSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := p.get()
+			if _, err := f.ReadAt(*buf, 0); err != nil {
+				b.Fatalf("unable to read: %v", err)
+			}
+			p.put(buf)
+		}
+	})
+}
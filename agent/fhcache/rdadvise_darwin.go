@@ -0,0 +1,67 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin
+
+package fhcache
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// prefaultRdadvise asks the kernel to read the page, or record, at offset into
+// the unified buffer cache with fcntl(F_RDADVISE) and returns without waiting
+// for the read.
+func (fhc *FileHandleCache) prefaultRdadvise(fhcValue *_Value, offset int64, pool *pagePool) error {
+	fd := fhcValue.f.Fd()
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(fd), &st); err != nil {
+		return errors.Wrap(err, "unable to fstat(2)")
+	}
+
+	// Like pread(2)'s EOF, a page past the end of the segment isn't an error.
+	if offset >= st.Size {
+		return nil
+	}
+
+	count := int64(pool.size)
+	if offset+count > st.Size {
+		count = st.Size - offset
+	}
+
+	ra := unix.Radvisory_t{
+		Offset: offset,
+		Count:  int32(count),
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_FCNTL, fd, unix.F_RDADVISE, uintptr(unsafe.Pointer(&ra))); errno != 0 {
+		return errors.Wrap(errno, "unable to fcntl(F_RDADVISE)")
+	}
+
+	return nil
+}
+
+// disableReadahead turns off the kernel's readahead on f with
+// fcntl(F_RDAHEAD).  Every F_RDADVISE names the exact range wanted, so
+// speculative reads past it only waste IO.
+func disableReadahead(f *os.File) error {
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_RDAHEAD, 0); err != nil {
+		return errors.Wrap(err, "unable to fcntl(F_RDAHEAD)")
+	}
+
+	return nil
+}
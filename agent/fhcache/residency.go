@@ -0,0 +1,85 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"os"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ResidencySupported is true when Resident can tell whether a page is in the
+// filesystem cache.
+const ResidencySupported = residencySupported
+
+// Resident returns true if the page referenced by ioCacheKey is in the
+// filesystem cache.  The page is mapped without being faulted in and its
+// residency is read with mincore(2), so asking doesn't change the answer.
+func (fhc *FileHandleCache) Resident(ioCacheKey structs.IOCacheKey) (bool, error) {
+	if !residencySupported {
+		return false, errors.New("mincore(2) is not supported on this platform")
+	}
+
+	fhcValue, err := fhc.getLocked(ioCacheKey)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to obtain file handle")
+	}
+	defer fhcValue.lock.RUnlock()
+
+	pageNum := ioCacheKey.Block.SegmentPageNum(fhc.blocksPerSegment(ioCacheKey))
+	offset := int64(uint64(pageNum) * uint64(fhc.cfg.BlockSize))
+
+	return resident(fhcValue.f, offset, int64(fhc.cfg.BlockSize))
+}
+
+// resident returns true if every OS page of the size bytes at offset in f is
+// in the filesystem cache.  Bytes past the end of f are never resident.
+func resident(f *os.File, offset, size int64) (bool, error) {
+	fd := int(f.Fd())
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return false, errors.Wrap(err, "unable to fstat(2)")
+	}
+	if offset >= st.Size {
+		return false, nil
+	}
+
+	pageSize := int64(os.Getpagesize())
+	start := offset &^ (pageSize - 1)
+	end := offset + size
+	if end > st.Size {
+		end = st.Size
+	}
+
+	data, err := unix.Mmap(fd, start, int(end-start), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to mmap(2)")
+	}
+	defer unix.Munmap(data)
+
+	vec := make([]byte, (int64(len(data))+pageSize-1)/pageSize)
+	if err := mincore(data, vec); err != nil {
+		return false, errors.Wrap(err, "unable to mincore(2)")
+	}
+	for _, v := range vec {
+		if v&1 == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestResident(t *testing.T) {
+	if !ResidencySupported {
+		t.Skip("mincore(2) is not supported on this platform")
+	}
+
+	const blockSize = 8192
+
+	f, err := ioutil.TempFile("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Pages just written are in the filesystem cache
+	if _, err := f.Write(make([]byte, 2*blockSize+100)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset   int64
+		resident bool
+	}{
+		{ // 0
+			offset:   0,
+			resident: true,
+		},
+		{ // 1
+			offset:   2 * blockSize,
+			resident: true,
+		},
+		{ // 2
+			offset:   3 * blockSize,
+			resident: false,
+		},
+	}
+
+	for n, test := range tests {
+		got, err := resident(f, test.offset, blockSize)
+		if err != nil {
+			t.Errorf("%d: unable to check residency: %v", n, err)
+			continue
+		}
+		if got != test.resident {
+			t.Errorf("%d: resident %t, want %t", n, got, test.resident)
+		}
+	}
+}
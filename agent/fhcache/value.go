@@ -17,8 +17,9 @@ import (
 	"os"
 	"sync"
 
+	"github.com/bschofield/pg_prefaulter/agent/sandbox"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 )
 
 // _Value is the FileHandleCache value.  _Value provides synchronization around
@@ -34,7 +35,7 @@ type _Value struct {
 	f    *os.File
 }
 
-func (fh *_Value) close() {
+func (fh *_Value) close(log *zerolog.Logger) {
 	fh.lock.Lock()
 	defer fh.lock.Unlock()
 
@@ -54,12 +55,20 @@ func (fh *_Value) close() {
 	closeLock.Unlock()
 }
 
-func (value *_Value) open(pgdataPath string) (*os.File, error) {
+func (value *_Value) open(pgdataPath string, limit bool) (*os.File, error) {
 	filename := value._Key.filename(pgdataPath)
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to open relation segment %q", filename)
 	}
+
+	if limit {
+		if err := sandbox.LimitFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
 	openLock.Lock()
 	openFDCount++
 	openLock.Unlock()
@@ -0,0 +1,38 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/bschofield/pg_prefaulter/agent/hooks"
+)
+
+// checkPrefaultFailures fires an event once per streak of WAL prefault failures
+// that reaches the failure threshold.
+func (a *Agent) checkPrefaultFailures() {
+	threshold := uint64(a.hooksCfg.FailureThreshold)
+	if threshold == 0 {
+		return
+	}
+
+	switch n := a.walCache.ConsecutiveFailures(); {
+	case n == 0:
+		a.failuresNotified = false
+	case n >= threshold && !a.failuresNotified:
+		a.failuresNotified = true
+		a.fireEvent(hooks.EventPrefaultFailures, map[string]interface{}{
+			"failures":  n,
+			"threshold": threshold,
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hooks notifies operator-supplied commands and webhooks of
+// significant events observed by the agent, e.g. a promotion, so that the
+// prefaulter can be wired into other automation.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Events fired by the agent.
+const (
+	// EventRoleChange is fired when the database is promoted or demoted.
+	EventRoleChange = "role-change"
+
+	// EventTimelineSwitch is fired when the timeline being replayed changes.
+	EventTimelineSwitch = "timeline-switch"
+
+	// EventLagThreshold is fired when the lag rises above or falls back below
+	// the lag threshold.
+	EventLagThreshold = "lag-threshold"
+
+	// EventPrefaultFailures is fired when prefaulting WAL files has failed
+	// repeatedly in a row.
+	EventPrefaultFailures = "prefault-failures"
+)
+
+// Events lists every event.
+var Events = []string{EventLagThreshold, EventPrefaultFailures, EventRoleChange, EventTimelineSwitch}
+
+// EventEnv is the environment variable holding the event's name when a hook's
+// command is run.
+const EventEnv = "PG_PREFAULTER_EVENT"
+
+// passedEnv are the variables of the agent's environment passed to a hook's
+// command, along with the LC_* locale variables.  Everything else, e.g.
+// PGPASSWORD or CONSUL_HTTP_TOKEN, is withheld.
+var passedEnv = map[string]bool{
+	"HOME":    true,
+	"LANG":    true,
+	"LOGNAME": true,
+	"PATH":    true,
+	"SHELL":   true,
+	"TMPDIR":  true,
+	"TZ":      true,
+	"USER":    true,
+}
+
+// queueSize bounds the events waiting to be delivered.  Events fired while the
+// queue is full are dropped.
+const queueSize = 64
+
+var (
+	hooksDelivered = metrics.NewCounter("hooks_delivered_total", "Number of events delivered to hooks.")
+	hooksFailed    = metrics.NewCounter("hooks_failed_total", "Number of events hooks failed to handle.")
+	hooksDropped   = metrics.NewCounter("hooks_dropped_total", "Number of events dropped because too many were waiting to be delivered.")
+)
+
+// Config describes where events are delivered.
+type Config struct {
+	// Command is run by /bin/sh with the event, as JSON, on its stdin and the
+	// event's name in EventEnv.  Only the passedEnv variables of the agent's
+	// environment are passed.  An empty Command is not run.
+	Command string
+
+	// URL is POSTed the event as JSON.  An empty URL disables the webhook.
+	URL string
+
+	// Events are the events delivered.  Every event is delivered when Events is
+	// empty.
+	Events []string
+
+	// Timeout bounds each delivery.
+	Timeout time.Duration
+
+	// Labels, e.g. the cluster name, are added to every event.
+	Labels map[string]string
+}
+
+// ValidEvent returns true if name is one of Events.
+func ValidEvent(name string) bool {
+	for _, e := range Events {
+		if e == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Event is the payload delivered to hooks.
+type Event struct {
+	Name    string                 `json:"event"`
+	Time    time.Time              `json:"time"`
+	Host    string                 `json:"host,omitempty"`
+	Labels  map[string]string      `json:"labels,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Runner delivers events to the configured command and webhook, one at a time
+// and in the order they were fired.  A nil Runner drops every event.
+type Runner struct {
+	cfg    Config
+	log    zerolog.Logger
+	client *http.Client
+	host   string
+	events map[string]bool
+	queue  chan Event
+}
+
+// New returns a Runner for cfg, or nil if cfg has neither a command nor a URL.
+func New(cfg Config, log zerolog.Logger) *Runner {
+	if cfg.Command == "" && cfg.URL == "" {
+		return nil
+	}
+
+	r := &Runner{
+		cfg:    cfg,
+		log:    log,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan Event, queueSize),
+	}
+	r.host, _ = os.Hostname()
+
+	if len(cfg.Events) > 0 {
+		r.events = make(map[string]bool, len(cfg.Events))
+		for _, e := range cfg.Events {
+			r.events[e] = true
+		}
+	}
+
+	return r
+}
+
+// Fire queues the event name for delivery without blocking.
+func (r *Runner) Fire(name string, details map[string]interface{}) {
+	if r == nil || (r.events != nil && !r.events[name]) {
+		return
+	}
+
+	e := Event{
+		Name:    name,
+		Time:    time.Now().UTC(),
+		Host:    r.host,
+		Labels:  r.cfg.Labels,
+		Details: details,
+	}
+
+	select {
+	case r.queue <- e:
+	default:
+		hooksDropped.Inc()
+		r.log.Warn().Str("event", name).Msg("too many events waiting for hooks, dropping event")
+	}
+}
+
+// Run delivers events until ctx is cancelled.
+func (r *Runner) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-r.queue:
+			if err := r.deliver(ctx, e); err != nil {
+				hooksFailed.Inc()
+				r.log.Warn().Err(err).Str("event", e.Name).Msg("hook failed")
+				continue
+			}
+			hooksDelivered.Inc()
+		}
+	}
+}
+
+// deliver runs the command and POSTs to the webhook.  Both are attempted even
+// if one of them fails.
+func (r *Runner) deliver(ctx context.Context, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode event")
+	}
+
+	var errs []string
+	if r.cfg.Command != "" {
+		if err := r.runCommand(ctx, e.Name, payload); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if r.cfg.URL != "" {
+		if err := r.post(ctx, payload); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (r *Runner) runCommand(ctx context.Context, name string, payload []byte) error {
+	if r.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Timeout)
+		defer cancel()
+	}
+
+	var errbuf bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", r.cfg.Command)
+	cmd.Env = commandEnv(os.Environ(), name)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "hook command failed: %q", strings.TrimSpace(errbuf.String()))
+	}
+
+	return nil
+}
+
+// commandEnv returns the environment of a hook's command from the agent's
+// environment, environ, and the event's name.
+func commandEnv(environ []string, name string) []string {
+	var env []string
+	for _, kv := range environ {
+		key := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			key = kv[:i]
+		}
+		if passedEnv[key] || strings.HasPrefix(key, "LC_") {
+			env = append(env, kv)
+		}
+	}
+
+	return append(env, EventEnv+"="+name)
+}
+
+func (r *Runner) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "unable to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "unable to post webhook")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/rs/zerolog"
+)
+
+func TestRunnerDeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := path.Join(dir, "event")
+
+	var posted Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(req.Body).Decode(&posted); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	r := New(Config{
+		Command: `echo "$` + EventEnv + `" > ` + out + ` && cat >> ` + out,
+		URL:     srv.URL,
+		Events:  []string{EventRoleChange},
+		Timeout: 5 * time.Second,
+	}, zerolog.Nop())
+
+	e := Event{
+		Name:    EventRoleChange,
+		Time:    time.Date(2019, 3, 5, 1, 2, 3, 0, time.UTC),
+		Host:    "replica-1",
+		Labels:  map[string]string{"cluster": "orders"},
+		Details: map[string]interface{}{"from": "follower", "to": "primary"},
+	}
+	if err := r.deliver(context.Background(), e); err != nil {
+		t.Fatalf("unable to deliver: %v", err)
+	}
+
+	if diff := pretty.Compare(posted, e); diff != "" {
+		t.Fatalf("webhook diff: (-got +want)\n%s", diff)
+	}
+
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EventRoleChange + "\n" + `{"event":"role-change","time":"2019-03-05T01:02:03Z","host":"replica-1","labels":{"cluster":"orders"},"details":{"from":"follower","to":"primary"}}`
+	if string(got) != want {
+		t.Fatalf("command got %q, want %q", got, want)
+	}
+
+	// Failures are reported
+	r.cfg.Command = "exit 3"
+	if err := r.deliver(context.Background(), e); err == nil {
+		t.Fatal("failed command not reported")
+	}
+}
+
+func TestRunnerFire(t *testing.T) {
+	if r := New(Config{}, zerolog.Nop()); r != nil {
+		t.Fatal("runner without a command or URL")
+	}
+	var none *Runner
+	none.Fire(EventRoleChange, nil)
+
+	r := New(Config{Command: "true", Events: []string{EventLagThreshold}}, zerolog.Nop())
+	r.Fire(EventRoleChange, nil)
+	r.Fire(EventLagThreshold, map[string]interface{}{"exceeded": true})
+	if n := len(r.queue); n != 1 {
+		t.Fatalf("queued %d events, want 1", n)
+	}
+
+	// Events fired while the queue is full are dropped rather than blocking
+	for i := 0; i < 2*queueSize; i++ {
+		r.Fire(EventLagThreshold, nil)
+	}
+	if n := len(r.queue); n != queueSize {
+		t.Fatalf("queued %d events, want %d", n, queueSize)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin:/bin",
+		"PGPASSWORD=hunter2",
+		"CONSUL_HTTP_TOKEN=tok123",
+		"LC_ALL=C",
+		"HOME=/var/lib/postgresql",
+		"PATHOLOGICAL=1",
+	}
+
+	want := []string{
+		"PATH=/usr/bin:/bin",
+		"LC_ALL=C",
+		"HOME=/var/lib/postgresql",
+		EventEnv + "=" + EventRoleChange,
+	}
+	if diff := pretty.Compare(commandEnv(environ, EventRoleChange), want); diff != "" {
+		t.Fatalf("environment diff: (-got +want)\n%s", diff)
+	}
+}
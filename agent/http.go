@@ -0,0 +1,351 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/warmset"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+)
+
+var httpAuthFailures = metrics.NewCounter("http_auth_failures_total", "Number of HTTP requests rejected for lacking a valid bearer token or client certificate.")
+
+// startHTTP starts the health, readiness, status, and metrics listener.  The
+// listener is shutdown when the agent's shutdownCtx is cancelled.
+func (a *Agent) startHTTP() {
+	if a.cfg.HTTPListenAddr == "" {
+		a.log.Debug().Msg("http listener disabled by request")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/readyz", a.handleReadyz)
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/warmset", a.handleWarmSet)
+	mux.HandleFunc("/caches", a.handleCaches)
+	mux.HandleFunc("/readahead", a.handleReadahead)
+	mux.HandleFunc("/io-workers", a.handleIOWorkers)
+	mux.HandleFunc("/advice", a.handleAdvice)
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+
+	srv := &http.Server{
+		Addr:    a.cfg.HTTPListenAddr,
+		Handler: a.authorize(mux),
+	}
+
+	auth := a.cfg.HTTPAuth
+	if auth.TLSCA != "" {
+		pool, err := lib.LoadCertPool(auth.TLSCA)
+		if err != nil {
+			a.log.Error().Err(err).Str("next step", "exiting").Msg("unable to configure client certificate verification")
+			a.fail(lib.ConfigError(err))
+			return
+		}
+
+		// Client certificates are optional at the TLS layer so that health
+		// checks and public metrics remain reachable.  authorize() rejects
+		// everything else that lacks a verified certificate or bearer token.
+		srv.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  pool,
+		}
+	}
+
+	go func() {
+		<-a.shutdownCtx.Done()
+
+		const shutdownTimeout = 5 * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			a.log.Warn().Err(err).Msg("unable to cleanly shutdown the http listener")
+		}
+	}()
+
+	go func() {
+		a.log.Info().Str("http-listen-addr", a.cfg.HTTPListenAddr).Bool("tls", auth.TLSCert != "").
+			Bool("auth", auth.Enabled()).Msg("starting http listener")
+
+		var err error
+		switch ln := a.cfg.HTTPListener; {
+		case ln != nil && auth.TLSCert != "":
+			err = srv.ServeTLS(ln, auth.TLSCert, auth.TLSKey)
+		case ln != nil:
+			err = srv.Serve(ln)
+		case auth.TLSCert != "":
+			err = srv.ListenAndServeTLS(auth.TLSCert, auth.TLSKey)
+		default:
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			err = errors.Wrap(err, "unable to start the http listener")
+			a.log.Error().Err(err).Msg("")
+			a.fail(err)
+		}
+	}()
+}
+
+// authorize requires requests to carry the configured bearer token or a
+// verified client certificate.  Health checks, and metrics if configured, are
+// always allowed.
+func (a *Agent) authorize(next http.Handler) http.Handler {
+	auth := a.cfg.HTTPAuth
+	if !auth.Enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz", r.URL.Path == "/readyz":
+		case r.URL.Path == "/metrics" && auth.PublicMetrics:
+		case r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+		case auth.Token != "" && validBearerToken(r, auth.Token):
+		default:
+			httpAuthFailures.Inc()
+			if auth.Token != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+buildtime.PROGNAME+`"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validBearerToken returns true if r's Authorization header carries token.
+func validBearerToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(h[len(prefix):]), []byte(token)) == 1
+}
+
+// handleHealthz reports whether or not the agent is alive.
+func (a *Agent) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if lib.IsShuttingDown(a.shutdownCtx) {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether or not the agent has completed its first WAL
+// scan.  Readiness is withdrawn while the agent drains.
+func (a *Agent) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !a.isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+// handleStatus renders the agent's Status as JSON.
+func (a *Agent) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a.Status()); err != nil {
+		a.log.Warn().Err(err).Msg("unable to encode status")
+	}
+}
+
+// maxCacheTuningSize bounds the size of the request accepted by handleCaches,
+// handleReadahead, and handleIOWorkers.
+const maxCacheTuningSize = 64 << 10
+
+// handleCaches renders the capacity and TTL of the agent's caches on GET and
+// changes them on PUT.  The body of a PUT is a CacheTuning keyed by cache name,
+// e.g. {"iocache": {"size": 100000, "ttl": "1h"}}.
+func (a *Agent) handleCaches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var tunings map[string]CacheTuning
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxCacheTuningSize)).Decode(&tunings); err != nil {
+			http.Error(w, fmt.Sprintf("unable to parse cache tunings: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.tuneCaches(tunings); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a.cacheStatus()); err != nil {
+		a.log.Warn().Err(err).Msg("unable to encode cache status")
+	}
+}
+
+// handleReadahead renders the amount of WAL read ahead of PostgreSQL and its
+// bounds on GET and changes them on PUT, e.g. {"readahead-bytes": "128MiB"}.
+func (a *Agent) handleReadahead(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if a.walCache == nil {
+			http.Error(w, errWALCacheNotRunning.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	case http.MethodPut:
+		var ra Readahead
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxCacheTuningSize)).Decode(&ra); err != nil {
+			http.Error(w, fmt.Sprintf("unable to parse readahead: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.setReadahead(ra, requester(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a.readahead()); err != nil {
+		a.log.Warn().Err(err).Msg("unable to encode readahead")
+	}
+}
+
+// handleIOWorkers renders the number of IO workers on GET and grows or shrinks
+// the IO worker pools on PUT, e.g. {"io-workers": 64}.
+func (a *Agent) handleIOWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if a.ioCache == nil {
+			http.Error(w, errIOCacheNotRunning.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	case http.MethodPut:
+		var workers IOWorkers
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxCacheTuningSize)).Decode(&workers); err != nil {
+			http.Error(w, fmt.Sprintf("unable to parse io workers: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.setIOWorkers(workers, requester(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(IOWorkers{Workers: a.ioCache.Workers()}); err != nil {
+		a.log.Warn().Err(err).Msg("unable to encode io workers")
+	}
+}
+
+// maxWarmSetManifestSize bounds the size of a warm set manifest accepted by
+// handleWarmSet.
+const maxWarmSetManifestSize = 64 << 20
+
+// handleWarmSet exports the agent's warm set on GET and imports a warm set
+// exported by another replica on POST.  Imported blocks are prefaulted
+// immediately.  GET accepts a limit parameter that returns only the most
+// recently prefaulted blocks, which is how peers exchange hints.
+func (a *Agent) handleWarmSet(w http.ResponseWriter, r *http.Request) {
+	if a.warmSet == nil {
+		http.Error(w, "warm set disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var limit uint64
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a.warmSet.Top(limit)); err != nil {
+			a.log.Warn().Err(err).Msg("unable to encode warm set")
+		}
+	case http.MethodPost:
+		var m warmset.Manifest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxWarmSetManifestSize)).Decode(&m); err != nil {
+			http.Error(w, fmt.Sprintf("unable to parse warm set: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.warmSet.Import(m); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		go a.replayWarmSet()
+
+		a.log.Info().Int("ranges", len(m.Ranges)).Uint64("blocks", m.Blocks()).Msg("imported warm set")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "imported %d blocks\n", m.Blocks())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdvice renders the advisor's current recommendations.
+func (a *Agent) handleAdvice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a.advisor.Report(time.Now())); err != nil {
+		a.log.Warn().Err(err).Msg("unable to encode advice")
+	}
+}
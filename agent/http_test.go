@@ -0,0 +1,319 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/advisor"
+	"github.com/bschofield/pg_prefaulter/agent/walcache"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestAuthorize(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	tests := []struct {
+		auth   config.HTTPAuth
+		path   string
+		header string
+		tls    *tls.ConnectionState
+		status int
+	}{
+		{ // 0: authentication disabled
+			path:   "/status",
+			status: http.StatusOK,
+		},
+		{ // 1
+			auth:   config.HTTPAuth{Token: "s3cret"},
+			path:   "/status",
+			status: http.StatusUnauthorized,
+		},
+		{ // 2
+			auth:   config.HTTPAuth{Token: "s3cret"},
+			path:   "/status",
+			header: "Bearer s3cret",
+			status: http.StatusOK,
+		},
+		{ // 3
+			auth:   config.HTTPAuth{Token: "s3cret"},
+			path:   "/warmset",
+			header: "Bearer s3cre",
+			status: http.StatusUnauthorized,
+		},
+		{ // 4: probes are always allowed
+			auth:   config.HTTPAuth{Token: "s3cret"},
+			path:   "/readyz",
+			status: http.StatusOK,
+		},
+		{ // 5
+			auth:   config.HTTPAuth{Token: "s3cret"},
+			path:   "/metrics",
+			status: http.StatusUnauthorized,
+		},
+		{ // 6
+			auth:   config.HTTPAuth{Token: "s3cret", PublicMetrics: true},
+			path:   "/metrics",
+			status: http.StatusOK,
+		},
+		{ // 7: mTLS without a client certificate
+			auth:   config.HTTPAuth{TLSCA: "ca.pem"},
+			path:   "/status",
+			tls:    &tls.ConnectionState{},
+			status: http.StatusUnauthorized,
+		},
+		{ // 8
+			auth:   config.HTTPAuth{TLSCA: "ca.pem"},
+			path:   "/status",
+			tls:    verified,
+			status: http.StatusOK,
+		},
+		{ // 9: a client certificate stands in for the token
+			auth:   config.HTTPAuth{TLSCA: "ca.pem", Token: "s3cret"},
+			path:   "/warmset",
+			tls:    verified,
+			status: http.StatusOK,
+		},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for n, test := range tests {
+		a := &Agent{cfg: &config.Agent{HTTPAuth: test.auth}}
+
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.TLS = test.tls
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+
+		w := httptest.NewRecorder()
+		a.authorize(ok).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%d: status %d, want %d", n, w.Code, test.status)
+		}
+	}
+}
+
+func TestHandleCaches(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{ // 0
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{ // 1
+			method: http.MethodPut,
+			body:   `{}`,
+			status: http.StatusOK,
+		},
+		{ // 2
+			method: http.MethodPut,
+			body:   `{"iocache": {"size": "big"}}`,
+			status: http.StatusBadRequest,
+		},
+		{ // 3: the cache isn't running
+			method: http.MethodPut,
+			body:   `{"iocache": {"size": 1000}}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{ // 4
+			method: http.MethodPost,
+			body:   `{}`,
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for n, test := range tests {
+		a := &Agent{cfg: &config.Agent{}}
+
+		r := httptest.NewRequest(test.method, "/caches", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		a.handleCaches(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%d: status %d, want %d: %s", n, w.Code, test.status, w.Body)
+		}
+	}
+}
+
+func TestHandleReadahead(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{ // 0: the WAL cache isn't running
+			method: http.MethodGet,
+			status: http.StatusServiceUnavailable,
+		},
+		{ // 1
+			method: http.MethodPut,
+			body:   `{"readahead-bytes": 64}`,
+			status: http.StatusBadRequest,
+		},
+		{ // 2: the WAL cache isn't running
+			method: http.MethodPut,
+			body:   `{"readahead-bytes": "64MiB"}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{ // 3
+			method: http.MethodPost,
+			body:   `{}`,
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for n, test := range tests {
+		a := &Agent{cfg: &config.Agent{}}
+
+		r := httptest.NewRequest(test.method, "/readahead", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		a.handleReadahead(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%d: status %d, want %d: %s", n, w.Code, test.status, w.Body)
+		}
+	}
+}
+
+func TestHandleReadaheadBounds(t *testing.T) {
+	a := &Agent{cfg: &config.Agent{}, walCache: &walcache.WALCache{}}
+	if err := a.walCache.SetReadahead(32*units.MiB, 0, units.GiB); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+		want   Readahead
+	}{
+		{ // 0
+			body:   `{}`,
+			status: http.StatusUnprocessableEntity,
+			want:   Readahead{Bytes: "32MiB", MinBytes: "0B", MaxBytes: "1GiB"},
+		},
+		{ // 1: lowering the maximum lowers the readahead
+			body:   `{"readahead-max-bytes": "16MiB"}`,
+			status: http.StatusOK,
+			want:   Readahead{Bytes: "16MiB", MinBytes: "0B", MaxBytes: "16MiB"},
+		},
+		{ // 2
+			body:   `{"readahead-bytes": "64MiB"}`,
+			status: http.StatusUnprocessableEntity,
+			want:   Readahead{Bytes: "16MiB", MinBytes: "0B", MaxBytes: "16MiB"},
+		},
+		{ // 3
+			body:   `{"readahead-bytes": "64MiB", "readahead-max-bytes": "128MiB"}`,
+			status: http.StatusOK,
+			want:   Readahead{Bytes: "64MiB", MinBytes: "0B", MaxBytes: "128MiB"},
+		},
+		{ // 4: above the cap
+			body:   `{"readahead-max-bytes": "1TiB"}`,
+			status: http.StatusUnprocessableEntity,
+			want:   Readahead{Bytes: "64MiB", MinBytes: "0B", MaxBytes: "128MiB"},
+		},
+	}
+
+	for n, test := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/readahead", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		a.handleReadahead(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%d: status %d, want %d: %s", n, w.Code, test.status, w.Body)
+		}
+		if diff := pretty.Compare(a.readahead(), test.want); diff != "" {
+			t.Fatalf("%d: readahead diff: (-got +want)\n%s", n, diff)
+		}
+	}
+
+	var changes int
+	for _, e := range a.recentEvents.list() {
+		if e.Name == "readahead-change" {
+			changes++
+		}
+	}
+	if changes != 2 {
+		t.Fatalf("%d readahead changes recorded, want 2", changes)
+	}
+}
+
+func TestHandleAdvice(t *testing.T) {
+	a := &Agent{cfg: &config.Agent{}, advisor: advisor.New(adviceObservations)}
+
+	w := httptest.NewRecorder()
+	a.handleAdvice(w, httptest.NewRequest(http.MethodGet, "/advice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var report advisor.Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("unable to parse advice: %v", err)
+	}
+	if report.Observations != 0 || len(report.Advice) != 0 {
+		t.Fatalf("advice without observations: %+v", report)
+	}
+
+	w = httptest.NewRecorder()
+	a.handleAdvice(w, httptest.NewRequest(http.MethodPost, "/advice", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusMethodNotAllowed, w.Body)
+	}
+}
+
+func TestHandleIOWorkers(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{ // 0: the IO cache isn't running
+			method: http.MethodGet,
+			status: http.StatusServiceUnavailable,
+		},
+		{ // 1
+			method: http.MethodPut,
+			body:   `{"io-workers": -1}`,
+			status: http.StatusBadRequest,
+		},
+		{ // 2: the IO cache isn't running
+			method: http.MethodPut,
+			body:   `{"io-workers": 64}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{ // 3
+			method: http.MethodDelete,
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for n, test := range tests {
+		a := &Agent{cfg: &config.Agent{}}
+
+		r := httptest.NewRequest(test.method, "/io-workers", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		a.handleIOWorkers(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%d: status %d, want %d: %s", n, w.Code, test.status, w.Body)
+		}
+	}
+}
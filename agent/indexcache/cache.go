@@ -0,0 +1,227 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package indexcache prefaults the indexes and TOAST tables of the relations
+// referenced by the WAL.  A heap record doesn't name the indexes that the
+// following index insertion records will modify, nor the TOAST table that
+// holds a wide row's out-of-line values, so the first time a relation is seen
+// its indexes and TOAST table are looked up in the catalog and their tail
+// blocks (and each index's metapage) are prefaulted ahead of their records.
+package indexcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/iocache"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/rs/zerolog"
+)
+
+// maxConcurrentLookups bounds the number of catalog queries in flight so that
+// index lookups don't starve the agent's other uses of the connection pool.
+const maxConcurrentLookups = 2
+
+var (
+	indexLookups     = metrics.NewCounter("index_lookups_total", "Number of relations whose indexes or TOAST table were looked up in the catalog.")
+	indexLookupFails = metrics.NewCounter("index_lookup_failures_total", "Number of catalog lookups of a relation's indexes or TOAST table that failed.")
+	indexBlocksTotal = metrics.NewCounter("index_blocks_prefaulted_total", "Number of index blocks scheduled for prefaulting by catalog lookups.")
+	toastBlocksTotal = metrics.NewCounter("toast_blocks_prefaulted_total", "Number of TOAST table blocks scheduled for prefaulting by catalog lookups.")
+)
+
+// Catalog looks up the indexes and TOAST table of a relation.  Catalog is
+// implemented by the agent to defeat cyclic import restrictions.
+type Catalog interface {
+	// QueryIndexes returns the B-tree indexes of the relation stored in
+	// tablespace/database/relation.
+	QueryIndexes(tablespace, database, relation pg.OID) ([]pg.Index, error)
+
+	// QueryToast returns the TOAST table of the relation stored in
+	// tablespace/database/relation.  found is false if the relation has no
+	// TOAST table.
+	QueryToast(tablespace, database, relation pg.OID) (toast pg.Toast, found bool, err error)
+}
+
+// IndexCache remembers the relations whose indexes and TOAST table have been
+// prefaulted.
+type IndexCache struct {
+	ctx     context.Context
+	log     zerolog.Logger
+	cfg     *config.IndexCacheConfig
+	c       gcache.Cache
+	ioCache *iocache.IOCache
+	catalog Catalog
+
+	// lookupSem limits the number of concurrent catalog lookups.
+	lookupSem chan struct{}
+}
+
+// New creates a new IndexCache.
+func New(ctx context.Context, cfg *config.Config, ioCache *iocache.IOCache, catalog Catalog) *IndexCache {
+	ic := &IndexCache{
+		ctx:       ctx,
+		log:       *lib.Logger(ctx),
+		cfg:       &cfg.IndexCacheConfig,
+		ioCache:   ioCache,
+		catalog:   catalog,
+		lookupSem: make(chan struct{}, maxConcurrentLookups),
+	}
+
+	ic.c = gcache.New(int(ic.cfg.Size)).
+		ARC().
+		LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
+			ic.load(key.(structs.IOCacheKey))
+			return struct{}{}, &ic.cfg.TTL, nil
+		}).
+		Build()
+
+	go lib.LogCacheStats(ic.ctx, ic.c, "indexcache-stats")
+
+	ic.log.Info().Bool("indexes", ic.cfg.Enable).Bool("toast", ic.cfg.Toast).
+		Uint("index-tail-blocks", ic.cfg.TailBlocks).Msg("prefaulting related relations")
+
+	return ic
+}
+
+// Observe notes that ioReq's relation was referenced by the WAL.  The first
+// time a relation is observed its indexes and TOAST table are looked up and
+// prefaulted in the background.
+func (ic *IndexCache) Observe(ioReq structs.IOCacheKey) {
+	if ioReq.SLRU != pg.SLRUNone {
+		return
+	}
+
+	key := structs.IOCacheKey{
+		Tablespace: ioReq.Tablespace,
+		Database:   ioReq.Database,
+		Relation:   ioReq.Relation,
+	}
+
+	// A miss schedules a lookup in the background.
+	switch _, err := ic.c.GetIFPresent(key); {
+	case err == nil, err == gcache.KeyNotFoundError:
+	default:
+		ic.log.Debug().Err(err).Msg("indexcache Observe()")
+	}
+}
+
+// load looks up the indexes and TOAST table of rel and schedules their blocks
+// to be prefaulted.  Failures are remembered the same as a relation without
+// indexes so that the catalog isn't queried for every record referencing rel.
+func (ic *IndexCache) load(rel structs.IOCacheKey) {
+	select {
+	case <-ic.ctx.Done():
+		return
+	case ic.lookupSem <- struct{}{}:
+	}
+	defer func() { <-ic.lookupSem }()
+
+	indexLookups.Inc()
+
+	if ic.cfg.Enable {
+		ic.loadIndexes(rel.Tablespace, rel.Database, rel.Relation)
+	}
+
+	if !ic.cfg.Toast {
+		return
+	}
+
+	toast, found, err := ic.catalog.QueryToast(rel.Tablespace, rel.Database, rel.Relation)
+	switch {
+	case err != nil:
+		indexLookupFails.Inc()
+		ic.log.Debug().Err(err).Uint64("database", uint64(rel.Database)).
+			Uint64("relation", uint64(rel.Relation)).Msg("unable to look up TOAST table")
+		return
+	case !found:
+		return
+	}
+
+	// New chunks are appended to the end of the TOAST table and are located
+	// via the TOAST table's index.
+	for _, block := range TailBlocks(toast.Blocks, ic.cfg.TailBlocks) {
+		toastBlocksTotal.Inc()
+		ic.prefault(toast.Tablespace, rel.Database, toast.Relation, block)
+	}
+	ic.loadIndexes(toast.Tablespace, rel.Database, toast.Relation)
+}
+
+// loadIndexes looks up the indexes of a relation and schedules their blocks to
+// be prefaulted.
+func (ic *IndexCache) loadIndexes(tablespace, database, relation pg.OID) {
+	indexes, err := ic.catalog.QueryIndexes(tablespace, database, relation)
+	if err != nil {
+		indexLookupFails.Inc()
+		ic.log.Debug().Err(err).Uint64("database", uint64(database)).
+			Uint64("relation", uint64(relation)).Msg("unable to look up indexes")
+		return
+	}
+
+	for _, index := range indexes {
+		for _, block := range IndexBlocks(index.Blocks, ic.cfg.TailBlocks) {
+			indexBlocksTotal.Inc()
+			ic.prefault(index.Tablespace, database, index.Relation, block)
+		}
+	}
+}
+
+// prefault schedules a block to be prefaulted via the ioCache.
+func (ic *IndexCache) prefault(tablespace, database, relation pg.OID, block pg.HeapBlockNumber) {
+	_, err := ic.ioCache.GetIFPresent(structs.IOCacheKey{
+		Tablespace: tablespace,
+		Database:   database,
+		Relation:   relation,
+		Block:      block,
+	})
+	if err != nil && err != gcache.KeyNotFoundError {
+		ic.log.Debug().Err(err).Msg("iocache related relation prefault")
+	}
+}
+
+// TailBlocks returns the last tail blocks of a relation of size blocks.
+func TailBlocks(blocks pg.HeapBlockNumber, tail uint) []pg.HeapBlockNumber {
+	first := pg.HeapBlockNumber(0)
+	if blocks > pg.HeapBlockNumber(tail) {
+		first = blocks - pg.HeapBlockNumber(tail)
+	}
+
+	var pages []pg.HeapBlockNumber
+	for block := first; block < blocks; block++ {
+		pages = append(pages, block)
+	}
+
+	return pages
+}
+
+// IndexBlocks returns the blocks of an index of size blocks that are
+// prefaulted: the B-tree metapage, which is read by every insertion, and the
+// last tail blocks, where insertions of increasing keys land.
+func IndexBlocks(blocks pg.HeapBlockNumber, tail uint) []pg.HeapBlockNumber {
+	if blocks == 0 {
+		return nil
+	}
+
+	pages := []pg.HeapBlockNumber{0}
+	for _, block := range TailBlocks(blocks, tail) {
+		if block != 0 {
+			pages = append(pages, block)
+		}
+	}
+
+	return pages
+}
@@ -0,0 +1,98 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexcache
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestTailBlocks(t *testing.T) {
+	tests := []struct {
+		blocks pg.HeapBlockNumber
+		tail   uint
+		pages  []pg.HeapBlockNumber
+	}{
+		{ // 0
+			blocks: 0,
+			tail:   4,
+		},
+		{ // 1
+			blocks: 2,
+			tail:   4,
+			pages:  []pg.HeapBlockNumber{0, 1},
+		},
+		{ // 2
+			blocks: 100,
+			tail:   4,
+			pages:  []pg.HeapBlockNumber{96, 97, 98, 99},
+		},
+		{ // 3
+			blocks: 100,
+			tail:   0,
+		},
+	}
+
+	for n, test := range tests {
+		if diff := pretty.Compare(TailBlocks(test.blocks, test.tail), test.pages); diff != "" {
+			t.Fatalf("%d: pages diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestIndexBlocks(t *testing.T) {
+	tests := []struct {
+		blocks pg.HeapBlockNumber
+		tail   uint
+		pages  []pg.HeapBlockNumber
+	}{
+		{ // 0
+			blocks: 0,
+			tail:   4,
+		},
+		{ // 1
+			blocks: 1,
+			tail:   4,
+			pages:  []pg.HeapBlockNumber{0},
+		},
+		{ // 2
+			blocks: 3,
+			tail:   4,
+			pages:  []pg.HeapBlockNumber{0, 1, 2},
+		},
+		{ // 3
+			blocks: 5,
+			tail:   4,
+			pages:  []pg.HeapBlockNumber{0, 1, 2, 3, 4},
+		},
+		{ // 4
+			blocks: 100,
+			tail:   4,
+			pages:  []pg.HeapBlockNumber{0, 96, 97, 98, 99},
+		},
+		{ // 5
+			blocks: 100,
+			tail:   0,
+			pages:  []pg.HeapBlockNumber{0},
+		},
+	}
+
+	for n, test := range tests {
+		if diff := pretty.Compare(IndexBlocks(test.blocks, test.tail), test.pages); diff != "" {
+			t.Fatalf("%d: pages diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// QueryIndexes looks up the B-tree indexes of a relation referenced by the WAL.
+// Only relations in the database the agent is connected to can be resolved.
+func (a *Agent) QueryIndexes(tablespace, database, relation pg.OID) ([]pg.Index, error) {
+	a.pgStateLock.RLock()
+	pool := a.pool
+	a.pgStateLock.RUnlock()
+	if pool == nil {
+		return nil, errors.New("no database connection")
+	}
+
+	return pg.QueryIndexes(a.shutdownCtx, pool, tablespace, database, relation)
+}
+
+// QueryToast looks up the TOAST table of a relation referenced by the WAL.
+// Only relations in the database the agent is connected to can be resolved.
+func (a *Agent) QueryToast(tablespace, database, relation pg.OID) (pg.Toast, bool, error) {
+	a.pgStateLock.RLock()
+	pool := a.pool
+	a.pgStateLock.RUnlock()
+	if pool == nil {
+		return pg.Toast{}, false, errors.New("no database connection")
+	}
+
+	return pg.QueryToast(a.shutdownCtx, pool, tablespace, database, relation)
+}
@@ -0,0 +1,117 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+)
+
+// maxBatchSize bounds the number of requests accumulated before a batch is
+// dispatched early.
+const maxBatchSize = 4096
+
+// batcher accumulates IO requests for up to window, sorts them by file and
+// block, drops duplicates, and hands them to dispatch in order.  Requests
+// arrive in WAL order, which is effectively random with respect to the heap.
+type batcher struct {
+	window   time.Duration
+	in       chan structs.IOCacheKey
+	dispatch func(structs.IOCacheKey)
+
+	// drop is called for every duplicate request removed from a batch.
+	drop func(structs.IOCacheKey)
+}
+
+func newBatcher(window time.Duration, dispatch, drop func(structs.IOCacheKey)) *batcher {
+	return &batcher{
+		window:   window,
+		in:       make(chan structs.IOCacheKey, maxBatchSize),
+		dispatch: dispatch,
+		drop:     drop,
+	}
+}
+
+// add queues ioReq for the next batch.  add blocks if the batcher is backed up
+// and returns false if ctx is cancelled first.
+func (b *batcher) add(ctx context.Context, ioReq structs.IOCacheKey) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case b.in <- ioReq:
+		return true
+	}
+}
+
+// run accumulates and dispatches batches until ctx is cancelled.
+func (b *batcher) run(ctx context.Context) {
+	batch := make([]structs.IOCacheKey, 0, maxBatchSize)
+	var timer *time.Timer
+	var timerC <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+
+		sorted, dups := sortBatch(batch)
+		for _, ioReq := range dups {
+			b.drop(ioReq)
+		}
+		for _, ioReq := range sorted {
+			b.dispatch(ioReq)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ioReq := <-b.in:
+			batch = append(batch, ioReq)
+			if len(batch) == 1 {
+				timer = time.NewTimer(b.window)
+				timerC = timer.C
+			}
+
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-timerC:
+			flush()
+		}
+	}
+}
+
+// sortBatch sorts batch in place by file and block and returns the unique
+// requests along with the duplicates that were removed.
+func sortBatch(batch []structs.IOCacheKey) (sorted, dups []structs.IOCacheKey) {
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Less(batch[j]) })
+
+	sorted = batch[:0]
+	for i, ioReq := range batch {
+		if i > 0 && ioReq == sorted[len(sorted)-1] {
+			dups = append(dups, ioReq)
+			continue
+		}
+		sorted = append(sorted, ioReq)
+	}
+
+	return sorted, dups
+}
@@ -0,0 +1,117 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSortBatch(t *testing.T) {
+	key := func(relation pg.OID, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: relation, Block: block}
+	}
+
+	tests := []struct {
+		name string
+		in   []structs.IOCacheKey
+		want []structs.IOCacheKey
+		dups []structs.IOCacheKey
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "sorted by relation then block",
+			in:   []structs.IOCacheKey{key(2, 5), key(1, 9), key(2, 1), key(1, 3)},
+			want: []structs.IOCacheKey{key(1, 3), key(1, 9), key(2, 1), key(2, 5)},
+		},
+		{
+			name: "duplicates merged",
+			in:   []structs.IOCacheKey{key(1, 3), key(2, 1), key(1, 3), key(1, 3), key(2, 1)},
+			want: []structs.IOCacheKey{key(1, 3), key(2, 1)},
+			dups: []structs.IOCacheKey{key(1, 3), key(1, 3), key(2, 1)},
+		},
+		{
+			name: "SLRU pages after relations",
+			in:   []structs.IOCacheKey{{SLRU: pg.SLRUXact, Block: 1}, key(9, 9)},
+			want: []structs.IOCacheKey{key(9, 9), {SLRU: pg.SLRUXact, Block: 1}},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			got, dups := sortBatch(test.in)
+			if diff := pretty.Compare(got, test.want); diff != "" {
+				t.Fatalf("sorted diff: (-got +want)\n%s", diff)
+			}
+			if diff := pretty.Compare(dups, test.dups); diff != "" {
+				t.Fatalf("dups diff: (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	var dispatched []pg.HeapBlockNumber
+	var dropped int
+	done := make(chan struct{})
+	b := newBatcher(10*time.Millisecond,
+		func(ioReq structs.IOCacheKey) {
+			lock.Lock()
+			defer lock.Unlock()
+			dispatched = append(dispatched, ioReq.Block)
+			if len(dispatched) == 3 {
+				close(done)
+			}
+		},
+		func(structs.IOCacheKey) {
+			lock.Lock()
+			defer lock.Unlock()
+			dropped++
+		})
+	go b.run(ctx)
+
+	for _, block := range []pg.HeapBlockNumber{7, 2, 7, 5} {
+		if !b.add(ctx, structs.IOCacheKey{Block: block}) {
+			t.Fatalf("unable to add block %d", block)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("batch not dispatched")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if diff := pretty.Compare(dispatched, []pg.HeapBlockNumber{2, 5, 7}); diff != "" {
+		t.Fatalf("dispatch order diff: (-got +want)\n%s", diff)
+	}
+	if dropped != 1 {
+		t.Fatalf("expected 1 dropped request, got %d", dropped)
+	}
+}
@@ -15,15 +15,34 @@ package iocache
 
 import (
 	"context"
+	"fmt"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluele/gcache"
 	"github.com/bschofield/pg_prefaulter/agent/fhcache"
+	"github.com/bschofield/pg_prefaulter/agent/maintenance"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/sandbox"
+	"github.com/bschofield/pg_prefaulter/agent/sched"
+	"github.com/bschofield/pg_prefaulter/agent/stallhist"
 	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/agent/warmset"
 	"github.com/bschofield/pg_prefaulter/config"
 	"github.com/bschofield/pg_prefaulter/lib"
-	log "github.com/rs/zerolog/log"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+var (
+	boostedIOs           = metrics.NewCounter("prefault_boosted_total", "Number of IOs prioritized because of their relation's replay stall history.")
+	ioWorkers            = metrics.NewGauge("io_workers", "Number of IO worker threads.")
+	pagesPrefaulted      = metrics.NewCounter("prefault_pages_total", "Number of pages prefaulted.")
+	relationsInvalidated = metrics.NewCounter("relations_invalidated_total", "Number of dropped or truncated relations whose pages and file handles were invalidated.")
 )
 
 // IOCache is a read-through cache to:
@@ -37,78 +56,552 @@ import (
 //    vs performing cache hits.
 type IOCache struct {
 	ctx context.Context
+	log zerolog.Logger
 	wg  sync.WaitGroup
 	cfg *config.IOCacheConfig
 
+	// pending is the number of IO requests that have been scheduled but have not
+	// completed.  pending is accessed atomically.
+	pending int64
+
 	purgeLock sync.Mutex
-	c         gcache.Cache
+	c         *lib.TunableCache
 	fhCache   *fhcache.FileHandleCache
+
+	// workQueue feeds the shared IO workers.  Requests on priorityQueue are
+	// serviced ahead of requests on workQueue.
+	workQueue     chan structs.IOCacheKey
+	priorityQueue chan structs.IOCacheKey
+	workers       *pool
+
+	// stallHistory identifies relations whose IOs are prioritized.
+	// stallHistory is nil when prioritization is disabled.
+	stallHistory *stallhist.History
+
+	// warmSet is told about every page prefaulted.  warmSet is nil when the
+	// warm set is disabled.
+	warmSet *warmset.Set
+
+	// batcher sorts and deduplicates requests before they are dispatched.
+	// batcher is nil when batching is disabled.
+	batcher *batcher
+
+	// throttle keeps reads under the cgroup's io.max.  throttle is nil when
+	// throttling is disabled.
+	throttle *throttle
+
+	// maintenance pauses or limits IOs during maintenance windows.
+	// maintenance is nil when no maintenance windows are configured.
+	maintenance *maintenanceLimiter
+
+	// savings estimates the replay time saved by prefaulting.
+	savings savings
+
+	// residency samples whether prefaulted pages were already resident.
+	residency residency
+
+	// latencies holds the latency of the most recent prefault reads.
+	latencies latencies
+
+	// elevators contains the per-device queues used when the elevator is
+	// enabled, keyed by device ID.  elevatorsLock also protects numWorkers, the
+	// number of workers in the shared pool and in each elevator's pool.
+	elevatorsLock sync.Mutex
+	elevators     map[uint64]*elevator
+	numWorkers    uint
+
+	// blocksPerRecord is the number of pages in each record relation segments
+	// are read in.  Requests are aligned to the first page of their record so
+	// that each record is only read once.
+	blocksPerRecord uint64
+
+	// pgDataPath is the only directory sandboxed IO workers may read from.
+	pgDataPath string
 }
 
 // New creates a new IOCache.
-func New(ctx context.Context, cfg *config.Config, fhc *fhcache.FileHandleCache) (*IOCache, error) {
+func New(ctx context.Context, cfg *config.Config, fhc *fhcache.FileHandleCache,
+	stallHistory *stallhist.History, warmSet *warmset.Set, schedule *maintenance.Schedule) (*IOCache, error) {
 	ioc := &IOCache{
-		ctx:     ctx,
-		cfg:     &cfg.IOCacheConfig,
-		fhCache: fhc,
-	}
-
-	ioWorkQueue := make(chan structs.IOCacheKey)
-	for ioWorker := uint(0); ioWorker < ioc.cfg.MaxConcurrentIOs; ioWorker++ {
-		ioc.wg.Add(1)
-		go func(threadID uint) {
-			defer func() {
-				ioc.wg.Done()
-			}()
-
-			for {
-				select {
-				case <-ioc.ctx.Done():
-					return
-				case ioReq, ok := <-ioWorkQueue:
-					if !ok {
-						return
-					}
-
-					if err := ioc.fhCache.PrefaultPage(ioReq); err != nil {
-						// If we had a problem prefaulting in the WAL file, for whatever
-						// reason, attempt to remove it from the cache.
-						ioc.c.Remove(ioReq)
-
-						log.Warn().Uint("io-worker-thread-id", threadID).Err(err).
-							Uint64("database", uint64(ioReq.Database)).
-							Uint64("relation", uint64(ioReq.Relation)).
-							Uint64("block", uint64(ioReq.Block)).Msg("unable to prefault page")
-					}
+		ctx:          ctx,
+		log:          *lib.Logger(ctx),
+		cfg:          &cfg.IOCacheConfig,
+		fhCache:      fhc,
+		stallHistory: stallHistory,
+		warmSet:      warmSet,
+		pgDataPath:   cfg.FHCacheConfig.PGDataPath,
+
+		elevators: make(map[uint64]*elevator),
+	}
+
+	if recordSize := cfg.FHCacheConfig.RecordSize; recordSize > 0 {
+		ioc.blocksPerRecord = uint64(recordSize / cfg.FHCacheConfig.BlockSize)
+	}
+
+	if ioc.cfg.Sandbox && !sandbox.Supported {
+		return nil, sandbox.ErrUnsupported
+	}
+	if ioc.cfg.Sandbox && !sandbox.PathsConfined() {
+		ioc.log.Warn().Str("next step", "use Linux 5.13 or newer with Landlock enabled").
+			Msg("sandboxed IO workers can read files outside of PGDATA")
+	}
+
+	if ioc.prioritized() && !sched.Supported {
+		return nil, sched.ErrUnsupported
+	}
+
+	ioc.workQueue = make(chan structs.IOCacheKey)
+	ioc.priorityQueue = make(chan structs.IOCacheKey)
+	ioc.workers = &pool{wg: &ioc.wg, confine: ioc.confineWorker, work: ioc.work}
+	ioc.numWorkers = ioc.cfg.MaxConcurrentIOs
+	if err := ioc.workers.resize(ioc.numWorkers); err != nil {
+		return nil, errors.Wrap(err, "unable to confine IO worker")
+	}
+	ioWorkers.Set(float64(ioc.numWorkers))
+	ioc.log.Info().Uint("io-worker-threads", ioc.cfg.MaxConcurrentIOs).Bool("io-elevator", ioc.cfg.Elevator).
+		Dur("io-batch-window", ioc.cfg.BatchWindow).Bool("sandbox", ioc.cfg.Sandbox).Int("io-nice", ioc.cfg.Nice).
+		Str("io-class", ioc.cfg.IOClass.String()).Int("io-priority", ioc.cfg.IOPriority).Msg("started IO worker threads")
+
+	if ioc.cfg.IOMaxFraction > 0 {
+		// Every read is accounted as a whole record when reading records.
+		readSize := cfg.FHCacheConfig.BlockSize
+		if cfg.FHCacheConfig.RecordSize > readSize {
+			readSize = cfg.FHCacheConfig.RecordSize
+		}
+		ioc.throttle = newThrottle(ioc.log, ioc.cfg.IOMaxFraction, readSize, ioc.fhCache.Device)
+		if err := ioc.throttle.refresh(); err != nil {
+			ioc.log.Warn().Err(err).Msg("unable to read cgroup io.max limits")
+		}
+		go ioc.throttle.run(ioc.ctx)
+	}
+
+	if schedule != nil {
+		ioc.maintenance = newMaintenanceLimiter(schedule)
+	}
+
+	if ioc.cfg.BatchWindow > 0 {
+		ioc.batcher = newBatcher(ioc.cfg.BatchWindow, ioc.dispatch, func(structs.IOCacheKey) {
+			atomic.AddInt64(&ioc.pending, -1)
+		})
+		go ioc.batcher.run(ioc.ctx)
+	}
+
+	ioc.c = lib.NewTunableCache(int(ioc.cfg.Size), ioc.cfg.TTL, func(size int) *gcache.CacheBuilder {
+		return gcache.New(size).
+			ARC().
+			LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
+				ioReq := key.(structs.IOCacheKey)
+				atomic.AddInt64(&ioc.pending, 1)
+
+				switch {
+				case ioc.batcher == nil:
+					ioc.dispatch(ioReq)
+				case !ioc.batcher.add(ioc.ctx, ioReq):
+					atomic.AddInt64(&ioc.pending, -1)
 				}
+
+				return struct{}{}, ioc.c.TTL(), nil
+
+			})
+	}, nil)
+
+	metrics.DefaultRegistry.GaugeFunc("io_pending", "Number of IOs scheduled but not yet completed.",
+		func() float64 { return float64(ioc.NumPending()) })
+	metrics.DefaultRegistry.GaugeFunc("replay_seconds_saved", "Estimated seconds of WAL replay saved by prefaulting pages that weren't resident.",
+		func() float64 { _, saved := ioc.Savings(); return saved.Seconds() })
+	metrics.DefaultRegistry.CounterFunc("prefault_useful_total", "Number of prefaults whose read was slow enough that the page wasn't resident.",
+		func() float64 { useful, _ := ioc.Savings(); return float64(useful) })
+	metrics.DefaultRegistry.GaugeFunc("resident_read_seconds", "Sampled latency of reading a page that is already resident.",
+		func() float64 { return ioc.savings.residentLatency().Seconds() })
+	for _, quantile := range []float64{0.5, 0.99} {
+		quantile := quantile
+		metrics.DefaultRegistry.GaugeFunc("prefault_read_seconds", "Latency of recent prefault reads.",
+			func() float64 { return ioc.ReadLatency(quantile).Seconds() },
+			metrics.Label{Name: "quantile", Value: strconv.FormatFloat(quantile, 'g', -1, 64)})
+	}
+
+	go lib.LogCacheStats(ioc.ctx, ioc.c, "iocache-stats")
+
+	return ioc, nil
+}
+
+// work services the shared work queues until quit is closed or the IOCache is
+// shutdown.  Requests on priorityQueue are serviced first.
+func (ioc *IOCache) work(threadID uint, quit <-chan struct{}) {
+	for {
+		select {
+		case ioReq := <-ioc.priorityQueue:
+			ioc.prefault(threadID, ioReq)
+			continue
+		default:
+		}
+
+		select {
+		case <-ioc.ctx.Done():
+			return
+		case <-quit:
+			return
+		case ioReq := <-ioc.priorityQueue:
+			ioc.prefault(threadID, ioReq)
+		case ioReq, ok := <-ioc.workQueue:
+			if !ok {
+				return
 			}
-		}(ioWorker)
+
+			ioc.prefault(threadID, ioReq)
+		}
+	}
+}
+
+// dispatch hands ioReq to its device's elevator, if enabled, or to the shared
+// IO workers.  Requests for relations with a history of stalling replay skip
+// the elevator and are serviced ahead of other requests.  dispatch blocks while
+// reads are throttled and drops ioReq while prefaulting is paused.
+func (ioc *IOCache) dispatch(ioReq structs.IOCacheKey) {
+	if !ioc.admit(ioReq) {
+		atomic.AddInt64(&ioc.pending, -1)
+		return
+	}
+
+	if ioc.stallHistory != nil && ioc.stallHistory.Boosted(ioReq) {
+		boostedIOs.Inc()
+
+		select {
+		case <-ioc.ctx.Done():
+			atomic.AddInt64(&ioc.pending, -1)
+		case ioc.priorityQueue <- ioReq:
+		}
+		return
+	}
+
+	// Fall through to the shared work queue if the device can't be determined.
+	if ioc.cfg.Elevator && ioc.enqueue(ioReq) {
+		return
+	}
+
+	select {
+	case <-ioc.ctx.Done():
+		atomic.AddInt64(&ioc.pending, -1)
+	case ioc.workQueue <- ioReq:
+	}
+}
+
+// admit blocks until ioReq can be read without exceeding the cgroup's io.max or
+// a maintenance window's IOPS.  admit returns false if ioReq is to be dropped
+// because prefaulting is paused or the IOCache is shutting down.
+func (ioc *IOCache) admit(ioReq structs.IOCacheKey) bool {
+	if ioc.maintenance != nil && !ioc.maintenance.wait(ioc.ctx) {
+		return false
+	}
+
+	if ioc.throttle != nil && !ioc.throttle.wait(ioc.ctx, ioReq) {
+		return false
+	}
+
+	return true
+}
+
+// prefault faults in ioReq and accounts for its completion.
+func (ioc *IOCache) prefault(threadID uint, ioReq structs.IOCacheKey) {
+	sampled := ioc.residency.sample()
+	var residentBefore bool
+	if sampled {
+		var err error
+		if residentBefore, err = ioc.fhCache.Resident(ioReq); err != nil {
+			sampled = false
+		}
+	}
+
+	start := time.Now()
+	err := ioc.fhCache.PrefaultPage(ioReq)
+	latency := time.Since(start)
+	atomic.AddInt64(&ioc.pending, -1)
+	if err != nil {
+		// If we had a problem prefaulting in the WAL file, for whatever
+		// reason, attempt to remove it from the cache.
+		ioc.c.Remove(ioReq)
+
+		// The failure to open a missing segment was logged when it was first
+		// found missing.
+		if fhcache.IsMissing(err) {
+			return
+		}
+
+		ioc.log.Warn().Uint("io-worker-thread-id", threadID).Err(err).
+			Str("slru", ioReq.SLRU.String()).
+			Uint64("database", uint64(ioReq.Database)).
+			Uint64("relation", uint64(ioReq.Relation)).
+			Uint64("block", uint64(ioReq.Block)).Msg("unable to prefault page")
+		return
+	}
+
+	if ioc.aligned(ioReq) {
+		pagesPrefaulted.Add(ioc.blocksPerRecord)
+	} else {
+		pagesPrefaulted.Inc()
+	}
+
+	ioc.savings.observe(latency)
+	ioc.latencies.observe(latency)
+
+	if sampled {
+		if residentAfter, err := ioc.fhCache.Resident(ioReq); err == nil {
+			ioc.residency.observe(residentBefore, residentAfter)
+		}
 	}
-	log.Info().Uint("io-worker-threads", ioc.cfg.MaxConcurrentIOs).Msg("started IO worker threads")
 
-	ioc.c = gcache.New(int(ioc.cfg.Size)).
-		ARC().
-		LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
+	// The page was just read, so reading it again samples a resident read.  The
+	// second read is throttled like any other, but isn't verified or counted as
+	// a prefault.
+	if ioc.savings.sample() && ioc.admit(ioReq) {
+		start = time.Now()
+		if err := ioc.fhCache.ReadPage(ioReq); err == nil {
+			ioc.savings.observeResident(time.Since(start))
+		}
+	}
+
+	if ioc.warmSet != nil {
+		ioc.warmSet.Record(ioReq)
+	}
+}
+
+// enqueue queues ioReq on its device's elevator, starting the device's workers
+// if necessary.  enqueue returns false if ioReq's device could not be
+// determined and ioReq was not queued.
+func (ioc *IOCache) enqueue(ioReq structs.IOCacheKey) bool {
+	dev, err := ioc.fhCache.Device(ioReq)
+	if err != nil {
+		ioc.log.Debug().Err(err).Uint64("database", uint64(ioReq.Database)).
+			Str("slru", ioReq.SLRU.String()).Msg("unable to determine device")
+		return false
+	}
+
+	ioc.elevatorsLock.Lock()
+	if lib.IsShuttingDown(ioc.ctx) {
+		ioc.elevatorsLock.Unlock()
+		atomic.AddInt64(&ioc.pending, -1)
+		return true
+	}
+
+	e, found := ioc.elevators[dev]
+	if !found {
+		e = newElevator()
+		ioc.elevators[dev] = e
+		ioc.startElevator(dev, e)
+	}
+	ioc.elevatorsLock.Unlock()
+
+	if !e.push(ioReq) {
+		// Already queued or shutting down
+		atomic.AddInt64(&ioc.pending, -1)
+	}
+
+	return true
+}
+
+// startElevator starts feeding a device's elevator to the shared IO workers.
+// The elevator hands over one request at a time, as a worker becomes free, so
+// the elevator keeps choosing the next request in the sweep while the shared
+// pool bounds the number of concurrent IOs.  startElevator must be called with
+// elevatorsLock held.
+func (ioc *IOCache) startElevator(dev uint64, e *elevator) {
+	go func() {
+		<-ioc.ctx.Done()
+		e.close()
+	}()
+
+	go func() {
+		for {
+			ioReq, ok := e.pop(ioc.ctx.Done())
+			if !ok {
+				return
+			}
+
 			select {
 			case <-ioc.ctx.Done():
-			case ioWorkQueue <- key.(structs.IOCacheKey):
+				atomic.AddInt64(&ioc.pending, -1)
+				return
+			case ioc.workQueue <- ioReq:
 			}
+		}
+	}()
 
-			return struct{}{}, &ioc.cfg.TTL, nil
+	ioc.log.Info().Uint64("device", dev).Msg("started IO elevator")
+}
 
-		}).
-		Build()
+// Workers returns the number of IO workers.
+func (ioc *IOCache) Workers() uint {
+	ioc.elevatorsLock.Lock()
+	defer ioc.elevatorsLock.Unlock()
 
-	go lib.LogCacheStats(ioc.ctx, ioc.c, "iocache-stats")
+	return ioc.numWorkers
+}
 
-	return ioc, nil
+// MaxWorkers returns the greatest number of IO workers SetWorkers accepts.
+func (ioc *IOCache) MaxWorkers() uint {
+	return ioc.cfg.MaxWorkers
+}
+
+// Throttled returns the number of IOs delayed to stay under the cgroup's
+// io.max read limits.
+func (ioc *IOCache) Throttled() uint64 {
+	return throttledIOs.Value()
+}
+
+// SetWorkers grows or shrinks the IO workers to workers.  Retired workers exit
+// once they finish their current IO.
+func (ioc *IOCache) SetWorkers(workers uint) error {
+	if workers < 1 || workers > ioc.cfg.MaxWorkers {
+		return fmt.Errorf("io workers must be between 1 and %d (%d)", ioc.cfg.MaxWorkers, workers)
+	}
+
+	ioc.elevatorsLock.Lock()
+	defer ioc.elevatorsLock.Unlock()
+
+	if err := ioc.workers.resize(workers); err != nil {
+		return errors.Wrap(err, "unable to confine IO worker")
+	}
+	ioc.numWorkers = workers
+	ioWorkers.Set(float64(workers))
+
+	return nil
+}
+
+// confineWorker locks the calling IO worker to its OS thread, then lowers the
+// thread's priority and sandboxes the thread, if enabled.  The thread is never
+// unlocked so that it exits along with the worker rather than being reused by
+// unconfined goroutines.
+func (ioc *IOCache) confineWorker() error {
+	if !ioc.cfg.Sandbox && !ioc.prioritized() {
+		return nil
+	}
+
+	runtime.LockOSThread()
+
+	// The sandbox forbids changing priorities.
+	if ioc.prioritized() {
+		if err := sched.SetThreadPriority(ioc.cfg.Nice, ioc.cfg.IOClass, ioc.cfg.IOPriority); err != nil {
+			return err
+		}
+	}
+
+	if !ioc.cfg.Sandbox {
+		return nil
+	}
+
+	return sandbox.ConfineThread(ioc.pgDataPath)
+}
+
+// prioritized returns true if the IO workers' scheduling priorities are
+// changed.
+func (ioc *IOCache) prioritized() bool {
+	return ioc.cfg.Nice != 0 || ioc.cfg.IOClass != config.IOClassDefault
 }
 
-// GetIFPresent forwards to gcache.Cache's GetIFPresent().
+// GetIFPresent forwards to gcache.Cache's GetIFPresent().  Relation pages are
+// aligned to the first page of their record when reading records.
 func (ioc *IOCache) GetIFPresent(k interface{}) (interface{}, error) {
+	if ioReq, ok := k.(structs.IOCacheKey); ok && ioc.aligned(ioReq) {
+		ioReq.Block -= ioReq.Block % pg.HeapBlockNumber(ioc.blocksPerRecord)
+		k = ioReq
+	}
+
 	return ioc.c.GetIFPresent(k)
 }
 
+// aligned returns true if ioReq is read as a whole record.  SLRU pages are
+// always read individually.
+func (ioc *IOCache) aligned(ioReq structs.IOCacheKey) bool {
+	return ioc.blocksPerRecord > 1 && ioReq.SLRU == pg.SLRUNone
+}
+
+// Size returns the capacity of the IOCache.
+func (ioc *IOCache) Size() int {
+	return ioc.c.Size()
+}
+
+// Resize changes the capacity of the IOCache without purging it.
+func (ioc *IOCache) Resize(size int) error {
+	return ioc.c.Resize(size)
+}
+
+// TTL returns the expiration of newly scheduled IO requests.
+func (ioc *IOCache) TTL() time.Duration {
+	return *ioc.c.TTL()
+}
+
+// SetTTL changes the expiration of newly scheduled IO requests.
+func (ioc *IOCache) SetTTL(ttl time.Duration) error {
+	return ioc.c.SetTTL(ttl)
+}
+
+// Statistics returns the IOCache's number of entries and counters.
+func (ioc *IOCache) Statistics() lib.CacheStatistics {
+	return ioc.c.Statistics()
+}
+
+// Savings returns the number of prefaults that found their page cold and the
+// estimated replay time they saved.
+func (ioc *IOCache) Savings() (useful uint64, saved time.Duration) {
+	return ioc.savings.estimate()
+}
+
+// SampleResidency checks whether a sample of the pages prefaulted from now on
+// were in the filesystem cache before and after they were prefaulted.
+func (ioc *IOCache) SampleResidency() error {
+	if !fhcache.ResidencySupported {
+		return errors.New("page residency can't be sampled on this platform")
+	}
+
+	atomic.StoreUint32(&ioc.residency.enabled, 1)
+	return nil
+}
+
+// Residency returns the counts of the pages whose residency was sampled.
+func (ioc *IOCache) Residency() Residency {
+	return ioc.residency.counts()
+}
+
+// ReadLatency returns the p'th percentile, 0 <= p <= 1, of the latency of
+// recent prefault reads.
+func (ioc *IOCache) ReadLatency(p float64) time.Duration {
+	return ioc.latencies.percentile(p)
+}
+
+// NumPending returns the number of IO requests that have been scheduled but
+// have not yet completed.
+func (ioc *IOCache) NumPending() int64 {
+	return atomic.LoadInt64(&ioc.pending)
+}
+
+// Invalidate forgets the pages of rels and closes their file handles.  rels
+// are relations whose files were dropped or truncated, so their pages are
+// prefaulted again should the relation reuse the files.
+func (ioc *IOCache) Invalidate(rels map[pg.RelFileNode]struct{}) {
+	if len(rels) == 0 {
+		return
+	}
+
+	pages := ioc.c.RemoveIf(func(k interface{}) bool {
+		ioReq := k.(structs.IOCacheKey)
+		if ioReq.SLRU != pg.SLRUNone {
+			return false
+		}
+
+		_, found := rels[pg.RelFileNode{
+			Tablespace: ioReq.Tablespace,
+			Database:   ioReq.Database,
+			Relation:   ioReq.Relation,
+		}]
+		return found
+	})
+	handles := ioc.fhCache.Invalidate(rels)
+
+	relationsInvalidated.Add(uint64(len(rels)))
+	ioc.log.Debug().Int("relations", len(rels)).Int("pages", pages).Int("file-handles", handles).
+		Msg("invalidated dropped and truncated relations")
+}
+
 // Purge purges the IOCache of its cache (and all downstream caches)
 func (ioc *IOCache) Purge() {
 	ioc.purgeLock.Lock()
@@ -0,0 +1,118 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+)
+
+// elevator orders the pending IO requests for a single device by file and
+// offset.  Requests are dispatched in one direction across the device
+// (C-SCAN): the next request is the lowest request at or after the last
+// dispatched request, wrapping around to the lowest request once the end has
+// been reached.
+type elevator struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending []structs.IOCacheKey
+	last    structs.IOCacheKey
+	closed  bool
+}
+
+func newElevator() *elevator {
+	e := &elevator{}
+	e.cond = sync.NewCond(&e.lock)
+	return e
+}
+
+// push queues key.  push returns false if key was already queued or the
+// elevator has been closed.
+func (e *elevator) push(key structs.IOCacheKey) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return false
+	}
+
+	i := sort.Search(len(e.pending), func(i int) bool { return !e.pending[i].Less(key) })
+	if i < len(e.pending) && e.pending[i] == key {
+		return false
+	}
+
+	e.pending = append(e.pending, structs.IOCacheKey{})
+	copy(e.pending[i+1:], e.pending[i:])
+	e.pending[i] = key
+	e.cond.Signal()
+
+	return true
+}
+
+// pop blocks until a request is available and returns the next request in
+// the sweep.  pop returns false once the elevator has been closed or quit has
+// been closed.  Waiters are woken by close.
+func (e *elevator) pop(quit <-chan struct{}) (structs.IOCacheKey, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for len(e.pending) == 0 && !e.closed && !isClosed(quit) {
+		e.cond.Wait()
+	}
+
+	if e.closed || isClosed(quit) {
+		return structs.IOCacheKey{}, false
+	}
+
+	i := sort.Search(len(e.pending), func(i int) bool { return !e.pending[i].Less(e.last) })
+	if i == len(e.pending) {
+		i = 0
+	}
+
+	key := e.pending[i]
+	e.pending = append(e.pending[:i], e.pending[i+1:]...)
+	e.last = key
+
+	return key, true
+}
+
+// len returns the number of queued requests.
+func (e *elevator) len() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return len(e.pending)
+}
+
+// isClosed returns true if ch has been closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// close wakes all waiters and discards any queued requests.
+func (e *elevator) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.closed = true
+	e.pending = nil
+	e.cond.Broadcast()
+}
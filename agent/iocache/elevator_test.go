@@ -0,0 +1,75 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestElevator(t *testing.T) {
+	key := func(relation pg.OID, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: relation, Block: block}
+	}
+
+	e := newElevator()
+	for _, k := range []structs.IOCacheKey{key(2, 5), key(1, 9), key(2, 1), key(1, 3)} {
+		if !e.push(k) {
+			t.Fatalf("unable to push %+v", k)
+		}
+	}
+
+	// Duplicates are dropped
+	if e.push(key(1, 9)) {
+		t.Fatalf("duplicate pushed")
+	}
+
+	var got []structs.IOCacheKey
+	pop := func() {
+		k, ok := e.pop(nil)
+		if !ok {
+			t.Fatalf("unexpected closed elevator")
+		}
+		got = append(got, k)
+	}
+
+	pop()
+	pop()
+
+	// Requests behind the head wait for the next sweep, requests ahead of the
+	// head are serviced in this sweep.
+	e.push(key(1, 1))
+	e.push(key(2, 0))
+	for e.len() > 0 {
+		pop()
+	}
+
+	want := []structs.IOCacheKey{
+		key(1, 3), key(1, 9), key(2, 0), key(2, 1), key(2, 5), key(1, 1),
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("dispatch order diff: (-got +want)\n%s", diff)
+	}
+
+	e.close()
+	if _, ok := e.pop(nil); ok {
+		t.Fatalf("expected closed elevator")
+	}
+	if e.push(key(3, 0)) {
+		t.Fatalf("push to a closed elevator")
+	}
+}
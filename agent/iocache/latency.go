@@ -0,0 +1,59 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindow is the number of most recent prefault reads whose latency is
+// kept to compute percentiles.
+const latencyWindow = 1024
+
+// latencies keeps the latency of the most recent prefault reads.
+type latencies struct {
+	lock sync.Mutex
+	buf  [latencyWindow]time.Duration
+	n    uint64
+}
+
+// observe records the latency of a prefault's read.
+func (l *latencies) observe(latency time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.buf[l.n%latencyWindow] = latency
+	l.n++
+}
+
+// percentile returns the p'th percentile, 0 <= p <= 1, of the recent read
+// latencies, or 0 if nothing has been read yet.
+func (l *latencies) percentile(p float64) time.Duration {
+	l.lock.Lock()
+	n := l.n
+	if n > latencyWindow {
+		n = latencyWindow
+	}
+	sorted := append([]time.Duration(nil), l.buf[:n]...)
+	l.lock.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[int(p*float64(len(sorted)-1))]
+}
@@ -0,0 +1,75 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/maintenance"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+)
+
+var (
+	pausedIOs      = metrics.NewCounter("prefault_paused_total", "Number of IOs dropped because prefaulting was paused by a maintenance window.")
+	maintenanceIOs = metrics.NewCounter("prefault_maintenance_throttled_total", "Number of IOs delayed to stay under the IOPS allowed during maintenance windows.")
+)
+
+// maintenanceLimiter drops IOs while a maintenance window pauses prefaulting
+// and otherwise limits IOs to the schedule's IOPS while a window is open.
+type maintenanceLimiter struct {
+	schedule *maintenance.Schedule
+
+	lock   sync.Mutex
+	bucket bucket
+}
+
+func newMaintenanceLimiter(schedule *maintenance.Schedule) *maintenanceLimiter {
+	return &maintenanceLimiter{
+		schedule: schedule,
+		bucket:   newBucket(float64(schedule.IOPS()), 1),
+	}
+}
+
+// wait blocks until an IO can be issued without exceeding the IOPS allowed
+// during an open maintenance window.  wait returns false if the IO is to be
+// dropped because prefaulting is paused or ctx is cancelled.
+func (m *maintenanceLimiter) wait(ctx context.Context) bool {
+	now := time.Now()
+	if !m.schedule.Open(now) {
+		return true
+	}
+	if m.schedule.IOPS() == 0 {
+		pausedIOs.Inc()
+		return false
+	}
+
+	m.lock.Lock()
+	delay := m.bucket.reserve(now, 1)
+	m.lock.Unlock()
+	if delay <= 0 {
+		return true
+	}
+	maintenanceIOs.Inc()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
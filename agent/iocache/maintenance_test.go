@@ -0,0 +1,45 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/maintenance"
+)
+
+func TestMaintenanceLimiter(t *testing.T) {
+	always, err := maintenance.ParseWindow("* * * * * 1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paused := newMaintenanceLimiter(maintenance.NewSchedule([]maintenance.Window{always}, 0))
+	if paused.wait(context.Background()) {
+		t.Fatal("IO issued while paused")
+	}
+
+	throttled := newMaintenanceLimiter(maintenance.NewSchedule([]maintenance.Window{always}, 1))
+	if !throttled.wait(context.Background()) {
+		t.Fatal("first IO not issued")
+	}
+
+	// The second IO has to wait a second, by which time ctx is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if throttled.wait(ctx) {
+		t.Fatal("IO issued over the limit")
+	}
+}
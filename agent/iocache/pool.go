@@ -0,0 +1,98 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"sync"
+)
+
+// pool is a resizable set of IO workers.  Each worker runs work until its quit
+// channel is closed.  Workers are retired newest first and only between IOs:
+// work is expected to return once it is idle and quit is closed.
+type pool struct {
+	wg *sync.WaitGroup
+
+	// confine is called by each worker before it runs work.  Workers that fail
+	// to confine themselves exit.
+	confine func() error
+	work    func(threadID uint, quit <-chan struct{})
+
+	lock   sync.Mutex
+	quits  []chan struct{}
+	nextID uint
+}
+
+// resize starts or retires workers until size workers are running.  resize
+// waits for new workers to confine themselves and, if any fail, retires all of
+// the new workers and returns the first error.
+func (p *pool) resize(size uint) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if uint(len(p.quits)) > size {
+		for _, quit := range p.quits[size:] {
+			close(quit)
+		}
+		p.quits = p.quits[:size]
+		return nil
+	}
+
+	n := int(size) - len(p.quits)
+	confined := make(chan error, n)
+	quits := make([]chan struct{}, n)
+	for i := range quits {
+		quit := make(chan struct{})
+		quits[i] = quit
+
+		p.wg.Add(1)
+		go func(threadID uint) {
+			defer p.wg.Done()
+
+			err := p.confine()
+			confined <- err
+			if err != nil {
+				return
+			}
+
+			p.work(threadID, quit)
+		}(p.nextID)
+		p.nextID++
+	}
+
+	var err error
+	for i := 0; i < n; i++ {
+		if confineErr := <-confined; confineErr != nil && err == nil {
+			err = confineErr
+		}
+	}
+	if err != nil {
+		for _, quit := range quits {
+			close(quit)
+		}
+		return err
+	}
+
+	p.quits = append(p.quits, quits...)
+
+	return nil
+}
+
+// size returns the number of running workers, excluding retired workers that
+// are finishing their last IO.
+func (p *pool) size() uint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return uint(len(p.quits))
+}
@@ -0,0 +1,80 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolResize(t *testing.T) {
+	var wg sync.WaitGroup
+	var running int64
+	var failConfine bool
+	p := &pool{
+		wg: &wg,
+		confine: func() error {
+			if failConfine {
+				return errors.New("confine failed")
+			}
+			return nil
+		},
+		work: func(threadID uint, quit <-chan struct{}) {
+			atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			<-quit
+		},
+	}
+
+	waitRunning := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&running) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d workers running, want %d", atomic.LoadInt64(&running), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := p.resize(4); err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(4)
+
+	if err := p.resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if size := p.size(); size != 1 {
+		t.Fatalf("size %d, want 1", size)
+	}
+	waitRunning(1)
+
+	// Workers that fail to confine themselves are not added
+	failConfine = true
+	if err := p.resize(3); err == nil {
+		t.Fatal("resized with unconfined workers")
+	}
+	if size := p.size(); size != 1 {
+		t.Fatalf("size %d, want 1", size)
+	}
+
+	if err := p.resize(0); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
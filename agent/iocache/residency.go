@@ -0,0 +1,67 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"sync/atomic"
+)
+
+// residencySampleInterval is how often a page's residency in the filesystem
+// cache is checked before and after it is prefaulted while residency sampling
+// is enabled.
+const residencySampleInterval = 16
+
+// Residency counts the prefaulted pages whose residency was sampled and how
+// many of them were in the filesystem cache before and after being prefaulted.
+type Residency struct {
+	Sampled        uint64 `json:"sampled"`
+	ResidentBefore uint64 `json:"resident-before"`
+	ResidentAfter  uint64 `json:"resident-after"`
+}
+
+// residency samples the residency of prefaulted pages.  Sampling costs two
+// mmap(2)s per sampled page, so it is disabled unless asked for, e.g. by the
+// self-test.  All fields are accessed atomically.
+type residency struct {
+	enabled uint32
+	reads   uint64
+	sampled uint64
+	before  uint64
+	after   uint64
+}
+
+// sample returns true if the residency of the page about to be prefaulted
+// should be checked.
+func (r *residency) sample() bool {
+	return atomic.LoadUint32(&r.enabled) != 0 && atomic.AddUint64(&r.reads, 1)%residencySampleInterval == 1
+}
+
+// observe records the residency of a page before and after it was prefaulted.
+func (r *residency) observe(before, after bool) {
+	atomic.AddUint64(&r.sampled, 1)
+	if before {
+		atomic.AddUint64(&r.before, 1)
+	}
+	if after {
+		atomic.AddUint64(&r.after, 1)
+	}
+}
+
+func (r *residency) counts() Residency {
+	return Residency{
+		Sampled:        atomic.LoadUint64(&r.sampled),
+		ResidentBefore: atomic.LoadUint64(&r.before),
+		ResidentAfter:  atomic.LoadUint64(&r.after),
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// residentSampleInterval is how often a prefaulted page is read again to
+	// sample the latency of reading a resident page.
+	residentSampleInterval = 64
+
+	// residentWeight is the weight of each new sample in the moving average
+	// of the resident read latency.
+	residentWeight = 0.1
+
+	// coldFactor is how much slower than a resident read a read must be for
+	// its page to be considered cold.  Faster reads are noise.
+	coldFactor = 4
+)
+
+// savings estimates the replay time saved by prefaulting.  Replay reads a page
+// synchronously when it isn't resident, so each prefault of a cold page saves
+// replay the difference between the latency of the prefault's read and that of
+// reading a resident page.  The latency of a resident page is sampled by
+// reading a page again right after prefaulting it.  The estimate assumes the
+// page would not have been faulted in before replay needed it, so it is an
+// upper bound.
+type savings struct {
+	// reads is accessed atomically.
+	reads uint64
+
+	lock     sync.Mutex
+	resident time.Duration
+	useful   uint64
+	saved    time.Duration
+}
+
+// sample returns true if the page just prefaulted should be read again to
+// sample the resident read latency.
+func (s *savings) sample() bool {
+	return atomic.AddUint64(&s.reads, 1)%residentSampleInterval == 1
+}
+
+// observeResident records the latency of reading a resident page.
+func (s *savings) observeResident(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.resident == 0 {
+		s.resident = latency
+		return
+	}
+	s.resident += time.Duration(residentWeight * float64(latency-s.resident))
+}
+
+// observe records the latency of a prefault's read.  Reads are only accounted
+// once the resident read latency has been sampled.
+func (s *savings) observe(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.resident == 0 || latency <= coldFactor*s.resident {
+		return
+	}
+
+	s.useful++
+	s.saved += latency - s.resident
+}
+
+// residentLatency returns the moving average of the resident read latency, or
+// 0 if it hasn't been sampled yet.
+func (s *savings) residentLatency() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.resident
+}
+
+// estimate returns the number of prefaults that found their page cold and the
+// replay time they saved.
+func (s *savings) estimate() (useful uint64, saved time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.useful, s.saved
+}
@@ -0,0 +1,108 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSavings(t *testing.T) {
+	var s savings
+
+	// Nothing is accounted before the resident latency is sampled
+	s.observe(time.Millisecond)
+	if useful, saved := s.estimate(); useful != 0 || saved != 0 {
+		t.Fatalf("estimated %d useful prefaults saving %s without a resident sample", useful, saved)
+	}
+
+	s.observeResident(10 * time.Microsecond)
+	s.observeResident(20 * time.Microsecond)
+	if resident := s.residentLatency(); resident != 11*time.Microsecond {
+		t.Fatalf("resident latency %s, want 11µs", resident)
+	}
+
+	// Reads of resident pages save nothing
+	s.observe(30 * time.Microsecond)
+	s.observe(time.Millisecond + 11*time.Microsecond)
+	s.observe(2*time.Millisecond + 11*time.Microsecond)
+	if useful, saved := s.estimate(); useful != 2 || saved != 3*time.Millisecond {
+		t.Fatalf("estimated %d useful prefaults saving %s, want 2 saving 3ms", useful, saved)
+	}
+
+	var samples int
+	for i := 0; i < 2*residentSampleInterval; i++ {
+		if s.sample() {
+			samples++
+		}
+	}
+	if samples != 2 {
+		t.Fatalf("sampled %d reads, want 2", samples)
+	}
+}
+
+func TestResidency(t *testing.T) {
+	var r residency
+
+	// Nothing is sampled until sampling is enabled
+	for i := 0; i < residencySampleInterval; i++ {
+		if r.sample() {
+			t.Fatal("sampled a read while sampling is disabled")
+		}
+	}
+
+	r.enabled = 1
+	var samples int
+	for i := 0; i < 2*residencySampleInterval; i++ {
+		if r.sample() {
+			samples++
+		}
+	}
+	if samples != 2 {
+		t.Fatalf("sampled %d reads, want 2", samples)
+	}
+
+	r.observe(false, true)
+	r.observe(true, true)
+	r.observe(false, false)
+	want := Residency{Sampled: 3, ResidentBefore: 1, ResidentAfter: 2}
+	if got := r.counts(); got != want {
+		t.Fatalf("counts %+v, want %+v", got, want)
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	var l latencies
+	if p := l.percentile(0.99); p != 0 {
+		t.Fatalf("p99 %s without reads, want 0", p)
+	}
+
+	for i := 1; i <= 100; i++ {
+		l.observe(time.Duration(i) * time.Millisecond)
+	}
+	if p := l.percentile(0.5); p != 50*time.Millisecond {
+		t.Fatalf("p50 %s, want 50ms", p)
+	}
+	if p := l.percentile(0.99); p != 99*time.Millisecond {
+		t.Fatalf("p99 %s, want 99ms", p)
+	}
+
+	// Only the most recent reads are kept
+	for i := 0; i < latencyWindow; i++ {
+		l.observe(time.Millisecond)
+	}
+	if p := l.percentile(0.99); p != time.Millisecond {
+		t.Fatalf("p99 %s, want 1ms", p)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/cgroup"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+// ioMaxRefreshInterval is how often the cgroup's io.max is re-read.
+const ioMaxRefreshInterval = time.Minute
+
+var throttledIOs = metrics.NewCounter("prefault_throttled_total", "Number of IOs delayed to stay under the agent's cgroup io.max read limits.")
+
+// throttle delays IOs to keep the agent's reads from each disk under a fraction
+// of the read limits in its cgroup's io.max.  Exceeding io.max trips the
+// kernel's throttling, which also delays the IOs of PostgreSQL when it shares
+// the agent's cgroup tree.  Every IO is assumed to reach the disk.
+type throttle struct {
+	log       zerolog.Logger
+	fraction  float64
+	blockSize float64
+
+	// device returns the ID of the device an IO is issued to.
+	device func(structs.IOCacheKey) (uint64, error)
+
+	lock    sync.Mutex
+	limits  map[uint64]cgroup.IOLimit
+	disks   map[uint64]uint64
+	buckets map[uint64]*diskBuckets
+}
+
+// diskBuckets rate limit the IOs and bytes read from a disk.
+type diskBuckets struct {
+	iops bucket
+	bps  bucket
+}
+
+func newThrottle(log zerolog.Logger, fraction float64, blockSize units.Base2Bytes, device func(structs.IOCacheKey) (uint64, error)) *throttle {
+	return &throttle{
+		log:       log,
+		fraction:  fraction,
+		blockSize: float64(blockSize),
+		device:    device,
+		limits:    make(map[uint64]cgroup.IOLimit),
+		disks:     make(map[uint64]uint64),
+		buckets:   make(map[uint64]*diskBuckets),
+	}
+}
+
+// refresh re-reads io.max.  The rates of disks whose limits changed are reset.
+func (t *throttle) refresh() error {
+	limits, err := cgroup.ReadIOMax()
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for disk, l := range limits {
+		if old, found := t.limits[disk]; found && old == l {
+			continue
+		}
+
+		delete(t.buckets, disk)
+		t.log.Info().Str("device", fmt.Sprintf("%d:%d", unix.Major(disk), unix.Minor(disk))).
+			Uint64("rbps", l.ReadBPS).Uint64("riops", l.ReadIOPS).Float64("io-max-fraction", t.fraction).
+			Msg("throttling reads under the cgroup's io.max")
+	}
+	for disk := range t.limits {
+		if _, found := limits[disk]; !found {
+			delete(t.buckets, disk)
+		}
+	}
+	t.limits = limits
+
+	return nil
+}
+
+// run refreshes the limits until ctx is cancelled.
+func (t *throttle) run(ctx context.Context) {
+	ticker := time.NewTicker(ioMaxRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.refresh(); err != nil {
+				t.log.Warn().Err(err).Msg("unable to refresh cgroup io.max limits")
+			}
+		}
+	}
+}
+
+// wait blocks until ioReq can be issued without exceeding its disk's limits.
+// wait returns false if ctx is cancelled first.
+func (t *throttle) wait(ctx context.Context, ioReq structs.IOCacheKey) bool {
+	delay := t.reserve(ioReq, time.Now())
+	if delay <= 0 {
+		return true
+	}
+	throttledIOs.Inc()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// reserve accounts for ioReq being issued at now and returns how long it must
+// be delayed.
+func (t *throttle) reserve(ioReq structs.IOCacheKey, now time.Time) time.Duration {
+	t.lock.Lock()
+	unlimited := len(t.limits) == 0
+	t.lock.Unlock()
+	if unlimited {
+		return 0
+	}
+
+	dev, err := t.device(ioReq)
+	if err != nil {
+		return 0
+	}
+
+	t.lock.Lock()
+	disk, found := t.disks[dev]
+	t.lock.Unlock()
+	if !found {
+		disk = cgroup.Disk(dev)
+
+		t.lock.Lock()
+		t.disks[dev] = disk
+		t.lock.Unlock()
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	l := t.limits[disk]
+	if l.ReadIOPS == 0 && l.ReadBPS == 0 {
+		return 0
+	}
+
+	b, found := t.buckets[disk]
+	if !found {
+		b = &diskBuckets{
+			iops: newBucket(t.fraction*float64(l.ReadIOPS), 1),
+			bps:  newBucket(t.fraction*float64(l.ReadBPS), t.blockSize),
+		}
+		t.buckets[disk] = b
+	}
+
+	delay := b.iops.reserve(now, 1)
+	if d := b.bps.reserve(now, t.blockSize); d > delay {
+		delay = d
+	}
+
+	return delay
+}
+
+// bucket is a token bucket refilled at rate tokens per second.  A zero rate is
+// unlimited.  Tokens go negative when reserved faster than they are refilled,
+// which queues reservations behind one another.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a full bucket that holds a tenth of a second's worth of
+// tokens, or at least cost tokens.
+func newBucket(rate, cost float64) bucket {
+	burst := math.Max(rate/10, cost)
+	return bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// reserve takes n tokens at now and returns how long until they are available.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
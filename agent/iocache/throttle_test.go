@@ -0,0 +1,84 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/cgroup"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/rs/zerolog"
+)
+
+func TestThrottleReserve(t *testing.T) {
+	const (
+		sda1 = 1
+		sda  = 2
+		sdb  = 3
+	)
+	devices := map[structs.IOCacheKey]uint64{
+		{Relation: 1}: sda1,
+		{Relation: 2}: sdb,
+	}
+
+	tests := []struct {
+		limit  cgroup.IOLimit
+		delays []time.Duration
+		after  time.Duration
+	}{
+		{ // 0: 50 IOPS with a burst of 5
+			limit:  cgroup.IOLimit{ReadIOPS: 100},
+			delays: []time.Duration{0, 0, 0, 0, 0, 20 * time.Millisecond, 40 * time.Millisecond},
+			after:  140 * time.Millisecond,
+		},
+		{ // 1: 50 8KiB pages a second
+			limit:  cgroup.IOLimit{ReadBPS: 100 * 8192},
+			delays: []time.Duration{0, 0, 0, 0, 0, 20 * time.Millisecond, 40 * time.Millisecond},
+			after:  140 * time.Millisecond,
+		},
+		{ // 2: the tighter limit applies
+			limit:  cgroup.IOLimit{ReadBPS: 100 * 8192, ReadIOPS: 20},
+			delays: []time.Duration{0, 100 * time.Millisecond},
+			after:  200 * time.Millisecond,
+		},
+	}
+
+	for n, test := range tests {
+		th := newThrottle(zerolog.Nop(), 0.5, 8192, func(ioReq structs.IOCacheKey) (uint64, error) {
+			return devices[ioReq], nil
+		})
+		th.limits = map[uint64]cgroup.IOLimit{sda: test.limit}
+		th.disks = map[uint64]uint64{sda1: sda, sdb: sdb}
+
+		now := time.Now()
+		for i, want := range test.delays {
+			if delay := th.reserve(structs.IOCacheKey{Relation: 1}, now); delay.Round(time.Millisecond) != want {
+				t.Fatalf("%d: IO %d delayed %s, want %s", n, i, delay, want)
+			}
+		}
+
+		// Disks without limits are never delayed
+		for i := 0; i < 100; i++ {
+			if delay := th.reserve(structs.IOCacheKey{Relation: 2}, now); delay != 0 {
+				t.Fatalf("%d: unlimited disk delayed %s", n, delay)
+			}
+		}
+
+		// Once the delays have passed, IOs are issued immediately
+		if delay := th.reserve(structs.IOCacheKey{Relation: 1}, now.Add(test.after)); delay != 0 {
+			t.Fatalf("%d: delayed %s after %s", n, delay, test.after)
+		}
+	}
+}
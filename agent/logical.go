@@ -0,0 +1,125 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/indexcache"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// minLogicalApplyVersion is the first version of PostgreSQL with built-in
+// logical replication.
+const minLogicalApplyVersion = 100000
+
+var logicalApplyBlocks = metrics.NewCounter("logical_apply_blocks_prefaulted_total", "Number of table and index blocks scheduled for prefaulting ahead of logical replication apply.")
+
+// prefaultLogicalApply prefaults the hot blocks of the tables replicated to
+// this subscriber by the subscriptions whose apply worker has received WAL
+// since the last poll.  Changes applied to a table land at the end of its heap
+// and indexes, so the tail blocks of each table, and the metapage and tail
+// blocks of each of its B-tree indexes, are prefaulted.  Errors are logged and
+// are not fatal.
+func (a *Agent) prefaultLogicalApply() {
+	if a.walTranslations.Major < minLogicalApplyVersion {
+		return
+	}
+
+	subs, err := pg.QuerySubscriptions(a.shutdownCtx, a.pool)
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to query subscriptions")
+		return
+	}
+
+	var advanced []pg.Subscription
+	advanced, a.subscriptionLSNs = advancedSubscriptions(a.subscriptionLSNs, subs)
+	for _, sub := range advanced {
+		tables, err := pg.QuerySubscriptionTables(a.shutdownCtx, a.pool, sub.OID)
+		if err != nil {
+			a.log.Debug().Err(err).Str("subscription", sub.Name).Msg("unable to query subscription tables")
+			continue
+		}
+
+		var blocks int
+		for _, table := range tables {
+			blocks += a.prefaultLogicalTable(table)
+		}
+
+		a.log.Debug().Str("subscription", sub.Name).Str("received-lsn", sub.ReceivedLSN.String()).
+			Int("tables", len(tables)).Int("blocks", blocks).Msg("prefaulted logical replication apply")
+	}
+}
+
+// advancedSubscriptions returns the subscriptions whose apply worker has
+// received WAL since the received LSNs in prev were observed, and the received
+// LSNs of subs.  A subscription not in prev has advanced.  Dropped
+// subscriptions are forgotten.
+func advancedSubscriptions(prev map[pg.OID]pg.LSN, subs []pg.Subscription) ([]pg.Subscription, map[pg.OID]pg.LSN) {
+	var advanced []pg.Subscription
+	seen := make(map[pg.OID]pg.LSN, len(subs))
+	for _, sub := range subs {
+		seen[sub.OID] = sub.ReceivedLSN
+
+		lsn, found := prev[sub.OID]
+		if sub.ReceivedLSN == pg.InvalidLSN || (found && sub.ReceivedLSN == lsn) {
+			continue
+		}
+		advanced = append(advanced, sub)
+	}
+
+	return advanced, seen
+}
+
+// prefaultLogicalTable schedules the tail blocks of table and the metapage and
+// tail blocks of its indexes to be prefaulted.  prefaultLogicalTable returns
+// the number of blocks scheduled.
+func (a *Agent) prefaultLogicalTable(table pg.SubscriptionTable) int {
+	var blocks int
+	for _, block := range indexcache.TailBlocks(table.Blocks, a.logicalTailBlocks) {
+		a.prefaultLogicalBlock(table.Tablespace, table.Database, table.Relation, block)
+		blocks++
+	}
+
+	indexes, err := pg.QueryIndexes(a.shutdownCtx, a.pool, table.Tablespace, table.Database, table.Relation)
+	if err != nil {
+		a.log.Debug().Err(err).Uint64("relation", uint64(table.Relation)).Msg("unable to look up indexes")
+		return blocks
+	}
+
+	for _, index := range indexes {
+		for _, block := range indexcache.IndexBlocks(index.Blocks, a.logicalTailBlocks) {
+			a.prefaultLogicalBlock(index.Tablespace, table.Database, index.Relation, block)
+			blocks++
+		}
+	}
+
+	return blocks
+}
+
+// prefaultLogicalBlock schedules a block to be prefaulted via the ioCache.
+func (a *Agent) prefaultLogicalBlock(tablespace, database, relation pg.OID, block pg.HeapBlockNumber) {
+	logicalApplyBlocks.Inc()
+
+	_, err := a.ioCache.GetIFPresent(structs.IOCacheKey{
+		Tablespace: tablespace,
+		Database:   database,
+		Relation:   relation,
+		Block:      block,
+	})
+	if err != nil && err != gcache.KeyNotFoundError {
+		a.log.Debug().Err(err).Msg("iocache logical apply prefault")
+	}
+}
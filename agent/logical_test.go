@@ -0,0 +1,56 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_advancedSubscriptions(t *testing.T) {
+	sub := func(oid pg.OID, lsn string) pg.Subscription {
+		s := pg.Subscription{OID: oid, Name: "sub", ReceivedLSN: pg.InvalidLSN}
+		if lsn != "" {
+			s.ReceivedLSN = pg.MustParseLSN(lsn)
+		}
+		return s
+	}
+
+	// First poll: every running apply worker has advanced
+	advanced, seen := advancedSubscriptions(nil, []pg.Subscription{
+		sub(16400, "0/3000000"),
+		sub(16401, ""),
+	})
+	if diff := pretty.Compare(advanced, []pg.Subscription{sub(16400, "0/3000000")}); diff != "" {
+		t.Fatalf("first poll diff: (-got +want)\n%s", diff)
+	}
+
+	// Only subscriptions that received WAL since the last poll have advanced
+	advanced, seen = advancedSubscriptions(seen, []pg.Subscription{
+		sub(16400, "0/3000000"),
+		sub(16401, "0/1000000"),
+		sub(16402, "0/2000000"),
+	})
+	if diff := pretty.Compare(advanced, []pg.Subscription{sub(16401, "0/1000000"), sub(16402, "0/2000000")}); diff != "" {
+		t.Fatalf("second poll diff: (-got +want)\n%s", diff)
+	}
+
+	// Dropped subscriptions are forgotten
+	_, seen = advancedSubscriptions(seen, []pg.Subscription{sub(16402, "0/2000000")})
+	if diff := pretty.Compare(seen, map[pg.OID]pg.LSN{16402: pg.MustParseLSN("0/2000000")}); diff != "" {
+		t.Fatalf("seen diff: (-got +want)\n%s", diff)
+	}
+}
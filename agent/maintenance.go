@@ -0,0 +1,46 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+)
+
+var maintenanceWindowGauge = metrics.NewGauge("maintenance_window_open", "1 while a maintenance window is open, 0 otherwise.")
+
+// checkMaintenance logs the opening and closing of maintenance windows and
+// returns true while a window pauses prefaulting.
+func (a *Agent) checkMaintenance() bool {
+	if a.maintenance == nil {
+		return false
+	}
+
+	open := a.maintenance.Open(time.Now())
+	paused := open && a.maintenance.IOPS() == 0
+	if open != a.inMaintenance {
+		a.inMaintenance = open
+		if open {
+			maintenanceWindowGauge.Set(1)
+			a.log.Info().Bool("paused", paused).Uint("maintenance-iops", a.maintenance.IOPS()).
+				Msg("maintenance window opened")
+		} else {
+			maintenanceWindowGauge.Set(0)
+			a.log.Info().Msg("maintenance window closed, resuming prefaulting")
+		}
+	}
+
+	return paused
+}
@@ -0,0 +1,233 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package maintenance describes recurring windows, e.g. nightly backups,
+// during which prefaulting is paused or throttled.
+package maintenance
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxDuration bounds how long a window stays open.
+const MaxDuration = 7 * 24 * time.Hour
+
+// Window opens at every minute matched by a crontab(5)-style schedule and stays
+// open for Duration.
+type Window struct {
+	spec     string
+	minutes  uint64
+	hours    uint64
+	doms     uint64
+	months   uint64
+	dows     uint64
+	anyDOM   bool
+	anyDOW   bool
+	Duration time.Duration
+}
+
+// ParseWindow parses a window from the five fields of a crontab(5) schedule
+// (minute, hour, day of month, month, and day of week) followed by the window's
+// duration, e.g. "0 2 * * * 3h".  Each field is "*", a number, a range "a-b",
+// any of these with a step "/n", or a comma-separated list of them.
+func ParseWindow(s string) (Window, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 6 {
+		return Window{}, fmt.Errorf("maintenance window %q must have 6 fields (minute hour day-of-month month day-of-week duration)", s)
+	}
+
+	w := Window{spec: strings.Join(fields, " ")}
+
+	var err error
+	if w.minutes, err = parseField(fields[0], 0, 59); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid minute in maintenance window %q", s)
+	}
+	if w.hours, err = parseField(fields[1], 0, 23); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid hour in maintenance window %q", s)
+	}
+	if w.doms, err = parseField(fields[2], 1, 31); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid day of month in maintenance window %q", s)
+	}
+	if w.months, err = parseField(fields[3], 1, 12); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid month in maintenance window %q", s)
+	}
+	if w.dows, err = parseField(fields[4], 0, 7); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid day of week in maintenance window %q", s)
+	}
+	// Both 0 and 7 are Sunday.
+	if w.dows&(1<<7) != 0 {
+		w.dows = w.dows&^(1<<7) | 1
+	}
+	w.anyDOM = strings.HasPrefix(fields[2], "*")
+	w.anyDOW = strings.HasPrefix(fields[4], "*")
+
+	if w.Duration, err = time.ParseDuration(fields[5]); err != nil {
+		return Window{}, errors.Wrapf(err, "invalid duration in maintenance window %q", s)
+	}
+	if w.Duration <= 0 || w.Duration > MaxDuration {
+		return Window{}, fmt.Errorf("duration of maintenance window %q must be positive and at most %s", s, MaxDuration)
+	}
+
+	return w, nil
+}
+
+// parseField returns the set of values in [min, max] matched by a field.
+func parseField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, term := range strings.Split(field, ",") {
+		rng, step := term, 1
+		if i := strings.IndexByte(term, '/'); i >= 0 {
+			var err error
+			rng = term[:i]
+			if step, err = strconv.Atoi(term[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", term)
+			}
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.IndexByte(rng, '-') >= 0:
+			i := strings.IndexByte(rng, '-')
+			var err error
+			if lo, err = strconv.Atoi(rng[:i]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", term)
+			}
+			if hi, err = strconv.Atoi(rng[i+1:]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", term)
+			}
+		default:
+			var err error
+			if lo, err = strconv.Atoi(rng); err != nil {
+				return 0, fmt.Errorf("invalid value %q", term)
+			}
+			hi = lo
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", term, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// String returns the window as it was parsed.
+func (w Window) String() string {
+	return w.spec
+}
+
+// starts returns true if the window opens at the minute t.  As in cron(8), a
+// restricted day of month and day of week match if either matches.
+func (w Window) starts(t time.Time) bool {
+	if w.minutes&(1<<uint(t.Minute())) == 0 || w.hours&(1<<uint(t.Hour())) == 0 ||
+		w.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := w.doms&(1<<uint(t.Day())) != 0
+	dow := w.dows&(1<<uint(t.Weekday())) != 0
+	switch {
+	case w.anyDOM || w.anyDOW:
+		return dom && dow
+	default:
+		return dom || dow
+	}
+}
+
+// closes returns when the window opened most recently at or before t closes,
+// or the zero time if the window isn't open at t.
+func (w Window) closes(t time.Time) time.Time {
+	for start := t.Truncate(time.Minute); t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.starts(start) {
+			return start.Add(w.Duration)
+		}
+	}
+
+	return time.Time{}
+}
+
+// Schedule is a set of windows during which prefaulting is paused or, if IOPS
+// is non-zero, limited to IOPS reads per second.  Windows are evaluated in the
+// agent's local time.
+type Schedule struct {
+	windows []Window
+	iops    uint
+
+	lock sync.Mutex
+
+	// until is when the windows' state, open, next needs to be re-evaluated.
+	until time.Time
+	open  bool
+}
+
+// NewSchedule returns a Schedule for windows, or nil if there are no windows.
+func NewSchedule(windows []Window, iops uint) *Schedule {
+	if len(windows) == 0 {
+		return nil
+	}
+
+	return &Schedule{
+		windows: windows,
+		iops:    iops,
+	}
+}
+
+// IOPS returns the limit on reads per second while a window is open.  Zero
+// means prefaulting is paused.
+func (s *Schedule) IOPS() uint {
+	return s.iops
+}
+
+// Open returns true if any window is open at t.
+func (s *Schedule) Open(t time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if t.Before(s.until) {
+		return s.open
+	}
+
+	// Windows only open on a minute boundary, so while every window is closed
+	// their state can't change until the next minute.
+	s.open = false
+	s.until = t.Truncate(time.Minute).Add(time.Minute)
+	for _, w := range s.windows {
+		if closes := w.closes(t); closes.After(t) {
+			if !s.open || closes.Before(s.until) {
+				s.until = closes
+			}
+			s.open = true
+		}
+	}
+
+	return s.open
+}
+
+// Paused returns true if prefaulting is paused at t.
+func (s *Schedule) Paused(t time.Time) bool {
+	return s.iops == 0 && s.Open(t)
+}
@@ -0,0 +1,109 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		in  string
+		err bool
+	}{
+		{in: "0 2 * * * 3h"},                  // 0
+		{in: "*/15 1-5 1,15 */2 1-5 90s"},     // 1
+		{in: "0 0 * * 7 1h"},                  // 2
+		{in: "0 2 * * *", err: true},          // 3
+		{in: "60 2 * * * 1h", err: true},      // 4
+		{in: "0 2 0 * * 1h", err: true},       // 5
+		{in: "0 5-2 * * * 1h", err: true},     // 6
+		{in: "*/0 2 * * * 1h", err: true},     // 7
+		{in: "0 2 * * * 0s", err: true},       // 8
+		{in: "0 2 * * * 169h", err: true},     // 9
+		{in: "0 2 * * * forever", err: true},  // 10
+		{in: "a 2 * * * 1h", err: true},       // 11
+		{in: "0 2 * * mon 1h", err: true},     // 12
+		{in: "0 2 * * * 1h extra", err: true}, // 13
+	}
+
+	for n, test := range tests {
+		w, err := ParseWindow(test.in)
+		switch {
+		case test.err && err == nil:
+			t.Fatalf("%d: parsed %q", n, test.in)
+		case !test.err && err != nil:
+			t.Fatalf("%d: unable to parse %q: %v", n, test.in, err)
+		case !test.err && w.String() != test.in:
+			t.Fatalf("%d: got %q, want %q", n, w.String(), test.in)
+		}
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	mustParse := func(s string) Window {
+		w, err := ParseWindow(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// Nightly at 23:30 for 2h, and on Sundays or the 1st of the month at noon
+	// for 30m.
+	s := NewSchedule([]Window{
+		mustParse("30 23 * * * 2h"),
+		mustParse("0 12 1 * 0 30m"),
+	}, 0)
+
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		at   string
+		open bool
+	}{
+		{at: "2019-03-05 23:29:59", open: false}, // 0
+		{at: "2019-03-05 23:30:00", open: true},  // 1
+		{at: "2019-03-06 00:45:00", open: true},  // 2
+		{at: "2019-03-06 01:29:59", open: true},  // 3
+		{at: "2019-03-06 01:30:00", open: false}, // 4
+		{at: "2019-03-06 12:10:00", open: false}, // 5: a Wednesday
+		{at: "2019-03-10 12:10:00", open: true},  // 6: a Sunday
+		{at: "2019-03-10 12:30:00", open: false}, // 7
+		{at: "2019-04-01 12:29:00", open: true},  // 8: the 1st, a Monday
+	}
+
+	for n, test := range tests {
+		if open := s.Open(at(test.at)); open != test.open {
+			t.Fatalf("%d: open at %s: %t, want %t", n, test.at, open, test.open)
+		}
+		if paused := s.Paused(at(test.at)); paused != test.open {
+			t.Fatalf("%d: paused at %s: %t, want %t", n, test.at, paused, test.open)
+		}
+	}
+
+	if s := NewSchedule(nil, 0); s != nil {
+		t.Fatal("schedule without windows")
+	}
+	if s := NewSchedule([]Window{mustParse("* * * * * 1m")}, 100); s.Paused(at("2019-03-05 00:00:00")) {
+		t.Fatal("throttled schedule paused")
+	}
+}
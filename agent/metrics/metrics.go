@@ -0,0 +1,376 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics is a small, dependency-free registry of counters and gauges.
+// The registry is rendered in the Prometheus text exposition format by the
+// agent's http listener and can be snapshotted by other sinks.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Namespace is prepended to every metric name.
+const Namespace = "pg_prefaulter"
+
+// Type is the type of a metric.
+type Type int
+
+const (
+	TypeCounter Type = iota
+	TypeGauge
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeCounter:
+		return "counter"
+	case TypeGauge:
+		return "gauge"
+	default:
+		panic(fmt.Sprintf("unknown metric type: %d", t))
+	}
+}
+
+// Label is a single name/value pair attached to a metric.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// SortedLabels returns the labels in m sorted by name.
+func SortedLabels(m map[string]string) []Label {
+	labels := make([]Label, 0, len(m))
+	for name, value := range m {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	return labels
+}
+
+// Sample is a point-in-time value of a single metric.
+type Sample struct {
+	Name   string
+	Help   string
+	Type   Type
+	Labels []Label
+	Value  float64
+}
+
+type metric interface {
+	sample() Sample
+}
+
+// Registry holds a set of metrics.  Registry is safe for concurrent use.
+type Registry struct {
+	lock    sync.RWMutex
+	metrics map[string]metric
+
+	// constLabels are added to every sample, after the metric's own labels.
+	constLabels []Label
+}
+
+// DefaultRegistry is the registry rendered by the agent.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+	}
+}
+
+// NewCounter returns the counter named name in the DefaultRegistry.
+func NewCounter(name, help string, labels ...Label) *Counter {
+	return DefaultRegistry.Counter(name, help, labels...)
+}
+
+// NewGauge returns the gauge named name in the DefaultRegistry.
+func NewGauge(name, help string, labels ...Label) *Gauge {
+	return DefaultRegistry.Gauge(name, help, labels...)
+}
+
+// Counter returns the counter identified by name and labels, creating it if
+// necessary.
+func (r *Registry) Counter(name, help string, labels ...Label) *Counter {
+	m := r.getOrCreate(name, labels, func() metric {
+		return &Counter{desc: newDesc(name, help, TypeCounter, labels)}
+	})
+
+	c, ok := m.(*Counter)
+	if !ok {
+		panic(fmt.Sprintf("metric %q is not a counter", name))
+	}
+	return c
+}
+
+// Gauge returns the gauge identified by name and labels, creating it if
+// necessary.
+func (r *Registry) Gauge(name, help string, labels ...Label) *Gauge {
+	m := r.getOrCreate(name, labels, func() metric {
+		return &Gauge{desc: newDesc(name, help, TypeGauge, labels)}
+	})
+
+	g, ok := m.(*Gauge)
+	if !ok {
+		panic(fmt.Sprintf("metric %q is not a gauge", name))
+	}
+	return g
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn each time the
+// registry is read.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...Label) {
+	r.getOrCreate(name, labels, func() metric {
+		return &funcMetric{desc: newDesc(name, help, TypeGauge, labels), fn: fn}
+	})
+}
+
+// CounterFunc registers a counter whose value is computed by fn each time the
+// registry is read, e.g. to export a counter maintained by a library.  fn must
+// never decrease.
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labels ...Label) {
+	r.getOrCreate(name, labels, func() metric {
+		return &funcMetric{desc: newDesc(name, help, TypeCounter, labels), fn: fn}
+	})
+}
+
+// SetConstLabels adds labels, e.g. the name of the cluster, to every sample of
+// every metric in the registry.  A metric's own label takes precedence over a
+// constant label of the same name.
+func (r *Registry) SetConstLabels(labels []Label) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.constLabels = append([]Label(nil), labels...)
+}
+
+func (r *Registry) getOrCreate(name string, labels []Label, create func() metric) metric {
+	key := seriesKey(name, labels)
+
+	r.lock.RLock()
+	m, found := r.metrics[key]
+	r.lock.RUnlock()
+	if found {
+		return m
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if m, found := r.metrics[key]; found {
+		return m
+	}
+
+	m = create()
+	r.metrics[key] = m
+	return m
+}
+
+// Snapshot returns the current value of every metric, sorted by name.
+func (r *Registry) Snapshot() []Sample {
+	r.lock.RLock()
+	samples := make([]Sample, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		s := m.sample()
+		s.Labels = withConstLabels(s.Labels, r.constLabels)
+		samples = append(samples, s)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return formatLabels(samples[i].Labels) < formatLabels(samples[j].Labels)
+	})
+
+	return samples
+}
+
+// WriteText renders the registry in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	var lastName string
+	for _, s := range r.Snapshot() {
+		if s.Name != lastName {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.Name, s.Help, s.Name, s.Type); err != nil {
+				return err
+			}
+			lastName = s.Name
+		}
+
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", s.Name, formatLabels(s.Labels), formatValue(s.Value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler returns an http.Handler that renders the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    Type
+	labels []Label
+}
+
+func newDesc(name, help string, typ Type, labels []Label) desc {
+	return desc{
+		name:   Namespace + "_" + name,
+		help:   help,
+		typ:    typ,
+		labels: append([]Label(nil), labels...),
+	}
+}
+
+func (d desc) newSample(v float64) Sample {
+	return Sample{
+		Name:   d.name,
+		Help:   d.help,
+		Type:   d.typ,
+		Labels: d.labels,
+		Value:  v,
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	desc
+	v uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the counter's current value.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) sample() Sample {
+	return c.newSample(float64(c.Value()))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	bits uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, next) {
+			return
+		}
+	}
+}
+
+// Value returns the gauge's current value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) sample() Sample {
+	return g.newSample(g.Value())
+}
+
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+func (f *funcMetric) sample() Sample {
+	return f.newSample(f.fn())
+}
+
+// withConstLabels returns labels followed by the constant labels whose names
+// aren't already used by labels.
+func withConstLabels(labels, constLabels []Label) []Label {
+	if len(constLabels) == 0 {
+		return labels
+	}
+
+	all := make([]Label, len(labels), len(labels)+len(constLabels))
+	copy(all, labels)
+next:
+	for _, c := range constLabels {
+		for _, l := range labels {
+			if l.Name == c.Name {
+				continue next
+			}
+		}
+		all = append(all, c)
+	}
+
+	return all
+}
+
+func seriesKey(name string, labels []Label) string {
+	return name + formatLabels(labels)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf("%s=%q", l.Name, l.Value)
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return fmt.Sprintf("%g", v)
+	}
+}
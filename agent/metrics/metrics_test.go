@@ -0,0 +1,80 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("pages_total", "Pages read.", Label{"cache", "io"}).Add(3)
+	r.Counter("pages_total", "Pages read.", Label{"cache", "fh"}).Inc()
+	r.Gauge("lag_bytes", "Replay lag.").Set(1.5)
+	r.GaugeFunc("workers", "Workers.", func() float64 { return 4 })
+	r.CounterFunc("hits_total", "Hits.", func() float64 { return 7 }, Label{"cache", "io"})
+
+	// Repeated lookups return the same series
+	r.Counter("pages_total", "Pages read.", Label{"cache", "io"}).Inc()
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	const want = `# HELP pg_prefaulter_hits_total Hits.
+# TYPE pg_prefaulter_hits_total counter
+pg_prefaulter_hits_total{cache="io"} 7
+# HELP pg_prefaulter_lag_bytes Replay lag.
+# TYPE pg_prefaulter_lag_bytes gauge
+pg_prefaulter_lag_bytes 1.5
+# HELP pg_prefaulter_pages_total Pages read.
+# TYPE pg_prefaulter_pages_total counter
+pg_prefaulter_pages_total{cache="fh"} 1
+pg_prefaulter_pages_total{cache="io"} 4
+# HELP pg_prefaulter_workers Workers.
+# TYPE pg_prefaulter_workers gauge
+pg_prefaulter_workers 4
+`
+	if diff := pretty.Compare(buf.String(), want); diff != "" {
+		t.Fatalf("WriteText diff: (-got +want)\n%s", diff)
+	}
+}
+
+func TestRegistry_SetConstLabels(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("lag_bytes", "Replay lag.").Set(1)
+	r.Counter("events_total", "Events.", Label{"role", "primary"}).Inc()
+	r.SetConstLabels([]Label{{"cluster", "orders"}, {"role", "replica"}})
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	// A metric's own label wins over a constant label of the same name
+	const want = `# HELP pg_prefaulter_events_total Events.
+# TYPE pg_prefaulter_events_total counter
+pg_prefaulter_events_total{role="primary",cluster="orders"} 1
+# HELP pg_prefaulter_lag_bytes Replay lag.
+# TYPE pg_prefaulter_lag_bytes gauge
+pg_prefaulter_lag_bytes{cluster="orders",role="replica"} 1
+`
+	if diff := pretty.Compare(buf.String(), want); diff != "" {
+		t.Fatalf("WriteText diff: (-got +want)\n%s", diff)
+	}
+}
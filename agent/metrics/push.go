@@ -0,0 +1,88 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Push replaces the metrics grouped under job and the grouping labels on the
+// Prometheus Pushgateway at gateway with the registry's current values.
+func (r *Registry) Push(ctx context.Context, client *http.Client, gateway, job string, grouping ...Label) error {
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return errors.Wrap(err, "invalid pushgateway URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("pushgateway URL %q must be http or https", u.Redacted())
+	}
+
+	if job == "" {
+		return errors.New("pushgateway job must not be empty")
+	}
+	path := "/metrics/" + groupingPair(Label{Name: "job", Value: job})
+	for _, l := range grouping {
+		path += "/" + groupingPair(l)
+	}
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + path
+	u.Path, _ = url.PathUnescape(u.RawPath)
+
+	var body bytes.Buffer
+	if err := r.WriteText(&body); err != nil {
+		return errors.Wrap(err, "unable to render metrics")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), &body)
+	if err != nil {
+		return errors.Wrap(err, "unable to create pushgateway request")
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "unable to push metrics")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pushgateway returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+// groupingPair renders a grouping label as a Pushgateway URL path segment.
+// Values that are empty or contain a slash are base64 encoded.
+func groupingPair(l Label) string {
+	switch {
+	case l.Value == "":
+		return l.Name + "@base64/="
+	case strings.Contains(l.Value, "/"):
+		return l.Name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(l.Value))
+	default:
+		return l.Name + "/" + url.PathEscape(l.Value)
+	}
+}
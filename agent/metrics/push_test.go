@@ -0,0 +1,115 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestRegistry_Push(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("pages_total", "Pages read.").Add(3)
+
+	type pushed struct {
+		Method      string
+		Path        string
+		ContentType string
+		Body        string
+	}
+	var got pushed
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		got = pushed{
+			Method:      req.Method,
+			Path:        req.URL.EscapedPath(),
+			ContentType: req.Header.Get("Content-Type"),
+			Body:        string(body),
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		gateway  string
+		job      string
+		grouping []Label
+		status   int
+		path     string
+		err      bool
+	}{
+		{ // 0
+			gateway:  srv.URL,
+			job:      "pg_prefaulter",
+			grouping: []Label{{"instance", "db-1"}},
+			path:     "/metrics/job/pg_prefaulter/instance/db-1",
+		},
+		{ // 1
+			gateway:  srv.URL + "/prefix/",
+			job:      "catch up",
+			grouping: []Label{{"instance", "a/b"}, {"env", ""}},
+			path:     "/prefix/metrics/job/catch%20up/instance@base64/YS9i/env@base64/=",
+		},
+		{ // 2
+			gateway: srv.URL,
+			job:     "pg_prefaulter",
+			status:  http.StatusBadRequest,
+			err:     true,
+		},
+		{ // 3
+			gateway: srv.URL,
+			err:     true,
+		},
+		{ // 4
+			gateway: "ftp://example.com",
+			job:     "pg_prefaulter",
+			err:     true,
+		},
+	}
+
+	for n, test := range tests {
+		got = pushed{}
+		status = http.StatusOK
+		if test.status != 0 {
+			status = test.status
+		}
+
+		err := r.Push(context.Background(), srv.Client(), test.gateway, test.job, test.grouping...)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%d: expected failure", n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+
+		want := pushed{
+			Method:      http.MethodPut,
+			Path:        test.path,
+			ContentType: "text/plain; version=0.0.4",
+			Body:        "# HELP pg_prefaulter_pages_total Pages read.\n# TYPE pg_prefaulter_pages_total counter\npg_prefaulter_pages_total 3\n",
+		}
+		if diff := pretty.Compare(got, want); diff != "" {
+			t.Fatalf("%d: push diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
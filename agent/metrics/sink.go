@@ -0,0 +1,28 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+)
+
+// Sink publishes snapshots of a registry to a monitoring system that doesn't
+// scrape the agent's http listener.
+type Sink interface {
+	// Name identifies the sink in logs.
+	Name() string
+
+	// Publish sends samples, as returned by Registry.Snapshot, to the sink.
+	Publish(ctx context.Context, samples []Sample) error
+}
@@ -0,0 +1,173 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// The agent is made of components that each run on their own schedule:
+//
+// 1) the role watcher asks whether the database is a primary or a follower
+// 2) the lag monitor measures a follower's lag, replay state, and slots
+// 3) the WAL scanner (the loop in Start) predicts the WAL files about to be
+//    replayed from the most recently observed role and lag
+// 4) the prefault dispatcher (faultWALFiles) hands each predicted WAL file to
+//    the walCache, which decodes it and prefaults its pages
+//
+// The role watcher and lag monitor wake the WAL scanner through observedCh.
+// The WAL scanner never waits on them, so a slow lag query delays the next lag
+// measurement but never the decoding of WAL.  Once a monitor has failed
+// monitorMaxFailures times in a row its last observation is forgotten, and the
+// WAL scanner stops until the database is observed again.
+
+// monitorMaxFailures is the number of consecutive failures after which a
+// monitor's last observation is forgotten.
+const monitorMaxFailures = 3
+
+// monitor runs check immediately and then every interval, or whenever wake is
+// signalled, until ctx is cancelled.  Errors are logged at errLevel and
+// counted, and the monitor carries on.
+type monitor struct {
+	name     string
+	interval time.Duration
+	wake     <-chan struct{}
+	errLevel zerolog.Level
+	check    func() error
+
+	// invalidate, if set, is called once check has failed monitorMaxFailures
+	// times in a row.
+	invalidate func()
+}
+
+func (m monitor) run(ctx context.Context, log zerolog.Logger) {
+	errs := metrics.NewCounter("monitor_errors_total", "Number of times a monitor failed to observe the database.",
+		metrics.Label{Name: "monitor", Value: m.name})
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		err := m.check()
+		switch {
+		case err == nil:
+			failures = 0
+		case !lib.IsShuttingDown(ctx):
+			errs.Inc()
+			log.WithLevel(m.errLevel).Err(err).Str("monitor", m.name).Msg("unable to observe the database, retrying")
+
+			if failures++; failures == monitorMaxFailures && m.invalidate != nil {
+				log.Warn().Str("monitor", m.name).Int("failures", failures).
+					Msg("forgetting the last observation of the database until it is observed again")
+				m.invalidate()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// startMonitors starts the role watcher and the lag monitor once the queries
+// for the database's version are known.
+func (a *Agent) startMonitors() {
+	a.monitorsOnce.Do(func() {
+		go monitor{
+			name:       "role",
+			interval:   a.cfg.PollInterval,
+			errLevel:   zerolog.ErrorLevel,
+			check:      a.checkRole,
+			invalidate: a.forgetRole,
+		}.run(a.shutdownCtx, a.log)
+
+		go monitor{
+			name:       "lag",
+			interval:   a.cfg.PollInterval,
+			wake:       a.lagCh,
+			errLevel:   zerolog.DebugLevel,
+			check:      a.checkLag,
+			invalidate: a.forgetLag,
+		}.run(a.shutdownCtx, a.log)
+	})
+}
+
+// checkRole records whether the database is a primary or a follower.  A
+// promotion wakes the WAL scanner and a new follower wakes the lag monitor.
+func (a *Agent) checkRole() error {
+	if err := a.ensureDBPool(); err != nil {
+		return errors.Wrap(err, "unable to determine if database is primary or not")
+	}
+
+	state, err := a.dbState()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine if database is primary or not")
+	}
+
+	changed := a.recordRole(state)
+	switch state {
+	case _DBStatePrimary:
+		a.recordLag(0)
+		a.resetRecoveryState()
+		if changed {
+			notify(a.observedCh)
+		}
+	case _DBStateFollower:
+		if changed {
+			notify(a.lagCh)
+		}
+	}
+
+	return nil
+}
+
+// checkLag records a follower's lag, replay state, and replication slots.  The
+// first lag measured since the role changed wakes the WAL scanner.
+func (a *Agent) checkLag() error {
+	if state, _, _ := a.observedDB(); state != _DBStateFollower {
+		return nil
+	}
+
+	lag, err := a.queryFollowerLag()
+	if err != nil {
+		return errors.Wrap(err, "unable to query follower lag")
+	}
+
+	if a.recordLag(lag) {
+		notify(a.observedCh)
+	}
+	a.recordRecoveryState(lag)
+	a.recordReplicationSlots()
+
+	return nil
+}
+
+// notify wakes the receiver of ch without blocking.  A receiver that is
+// already due to wake up isn't woken twice.
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
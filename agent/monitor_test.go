@@ -0,0 +1,190 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func TestMonitorRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wake := make(chan struct{}, 1)
+	checks := make(chan struct{}, 10)
+	var failures int32
+	invalidated := make(chan int32, 10)
+	m := monitor{
+		name:     "test",
+		interval: time.Hour,
+		wake:     wake,
+		errLevel: zerolog.DebugLevel,
+		check: func() error {
+			atomic.AddInt32(&failures, 1)
+			checks <- struct{}{}
+			return errors.New("query failed")
+		},
+		invalidate: func() {
+			invalidated <- atomic.LoadInt32(&failures)
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.run(ctx, zerolog.Nop())
+	}()
+
+	checked := func() bool {
+		select {
+		case <-checks:
+			return true
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+
+	// The first check runs immediately, and a failed check doesn't stop the
+	// monitor from being woken.
+	if !checked() {
+		t.Fatal("monitor didn't check at startup")
+	}
+	notify(wake)
+	if !checked() {
+		t.Fatal("monitor didn't check when woken")
+	}
+
+	// The last observation is forgotten once, after monitorMaxFailures
+	// failures in a row.
+	for i := 0; i < monitorMaxFailures; i++ {
+		notify(wake)
+		if !checked() {
+			t.Fatal("monitor didn't check when woken")
+		}
+	}
+	select {
+	case n := <-invalidated:
+		if n != monitorMaxFailures {
+			t.Fatalf("invalidated after %d failures, want %d", n, monitorMaxFailures)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor didn't invalidate")
+	}
+	if n := len(invalidated); n != 0 {
+		t.Fatalf("invalidated %d more times", n)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor didn't stop when cancelled")
+	}
+}
+
+func TestRecordRoleLag(t *testing.T) {
+	type observation struct {
+		state _DBState
+		lag   units.Base2Bytes
+	}
+
+	tests := []struct {
+		observations []observation
+		changed      bool
+		first        bool
+		lagObserved  bool
+	}{
+		{ // 0: a new follower
+			observations: []observation{{_DBStateFollower, 0}},
+			changed:      true,
+			first:        true,
+			lagObserved:  true,
+		},
+		{ // 1: lag measured again in the same role
+			observations: []observation{{_DBStateFollower, 1 * units.MiB}, {_DBStateFollower, 2 * units.MiB}},
+			changed:      false,
+			first:        false,
+			lagObserved:  true,
+		},
+		{ // 2: a promotion forgets the follower's lag
+			observations: []observation{{_DBStateFollower, 1 * units.MiB}, {_DBStatePrimary, 0}},
+			changed:      true,
+			first:        true,
+			lagObserved:  true,
+		},
+		{ // 3: a demotion measures the lag anew
+			observations: []observation{{_DBStatePrimary, 0}, {_DBStateFollower, 16 * units.MiB}},
+			changed:      true,
+			first:        true,
+			lagObserved:  true,
+		},
+	}
+
+	for n, test := range tests {
+		a := &Agent{}
+
+		var changed, first bool
+		for _, o := range test.observations {
+			changed = a.recordRole(o.state)
+			first = a.recordLag(o.lag)
+		}
+
+		last := test.observations[len(test.observations)-1]
+		state, lag, lagObserved := a.observedDB()
+		if state != last.state || lag != last.lag || lagObserved != test.lagObserved {
+			t.Errorf("%d: observed %v, %v, %v, want %v, %v, %v", n, state, lag, lagObserved, last.state, last.lag, test.lagObserved)
+		}
+		if changed != test.changed {
+			t.Errorf("%d: changed %v, want %v", n, changed, test.changed)
+		}
+		if first != test.first {
+			t.Errorf("%d: first %v, want %v", n, first, test.first)
+		}
+	}
+
+	// The scanner waits for the lag once the role is known
+	a := &Agent{}
+	a.recordRole(_DBStateFollower)
+	if _, _, lagObserved := a.observedDB(); lagObserved {
+		t.Fatal("lag observed before it was measured")
+	}
+
+	// A forgotten lag has to be measured again
+	a.recordLag(1 * units.MiB)
+	a.forgetLag()
+	if state, _, lagObserved := a.observedDB(); state != _DBStateFollower || lagObserved {
+		t.Fatalf("observed %v, %v after forgetting the lag", state, lagObserved)
+	}
+	if !a.recordLag(1 * units.MiB) {
+		t.Fatal("lag measured again wasn't the first")
+	}
+
+	// A forgotten role is unknown until it is observed again, even if it
+	// didn't change.
+	a.forgetRole()
+	if state, _, lagObserved := a.observedDB(); state != _DBStateUnknown || lagObserved {
+		t.Fatalf("observed %v, %v after forgetting the role", state, lagObserved)
+	}
+	if !a.recordRole(_DBStateFollower) {
+		t.Fatal("role observed again wasn't recorded as changed")
+	}
+	if state, _, _ := a.observedDB(); state != _DBStateFollower {
+		t.Fatalf("observed %v, want %v", state, _DBStateFollower)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/rs/zerolog"
+)
+
+// Option customizes an Agent embedded in another program.
+type Option func(*Agent)
+
+// WithLogger sends the agent's logs to logger instead of the global logger.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(a *Agent) {
+		a.log = logger
+	}
+}
+
+// WithMetricsSink publishes the agent's metrics to sink every interval, in
+// addition to any sinks enabled by the configuration.
+func WithMetricsSink(sink metrics.Sink, interval time.Duration) Option {
+	return func(a *Agent) {
+		a.metricSinks = append(a.metricSinks, metricSink{
+			sink:     sink,
+			interval: interval,
+		})
+	}
+}
+
+// WithSignals has the agent handle the process's signals: SIGINT and SIGTERM
+// shut the agent down.  Programs embedding the agent normally handle signals
+// themselves and cancel the context passed to Start instead.
+func WithSignals() Option {
+	return func(a *Agent) {
+		a.handlesSignals = true
+	}
+}
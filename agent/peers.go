@@ -0,0 +1,92 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/warmset"
+	"github.com/bschofield/pg_prefaulter/lib"
+)
+
+// peerTimeout bounds each request for a peer's hot blocks.
+const peerTimeout = 30 * time.Second
+
+var (
+	peerExchanges     = metrics.NewCounter("peer_exchanges_total", "Number of requests for a peer's hot blocks.")
+	peerExchangeFails = metrics.NewCounter("peer_exchange_failures_total", "Number of requests for a peer's hot blocks that failed.")
+	peerHintBlocks    = metrics.NewCounter("peer_hint_blocks_total", "Number of blocks added to the warm set from peers' hot blocks.")
+)
+
+// runPeerExchange periodically requests the most recently prefaulted blocks of
+// each peer and adds those the agent hasn't seen to its warm set, where they
+// are prefaulted.  The first exchange happens immediately so that a rebuilt
+// replica starts warming what its peers already know is hot.
+func (a *Agent) runPeerExchange() {
+	client, err := lib.NewHTTPClient(a.cfg.HTTPAuth, peerTimeout)
+	if err != nil {
+		a.log.Error().Err(err).Msg("unable to configure the peer client, peer exchange disabled")
+		return
+	}
+
+	ticker := time.NewTicker(a.cfg.PeerInterval)
+	defer ticker.Stop()
+
+	for {
+		a.exchangePeers(client)
+
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exchangePeers requests the hot blocks of every peer once.
+func (a *Agent) exchangePeers(client *http.Client) {
+	var added uint64
+	for _, peer := range a.cfg.Peers {
+		if a.shutdownCtx.Err() != nil {
+			return
+		}
+
+		peerExchanges.Inc()
+		m, err := warmset.Fetch(a.shutdownCtx, client, peer, a.cfg.PeerTopBlocks)
+		if err != nil {
+			peerExchangeFails.Inc()
+			a.log.Debug().Err(err).Str("peer", peer).Msg("unable to fetch peer's hot blocks")
+			continue
+		}
+
+		n, err := a.warmSet.Hint(m)
+		if err != nil {
+			peerExchangeFails.Inc()
+			a.log.Warn().Err(err).Str("peer", peer).Msg("ignoring peer's hot blocks")
+			continue
+		}
+
+		if n > 0 {
+			a.log.Debug().Str("peer", peer).Uint64("blocks", n).Msg("added peer's hot blocks to the warm set")
+		}
+		peerHintBlocks.Add(n)
+		added += n
+	}
+
+	if added > 0 {
+		a.replayWarmSet()
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/pglog"
+	"github.com/bschofield/pg_prefaulter/agent/stallhist"
+)
+
+// pgLogPollInterval is how often the server log is checked for new entries.
+const pgLogPollInterval = time.Second
+
+var pgLogEvents = func() map[pglog.Kind]*metrics.Counter {
+	counters := make(map[pglog.Kind]*metrics.Counter, len(pglog.Kinds))
+	for _, kind := range pglog.Kinds {
+		counters[kind] = metrics.NewCounter("pg_log_events_total",
+			"Number of recovery conflicts, stalls, and invalid WAL records reported by the server log.",
+			metrics.Label{Name: "kind", Value: string(kind)})
+	}
+	return counters
+}()
+
+// PGLogStatus summarizes the events found in the server's log.
+type PGLogStatus struct {
+	Events      map[pglog.Kind]uint64 `json:"events"`
+	LastEvent   *time.Time            `json:"last-event,omitempty"`
+	LastKind    pglog.Kind            `json:"last-kind,omitempty"`
+	LastMessage string                `json:"last-message,omitempty"`
+}
+
+// observePGLog records an event found in the server's log.  Replay stalls are
+// attributed to the relation being replayed, if reported, and every event
+// wakes the WAL scan: a stalled or conflicted replay, or replay reaching the
+// end of the WAL received, is when prefaulting further ahead pays off.
+func (a *Agent) observePGLog(ev pglog.Event) {
+	pgLogEvents[ev.Kind].Inc()
+	a.log.Debug().Str("kind", string(ev.Kind)).Str("message", ev.Message).
+		Dur("waited", ev.Waited).Msg("server log event")
+
+	a.recentEvents.add(recentEvent{
+		Time:    ev.Time,
+		Name:    "server-log",
+		Details: map[string]interface{}{"kind": string(ev.Kind), "message": ev.Message},
+	})
+
+	a.pgLogLock.Lock()
+	a.pgLogCounts[ev.Kind]++
+	a.pgLogLast = &ev
+	a.pgLogLock.Unlock()
+
+	if a.stallHistory != nil && ev.Waited > 0 && ev.Relation.Relation != 0 {
+		a.stallHistory.RecordRelationStall(stallhist.Relation{
+			Tablespace: ev.Relation.Tablespace,
+			Database:   ev.Relation.Database,
+			Relation:   ev.Relation.Relation,
+		}, ev.Waited)
+	}
+
+	select {
+	case a.pgLogCh <- struct{}{}:
+	default:
+	}
+}
+
+// pgLogStatus returns the events found in the server's log, or nil if the log
+// isn't tailed.
+func (a *Agent) pgLogStatus() *PGLogStatus {
+	if a.pgLog == nil {
+		return nil
+	}
+
+	a.pgLogLock.Lock()
+	defer a.pgLogLock.Unlock()
+
+	s := &PGLogStatus{
+		Events: make(map[pglog.Kind]uint64, len(pglog.Kinds)),
+	}
+	for _, kind := range pglog.Kinds {
+		s.Events[kind] = a.pgLogCounts[kind]
+	}
+	if a.pgLogLast != nil {
+		t := a.pgLogLast.Time.UTC()
+		s.LastEvent = &t
+		s.LastKind = a.pgLogLast.Kind
+		s.LastMessage = a.pgLogLast.Message
+	}
+
+	return s
+}
@@ -0,0 +1,232 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pglog tails PostgreSQL's csvlog or jsonlog and reports the messages
+// that explain why recovery is stalled or behind: queries cancelled by
+// recovery conflicts, replay waiting on conflicting queries or paused, and
+// invalid WAL records.  The log is read even when the database is too busy,
+// or too far behind, to answer the agent's queries.
+package pglog
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// Log formats.  FormatAuto picks the format from the log file's extension.
+const (
+	FormatAuto    = "auto"
+	FormatCSVLog  = "csvlog"
+	FormatJSONLog = "jsonlog"
+)
+
+// Formats lists the log formats.
+var Formats = []string{FormatAuto, FormatCSVLog, FormatJSONLog}
+
+// Kind classifies an Event.
+type Kind string
+
+// Kinds of events.
+const (
+	// KindConflict is a query cancelled, or a session terminated, by a
+	// conflict with recovery.
+	KindConflict Kind = "conflict"
+
+	// KindStall is replay waiting on a conflicting query or paused.
+	KindStall Kind = "stall"
+
+	// KindInvalidRecord is an invalid WAL record, e.g. replay reaching the end
+	// of the WAL received so far or a corrupt segment.
+	KindInvalidRecord Kind = "invalid-record"
+)
+
+// Kinds lists every Kind.
+var Kinds = []Kind{KindConflict, KindStall, KindInvalidRecord}
+
+// Event is a message of interest found in the log.
+type Event struct {
+	Time    time.Time
+	Kind    Kind
+	Message string
+
+	// Waited is how long replay had been waiting, when the server reports it
+	// (log_recovery_conflict_waits).
+	Waited time.Duration
+
+	// Relation is the relation being replayed, when the server reports it.
+	// Relation.Relation is 0 otherwise.
+	Relation pg.RelFileNode
+}
+
+// entry holds the fields of a log entry used to classify it.
+type entry struct {
+	severity string
+	message  string
+	detail   string
+	context  string
+}
+
+// csvlog columns, see "Using CSV-Format Log Output" in the PostgreSQL manual.
+const (
+	csvSeverity = 11
+	csvMessage  = 13
+	csvDetail   = 14
+	csvContext  = 18
+)
+
+var (
+	conflictRE      = regexp.MustCompile(`due to conflict with recovery`)
+	stallRE         = regexp.MustCompile(`^recovery (?:still waiting after (\d+(?:\.\d+)?) ms|has paused)`)
+	invalidRecordRE = regexp.MustCompile(`^(?:invalid (?:record length|record offset|resource manager ID|magic number|info bits|contrecord length)|record with incorrect prev-link|incorrect resource manager data checksum|unexpected pageaddr|there is no contrecord flag|contrecord is requested by|record length \d+ at \S+ too long)`)
+
+	// The CONTEXT of a message logged during replay names the record being
+	// replayed:
+	//
+	// WAL redo at 0/3000108 for Heap2/PRUNE: snapshotConflictHorizon: 744, nredirected: 0, ndead: 1; blkref #0: rel 1663/5/16384, blk 0
+	relationRE = regexp.MustCompile(`rel (\d+)/(\d+)/(\d+)`)
+)
+
+// parseCSV parses a csvlog record.
+func parseCSV(record []byte) (entry, bool) {
+	r := csv.NewReader(bytes.NewReader(record))
+	r.FieldsPerRecord = -1
+	fields, err := r.Read()
+	if err != nil || len(fields) <= csvMessage {
+		return entry{}, false
+	}
+
+	e := entry{
+		severity: fields[csvSeverity],
+		message:  fields[csvMessage],
+	}
+	if len(fields) > csvDetail {
+		e.detail = fields[csvDetail]
+	}
+	if len(fields) > csvContext {
+		e.context = fields[csvContext]
+	}
+
+	return e, true
+}
+
+// parseJSON parses a jsonlog record.
+func parseJSON(record []byte) (entry, bool) {
+	var fields struct {
+		Severity string `json:"error_severity"`
+		Message  string `json:"message"`
+		Detail   string `json:"detail"`
+		Context  string `json:"context"`
+	}
+	if err := json.Unmarshal(record, &fields); err != nil || fields.Message == "" {
+		return entry{}, false
+	}
+
+	return entry{
+		severity: fields.Severity,
+		message:  fields.Message,
+		detail:   fields.Detail,
+		context:  fields.Context,
+	}, true
+}
+
+// classify returns the Event e reports, if any.
+func classify(now time.Time, e entry) (Event, bool) {
+	ev := Event{
+		Time:    now,
+		Message: e.message,
+	}
+
+	switch {
+	case conflictRE.MatchString(e.message):
+		ev.Kind = KindConflict
+	case stallRE.MatchString(e.message):
+		ev.Kind = KindStall
+		if m := stallRE.FindStringSubmatch(e.message); m[1] != "" {
+			if ms, err := strconv.ParseFloat(m[1], 64); err == nil {
+				ev.Waited = time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+	case invalidRecordRE.MatchString(e.message):
+		ev.Kind = KindInvalidRecord
+	default:
+		return Event{}, false
+	}
+
+	if m := relationRE.FindStringSubmatch(e.context); m != nil {
+		if rfn, err := parseRelation(m[1:]); err == nil {
+			ev.Relation = rfn
+		}
+	}
+
+	return ev, true
+}
+
+// parseRelation parses the tablespace, database, and relation OIDs of a
+// relation.
+func parseRelation(oids []string) (pg.RelFileNode, error) {
+	var parsed [3]uint64
+	for i, oid := range oids {
+		n, err := strconv.ParseUint(oid, 10, 32)
+		if err != nil {
+			return pg.RelFileNode{}, err
+		}
+		parsed[i] = n
+	}
+
+	return pg.RelFileNode{
+		Tablespace: pg.OID(parsed[0]),
+		Database:   pg.OID(parsed[1]),
+		Relation:   pg.OID(parsed[2]),
+	}, nil
+}
+
+// splitLines splits buf into complete lines and the incomplete remainder.
+func splitLines(buf []byte) (records [][]byte, rest []byte) {
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return records, buf
+		}
+		if i > 0 {
+			records = append(records, buf[:i])
+		}
+		buf = buf[i+1:]
+	}
+}
+
+// splitCSV splits buf into complete csvlog records and the incomplete
+// remainder.  Quoted fields, e.g. a multi-line query, may contain newlines.
+func splitCSV(buf []byte) (records [][]byte, rest []byte) {
+	var quoted bool
+	start := 0
+	for i, c := range buf {
+		switch {
+		case c == '"':
+			// An escaped quote ("") toggles twice
+			quoted = !quoted
+		case c == '\n' && !quoted:
+			if i > start {
+				records = append(records, buf[start:i])
+			}
+			start = i + 1
+		}
+	}
+
+	return records, buf[start:]
+}
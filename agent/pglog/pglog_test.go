@@ -0,0 +1,178 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pglog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/rs/zerolog"
+)
+
+const (
+	csvConflict = `2019-03-05 01:02:03.456 UTC,"postgres","postgres",1234,"[local]",5c7dcb2b.4d2,1,"SELECT",2019-03-05 01:00:00 UTC,3/4,0,ERROR,40001,"canceling statement due to conflict with recovery","User query might have needed to see row versions that must be removed.",,,,,"select *
+from t;",,,"psql","client backend",,0`
+	csvStall = `2019-03-05 01:02:04.000 UTC,,,1000,,5c7dcb2b.3e8,5,,2019-03-05 01:00:00 UTC,1/0,0,LOG,00000,"recovery still waiting after 1000.5 ms: recovery conflict on snapshot","Conflicting process: 1234.",,,,"WAL redo at 0/3000108 for Heap2/PRUNE: snapshotConflictHorizon: 744, nredirected: 0, ndead: 1; blkref #0: rel 1663/16384/16385, blk 0",,,,"","startup",,0`
+	csvReady = `2019-03-05 01:00:01.000 UTC,,,999,,5c7dcb2b.3e7,3,,2019-03-05 01:00:00 UTC,,0,LOG,00000,"database system is ready to accept read-only connections",,,,,,,,,"","postmaster",,0`
+
+	jsonInvalid = `{"timestamp":"2019-03-05 01:02:05.000 UTC","pid":1000,"error_severity":"LOG","state_code":"XX000","message":"invalid record length at 0/3000140: expected at least 24, got 0","backend_type":"startup"}`
+	jsonPaused  = `{"timestamp":"2019-03-05 01:02:06.000 UTC","pid":1000,"error_severity":"LOG","state_code":"00000","message":"recovery has paused","hint":"Execute pg_wal_replay_resume() to continue.","backend_type":"startup"}`
+)
+
+func TestClassify(t *testing.T) {
+	now := time.Date(2019, 3, 5, 1, 2, 3, 0, time.UTC)
+
+	tests := []struct {
+		record string
+		json   bool
+		event  *Event
+	}{
+		{ // 0
+			record: csvConflict,
+			event: &Event{
+				Time:    now,
+				Kind:    KindConflict,
+				Message: "canceling statement due to conflict with recovery",
+			},
+		},
+		{ // 1
+			record: csvStall,
+			event: &Event{
+				Time:     now,
+				Kind:     KindStall,
+				Message:  "recovery still waiting after 1000.5 ms: recovery conflict on snapshot",
+				Waited:   1000500 * time.Microsecond,
+				Relation: pg.RelFileNode{Tablespace: 1663, Database: 16384, Relation: 16385},
+			},
+		},
+		{ // 2
+			record: csvReady,
+		},
+		{ // 3
+			record: jsonInvalid,
+			json:   true,
+			event: &Event{
+				Time:    now,
+				Kind:    KindInvalidRecord,
+				Message: "invalid record length at 0/3000140: expected at least 24, got 0",
+			},
+		},
+		{ // 4
+			record: jsonPaused,
+			json:   true,
+			event: &Event{
+				Time:    now,
+				Kind:    KindStall,
+				Message: "recovery has paused",
+			},
+		},
+		{ // 5
+			record: `not json`,
+			json:   true,
+		},
+	}
+
+	for n, test := range tests {
+		parse := parseCSV
+		if test.json {
+			parse = parseJSON
+		}
+
+		var event *Event
+		if e, ok := parse([]byte(test.record)); ok {
+			if ev, ok := classify(now, e); ok {
+				event = &ev
+			}
+		}
+
+		if diff := pretty.Compare(event, test.event); diff != "" {
+			t.Fatalf("%d: event diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pglog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := path.Join(dir, "postgresql-01.csv")
+	if err := ioutil.WriteFile(first, []byte(csvConflict+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "postgresql-01.log"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []Kind
+	collect := func(ev Event) {
+		kinds = append(kinds, ev.Kind)
+	}
+	tailer := New(dir, FormatAuto, zerolog.Nop())
+
+	// The log present at startup is skipped
+	if err := tailer.poll(time.Now(), collect); err != nil {
+		t.Fatal(err)
+	}
+	if len(kinds) != 0 {
+		t.Fatalf("read the existing log: %v", kinds)
+	}
+
+	// Records are only read once complete
+	f, err := os.OpenFile(first, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	partial := len(csvConflict) / 2
+	if _, err := f.WriteString(csvStall + "\n" + csvConflict[:partial]); err != nil {
+		t.Fatal(err)
+	}
+	if err := tailer.poll(time.Now(), collect); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(csvConflict[partial:] + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tailer.poll(time.Now(), collect); err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(kinds, []Kind{KindStall, KindConflict}); diff != "" {
+		t.Fatalf("kinds diff: (-got +want)\n%s", diff)
+	}
+
+	// A rotated log is read from its start
+	second := path.Join(dir, "postgresql-02.csv")
+	if err := ioutil.WriteFile(second, []byte(csvReady+"\n"+csvStall+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(second, later, later); err != nil {
+		t.Fatal(err)
+	}
+	kinds = nil
+	if err := tailer.poll(time.Now(), collect); err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(kinds, []Kind{KindStall}); diff != "" {
+		t.Fatalf("kinds diff: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pglog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// maxRead bounds the log read by a single poll.  The rest is read by the
+	// following polls.
+	maxRead = 4 * 1024 * 1024
+
+	// maxRecord bounds an incomplete record.  Larger records are discarded.
+	maxRecord = 1024 * 1024
+)
+
+// Tailer follows the server's log.  path is either a log file or the
+// log_directory, in which case the most recently modified log file in the
+// format is followed, so that log rotation is followed too.
+type Tailer struct {
+	path   string
+	format string
+	log    zerolog.Logger
+
+	// started is set after the first poll.  The file followed at startup is
+	// read from its end, files that appear afterwards from their start.
+	started bool
+	name    string
+	fi      os.FileInfo
+	offset  int64
+	buf     []byte
+}
+
+// New returns a Tailer following path, written in format, one of Formats.
+func New(path, format string, log zerolog.Logger) *Tailer {
+	return &Tailer{
+		path:   path,
+		format: format,
+		log:    log,
+	}
+}
+
+// Run polls the log every interval and calls fn with each event found until
+// ctx is cancelled.
+func (t *Tailer) Run(ctx context.Context, interval time.Duration, fn func(Event)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failing bool
+	for {
+		switch err := t.poll(time.Now(), fn); {
+		case err != nil && !failing:
+			t.log.Warn().Err(err).Str("pg-log", t.path).Msg("unable to read the server log")
+			failing = true
+		case err == nil && failing:
+			t.log.Info().Str("pg-log", t.name).Msg("reading the server log")
+			failing = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads what has been appended to the log since the last poll.
+func (t *Tailer) poll(now time.Time, fn func(Event)) error {
+	started := t.started
+	t.started = true
+
+	name, err := t.current()
+	if err != nil {
+		return err
+	}
+	format, err := t.formatOf(name, name == t.path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return errors.Wrap(err, "unable to stat the server log")
+	}
+
+	// Rotated to a new file, or truncated on rotation
+	if name != t.name || t.fi == nil || !os.SameFile(fi, t.fi) || fi.Size() < t.offset {
+		t.name, t.offset, t.buf = name, 0, nil
+		if !started {
+			t.offset = fi.Size()
+		}
+	}
+	t.fi = fi
+
+	if fi.Size() == t.offset {
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "unable to open the server log")
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		return errors.Wrap(err, "unable to seek the server log")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxRead))
+	if err != nil {
+		return errors.Wrap(err, "unable to read the server log")
+	}
+	t.offset += int64(len(data))
+
+	var records [][]byte
+	t.buf = append(t.buf, data...)
+	parse := parseCSV
+	if format == FormatJSONLog {
+		records, t.buf = splitLines(t.buf)
+		parse = parseJSON
+	} else {
+		records, t.buf = splitCSV(t.buf)
+	}
+
+	for _, record := range records {
+		e, ok := parse(record)
+		if !ok {
+			continue
+		}
+		if ev, ok := classify(now, e); ok {
+			fn(ev)
+		}
+	}
+
+	// Don't let an unterminated record grow without bound
+	if len(t.buf) > maxRecord {
+		t.log.Debug().Int("bytes", len(t.buf)).Msg("discarding an oversized server log record")
+		t.buf = nil
+	} else {
+		t.buf = append([]byte(nil), t.buf...)
+	}
+
+	return nil
+}
+
+// current returns the log file to follow.
+func (t *Tailer) current() (string, error) {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to stat the server log")
+	}
+	if !fi.IsDir() {
+		return t.path, nil
+	}
+
+	files, err := ioutil.ReadDir(t.path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to list the server log directory")
+	}
+
+	var newest os.FileInfo
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if _, err := t.formatOf(fi.Name(), false); err != nil {
+			continue
+		}
+		if newest == nil || fi.ModTime().After(newest.ModTime()) {
+			newest = fi
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no csvlog or jsonlog files in %q", t.path)
+	}
+
+	return path.Join(t.path, newest.Name()), nil
+}
+
+// formatOf returns the format of the log file name.  The format of the file
+// named by the Tailer's path is configured or follows the file's extension.
+// In a log_directory, only the files with the extension PostgreSQL gives the
+// format are followed.
+func (t *Tailer) formatOf(name string, named bool) (string, error) {
+	var format string
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		format = FormatCSVLog
+	case ".json":
+		format = FormatJSONLog
+	}
+
+	switch {
+	case t.format != FormatAuto && (named || format == t.format):
+		return t.format, nil
+	case t.format == FormatAuto && format != "":
+		return format, nil
+	default:
+		return "", fmt.Errorf("%q is not a csvlog or jsonlog file", name)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"sync"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// predictDepth bounds the number of predictions buffered between the predict
+// and fault stages of the WAL pipeline.
+const predictDepth = pg.NumOldLSNs
+
+// scanWALFiles runs one pass of the WAL pipeline:
+//
+// 1) predict: find the WAL files PostgreSQL is about to replay
+// 2) fault: the prefault dispatcher hands predicted WAL files to the walCache
+//
+// The walCache decodes, filters, and prefaults the pages of each WAL file in
+// its own pipeline.  walFiles is every WAL file predicted during the pass.
+// When moreWork is set to true it indicates the caller should loop
+// immediately.
+func (a *Agent) scanWALFiles() (walFiles pg.WALFiles, moreWork bool, err error) {
+	predicted := make(chan pg.WALFiles, predictDepth)
+
+	var faultWG sync.WaitGroup
+	faultWG.Add(1)
+	go func() {
+		defer faultWG.Done()
+		moreWork = a.faultWALFiles(predicted)
+	}()
+
+	walFiles, err = a.getWALFiles(func(predictedWALFiles pg.WALFiles) {
+		predicted <- predictedWALFiles
+	})
+	close(predicted)
+	faultWG.Wait()
+
+	return walFiles, moreWork, err
+}
+
+// faultWALFiles pre-faults the heap pages referenced in WAL files as they are
+// predicted.  faultWALFiles returns true if enough WAL files were already in
+// flight that the caller should loop immediately.
+func (a *Agent) faultWALFiles(predicted <-chan pg.WALFiles) (moreWork bool) {
+	// Read through the cache to prefault a given WAL file.  The cache
+	// begins to fault the WAL file as soon as requested in the event of
+	// a cache miss.  FaultWALFile() dedupes requests and prevents a WAL
+	// file from concurrent prefault operations.
+	seen := make(map[pg.WALFilename]struct{})
+	var numWaiting int
+	for walFiles := range predicted {
+		for _, walFile := range walFiles {
+			if _, found := seen[walFile]; found {
+				continue
+			}
+			seen[walFile] = struct{}{}
+
+			if faulting, _ := a.walCache.FaultWALFile(walFile); faulting {
+				numWaiting++
+			}
+		}
+	}
+
+	return numWaiting > pg.NumOldLSNs
+}
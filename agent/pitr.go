@@ -0,0 +1,102 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// pitrTarget is where point-in-time recovery stops.
+type pitrTarget struct {
+	// lsn is pg.InvalidLSN and time is zero when unset.
+	lsn  pg.LSN
+	time time.Time
+}
+
+// getWALFilesPITR returns the WAL files to prefault ahead of point-in-time
+// recovery.  No database connection is used: recovery is tracked via the
+// startup process' title, falling back to pg_control, and segments that have
+// not yet been restored are fetched from the archive by the walCache.
+func (a *Agent) getWALFilesPITR() (pg.WALFiles, error) {
+	progress, err := readRecoveryProgress(a.cfg.ControlDataPath, a.cfg.PGData)
+	if err != nil {
+		return nil, newWALError(errors.Wrap(err, "unable to read recovery progress"), dbErrorCategory(err), false)
+	}
+
+	timelineID, lsn := progress.Position()
+	if walFile, err := a.findWALFileProcArgs(); err == nil {
+		if timelineID, lsn, err = pg.ParseWalfile(walFile); err != nil {
+			return nil, newWALError(errors.Wrap(err, "unable to parse the WAL filename"), lib.ErrorCategoryTransientDB, false)
+		}
+	} else {
+		a.log.Debug().Err(err).Msg("unable to find the WAL file being recovered, using pg_control")
+	}
+
+	// Until a commit has been decoded from the WAL before the one being
+	// replayed, the latest checkpoint is the best known lower bound of the
+	// replay timestamp.
+	replayTime, found := a.walCache.ReplayTimestamp(lsn.AddBytes(1).WALFilename(timelineID))
+	if !found {
+		replayTime = progress.CheckpointTime
+	}
+
+	target := pitrTarget{lsn: a.cfg.PITRTargetLSN, time: a.cfg.PITRTargetTime}
+	walFiles, done := pitrWALFiles(timelineID, lsn, replayTime, progress, target, a.walCache.ReadaheadBytes())
+
+	a.pgStateLock.Lock()
+	changed := done != a.pitrDone
+	a.pitrDone = done
+	a.pgStateLock.Unlock()
+
+	if changed && done != "" {
+		a.log.Info().Str("state", progress.State).Str("lsn", lsn.String()).
+			Time("replay-time", replayTime).Msg(done + ", not prefaulting")
+	}
+
+	if len(walFiles) > 0 {
+		a.storeWALPosition(_WALPosition{timelineID: timelineID, walFile: walFiles[0]})
+	}
+
+	return walFiles, nil
+}
+
+// pitrWALFiles returns the WAL files to read ahead of recovery positioned at
+// timelineID/lsn, having replayed transactions up to replayTime, bounded by
+// target.  If recovery is complete or has reached target, no WAL files are
+// returned and done describes why.
+func pitrWALFiles(timelineID pg.TimelineID, lsn pg.LSN, replayTime time.Time, progress pg.RecoveryProgress, target pitrTarget, readahead units.Base2Bytes) (walFiles pg.WALFiles, done string) {
+	switch {
+	case !progress.InRecovery():
+		return nil, "recovery has ended"
+	case !target.time.IsZero() && !replayTime.Before(target.time):
+		return nil, "recovery has passed the target time"
+	case target.lsn != pg.InvalidLSN && lsn >= target.lsn:
+		return nil, "recovery has reached the target LSN"
+	}
+
+	// Don't read past the segment containing the target.
+	if target.lsn != pg.InvalidLSN {
+		segments := target.lsn.SegmentNumber() - lsn.SegmentNumber() + 1
+		if maxBytes := units.Base2Bytes(segments) * pg.WALSegmentSize; maxBytes < readahead {
+			readahead = maxBytes
+		}
+	}
+
+	return lsn.Readahead(timelineID, readahead), ""
+}
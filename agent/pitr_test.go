@@ -0,0 +1,84 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_pitrWALFiles(t *testing.T) {
+	replayed := time.Date(2019, time.July, 10, 12, 0, 0, 0, time.UTC)
+	recovering := pg.RecoveryProgress{State: pg.ClusterStateArchiveRecovery}
+	noTarget := pitrTarget{lsn: pg.InvalidLSN}
+
+	tests := []struct {
+		lsn      string
+		progress pg.RecoveryProgress
+		target   pitrTarget
+		walFiles pg.WALFiles
+		done     bool
+	}{
+		{ // 0
+			lsn:      "0/5000028",
+			progress: recovering,
+			target:   noTarget,
+			walFiles: pg.WALFiles{"000000010000000000000005", "000000010000000000000006", "000000010000000000000007"},
+		},
+		{ // 1
+			lsn:      "0/5000028",
+			progress: pg.RecoveryProgress{State: pg.ClusterStateProduction},
+			target:   noTarget,
+			done:     true,
+		},
+		{ // 2: readahead stops at the target's segment
+			lsn:      "0/5800000",
+			progress: recovering,
+			target:   pitrTarget{lsn: pg.MustParseLSN("0/6100000")},
+			walFiles: pg.WALFiles{"000000010000000000000005", "000000010000000000000006"},
+		},
+		{ // 3
+			lsn:      "0/6100000",
+			progress: recovering,
+			target:   pitrTarget{lsn: pg.MustParseLSN("0/6100000")},
+			done:     true,
+		},
+		{ // 4
+			lsn:      "0/5000028",
+			progress: recovering,
+			target:   pitrTarget{lsn: pg.InvalidLSN, time: replayed.Add(time.Minute)},
+			walFiles: pg.WALFiles{"000000010000000000000005", "000000010000000000000006", "000000010000000000000007"},
+		},
+		{ // 5
+			lsn:      "0/5000028",
+			progress: recovering,
+			target:   pitrTarget{lsn: pg.InvalidLSN, time: replayed},
+			done:     true,
+		},
+	}
+
+	for n, test := range tests {
+		walFiles, done := pitrWALFiles(1, pg.MustParseLSN(test.lsn), replayed, test.progress, test.target, 3*pg.WALSegmentSize)
+		if (done != "") != test.done {
+			t.Fatalf("%d: done %q, want %t", n, done, test.done)
+		}
+
+		if diff := pretty.Compare(walFiles, test.walFiles); diff != "" {
+			t.Fatalf("%d: WAL files diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
@@ -25,8 +25,24 @@ import (
 
 type PID uint
 
-// FindChildPIDs finds the child PIDs of a given process
-func FindChildPIDs(ctx context.Context, pid PID) ([]PID, error) {
+// IOStats describes the cumulative read activity of a process.  Not every
+// platform exposes every counter, counters that are unavailable are left as
+// zero.
+type IOStats struct {
+	// ReadOps is the number of read operations performed by the process.
+	// Depending on the platform this is either the number of read(2)-family
+	// syscalls or the number of block input operations.
+	ReadOps uint64
+
+	// ReadBytes is the number of bytes the process caused to be fetched from the
+	// storage layer.
+	ReadBytes uint64
+}
+
+// findChildPIDsViaPgrep finds the child PIDs of a given process using
+// pgrep(1).  pgrep(1) is the fallback used on platforms without a structured
+// interface to the process table.
+func findChildPIDsViaPgrep(ctx context.Context, pid PID) ([]PID, error) {
 	// FIXME(seanc@): The call to exec.LookPath("pgrep") should probably be
 	// performed at process startup and cached.
 	pgrepPath, err := exec.LookPath("pgrep")
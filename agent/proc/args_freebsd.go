@@ -0,0 +1,176 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build freebsd
+// +build freebsd
+
+package proc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strconv"
+	"unsafe"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Offsets into struct kinfo_proc (see sys/user.h).  The first eight members
+// after ki_structsize and ki_layout are pointers, which is why ki_pid's offset
+// depends on the pointer width.
+const (
+	kinfoProcStructSizeOff = 0
+	kinfoProcPtrsOff       = 8
+	kinfoProcNumPtrs       = 8
+
+	// ki_rusage's offset is only known for the LP64 layout of kinfo_proc,
+	// identified by its ki_structsize (KINFO_PROC_SIZE).
+	kinfoProcSizeLP64      = 1088
+	kinfoProcRusageOffLP64 = 608
+	rusageInBlockOffLP64   = 88 // ru_inblock
+)
+
+var (
+	kinfoProcPIDOff  = kinfoProcPtrsOff + kinfoProcNumPtrs*int(unsafe.Sizeof(uintptr(0)))
+	kinfoProcPPIDOff = kinfoProcPIDOff + 4
+)
+
+// FindChildPIDs finds the child PIDs of a given process using the
+// kern.proc.proc sysctl(3).  If the sysctl(3) is unavailable or the
+// kinfo_proc layout is not recognized, fall back to pgrep(1).
+func FindChildPIDs(ctx context.Context, pid PID) ([]PID, error) {
+	pids, err := findChildPIDsViaSysctl(pid)
+	if err != nil {
+		lib.Logger(ctx).Debug().Err(err).Msg("unable to find child PIDs via sysctl(3), falling back to pgrep(1)")
+		return findChildPIDsViaPgrep(ctx, pid)
+	}
+
+	return pids, nil
+}
+
+// FindWALFileFromPIDArgs searches a slice of PIDs to find the WAL filename
+// being currently processed.  The process args are read using the
+// kern.proc.args sysctl(3) and fall back to ps(1).
+func FindWALFileFromPIDArgs(ctx context.Context, pids []PID) (pg.WALFilename, error) {
+	walFilename, err := findWALFileFromPIDArgsViaSysctl(ctx, pids)
+	if err == nil && walFilename != "" {
+		return walFilename, nil
+	}
+
+	lib.Logger(ctx).Debug().Err(err).Msg("unable to find WAL file via sysctl(3), falling back to ps(1)")
+	return findWALFileFromPIDArgsViaPS(ctx, pids)
+}
+
+// ReadIOStats returns the IO counters for a given PID from the ki_rusage of
+// its kinfo_proc.  If kinfo_proc's layout isn't recognized, fall back to
+// ps(1).  Neither reports the number of bytes read.
+func ReadIOStats(ctx context.Context, pid PID) (IOStats, error) {
+	stats, err := readIOStatsViaSysctl(pid)
+	if err != nil {
+		lib.Logger(ctx).Debug().Err(err).Msg("unable to read IO stats via sysctl(3), falling back to ps(1)")
+		return readIOStatsViaPS(ctx, pid)
+	}
+
+	return stats, nil
+}
+
+func findChildPIDsViaSysctl(ppid PID) ([]PID, error) {
+	buf, err := unix.SysctlRaw("kern.proc.proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query kern.proc.proc")
+	}
+
+	if len(buf) < kinfoProcPPIDOff+4 {
+		return nil, errors.Errorf("short kern.proc.proc response: %d bytes", len(buf))
+	}
+
+	// Every kinfo_proc entry is ki_structsize bytes long.  Use the size reported
+	// by the kernel so we don't have to hard code KINFO_PROC_SIZE.
+	structSize := int(binary.LittleEndian.Uint32(buf[kinfoProcStructSizeOff:]))
+	if structSize <= kinfoProcPPIDOff || len(buf)%structSize != 0 {
+		return nil, errors.Errorf("unsupported kinfo_proc size: %d", structSize)
+	}
+
+	const defaultNumPids = 16
+	pids := make([]PID, 0, defaultNumPids)
+	for off := 0; off+structSize <= len(buf); off += structSize {
+		entry := buf[off : off+structSize]
+		if PID(binary.LittleEndian.Uint32(entry[kinfoProcPPIDOff:])) != ppid {
+			continue
+		}
+
+		pids = append(pids, PID(binary.LittleEndian.Uint32(entry[kinfoProcPIDOff:])))
+	}
+
+	return pids, nil
+}
+
+func findWALFileFromPIDArgsViaSysctl(ctx context.Context, pids []PID) (pg.WALFilename, error) {
+	for _, pid := range pids {
+		buf, err := unix.SysctlRaw("kern.proc.args", int(pid))
+		if err != nil {
+			// Assume the PID terminated and continue processing
+			continue
+		}
+
+		// PostgreSQL's use of setproctitle(3) sets one large string with spaces.
+		args := bytes.Split(buf, []byte("\x00"))
+		if len(args) < 1 {
+			continue
+		}
+
+		md := psRE.FindSubmatch(args[0])
+		if len(md) != 2 {
+			continue
+		}
+
+		walFilename := pg.WALFilename(md[1])
+		if _, _, err := pg.ParseWalfile(walFilename); err == nil {
+			lib.Logger(ctx).Debug().Str("walfile", string(walFilename)).
+				Str("pid", strconv.FormatUint(uint64(pid), 10)).
+				Msg("found WAL segment from sysctl(3)")
+			return walFilename, nil
+		}
+	}
+
+	return "", nil
+}
+
+func readIOStatsViaSysctl(pid PID) (IOStats, error) {
+	buf, err := unix.SysctlRaw("kern.proc.pid", int(pid))
+	if err != nil {
+		return IOStats{}, errors.Wrap(err, "unable to query kern.proc.pid")
+	}
+
+	return parseKinfoProcIO(buf)
+}
+
+// parseKinfoProcIO extracts ru_inblock from the ki_rusage of a kinfo_proc.
+func parseKinfoProcIO(buf []byte) (IOStats, error) {
+	if len(buf) < kinfoProcStructSizeOff+4 {
+		return IOStats{}, errors.Errorf("short kern.proc.pid response: %d bytes", len(buf))
+	}
+
+	structSize := int(binary.LittleEndian.Uint32(buf[kinfoProcStructSizeOff:]))
+	if structSize != kinfoProcSizeLP64 || len(buf) < structSize {
+		return IOStats{}, errors.Errorf("unsupported kinfo_proc size: %d", structSize)
+	}
+
+	return IOStats{
+		ReadOps: binary.LittleEndian.Uint64(buf[kinfoProcRusageOffLP64+rusageInBlockOffLP64:]),
+	}, nil
+}
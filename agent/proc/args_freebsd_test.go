@@ -0,0 +1,46 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func Test_parseKinfoProcIO(t *testing.T) {
+	buf := make([]byte, kinfoProcSizeLP64)
+	binary.LittleEndian.PutUint32(buf[kinfoProcStructSizeOff:], kinfoProcSizeLP64)
+	binary.LittleEndian.PutUint64(buf[kinfoProcRusageOffLP64+rusageInBlockOffLP64:], 1402)
+
+	stats, err := parseKinfoProcIO(buf)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if stats.ReadOps != 1402 {
+		t.Errorf("ReadOps: want 1402, got %d", stats.ReadOps)
+	}
+
+	binary.LittleEndian.PutUint32(buf[kinfoProcStructSizeOff:], 768)
+	if _, err := parseKinfoProcIO(buf); err == nil {
+		t.Errorf("expected an unrecognized kinfo_proc to be rejected")
+	}
+}
+
+func TestReadIOStats(t *testing.T) {
+	if _, err := ReadIOStats(context.Background(), PID(os.Getpid())); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+}
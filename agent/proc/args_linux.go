@@ -0,0 +1,150 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"strconv"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// FindChildPIDs finds the child PIDs of a given process by walking /proc.  If
+// /proc is unavailable (e.g. inside of a restricted container), fall back to
+// pgrep(1).
+func FindChildPIDs(ctx context.Context, pid PID) ([]PID, error) {
+	pids, err := findChildPIDsViaProc(pid)
+	if err != nil {
+		lib.Logger(ctx).Debug().Err(err).Msg("unable to find child PIDs via /proc, falling back to pgrep(1)")
+		return findChildPIDsViaPgrep(ctx, pid)
+	}
+
+	return pids, nil
+}
+
+// FindWALFileFromPIDArgs searches a slice of PIDs to find the WAL filename
+// being currently processed.
+func FindWALFileFromPIDArgs(ctx context.Context, pids []PID) (pg.WALFilename, error) {
+	return findWALFileFromPIDArgsViaPS(ctx, pids)
+}
+
+// ReadIOStats returns the IO counters for a given PID from /proc/<pid>/io.
+func ReadIOStats(ctx context.Context, pid PID) (IOStats, error) {
+	buf, err := ioutil.ReadFile(path.Join("/proc", strconv.FormatUint(uint64(pid), 10), "io"))
+	if err != nil {
+		return IOStats{}, errors.Wrap(err, "unable to read /proc io")
+	}
+
+	return parseProcIO(buf)
+}
+
+// parseProcIO parses the contents of /proc/<pid>/io:
+//
+// rchar: 323934931
+// wchar: 323929600
+// syscr: 632687
+// syscw: 632675
+// read_bytes: 0
+// write_bytes: 323932160
+// cancelled_write_bytes: 0
+func parseProcIO(buf []byte) (IOStats, error) {
+	var stats IOStats
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		fields := bytes.SplitN(scanner.Bytes(), []byte(": "), 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		var dst *uint64
+		switch string(fields[0]) {
+		case "syscr":
+			dst = &stats.ReadOps
+		case "read_bytes":
+			dst = &stats.ReadBytes
+		default:
+			continue
+		}
+
+		v, err := strconv.ParseUint(string(fields[1]), 10, 64)
+		if err != nil {
+			return IOStats{}, errors.Wrapf(err, "unable to parse %s", fields[0])
+		}
+		*dst = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return IOStats{}, errors.Wrap(err, "unable to scan /proc io")
+	}
+
+	return stats, nil
+}
+
+// findChildPIDsViaProc scans /proc/<pid>/stat for processes whose parent is
+// ppid.
+func findChildPIDsViaProc(ppid PID) ([]PID, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read /proc")
+	}
+
+	const defaultNumPids = 16
+	pids := make([]PID, 0, defaultNumPids)
+	for _, entry := range entries {
+		pid64, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			// Assume the PID terminated and continue processing
+			continue
+		}
+
+		// 13637 (postgres) S 13633 13637 13637 0 -1 ...
+		//
+		// The command name may contain spaces or parens so search for the last
+		// paren before splitting the remaining fields.
+		end := bytes.LastIndexByte(buf, ')')
+		if end < 0 {
+			continue
+		}
+
+		fields := bytes.Fields(buf[end+1:])
+		if len(fields) < 2 {
+			continue
+		}
+
+		parent, err := strconv.ParseUint(string(fields[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if PID(parent) == ppid {
+			pids = append(pids, PID(pid64))
+		}
+	}
+
+	return pids, nil
+}
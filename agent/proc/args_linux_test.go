@@ -0,0 +1,92 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_findChildPIDsViaProc(t *testing.T) {
+	pids, err := findChildPIDsViaProc(PID(os.Getppid()))
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	for _, pid := range pids {
+		if pid == PID(os.Getpid()) {
+			return
+		}
+	}
+
+	t.Fatalf("unable to find ourself (%d) in children of %d: %v", os.Getpid(), os.Getppid(), pids)
+}
+
+func Test_parseProcIO(t *testing.T) {
+	tests := []struct {
+		buf   string
+		stats IOStats
+		fail  bool
+	}{
+		{ // 0
+			buf: "rchar: 323934931\nwchar: 323929600\nsyscr: 632687\nsyscw: 632675\n" +
+				"read_bytes: 8192\nwrite_bytes: 323932160\ncancelled_write_bytes: 0\n",
+			stats: IOStats{ReadOps: 632687, ReadBytes: 8192},
+		},
+		{ // 1
+			buf:   "rchar: 1\n",
+			stats: IOStats{},
+		},
+		{ // 2
+			buf:  "syscr: lots\n",
+			fail: true,
+		},
+	}
+
+	for n, test := range tests {
+		stats, err := parseProcIO([]byte(test.buf))
+		if test.fail {
+			if err == nil {
+				t.Errorf("[%d] expected an error", n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%d] bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(test.stats, stats); diff != "" {
+			t.Errorf("[%d] IOStats diff: (-want +got)\n%s", n, diff)
+		}
+	}
+}
+
+func TestReadIOStats(t *testing.T) {
+	if _, err := os.Stat("/proc/self/io"); err != nil {
+		t.Skipf("/proc/self/io unavailable: %v", err)
+	}
+
+	stats, err := ReadIOStats(context.Background(), PID(os.Getpid()))
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Reading /proc/<pid>/io is itself a read(2).
+	if stats.ReadOps == 0 {
+		t.Errorf("expected read syscalls to be counted: %+v", stats)
+	}
+}
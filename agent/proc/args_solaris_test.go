@@ -0,0 +1,44 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func Test_parsePRUsage(t *testing.T) {
+	buf := make([]byte, prusageMinSize)
+	binary.LittleEndian.PutUint64(buf[prusageInBlkOff:], 1402)
+
+	stats, err := parsePRUsage(buf)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if stats.ReadOps != 1402 {
+		t.Errorf("ReadOps: want 1402, got %d", stats.ReadOps)
+	}
+
+	if _, err := parsePRUsage(buf[:prusageInBlkOff]); err == nil {
+		t.Errorf("expected a short prusage_t to be rejected")
+	}
+}
+
+func TestReadIOStats(t *testing.T) {
+	if _, err := ReadIOStats(context.Background(), PID(os.Getpid())); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+}
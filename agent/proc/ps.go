@@ -0,0 +1,117 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// $ ps -o command -p 13635,13636,13637,35959
+//
+// postgres: checkpointer process
+// postgres: writer process
+// postgres: wal writer process
+// postgres: startup process   recovering 000000010000000C000000A1
+var psRE = regexp.MustCompile(`^postgres: startup[\sprocess]*[\s]+recovering[\s]+([0-9A-F]{24})`)
+
+// findWALFileFromPIDArgsViaPS searches a slice of PIDs to find the WAL filename
+// being currently processed by using the ps(1) command.
+func findWALFileFromPIDArgsViaPS(ctx context.Context, pids []PID) (pg.WALFilename, error) {
+	psOut, err := psCommands(ctx, pids)
+	if err != nil {
+		return "", err
+	}
+
+	var walSegment string
+	scanner := bufio.NewScanner(bytes.NewReader(psOut))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		md := psRE.FindStringSubmatch(line)
+		if len(md) == 2 {
+			walSegment = md[1]
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "unable to extract PostgreSQL WAL segment from ps(1) args")
+	}
+
+	lib.Logger(ctx).Debug().Str("walfile", string(walSegment)).
+		Msg("found WAL segment from ps(1)")
+
+	return pg.WALFilename(walSegment), nil
+}
+
+// findWALReceiverLSNFromArgs searches a slice of PIDs for the walreceiver and
+// returns the LSN named in its args.  InvalidLSN is returned if there is no
+// walreceiver.
+func findWALReceiverLSNFromArgs(ctx context.Context, pids []PID) (pg.LSN, error) {
+	psOut, err := psCommands(ctx, pids)
+	if err != nil {
+		return pg.InvalidLSN, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(psOut))
+	for scanner.Scan() {
+		lsn, err := parseWALReceiverArgs(scanner.Bytes())
+		if err != nil || lsn != pg.InvalidLSN {
+			return lsn, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return pg.InvalidLSN, errors.Wrap(err, "unable to extract the walreceiver's LSN from ps(1) args")
+	}
+
+	return pg.InvalidLSN, nil
+}
+
+// psCommands returns the output of ps(1) listing the command of each of pids.
+func psCommands(ctx context.Context, pids []PID) ([]byte, error) {
+	pidStr := make([]string, len(pids))
+	for i, pid := range pids {
+		pidStr[i] = strconv.FormatUint(uint64(pid), 10)
+	}
+
+	// FIXME(seanc@): Early on in the startup process, we should use
+	// exec.LookPath("ps") and use the value found at process startup time.  And
+	// if ps(1) can't be found because PATH isn't set, we should complain bitterly
+	// and likely exit.
+	psPath, err := exec.LookPath("ps")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find ps(1)")
+	}
+
+	psOut, err := exec.CommandContext(ctx, psPath, "-o", "command", "-p", strings.Join(pidStr, ",")).Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to exec ps(1) args")
+	}
+
+	return psOut, nil
+}
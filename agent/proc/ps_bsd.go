@@ -0,0 +1,58 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package proc
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// $ ps -o inblock= -p 13637
+//
+//	1402
+var psInBlockRE = regexp.MustCompile(`^[\s]*([\d]+)[\s]*$`)
+
+// readIOStatsViaPS uses ps(1) to obtain the number of block input operations
+// performed by pid.  ps(1) does not report the number of bytes read.
+func readIOStatsViaPS(ctx context.Context, pid PID) (IOStats, error) {
+	psPath, err := exec.LookPath("ps")
+	if err != nil {
+		return IOStats{}, errors.Wrap(err, "unable to find ps(1)")
+	}
+
+	psOut, err := exec.CommandContext(ctx, psPath, "-o", "inblock=", "-p", strconv.FormatUint(uint64(pid), 10)).Output()
+	if err != nil {
+		return IOStats{}, errors.Wrap(err, "unable to exec ps(1) inblock")
+	}
+
+	md := psInBlockRE.FindStringSubmatch(strings.TrimSpace(string(psOut)))
+	if len(md) != 2 {
+		return IOStats{}, errors.Errorf("unable to parse ps(1) inblock output: %+q", string(psOut))
+	}
+
+	readOps, err := strconv.ParseUint(md[1], 10, 64)
+	if err != nil {
+		return IOStats{}, errors.Wrap(err, "unable to parse ps(1) inblock value")
+	}
+
+	return IOStats{ReadOps: readOps}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// postgres: walreceiver   streaming 0/3000148
+// postgres: wal receiver process   streaming 0/3000148
+// postgres: main: walreceiver streaming 0/3000148
+var walReceiverRE = regexp.MustCompile(`^postgres: (?:[^:]+: )?wal ?receiver[\sprocess]*[\s]+streaming[\s]+([0-9A-F]+/[0-9A-F]+)`)
+
+// FindWALReceiverLSN returns the position up to which PostgreSQL's walreceiver,
+// one of pids, has written WAL into walDir.  The position is read from the
+// walreceiver's process title.  Without a title (e.g. update_process_title is
+// off) the position is the start of the newest WAL segment open by any of pids
+// or, failing that, of the most recently modified segment in walDir: only the
+// segments before it are known to be fully written.
+func FindWALReceiverLSN(ctx context.Context, pids []PID, walDir string) (pg.LSN, error) {
+	lsn, err := findWALReceiverLSNFromArgs(ctx, pids)
+	switch {
+	case err != nil:
+		lib.Logger(ctx).Debug().Err(err).Msg("unable to find the walreceiver's position from its args")
+	case lsn != pg.InvalidLSN:
+		return lsn, nil
+	}
+
+	walFile, err := findOpenWALFile(pids, walDir)
+	if err != nil {
+		lib.Logger(ctx).Debug().Err(err).Msg("unable to find the WAL segment open by the walreceiver")
+	}
+	if walFile == "" {
+		if walFile, err = findNewestWALFile(walDir); err != nil {
+			return pg.InvalidLSN, err
+		}
+	}
+
+	_, lsn, err = pg.ParseWalfile(walFile)
+	if err != nil {
+		return pg.InvalidLSN, errors.Wrap(err, "unable to parse the walreceiver's WAL filename")
+	}
+
+	return lsn, nil
+}
+
+// parseWALReceiverArgs returns the LSN named in a walreceiver's process title.
+// parseWALReceiverArgs returns InvalidLSN if args isn't a walreceiver's title.
+func parseWALReceiverArgs(args []byte) (pg.LSN, error) {
+	md := walReceiverRE.FindSubmatch(args)
+	if len(md) != 2 {
+		return pg.InvalidLSN, nil
+	}
+
+	lsn, err := pg.ParseLSN(string(md[1]))
+	if err != nil {
+		return pg.InvalidLSN, errors.Wrapf(err, "unable to parse the walreceiver's LSN: %+q", md[1])
+	}
+
+	return lsn, nil
+}
+
+// findNewestWALFile returns the most recently modified WAL segment in walDir.
+// Recycled segments are renamed ahead of the current segment but keep their old
+// modification times.
+func findNewestWALFile(walDir string) (pg.WALFilename, error) {
+	entries, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read the WAL directory")
+	}
+
+	var newest pg.WALFilename
+	var newestEntry int
+	for i, entry := range entries {
+		walFile := pg.WALFilename(entry.Name())
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if _, _, err := pg.ParseWalfile(walFile); err != nil {
+			continue
+		}
+
+		if newest == "" || entry.ModTime().After(entries[newestEntry].ModTime()) ||
+			(entry.ModTime().Equal(entries[newestEntry].ModTime()) && walFile > newest) {
+			newest = walFile
+			newestEntry = i
+		}
+	}
+
+	if newest == "" {
+		return "", fmt.Errorf("no WAL segments in %s", walDir)
+	}
+
+	return newest, nil
+}
@@ -0,0 +1,66 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// findOpenWALFile returns the newest WAL segment in walDir open by any of pids
+// according to /proc/<pid>/fd.  The walreceiver has the segment it's writing
+// open, the startup process the older segment it's replaying.
+func findOpenWALFile(pids []PID, walDir string) (pg.WALFilename, error) {
+	// The links in /proc/<pid>/fd are resolved, pg_wal often isn't.
+	walDir, err := filepath.EvalSymlinks(walDir)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to resolve the WAL directory")
+	}
+
+	var newest pg.WALFilename
+	for _, pid := range pids {
+		fdDir := filepath.Join("/proc", strconv.FormatUint(uint64(pid), 10), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// Assume the PID terminated, or isn't ours to inspect, and continue
+			// processing
+			continue
+		}
+
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || filepath.Dir(target) != walDir {
+				continue
+			}
+
+			walFile := pg.WALFilename(filepath.Base(target))
+			if _, _, err := pg.ParseWalfile(walFile); err != nil {
+				continue
+			}
+
+			if walFile > newest {
+				newest = walFile
+			}
+		}
+	}
+
+	return newest, nil
+}
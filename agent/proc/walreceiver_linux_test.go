@@ -0,0 +1,52 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_findOpenWALFile(t *testing.T) {
+	walDir, err := ioutil.TempDir("", "pg_wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(walDir)
+
+	for _, walFile := range []string{"000000010000000000000002", "000000010000000000000003", "000000010000000000000004"} {
+		if err := ioutil.WriteFile(filepath.Join(walDir, walFile), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the segments that are open count
+	for _, walFile := range []string{"000000010000000000000002", "000000010000000000000003"} {
+		f, err := os.Open(filepath.Join(walDir, walFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+	}
+
+	walFile, err := findOpenWALFile([]PID{PID(os.Getpid())}, walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walFile != "000000010000000000000003" {
+		t.Fatalf("open %q, want 000000010000000000000003", walFile)
+	}
+}
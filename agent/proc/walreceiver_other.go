@@ -0,0 +1,26 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package proc
+
+import (
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// findOpenWALFile is only implemented on Linux.  Other platforms fall back to
+// the modification times of the segments in the WAL directory.
+func findOpenWALFile(pids []PID, walDir string) (pg.WALFilename, error) {
+	return "", nil
+}
@@ -0,0 +1,100 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestParseWALReceiverArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		lsn  pg.LSN
+	}{
+		{ // 0
+			args: "postgres: walreceiver   streaming 0/3000148",
+			lsn:  pg.MustParseLSN("0/3000148"),
+		},
+		{ // 1: PostgreSQL 9.6
+			args: "postgres: wal receiver process   streaming 2B8/F9000000",
+			lsn:  pg.MustParseLSN("2B8/F9000000"),
+		},
+		{ // 2: cluster_name is set
+			args: "postgres: main: walreceiver streaming 0/3000148",
+			lsn:  pg.MustParseLSN("0/3000148"),
+		},
+		{ // 3
+			args: "postgres: startup   recovering 000000010000000000000003",
+			lsn:  pg.InvalidLSN,
+		},
+		{ // 4: not yet streaming
+			args: "postgres: walreceiver",
+			lsn:  pg.InvalidLSN,
+		},
+	}
+
+	for n, test := range tests {
+		lsn, err := parseWALReceiverArgs([]byte(test.args))
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if lsn != test.lsn {
+			t.Fatalf("%d: lsn %d, want %d", n, lsn, test.lsn)
+		}
+	}
+}
+
+func TestFindNewestWALFile(t *testing.T) {
+	walDir, err := ioutil.TempDir("", "pg_wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(walDir)
+
+	if _, err := findNewestWALFile(walDir); err == nil {
+		t.Fatal("found a WAL file in an empty directory")
+	}
+
+	// The recycled segment sorts last but was modified first
+	now := time.Now()
+	for walFile, mtime := range map[string]time.Time{
+		"000000010000000000000004":         now.Add(-time.Hour),
+		"000000010000000000000002":         now.Add(-time.Minute),
+		"000000010000000000000003":         now,
+		"000000010000000000000003.partial": now.Add(time.Minute),
+		"00000002.history":                 now.Add(time.Minute),
+	} {
+		name := filepath.Join(walDir, walFile)
+		if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walFile, err := findNewestWALFile(walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walFile != "000000010000000000000003" {
+		t.Fatalf("newest %s, want 000000010000000000000003", walFile)
+	}
+}
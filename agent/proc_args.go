@@ -14,40 +14,109 @@
 package agent
 
 import (
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
 	"github.com/bschofield/pg_prefaulter/agent/proc"
 	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
+)
+
+var (
+	postgresqlReadOps   = metrics.NewGauge("postgresql_read_ops", "Read operations performed by PostgreSQL's child processes, sampled while the database can't be queried (e.g. during crash recovery).")
+	postgresqlReadBytes = metrics.NewGauge("postgresql_read_bytes", "Bytes PostgreSQL's child processes fetched from storage, sampled while the database can't be queried.  Zero where the platform doesn't report it.")
 )
 
 // getWALFilesProcArgs finds the PostgreSQL parent PID and looks through all
 // processes that decend from PostgreSQL to parse out the current WAL file
 // contained in the args.
 func (a *Agent) getWALFilesProcArgs() (walFiles pg.WALFiles, err error) {
-	parentPid, err := a.findPostgreSQLPostmasterPID()
+	childPIDs, err := a.findPostgreSQLChildPIDs()
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to find the PostgreSQL pid")
+		return nil, err
 	}
 
-	childPIDs, err := proc.FindChildPIDs(a.shutdownCtx, parentPid)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to find any PostgreSQL child processes")
-	}
+	a.sampleProcIOStats(childPIDs)
 
 	walFile, err := proc.FindWALFileFromPIDArgs(a.shutdownCtx, childPIDs)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to find a WAL file from pids")
 	}
 
-	walFiles, err = a.predictProcWALFilenames(walFile)
+	// WAL that hasn't arrived locally can't be read ahead unless it can be
+	// fetched from the archive.  Without the walreceiver's position, fall back
+	// to the configured readahead.
+	writtenLSN := pg.InvalidLSN
+	if !a.walCache.ArchiveEnabled() {
+		a.pgStateLock.RLock()
+		walDir := a.walDir
+		a.pgStateLock.RUnlock()
+
+		if writtenLSN, err = proc.FindWALReceiverLSN(a.shutdownCtx, childPIDs, walDir); err != nil {
+			a.log.Debug().Err(err).Msg("unable to find the walreceiver's position")
+			writtenLSN = pg.InvalidLSN
+		}
+	}
+
+	walFiles, err = a.predictProcWALFilenames(walFile, writtenLSN)
 	if err != nil {
-		log.Debug().Err(err).Msg("unable to predict proc WAL filenames")
+		a.log.Debug().Err(err).Msg("unable to predict proc WAL filenames")
 		return walFiles, err
 	}
 
 	return walFiles, nil
 }
 
+// findWALFileProcArgs returns the WAL file named in the args of PostgreSQL's
+// child processes (e.g. the startup process' "recovering" title).
+func (a *Agent) findWALFileProcArgs() (pg.WALFilename, error) {
+	childPIDs, err := a.findPostgreSQLChildPIDs()
+	if err != nil {
+		return "", err
+	}
+
+	walFile, err := proc.FindWALFileFromPIDArgs(a.shutdownCtx, childPIDs)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find a WAL file from pids")
+	}
+
+	return walFile, nil
+}
+
+// findPostgreSQLChildPIDs returns the PIDs of PostgreSQL's child processes.
+func (a *Agent) findPostgreSQLChildPIDs() ([]proc.PID, error) {
+	parentPid, err := a.findPostgreSQLPostmasterPID()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find the PostgreSQL pid")
+	}
+
+	childPIDs, err := proc.FindChildPIDs(a.shutdownCtx, parentPid)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find any PostgreSQL child processes")
+	}
+
+	return childPIDs, nil
+}
+
+// sampleProcIOStats exports the read activity of PostgreSQL's child processes.
+// While the startup process replays WAL, reads it has to wait on show up here.
+// Children that have exited are skipped.
+func (a *Agent) sampleProcIOStats(pids []proc.PID) {
+	var total proc.IOStats
+	for _, pid := range pids {
+		stats, err := proc.ReadIOStats(a.shutdownCtx, pid)
+		if err != nil {
+			a.log.Debug().Err(err).Uint("pid", uint(pid)).Msg("unable to read IO stats")
+			continue
+		}
+
+		total.ReadOps += stats.ReadOps
+		total.ReadBytes += stats.ReadBytes
+	}
+
+	postgresqlReadOps.Set(float64(total.ReadOps))
+	postgresqlReadBytes.Set(float64(total.ReadBytes))
+}
+
 // predictProcWALFilenames guesses what the filenames are going to be in advance
 // of PostgreSQL naively processing a WAL file.  Use walFile as the seed
 // filename to indicate where we are in the WAL stream and forecast N WAL
@@ -56,8 +125,10 @@ func (a *Agent) getWALFilesProcArgs() (walFiles pg.WALFiles, err error) {
 //
 // Unlike predictDBWALFilenames(), predictProcWALFilenames() uses a derived LSN
 // from the WAL filename to predict the next WAL segment to process (as opposed
-// to querying the database and potentially backing off).
-func (a *Agent) predictProcWALFilenames(walFile pg.WALFilename) (pg.WALFiles, error) {
+// to querying the database and potentially backing off).  The readahead is
+// clamped to writtenLSN, the WAL that has arrived locally, unless writtenLSN
+// is InvalidLSN.
+func (a *Agent) predictProcWALFilenames(walFile pg.WALFilename, writtenLSN pg.LSN) (pg.WALFiles, error) {
 	timelineID, walLSN, err := pg.ParseWalfile(walFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to parse the WAL filename")
@@ -66,6 +137,15 @@ func (a *Agent) predictProcWALFilenames(walFile pg.WALFilename) (pg.WALFiles, er
 	// Clamp the number of bytes we'll readahead in order to prevent reading into
 	// the future.
 	maxBytes := a.walCache.ReadaheadBytes()
+	if writtenLSN != pg.InvalidLSN {
+		var arrivedBytes units.Base2Bytes
+		if writtenLSN > walLSN {
+			arrivedBytes = units.Base2Bytes(writtenLSN - walLSN)
+		}
+		if maxBytes > arrivedBytes {
+			maxBytes = arrivedBytes
+		}
+	}
 
 	return walLSN.Readahead(timelineID, maxBytes), nil
 }
@@ -0,0 +1,47 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+)
+
+// pushTimeout bounds how long exiting waits on the Pushgateway.
+const pushTimeout = 10 * time.Second
+
+// pushMetrics pushes the agent's final metrics to the configured Pushgateway so
+// that runs too short to be scraped are still recorded.
+func (a *Agent) pushMetrics() {
+	if a.cfg.PushGatewayURL == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+
+	err := metrics.DefaultRegistry.Push(ctx, &http.Client{}, a.cfg.PushGatewayURL, a.cfg.PushGatewayJob,
+		metrics.Label{Name: "instance", Value: a.cfg.PushGatewayInstance})
+	if err != nil {
+		a.log.Warn().Err(err).Str("job", a.cfg.PushGatewayJob).Str("instance", a.cfg.PushGatewayInstance).
+			Msg("unable to push metrics to the Pushgateway")
+		return
+	}
+
+	a.log.Info().Str("job", a.cfg.PushGatewayJob).Str("instance", a.cfg.PushGatewayInstance).
+		Msg("pushed metrics to the Pushgateway")
+}
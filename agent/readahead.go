@@ -0,0 +1,121 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+)
+
+// Readahead describes the amount of WAL read ahead of PostgreSQL, e.g.
+// "64MiB", and the bounds it may be changed within at runtime.
+type Readahead struct {
+	Bytes    string `json:"readahead-bytes,omitempty"`
+	MinBytes string `json:"readahead-min-bytes,omitempty"`
+	MaxBytes string `json:"readahead-max-bytes,omitempty"`
+}
+
+// errWALCacheNotRunning is returned when the readahead is changed before the
+// WAL cache has started.
+var errWALCacheNotRunning = errors.New("WAL cache not running")
+
+// readahead returns the current readahead and its bounds.
+func (a *Agent) readahead() Readahead {
+	min, max := a.walCache.ReadaheadBounds()
+	return Readahead{
+		Bytes:    a.walCache.ReadaheadBytes().String(),
+		MinBytes: min.String(),
+		MaxBytes: max.String(),
+	}
+}
+
+// setReadahead changes the amount of WAL read ahead of PostgreSQL, its bounds,
+// or both.  A readahead outside new bounds is moved within them.  The change is
+// logged and recorded as a recent event along with who requested it.
+func (a *Agent) setReadahead(ra Readahead, requester string) error {
+	if a.walCache == nil {
+		return errWALCacheNotRunning
+	}
+	if ra == (Readahead{}) {
+		return errors.New("readahead-bytes, readahead-min-bytes, or readahead-max-bytes is required")
+	}
+
+	old := a.walCache.ReadaheadBytes()
+	oldMin, oldMax := a.walCache.ReadaheadBounds()
+
+	readaheadBytes, min, max := old, oldMin, oldMax
+	for _, field := range []struct {
+		name  string
+		value string
+		bytes *units.Base2Bytes
+	}{
+		{"readahead-bytes", ra.Bytes, &readaheadBytes},
+		{"readahead-min-bytes", ra.MinBytes, &min},
+		{"readahead-max-bytes", ra.MaxBytes, &max},
+	} {
+		if field.value == "" {
+			continue
+		}
+
+		b, err := units.ParseBase2Bytes(field.value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", field.name)
+		}
+		*field.bytes = b
+	}
+
+	if ra.Bytes == "" {
+		switch {
+		case readaheadBytes < min:
+			readaheadBytes = min
+		case readaheadBytes > max:
+			readaheadBytes = max
+		}
+	}
+
+	if err := a.walCache.SetReadahead(readaheadBytes, min, max); err != nil {
+		return err
+	}
+
+	a.recentEvents.add(recentEvent{
+		Time: time.Now().UTC(),
+		Name: "readahead-change",
+		Details: map[string]interface{}{
+			"requester": requester,
+			"old":       Readahead{Bytes: old.String(), MinBytes: oldMin.String(), MaxBytes: oldMax.String()},
+			"new":       Readahead{Bytes: readaheadBytes.String(), MinBytes: min.String(), MaxBytes: max.String()},
+		},
+	})
+	a.log.Info().Str("requester", requester).
+		Str("old", old.String()).Str("new", readaheadBytes.String()).
+		Str("old-min", oldMin.String()).Str("new-min", min.String()).
+		Str("old-max", oldMax.String()).Str("new-max", max.String()).
+		Msg("changed WAL readahead")
+
+	return nil
+}
+
+// requester identifies the sender of r for the log: its address and, when
+// authenticated with a client certificate, the certificate's subject.
+func requester(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return fmt.Sprintf("%s (%s)", r.RemoteAddr, r.TLS.VerifiedChains[0][0].Subject)
+	}
+
+	return r.RemoteAddr
+}
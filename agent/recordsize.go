@@ -0,0 +1,85 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+)
+
+// zfsTimeout bounds the zfs(8) command used to detect the recordsize.
+const zfsTimeout = 10 * time.Second
+
+// loadRecordSize threads the size of the records relation segments are read in
+// through the cache configuration, detecting the recordsize of PGDATA's ZFS
+// dataset if requested.  Records that aren't a whole number of pages, or that
+// don't evenly divide a segment, are read as individual pages.  loadRecordSize
+// must be called after loadControlData.
+func (a *Agent) loadRecordSize(cfg *config.Config) {
+	fhConfig := &cfg.FHCacheConfig
+
+	if fhConfig.DetectRecordSize {
+		size, err := zfsRecordSize(fhConfig.PGDataPath)
+		if err != nil {
+			a.log.Debug().Err(err).Str("pgdata", fhConfig.PGDataPath).
+				Msg("unable to detect a ZFS recordsize, reading individual pages")
+		}
+		fhConfig.RecordSize = size
+	}
+
+	segmentSize := units.Base2Bytes(fhConfig.BlocksPerSegment) * fhConfig.BlockSize
+	switch size := fhConfig.RecordSize; {
+	case size <= fhConfig.BlockSize:
+		fhConfig.RecordSize = 0
+	case size%fhConfig.BlockSize != 0 || segmentSize%size != 0:
+		a.log.Warn().Str("record-size", size.String()).Str("block-size", fhConfig.BlockSize.String()).
+			Str("segment-size", segmentSize.String()).Msg("record size doesn't align with pages and segments, reading individual pages")
+		fhConfig.RecordSize = 0
+	default:
+		a.log.Info().Str("record-size", size.String()).Msg("reading relations in aligned records")
+	}
+}
+
+// zfsRecordSize returns the recordsize of the ZFS dataset holding path.
+func zfsRecordSize(path string) (units.Base2Bytes, error) {
+	zfsPath, err := exec.LookPath("zfs")
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to find zfs(8)")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), zfsTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, zfsPath, "get", "-H", "-p", "-o", "value", "recordsize", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, errors.Wrapf(err, "unable to run zfs: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	size, err := strconv.ParseUint(string(bytes.TrimSpace(stdout.Bytes())), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to parse the recordsize")
+	}
+
+	return units.Base2Bytes(size), nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+)
+
+func TestLoadRecordSize(t *testing.T) {
+	tests := []struct {
+		recordSize units.Base2Bytes
+		want       units.Base2Bytes
+	}{
+		{ // 0
+			recordSize: 0,
+			want:       0,
+		},
+		{ // 1
+			recordSize: 8 * units.KiB,
+			want:       0,
+		},
+		{ // 2
+			recordSize: 4 * units.KiB,
+			want:       0,
+		},
+		{ // 3
+			recordSize: 128 * units.KiB,
+			want:       128 * units.KiB,
+		},
+		{ // 4
+			recordSize: 1 * units.MiB,
+			want:       1 * units.MiB,
+		},
+		{ // 5
+			recordSize: 2 * units.GiB,
+			want:       0,
+		},
+	}
+
+	for n, test := range tests {
+		cfg := &config.Config{
+			FHCacheConfig: config.FHCacheConfig{
+				BlockSize:        8 * units.KiB,
+				BlocksPerSegment: 131072,
+				RecordSize:       test.recordSize,
+			},
+		}
+
+		a := &Agent{}
+		a.loadRecordSize(cfg)
+		if got := cfg.FHCacheConfig.RecordSize; got != test.want {
+			t.Errorf("%d: record size %s, want %s", n, got, test.want)
+		}
+	}
+}
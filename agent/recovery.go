@@ -0,0 +1,207 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"path"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/stallhist"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+var (
+	lagBytesGauge       = metrics.NewGauge("lag_bytes", "Visibility lag of the database in bytes.")
+	replayPausedGauge   = metrics.NewGauge("replay_paused", "1 if WAL replay has been paused, 0 otherwise.")
+	replayStalledGauge  = metrics.NewGauge("replay_stalled_seconds", "Seconds since WAL replay last advanced while the database was lagging.")
+	redoDistanceGauge   = metrics.NewGauge("redo_distance_bytes", "WAL between the latest restartpoint's REDO location and the newest WAL available locally in bytes.")
+	replayDistanceGauge = metrics.NewGauge("replay_distance_bytes", "WAL received but not yet replayed in bytes.")
+	conflictsTablespace = newConflictCounter("tablespace")
+	conflictsLock       = newConflictCounter("lock")
+	conflictsSnapshot   = newConflictCounter("snapshot")
+	conflictsBufferPin  = newConflictCounter("bufferpin")
+	conflictsDeadlock   = newConflictCounter("deadlock")
+)
+
+// stallHistorySaveInterval is how often the stall history is persisted.
+const stallHistorySaveInterval = time.Minute
+
+func newConflictCounter(conflictType string) *metrics.Counter {
+	return metrics.NewCounter("recovery_conflicts_total",
+		"Number of queries cancelled due to conflicts with recovery.",
+		metrics.Label{Name: "type", Value: conflictType})
+}
+
+// replayTracker distinguishes a follower whose replay is stalled (e.g. waiting
+// on a recovery conflict or paused) from one that is replaying but behind.
+type replayTracker struct {
+	lsn   pg.LSN
+	since time.Time
+}
+
+// observe records the replay LSN at time now and returns how long replay has
+// been stalled.  Replay is only considered stalled while lag is non-zero.
+func (t *replayTracker) observe(now time.Time, lsn pg.LSN, lag units.Base2Bytes) time.Duration {
+	if lsn != t.lsn || lag <= 0 || t.since.IsZero() {
+		t.lsn = lsn
+		t.since = now
+		return 0
+	}
+
+	return now.Sub(t.since)
+}
+
+// conflictDelta returns the number of conflicts that occurred between two
+// observations of a cumulative conflict count.  A decrease means the
+// statistics were reset, in which case cur conflicts occurred since.
+func conflictDelta(prev, cur int64) uint64 {
+	switch {
+	case cur < 0:
+		return 0
+	case cur < prev:
+		return uint64(cur)
+	default:
+		return uint64(cur - prev)
+	}
+}
+
+// redoDistance returns the WAL between the REDO location of the latest
+// restartpoint and the newest WAL available locally, i.e. the WAL crash
+// recovery would replay, and the WAL received but not yet replayed.  received
+// is InvalidLSN when there is no WAL receiver, e.g. while restoring from the
+// archive, in which case the replayed WAL is the newest WAL known to be
+// available.
+func redoDistance(redo, replay, received pg.LSN) (toRedo, toReplay units.Base2Bytes) {
+	newest := replay
+	if received != pg.InvalidLSN && (newest == pg.InvalidLSN || received > newest) {
+		newest = received
+	}
+
+	if redo != pg.InvalidLSN && newest != pg.InvalidLSN && newest > redo {
+		toRedo = units.Base2Bytes(newest - redo)
+	}
+	if replay != pg.InvalidLSN && received != pg.InvalidLSN && received > replay {
+		toReplay = units.Base2Bytes(received - replay)
+	}
+
+	return toRedo, toReplay
+}
+
+// recordRedoDistance updates the redo and replay distance gauges from
+// pg_control and the WAL receiver's position.  Errors are logged and are not
+// fatal.
+func (a *Agent) recordRedoDistance(replay pg.LSN) {
+	controlFile := path.Join(a.cfg.PGData, "global", "pg_control")
+	buf, err := readControlFile(controlFile)
+	if err != nil {
+		a.log.Debug().Err(err).Str("pg_control", controlFile).Msg("unable to read the REDO location")
+		return
+	}
+	redo, err := pg.ParseControlFileRedo(buf)
+	if err != nil {
+		a.log.Debug().Err(err).Str("pg_control", controlFile).Msg("unable to read the REDO location")
+		return
+	}
+
+	received := pg.InvalidLSN
+	switch walReceiver, found, err := pg.QueryWALReceiver(a.shutdownCtx, a.pool, a.walTranslations); {
+	case err != nil:
+		a.log.Debug().Err(err).Msg("unable to query the WAL receiver")
+	case found:
+		received = walReceiver.ReceivedLSN()
+	}
+
+	toRedo, toReplay := redoDistance(redo, replay, received)
+	redoDistanceGauge.Set(float64(toRedo))
+	replayDistanceGauge.Set(float64(toReplay))
+}
+
+// recordRecoveryState queries a follower's replay state and updates the
+// recovery metrics.  Errors are logged and are not fatal.
+func (a *Agent) recordRecoveryState(lag units.Base2Bytes) {
+	rs, err := pg.QueryRecoveryState(a.shutdownCtx, a.pool, a.walTranslations)
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to query recovery state")
+		return
+	}
+
+	now := time.Now()
+	a.pgStateLock.Lock()
+	prev := a.lastRecovery
+	first := !a.recoveryObserved
+	stalled := a.replayTracker.observe(now, rs.ReplayLSN, lag)
+	slowed := a.stallDetector.Observe(now, rs.ReplayLSN, lag)
+	a.lastRecovery = rs
+	a.recoveryObserved = true
+	a.replayStalled = stalled
+	a.pgStateLock.Unlock()
+
+	if slowed > 0 {
+		a.recordStall(rs.ReplayLSN, slowed)
+	}
+
+	if rs.ReplayPaused {
+		replayPausedGauge.Set(1)
+	} else {
+		replayPausedGauge.Set(0)
+	}
+	replayStalledGauge.Set(stalled.Seconds())
+	a.recordRedoDistance(rs.ReplayLSN)
+
+	if !first {
+		conflictsTablespace.Add(conflictDelta(prev.Conflicts.Tablespace, rs.Conflicts.Tablespace))
+		conflictsLock.Add(conflictDelta(prev.Conflicts.Lock, rs.Conflicts.Lock))
+		conflictsSnapshot.Add(conflictDelta(prev.Conflicts.Snapshot, rs.Conflicts.Snapshot))
+		conflictsBufferPin.Add(conflictDelta(prev.Conflicts.BufferPin, rs.Conflicts.BufferPin))
+		conflictsDeadlock.Add(conflictDelta(prev.Conflicts.Deadlock, rs.Conflicts.Deadlock))
+	}
+
+	if rs.ReplayPaused != prev.ReplayPaused {
+		a.log.Warn().Bool("replay-paused", rs.ReplayPaused).Msg("WAL replay pause state changed")
+	}
+}
+
+// recordStall attributes an interval of stalled or slow replay to the
+// relations referenced by the WAL segment containing replayLSN.
+func (a *Agent) recordStall(replayLSN pg.LSN, slowed time.Duration) {
+	timelineID := a.loadWALPosition().timelineID
+	if a.stallHistory == nil || timelineID == 0 || replayLSN == pg.InvalidLSN {
+		return
+	}
+
+	walFile := replayLSN.WALFilename(timelineID)
+	if n := a.stallHistory.RecordStall(walFile, slowed); n > 0 {
+		a.log.Debug().Str("walfile", string(walFile)).Dur("stalled", slowed).Int("relations", n).
+			Msg("recorded replay stall")
+	}
+}
+
+// resetRecoveryState clears the replay state once the database is no longer a
+// follower.
+func (a *Agent) resetRecoveryState() {
+	a.pgStateLock.Lock()
+	a.lastRecovery = pg.RecoveryState{}
+	a.recoveryObserved = false
+	a.replayTracker = replayTracker{}
+	a.stallDetector = stallhist.Detector{}
+	a.replayStalled = 0
+	a.pgStateLock.Unlock()
+
+	replayPausedGauge.Set(0)
+	replayStalledGauge.Set(0)
+	redoDistanceGauge.Set(0)
+	replayDistanceGauge.Set(0)
+}
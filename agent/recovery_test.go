@@ -0,0 +1,116 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func Test_replayTracker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	lsn := pg.MustParseLSN("0/3000140")
+
+	tests := []struct {
+		offset time.Duration
+		lsn    pg.LSN
+		lag    units.Base2Bytes
+		out    time.Duration
+	}{
+		{offset: 0, lsn: lsn, lag: units.MiB, out: 0},
+		{offset: 5 * time.Second, lsn: lsn, lag: units.MiB, out: 5 * time.Second},
+		{offset: 8 * time.Second, lsn: lsn, lag: units.MiB, out: 8 * time.Second},
+		// Replay advanced
+		{offset: 9 * time.Second, lsn: lsn.AddBytes(24), lag: units.MiB, out: 0},
+		{offset: 10 * time.Second, lsn: lsn.AddBytes(24), lag: units.MiB, out: 1 * time.Second},
+		// Caught up, an idle follower is not stalled
+		{offset: 20 * time.Second, lsn: lsn.AddBytes(24), lag: 0, out: 0},
+		{offset: 30 * time.Second, lsn: lsn.AddBytes(24), lag: 0, out: 0},
+	}
+
+	var tracker replayTracker
+	for n, test := range tests {
+		if got := tracker.observe(start.Add(test.offset), test.lsn, test.lag); got != test.out {
+			t.Fatalf("%d: got %s, want %s", n, got, test.out)
+		}
+	}
+}
+
+func Test_conflictDelta(t *testing.T) {
+	tests := []struct {
+		prev, cur int64
+		out       uint64
+	}{
+		{prev: 0, cur: 0, out: 0},
+		{prev: 3, cur: 7, out: 4},
+		// Statistics reset
+		{prev: 7, cur: 2, out: 2},
+	}
+
+	for n, test := range tests {
+		if got := conflictDelta(test.prev, test.cur); got != test.out {
+			t.Errorf("%d: got %d, want %d", n, got, test.out)
+		}
+	}
+}
+
+func Test_redoDistance(t *testing.T) {
+	redo := pg.MustParseLSN("0/3000028")
+
+	tests := []struct {
+		redo, replay, received pg.LSN
+		toRedo, toReplay       units.Base2Bytes
+	}{
+		{ // 0: streaming
+			redo:     redo,
+			replay:   redo.AddBytes(units.MiB),
+			received: redo.AddBytes(3 * units.MiB),
+			toRedo:   3 * units.MiB,
+			toReplay: 2 * units.MiB,
+		},
+		{ // 1: restoring from the archive
+			redo:     redo,
+			replay:   redo.AddBytes(units.MiB),
+			received: pg.InvalidLSN,
+			toRedo:   units.MiB,
+		},
+		{ // 2: replay caught up
+			redo:     redo,
+			replay:   redo.AddBytes(units.MiB),
+			received: redo.AddBytes(units.MiB),
+			toRedo:   units.MiB,
+		},
+		{ // 3: nothing replayed yet
+			redo:     redo,
+			replay:   pg.InvalidLSN,
+			received: redo.AddBytes(units.MiB),
+			toRedo:   units.MiB,
+		},
+		{ // 4: nothing known
+			redo:     redo,
+			replay:   pg.InvalidLSN,
+			received: pg.InvalidLSN,
+		},
+	}
+
+	for n, test := range tests {
+		toRedo, toReplay := redoDistance(test.redo, test.replay, test.received)
+		if toRedo != test.toRedo || toReplay != test.toReplay {
+			t.Fatalf("%d: got %s/%s, want %s/%s", n, toRedo, toReplay, test.toRedo, test.toReplay)
+		}
+	}
+}
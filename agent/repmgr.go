@@ -0,0 +1,177 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// repmgrConf contains the subset of repmgr.conf(5) used by the agent.
+type repmgrConf struct {
+	NodeID   int
+	NodeName string
+	Conninfo string
+}
+
+// repmgrNode is the agent's view of the local node as recorded in repmgr's
+// metadata.
+type repmgrNode struct {
+	ID               int
+	Name             string
+	Type             string
+	Active           bool
+	UpstreamID       *int
+	UpstreamConninfo *string
+}
+
+// parseRepmgrConf parses the key/value pairs out of a repmgr.conf(5) file.
+// Values may be optionally single or double quoted.  Unknown keys are
+// ignored.
+func parseRepmgrConf(r io.Reader) (repmgrConf, error) {
+	var conf repmgrConf
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if n := len(value); n >= 2 && (value[0] == '\'' || value[0] == '"') && value[n-1] == value[0] {
+			value = value[1 : n-1]
+		}
+
+		switch key {
+		case "node_id":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return repmgrConf{}, errors.Wrapf(err, "unable to parse repmgr node_id %q", value)
+			}
+			conf.NodeID = id
+		case "node_name":
+			conf.NodeName = value
+		case "conninfo":
+			conf.Conninfo = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return repmgrConf{}, errors.Wrap(err, "unable to scan repmgr.conf")
+	}
+
+	if conf.NodeID == 0 {
+		return repmgrConf{}, errors.New("repmgr.conf does not contain a node_id")
+	}
+
+	return conf, nil
+}
+
+// loadRepmgrConf reads the repmgr.conf(5) file configured via
+// config.KeyRepmgrConfig.
+func (a *Agent) loadRepmgrConf() (repmgrConf, error) {
+	filename := a.cfg.RepmgrConfigPath
+	f, err := os.Open(filename)
+	if err != nil {
+		return repmgrConf{}, errors.Wrap(err, "unable to open repmgr.conf")
+	}
+	defer f.Close()
+
+	return parseRepmgrConf(f)
+}
+
+// queryRepmgrNode looks up the local node and its upstream in repmgr's
+// metadata schema.
+func (a *Agent) queryRepmgrNode() (repmgrNode, error) {
+	conf, err := a.loadRepmgrConf()
+	if err != nil {
+		return repmgrNode{}, errors.Wrap(err, "unable to load repmgr config")
+	}
+
+	const sql = `SELECT
+	    n.node_id, n.node_name, n.type, n.active, n.upstream_node_id, u.conninfo
+	    FROM repmgr.nodes n
+	    LEFT JOIN repmgr.nodes u ON u.node_id = n.upstream_node_id
+	    WHERE n.node_id = $1`
+
+	var node repmgrNode
+	err = a.pool.QueryRowEx(a.shutdownCtx, sql, nil, conf.NodeID).
+		Scan(&node.ID, &node.Name, &node.Type, &node.Active, &node.UpstreamID, &node.UpstreamConninfo)
+	if err != nil {
+		return repmgrNode{}, errors.Wrapf(err, "unable to query repmgr metadata for node %d", conf.NodeID)
+	}
+
+	return node, nil
+}
+
+// repmgrDBState maps the repmgr node type to a _DBState.  Only active standbys
+// are prefaulted, everything else (primaries, witnesses, and inactive nodes)
+// is treated like a primary and left alone.
+func (a *Agent) repmgrDBState() (_DBState, error) {
+	node, err := a.queryRepmgrNode()
+	if err != nil {
+		return _DBStateUnknown, err
+	}
+
+	if err := a.ensureUpstreamPool(node); err != nil {
+		a.log.Warn().Err(err).Int("upstream-node-id", derefInt(node.UpstreamID)).
+			Msg("unable to configure repmgr upstream, lag will be queried locally")
+	}
+
+	if node.Type == "standby" && node.Active {
+		return _DBStateFollower, nil
+	}
+
+	return _DBStatePrimary, nil
+}
+
+// ensureUpstreamPool (re)creates the connection pool used to query the repmgr
+// upstream node.  The pool is only recreated when the upstream changes.
+func (a *Agent) ensureUpstreamPool(node repmgrNode) error {
+	var conninfo string
+	if node.UpstreamConninfo != nil {
+		conninfo = *node.UpstreamConninfo
+	}
+
+	changed, err := a.setUpstream(node.Name, conninfo)
+	if err != nil {
+		return errors.Wrap(err, "unable to configure repmgr upstream")
+	}
+
+	if changed && conninfo != "" {
+		a.log.Info().Str("node-name", node.Name).Int("upstream-node-id", derefInt(node.UpstreamID)).
+			Msg("using repmgr upstream for lag queries")
+	}
+
+	return nil
+}
+
+func derefInt(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
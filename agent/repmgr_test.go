@@ -0,0 +1,77 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_parseRepmgrConf(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantFail bool
+		out      repmgrConf
+	}{
+		{ // 0
+			in: `# repmgr.conf
+node_id=2
+node_name='node2'
+conninfo='host=node2 user=repmgr dbname=repmgr connect_timeout=2'
+data_directory='/var/lib/postgresql/data'
+`,
+			out: repmgrConf{
+				NodeID:   2,
+				NodeName: "node2",
+				Conninfo: "host=node2 user=repmgr dbname=repmgr connect_timeout=2",
+			},
+		},
+		{ // 1
+			in: `node_id = 3
+node_name = "node3"
+  # conninfo='ignored'
+`,
+			out: repmgrConf{
+				NodeID:   3,
+				NodeName: "node3",
+			},
+		},
+		{ // 2
+			in:       `node_name='missing-id'`,
+			wantFail: true,
+		},
+		{ // 3
+			in:       `node_id=two`,
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		conf, err := parseRepmgrConf(strings.NewReader(test.in))
+		switch {
+		case err != nil && test.wantFail:
+			continue
+		case err != nil && !test.wantFail:
+			t.Fatalf("%d: bad: %v", n, err)
+		case err == nil && test.wantFail:
+			t.Fatalf("%d: expected failure", n)
+		}
+
+		if diff := pretty.Compare(conf, test.out); diff != "" {
+			t.Fatalf("%d: repmgrConf diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
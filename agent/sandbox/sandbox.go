@@ -0,0 +1,34 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sandbox confines the IO workers to the handful of system calls they
+// need to prefault pages: read-only open(2)s, pread(2), and close(2), plus
+// whatever the Go runtime requires.  A bug in the IO path therefore can't be
+// leveraged into writing files, executing programs, or opening sockets.
+//
+// On Linux each IO worker's OS thread installs a seccomp-bpf filter and, where
+// Landlock is available, a ruleset that only allows reading files beneath
+// PGDATA.  Both only apply to the thread that installed them, so the rest of
+// the agent (pg_waldump(1), database connections, the HTTP listener) is
+// unaffected.  On FreeBSD, where capsicum(4) can only confine a whole process,
+// the IO workers themselves are not confined: only the file descriptors they
+// open are limited, to pread(2), read-only mmap(2), and fstat(2).
+package sandbox
+
+import (
+	"errors"
+	"runtime"
+)
+
+// ErrUnsupported is returned on platforms without a sandbox.
+var ErrUnsupported = errors.New("sandboxing is not supported on " + runtime.GOOS + "/" + runtime.GOARCH)
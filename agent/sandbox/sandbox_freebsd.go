@@ -0,0 +1,54 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build freebsd
+
+package sandbox
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Supported is true when the IO workers can be sandboxed.
+const Supported = true
+
+// PathsConfined is false on FreeBSD: the IO workers may open any file the
+// agent can.
+func PathsConfined() bool {
+	return false
+}
+
+// ConfineThread is a no-op on FreeBSD, where capsicum(4) confines processes
+// rather than threads.  The IO workers' threads are not confined at all, only
+// the file descriptors they open are, by LimitFile.
+func ConfineThread(dirs ...string) error {
+	return nil
+}
+
+// LimitFile limits f to pread(2), read-only mmap(2), and fstat(2) with
+// capsicum(4).
+func LimitFile(f *os.File) error {
+	rights, err := unix.CapRightsInit([]uint64{unix.CAP_PREAD, unix.CAP_MMAP_R, unix.CAP_FSTAT})
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize capability rights")
+	}
+
+	if err := unix.CapRightsLimit(f.Fd(), rights); err != nil {
+		return errors.Wrapf(err, "unable to limit the capability rights of %q", f.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,amd64 linux,arm64
+
+package sandbox
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Supported is true when ConfineThread can sandbox the calling thread.
+const Supported = true
+
+// Return values of a seccomp filter.
+const (
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+)
+
+// Offsets into struct seccomp_data.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// allowedSyscalls are the system calls an IO worker, and the Go runtime on its
+// behalf, may make.  openat(2) is handled separately.
+var allowedSyscalls = []uintptr{
+	// The IO path
+	unix.SYS_READ,
+	unix.SYS_PREAD64,
+	unix.SYS_PREADV,
+	unix.SYS_FSTAT,
+	unix.SYS_LSEEK,
+	unix.SYS_CLOSE,
+	unix.SYS_FCNTL,
+	unix.SYS_EPOLL_CTL,
+	unix.SYS_MINCORE,
+
+	// Logging, and waking the network poller
+	unix.SYS_WRITE,
+	unix.SYS_WRITEV,
+
+	// The Go runtime
+	unix.SYS_FUTEX,
+	unix.SYS_MMAP,
+	unix.SYS_MUNMAP,
+	unix.SYS_MADVISE,
+	unix.SYS_MPROTECT,
+	unix.SYS_SCHED_YIELD,
+	unix.SYS_NANOSLEEP,
+	unix.SYS_CLOCK_GETTIME,
+	unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_GETTID,
+	unix.SYS_GETPID,
+	unix.SYS_TGKILL,
+	unix.SYS_RT_SIGRETURN,
+	unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_SIGALTSTACK,
+	unix.SYS_RESTART_SYSCALL,
+	unix.SYS_GETRANDOM,
+	unix.SYS_SETITIMER,
+	unix.SYS_TIMER_SETTIME,
+	unix.SYS_TIMER_DELETE,
+	unix.SYS_EXIT,
+	unix.SYS_EXIT_GROUP,
+}
+
+// Landlock's system calls, which are numbered alike on every architecture,
+// and the filesystem access rights of its first ABI.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessFSReadFile = 1 << 2
+	landlockAccessFSReadDir  = 1 << 3
+
+	// landlockAccessFSAll covers executing, writing, reading, removing, and
+	// creating files of every type.
+	landlockAccessFSAll = 1<<13 - 1
+)
+
+// landlockRulesetAttr is struct landlock_ruleset_attr.
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is struct landlock_path_beneath_attr.  The kernel's
+// struct is packed, the trailing padding of this one is never read.
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFD      int32
+}
+
+// openWriteFlags are the open(2) flags that are denied.
+const openWriteFlags = unix.O_WRONLY | unix.O_RDWR | unix.O_CREAT | unix.O_TRUNC |
+	unix.O_APPEND | (unix.O_TMPFILE &^ unix.O_DIRECTORY)
+
+// PathsConfined returns true if ConfineThread limits the files the thread may
+// open to those beneath dirs.  This requires Landlock, i.e. Linux 5.13 or
+// newer with Landlock enabled.
+func PathsConfined() bool {
+	abi, _, errno := unix.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	return errno == 0 && int(abi) >= 1
+}
+
+// ConfineThread installs a seccomp-bpf filter on the calling OS thread and, if
+// PathsConfined, a Landlock ruleset that only allows reading files beneath
+// dirs.  The caller MUST have called runtime.LockOSThread() and MUST NOT unlock
+// the thread: when the goroutine exits the runtime terminates the thread
+// instead of reusing it for other goroutines.  System calls denied by the
+// filter fail with EPERM, opens denied by the ruleset with EACCES.
+func ConfineThread(dirs ...string) error {
+	prog := filter()
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+
+	// Required to install a filter or ruleset without CAP_SYS_ADMIN.  Like the
+	// filter, no_new_privs only applies to the calling thread.
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "unable to set no_new_privs")
+	}
+
+	// The filter denies Landlock's system calls, so the ruleset goes first.
+	if PathsConfined() {
+		if err := restrictPaths(dirs); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+		return errors.Wrap(err, "unable to install seccomp filter")
+	}
+
+	return nil
+}
+
+// restrictPaths restricts the calling thread to reading the files and
+// directories beneath dirs with Landlock.
+func restrictPaths(dirs []string) error {
+	attr := landlockRulesetAttr{handledAccessFS: landlockAccessFSAll}
+	ruleset, _, errno := unix.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errors.Wrap(errno, "unable to create Landlock ruleset")
+	}
+	defer unix.Close(int(ruleset))
+
+	for _, dir := range dirs {
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return errors.Wrapf(err, "unable to open %q", dir)
+		}
+
+		rule := landlockPathBeneathAttr{
+			allowedAccess: landlockAccessFSReadFile | landlockAccessFSReadDir,
+			parentFD:      int32(fd),
+		}
+		_, _, errno := unix.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		unix.Close(fd)
+		if errno != 0 {
+			return errors.Wrapf(errno, "unable to allow reading beneath %q", dir)
+		}
+	}
+
+	if _, _, errno := unix.Syscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return errors.Wrap(errno, "unable to enforce Landlock ruleset")
+	}
+
+	return nil
+}
+
+// LimitFile is a no-op on Linux, the thread is confined instead.
+func LimitFile(f *os.File) error {
+	return nil
+}
+
+// filter returns the seccomp-bpf program installed by ConfineThread.
+func filter() []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+
+	const (
+		ld   = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jset = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		ret  = unix.BPF_RET | unix.BPF_K
+		deny = seccompRetErrno | uint32(unix.EPERM)
+	)
+
+	prog := []unix.SockFilter{
+		// System call numbers are only meaningful for the native architecture.
+		stmt(ld, seccompDataArch),
+		jump(jeq, auditArch, 1, 0),
+		stmt(ret, deny),
+		stmt(ld, seccompDataNr),
+
+		// openat(2) is allowed for reading.  The flags are the third argument,
+		// the low word of which comes first on little-endian architectures.
+		jump(jeq, unix.SYS_OPENAT, 0, 4),
+		stmt(ld, seccompDataArgs+2*8),
+		jump(jset, openWriteFlags, 1, 0),
+		stmt(ret, seccompRetAllow),
+		stmt(ret, deny),
+	}
+
+	for i, nr := range allowedSyscalls {
+		// Jump over the remaining comparisons and the deny to the allow.
+		prog = append(prog, jump(jeq, uint32(nr), uint8(len(allowedSyscalls)-i), 0))
+	}
+
+	return append(prog, stmt(ret, deny), stmt(ret, seccompRetAllow))
+}
@@ -0,0 +1,100 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,amd64 linux,arm64
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+func TestConfineThread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	relation := path.Join(dir, "16385")
+	if err := ioutil.WriteFile(relation, []byte("page"), 0600); err != nil {
+		t.Fatalf("unable to create relation: %v", err)
+	}
+
+	outsideDir, err := ioutil.TempDir("", "sandbox-outside")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(outsideDir)
+
+	outside := path.Join(outsideDir, "secret")
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+
+	errs := make(chan string, 6)
+	go func() {
+		defer close(errs)
+
+		// Never unlocked: the confined thread exits with the goroutine.
+		runtime.LockOSThread()
+		if err := ConfineThread(dir); err != nil {
+			errs <- "unable to confine thread: " + err.Error()
+			return
+		}
+
+		f, err := os.Open(relation)
+		if err != nil {
+			errs <- "unable to open relation: " + err.Error()
+			return
+		}
+		buf := make([]byte, 4)
+		if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "page" {
+			errs <- "unable to read relation"
+		}
+		f.Close()
+
+		if _, err := os.OpenFile(relation, os.O_RDWR, 0); !os.IsPermission(err) {
+			errs <- "opened relation for writing"
+		}
+		if _, err := os.Create(path.Join(dir, "new")); !os.IsPermission(err) {
+			errs <- "created file"
+		}
+		if f, err := os.Open(outside); err == nil {
+			f.Close()
+			if PathsConfined() {
+				errs <- "opened file outside of the allowed directory"
+			}
+		}
+		if conn, err := net.Dial("udp", "127.0.0.1:9"); err == nil {
+			conn.Close()
+			errs <- "opened socket"
+		}
+	}()
+
+	for msg := range errs {
+		t.Fatal(msg)
+	}
+
+	// Other threads are unaffected
+	f, err := os.Create(path.Join(dir, "unconfined"))
+	if err != nil {
+		t.Fatalf("unconfined thread unable to create file: %v", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,36 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux,!freebsd linux,!amd64,!arm64
+
+package sandbox
+
+import "os"
+
+// Supported is true when the IO workers can be sandboxed.
+const Supported = false
+
+// PathsConfined is false on unsupported platforms.
+func PathsConfined() bool {
+	return false
+}
+
+// ConfineThread returns ErrUnsupported.
+func ConfineThread(dirs ...string) error {
+	return ErrUnsupported
+}
+
+// LimitFile returns ErrUnsupported.
+func LimitFile(f *os.File) error {
+	return ErrUnsupported
+}
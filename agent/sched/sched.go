@@ -0,0 +1,27 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sched lowers the CPU and IO scheduling priority of the IO workers so
+// that prefault reads are serviced behind PostgreSQL's own IO on a contended
+// host.  Priorities are set on the calling OS thread, which the caller must
+// have locked with runtime.LockOSThread(), and so do not affect the rest of
+// the agent.
+package sched
+
+import (
+	"errors"
+	"runtime"
+)
+
+// ErrUnsupported is returned on platforms without per-thread priorities.
+var ErrUnsupported = errors.New("per-thread scheduling priorities are not supported on " + runtime.GOOS)
@@ -0,0 +1,65 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package sched
+
+import (
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Supported is true when SetThreadPriority can prioritize the calling thread.
+const Supported = true
+
+// Arguments of ioprio_set(2), from linux/ioprio.h.
+const (
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioWhoProcess = 1
+)
+
+// SetThreadPriority sets the nice(1) level of the calling thread, unless nice
+// is zero, and its ionice(1) class and priority, unless class is
+// config.IOClassDefault.  priority is ignored by the idle class.
+func SetThreadPriority(nice int, class config.IOClass, priority int) error {
+	// Linux applies both to a single thread when given a thread ID.
+	tid := unix.Gettid()
+
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+			return errors.Wrapf(err, "unable to set nice level %d", nice)
+		}
+	}
+
+	var ioprio uintptr
+	switch class {
+	case config.IOClassDefault:
+		return nil
+	case config.IOClassBestEffort:
+		ioprio = ioprioClassBE<<ioprioClassShift | uintptr(priority)
+	case config.IOClassIdle:
+		ioprio = ioprioClassIdle << ioprioClassShift
+	default:
+		return errors.Errorf("unsupported IO scheduling class %d", class)
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprio); errno != 0 {
+		return errors.Wrapf(errno, "unable to set IO scheduling class %s", class)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package sched
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetThreadPriority(t *testing.T) {
+	before, err := unix.Getpriority(unix.PRIO_PROCESS, 0)
+	if err != nil {
+		t.Fatalf("unable to get priority: %v", err)
+	}
+
+	errs := make(chan string, 2)
+	go func() {
+		defer close(errs)
+
+		// Never unlocked: the deprioritized thread exits with the goroutine.
+		runtime.LockOSThread()
+		if err := SetThreadPriority(5, config.IOClassBestEffort, 7); err != nil {
+			errs <- "unable to set priority: " + err.Error()
+			return
+		}
+
+		// getpriority(2) returns 20 - nice
+		if prio, err := unix.Getpriority(unix.PRIO_PROCESS, unix.Gettid()); err != nil || prio != before-5 {
+			errs <- "nice level not set"
+		}
+
+		ioprio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(unix.Gettid()), 0)
+		if errno != 0 || ioprio != ioprioClassBE<<ioprioClassShift|7 {
+			errs <- "IO priority not set"
+		}
+	}()
+
+	for msg := range errs {
+		t.Fatal(msg)
+	}
+
+	// Other threads are unaffected
+	if after, err := unix.Getpriority(unix.PRIO_PROCESS, 0); err != nil || after != before {
+		t.Fatalf("process priority changed from %d to %d", before, after)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// restartpointPollInterval is how often pg_control is checked for a new
+// checkpoint or restartpoint.  A stat(2) is cheap, pg_control is only read when
+// its mtime changes.
+const restartpointPollInterval = 250 * time.Millisecond
+
+var pollIntervalGauge = metrics.NewGauge("poll_interval_seconds", "Current delay between WAL scans in seconds.")
+
+// scanScheduler computes the delay between WAL scans.  The delay starts at the
+// poll interval.  It returns to the poll interval whenever a scan finds new WAL
+// files, is halved while the same WAL files are found but the lag grows, and
+// otherwise doubles, up to a maximum.
+type scanScheduler struct {
+	min time.Duration
+	max time.Duration
+
+	lock    sync.Mutex
+	cur     time.Duration
+	last    string
+	lastLag units.Base2Bytes
+	valid   bool
+}
+
+func newScanScheduler(min, max time.Duration) *scanScheduler {
+	if max < min {
+		max = min
+	}
+
+	s := &scanScheduler{
+		min: min,
+		max: max,
+	}
+	s.set(min)
+
+	return s
+}
+
+// observe records the result of a scan and the lag reported by the database,
+// and adjusts the delay.
+func (s *scanScheduler) observe(walFiles pg.WALFiles, lag units.Base2Bytes) {
+	uniq := walFiles.Unique()
+	names := make([]string, len(uniq))
+	for i := range uniq {
+		names[i] = string(uniq[i])
+	}
+	sort.Strings(names)
+	fingerprint := strings.Join(names, ",")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case !s.valid || fingerprint != s.last:
+		s.set(s.min)
+	case lag > s.lastLag:
+		s.set(s.cur / 2)
+	default:
+		s.set(s.cur * 2)
+	}
+
+	s.last = fingerprint
+	s.lastLag = lag
+	s.valid = true
+}
+
+// reset returns the delay to the poll interval.
+func (s *scanScheduler) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(s.min)
+}
+
+// interval returns the delay before the next scan.
+func (s *scanScheduler) interval() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.cur
+}
+
+// set clamps d to the scheduler's bounds and makes it the delay before the next
+// scan.  The caller must hold lock, except during construction.
+func (s *scanScheduler) set(d time.Duration) {
+	switch {
+	case d < s.min:
+		d = s.min
+	case d > s.max:
+		d = s.max
+	}
+
+	s.cur = d
+	pollIntervalGauge.Set(d.Seconds())
+}
+
+// waitForScan sleeps for up to d, returning early if a checkpoint or
+// restartpoint completes, a new WAL segment starts being written, the role
+// changes or a new follower's lag is first measured, or the agent is shutting
+// down.
+func (a *Agent) waitForScan(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-a.shutdownCtx.Done():
+	case <-timer.C:
+	case <-a.restartpointCh:
+		a.log.Debug().Msg("restartpoint completed, rescanning")
+		a.scanScheduler.reset()
+	case <-a.walArrivedCh:
+		a.log.Debug().Msg("new WAL segment, rescanning")
+		a.scanScheduler.reset()
+	case <-a.pgLogCh:
+		a.log.Debug().Msg("recovery stall reported by the server log, rescanning")
+		a.scanScheduler.reset()
+	case <-a.observedCh:
+		a.log.Debug().Msg("database role or lag observed, rescanning")
+		a.scanScheduler.reset()
+	}
+}
+
+// watchRestartpoints polls pg_control and signals restartpointCh whenever the
+// checkpoint location changes.  On a follower the checkpoint location moves
+// when a restartpoint completes, which is when the oldest LSNs reported by the
+// database advance.
+func (a *Agent) watchRestartpoints(pgdata string) {
+	controlFile := path.Join(pgdata, "global", "pg_control")
+
+	var lastMTime time.Time
+	lastLSN := pg.InvalidLSN
+
+	ticker := time.NewTicker(restartpointPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(controlFile)
+		if err != nil || fi.ModTime().Equal(lastMTime) {
+			continue
+		}
+		lastMTime = fi.ModTime()
+
+		lsn, err := readControlFileCheckpoint(controlFile)
+		if err != nil {
+			a.log.Debug().Err(err).Str("pg_control", controlFile).Msg("unable to read checkpoint location")
+			continue
+		}
+
+		if lsn == lastLSN {
+			continue
+		}
+
+		first := lastLSN == pg.InvalidLSN
+		lastLSN = lsn
+		if first {
+			continue
+		}
+
+		a.log.Debug().Str("checkpoint", lsn.String()).Msg("checkpoint location changed")
+		select {
+		case a.restartpointCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func readControlFileCheckpoint(controlFile string) (pg.LSN, error) {
+	buf, err := readControlFile(controlFile)
+	if err != nil {
+		return pg.InvalidLSN, err
+	}
+
+	return pg.ParseControlFileCheckpoint(buf)
+}
+
+// readControlFile reads the start of pg_control, which holds the location of
+// the latest checkpoint.
+func readControlFile(controlFile string) ([]byte, error) {
+	f, err := os.Open(controlFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open pg_control")
+	}
+	defer f.Close()
+
+	var buf [64]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "unable to read pg_control")
+	}
+
+	return buf[:n], nil
+}
@@ -0,0 +1,63 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestScanScheduler(t *testing.T) {
+	a := pg.WALFiles{"000000010000000000000001", "000000010000000000000002"}
+	b := pg.WALFiles{"000000010000000000000002", "000000010000000000000003"}
+
+	s := newScanScheduler(time.Second, 5*time.Second)
+
+	tests := []struct {
+		in    pg.WALFiles
+		lag   units.Base2Bytes
+		reset bool
+		out   time.Duration
+	}{
+		{in: a, out: time.Second},                           // 0
+		{in: a, out: 2 * time.Second},                       // 1
+		{in: pg.WALFiles{a[1], a[0]}, out: 4 * time.Second}, // 2
+		{in: a, out: 5 * time.Second},                       // 3
+		{in: b, out: time.Second},                           // 4
+		{in: b, out: 2 * time.Second},                       // 5
+		{in: b, reset: true, out: time.Second},              // 6
+		{in: b, out: 2 * time.Second},                       // 7
+		{in: b, out: 4 * time.Second},                       // 8
+		{in: b, lag: units.MiB, out: 2 * time.Second},       // 9
+		{in: b, lag: 2 * units.MiB, out: time.Second},       // 10
+		{in: b, lag: 3 * units.MiB, out: time.Second},       // 11
+		{in: b, lag: 3 * units.MiB, out: 2 * time.Second},   // 12
+		{in: b, lag: units.MiB, out: 4 * time.Second},       // 13
+	}
+
+	for n, test := range tests {
+		s.observe(test.in, test.lag)
+		if test.reset {
+			s.reset()
+		}
+
+		if diff := pretty.Compare(s.interval(), test.out); diff != "" {
+			t.Fatalf("%d: interval diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"golang.org/x/sys/unix"
+)
+
+// memStatsMaxAge is how long a reading of the runtime's memory statistics is
+// reused.  Reading them stops the world, so the memory and GC metrics share one
+// reading per snapshot of the registry.
+const memStatsMaxAge = time.Second
+
+// memStatsCache caches the runtime's memory statistics for memStatsMaxAge.
+type memStatsCache struct {
+	lock  sync.Mutex
+	read  time.Time
+	stats runtime.MemStats
+}
+
+// get returns the memory statistics, reading them again if the cached reading
+// is older than memStatsMaxAge as of now.
+func (c *memStatsCache) get(now time.Time) runtime.MemStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.read.IsZero() || now.Sub(c.read) >= memStatsMaxAge {
+		runtime.ReadMemStats(&c.stats)
+		c.read = now
+	}
+
+	return c.stats
+}
+
+// registerProcessMetrics exports what the agent itself costs: its memory,
+// goroutines, garbage collection, and file descriptors.  A steadily growing
+// number of goroutines or open file descriptors is a leak.
+func registerProcessMetrics() {
+	r := metrics.DefaultRegistry
+	var ms memStatsCache
+	memStat := func(fn func(*runtime.MemStats) float64) func() float64 {
+		return func() float64 {
+			stats := ms.get(time.Now())
+			return fn(&stats)
+		}
+	}
+
+	if _, found := residentMemory(); found {
+		r.GaugeFunc("process_resident_memory_bytes", "Resident memory of the agent in bytes.",
+			func() float64 {
+				rss, _ := residentMemory()
+				return float64(rss)
+			})
+	}
+	if _, found := openFDs(); found {
+		r.GaugeFunc("process_open_fds", "Number of file descriptors open by the agent.",
+			func() float64 {
+				n, _ := openFDs()
+				return float64(n)
+			})
+	}
+	r.GaugeFunc("process_max_fds", "Maximum number of file descriptors the agent may open.",
+		func() float64 {
+			var rlimit unix.Rlimit
+			if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+				return 0
+			}
+			return float64(rlimit.Cur)
+		})
+
+	r.GaugeFunc("go_goroutines", "Number of goroutines.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	r.GaugeFunc("go_heap_alloc_bytes", "Bytes of allocated heap objects.",
+		memStat(func(s *runtime.MemStats) float64 { return float64(s.HeapAlloc) }))
+	r.GaugeFunc("go_heap_objects", "Number of allocated heap objects.",
+		memStat(func(s *runtime.MemStats) float64 { return float64(s.HeapObjects) }))
+	r.GaugeFunc("go_sys_bytes", "Bytes of memory obtained from the OS by the Go runtime.",
+		memStat(func(s *runtime.MemStats) float64 { return float64(s.Sys) }))
+	r.CounterFunc("go_gc_cycles_total", "Number of completed GC cycles.",
+		memStat(func(s *runtime.MemStats) float64 { return float64(s.NumGC) }))
+	r.CounterFunc("go_gc_pause_seconds_total", "Total time the world was stopped by the GC in seconds.",
+		memStat(func(s *runtime.MemStats) float64 { return time.Duration(s.PauseTotalNs).Seconds() }))
+	r.GaugeFunc("go_gc_last_pause_seconds", "Duration of the most recent GC pause in seconds.",
+		memStat(func(s *runtime.MemStats) float64 {
+			if s.NumGC == 0 {
+				return 0
+			}
+			return time.Duration(s.PauseNs[(s.NumGC+255)%256]).Seconds()
+		}))
+}
@@ -0,0 +1,39 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_memStatsCache(t *testing.T) {
+	var c memStatsCache
+	start := time.Unix(1000, 0)
+
+	first := c.get(start)
+	if first.NumGC == 0 && first.Sys == 0 {
+		t.Fatal("memory statistics not read")
+	}
+
+	// Readings are reused until they are memStatsMaxAge old
+	runtime.GC()
+	if got := c.get(start.Add(memStatsMaxAge / 2)); got.NumGC != first.NumGC {
+		t.Fatalf("reading refreshed early: %d GC cycles, want %d", got.NumGC, first.NumGC)
+	}
+	if got := c.get(start.Add(memStatsMaxAge)); got.NumGC <= first.NumGC {
+		t.Fatalf("reading not refreshed: %d GC cycles, want more than %d", got.NumGC, first.NumGC)
+	}
+}
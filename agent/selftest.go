@@ -0,0 +1,183 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/iocache"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+)
+
+// Self-test check results.
+const (
+	SelfTestPass = "pass"
+	SelfTestFail = "fail"
+	SelfTestSkip = "skip"
+)
+
+// minResidentAfter is the fraction of the sampled pages that must be in the
+// filesystem cache right after being prefaulted for the self-test to consider
+// prefaulting effective.
+const minResidentAfter = 0.9
+
+// SelfTestCheck is the result of one of the self-test's checks.
+type SelfTestCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Detail string `json:"detail"`
+}
+
+// SelfTestReport is what each stage of the pipeline did while the self-test
+// ran and whether that shows the agent is prefaulting.
+type SelfTestReport struct {
+	Duration        string            `json:"duration"`
+	Role            string            `json:"role"`
+	Lag             string            `json:"lag,omitempty"`
+	SegmentsDecoded uint64            `json:"segments-decoded"`
+	TailDecodes     uint64            `json:"tail-decodes"`
+	BlocksQueued    uint64            `json:"blocks-queued"`
+	PagesPrefaulted uint64            `json:"pages-prefaulted"`
+	Residency       iocache.Residency `json:"residency"`
+	Checks          []SelfTestCheck   `json:"checks"`
+	Passed          bool              `json:"passed"`
+}
+
+// selfTestCounts are the counters the self-test compares before and after
+// running the agent.
+type selfTestCounts struct {
+	segments    uint64
+	tailDecodes uint64
+	queued      uint64
+	prefaulted  uint64
+}
+
+// SelfTest runs the agent for d, or until ctx is cancelled, and reports whether
+// every stage of the pipeline produced output.  The residency of a sample of
+// the pages prefaulted is checked before and after each is read.  The agent is
+// stopped when SelfTest returns and must not be started again.
+func (a *Agent) SelfTest(ctx context.Context, d time.Duration) (SelfTestReport, error) {
+	residencyErr := a.ioCache.SampleResidency()
+	before := a.selfTestCounts()
+	start := time.Now()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go a.Start(runCtx)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-a.shutdownCtx.Done():
+	}
+
+	state, lag, lagObserved := a.observedDB()
+	cancel()
+	err := a.Wait()
+	a.Stop()
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+
+	after := a.selfTestCounts()
+	r := SelfTestReport{
+		Duration:        time.Since(start).Round(time.Millisecond).String(),
+		Role:            state.String(),
+		SegmentsDecoded: after.segments - before.segments,
+		TailDecodes:     after.tailDecodes - before.tailDecodes,
+		BlocksQueued:    after.queued - before.queued,
+		PagesPrefaulted: after.prefaulted - before.prefaulted,
+		Residency:       a.ioCache.Residency(),
+	}
+	if lagObserved {
+		r.Lag = lag.String()
+	}
+	r.evaluate(state, lagObserved, residencyErr)
+
+	return r, nil
+}
+
+// selfTestCounts reads the counters of each stage of the pipeline.
+func (a *Agent) selfTestCounts() selfTestCounts {
+	values := make(map[string]float64)
+	for _, s := range metrics.DefaultRegistry.Snapshot() {
+		values[s.Name] += s.Value
+	}
+	counter := func(name string) uint64 {
+		return uint64(values[metrics.Namespace+"_"+name])
+	}
+
+	return selfTestCounts{
+		segments:    counter("wal_decoder_segments_total"),
+		tailDecodes: counter("wal_tail_decodes_total"),
+		queued:      a.ioCache.Statistics().Misses,
+		prefaulted:  counter("prefault_pages_total"),
+	}
+}
+
+// evaluate fills in r's checks.  r passes unless one of its checks failed.
+func (r *SelfTestReport) evaluate(state _DBState, lagObserved bool, residencyErr error) {
+	check := func(name string, pass bool, passDetail, failDetail string) {
+		c := SelfTestCheck{Name: name, Result: SelfTestPass, Detail: passDetail}
+		if !pass {
+			c.Result, c.Detail = SelfTestFail, failDetail
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	switch {
+	case state == _DBStatePrimary:
+		check("database", false, "", "the database is a primary, only a follower replays WAL")
+	case state != _DBStateFollower || !lagObserved:
+		check("database", false, "", "the role or lag of the database was never determined: check the connection to the database")
+	default:
+		check("database", true, fmt.Sprintf("follower lagging by %s", r.Lag), "")
+	}
+
+	check("decode", r.SegmentsDecoded+r.TailDecodes > 0,
+		fmt.Sprintf("decoded %d WAL segments and %d ranges of the segment being written", r.SegmentsDecoded, r.TailDecodes),
+		"no WAL was decoded: check the WAL decoder (pg_waldump) and that WAL is arriving from the primary")
+	check("queue", r.BlocksQueued > 0,
+		fmt.Sprintf("queued %d blocks", r.BlocksQueued),
+		"no blocks were queued: the WAL decoded referenced no pages, generate writes on the primary or run the self-test for longer")
+	check("prefault", r.PagesPrefaulted > 0,
+		fmt.Sprintf("prefaulted %d pages", r.PagesPrefaulted),
+		"no pages were prefaulted: check the logs for prefault errors and that PGDATA is readable")
+
+	res := r.Residency
+	switch {
+	case residencyErr != nil:
+		r.Checks = append(r.Checks, SelfTestCheck{Name: "residency", Result: SelfTestSkip, Detail: residencyErr.Error()})
+	case res.Sampled == 0:
+		r.Checks = append(r.Checks, SelfTestCheck{Name: "residency", Result: SelfTestSkip, Detail: "no prefaulted pages were sampled"})
+	default:
+		before := float64(res.ResidentBefore) / float64(res.Sampled)
+		after := float64(res.ResidentAfter) / float64(res.Sampled)
+		detail := fmt.Sprintf("%.0f%% of %d sampled pages were resident before prefaulting and %.0f%% after",
+			100*before, res.Sampled, 100*after)
+		check("residency", after >= minResidentAfter, detail,
+			detail+": the filesystem cache is evicting pages as fast as they are prefaulted, or the prefault backend is asynchronous")
+	}
+
+	r.Passed = true
+	for _, c := range r.Checks {
+		if c.Result == SelfTestFail {
+			r.Passed = false
+		}
+	}
+}
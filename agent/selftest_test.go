@@ -0,0 +1,116 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/iocache"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSelfTestEvaluate(t *testing.T) {
+	working := SelfTestReport{
+		Lag:             "16MiB",
+		SegmentsDecoded: 2,
+		TailDecodes:     5,
+		BlocksQueued:    300,
+		PagesPrefaulted: 280,
+		Residency:       iocache.Residency{Sampled: 20, ResidentBefore: 4, ResidentAfter: 20},
+	}
+
+	tests := []struct {
+		report       SelfTestReport
+		state        _DBState
+		lagObserved  bool
+		residencyErr error
+		results      map[string]string
+		passed       bool
+	}{
+		{ // 0: every stage did its work
+			report:      working,
+			state:       _DBStateFollower,
+			lagObserved: true,
+			results: map[string]string{
+				"database":  SelfTestPass,
+				"decode":    SelfTestPass,
+				"queue":     SelfTestPass,
+				"prefault":  SelfTestPass,
+				"residency": SelfTestPass,
+			},
+			passed: true,
+		},
+		{ // 1: a primary
+			report:      working,
+			state:       _DBStatePrimary,
+			lagObserved: true,
+			results: map[string]string{
+				"database":  SelfTestFail,
+				"decode":    SelfTestPass,
+				"queue":     SelfTestPass,
+				"prefault":  SelfTestPass,
+				"residency": SelfTestPass,
+			},
+		},
+		{ // 2: WAL was decoded but referenced no pages, residency unsupported
+			report: SelfTestReport{
+				Lag:             "0B",
+				SegmentsDecoded: 1,
+			},
+			state:        _DBStateFollower,
+			lagObserved:  true,
+			residencyErr: errors.New("unsupported"),
+			results: map[string]string{
+				"database":  SelfTestPass,
+				"decode":    SelfTestPass,
+				"queue":     SelfTestFail,
+				"prefault":  SelfTestFail,
+				"residency": SelfTestSkip,
+			},
+		},
+		{ // 3: pages were evicted as fast as they were prefaulted
+			report: SelfTestReport{
+				SegmentsDecoded: 1,
+				BlocksQueued:    100,
+				PagesPrefaulted: 100,
+				Residency:       iocache.Residency{Sampled: 10, ResidentAfter: 5},
+			},
+			state: _DBStateFollower,
+			results: map[string]string{
+				"database":  SelfTestFail,
+				"decode":    SelfTestPass,
+				"queue":     SelfTestPass,
+				"prefault":  SelfTestPass,
+				"residency": SelfTestFail,
+			},
+		},
+	}
+
+	for n, test := range tests {
+		r := test.report
+		r.evaluate(test.state, test.lagObserved, test.residencyErr)
+
+		results := make(map[string]string, len(r.Checks))
+		for _, c := range r.Checks {
+			results[c.Name] = c.Result
+		}
+		if diff := pretty.Compare(results, test.results); diff != "" {
+			t.Errorf("%d: results diff: (-got +want)\n%s", n, diff)
+		}
+		if r.Passed != test.passed {
+			t.Errorf("%d: passed %t, want %t", n, r.Passed, test.passed)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+)
+
+// waitForPGData blocks until PG_VERSION exists in pgdataPath, the timeout
+// expires, or the agent is shutdown.  When running as a sidecar the PostgreSQL
+// container may still be running initdb(1) or restoring a base backup when the
+// agent starts.
+func (a *Agent) waitForPGData(pgdataPath string, timeout time.Duration) error {
+	const pollInterval = 1 * time.Second
+
+	versionFile := path.Join(pgdataPath, "PG_VERSION")
+	deadline := time.Now().Add(timeout)
+	for n := 0; ; n++ {
+		_, err := os.Stat(versionFile)
+		switch {
+		case err == nil:
+			return nil
+		case !os.IsNotExist(err):
+			return errors.Wrapf(err, "unable to stat %q", versionFile)
+		case timeout > 0 && time.Now().After(deadline):
+			return errors.Errorf("timed out after %s waiting for %q", timeout, versionFile)
+		}
+
+		if n == 0 {
+			a.log.Info().Str("pgdata", pgdataPath).Dur("startup-timeout", timeout).Msg("waiting for PGDATA")
+		}
+
+		select {
+		case <-a.shutdownCtx.Done():
+			return errors.New("shutdown while waiting for PGDATA")
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// requestShutdown begins an orderly shutdown.  The agent stops accepting new
+// WAL files.  If a drain timeout has been configured the agent waits for
+// queued work to complete before shutting down.  A second request skips the
+// drain.
+func (a *Agent) requestShutdown() {
+	a.walCache.Close()
+
+	if a.cfg.DrainTimeout <= 0 {
+		a.shutdown()
+		return
+	}
+
+	if !atomic.CompareAndSwapUint32(&a.draining, 0, 1) {
+		a.log.Info().Msg("shutdown requested while draining, exiting immediately")
+		a.shutdown()
+		return
+	}
+
+	go func() {
+		defer a.shutdown()
+		a.drain(a.cfg.DrainTimeout)
+	}()
+}
+
+// drain waits until the WAL and IO caches have no outstanding work or timeout
+// has elapsed.
+func (a *Agent) drain(timeout time.Duration) {
+	const pollInterval = 100 * time.Millisecond
+
+	start := time.Now()
+	a.log.Info().Dur("drain-timeout", timeout).Msg("draining queued work")
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		walInFlight, ioPending := a.walCache.NumInFlight(), a.ioCache.NumPending()
+		if walInFlight == 0 && ioPending == 0 {
+			a.log.Info().Dur("duration", time.Since(start)).Msg("drained queued work")
+			return
+		}
+
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-deadline.C:
+			a.log.Warn().Int("wal-in-flight", walInFlight).Int64("io-pending", ioPending).
+				Msg("drain timeout expired, abandoning queued work")
+			return
+		case <-ticker.C:
+			if lib.IsShuttingDown(a.shutdownCtx) {
+				return
+			}
+		}
+	}
+}
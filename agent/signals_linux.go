@@ -16,22 +16,17 @@
 package agent
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"os/signal"
 
-	"github.com/rs/zerolog/log"
 	"golang.org/x/sys/unix"
 )
 
+// setupSignals routes signals to handleSignals.
 func (a *Agent) setupSignals() {
-	// Handle shutdown via a.shutdownCtx
 	a.signalCh = make(chan os.Signal, 10)
-	signal.Notify(a.signalCh, os.Interrupt, unix.SIGTERM, unix.SIGHUP, unix.SIGPIPE)
-
-	a.shutdownCtx, a.shutdown = context.WithCancel(context.Background())
-	a.pgConnCtx, a.pgConnShutdown = context.WithCancel(a.shutdownCtx)
+	signal.Notify(a.signalCh, os.Interrupt, unix.SIGTERM, unix.SIGHUP, unix.SIGPIPE, unix.SIGUSR1)
 }
 
 // handleSignals runs the signal handler thread
@@ -39,15 +34,17 @@ func (a *Agent) handleSignals() {
 	for {
 		select {
 		case <-a.shutdownCtx.Done():
-			log.Debug().Msg("Shutting down")
+			a.log.Debug().Msg("Shutting down")
 			return
 		case sig := <-a.signalCh:
-			log.Info().Str("signal", sig.String()).Msg("Received signal")
+			a.log.Info().Str("signal", sig.String()).Msg("Received signal")
 			switch sig {
 			case os.Interrupt, unix.SIGTERM:
-				a.shutdown()
+				a.requestShutdown()
 			case unix.SIGPIPE, unix.SIGHUP:
 				// Noop
+			case unix.SIGUSR1:
+				a.dumpDiagnostics()
 			default:
 				panic(fmt.Sprintf("unsupported signal: %v", sig))
 			}
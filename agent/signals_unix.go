@@ -16,24 +16,19 @@
 package agent
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 
 	"github.com/alecthomas/units"
-	"github.com/rs/zerolog/log"
 	"golang.org/x/sys/unix"
 )
 
+// setupSignals routes signals to handleSignals.
 func (a *Agent) setupSignals() {
-	// Handle shutdown via a.shutdownCtx
 	a.signalCh = make(chan os.Signal, 10)
-	signal.Notify(a.signalCh, os.Interrupt, unix.SIGTERM, unix.SIGHUP, unix.SIGPIPE, unix.SIGINFO)
-
-	a.shutdownCtx, a.shutdown = context.WithCancel(context.Background())
-	a.pgConnCtx, a.pgConnShutdown = context.WithCancel(a.shutdownCtx)
+	signal.Notify(a.signalCh, os.Interrupt, unix.SIGTERM, unix.SIGHUP, unix.SIGPIPE, unix.SIGUSR1, unix.SIGINFO)
 }
 
 // handleSignals runs the signal handler thread
@@ -46,15 +41,17 @@ func (a *Agent) handleSignals() {
 	for {
 		select {
 		case <-a.shutdownCtx.Done():
-			log.Debug().Msg("Shutting down")
+			a.log.Debug().Msg("Shutting down")
 			return
 		case sig := <-a.signalCh:
-			log.Info().Str("signal", sig.String()).Msg("Received signal")
+			a.log.Info().Str("signal", sig.String()).Msg("Received signal")
 			switch sig {
 			case os.Interrupt, unix.SIGTERM:
-				a.shutdown()
+				a.requestShutdown()
 			case unix.SIGPIPE, unix.SIGHUP:
 				// Noop
+			case unix.SIGUSR1:
+				a.dumpDiagnostics()
 			case unix.SIGINFO:
 				stacklen := runtime.Stack(buf, true)
 				fmt.Printf("=== received SIGINFO ===\n*** goroutine dump...\n%s\n*** end\n", buf[:stacklen])
@@ -0,0 +1,53 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+)
+
+// metricSink is a metrics.Sink published to every interval.
+type metricSink struct {
+	sink     metrics.Sink
+	interval time.Duration
+}
+
+// runSink publishes the agent's metrics to s every interval until the agent
+// shuts down, and once more as it shuts down.
+func (a *Agent) runSink(s metricSink) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.shutdownCtx.Done():
+			// ctx has been cancelled, use a fresh context for the final publish.
+			ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+			a.publishMetrics(ctx, s.sink)
+			cancel()
+			return
+		case <-ticker.C:
+			a.publishMetrics(a.shutdownCtx, s.sink)
+		}
+	}
+}
+
+func (a *Agent) publishMetrics(ctx context.Context, sink metrics.Sink) {
+	if err := sink.Publish(ctx, metrics.DefaultRegistry.Snapshot()); err != nil {
+		a.log.Warn().Err(err).Str("sink", sink.Name()).Msg("unable to publish metrics")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// replicationSlotInterval is how often the upstream's replication slots and
+// WAL retention are queried.
+const replicationSlotInterval = 30 * time.Second
+
+// retentionWarnFraction is the fraction of the WAL the upstream retains for this
+// follower that it may fall behind by before the agent warns.
+const retentionWarnFraction = 0.8
+
+var (
+	walRetentionGauge = metrics.NewGauge("wal_retention_bytes", "WAL the upstream retains for this follower in bytes, -1 if unlimited.")
+	walBehindGauge    = metrics.NewGauge("wal_retention_behind_bytes", "Bytes of WAL this follower has yet to receive from its upstream.")
+)
+
+func slotLabel(slot string) metrics.Label {
+	return metrics.Label{Name: "slot", Value: slot}
+}
+
+// recordReplicationSlots queries the replication slots of this follower's
+// upstream, exports their lag, and warns when the retention of this
+// follower's slot suggests the WAL segments the agent is about to read will
+// soon be recycled.  Errors are logged and are not fatal.
+func (a *Agent) recordReplicationSlots() {
+	a.pgStateLock.Lock()
+	pool := a.upstreamPool
+	due := time.Since(a.lastSlotCheck) >= replicationSlotInterval
+	if pool != nil && due {
+		a.lastSlotCheck = time.Now()
+	}
+	a.pgStateLock.Unlock()
+	if pool == nil || !due {
+		return
+	}
+
+	upstreamTranslations, err := a.upstreamQueries(pool)
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to generate queries for the upstream")
+		return
+	}
+
+	slots, position, err := pg.QueryReplicationSlots(a.shutdownCtx, pool, upstreamTranslations)
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to query upstream replication slots")
+		return
+	}
+
+	for _, slot := range slots {
+		label := slotLabel(slot.Name)
+		metrics.NewGauge("replication_slot_lag_bytes", "WAL retained by the upstream's replication slot in bytes.", label).
+			Set(float64(slot.Lag(position)))
+
+		active := metrics.NewGauge("replication_slot_active", "1 if the upstream's replication slot is in use, 0 otherwise.", label)
+		if slot.Active {
+			active.Set(1)
+		} else {
+			active.Set(0)
+		}
+	}
+
+	slotName, err := a.queryPrimarySlotName()
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to determine this follower's replication slot")
+		return
+	}
+	a.recordWALRetention(pool, upstreamTranslations, slotName)
+	if slotName == "" {
+		return
+	}
+
+	walPosition := a.loadWALPosition()
+	_, walLSN, err := pg.ParseWalfile(walPosition.walFile)
+	if walPosition.walFile == "" || err != nil {
+		walLSN = pg.InvalidLSN
+	}
+
+	warning := slotRetentionWarning(slotName, slots, walLSN, a.walCache.ReadaheadBytes())
+
+	a.pgStateLock.Lock()
+	changed := warning != a.lastSlotWarning
+	a.lastSlotWarning = warning
+	a.pgStateLock.Unlock()
+
+	switch {
+	case !changed:
+	case warning != "":
+		a.log.Warn().Str("slot", slotName).Str("walfile", string(walPosition.walFile)).
+			Str("next step", "expect WAL files not found while decoding").Msg(warning)
+	default:
+		a.log.Info().Str("slot", slotName).Msg("upstream replication slot retention recovered")
+	}
+}
+
+// recordWALRetention queries how much WAL the upstream keeps for this follower,
+// slotName being the replication slot it streams from if any, and warns when
+// the follower has fallen far enough behind that the segments it still needs
+// will soon be recycled.  upstreamTranslations are the upstream's queries.
+// Errors are logged and are not fatal.
+func (a *Agent) recordWALRetention(pool *pgx.ConnPool, upstreamTranslations *pg.WALTranslations, slotName string) {
+	r, err := pg.QueryWALRetention(a.shutdownCtx, pool, upstreamTranslations)
+	if err != nil {
+		a.log.Debug().Err(err).Msg("unable to query upstream WAL retention")
+		return
+	}
+
+	// The WAL receiver restarts streaming from the replay position when it
+	// isn't running.
+	a.pgStateLock.RLock()
+	needed := pg.InvalidLSN
+	if a.recoveryObserved {
+		needed = a.lastRecovery.ReplayLSN
+	}
+	a.pgStateLock.RUnlock()
+	switch walReceiver, found, err := pg.QueryWALReceiver(a.shutdownCtx, a.pool, a.walTranslations); {
+	case err != nil:
+		a.log.Debug().Err(err).Msg("unable to query the WAL receiver")
+	case found && walReceiver.ReceivedLSN() != pg.InvalidLSN:
+		needed = walReceiver.ReceivedLSN()
+	}
+
+	limit, behind, warning := walRetentionWarning(r, slotName, needed)
+	walRetentionGauge.Set(float64(limit))
+	walBehindGauge.Set(float64(behind))
+
+	a.pgStateLock.Lock()
+	changed := warning != a.lastRetentionWarning
+	a.lastRetentionWarning = warning
+	a.pgStateLock.Unlock()
+
+	switch {
+	case !changed:
+	case warning != "":
+		a.log.Warn().Str("slot", slotName).Str("behind", behind.String()).
+			Str("next step", "expect \"requested WAL segment has already been removed\" on this follower").Msg(warning)
+	default:
+		a.log.Info().Str("slot", slotName).Str("behind", behind.String()).Msg("upstream WAL retention recovered")
+	}
+}
+
+// walRetentionWarning returns the WAL the upstream retains for this follower
+// given its retention, r, the follower's replication slot, slotName, and the
+// oldest LSN the follower still needs from the upstream, needed, along with how
+// far behind the upstream the follower is and why the WAL it needs may soon be
+// recycled.  An empty warning means the retention is sufficient.
+func walRetentionWarning(r pg.WALRetention, slotName string, needed pg.LSN) (limit, behind units.Base2Bytes, warning string) {
+	if needed != pg.InvalidLSN && r.Position != pg.InvalidLSN && r.Position > needed {
+		behind = units.Base2Bytes(r.Position - needed)
+	}
+
+	setting := "wal_keep_size"
+	limit = r.KeepSize
+	if slotName != "" {
+		setting = "max_slot_wal_keep_size"
+		limit = r.MaxSlotKeepSize
+	}
+
+	if limit < 0 {
+		return pg.UnlimitedWALKeepSize, behind, ""
+	}
+
+	// The WAL since the upstream's last checkpoint is kept regardless, and
+	// checkpoints are up to max_wal_size apart, so a follower catching up
+	// within max_wal_size of the upstream isn't at risk even when
+	// wal_keep_size is 0.
+	if r.MaxWALSize > limit {
+		setting = "max_wal_size"
+		limit = r.MaxWALSize
+	}
+
+	if limit > 0 && float64(behind) >= retentionWarnFraction*float64(limit) {
+		return limit, behind, fmt.Sprintf("follower is %s behind an upstream that keeps %s of WAL for it (%s), the segments it needs will soon be recycled", behind, limit, setting)
+	}
+
+	return limit, behind, ""
+}
+
+// queryPrimarySlotName returns the name of the replication slot this follower's
+// WAL receiver streams from, or an empty string if it doesn't use a slot.
+// slot_name was added to pg_stat_wal_receiver in PostgreSQL 10.
+func (a *Agent) queryPrimarySlotName() (string, error) {
+	const minSlotNameVersion = 100000
+	if a.walTranslations.Major < minSlotNameVersion {
+		return "", nil
+	}
+
+	const sql = `SELECT slot_name FROM pg_catalog.pg_stat_wal_receiver`
+
+	var slotName *string
+	switch err := a.pool.QueryRowEx(a.shutdownCtx, sql, nil).Scan(&slotName); {
+	case err == pgx.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", errors.Wrap(err, "unable to query pg_stat_wal_receiver")
+	case slotName == nil:
+		return "", nil
+	}
+
+	return *slotName, nil
+}
+
+// slotRetentionWarning returns why the upstream may recycle WAL the agent
+// expects to read given this follower's slot, slotName, the WAL position the
+// agent has reached, walLSN, and the amount of WAL the agent reads ahead.  An
+// empty string means the slot's retention is sufficient.
+func slotRetentionWarning(slotName string, slots []pg.ReplicationSlot, walLSN pg.LSN, readahead units.Base2Bytes) string {
+	var slot *pg.ReplicationSlot
+	for i := range slots {
+		if slots[i].Name == slotName {
+			slot = &slots[i]
+			break
+		}
+	}
+
+	switch {
+	case slot == nil:
+		return "replication slot not found on the upstream, WAL is not retained for this follower"
+	case slot.WALStatus == pg.SlotWALLost:
+		return "upstream has removed WAL required by this follower's replication slot"
+	case slot.WALStatus == pg.SlotWALUnreserved:
+		return "upstream will remove WAL required by this follower's replication slot at its next checkpoint"
+	case slot.SafeWALSize != pg.UnknownSafeWALSize && slot.SafeWALSize < readahead:
+		return fmt.Sprintf("upstream retains less WAL (%s) for this follower's replication slot than the agent reads ahead (%s)", slot.SafeWALSize, readahead)
+	case walLSN != pg.InvalidLSN && slot.RestartLSN != pg.InvalidLSN &&
+		walLSN.SegmentNumber() < slot.RestartLSN.SegmentNumber():
+		return fmt.Sprintf("agent is reading WAL older than the replication slot's restart LSN (%s), those segments may be recycled", slot.RestartLSN)
+	default:
+		return ""
+	}
+}
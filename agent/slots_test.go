@@ -0,0 +1,188 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func Test_slotRetentionWarning(t *testing.T) {
+	slot := func(walStatus string, safeWALSize units.Base2Bytes, restartLSN string) []pg.ReplicationSlot {
+		return []pg.ReplicationSlot{
+			{Name: "other", Type: "physical", RestartLSN: pg.InvalidLSN, SafeWALSize: pg.UnknownSafeWALSize},
+			{
+				Name:        "replica1",
+				Type:        "physical",
+				Active:      true,
+				RestartLSN:  pg.MustParseLSN(restartLSN),
+				WALStatus:   walStatus,
+				SafeWALSize: safeWALSize,
+			},
+		}
+	}
+
+	tests := []struct {
+		slots   []pg.ReplicationSlot
+		walLSN  pg.LSN
+		warning string
+	}{
+		{ // 0
+			slots:  slot(pg.SlotWALReserved, pg.UnknownSafeWALSize, "0/3000000"),
+			walLSN: pg.MustParseLSN("0/3000000"),
+		},
+		{ // 1: pre-PostgreSQL 13
+			slots:  slot("", pg.UnknownSafeWALSize, "0/3000000"),
+			walLSN: pg.MustParseLSN("0/4000000"),
+		},
+		{ // 2
+			slots:   slot("", pg.UnknownSafeWALSize, "0/3000000")[:1],
+			walLSN:  pg.MustParseLSN("0/3000000"),
+			warning: "not found",
+		},
+		{ // 3
+			slots:   slot(pg.SlotWALLost, pg.UnknownSafeWALSize, "0/3000000"),
+			walLSN:  pg.MustParseLSN("0/3000000"),
+			warning: "has removed WAL",
+		},
+		{ // 4
+			slots:   slot(pg.SlotWALUnreserved, 0, "0/3000000"),
+			walLSN:  pg.MustParseLSN("0/3000000"),
+			warning: "next checkpoint",
+		},
+		{ // 5
+			slots:   slot(pg.SlotWALExtended, 16*units.MiB, "0/3000000"),
+			walLSN:  pg.MustParseLSN("0/3000000"),
+			warning: "retains less WAL",
+		},
+		{ // 6
+			slots:  slot(pg.SlotWALReserved, 64*units.MiB, "0/3000000"),
+			walLSN: pg.MustParseLSN("0/3000000"),
+		},
+		{ // 7
+			slots:   slot(pg.SlotWALReserved, pg.UnknownSafeWALSize, "0/5000028"),
+			walLSN:  pg.MustParseLSN("0/4000000"),
+			warning: "older than the replication slot's restart LSN",
+		},
+		{ // 8: WAL position unknown
+			slots:  slot(pg.SlotWALReserved, pg.UnknownSafeWALSize, "0/5000028"),
+			walLSN: pg.InvalidLSN,
+		},
+	}
+
+	for n, test := range tests {
+		warning := slotRetentionWarning("replica1", test.slots, test.walLSN, 32*units.MiB)
+		switch {
+		case test.warning == "" && warning != "":
+			t.Fatalf("%d: unexpected warning: %q", n, warning)
+		case !strings.Contains(warning, test.warning):
+			t.Fatalf("%d: warning %q does not contain %q", n, warning, test.warning)
+		}
+	}
+}
+
+func Test_walRetentionWarning(t *testing.T) {
+	retention := func(keepSize, maxSlotKeepSize units.Base2Bytes) pg.WALRetention {
+		return pg.WALRetention{
+			KeepSize:        keepSize,
+			MaxSlotKeepSize: maxSlotKeepSize,
+			MaxWALSize:      units.GiB,
+			Position:        pg.MustParseLSN("1/0"),
+		}
+	}
+
+	tests := []struct {
+		retention pg.WALRetention
+		slotName  string
+		needed    pg.LSN
+		limit     units.Base2Bytes
+		behind    units.Base2Bytes
+		warning   string
+	}{
+		{ // 0
+			retention: retention(1*units.GiB, pg.UnlimitedWALKeepSize),
+			needed:    pg.MustParseLSN("0/F0000000"),
+			limit:     1 * units.GiB,
+			behind:    256 * units.MiB,
+		},
+		{ // 1
+			retention: retention(1*units.GiB, pg.UnlimitedWALKeepSize),
+			needed:    pg.MustParseLSN("0/30000000"),
+			limit:     1 * units.GiB,
+			behind:    3328 * units.MiB,
+			warning:   "keeps 1GiB of WAL for it (wal_keep_size)",
+		},
+		{ // 2: slots retain WAL without limit
+			retention: retention(1*units.GiB, pg.UnlimitedWALKeepSize),
+			slotName:  "replica1",
+			needed:    pg.MustParseLSN("0/30000000"),
+			limit:     pg.UnlimitedWALKeepSize,
+			behind:    3328 * units.MiB,
+		},
+		{ // 3
+			retention: retention(0, 4*units.GiB),
+			slotName:  "replica1",
+			needed:    pg.MustParseLSN("0/30000000"),
+			limit:     4 * units.GiB,
+			behind:    3328 * units.MiB,
+			warning:   "keeps 4GiB of WAL for it (max_slot_wal_keep_size)",
+		},
+		{ // 4: catching up within max_wal_size with wal_keep_size 0
+			retention: retention(0, pg.UnlimitedWALKeepSize),
+			needed:    pg.MustParseLSN("0/F0000000"),
+			limit:     1 * units.GiB,
+			behind:    256 * units.MiB,
+		},
+		{ // 5
+			retention: retention(0, pg.UnlimitedWALKeepSize),
+			needed:    pg.MustParseLSN("0/30000000"),
+			limit:     1 * units.GiB,
+			behind:    3328 * units.MiB,
+			warning:   "keeps 1GiB of WAL for it (max_wal_size)",
+		},
+		{ // 6: position unknown
+			retention: retention(1*units.GiB, pg.UnlimitedWALKeepSize),
+			needed:    pg.InvalidLSN,
+			limit:     1 * units.GiB,
+		},
+		{ // 7: ahead of a cascading upstream
+			retention: retention(1*units.GiB, pg.UnlimitedWALKeepSize),
+			needed:    pg.MustParseLSN("1/1000"),
+			limit:     1 * units.GiB,
+		},
+		{ // 8: max_wal_size is a floor under max_slot_wal_keep_size
+			retention: retention(0, 256*units.MiB),
+			slotName:  "replica1",
+			needed:    pg.MustParseLSN("0/F0000000"),
+			limit:     1 * units.GiB,
+			behind:    256 * units.MiB,
+		},
+	}
+
+	for n, test := range tests {
+		limit, behind, warning := walRetentionWarning(test.retention, test.slotName, test.needed)
+		if limit != test.limit || behind != test.behind {
+			t.Fatalf("%d: got limit %s behind %s, want limit %s behind %s", n, limit, behind, test.limit, test.behind)
+		}
+		switch {
+		case test.warning == "" && warning != "":
+			t.Fatalf("%d: unexpected warning: %q", n, warning)
+		case !strings.Contains(warning, test.warning):
+			t.Fatalf("%d: warning %q does not contain %q", n, warning, test.warning)
+		}
+	}
+}
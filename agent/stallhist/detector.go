@@ -0,0 +1,69 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stallhist
+
+import (
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+const (
+	// dipFraction is the fraction of the average replay rate below which
+	// replay is considered to have slowed.
+	dipFraction = 0.25
+
+	// rateWeight is the weight of the newest observation in the average
+	// replay rate.
+	rateWeight = 0.2
+)
+
+// Detector flags the intervals during which a lagging follower's replay
+// stalled or slowed sharply relative to its average replay rate.
+type Detector struct {
+	lsn  pg.LSN
+	at   time.Time
+	rate float64
+}
+
+// Observe records the replay LSN at time now and returns the length of the
+// interval since the previous observation if replay stalled or slowed during
+// it, or zero otherwise.
+func (d *Detector) Observe(now time.Time, lsn pg.LSN, lag units.Base2Bytes) time.Duration {
+	prevLSN, prevAt := d.lsn, d.at
+	d.lsn, d.at = lsn, now
+
+	elapsed := now.Sub(prevAt)
+	if prevAt.IsZero() || elapsed <= 0 || lsn < prevLSN {
+		// First observation, or replay restarted on a new timeline
+		d.rate = 0
+		return 0
+	}
+
+	rate := float64(lsn-prevLSN) / elapsed.Seconds()
+	dip := lag > 0 && (rate == 0 || rate < dipFraction*d.rate)
+
+	if d.rate == 0 {
+		d.rate = rate
+	} else {
+		d.rate = rateWeight*rate + (1-rateWeight)*d.rate
+	}
+
+	if !dip {
+		return 0
+	}
+
+	return elapsed
+}
@@ -0,0 +1,51 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stallhist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestDetector(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	const lagging = 16 * units.MiB
+
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		lsn     pg.LSN
+		lag     units.Base2Bytes
+		flagged time.Duration
+	}{
+		{name: "first", offset: 0, lsn: 0x1000000, lag: lagging},
+		{name: "steady", offset: time.Second, lsn: 0x1100000, lag: lagging},
+		{name: "steady", offset: 2 * time.Second, lsn: 0x1200000, lag: lagging},
+		{name: "dip", offset: 3 * time.Second, lsn: 0x1210000, lag: lagging, flagged: time.Second},
+		{name: "stall", offset: 5 * time.Second, lsn: 0x1210000, lag: lagging, flagged: 2 * time.Second},
+		{name: "idle", offset: 6 * time.Second, lsn: 0x1210000, lag: 0},
+		{name: "recovered", offset: 7 * time.Second, lsn: 0x1310000, lag: lagging},
+		{name: "new timeline", offset: 8 * time.Second, lsn: 0x1000, lag: lagging},
+	}
+
+	var d Detector
+	for _, test := range tests {
+		if got := d.Observe(start.Add(test.offset), test.lsn, test.lag); got != test.flagged {
+			t.Fatalf("%s: flagged %v, want %v", test.name, got, test.flagged)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stallhist records which relations were being replayed when WAL
+// replay stalled or slowed and persists a weighting used to prioritize their
+// IOs on subsequent runs.
+package stallhist
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxSegments is the number of recently decoded WAL segments whose
+	// relations are remembered for attribution.
+	maxSegments = 64
+
+	// maxRelationsPerSegment bounds the relations remembered per segment.
+	maxRelationsPerSegment = 4096
+
+	// halfLife is how long it takes for a relation's weight to halve.
+	halfLife = 24 * time.Hour
+
+	// boostWeight is the weight, in seconds of attributed stall, at which a
+	// relation's IOs are prioritized.
+	boostWeight = 1.0
+
+	// minWeight is the weight below which a relation is forgotten.
+	minWeight = 0.01
+)
+
+var relationsGauge = metrics.NewGauge("stall_history_relations", "Number of relations with a recorded replay stall weight.")
+
+// Relation identifies a relation independent of its segments and blocks.
+type Relation struct {
+	Tablespace pg.OID `json:"tablespace"`
+	Database   pg.OID `json:"database"`
+	Relation   pg.OID `json:"relation"`
+}
+
+// RelationOf returns the relation referenced by key.
+func RelationOf(key structs.IOCacheKey) Relation {
+	return Relation{
+		Tablespace: key.Tablespace,
+		Database:   key.Database,
+		Relation:   key.Relation,
+	}
+}
+
+// History maps relations to a weight: the number of seconds of replay stall
+// attributed to the relation, decayed over time.
+type History struct {
+	blob state.Blob
+
+	lock    sync.RWMutex
+	weights map[Relation]float64
+	updated time.Time
+
+	// segments contains the relations referenced by recently decoded WAL
+	// segments.  order is the order segments were added for eviction.
+	segments map[pg.WALFilename]map[Relation]struct{}
+	order    []pg.WALFilename
+}
+
+// _File is the on-disk representation of a History.
+type _File struct {
+	Updated   time.Time       `json:"updated"`
+	Relations []_FileRelation `json:"relations"`
+}
+
+type _FileRelation struct {
+	Relation
+	Weight float64 `json:"weight"`
+}
+
+// New creates an empty History persisted to blob.
+func New(blob state.Blob) *History {
+	return &History{
+		blob:     blob,
+		weights:  make(map[Relation]float64),
+		updated:  time.Now(),
+		segments: make(map[pg.WALFilename]map[Relation]struct{}),
+	}
+}
+
+// Load reads the History from its blob, decaying the persisted weights by the
+// time elapsed since they were saved.  A missing history is not an error.
+func (h *History) Load() error {
+	buf, err := h.blob.Read()
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "unable to read stall history")
+	case buf == nil:
+		return nil
+	}
+
+	var f _File
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return errors.Wrap(err, "unable to parse stall history")
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.weights = make(map[Relation]float64, len(f.Relations))
+	for _, r := range f.Relations {
+		h.weights[r.Relation] = r.Weight
+	}
+	h.updated = f.Updated
+	h.decayLocked(time.Now())
+
+	return nil
+}
+
+// Save decays and writes the History to its blob.
+func (h *History) Save() error {
+	h.lock.Lock()
+	h.decayLocked(time.Now())
+	f := _File{
+		Updated:   h.updated,
+		Relations: make([]_FileRelation, 0, len(h.weights)),
+	}
+	for rel, weight := range h.weights {
+		f.Relations = append(f.Relations, _FileRelation{Relation: rel, Weight: weight})
+	}
+	h.lock.Unlock()
+
+	sort.Slice(f.Relations, func(i, j int) bool { return f.Relations[i].Weight > f.Relations[j].Weight })
+
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode stall history")
+	}
+
+	if err := h.blob.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write stall history")
+	}
+
+	return nil
+}
+
+// Run saves the History every interval until ctx is cancelled, and once more
+// on the way out.
+func (h *History) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := h.Save(); err != nil {
+				lib.Logger(ctx).Warn().Err(err).Str("state", h.blob.String()).Msg("unable to save stall history")
+			}
+			return
+		case <-ticker.C:
+			if err := h.Save(); err != nil {
+				lib.Logger(ctx).Warn().Err(err).Str("state", h.blob.String()).Msg("unable to save stall history")
+			}
+		}
+	}
+}
+
+// Decoded records the relations referenced by the records of walFile, a
+// decoded WAL file.
+func (h *History) Decoded(walFile pg.WALFilename, relations map[Relation]struct{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	segment, found := h.segments[walFile]
+	if !found {
+		for len(h.order) >= maxSegments {
+			delete(h.segments, h.order[0])
+			h.order = h.order[1:]
+		}
+
+		segment = make(map[Relation]struct{}, len(relations))
+		h.segments[walFile] = segment
+		h.order = append(h.order, walFile)
+	}
+
+	for rel := range relations {
+		if len(segment) >= maxRelationsPerSegment {
+			break
+		}
+		segment[rel] = struct{}{}
+	}
+}
+
+// RecordStall attributes stalled to every relation decoded from walFile, the
+// WAL segment being replayed when replay stalled.  RecordStall returns the
+// number of relations the stall was attributed to.
+func (h *History) RecordStall(walFile pg.WALFilename, stalled time.Duration) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	segment := h.segments[walFile]
+	for rel := range segment {
+		h.weights[rel] += stalled.Seconds()
+	}
+	relationsGauge.Set(float64(len(h.weights)))
+
+	return len(segment)
+}
+
+// RecordRelationStall attributes stalled to rel, a relation the server
+// reported replay waiting on.
+func (h *History) RecordRelationStall(rel Relation, stalled time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.weights[rel] += stalled.Seconds()
+	relationsGauge.Set(float64(len(h.weights)))
+}
+
+// Weight returns rel's current weight.
+func (h *History) Weight(rel Relation) float64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.weights[rel]
+}
+
+// Boosted returns true if IOs for key should be serviced ahead of other IOs.
+func (h *History) Boosted(key structs.IOCacheKey) bool {
+	if key.SLRU != pg.SLRUNone {
+		return false
+	}
+
+	return h.Weight(RelationOf(key)) >= boostWeight
+}
+
+// decayLocked decays all weights to now.  The caller must hold the write lock.
+func (h *History) decayLocked(now time.Time) {
+	elapsed := now.Sub(h.updated)
+	if elapsed <= 0 {
+		return
+	}
+
+	factor := math.Pow(0.5, float64(elapsed)/float64(halfLife))
+	for rel, weight := range h.weights {
+		weight *= factor
+		if weight < minWeight {
+			delete(h.weights, rel)
+			continue
+		}
+		h.weights[rel] = weight
+	}
+	h.updated = now
+	relationsGauge.Set(float64(len(h.weights)))
+}
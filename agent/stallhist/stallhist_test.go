@@ -0,0 +1,104 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stallhist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stallhist")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hot := structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: 16385, Block: 7}
+	cold := structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: 16386, Block: 7}
+	const (
+		stalledWAL pg.WALFilename = "000000010000000000000002"
+		otherWAL   pg.WALFilename = "000000010000000000000003"
+	)
+
+	h := New(state.File(path.Join(dir, "history.json")))
+	h.Decoded(stalledWAL, map[Relation]struct{}{RelationOf(hot): {}})
+	h.Decoded(otherWAL, map[Relation]struct{}{RelationOf(cold): {}})
+
+	if n := h.RecordStall(stalledWAL, 2*time.Second); n != 1 {
+		t.Fatalf("stall attributed to %d relations, want 1", n)
+	}
+	if n := h.RecordStall("000000010000000000000009", time.Second); n != 0 {
+		t.Fatalf("stall attributed to %d relations of an unknown segment, want 0", n)
+	}
+
+	if !h.Boosted(hot) {
+		t.Fatalf("expected %+v to be boosted", hot)
+	}
+	if h.Boosted(cold) {
+		t.Fatalf("expected %+v not to be boosted", cold)
+	}
+	if h.Boosted(structs.IOCacheKey{SLRU: pg.SLRUXact}) {
+		t.Fatalf("SLRU pages are never boosted")
+	}
+
+	if err := h.Save(); err != nil {
+		t.Fatalf("unable to save: %v", err)
+	}
+
+	loaded := New(h.blob)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	if w := loaded.Weight(RelationOf(hot)); math.Abs(w-2) > 0.01 {
+		t.Fatalf("bad loaded weight: %v", w)
+	}
+
+	// Weights decay with a half-life
+	loaded.lock.Lock()
+	loaded.decayLocked(loaded.updated.Add(halfLife))
+	loaded.lock.Unlock()
+	if w := loaded.Weight(RelationOf(hot)); math.Abs(w-1) > 0.01 {
+		t.Fatalf("bad decayed weight: %v", w)
+	}
+
+	// A missing history is not an error
+	if err := New(state.File(path.Join(dir, "missing.json"))).Load(); err != nil {
+		t.Fatalf("unable to load a missing history: %v", err)
+	}
+}
+
+func TestHistorySegmentEviction(t *testing.T) {
+	h := New(state.File(""))
+	rel := map[Relation]struct{}{{Tablespace: 1663, Database: 1, Relation: 2}: {}}
+	for i := 0; i < maxSegments+1; i++ {
+		h.Decoded(pg.WALFilename(fmt.Sprintf("0000000100000000%08X", i)), rel)
+	}
+
+	if len(h.segments) != maxSegments || len(h.order) != maxSegments {
+		t.Fatalf("bad number of segments: %d/%d", len(h.segments), len(h.order))
+	}
+	if n := h.RecordStall("000000010000000000000000", time.Second); n != 0 {
+		t.Fatalf("oldest segment was not evicted")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/fhcache"
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+const (
+	// stateSaveInterval is how often the agent's own state is persisted.
+	stateSaveInterval = time.Minute
+
+	// walPositionKey is the key of the _SavedWALPosition in state.BucketWAL.
+	walPositionKey = "position"
+
+	// missingFilesKey is the key of the segments the file handle cache found
+	// missing in state.BucketNegativeCache.
+	missingFilesKey = "missing-files"
+)
+
+// _SavedWALPosition is the persisted form of the most recent _WALPosition and
+// replay LSN.
+type _SavedWALPosition struct {
+	Saved      time.Time      `json:"saved"`
+	TimelineID pg.TimelineID  `json:"timeline-id"`
+	WALFile    pg.WALFilename `json:"wal-file"`
+	ReplayLSN  string         `json:"replay-lsn,omitempty"`
+}
+
+// stateBlob returns where a piece of state is persisted: its own file if
+// filePath is set, otherwise bucket/key of the state store.  stateBlob returns
+// nil if neither is configured.
+func (a *Agent) stateBlob(filePath, bucket, key string) state.Blob {
+	switch {
+	case filePath != "":
+		return state.File(filePath)
+	case a.stateStore != nil:
+		return a.stateStore.Blob(bucket, key)
+	default:
+		return nil
+	}
+}
+
+// restoreState seeds the agent with the WAL position saved by the previous
+// run.
+func (a *Agent) restoreState() error {
+	var saved _SavedWALPosition
+	found, err := a.stateStore.Get(state.BucketWAL, walPositionKey, &saved)
+	if err != nil || !found {
+		return err
+	}
+
+	a.storeWALPosition(_WALPosition{timelineID: saved.TimelineID, walFile: saved.WALFile})
+
+	a.log.Info().Time("saved", saved.Saved).Uint32("timeline-id", uint32(saved.TimelineID)).
+		Str("walfile", string(saved.WALFile)).Str("replay-lsn", saved.ReplayLSN).
+		Msg("restored WAL position")
+
+	return nil
+}
+
+// restoreMissingFiles seeds the file handle cache with the segments the
+// previous run found missing, for whatever remains of their TTL.
+func (a *Agent) restoreMissingFiles() error {
+	var files []fhcache.MissingFile
+	found, err := a.stateStore.Get(state.BucketNegativeCache, missingFilesKey, &files)
+	if err != nil || !found {
+		return err
+	}
+
+	a.fileHandleCache.RestoreMissingFiles(files)
+
+	return nil
+}
+
+// saveState persists the agent's WAL position and the segments the file
+// handle cache found missing.
+func (a *Agent) saveState() error {
+	if a.fileHandleCache != nil {
+		if err := a.stateStore.Put(state.BucketNegativeCache, missingFilesKey, a.fileHandleCache.MissingFiles()); err != nil {
+			return errors.Wrap(err, "unable to save missing files")
+		}
+	}
+
+	p := a.loadWALPosition()
+	if p.walFile == "" {
+		return nil
+	}
+
+	saved := _SavedWALPosition{
+		Saved:      time.Now(),
+		TimelineID: p.timelineID,
+		WALFile:    p.walFile,
+	}
+
+	a.pgStateLock.RLock()
+	if a.recoveryObserved && a.lastRecovery.ReplayLSN != pg.InvalidLSN {
+		saved.ReplayLSN = a.lastRecovery.ReplayLSN.String()
+	}
+	a.pgStateLock.RUnlock()
+
+	if err := a.stateStore.Put(state.BucketWAL, walPositionKey, saved); err != nil {
+		return errors.Wrap(err, "unable to save WAL position")
+	}
+
+	return nil
+}
+
+// runStateStore saves the agent's state every stateSaveInterval until
+// shutdown, and once more on the way out.
+func (a *Agent) runStateStore() {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.shutdownCtx.Done():
+			if err := a.saveState(); err != nil {
+				a.log.Warn().Err(err).Msg("unable to save agent state")
+			}
+			return
+		case <-ticker.C:
+			if err := a.saveState(); err != nil {
+				a.log.Warn().Err(err).Msg("unable to save agent state")
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Blob is an opaque piece of agent state that is read at startup and
+// rewritten periodically.
+type Blob interface {
+	// Read returns the Blob's contents, or nil if it has never been written.
+	Read() ([]byte, error)
+
+	// Write replaces the Blob's contents.
+	Write(buf []byte) error
+
+	// String describes where the Blob is persisted.
+	String() string
+}
+
+// _FileBlob is a Blob persisted to its own file.
+type _FileBlob string
+
+// File returns a Blob persisted to the file at path.
+func File(path string) Blob {
+	return _FileBlob(path)
+}
+
+func (f _FileBlob) Read() ([]byte, error) {
+	buf, err := ioutil.ReadFile(string(f))
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "unable to read %q", string(f))
+	}
+
+	return buf, nil
+}
+
+func (f _FileBlob) Write(buf []byte) error {
+	// Write and rename so that a crash never leaves a truncated file.
+	tmpPath := string(f) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return errors.Wrapf(err, "unable to write %q", tmpPath)
+	}
+	if err := os.Rename(tmpPath, string(f)); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "unable to replace %q", string(f))
+	}
+
+	return nil
+}
+
+func (f _FileBlob) String() string {
+	return string(f)
+}
@@ -0,0 +1,198 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package state is a small on-disk key/value store for the agent's
+// accumulated knowledge (e.g. its WAL position, warm set, and stall history)
+// so that it survives restarts and host reboots.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets used by the agent.  Each bucket holds one kind of state.
+const (
+	BucketWAL           = "wal"
+	BucketWarmSet       = "warm-set"
+	BucketStallHistory  = "stall-history"
+	BucketNegativeCache = "negative-cache"
+)
+
+// openTimeout is how long Open waits for another process to release the store.
+const openTimeout = time.Second
+
+// Store is an embedded key/value store.  Values are JSON encoded and grouped
+// into buckets.
+type Store struct {
+	path string
+	db   *bolt.DB
+}
+
+// Open opens, creating if necessary, the Store at path.  Only one process may
+// have a Store open at a time.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open state store %q", path)
+	}
+
+	return &Store{
+		path: path,
+		db:   db,
+	}, nil
+}
+
+// Close closes the Store.
+func (s *Store) Close() error {
+	if err := s.db.Close(); err != nil {
+		return errors.Wrapf(err, "unable to close state store %q", s.path)
+	}
+
+	return nil
+}
+
+// Get decodes the value of key in bucket into v.  found is false if the key
+// does not exist.
+func (s *Store) Get(bucket, key string, v interface{}) (found bool, err error) {
+	buf, err := s.get(bucket, key)
+	if err != nil || buf == nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return false, errors.Wrapf(err, "unable to decode %s/%s", bucket, key)
+	}
+
+	return true, nil
+}
+
+// Put encodes v and stores it as the value of key in bucket.
+func (s *Store) Put(bucket, key string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "unable to encode %s/%s", bucket, key)
+	}
+
+	return s.put(bucket, key, buf)
+}
+
+// Delete removes key from bucket.  Deleting a missing key is not an error.
+func (s *Store) Delete(bucket, key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to delete %s/%s", bucket, key)
+	}
+
+	return nil
+}
+
+// Keys returns the keys in bucket.
+func (s *Store) Keys(bucket string) ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list %s", bucket)
+	}
+
+	return keys, nil
+}
+
+// Blob returns a Blob persisted as the value of key in bucket.
+func (s *Store) Blob(bucket, key string) Blob {
+	return _StoreBlob{
+		store:  s,
+		bucket: bucket,
+		key:    key,
+	}
+}
+
+// get returns a copy of the raw value of key in bucket, or nil if it does not
+// exist.
+func (s *Store) get(bucket, key string) ([]byte, error) {
+	var buf []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		// Values are only valid for the life of the transaction.
+		if v := b.Get([]byte(key)); v != nil {
+			buf = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s/%s", bucket, key)
+	}
+
+	return buf, nil
+}
+
+// put stores buf as the raw value of key in bucket.
+func (s *Store) put(bucket, key string, buf []byte) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), buf)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to write %s/%s", bucket, key)
+	}
+
+	return nil
+}
+
+// _StoreBlob is a Blob persisted as a raw value in a Store.
+type _StoreBlob struct {
+	store  *Store
+	bucket string
+	key    string
+}
+
+func (b _StoreBlob) Read() ([]byte, error) {
+	return b.store.get(b.bucket, b.key)
+}
+
+func (b _StoreBlob) Write(buf []byte) error {
+	return b.store.put(b.bucket, b.key, buf)
+}
+
+func (b _StoreBlob) String() string {
+	return fmt.Sprintf("%s:%s/%s", b.store.path, b.bucket, b.key)
+}
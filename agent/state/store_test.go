@@ -0,0 +1,116 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	type value struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	storePath := path.Join(dir, "state.db")
+	s, err := state.Open(storePath)
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+
+	var v value
+	if found, err := s.Get(state.BucketWAL, "missing", &v); err != nil || found {
+		t.Fatalf("missing key: found %t, err %v", found, err)
+	}
+
+	if err := s.Put(state.BucketWAL, "position", value{Name: "a", Count: 1}); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+	if err := s.Blob(state.BucketWarmSet, "manifest").Write([]byte("manifest")); err != nil {
+		t.Fatalf("unable to write blob: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unable to close: %v", err)
+	}
+
+	// Values survive reopening the store
+	s, err = state.Open(storePath)
+	if err != nil {
+		t.Fatalf("unable to reopen: %v", err)
+	}
+	defer s.Close()
+
+	if found, err := s.Get(state.BucketWAL, "position", &v); err != nil || !found {
+		t.Fatalf("position: found %t, err %v", found, err)
+	}
+	if diff := pretty.Compare(v, value{Name: "a", Count: 1}); diff != "" {
+		t.Fatalf("value diff: (-got +want)\n%s", diff)
+	}
+
+	buf, err := s.Blob(state.BucketWarmSet, "manifest").Read()
+	if err != nil || string(buf) != "manifest" {
+		t.Fatalf("blob: got %q, err %v", buf, err)
+	}
+
+	if buf, err := s.Blob(state.BucketStallHistory, "relations").Read(); err != nil || buf != nil {
+		t.Fatalf("missing blob: got %q, err %v", buf, err)
+	}
+
+	keys, err := s.Keys(state.BucketWAL)
+	if err != nil {
+		t.Fatalf("unable to list keys: %v", err)
+	}
+	if diff := pretty.Compare(keys, []string{"position"}); diff != "" {
+		t.Fatalf("keys diff: (-got +want)\n%s", diff)
+	}
+
+	if err := s.Delete(state.BucketWAL, "position"); err != nil {
+		t.Fatalf("unable to delete: %v", err)
+	}
+	if found, err := s.Get(state.BucketWAL, "position", &v); err != nil || found {
+		t.Fatalf("deleted key: found %t, err %v", found, err)
+	}
+}
+
+func TestFileBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := state.File(path.Join(dir, "blob.json"))
+	if buf, err := b.Read(); err != nil || buf != nil {
+		t.Fatalf("missing file: got %q, err %v", buf, err)
+	}
+
+	if err := b.Write([]byte("{}")); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	if buf, err := b.Read(); err != nil || string(buf) != "{}" {
+		t.Fatalf("file: got %q, err %v", buf, err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestStateRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-state")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	storePath := path.Join(dir, "state.db")
+	store, err := state.Open(storePath)
+	if err != nil {
+		t.Fatalf("unable to open state store: %v", err)
+	}
+
+	// Nothing is saved before the first WAL scan
+	a := &Agent{stateStore: store}
+	if err := a.saveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+
+	want := _WALPosition{timelineID: 3, walFile: "000000030000000100000042"}
+	a.storeWALPosition(want)
+	if err := a.saveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unable to close state store: %v", err)
+	}
+
+	store, err = state.Open(storePath)
+	if err != nil {
+		t.Fatalf("unable to reopen state store: %v", err)
+	}
+	defer store.Close()
+
+	restored := &Agent{stateStore: store}
+	if err := restored.restoreState(); err != nil {
+		t.Fatalf("unable to restore state: %v", err)
+	}
+	if diff := pretty.Compare(restored.loadWALPosition(), want); diff != "" {
+		t.Fatalf("restored position diff: (-got +want)\n%s", diff)
+	}
+
+	if blob := restored.stateBlob("", state.BucketWarmSet, "manifest"); blob == nil {
+		t.Fatalf("expected a blob in the state store")
+	}
+	if blob := (&Agent{}).stateBlob("", state.BucketWarmSet, "manifest"); blob != nil {
+		t.Fatalf("expected no blob without a state store, got %s", blob)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/consul"
+	"github.com/bschofield/pg_prefaulter/agent/hooks"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// Status is a point-in-time snapshot of the agent's state suitable for
+// rendering to operators.
+type Status struct {
+	Version        string                 `json:"version"`
+	Ready          bool                   `json:"ready"`
+	Draining       bool                   `json:"draining"`
+	Role           string                 `json:"role"`
+	UpstreamRole   string                 `json:"upstream-role,omitempty"`
+	LastScan       *time.Time             `json:"last-scan,omitempty"`
+	LastWALFile    pg.WALFilename         `json:"last-wal-file,omitempty"`
+	LastTimelineID pg.TimelineID          `json:"last-timeline-id,omitempty"`
+	WALDirectory   string                 `json:"wal-directory,omitempty"`
+	LagBytes       int64                  `json:"lag-bytes"`
+	PollInterval   string                 `json:"poll-interval,omitempty"`
+	Maintenance    bool                   `json:"maintenance-window,omitempty"`
+	Recovery       *RecoveryStatus        `json:"recovery,omitempty"`
+	PGLog          *PGLogStatus           `json:"pg-log,omitempty"`
+	WALInFlight    int                    `json:"wal-in-flight"`
+	ReadaheadBytes string                 `json:"readahead-bytes,omitempty"`
+	IOPending      int64                  `json:"io-pending"`
+	IOWorkers      uint                   `json:"io-workers,omitempty"`
+	SecondsSaved   float64                `json:"replay-seconds-saved"`
+	Caches         map[string]CacheStatus `json:"caches,omitempty"`
+}
+
+// RecoveryStatus describes a follower's replay state.  A growing lag with an
+// advancing replay means the prefaulter is behind, a stalled or paused replay
+// means replay is blocked (e.g. by recovery conflicts).
+type RecoveryStatus struct {
+	ReplayPaused         bool                 `json:"replay-paused"`
+	ReplayLSN            string               `json:"replay-lsn,omitempty"`
+	ReplayStalledSeconds float64              `json:"replay-stalled-seconds"`
+	Conflicts            pg.RecoveryConflicts `json:"conflicts"`
+}
+
+// Status returns the current Status of the agent.
+func (a *Agent) Status() Status {
+	s := Status{
+		Version:  buildtime.VERSION,
+		Ready:    a.isReady(),
+		Draining: a.isDraining(),
+	}
+
+	if lastScan := atomic.LoadInt64(&a.lastScan); lastScan != 0 {
+		t := time.Unix(0, lastScan).UTC()
+		s.LastScan = &t
+	}
+
+	walPosition := a.loadWALPosition()
+	s.LastWALFile = walPosition.walFile
+	s.LastTimelineID = walPosition.timelineID
+
+	a.pgStateLock.RLock()
+	s.WALDirectory = a.walDir
+	s.Role = a.lastDBState.String()
+	if a.upstreamPool != nil && a.upstreamRole != _DBStateUnknown {
+		s.UpstreamRole = a.upstreamRole.String()
+	}
+	s.LagBytes = int64(a.lastLag)
+	if a.recoveryObserved {
+		s.Recovery = &RecoveryStatus{
+			ReplayPaused:         a.lastRecovery.ReplayPaused,
+			ReplayStalledSeconds: a.replayStalled.Seconds(),
+			Conflicts:            a.lastRecovery.Conflicts,
+		}
+		if a.lastRecovery.ReplayLSN != pg.InvalidLSN {
+			s.Recovery.ReplayLSN = a.lastRecovery.ReplayLSN.String()
+		}
+	}
+	a.pgStateLock.RUnlock()
+
+	if a.maintenance != nil {
+		s.Maintenance = a.maintenance.Open(time.Now())
+	}
+
+	if a.scanScheduler != nil {
+		s.PollInterval = a.scanScheduler.interval().String()
+	}
+
+	if a.walCache != nil {
+		s.WALInFlight = a.walCache.NumInFlight()
+		s.ReadaheadBytes = a.walCache.ReadaheadBytes().String()
+	}
+
+	if a.ioCache != nil {
+		s.IOPending = a.ioCache.NumPending()
+		s.IOWorkers = a.ioCache.Workers()
+		_, saved := a.ioCache.Savings()
+		s.SecondsSaved = saved.Seconds()
+	}
+
+	s.PGLog = a.pgLogStatus()
+	s.Caches = a.cacheStatus()
+
+	return s
+}
+
+// isReady returns true once the agent has completed its first successful WAL
+// scan and is not draining.
+func (a *Agent) isReady() bool {
+	return atomic.LoadUint32(&a.ready) == 1 && !a.isDraining()
+}
+
+// isDraining returns true once the agent has stopped accepting new work in
+// preparation for shutting down.
+func (a *Agent) isDraining() bool {
+	return atomic.LoadUint32(&a.draining) == 1
+}
+
+// markScanned records the completion of a successful WAL scan.
+func (a *Agent) markScanned() {
+	atomic.StoreInt64(&a.lastScan, time.Now().UnixNano())
+	atomic.StoreUint32(&a.ready, 1)
+}
+
+// recordRole records the most recently observed database role and returns
+// true if it changed or was forgotten.  The lag is forgotten when the role
+// changes: a primary has no lag and a new follower's lag has yet to be
+// measured.
+func (a *Agent) recordRole(state _DBState) (changed bool) {
+	a.pgStateLock.Lock()
+	defer a.pgStateLock.Unlock()
+
+	if state == a.lastDBState && a.roleObserved {
+		return false
+	}
+
+	if state != a.lastDBState && a.lastDBState != _DBStateUnknown {
+		a.fireEvent(hooks.EventRoleChange, map[string]interface{}{
+			"from": a.lastDBState.String(),
+			"to":   state.String(),
+		})
+	}
+
+	a.lastDBState = state
+	a.roleObserved = true
+	a.lagObserved = false
+
+	return true
+}
+
+// forgetRole is called once the role can no longer be observed.  The WAL
+// scanner stops predicting WAL files from the stale role and lag until the
+// role is observed again.
+func (a *Agent) forgetRole() {
+	a.pgStateLock.Lock()
+	defer a.pgStateLock.Unlock()
+
+	a.roleObserved = false
+	a.lagObserved = false
+}
+
+// forgetLag is called once the lag can no longer be measured.  The WAL scanner
+// stops predicting WAL files from the stale lag until it is measured again.
+func (a *Agent) forgetLag() {
+	a.pgStateLock.Lock()
+	defer a.pgStateLock.Unlock()
+
+	a.lagObserved = false
+}
+
+// recordLag records the most recently observed lag and returns true if it is
+// the first lag observed since the role changed.
+func (a *Agent) recordLag(lag units.Base2Bytes) (first bool) {
+	a.pgStateLock.Lock()
+	defer a.pgStateLock.Unlock()
+
+	if threshold := a.hooksCfg.LagThreshold; threshold > 0 && (lag > threshold) != a.lagExceeded {
+		a.lagExceeded = lag > threshold
+		a.fireEvent(hooks.EventLagThreshold, map[string]interface{}{
+			"lag-bytes":       uint64(lag),
+			"threshold-bytes": uint64(threshold),
+			"exceeded":        a.lagExceeded,
+		})
+	}
+
+	a.alerter.Observe(time.Now(), lag)
+
+	first = !a.lagObserved
+	a.lastLag = lag
+	a.lagObserved = true
+
+	lagBytesGauge.Set(float64(lag))
+
+	return first
+}
+
+// observedDB returns the most recently observed role and lag.  The role is
+// _DBStateUnknown while it is forgotten, and lagObserved is false until the lag
+// has been measured in the current role.
+func (a *Agent) observedDB() (state _DBState, lag units.Base2Bytes, lagObserved bool) {
+	a.pgStateLock.RLock()
+	defer a.pgStateLock.RUnlock()
+
+	state = a.lastDBState
+	if !a.roleObserved {
+		state = _DBStateUnknown
+	}
+
+	return state, a.lastLag, a.lagObserved
+}
+
+// lag returns the most recently observed lag.
+func (a *Agent) lag() units.Base2Bytes {
+	a.pgStateLock.RLock()
+	defer a.pgStateLock.RUnlock()
+
+	return a.lastLag
+}
+
+// consulHealth adapts the agent's Status for the Consul registrar.
+func (a *Agent) consulHealth() consul.Health {
+	s := a.Status()
+
+	h := consul.Health{
+		Ready:    s.Ready,
+		LagBytes: units.Base2Bytes(s.LagBytes),
+	}
+
+	if s.Role != _DBStateUnknown.String() {
+		h.Role = s.Role
+	}
+
+	if s.LastScan != nil {
+		h.LastScan = *s.LastScan
+	}
+
+	return h
+}
@@ -20,9 +20,30 @@ import "github.com/bschofield/pg_prefaulter/pg"
 // [comparable](https://golang.org/ref/spec#Comparison_operators) struct
 // suitable for use as a lookup key.  These values are immutable and map 1:1
 // with the string inputs read from the pg_waldump(1) scanning utility.
+//
+// When SLRU is not pg.SLRUNone the key identifies a page of an SLRU (e.g. the
+// commit log) instead of a relation.  Block is then the SLRU's page number and
+// the remaining fields are zero.
 type IOCacheKey struct {
 	Tablespace pg.OID
 	Database   pg.OID
 	Relation   pg.OID
 	Block      pg.HeapBlockNumber
+	SLRU       pg.SLRU
+}
+
+// Less orders IOCacheKeys by file and then by block.
+func (k IOCacheKey) Less(other IOCacheKey) bool {
+	switch {
+	case k.SLRU != other.SLRU:
+		return k.SLRU < other.SLRU
+	case k.Tablespace != other.Tablespace:
+		return k.Tablespace < other.Tablespace
+	case k.Database != other.Database:
+		return k.Database < other.Database
+	case k.Relation != other.Relation:
+		return k.Relation < other.Relation
+	default:
+		return k.Block < other.Block
+	}
 }
@@ -0,0 +1,59 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+)
+
+// tailWAL prefaults the blocks referenced by the records landing in the WAL
+// segment being written every WALTailInterval.  Only a follower within the WAL
+// readahead of its upstream is tailed: a follower further behind has WAL
+// already written to prefault first, and a primary has nothing to prefault.
+func (a *Agent) tailWAL() {
+	ticker := time.NewTicker(a.cfg.WALTailInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !a.shouldTail(time.Now()) {
+			continue
+		}
+
+		if err := a.walCache.TailWAL(a.shutdownCtx); err != nil {
+			a.log.Debug().Err(err).Msg("unable to tail the WAL segment being written")
+		}
+	}
+}
+
+// shouldTail returns true if the WAL segment being written should be tailed at
+// now.
+func (a *Agent) shouldTail(now time.Time) bool {
+	if a.isDraining() {
+		return false
+	}
+
+	if a.maintenance != nil && a.maintenance.Open(now) && a.maintenance.IOPS() == 0 {
+		return false
+	}
+
+	state, lag, lagObserved := a.observedDB()
+
+	return state == _DBStateFollower && lagObserved && lag <= a.walCache.ReadaheadBytes()
+}
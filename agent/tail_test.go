@@ -0,0 +1,79 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/walcache"
+)
+
+func TestShouldTail(t *testing.T) {
+	tests := []struct {
+		state    _DBState
+		lag      units.Base2Bytes
+		measured bool
+		draining bool
+		tail     bool
+	}{
+		{ // 0: a follower within the readahead
+			state:    _DBStateFollower,
+			lag:      16 * units.MiB,
+			measured: true,
+			tail:     true,
+		},
+		{ // 1: a follower further behind
+			state:    _DBStateFollower,
+			lag:      64 * units.MiB,
+			measured: true,
+		},
+		{ // 2: a follower whose lag hasn't been measured
+			state: _DBStateFollower,
+		},
+		{ // 3: a primary
+			state:    _DBStatePrimary,
+			measured: true,
+		},
+		{ // 4: the role hasn't been observed
+			state: _DBStateUnknown,
+		},
+		{ // 5: draining
+			state:    _DBStateFollower,
+			measured: true,
+			draining: true,
+		},
+	}
+
+	for n, test := range tests {
+		a := &Agent{walCache: &walcache.WALCache{}}
+		if err := a.walCache.SetReadahead(32*units.MiB, 0, units.GiB); err != nil {
+			t.Fatal(err)
+		}
+		if test.state != _DBStateUnknown {
+			a.recordRole(test.state)
+		}
+		if test.measured {
+			a.recordLag(test.lag)
+		}
+		if test.draining {
+			a.draining = 1
+		}
+
+		if tail := a.shouldTail(time.Now()); tail != test.tail {
+			t.Errorf("%d: tail %v, want %v", n, tail, test.tail)
+		}
+	}
+}
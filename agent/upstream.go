@@ -0,0 +1,191 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// setUpstream (re)creates the connection pool used to query this follower's
+// upstream.  nodeName is the application_name this follower uses when
+// connecting to its upstream and may be empty if it is unknown.  An empty
+// conninfo removes the upstream.  The pool is only recreated when the upstream
+// changes, in which case changed is true.
+func (a *Agent) setUpstream(nodeName, conninfo string) (changed bool, err error) {
+	a.pgStateLock.Lock()
+	defer a.pgStateLock.Unlock()
+
+	if a.upstreamConninfo == conninfo && a.upstreamNodeName == nodeName {
+		return false, nil
+	}
+
+	if a.upstreamPool != nil {
+		a.upstreamPool.Close()
+		a.upstreamPool = nil
+	}
+	a.upstreamConninfo = ""
+	a.upstreamNodeName = nodeName
+	a.upstreamRole = _DBStateUnknown
+	a.upstreamTranslations = nil
+
+	if conninfo == "" {
+		return true, nil
+	}
+
+	connConfig, err := pgx.ParseConnectionString(conninfo)
+	if err != nil {
+		return true, errors.Wrap(err, "unable to parse upstream conninfo")
+	}
+
+	poolConfig := *a.poolConfig
+	poolConfig.ConnConfig = a.poolConfig.ConnConfig.Merge(connConfig)
+	pool, err := pgx.NewConnPool(poolConfig)
+	if err != nil {
+		return true, errors.Wrap(err, "unable to connect to upstream")
+	}
+
+	a.log.Debug().Str("upstream-host", connConfig.Host).Msg("connected to upstream")
+
+	a.upstreamPool = pool
+	a.upstreamConninfo = conninfo
+
+	return true, nil
+}
+
+// upstreamQueries returns the queries for the server_version_num of the
+// upstream pool connects to, which may differ from this follower's.
+func (a *Agent) upstreamQueries(pool *pgx.ConnPool) (*pg.WALTranslations, error) {
+	a.pgStateLock.RLock()
+	translations := a.upstreamTranslations
+	a.pgStateLock.RUnlock()
+	if translations != nil {
+		return translations, nil
+	}
+
+	var serverVersion int64
+	const sql = `SELECT current_setting('server_version_num')::INT8`
+	if err := pool.QueryRowEx(a.shutdownCtx, sql, nil).Scan(&serverVersion); err != nil {
+		return nil, errors.Wrap(err, "unable to query the upstream's version")
+	}
+
+	t := pg.Translate(uint64(serverVersion))
+	t.Override(a.cfg.QueryOverrides)
+
+	a.pgStateLock.Lock()
+	if a.upstreamPool == pool {
+		a.upstreamTranslations = &t
+	}
+	a.pgStateLock.Unlock()
+
+	return &t, nil
+}
+
+// discoverWALReceiverUpstream uses pg_stat_wal_receiver to find the upstream
+// this follower is streaming from.  sender_host and sender_port were added in
+// PostgreSQL 11, older followers only learn of their upstream via repmgr.
+func (a *Agent) discoverWALReceiverUpstream() error {
+	const minSenderHostVersion = 110000
+	if a.walTranslations.Major < minSenderHostVersion {
+		return nil
+	}
+
+	const sql = `SELECT sender_host, sender_port FROM pg_catalog.pg_stat_wal_receiver WHERE status = 'streaming'`
+
+	var host *string
+	var port *int32
+	switch err := a.pool.QueryRowEx(a.shutdownCtx, sql, nil).Scan(&host, &port); {
+	case err == pgx.ErrNoRows:
+		// Not streaming (e.g. restoring from the archive).  Keep the last known
+		// upstream until the WAL receiver reconnects.
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "unable to query pg_stat_wal_receiver")
+	case host == nil || port == nil:
+		return nil
+	}
+
+	changed, err := a.setUpstream("", fmt.Sprintf("host=%s port=%d", *host, *port))
+	if err != nil {
+		return errors.Wrap(err, "unable to configure WAL receiver upstream")
+	}
+
+	if changed {
+		a.log.Info().Str("upstream-host", *host).Int32("upstream-port", *port).
+			Msg("using WAL receiver upstream for lag queries")
+	}
+
+	return nil
+}
+
+// upstreamLagQuery returns the query used to determine this follower's lag
+// given the role of its upstream.  A cascading upstream's pg_stat_replication
+// is relative to what the upstream itself has received, not the primary's
+// flush LSN, so lag is computed against the upstream's received LSN instead.
+// The same is true when the name this follower uses to identify itself to the
+// upstream is unknown.
+func upstreamLagQuery(upstreamRole _DBState, nodeName string) _QueryLag {
+	if upstreamRole == _DBStateFollower || nodeName == "" {
+		return _QueryLagCascade
+	}
+
+	return _QueryLagUpstream
+}
+
+// queryUpstreamLag determines the role of this follower's upstream and
+// returns this follower's visibility lag relative to it.
+func (a *Agent) queryUpstreamLag() (units.Base2Bytes, error) {
+	a.pgStateLock.RLock()
+	pool := a.upstreamPool
+	nodeName := a.upstreamNodeName
+	prevRole := a.upstreamRole
+	a.pgStateLock.RUnlock()
+	if pool == nil {
+		return 0, errors.New("no upstream configured")
+	}
+
+	var inRecovery bool
+	var upstreamLSN *string
+	if err := pool.QueryRowEx(a.shutdownCtx, a.walTranslations.Queries.UpstreamPosition, nil).Scan(&inRecovery, &upstreamLSN); err != nil {
+		return 0, errors.Wrap(err, "unable to query upstream position")
+	}
+
+	role := _DBStatePrimary
+	if inRecovery {
+		role = _DBStateFollower
+	}
+
+	if role != prevRole {
+		a.pgStateLock.Lock()
+		a.upstreamRole = role
+		a.pgStateLock.Unlock()
+
+		a.log.Info().Str("upstream-role", role.String()).Bool("cascading", role == _DBStateFollower).
+			Msg("detected upstream role")
+	}
+
+	switch lagQuery := upstreamLagQuery(role, nodeName); lagQuery {
+	case _QueryLagCascade:
+		if upstreamLSN == nil {
+			return 0, errors.New("upstream has not received any WAL")
+		}
+		return a.queryLag(lagQuery, *upstreamLSN)
+	default:
+		return a.queryLag(lagQuery)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import "testing"
+
+func Test_upstreamLagQuery(t *testing.T) {
+	tests := []struct {
+		role     _DBState
+		nodeName string
+		out      _QueryLag
+	}{
+		{role: _DBStatePrimary, nodeName: "node2", out: _QueryLagUpstream},
+		{role: _DBStateFollower, nodeName: "node2", out: _QueryLagCascade},
+		{role: _DBStatePrimary, nodeName: "", out: _QueryLagCascade},
+		{role: _DBStateFollower, nodeName: "", out: _QueryLagCascade},
+	}
+
+	for n, test := range tests {
+		if got := upstreamLagQuery(test.role, test.nodeName); got != test.out {
+			t.Errorf("%d: got %v, want %v", n, got, test.out)
+		}
+	}
+}
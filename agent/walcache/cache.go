@@ -21,22 +21,28 @@ import (
 	"io"
 	"math"
 	"os"
-	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/alecthomas/units"
 	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/archive"
+	"github.com/bschofield/pg_prefaulter/agent/faults"
+	"github.com/bschofield/pg_prefaulter/agent/indexcache"
 	"github.com/bschofield/pg_prefaulter/agent/iocache"
+	"github.com/bschofield/pg_prefaulter/agent/stallhist"
 	"github.com/bschofield/pg_prefaulter/agent/structs"
 	"github.com/bschofield/pg_prefaulter/config"
 	"github.com/bschofield/pg_prefaulter/lib"
 	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/jackc/pgx"
 	"github.com/pkg/errors"
-	log "github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 )
 
 // Input to parse: rel 1663/16394/1249 blk 29
@@ -52,12 +58,98 @@ var pgWalDumpRE = regexp.MustCompile(`rel ([\d]+)/([\d]+)/([\d]+) (?:fork [^\s]+
 // [cur:C4/70, xid:450806558, rmid:10(Heap), len/tot_len:737/769, info:0, prev:C4/20] insert: s/d/r:1663/16385/16431 blk/off:32400985/3 header: t_infomask2 12 t_infomask 2051 t_hoff 32
 var waldumpRE = regexp.MustCompile(`s/d/r:([\d]+)/([\d]+)/([\d]+) (?:tid |blk/off:)([\d]+)`)
 
+// XLOG_SWITCH records end a segment early.  The remainder of the segment is
+// zero padding.
+//
+// rmgr: XLOG        len (rec/tot):     24/    24, tx:          0, lsn: 0/03000140, prev 0/03000108, desc: SWITCH
+// [cur:0/3000140, xid:0, rmid:0(XLOG), len/tot_len:0/24, info:64, prev:0/3000108] xlog switch
+var (
+	pgWalDumpSwitchRE = regexp.MustCompile(`lsn: ([0-9A-F]+/[0-9A-F]+), .*desc: SWITCH`)
+	waldumpSwitchRE   = regexp.MustCompile(`\[cur:([0-9A-F]+/[0-9A-F]+),.*\] xlog switch`)
+)
+
+// Replaying a commit or abort record sets the status of the transaction and
+// its subtransactions in the commit log (pg_xact).  When
+// track_commit_timestamp is on, replaying a commit record also records the
+// commit timestamp of the transaction and its subtransactions in pg_commit_ts.
+//
+// rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync
+// rmgr: Transaction len (rec/tot):     46/    46, tx:       1002, lsn: 0/03000A10, prev 0/030009D8, desc: ABORT 2017-09-30 17:24:02.108724 UTC; subxacts: 1003 1004
+// [cur:C4/1F0, xid:450806559, rmid:1(Transaction), len/tot_len:12/44, info:0, prev:C4/1A0] commit: 2017-09-30 17:23:38.416563 UTC
+var (
+	pgWalDumpXactRE = regexp.MustCompile(`tx:\s*(\d+), lsn: [0-9A-F]+/[0-9A-F]+, prev [0-9A-F]+/[0-9A-F]+, desc: (COMMIT|ABORT) `)
+	waldumpXactRE   = regexp.MustCompile(`xid:(\d+), rmid:1\(Transaction\),.*\] (commit|abort):`)
+	subxactsRE      = regexp.MustCompile(`subxacts:((?: \d+)+)`)
+)
+
+// Replaying a multixact creation record writes the multixact's starting offset
+// to pg_multixact/offsets and its members to pg_multixact/members.  Only
+// pg_waldump(1)'s output is decoded.
+//
+// rmgr: MultiXact   len (rec/tot):     54/    54, tx:        746, lsn: 0/01663A48, prev 0/01663A10, desc: CREATE_ID 1 offset 1 nmembers 2: 745 (keysh) 746 (keysh)
+var pgWalDumpMultiXactRE = regexp.MustCompile(`desc: CREATE_ID (\d+) offset (\d+) nmembers (\d+)`)
+
+// A PARAMETER_CHANGE record is written when the primary restarts with a
+// different track_commit_timestamp.  Only pg_waldump(1)'s output is decoded.
+//
+// rmgr: XLOG        len (rec/tot):     54/    54, tx:          0, lsn: 0/03000028, prev 0/02000108, desc: PARAMETER_CHANGE max_connections=100 max_worker_processes=8 max_wal_senders=10 max_prepared_xacts=0 max_locks_per_xact=64 wal_level=replica wal_log_hints=off track_commit_timestamp=on
+var pgWalDumpParameterChangeRE = regexp.MustCompile(`desc: PARAMETER_CHANGE .*track_commit_timestamp=(on|off)`)
+
+// VACUUM FULL, CLUSTER, and TRUNCATE give a relation a new relfilenode and the
+// commit record drops the files of the old one.  VACUUM truncates the empty
+// pages at the end of a relation.  The cached pages and file handles of
+// dropped and truncated relations are invalidated.  Only pg_waldump(1)'s
+// output is decoded.
+//
+// rmgr: Storage     len (rec/tot):     46/    46, tx:          0, lsn: 0/0301A2D8, prev 0/0301A298, desc: TRUNCATE base/16384/16385 to 0 blocks flags 7
+// rmgr: Transaction len (rec/tot):    130/   130, tx:        997, lsn: 0/0301C8E0, prev 0/0301C8A0, desc: COMMIT 2017-09-30 17:25:11.102934 UTC; rels: base/16384/16385 base/16384/16388; inval msgs: catcache 50 relcache 16385
+var (
+	pgWalDumpTruncateRE    = regexp.MustCompile(`desc: TRUNCATE (\S+) to \d+ blocks`)
+	pgWalDumpDroppedRelsRE = regexp.MustCompile(`; rels:((?: [^;\s]+)+)`)
+)
+
+// pg_waldump(1) reports the zero padding after an XLOG_SWITCH as an invalid
+// record when it reaches the end of the available WAL.  PostgreSQL 16 reworded
+// the report:
+//
+// pg_waldump: FATAL:  error in WAL record at 0/3000140: invalid record length at 0/3000158: wanted 24, got 0
+// pg_waldump: error: error in WAL record at 0/3000140: invalid record length at 0/3000158: expected at least 24, got 0
+var (
+	switchPaddingRE     = regexp.MustCompile(`invalid record length at [0-9A-F]+/[0-9A-F]+: wanted \d+, got 0|could not find file`)
+	pg16SwitchPaddingRE = regexp.MustCompile(`invalid record length at [0-9A-F]+/[0-9A-F]+: expected at least \d+, got 0|could not find file`)
+)
+
+// The LSN of every record decoded by pg_waldump(1) is tracked so that a segment
+// that is still being written can be decoded again from where the previous
+// decode stopped.
+//
+// rmgr: Heap        len (rec/tot):     54/  1222, tx:        995, lsn: 0/03000080, prev 0/03000060, desc: INSERT off 4, blkref #0: rel 1664/0/1262 blk 0 FPW
+var pgWalDumpLSNRE = regexp.MustCompile(`, lsn: ([0-9A-F]+/[0-9A-F]+), prev `)
+
+// minExpectedAtLeastVersion is the first version of PostgreSQL whose
+// pg_waldump(1) reports the end of the WAL with pg16SwitchPaddingRE.
+const minExpectedAtLeastVersion = 160000 // PostgreSQL version 16
+
+// switchPadding returns the pattern matching how the pg_waldump(1) of the
+// running version of PostgreSQL reports the padding after an XLOG_SWITCH.
+func (wc *WALCache) switchPadding() *regexp.Regexp {
+	if wc.walTranslations.Major >= minExpectedAtLeastVersion {
+		return pg16SwitchPaddingRE
+	}
+
+	return switchPaddingRE
+}
+
 // ConnContextAcquirer is an helper interface passed in by the agent and used to
 // defeat cyclic import restrictions.
 type ConnContextAcquirer interface {
 	// AcquireConnContext() MUST return a Context that is used to signal when
 	// connections to PostgreSQL must be closed.
 	AcquireConnContext() context.Context
+
+	// AcquirePool() returns the current connection pool to PostgreSQL, which
+	// is nil while the agent isn't connected.
+	AcquirePool() *pgx.ConnPool
 }
 
 // WALCache is a read-through cache to:
@@ -69,21 +161,120 @@ type ConnContextAcquirer interface {
 type WALCache struct {
 	pgConnCtxAcquirer ConnContextAcquirer
 	shutdownCtx       context.Context
+	log               zerolog.Logger
 	wg                sync.WaitGroup
 	cfg               *config.WALCacheConfig
 	walTranslations   *pg.WALTranslations
 
 	purgeLock sync.Mutex
-	c         gcache.Cache
+	c         *lib.TunableCache
 	ioCache   *iocache.IOCache
 
 	inFlightLock     sync.RWMutex
 	inFlightCond     *sync.Cond
 	inFlightWALFiles map[pg.WALFilename]struct{}
 
-	re *regexp.Regexp
+	// fetcher is used to retrieve WAL files that are not present in pg_wal
+	// (e.g. during restore_command-driven recovery).  fetcher is nil when
+	// archive fetching is disabled.
+	fetcher archive.Fetcher
+
+	// decodeQueue feeds the WAL decoder worker goroutines, each of which runs
+	// one pg_waldump(1) per run of consecutive segments.  decodeBatchSize is
+	// the maximum number of segments in a run.
+	decodeQueue     *decodeQueue
+	decodeBatchSize uint
+
+	// decoders limits the number of pg_waldump(1) processes run at once.  A
+	// slot is held for the life of each process.  decoders is nil when
+	// unlimited.
+	decoders chan struct{}
+
+	// feedOrder has concurrently decoded WAL files prefaulted in WAL order.
+	feedOrder feedOrder
+
+	// switched contains the WAL files known to end in an XLOG_SWITCH record.
+	switched gcache.Cache
+
+	// partial maps the WAL files that were only partially decoded to the LSN
+	// their next decode resumes from.
+	partial gcache.Cache
+
+	// tail is how far the WAL segment being written has been decoded by
+	// TailWAL.
+	tail walTail
+
+	re       *regexp.Regexp
+	switchRE *regexp.Regexp
+	xactRE   *regexp.Regexp
+
+	// lsnRE is nil when partially decoded WAL files can't be resumed.
+	lsnRE *regexp.Regexp
+
+	// commitTimes is nil unless the commit times of the WAL files decoded are
+	// recorded for point-in-time recovery.
+	commitTimes *_CommitTimes
+
+	// multiXactRE, parameterChangeRE, truncateRE, and droppedRelsRE are nil
+	// when multixact, parameter change, truncate, and dropped relations can't be
+	// decoded.
+	multiXactRE       *regexp.Regexp
+	parameterChangeRE *regexp.Regexp
+	truncateRE        *regexp.Regexp
+	droppedRelsRE     *regexp.Regexp
+
+	// trackCommitTs is non-zero when commit records also update pg_commit_ts.
+	trackCommitTs uint32
+
+	// blockSize is the size of a commit log page.
+	blockSize units.Base2Bytes
+
+	// stallHistory is told which relations each WAL file references.
+	// stallHistory is nil when stall-driven prioritization is disabled.
+	stallHistory *stallhist.History
+
+	// indexCache is told which relations each WAL file references.  indexCache
+	// is nil when index and TOAST prefaulting are disabled.
+	indexCache *indexcache.IndexCache
+
+	// faults is nil unless fault injection is enabled.
+	faults *faults.Injector
+
+	// readaheadBytes starts at KeyWALReadahead, can be changed at runtime, and
+	// is accessed atomically.
+	readaheadBytes int64
+
+	// readaheadMin and readaheadMax bound readaheadBytes and are protected
+	// by readaheadLock.
+	readaheadLock sync.Mutex
+	readaheadMin  units.Base2Bytes
+	readaheadMax  units.Base2Bytes
+
+	// quarantine holds the WAL files whose decode timed out.
+	quarantine *quarantine
+
+	// failures is the number of decodes in a row that failed to prefault their
+	// WAL files and is accessed atomically.
+	failures uint64
+
+	// closed is non-zero once the WALCache stops accepting WAL files and is
+	// accessed atomically.
+	closed uint32
+
+	// replayPosition holds the pg.WALFilename PostgreSQL was last seen
+	// replaying.  Queued WAL files older than it are skipped once a decode
+	// exceeds its SegmentBudget.
+	replayPosition atomic.Value
+
+	// walDumpPath holds the path of pg_waldump(1).  It is empty until
+	// pg_waldump(1) is found if PG_VERSION couldn't be read at startup.
+	walDumpPath atomic.Value
 }
 
+// pipelineDepth bounds the number of lines and IO requests buffered between
+// the stages of a WAL file's decode pipeline.
+const pipelineDepth = 1024
+
 var (
 	numConcurrentWALLock sync.Mutex
 	numConcurrentWALs    int64
@@ -91,88 +282,118 @@ var (
 
 func New(pgConnCtxAcquirer ConnContextAcquirer, shutdownCtx context.Context,
 	cfg *config.Config,
-	ioCache *iocache.IOCache, walTranslations *pg.WALTranslations) (*WALCache, error) {
-	walWorkers := pg.NumOldLSNs * int(math.Ceil(float64(cfg.ReadaheadBytes)/float64(pg.WALSegmentSize)))
+	ioCache *iocache.IOCache, walTranslations *pg.WALTranslations,
+	stallHistory *stallhist.History, indexCache *indexcache.IndexCache) (*WALCache, error) {
+	walWorkers := pg.NumOldLSNs * int(math.Ceil(float64(cfg.ReadaheadBytes)/float64(cfg.SegmentSize)))
 
 	wc := &WALCache{
 		pgConnCtxAcquirer: pgConnCtxAcquirer,
 		shutdownCtx:       shutdownCtx,
+		log:               *lib.Logger(shutdownCtx),
 		cfg:               &cfg.WALCacheConfig,
 		walTranslations:   walTranslations,
 
 		inFlightWALFiles: make(map[pg.WALFilename]struct{}, walWorkers),
 		ioCache:          ioCache,
+		blockSize:        cfg.FHCacheConfig.BlockSize,
+		stallHistory:     stallHistory,
+		indexCache:       indexCache,
+		faults:           faults.New(cfg.FaultConfig),
+		readaheadBytes:   int64(cfg.ReadaheadBytes),
+		readaheadMin:     cfg.ReadaheadMinBytes,
+		readaheadMax:     cfg.ReadaheadMaxBytes,
+		quarantine:       newQuarantine(),
 	}
 	wc.inFlightCond = sync.NewCond(&wc.inFlightLock)
+	wc.walDumpPath.Store(cfg.WALCacheConfig.WalDumpPath)
+
+	fetcher, err := archive.New(&cfg.WALCacheConfig.Archive, pgConnCtxAcquirer)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to initialize the WAL archive fetcher")
+	}
+	if fetcher != nil {
+		if err := os.MkdirAll(cfg.WALCacheConfig.Archive.ScratchDir, 0700); err != nil {
+			return nil, errors.Wrap(err, "unable to create the WAL archive scratch directory")
+		}
+
+		wc.log.Info().Str("fetcher", fetcher.Name()).
+			Str("scratch-dir", cfg.WALCacheConfig.Archive.ScratchDir).
+			Msg("fetching missing WAL files from the archive")
+	}
+	wc.fetcher = fetcher
+
+	if len(cfg.WALCacheConfig.WalDumpWrapper)+len(cfg.WALCacheConfig.WalDumpArgs)+len(cfg.WALCacheConfig.WalDumpEnv) > 0 {
+		wc.log.Info().Str("pg_waldump-path", cfg.WALCacheConfig.WalDumpPath).
+			Strs("wrapper", cfg.WALCacheConfig.WalDumpWrapper).
+			Strs("args", cfg.WALCacheConfig.WalDumpArgs).
+			Strs("env", cfg.WALCacheConfig.WalDumpEnv).
+			Msg("customized pg_waldump(1) invocation")
+	}
 
 	switch cfg.WALCacheConfig.Mode {
 	case config.WALModeXLog:
 		wc.re = waldumpRE
+		wc.switchRE = waldumpSwitchRE
+		wc.xactRE = waldumpXactRE
 	case config.WALModePG:
 		wc.re = pgWalDumpRE
+		wc.switchRE = pgWalDumpSwitchRE
+		wc.xactRE = pgWalDumpXactRE
+		wc.lsnRE = pgWalDumpLSNRE
+		wc.multiXactRE = pgWalDumpMultiXactRE
+		wc.parameterChangeRE = pgWalDumpParameterChangeRE
+		wc.truncateRE = pgWalDumpTruncateRE
+		wc.droppedRelsRE = pgWalDumpDroppedRelsRE
+		if cfg.PGMode == "pitr" {
+			wc.commitTimes = newCommitTimes()
+		}
 	default:
 		panic(fmt.Sprintf("unsupported WALConfig.mode: %v", cfg.WALCacheConfig.Mode))
 	}
 
-	walFilePrefaultWorkQueue := make(chan pg.WALFilename)
-	for walWorker := 0; walWorker < walWorkers; walWorker++ {
-		wc.wg.Add(1)
-		go func(threadID int) {
-			defer func() {
-				wc.wg.Done()
-			}()
-
-			for {
-				select {
-				case <-wc.shutdownCtx.Done():
-					return
-				case walFile, ok := <-walFilePrefaultWorkQueue:
-					if !ok {
-						return
-					}
-
-					numConcurrentWALLock.Lock()
-					numConcurrentWALs++
-					numConcurrentWALLock.Unlock()
+	wc.decodeBatchSize = cfg.WALCacheConfig.DecodeBatchSize
+	if wc.decodeBatchSize == 0 || cfg.WALCacheConfig.Mode != config.WALModePG {
+		// Only pg_waldump(1) decodes a range of segments
+		wc.decodeBatchSize = 1
+	}
 
-					if err := wc.prefaultWALFile(walFile); err != nil {
-						// If we had a problem prefaulting in the WAL file, for whatever
-						// reason, attempt to remove it from the cache.
-						log.Warn().Err(err).Msg("prefault failed")
-						wc.c.Remove(walFile)
-					}
+	if maxDecoders := cfg.WALCacheConfig.MaxDecoders; maxDecoders > 0 {
+		wc.decoders = make(chan struct{}, maxDecoders)
+	}
 
-					numConcurrentWALLock.Lock()
-					numConcurrentWALs--
-					numConcurrentWALLock.Unlock()
+	decodeConcurrency := walWorkers
+	if wc.decoders != nil && cap(wc.decoders) < decodeConcurrency {
+		decodeConcurrency = cap(wc.decoders)
+	}
+	wc.decodeQueue = newDecodeQueue(decodeConcurrency)
+	go func() {
+		<-wc.shutdownCtx.Done()
+		wc.decodeQueue.close()
+	}()
 
-					// Inserts into wc.inFlightWALFile happen in FaultWALFile()
-					wc.inFlightLock.Lock()
-					delete(wc.inFlightWALFiles, walFile)
-					wc.inFlightCond.Broadcast()
-					wc.inFlightLock.Unlock()
-				}
-			}
-		}(walWorker)
+	for walWorker := 0; walWorker < walWorkers; walWorker++ {
+		wc.wg.Add(1)
+		go wc.superviseDecoder(walWorker)
 	}
-	log.Info().Int("wal-worker-threads", walWorkers).Msg("started WAL worker threads")
+	wc.log.Info().Int("wal-worker-threads", walWorkers).Uint("wal-decode-batch-size", wc.decodeBatchSize).
+		Int("wal-max-decoders", cap(wc.decoders)).Msg("started WAL worker threads")
 
 	// Deliberately use a scan-intolerant cache because the inputs are going to be
 	// ordered.  When the cache is queried, return a faux result and actually
 	// perform the real work in a background goroutine.
-	wc.c = gcache.New(2 * int(walWorkers)).
-		LRU().
-		LoaderFunc(func(keyRaw interface{}) (interface{}, error) {
-			walFilename := keyRaw.(pg.WALFilename)
-
-			select {
-			case <-wc.shutdownCtx.Done():
-			case walFilePrefaultWorkQueue <- walFilename:
-			}
+	wc.c = lib.NewTunableCache(2*int(walWorkers), 0, func(size int) *gcache.CacheBuilder {
+		return gcache.New(size).
+			LRU().
+			LoaderFunc(func(keyRaw interface{}) (interface{}, error) {
+				walFilename := keyRaw.(pg.WALFilename)
+				wc.decodeQueue.push(walFilename)
+
+				return true, nil
+			})
+	}, nil)
 
-			return true, nil
-		}).
-		Build()
+	wc.switched = gcache.New(2 * int(walWorkers)).LRU().Build()
+	wc.partial = gcache.New(2 * int(walWorkers)).LRU().Build()
 
 	go lib.LogCacheStats(wc.shutdownCtx, wc.c, "walcache-stats")
 
@@ -185,8 +406,13 @@ func (wc *WALCache) Get(k interface{}) (interface{}, error) {
 }
 
 // GetIFPresent forwards to gcache.Cache's GetIFPresent() if the given
-// WALFilename is not already in process.
+// WALFilename is not already in process or quarantined and the WALCache hasn't
+// been closed.
 func (wc *WALCache) FaultWALFile(walFilename pg.WALFilename) (bool, error) {
+	if atomic.LoadUint32(&wc.closed) != 0 || wc.quarantine.held(walFilename) {
+		return false, nil
+	}
+
 	wc.inFlightLock.Lock()
 	if _, found := wc.inFlightWALFiles[walFilename]; found {
 		wc.inFlightLock.Unlock()
@@ -218,6 +444,20 @@ func (wc *WALCache) InProcess(walFilename pg.WALFilename) bool {
 	return (err != gcache.KeyNotFoundError)
 }
 
+// NumInFlight returns the number of WAL files currently being prefaulted.
+func (wc *WALCache) NumInFlight() int {
+	wc.inFlightLock.RLock()
+	defer wc.inFlightLock.RUnlock()
+
+	return len(wc.inFlightWALFiles)
+}
+
+// ConsecutiveFailures returns the number of decodes in a row that failed to
+// prefault their WAL files.
+func (wc *WALCache) ConsecutiveFailures() uint64 {
+	return atomic.LoadUint64(&wc.failures)
+}
+
 // Wait blocks until the WAL File is no longer in flight.
 func (wc *WALCache) WaitWALFile(walFilename pg.WALFilename) error {
 	wc.inFlightLock.Lock()
@@ -234,18 +474,193 @@ func (wc *WALCache) WaitWALFile(walFilename pg.WALFilename) error {
 	return fmt.Errorf("%d spurious wakeups achieved while waiting for %+q", maxWakeups, walFilename)
 }
 
+// Size returns the number of WAL files remembered by the WALCache.
+func (wc *WALCache) Size() int {
+	return wc.c.Size()
+}
+
+// Resize changes the number of WAL files remembered by the WALCache without
+// purging it.  WAL files forgotten are decoded again if they are requested.
+func (wc *WALCache) Resize(size int) error {
+	return wc.c.Resize(size)
+}
+
+// Statistics returns the WALCache's number of entries and counters.
+func (wc *WALCache) Statistics() lib.CacheStatistics {
+	return wc.c.Statistics()
+}
+
 // Purge purges the WALCache of its cache (and all downstream caches)
 func (wc *WALCache) Purge() {
 	wc.purgeLock.Lock()
 	defer wc.purgeLock.Unlock()
 
 	wc.c.Purge()
+	wc.switched.Purge()
+	wc.partial.Purge()
 	wc.ioCache.Purge()
 }
 
+// Switched returns true if walFilename is known to end in an XLOG_SWITCH record
+// and contains nothing but padding after the switch.
+func (wc *WALCache) Switched(walFilename pg.WALFilename) bool {
+	_, err := wc.switched.GetIFPresent(walFilename)
+	return err == nil
+}
+
+// SetReplayPosition records the WAL file PostgreSQL is replaying.
+func (wc *WALCache) SetReplayPosition(walFilename pg.WALFilename) {
+	wc.replayPosition.Store(walFilename)
+}
+
+// ReplayPosition returns the WAL file PostgreSQL was last seen replaying, or an
+// empty WALFilename if it isn't known yet.
+func (wc *WALCache) ReplayPosition() pg.WALFilename {
+	walFilename, _ := wc.replayPosition.Load().(pg.WALFilename)
+	return walFilename
+}
+
+// addRelPaths adds the relations in relPaths, a space separated list of
+// relation paths, to rels.
+func (wc *WALCache) addRelPaths(rels map[pg.RelFileNode]struct{}, relPaths []byte) {
+	for _, relPath := range strings.Fields(string(relPaths)) {
+		rfn, err := pg.ParseRelPath(relPath)
+		if err != nil {
+			wc.log.Debug().Err(err).Msg("unable to parse relation path")
+			continue
+		}
+		rels[rfn] = struct{}{}
+	}
+}
+
+// markSwitched records the WAL file containing the XLOG_SWITCH record at
+// lsnRaw.
+func (wc *WALCache) markSwitched(timelineID pg.TimelineID, lsnRaw []byte) {
+	lsn, err := pg.ParseLSN(string(lsnRaw))
+	if err != nil {
+		wc.log.Debug().Err(err).Str("input", string(lsnRaw)).Msg("unable to parse XLOG_SWITCH LSN")
+		return
+	}
+
+	// The switch record starts inside of the segment it terminates, so the
+	// record's LSN is never on a segment boundary.
+	walFile := lsn.AddBytes(1).WALFilename(timelineID)
+	if err := wc.switched.Set(walFile, true); err != nil {
+		wc.log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to record XLOG_SWITCH")
+		return
+	}
+
+	wc.log.Debug().Str("walfile", string(walFile)).Str("lsn", lsn.String()).Msg("found XLOG_SWITCH")
+}
+
+// resumeLSN returns the LSN the next decode of walFilename resumes from, if
+// walFilename was only partially decoded.
+func (wc *WALCache) resumeLSN(walFilename pg.WALFilename) (pg.LSN, bool) {
+	lsnRaw, err := wc.partial.GetIFPresent(walFilename)
+	if err != nil {
+		return pg.InvalidLSN, false
+	}
+
+	return lsnRaw.(pg.LSN), true
+}
+
+// markPartial records how far walFiles were decoded when pg_waldump(1) stopped
+// early, e.g. on the truncated record at the end of a segment the walreceiver
+// is still writing.  lastLSN is the LSN of the last record decoded.
+// markPartial returns an error wrapping errPartialDecode if lastLSN is inside
+// of walFiles, otherwise nil.
+func (wc *WALCache) markPartial(timelineID pg.TimelineID, walFiles []pg.WALFilename, lastLSN pg.LSN) error {
+	if lastLSN == pg.InvalidLSN {
+		return nil
+	}
+
+	// A record is never the last byte of a segment, so the byte after the start
+	// of the record is in the same segment and pg_waldump(1) resumes at the
+	// next record from there.
+	resume := lastLSN.AddBytes(1)
+	walFile := resume.WALFilename(timelineID)
+
+	for _, decoded := range walFiles {
+		if decoded != walFile {
+			wc.partial.Remove(decoded)
+			continue
+		}
+
+		if err := wc.partial.Set(walFile, resume); err != nil {
+			wc.log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to record partially decoded WAL file")
+			return nil
+		}
+
+		return errors.Wrapf(errPartialDecode, "decoded %+q up to %s", walFile, waldumpLSN(lastLSN))
+	}
+
+	return nil
+}
+
+// waldumpLSN formats lsn the way PostgreSQL does, e.g. "0/3000140".
+func waldumpLSN(lsn pg.LSN) string {
+	return fmt.Sprintf("%X/%X", uint64(lsn)>>32, uint32(lsn))
+}
+
+// ArchiveEnabled returns true if WAL files missing from the WAL directory are
+// fetched from the archive.
+func (wc *WALCache) ArchiveEnabled() bool {
+	return wc.fetcher != nil
+}
+
+// WalDumpPath returns the path of pg_waldump(1), or an empty string if it has
+// yet to be found.
+func (wc *WALCache) WalDumpPath() string {
+	return wc.walDumpPath.Load().(string)
+}
+
+// SetWalDumpPath sets the path of pg_waldump(1) used by subsequent decodes.
+func (wc *WALCache) SetWalDumpPath(walDumpPath string) {
+	wc.walDumpPath.Store(walDumpPath)
+}
+
 // ReadaheadBytes returns the number of WAL files to read ahead of PostgreSQL.
 func (wc *WALCache) ReadaheadBytes() units.Base2Bytes {
-	return wc.cfg.ReadaheadBytes
+	return units.Base2Bytes(atomic.LoadInt64(&wc.readaheadBytes))
+}
+
+// ReadaheadBounds returns the least and greatest readahead SetReadahead
+// accepts.
+func (wc *WALCache) ReadaheadBounds() (min, max units.Base2Bytes) {
+	wc.readaheadLock.Lock()
+	defer wc.readaheadLock.Unlock()
+
+	return wc.readaheadMin, wc.readaheadMax
+}
+
+// SetReadahead changes the amount of WAL read ahead of PostgreSQL, starting
+// with the next scan, and the bounds it may later be changed within.  The
+// number of WAL workers is sized for the initial readahead and is not changed.
+func (wc *WALCache) SetReadahead(readaheadBytes, min, max units.Base2Bytes) error {
+	switch {
+	case min < 0:
+		return fmt.Errorf("readahead minimum can not be negative (%s)", min)
+	case max > config.MaxReadaheadBytes:
+		return fmt.Errorf("readahead maximum can not exceed %s (%s)", config.MaxReadaheadBytes, max)
+	case min > max:
+		return fmt.Errorf("readahead minimum (%s) can not exceed the maximum (%s)", min, max)
+	case readaheadBytes < min || readaheadBytes > max:
+		return fmt.Errorf("readahead must be between %s and %s (%s)", min, max, readaheadBytes)
+	}
+
+	wc.readaheadLock.Lock()
+	defer wc.readaheadLock.Unlock()
+
+	wc.readaheadMin, wc.readaheadMax = min, max
+	atomic.StoreInt64(&wc.readaheadBytes, int64(readaheadBytes))
+
+	return nil
+}
+
+// Close stops the WALCache from accepting new WAL files.  WAL files that are
+// already being decoded are still prefaulted.
+func (wc *WALCache) Close() {
+	atomic.StoreUint32(&wc.closed, 1)
 }
 
 // Wait blocks until the WALCache finishes shutting down its workers (including
@@ -255,25 +670,92 @@ func (wc *WALCache) Wait() {
 	wc.ioCache.Wait()
 }
 
-// prefaultWALFile shells out to pg_waldump(1) and reads its input.  The input
+// walFilePath returns the absolute path of walFile in the WAL directory.
+func (wc *WALCache) walFilePath(walFile pg.WALFilename) string {
+	return path.Join(wc.cfg.PGDataPath, wc.walTranslations.Directory, string(walFile))
+}
+
+// prefaultWALFiles shells out to pg_waldump(1) and reads its input.  The input
 // from pg_waldump(1) is then turned into IO requests that are picked up and
-// handled by the ioCache.
-func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
+// handled by the ioCache.  walFiles is a run of consecutive WAL files that is
+// decoded by a single pg_waldump(1) invocation.  A run of more than one WAL
+// file must be present in the WAL directory.
+func (wc *WALCache) prefaultWALFiles(walFiles []pg.WALFilename) (err error) {
+	walFile := walFiles[0]
 
-	log.Debug().Str("walfile", string(walFile)).Msg("prefaulting")
+	wc.log.Debug().Str("walfile", string(walFile)).Int("segments", len(walFiles)).Msg("prefaulting")
+
+	if err := wc.faults.Decode(); err != nil {
+		return errors.Wrap(err, "unable to decode WAL")
+	}
 
 	var blocksMatched, linesMatched, linesScanned, walFilesProcessed, waldumpBytes uint64
-	var ioCacheHit, ioCacheMiss uint64
+	var ioCacheHit, ioCacheMiss, switchesMatched, xactsMatched, multiXactsMatched uint64
 
-	walFileAbs := path.Join(wc.cfg.PGDataPath, wc.walTranslations.Directory, string(walFile))
-	_, err = os.Stat(walFileAbs)
+	timelineID, _, err := pg.ParseWalfile(walFile)
 	if err != nil {
-		log.Warn().Err(err).Str("walfile", string(walFile)).Msg("stat")
+		return errors.Wrap(err, "unable to parse WAL filename")
+	}
+
+	// Once walFiles have been decoded to the end there's nothing to resume.
+	defer func() {
+		if err == nil {
+			for _, decoded := range walFiles {
+				wc.partial.Remove(decoded)
+			}
+		}
+	}()
+
+	walFileAbs := wc.walFilePath(walFile)
+	waldumpArgs := []string{"-f", walFileAbs}
+	if len(walFiles) > 1 {
+		waldumpArgs = append(waldumpArgs, wc.walFilePath(walFiles[len(walFiles)-1]))
+	}
+	if resume, found := wc.resumeLSN(walFile); found && wc.lsnRE != nil {
+		wc.log.Debug().Str("walfile", string(walFile)).Str("lsn", waldumpLSN(resume)).Msg("resuming partially decoded WAL file")
+		waldumpArgs = append([]string{"-s", waldumpLSN(resume)}, waldumpArgs...)
+	}
+	_, err = os.Stat(walFileAbs)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err) && wc.fetcher != nil && len(walFiles) == 1:
+		walFileAbs, err = wc.fetchWALFile(walFile)
+		if err != nil {
+			return errors.Wrap(err, "WAL file does not exist locally or in the archive")
+		}
+		defer os.Remove(walFileAbs)
+
+		// Don't follow into the next segment, the scratch directory only ever
+		// contains the segments currently being decoded.
+		waldumpArgs = []string{walFileAbs}
+	default:
+		wc.log.Warn().Err(err).Str("walfile", string(walFile)).Msg("stat")
 		return errors.Wrap(err, "WAL file does not exist")
 	}
 
-	cmd := exec.CommandContext(wc.pgConnCtxAcquirer.AcquireConnContext(),
-		wc.cfg.WalDumpPath, "-f", walFileAbs)
+	ctx := wc.pgConnCtxAcquirer.AcquireConnContext()
+	if err := wc.acquireDecoder(ctx); err != nil {
+		return errors.Wrap(err, "unable to start pg_waldump(1)")
+	}
+	defer wc.releaseDecoder()
+
+	ready, leave := wc.feedOrder.enter(walFile)
+	defer leave()
+	if ready != nil {
+		decoderHeld.Inc()
+	}
+
+	// pg_waldump(1) is killed if it wedges, e.g. on a truncated segment or a
+	// hung NFS mount, and prints nothing for the decode timeout.  Time spent
+	// waiting for a decoder slot, for the decodes of earlier WAL files, or
+	// blocked while the rest of the pipeline catches up, doesn't count against
+	// the timeout.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := newWatchdog(wc.cfg.DecodeTimeout, cancel)
+	defer idle.stop()
+
+	cmd := wc.waldumpCommand(ctx, waldumpArgs...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 
@@ -286,18 +768,151 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 		return errors.Wrapf(err, "unable to read from pg_waldump(1): %q", errbuf.String())
 	}
 
+	faultPage := func(ioCacheKey structs.IOCacheKey) {
+		_, err := wc.ioCache.GetIFPresent(ioCacheKey)
+		switch {
+		case err == nil:
+			atomic.AddUint64(&ioCacheHit, 1)
+		case err == gcache.KeyNotFoundError:
+			// cache miss, an IO has been scheduled in the background.
+			atomic.AddUint64(&ioCacheMiss, 1)
+		case err != nil:
+			wc.log.Debug().Err(err).Msg("iocache prefaultWALFile()")
+		}
+	}
+
+	// Decoding, filtering, and prefaulting run as a pipeline connected by
+	// bounded channels so that the first pages of a segment are faulted while
+	// pg_waldump(1) is still decoding the rest of the segment.
+	lines := make(chan []byte, pipelineDepth)
+	ioReqs := make(chan structs.IOCacheKey, pipelineDepth)
+
 	scanner := bufio.NewScanner(dumpOutReader)
 	var cmdWG sync.WaitGroup
-	cmdWG.Add(1)
+	cmdWG.Add(3)
+
+	// Decode: read pg_waldump(1)'s output
 	go func() {
 		defer cmdWG.Done()
+		defer close(lines)
+
+		for {
+			idle.start()
+			if !scanner.Scan() {
+				idle.stop()
+				break
+			}
+			idle.stop()
 
-		for scanner.Scan() {
 			line := scanner.Bytes()
 			atomic.AddUint64(&waldumpBytes, uint64(len(line)))
 			atomic.AddUint64(&linesScanned, 1)
+
+			// The scanner reuses its buffer
+			lines <- append([]byte(nil), line...)
+		}
+	}()
+
+	// Filter: extract the pages referenced by each record and the relations
+	// whose files were dropped or truncated
+	invalidated := make(map[pg.RelFileNode]struct{})
+	var lastLSNRaw []byte
+
+	// relations maps each WAL file to the relations referenced by the records
+	// that start in it.  Without record LSNs the records of a run can't be
+	// split between its WAL files, so only single WAL file runs are recorded.
+	var relations map[pg.WALFilename]map[stallhist.Relation]struct{}
+	if wc.stallHistory != nil && (wc.lsnRE != nil || len(walFiles) == 1) {
+		relations = make(map[pg.WALFilename]map[stallhist.Relation]struct{}, len(walFiles))
+	}
+
+	// commitTimes maps each WAL file to the time of its latest commit or abort
+	// record.
+	var commitTimes map[pg.WALFilename]time.Time
+	if wc.commitTimes != nil {
+		commitTimes = make(map[pg.WALFilename]time.Time, len(walFiles))
+	}
+	trackSegments := len(walFiles) > 1 && (relations != nil || commitTimes != nil)
+	go func() {
+		defer cmdWG.Done()
+		defer close(ioReqs)
+
+		segment := walFiles[0]
+		for line := range lines {
+			if wc.lsnRE != nil {
+				if lsnMatch := wc.lsnRE.FindSubmatch(line); lsnMatch != nil {
+					lastLSNRaw = lsnMatch[1]
+					if trackSegments {
+						if lsn, err := pg.ParseLSN(string(lsnMatch[1])); err == nil {
+							segment = lsn.AddBytes(1).WALFilename(timelineID)
+						}
+					}
+				}
+			}
+
 			submatches := wc.re.FindAllSubmatch(line, -1)
 			if submatches == nil {
+				// Switch, commit, and abort records never reference a block.
+				if switchMatch := wc.switchRE.FindSubmatch(line); switchMatch != nil {
+					atomic.AddUint64(&switchesMatched, 1)
+					wc.markSwitched(timelineID, switchMatch[1])
+				} else if xactMatch := wc.xactRE.FindSubmatch(line); xactMatch != nil {
+					atomic.AddUint64(&xactsMatched, 1)
+					if commitTimes != nil {
+						if t, ok := parseCommitTime(line); ok && t.After(commitTimes[segment]) {
+							commitTimes[segment] = t
+						}
+					}
+					if wc.droppedRelsRE != nil {
+						if relsMatch := wc.droppedRelsRE.FindSubmatch(line); relsMatch != nil {
+							wc.addRelPaths(invalidated, relsMatch[1])
+						}
+					}
+
+					pages, err := xactPages(xactMatch[1], line, wc.blockSize, pg.XactPage)
+					if err != nil {
+						wc.log.Debug().Err(err).Str("input", string(line)).Msg("unable to parse transaction record")
+						continue
+					}
+
+					for _, page := range pages {
+						ioReqs <- structs.IOCacheKey{
+							Block: page,
+							SLRU:  pg.SLRUXact,
+						}
+					}
+
+					if !bytes.EqualFold(xactMatch[2], []byte("commit")) || !wc.TrackCommitTimestamp() {
+						continue
+					}
+
+					pages, _ = xactPages(xactMatch[1], line, wc.blockSize, pg.CommitTsPage)
+					for _, page := range pages {
+						ioReqs <- structs.IOCacheKey{
+							Block: page,
+							SLRU:  pg.SLRUCommitTs,
+						}
+					}
+				} else if wc.parameterChangeRE != nil && wc.parameterChangeRE.Match(line) {
+					m := wc.parameterChangeRE.FindSubmatch(line)
+					wc.SetTrackCommitTimestamp(string(m[1]) == "on")
+				} else if wc.truncateRE != nil && wc.truncateRE.Match(line) {
+					m := wc.truncateRE.FindSubmatch(line)
+					wc.addRelPaths(invalidated, m[1])
+				} else if wc.multiXactRE != nil {
+					if multiXactMatch := wc.multiXactRE.FindSubmatch(line); multiXactMatch != nil {
+						atomic.AddUint64(&multiXactsMatched, 1)
+						ioCacheKeys, err := multiXactPages(multiXactMatch[1], multiXactMatch[2], multiXactMatch[3], wc.blockSize)
+						if err != nil {
+							wc.log.Debug().Err(err).Str("input", string(line)).Msg("unable to parse multixact record")
+							continue
+						}
+
+						for _, ioCacheKey := range ioCacheKeys {
+							ioReqs <- ioCacheKey
+						}
+					}
+				}
 				continue
 			}
 
@@ -305,20 +920,9 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 
 			for _, matches := range submatches {
 				atomic.AddUint64(&blocksMatched, 1)
-				tablespace, err := strconv.ParseUint(string(matches[1]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[1])).Msg("unable to convert tablespace")
-					continue
-				}
-
-				database, err := strconv.ParseUint(string(matches[2]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[2])).Msg("unable to convert database")
-					continue
-				}
 
 				// NOTE(seanc@): PostgreSQL uses database ID 0 for some system catalog
-				// activity, notably CREATE DATABASE.
+				// activity, notably CREATE DATABASE.  parseBlockRef skips these.
 				//
 				// rmgr: XLOG        len (rec/tot):     30/    30, tx:          0, lsn: 0/03000060, prev 0/03000028, desc: NEXTOID 24576
 				// rmgr: Heap        len (rec/tot):     54/  1222, tx:        995, lsn: 0/03000080, prev 0/03000060, desc: INSERT off 4, blkref #0: rel 1664/0/1262 blk 0 FPW
@@ -331,20 +935,9 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 				// rmgr: XLOG        len (rec/tot):    106/   106, tx:          0, lsn: 0/030007D0, prev 0/03000798, desc: CHECKPOINT_ONLINE redo 0/3000798; tli 1; prev tli 1; fpw true; xid 0:996; oid 24576; multi 1; offset 0; oldest xid 988 in DB 1; oldest multi 1 in DB 1; oldest/newest commit timestamp xid: 0/0; oldest running xid 995; online
 				// rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync
 				// rmgr: Storage     len (rec/tot):     42/    42, tx:          0, lsn: 0/03000888, prev 0/03000840, desc: CREATE base/16384/16385
-				if database == 0 {
-					log.Info().Str("input", string(line)).Msg("database 0")
-					continue
-				}
-
-				relation, err := strconv.ParseUint(string(matches[3]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[3])).Msg("unable to convert relation")
-					continue
-				}
-
-				block, err := strconv.ParseUint(string(matches[4]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[4])).Msg("unable to convert block")
+				ioReq, ok := parseBlockRef(matches)
+				if !ok {
+					wc.log.Debug().Str("input", string(line)).Msg("skipping block reference")
 					continue
 				}
 
@@ -359,35 +952,60 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 				// (16MiB/8KiB == ~2K), at most we should have 2K threads running *
 				// KeyWALReadahead.  That's very survivable for now but can be optimized
 				// if necessary.
-				ioCacheKey := structs.IOCacheKey{
-					Tablespace: pg.OID(tablespace),
-					Database:   pg.OID(database),
-					Relation:   pg.OID(relation),
-					Block:      pg.HeapBlockNumber(block),
-				}
-				_, err = wc.ioCache.GetIFPresent(ioCacheKey)
-				switch {
-				case err == nil:
-					atomic.AddUint64(&ioCacheHit, 1)
-				case err == gcache.KeyNotFoundError:
-					// cache miss, an IO has been scheduled in the background.
-					atomic.AddUint64(&ioCacheMiss, 1)
-				case err != nil:
-					log.Debug().Err(err).Msg("iocache prefaultWALFile()")
+				if relations != nil {
+					if relations[segment] == nil {
+						relations[segment] = make(map[stallhist.Relation]struct{})
+					}
+					relations[segment][stallhist.RelationOf(ioReq)] = struct{}{}
 				}
+				ioReqs <- ioReq
 			}
 		}
+	}()
+
+	// Prefault: hand each page to the ioCache
+	prefault := func(ioReq structs.IOCacheKey) {
+		faultPage(ioReq)
+		if wc.indexCache != nil {
+			wc.indexCache.Observe(ioReq)
+		}
+	}
+	go func() {
+		defer cmdWG.Done()
+
+		// Hold the pages back until the decodes of earlier WAL files have
+		// prefaulted theirs.
+		for _, ioReq := range hold(ready, ioReqs, maxHeldPages) {
+			prefault(ioReq)
+		}
+
+		for ioReq := range ioReqs {
+			prefault(ioReq)
+		}
 
 		// Declare victory if we fault at least one block
 		if atomic.LoadUint64(&ioCacheMiss)+atomic.LoadUint64(&ioCacheHit) > 0 {
-			atomic.AddUint64(&walFilesProcessed, uint64(1))
+			atomic.AddUint64(&walFilesProcessed, uint64(len(walFiles)))
 		}
 	}()
 
 	cmdWG.Wait()
 
+	// Invalidate once every page referenced before the relations were dropped
+	// or truncated has been faulted.
+	wc.ioCache.Invalidate(invalidated)
+
+	if relations != nil {
+		for _, walFile := range walFiles {
+			wc.stallHistory.Decoded(walFile, relations[walFile])
+		}
+	}
+	for walFile, t := range commitTimes {
+		wc.commitTimes.record(walFile, t)
+	}
+
 	if err = scanner.Err(); err != nil {
-		log.Warn().Err(err).Str("stderr", errbuf.String()).Msg("scanning output")
+		wc.log.Warn().Err(err).Str("stderr", errbuf.String()).Msg("scanning output")
 	}
 
 	// pg_waldump(1) can return 1 when it has problems decoding output.  Notably
@@ -401,13 +1019,39 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 	// of Wait is deferred until after the logging.
 	waitErr := cmd.Wait()
 
+	lastLSN := pg.InvalidLSN
+	if lastLSNRaw != nil {
+		if lastLSN, err = pg.ParseLSN(string(lastLSNRaw)); err != nil {
+			wc.log.Debug().Err(err).Str("input", string(lastLSNRaw)).Msg("unable to parse record LSN")
+		}
+	}
+	if idle.Expired() {
+		wc.log.Error().Str("walfile", walFileAbs).Int("segments", len(walFiles)).Dur("timeout", wc.cfg.DecodeTimeout).
+			Str("stderr", errbuf.String()).Uint64("lines-scanned", atomic.LoadUint64(&linesScanned)).
+			Msg("killed pg_waldump(1) after decode timeout")
+		// Resume from the last record decoded once the quarantine expires, but
+		// quarantine the WAL files regardless so that a wedged WAL file doesn't
+		// tie up a worker on every scan.
+		_ = wc.markPartial(timelineID, walFiles, lastLSN)
+		return errors.Wrapf(errDecodeTimeout, "pg_waldump(1) printed nothing for %s decoding %+q", wc.cfg.DecodeTimeout, walFileAbs)
+	}
+
+	// Running off the end of the available WAL after an XLOG_SWITCH is
+	// expected: the remainder of the segment is padding and the next segment
+	// may not exist yet.
+	if waitErr != nil && atomic.LoadUint64(&switchesMatched) > 0 && wc.switchPadding().MatchString(errbuf.String()) {
+		wc.log.Debug().Str("walfile", walFileAbs).Str("stderr", errbuf.String()).
+			Msg("reached XLOG_SWITCH padding")
+		return nil
+	}
+
 	// For whatever reason pg_waldump(1) had stderr output.  It's
 	// entirely plausible, even likely, that pg_waldump(1) threw some
 	// output to stderr and yet the prefaulter still produced useful
 	// results.
 	if len(errbuf.String()) > 0 {
-		log.Warn().Err(waitErr).
-			Str("pg_waldump-path", wc.cfg.WalDumpPath).
+		wc.log.Warn().Err(waitErr).
+			Str("pg_waldump-path", wc.WalDumpPath()).
 			Str("walfile", walFileAbs).
 			Str("stderr", errbuf.String()).
 			Uint64("blocks-matched", atomic.LoadUint64(&blocksMatched)).
@@ -415,6 +1059,8 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 			Uint64("iocache-hit", atomic.LoadUint64(&ioCacheHit)).
 			Uint64("iocache-miss", atomic.LoadUint64(&ioCacheMiss)).
 			Uint64("lines-matched", atomic.LoadUint64(&linesMatched)).
+			Uint64("xacts-matched", atomic.LoadUint64(&xactsMatched)).
+			Uint64("multixacts-matched", atomic.LoadUint64(&multiXactsMatched)).
 			Uint64("lines-scanned", atomic.LoadUint64(&linesScanned)).
 			Uint64("pg_waldump-bytes", atomic.LoadUint64(&waldumpBytes)).
 			Msg("pg_waldump(1) stderr")
@@ -424,5 +1070,134 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 		return nil
 	}
 
-	return errors.Wrapf(waitErr, "pg_waldump(1) returned uncleanly when reading %+q or running %+q: %+q", walFileAbs, wc.cfg.WalDumpPath, errbuf.String())
+	if err := wc.markPartial(timelineID, walFiles, lastLSN); err != nil {
+		return err
+	}
+
+	return errors.Wrapf(waitErr, "pg_waldump(1) returned uncleanly when reading %+q or running %+q: %+q", walFileAbs, wc.WalDumpPath(), errbuf.String())
+}
+
+// SetTrackCommitTimestamp tells the WALCache whether or not commit records
+// update pg_commit_ts.
+func (wc *WALCache) SetTrackCommitTimestamp(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+
+	if atomic.SwapUint32(&wc.trackCommitTs, v) != v {
+		wc.log.Info().Bool("track-commit-timestamp", on).Msg("commit timestamp tracking changed")
+	}
+}
+
+// TrackCommitTimestamp returns true if commit records update pg_commit_ts.
+func (wc *WALCache) TrackCommitTimestamp() bool {
+	return atomic.LoadUint32(&wc.trackCommitTs) != 0
+}
+
+// xactPages returns the SLRU pages, as computed by pageOf, updated for the
+// transaction in a commit or abort record.  xidRaw is the record's transaction
+// ID, line is searched for the IDs of any subtransactions.
+func xactPages(xidRaw, line []byte, blockSize units.Base2Bytes,
+	pageOf func(pg.TransactionID, units.Base2Bytes) pg.HeapBlockNumber) ([]pg.HeapBlockNumber, error) {
+	xids := []string{string(xidRaw)}
+	if m := subxactsRE.FindSubmatch(line); m != nil {
+		xids = append(xids, strings.Fields(string(m[1]))...)
+	}
+
+	pages := make([]pg.HeapBlockNumber, 0, 1)
+	for _, xidStr := range xids {
+		xid, err := strconv.ParseUint(xidStr, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse transaction ID %q", xidStr)
+		}
+
+		// Subtransactions are usually on the same page as their parent.
+		page := pageOf(pg.TransactionID(xid), blockSize)
+		var found bool
+		for _, p := range pages {
+			if p == page {
+				found = true
+				break
+			}
+		}
+		if !found {
+			pages = append(pages, page)
+		}
+	}
+
+	return pages, nil
+}
+
+// multiXactPages returns the SLRU pages updated by a multixact creation
+// record: the offsets page containing the multixact and the members pages
+// containing its nmembers members starting at offset.
+func multiXactPages(mxidRaw, offsetRaw, nmembersRaw []byte, blockSize units.Base2Bytes) ([]structs.IOCacheKey, error) {
+	mxid, err := strconv.ParseUint(string(mxidRaw), 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse multixact ID %q", mxidRaw)
+	}
+
+	offset, err := strconv.ParseUint(string(offsetRaw), 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse multixact offset %q", offsetRaw)
+	}
+
+	nmembers, err := strconv.ParseUint(string(nmembersRaw), 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse multixact member count %q", nmembersRaw)
+	}
+
+	ioCacheKeys := []structs.IOCacheKey{{
+		Block: pg.MultiXactOffsetPage(pg.MultiXactID(mxid), blockSize),
+		SLRU:  pg.SLRUMultiXactOffsets,
+	}}
+
+	if nmembers == 0 {
+		return ioCacheKeys, nil
+	}
+
+	first := pg.MultiXactOffset(offset)
+	last := first + pg.MultiXactOffset(nmembers-1)
+	spans := [][2]pg.MultiXactOffset{{first, last}}
+	if last < first {
+		// The members wrap around the end of the members SLRU
+		spans = [][2]pg.MultiXactOffset{{first, math.MaxUint32}, {0, last}}
+	}
+
+	for _, span := range spans {
+		for page := pg.MultiXactMemberPage(span[0], blockSize); page <= pg.MultiXactMemberPage(span[1], blockSize); page++ {
+			ioCacheKeys = append(ioCacheKeys, structs.IOCacheKey{
+				Block: page,
+				SLRU:  pg.SLRUMultiXactMembers,
+			})
+		}
+	}
+
+	return ioCacheKeys, nil
+}
+
+// fetchWALFile fetches walFile from the WAL archive into the scratch directory
+// and returns the path of the fetched file.  Callers are responsible for
+// removing the returned file.
+func (wc *WALCache) fetchWALFile(walFile pg.WALFilename) (string, error) {
+	dst := archive.ScratchPath(wc.cfg.Archive.ScratchDir, walFile)
+
+	ctx := wc.pgConnCtxAcquirer.AcquireConnContext()
+	if wc.cfg.Archive.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wc.cfg.Archive.FetchTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	if err := wc.fetcher.Fetch(ctx, walFile, dst); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+
+	wc.log.Debug().Str("walfile", string(walFile)).Str("fetcher", wc.fetcher.Name()).
+		Dur("fetch-duration", time.Since(start)).Msg("fetched WAL file from archive")
+
+	return dst, nil
 }
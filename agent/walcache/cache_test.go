@@ -14,9 +14,18 @@
 package walcache
 
 import (
+	"regexp"
+	"strings"
 	"testing"
 
+	"github.com/alecthomas/units"
+	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/kylelemons/godebug/pretty"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 )
 
 func TestPGWalDumpRE(t *testing.T) {
@@ -53,6 +62,96 @@ func TestPGWalDumpRE(t *testing.T) {
 			relationID:   []string{"16434", "16434", "16434"},
 			blockNumber:  []string{"9578854", "19938685", "3875203"},
 		},
+		{
+			version:      "pg15+fpw",
+			input:        []byte(`rmgr: Heap        len (rec/tot):     54/  7974, tx:        735, lsn: 0/01524E48, prev 0/01524E10, desc: DELETE off 3 flags 0x00 KEYS_UPDATED , blkref #0: rel 1663/5/16384 blk 0 FPW`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16384"},
+			blockNumber:  []string{"0"},
+		},
+		{
+			version:      "pg16",
+			input:        []byte(`rmgr: Heap2       len (rec/tot):     64/  8256, tx:          0, lsn: 0/0152C358, prev 0/0152C320, desc: VISIBLE snapshotConflictHorizon: 740, flags: 0x03, blkref #0: rel 1663/5/16384 fork vm blk 0 FPW, blkref #1: rel 1663/5/16384 blk 2`),
+			tablespaceID: []string{"1663", "1663"},
+			databaseID:   []string{"5", "5"},
+			relationID:   []string{"16384", "16384"},
+			blockNumber:  []string{"0", "2"},
+		},
+		{
+			version:      "pg15+xlog-fpi",
+			input:        []byte(`rmgr: XLOG        len (rec/tot):     49/  8213, tx:          0, lsn: 0/0152A2D0, prev 0/0152A298, desc: FPI , blkref #0: rel 1663/5/1259 blk 0 FPW`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"1259"},
+			blockNumber:  []string{"0"},
+		},
+		{
+			version:      "pg15+update",
+			input:        []byte(`rmgr: Heap        len (rec/tot):     80/    80, tx:        736, lsn: 0/01526EF8, prev 0/01526EC0, desc: UPDATE off 4 xmax 736 flags 0x00 KEYS_UPDATED ; new off 1 xmax 0, blkref #0: rel 1663/5/16384 blk 1, blkref #1: rel 1663/5/16384 blk 0`),
+			tablespaceID: []string{"1663", "1663"},
+			databaseID:   []string{"5", "5"},
+			relationID:   []string{"16384", "16384"},
+			blockNumber:  []string{"1", "0"},
+		},
+		{
+			version:      "pg15+fsm",
+			input:        []byte(`rmgr: XLOG        len (rec/tot):     49/  8241, tx:          0, lsn: 0/0152D810, prev 0/0152D7D8, desc: FPI , blkref #0: rel 1663/5/16384 fork fsm blk 2 FPW`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16384"},
+			blockNumber:  []string{"2"},
+		},
+		{
+			version:      "pg16+xlog-fpi-for-hint",
+			input:        []byte(`rmgr: XLOG        len (rec/tot):     49/  7869, tx:          0, lsn: 0/0153B0C8, prev 0/0153B090, desc: FPI_FOR_HINT , blkref #0: rel 1663/5/16384 fork main blk 0 FPW`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16384"},
+			blockNumber:  []string{"0"},
+		},
+		{
+			version:      "pg16+prune",
+			input:        []byte(`rmgr: Heap2       len (rec/tot):     59/    59, tx:          0, lsn: 0/0153B110, prev 0/0153B0C8, desc: PRUNE snapshotConflictHorizon: 739, nredirected: 0, ndead: 1, isCatalogRel: F, nunused: 0, redirected: [], dead: [4], unused: [], blkref #0: rel 1663/5/16384 blk 0`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16384"},
+			blockNumber:  []string{"0"},
+		},
+		{
+			version:      "pg16+btree-insert-leaf",
+			input:        []byte(`rmgr: Btree       len (rec/tot):     64/    64, tx:        741, lsn: 0/0153B150, prev 0/0153B110, desc: INSERT_LEAF off: 2, blkref #0: rel 1663/5/16387 blk 1`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16387"},
+			blockNumber:  []string{"1"},
+		},
+		{
+			version:      "pg16+wal-consistency",
+			input:        []byte(`rmgr: Heap        len (rec/tot):     59/  8251, tx:        742, lsn: 0/0153B190, prev 0/0153B150, desc: INSERT off: 5, flags: 0x00, blkref #0: rel 1663/5/16384 blk 0 FPW for WAL verification`),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16384"},
+			blockNumber:  []string{"0"},
+		},
+		{
+			version: "pg16+create-database",
+			input:   []byte(`rmgr: Database    len (rec/tot):     42/    42, tx:        743, lsn: 0/0153B1D0, prev 0/0153B190, desc: CREATE_WAL_LOG create dir 1663/16388`),
+			fail:    true,
+		},
+		{
+			version: "pg16+running-xacts",
+			input:   []byte(`rmgr: Standby     len (rec/tot):     50/    50, tx:          0, lsn: 0/0153B200, prev 0/0153B1D0, desc: RUNNING_XACTS nextXid 744 latestCompletedXid 743 oldestRunningXid 744`),
+			fail:    true,
+		},
+		{
+			version:      "pg16+bkp-details",
+			input:        []byte("\tblkref #0: rel 1663/5/16384 fork main blk 7 (FPW); hole: offset: 44, length: 7924, compression saved: 0, method: pglz"),
+			tablespaceID: []string{"1663"},
+			databaseID:   []string{"5"},
+			relationID:   []string{"16384"},
+			blockNumber:  []string{"7"},
+		},
 	}
 
 	for i, test := range tests {
@@ -60,6 +159,9 @@ func TestPGWalDumpRE(t *testing.T) {
 		if submatches == nil && !test.fail {
 			t.Fatalf("%d failed to match test: %q", i, test.input)
 		} else if test.fail {
+			if submatches != nil {
+				t.Fatalf("%d unexpectedly matched test: %q", i, test.input)
+			}
 			continue
 		}
 
@@ -90,3 +192,376 @@ func TestPGWalDumpRE(t *testing.T) {
 		}
 	}
 }
+
+func TestSwitchRE(t *testing.T) {
+	tests := []struct {
+		re    *regexp.Regexp
+		input string
+		lsn   string
+	}{
+		{ // 0
+			re:    pgWalDumpSwitchRE,
+			input: `rmgr: XLOG        len (rec/tot):     24/    24, tx:          0, lsn: 0/03000140, prev 0/03000108, desc: SWITCH `,
+			lsn:   "0/03000140",
+		},
+		{ // 1
+			re:    pgWalDumpSwitchRE,
+			input: `rmgr: XLOG        len (rec/tot):    106/   106, tx:          0, lsn: 0/030006F8, prev 0/030006C0, desc: CHECKPOINT_ONLINE redo 0/30006C0; tli 1`,
+		},
+		{ // 2
+			re:    waldumpSwitchRE,
+			input: `[cur:0/3000140, xid:0, rmid:0(XLOG), len/tot_len:0/24, info:64, prev:0/3000108] xlog switch`,
+			lsn:   "0/3000140",
+		},
+	}
+
+	for n, test := range tests {
+		var lsn string
+		if m := test.re.FindStringSubmatch(test.input); m != nil {
+			lsn = m[1]
+		}
+
+		if diff := pretty.Compare(lsn, test.lsn); diff != "" {
+			t.Fatalf("%d: switch LSN diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestSwitchPaddingRE(t *testing.T) {
+	tests := []struct {
+		major uint64
+		input string
+		match bool
+	}{
+		{120000, `pg_waldump: FATAL:  error in WAL record at 0/3000140: invalid record length at 0/3000158: wanted 24, got 0`, true},
+		{120000, `pg_waldump: fatal: could not find file "000000010000000000000004": No such file or directory`, true},
+		{120000, `pg_waldump: FATAL:  error in WAL record at C/A15FD930: record with incorrect prev-link 61313664/37303561 at C/A15FD968`, false},
+		{150000, `pg_waldump: error: error in WAL record at 0/3000140: invalid record length at 0/3000158: wanted 24, got 0`, true},
+		{160000, `pg_waldump: error: error in WAL record at 0/3000140: invalid record length at 0/3000158: expected at least 24, got 0`, true},
+		{160000, `pg_waldump: error: could not find file "000000010000000000000004": No such file or directory`, true},
+		{160000, `pg_waldump: error: error in WAL record at 0/3000140: invalid record length at 0/3000158: wanted 24, got 0`, false},
+		{150000, `pg_waldump: error: error in WAL record at 0/3000140: invalid record length at 0/3000158: expected at least 24, got 0`, false},
+	}
+
+	for n, test := range tests {
+		wc := &WALCache{walTranslations: &pg.WALTranslations{Major: test.major}}
+		if diff := pretty.Compare(wc.switchPadding().MatchString(test.input), test.match); diff != "" {
+			t.Fatalf("%d: padding match diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestXactRE(t *testing.T) {
+	tests := []struct {
+		re            *regexp.Regexp
+		input         string
+		commit        bool
+		pages         []pg.HeapBlockNumber
+		commitTsPages []pg.HeapBlockNumber
+	}{
+		{ // 0
+			re:            pgWalDumpXactRE,
+			input:         `rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync`,
+			commit:        true,
+			pages:         []pg.HeapBlockNumber{0},
+			commitTsPages: []pg.HeapBlockNumber{1},
+		},
+		{ // 1
+			re:            pgWalDumpXactRE,
+			input:         `rmgr: Transaction len (rec/tot):     46/    46, tx:      32767, lsn: 0/03000A10, prev 0/030009D8, desc: ABORT 2017-09-30 17:24:02.108724 UTC; subxacts: 32768 32769`,
+			pages:         []pg.HeapBlockNumber{0, 1},
+			commitTsPages: []pg.HeapBlockNumber{40},
+		},
+		{ // 2
+			re:    pgWalDumpXactRE,
+			input: `rmgr: Transaction len (rec/tot):     34/    34, tx:          0, lsn: 0/03000BD0, prev 0/03000B98, desc: ASSIGNMENT xtop 1010: subxacts: 1011`,
+		},
+		{ // 3
+			re:            pgWalDumpXactRE,
+			input:         `rmgr: Transaction len (rec/tot):    258/   258, tx:        740, lsn: 0/0152C4D0, prev 0/0152C498, desc: COMMIT 2023-09-14 09:12:44.361285 UTC; rels: 1663/5/16390; dropped stats: 2/5/16390; inval msgs: catcache 80 relcache 16390`,
+			commit:        true,
+			pages:         []pg.HeapBlockNumber{0},
+			commitTsPages: []pg.HeapBlockNumber{0},
+		},
+		{ // 4
+			re:            waldumpXactRE,
+			input:         `[cur:C4/1F0, xid:450806559, rmid:1(Transaction), len/tot_len:12/44, info:0, prev:C4/1A0] commit: 2017-09-30 17:23:38.416563 UTC`,
+			commit:        true,
+			pages:         []pg.HeapBlockNumber{13757},
+			commitTsPages: []pg.HeapBlockNumber{550435},
+		},
+	}
+
+	for n, test := range tests {
+		var commit bool
+		var pages, commitTsPages []pg.HeapBlockNumber
+		if m := test.re.FindStringSubmatch(test.input); m != nil {
+			var err error
+			commit = strings.EqualFold(m[2], "commit")
+			pages, err = xactPages([]byte(m[1]), []byte(test.input), pg.HeapPageSize, pg.XactPage)
+			if err != nil {
+				t.Fatalf("%d: unexpected failure: %v", n, err)
+			}
+
+			commitTsPages, err = xactPages([]byte(m[1]), []byte(test.input), pg.HeapPageSize, pg.CommitTsPage)
+			if err != nil {
+				t.Fatalf("%d: unexpected failure: %v", n, err)
+			}
+		}
+
+		if commit != test.commit {
+			t.Fatalf("%d: commit: got %t, want %t", n, commit, test.commit)
+		}
+
+		if diff := pretty.Compare(pages, test.pages); diff != "" {
+			t.Fatalf("%d: pages diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(commitTsPages, test.commitTsPages); diff != "" {
+			t.Fatalf("%d: commit_ts pages diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestParameterChangeRE(t *testing.T) {
+	tests := []struct {
+		input string
+		match string
+	}{
+		{ // 0
+			input: `rmgr: XLOG        len (rec/tot):     54/    54, tx:          0, lsn: 0/03000028, prev 0/02000108, desc: PARAMETER_CHANGE max_connections=100 max_worker_processes=8 max_wal_senders=10 max_prepared_xacts=0 max_locks_per_xact=64 wal_level=replica wal_log_hints=off track_commit_timestamp=on`,
+			match: "on",
+		},
+		{ // 1
+			input: `rmgr: XLOG        len (rec/tot):     54/    54, tx:          0, lsn: 0/03000028, prev 0/02000108, desc: PARAMETER_CHANGE max_connections=100 max_worker_processes=8 max_prepared_xacts=0 max_locks_per_xact=64 wal_level=replica wal_log_hints=off track_commit_timestamp=off`,
+			match: "off",
+		},
+		{ // 2
+			input: `rmgr: XLOG        len (rec/tot):     24/    24, tx:          0, lsn: 0/03000140, prev 0/03000108, desc: SWITCH`,
+		},
+	}
+
+	for n, test := range tests {
+		var match string
+		if m := pgWalDumpParameterChangeRE.FindStringSubmatch(test.input); m != nil {
+			match = m[1]
+		}
+
+		if match != test.match {
+			t.Fatalf("%d: match: got %q, want %q", n, match, test.match)
+		}
+	}
+}
+
+func TestMultiXactRE(t *testing.T) {
+	tests := []struct {
+		input       string
+		ioCacheKeys []structs.IOCacheKey
+	}{
+		{ // 0
+			input: `rmgr: MultiXact   len (rec/tot):     54/    54, tx:        746, lsn: 0/01663A48, prev 0/01663A10, desc: CREATE_ID 1 offset 1 nmembers 2: 745 (keysh) 746 (keysh)`,
+			ioCacheKeys: []structs.IOCacheKey{
+				{SLRU: pg.SLRUMultiXactOffsets, Block: 0},
+				{SLRU: pg.SLRUMultiXactMembers, Block: 0},
+			},
+		},
+		{ // 1: members span two pages
+			input: `rmgr: MultiXact   len (rec/tot):     54/    54, tx:        746, lsn: 0/01663A48, prev 0/01663A10, desc: CREATE_ID 2048 offset 1635 nmembers 2: 745 (keysh) 746 (keysh)`,
+			ioCacheKeys: []structs.IOCacheKey{
+				{SLRU: pg.SLRUMultiXactOffsets, Block: 1},
+				{SLRU: pg.SLRUMultiXactMembers, Block: 0},
+				{SLRU: pg.SLRUMultiXactMembers, Block: 1},
+			},
+		},
+		{ // 2: members wrap around
+			input: `rmgr: MultiXact   len (rec/tot):     54/    54, tx:        746, lsn: 0/01663A48, prev 0/01663A10, desc: CREATE_ID 4294967295 offset 4294967295 nmembers 2: 745 (keysh) 746 (keysh)`,
+			ioCacheKeys: []structs.IOCacheKey{
+				{SLRU: pg.SLRUMultiXactOffsets, Block: 2097151},
+				{SLRU: pg.SLRUMultiXactMembers, Block: 2625285},
+				{SLRU: pg.SLRUMultiXactMembers, Block: 0},
+			},
+		},
+		{ // 3
+			input: `rmgr: MultiXact   len (rec/tot):     30/    30, tx:          0, lsn: 0/01663A10, prev 0/016639D8, desc: ZERO_OFF_PAGE 1`,
+		},
+	}
+
+	for n, test := range tests {
+		var ioCacheKeys []structs.IOCacheKey
+		if m := pgWalDumpMultiXactRE.FindStringSubmatch(test.input); m != nil {
+			var err error
+			ioCacheKeys, err = multiXactPages([]byte(m[1]), []byte(m[2]), []byte(m[3]), pg.HeapPageSize)
+			if err != nil {
+				t.Fatalf("%d: unexpected failure: %v", n, err)
+			}
+		}
+
+		if diff := pretty.Compare(ioCacheKeys, test.ioCacheKeys); diff != "" {
+			t.Fatalf("%d: pages diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestInvalidatedRelsRE(t *testing.T) {
+	tests := []struct {
+		input string
+		rels  map[pg.RelFileNode]struct{}
+	}{
+		{ // 0
+			input: `rmgr: Storage     len (rec/tot):     46/    46, tx:          0, lsn: 0/0301A2D8, prev 0/0301A298, desc: TRUNCATE base/16384/16385 to 0 blocks flags 7`,
+			rels: map[pg.RelFileNode]struct{}{
+				{Tablespace: 1663, Database: 16384, Relation: 16385}: {},
+			},
+		},
+		{ // 1
+			input: `rmgr: Transaction len (rec/tot):    130/   130, tx:        997, lsn: 0/0301C8E0, prev 0/0301C8A0, desc: COMMIT 2017-09-30 17:25:11.102934 UTC; rels: base/16384/16385 pg_tblspc/16400/PG_10_201707211/16384/16388; inval msgs: catcache 50 relcache 16385`,
+			rels: map[pg.RelFileNode]struct{}{
+				{Tablespace: 1663, Database: 16384, Relation: 16385}:  {},
+				{Tablespace: 16400, Database: 16384, Relation: 16388}: {},
+			},
+		},
+		{ // 2
+			input: `rmgr: Transaction len (rec/tot):     82/    82, tx:       1002, lsn: 0/03000A10, prev 0/030009D8, desc: ABORT 2017-09-30 17:24:02.108724 UTC; rels: base/16384/16390`,
+			rels: map[pg.RelFileNode]struct{}{
+				{Tablespace: 1663, Database: 16384, Relation: 16390}: {},
+			},
+		},
+		{ // 3
+			input: `rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync`,
+			rels:  map[pg.RelFileNode]struct{}{},
+		},
+		{ // 4
+			input: `rmgr: Storage     len (rec/tot):     42/    42, tx:          0, lsn: 0/03000888, prev 0/03000840, desc: CREATE base/16384/16385`,
+			rels:  map[pg.RelFileNode]struct{}{},
+		},
+	}
+
+	wc := &WALCache{log: zerolog.Nop()}
+	for n, test := range tests {
+		rels := make(map[pg.RelFileNode]struct{})
+		if m := pgWalDumpTruncateRE.FindSubmatch([]byte(test.input)); m != nil {
+			wc.addRelPaths(rels, m[1])
+		}
+		if m := pgWalDumpDroppedRelsRE.FindSubmatch([]byte(test.input)); m != nil {
+			wc.addRelPaths(rels, m[1])
+		}
+
+		if diff := pretty.Compare(rels, test.rels); diff != "" {
+			t.Fatalf("%d: relations diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestSetReadahead(t *testing.T) {
+	wc := &WALCache{readaheadBytes: int64(32 * units.MiB), readaheadMax: units.GiB}
+
+	if err := wc.SetReadahead(128*units.MiB, 16*units.MiB, 256*units.MiB); err != nil {
+		t.Fatal(err)
+	}
+	if readahead := wc.ReadaheadBytes(); readahead != 128*units.MiB {
+		t.Fatalf("readahead %s, want 128MiB", readahead)
+	}
+	if min, max := wc.ReadaheadBounds(); min != 16*units.MiB || max != 256*units.MiB {
+		t.Fatalf("readahead bounds %s-%s, want 16MiB-256MiB", min, max)
+	}
+
+	for n, test := range []struct {
+		readahead, min, max units.Base2Bytes
+	}{
+		{-1, -1, 256 * units.MiB},                    // 0
+		{512 * units.MiB, 0, 256 * units.MiB},        // 1
+		{8 * units.MiB, 16 * units.MiB, units.GiB},   // 2
+		{units.GiB, 0, 2 * config.MaxReadaheadBytes}, // 3
+		{64 * units.MiB, 256 * units.MiB, units.MiB}, // 4
+	} {
+		if err := wc.SetReadahead(test.readahead, test.min, test.max); err == nil {
+			t.Fatalf("%d: set readahead %s within %s-%s", n, test.readahead, test.min, test.max)
+		}
+	}
+	if readahead := wc.ReadaheadBytes(); readahead != 128*units.MiB {
+		t.Fatalf("readahead %s changed by a rejected value", readahead)
+	}
+	if min, max := wc.ReadaheadBounds(); min != 16*units.MiB || max != 256*units.MiB {
+		t.Fatalf("readahead bounds %s-%s changed by a rejected value", min, max)
+	}
+}
+
+func TestClose(t *testing.T) {
+	wc := &WALCache{}
+	wc.Close()
+
+	faulting, err := wc.FaultWALFile("000000010000000000000001")
+	if faulting || err != nil {
+		t.Fatalf("closed cache accepted a WAL file: %t, %v", faulting, err)
+	}
+	if n := wc.NumInFlight(); n != 0 {
+		t.Fatalf("%d WAL files in flight, want 0", n)
+	}
+}
+
+func TestMarkPartial(t *testing.T) {
+	walFiles := []pg.WALFilename{
+		"000000010000000000000003",
+		"000000010000000000000004",
+	}
+
+	tests := []struct {
+		lastLSN string
+		partial bool
+		resume  map[pg.WALFilename]string
+	}{
+		{ // 0: nothing decoded
+			lastLSN: "",
+			resume:  map[pg.WALFilename]string{},
+		},
+		{ // 1: stopped in the first WAL file
+			lastLSN: "0/03000140",
+			partial: true,
+			resume:  map[pg.WALFilename]string{"000000010000000000000003": "0/3000141"},
+		},
+		{ // 2: stopped in the last WAL file
+			lastLSN: "0/04FFFFD8",
+			partial: true,
+			resume:  map[pg.WALFilename]string{"000000010000000000000004": "0/4FFFFD9"},
+		},
+		{ // 3: stopped after the run
+			lastLSN: "0/05000028",
+			resume:  map[pg.WALFilename]string{},
+		},
+	}
+
+	for n, test := range tests {
+		wc := &WALCache{
+			log:     zerolog.Nop(),
+			partial: gcache.New(4).LRU().Build(),
+		}
+		// Stale positions are forgotten
+		wc.partial.Set(walFiles[0], pg.LSN(1))
+
+		lastLSN := pg.InvalidLSN
+		if test.lastLSN != "" {
+			var err error
+			if lastLSN, err = pg.ParseLSN(test.lastLSN); err != nil {
+				t.Fatalf("%d: %v", n, err)
+			}
+		}
+
+		err := wc.markPartial(1, walFiles, lastLSN)
+		if partial := errors.Cause(err) == errPartialDecode; partial != test.partial {
+			t.Fatalf("%d: partial %t, want %t: %v", n, partial, test.partial, err)
+		}
+
+		if test.lastLSN == "" {
+			continue
+		}
+		resume := make(map[pg.WALFilename]string)
+		for _, walFile := range walFiles {
+			if lsn, found := wc.resumeLSN(walFile); found {
+				resume[walFile] = waldumpLSN(lsn)
+			}
+		}
+		if diff := pretty.Compare(resume, test.resume); diff != "" {
+			t.Fatalf("%d: resume diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// waldumpCommand returns the command running pg_waldump(1) with args.
+// pg_waldump(1) is run under the configured wrapper, with the configured
+// arguments ahead of args and the configured variables added to the agent's
+// environment.
+func (wc *WALCache) waldumpCommand(ctx context.Context, args ...string) *exec.Cmd {
+	argv := make([]string, 0, len(wc.cfg.WalDumpWrapper)+1+len(wc.cfg.WalDumpArgs)+len(args))
+	argv = append(argv, wc.cfg.WalDumpWrapper...)
+	argv = append(argv, wc.WalDumpPath())
+	argv = append(argv, wc.cfg.WalDumpArgs...)
+	argv = append(argv, args...)
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	if len(wc.cfg.WalDumpEnv) > 0 {
+		cmd.Env = append(os.Environ(), wc.cfg.WalDumpEnv...)
+	}
+
+	return cmd
+}
@@ -0,0 +1,63 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestWaldumpCommand(t *testing.T) {
+	tests := []struct {
+		cfg  config.WALCacheConfig
+		args []string
+		env  []string
+	}{
+		{ // 0
+			cfg:  config.WALCacheConfig{WalDumpPath: "/usr/lib/postgresql/16/bin/pg_waldump"},
+			args: []string{"/usr/lib/postgresql/16/bin/pg_waldump", "-f", "000000010000000000000001"},
+		},
+		{ // 1
+			cfg: config.WALCacheConfig{
+				WalDumpPath:    "/usr/lib/postgresql/16/bin/pg_waldump",
+				WalDumpArgs:    []string{"--timeline=2"},
+				WalDumpEnv:     []string{"LC_ALL=C"},
+				WalDumpWrapper: []string{"numactl", "--cpunodebind=0"},
+			},
+			args: []string{"numactl", "--cpunodebind=0", "/usr/lib/postgresql/16/bin/pg_waldump", "--timeline=2", "-f", "000000010000000000000001"},
+			env:  []string{"LC_ALL=C"},
+		},
+	}
+
+	for n, test := range tests {
+		wc := &WALCache{cfg: &test.cfg}
+		wc.SetWalDumpPath(test.cfg.WalDumpPath)
+		cmd := wc.waldumpCommand(context.Background(), "-f", "000000010000000000000001")
+		if diff := pretty.Compare(cmd.Args, test.args); diff != "" {
+			t.Fatalf("%d: args diff: (-got +want)\n%s", n, diff)
+		}
+
+		// The configured variables are added to, and override, the agent's
+		var env []string
+		if len(cmd.Env) > 0 {
+			env = cmd.Env[len(cmd.Env)-len(test.env):]
+		}
+		if diff := pretty.Compare(env, test.env); diff != "" {
+			t.Fatalf("%d: env diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
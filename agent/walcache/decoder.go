@@ -0,0 +1,556 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// maxHeldPages bounds the number of pages a decode holds back while it waits for
+// the decodes of earlier WAL files.
+const maxHeldPages = 16 * 1024
+
+// decoderRestartDelay is how long a decoder worker waits before restarting
+// after a failure.
+const decoderRestartDelay = time.Second
+
+var (
+	decoderInvocations = metrics.NewCounter("wal_decoder_invocations_total", "Number of WAL decoder invocations.")
+	decoderSegments    = metrics.NewCounter("wal_decoder_segments_total", "Number of WAL segments decoded.")
+	decoderRestarts    = metrics.NewCounter("wal_decoder_restarts_total", "Number of times a WAL decoder worker was restarted after a failure.")
+	decoderTimeouts    = metrics.NewCounter("wal_decoder_timeouts_total", "Number of WAL decoder invocations killed after exceeding the decode timeout.")
+	decodersRunning    = metrics.NewGauge("wal_decoders", "Number of pg_waldump(1) processes running.")
+	decoderWaits       = metrics.NewCounter("wal_decoder_waits_total", "Number of WAL decoder invocations delayed by the limit on concurrent decoders.")
+	partialDecodes     = metrics.NewCounter("wal_partial_decodes_total", "Number of WAL decoder invocations that stopped partway through a WAL segment and will resume from there.")
+	overBudget         = metrics.NewCounter("wal_segment_budget_exceeded_total", "Number of WAL decoder invocations that exceeded their per-segment processing budget.")
+	segmentsSkipped    = metrics.NewCounter("wal_segments_skipped_total", "Number of queued WAL segments skipped because PostgreSQL had already replayed past them.")
+	decoderHeld        = metrics.NewCounter("wal_decoder_held_total", "Number of WAL decoder invocations whose pages were held back until an earlier segment's pages had been prefaulted.")
+)
+
+// errDecodeTimeout is returned when pg_waldump(1) is killed after exceeding the
+// decode timeout.
+var errDecodeTimeout = errors.New("pg_waldump(1) timed out")
+
+// watchdog calls expire when it has been running for longer than its timeout.
+// It only runs between start and stop, so time pg_waldump(1) spends blocked
+// behind the rest of the pipeline isn't counted.  A nil watchdog never expires.
+type watchdog struct {
+	timer   *time.Timer
+	timeout time.Duration
+	expired uint32
+}
+
+// newWatchdog returns a stopped watchdog, or nil if timeout is zero.
+func newWatchdog(timeout time.Duration, expire func()) *watchdog {
+	if timeout <= 0 {
+		return nil
+	}
+
+	w := &watchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreUint32(&w.expired, 1)
+		expire()
+	})
+	w.timer.Stop()
+
+	return w
+}
+
+// start (re)starts the timeout.
+func (w *watchdog) start() {
+	if w != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop pauses the timeout until the next start.
+func (w *watchdog) stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// Expired returns true once the watchdog has expired.
+func (w *watchdog) Expired() bool {
+	return w != nil && atomic.LoadUint32(&w.expired) != 0
+}
+
+// errPartialDecode is returned when pg_waldump(1) stopped partway through a WAL
+// file, e.g. one the walreceiver is still writing, after decoding some of its
+// records.
+var errPartialDecode = errors.New("WAL file partially decoded")
+
+// decodeQueue holds the WAL files waiting to be decoded.  Workers take the
+// oldest pending WAL file along with any pending successors so that a backlog
+// of consecutive segments is decoded by a single pg_waldump(1) invocation
+// instead of one invocation per segment.  The backlog is shared with the other
+// idle workers, up to concurrency of them, so that it is decoded in parallel
+// rather than by one worker while the others wait.
+type decodeQueue struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	pending     map[pg.WALFilename]struct{}
+	closed      bool
+	concurrency int
+
+	// waiting is the number of workers blocked in pop.
+	waiting int
+}
+
+func newDecodeQueue(concurrency int) *decodeQueue {
+	q := &decodeQueue{
+		pending:     make(map[pg.WALFilename]struct{}),
+		concurrency: concurrency,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// push queues walFile.  push returns false if the queue has been closed.
+func (q *decodeQueue) push(walFile pg.WALFilename) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	q.pending[walFile] = struct{}{}
+	q.cond.Signal()
+
+	return true
+}
+
+// pop blocks until a WAL file is available and returns the oldest pending WAL
+// file followed by up to maxRun-1 of its consecutive successors.  The run is
+// shortened so that the workers still waiting can take a share of the pending
+// WAL files.  pop returns false once the queue has been closed.
+func (q *decodeQueue) pop(maxRun uint) ([]pg.WALFilename, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.waiting++
+	for len(q.pending) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	q.waiting--
+
+	if q.closed {
+		return nil, false
+	}
+
+	if share := runLength(len(q.pending), q.waiting+1, q.concurrency); share < maxRun {
+		maxRun = share
+	}
+
+	// WAL filenames are fixed-width hex and sort by timeline and then segment.
+	oldest := make([]pg.WALFilename, 0, len(q.pending))
+	for walFile := range q.pending {
+		oldest = append(oldest, walFile)
+	}
+	sort.Slice(oldest, func(i, j int) bool { return oldest[i] < oldest[j] })
+
+	run := []pg.WALFilename{oldest[0]}
+	delete(q.pending, oldest[0])
+	for uint(len(run)) < maxRun {
+		next, err := nextWALFile(run[len(run)-1])
+		if err != nil {
+			break
+		}
+		if _, found := q.pending[next]; !found {
+			break
+		}
+
+		run = append(run, next)
+		delete(q.pending, next)
+	}
+
+	return run, true
+}
+
+// runLength returns how many of pending WAL files one of workers idle workers
+// takes when at most concurrency of them decode at once.
+func runLength(pending, workers, concurrency int) uint {
+	if concurrency > 0 && workers > concurrency {
+		workers = concurrency
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	n := (pending + workers - 1) / workers
+	if n < 1 {
+		return 1
+	}
+
+	return uint(n)
+}
+
+// len returns the number of queued WAL files.
+func (q *decodeQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.pending)
+}
+
+// dropBefore removes and returns the queued WAL files that sort before walFile,
+// i.e. older segments on the same timeline and every segment on an earlier
+// timeline.
+func (q *decodeQueue) dropBefore(walFile pg.WALFilename) []pg.WALFilename {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var dropped []pg.WALFilename
+	for pending := range q.pending {
+		if pending < walFile {
+			dropped = append(dropped, pending)
+			delete(q.pending, pending)
+		}
+	}
+	sort.Slice(dropped, func(i, j int) bool { return dropped[i] < dropped[j] })
+
+	return dropped
+}
+
+// close wakes all waiters.  Queued WAL files are discarded.
+func (q *decodeQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.pending = make(map[pg.WALFilename]struct{})
+	q.cond.Broadcast()
+}
+
+// feedOrder hands the pages of concurrently decoded WAL files to the IO cache in
+// WAL order.  A decode that starts while decodes of earlier WAL files are
+// running holds its pages back until those decodes have prefaulted theirs, so
+// that the segments PostgreSQL replays first are prefaulted first.  Only
+// running decodes are waited for, a decode of an earlier WAL file that starts
+// later doesn't hold back the decodes already running.  See hold for how many
+// pages a waiting decode holds back.
+type feedOrder struct {
+	lock    sync.Mutex
+	running []*feedTurn
+}
+
+// feedTurn is a decode's place in the feedOrder.
+type feedTurn struct {
+	walFile pg.WALFilename
+	done    chan struct{}
+}
+
+// enter registers a decode starting at walFile.  The returned channel is closed
+// once every decode of an earlier WAL file that was running has left, and is
+// nil if there were none.  leave must be called once the decode has prefaulted
+// its pages.
+func (o *feedOrder) enter(walFile pg.WALFilename) (ready <-chan struct{}, leave func()) {
+	turn := &feedTurn{
+		walFile: walFile,
+		done:    make(chan struct{}),
+	}
+
+	o.lock.Lock()
+	var earlier []chan struct{}
+	for _, running := range o.running {
+		if running.walFile < walFile {
+			earlier = append(earlier, running.done)
+		}
+	}
+	o.running = append(o.running, turn)
+	o.lock.Unlock()
+
+	leave = func() {
+		o.lock.Lock()
+		for i, running := range o.running {
+			if running == turn {
+				o.running = append(o.running[:i], o.running[i+1:]...)
+				break
+			}
+		}
+		o.lock.Unlock()
+		close(turn.done)
+	}
+
+	if len(earlier) == 0 {
+		return nil, leave
+	}
+
+	c := make(chan struct{})
+	go func() {
+		for _, done := range earlier {
+			<-done
+		}
+		close(c)
+	}()
+
+	return c, leave
+}
+
+// hold reads the pages of a decode from ioReqs until ready is closed and
+// returns them.  Once max pages are held ioReqs is left unread, backing the
+// pipeline up to pg_waldump(1).  The decode timeout only runs while
+// pg_waldump(1) is being read, so a decode waiting for its turn is never
+// killed.
+func hold(ready <-chan struct{}, ioReqs <-chan structs.IOCacheKey, max int) []structs.IOCacheKey {
+	var held []structs.IOCacheKey
+	for reqs := ioReqs; ready != nil; {
+		if len(held) >= max {
+			reqs = nil
+		}
+
+		select {
+		case <-ready:
+			ready = nil
+		case ioReq, ok := <-reqs:
+			if !ok {
+				reqs = nil
+				continue
+			}
+			held = append(held, ioReq)
+		}
+	}
+
+	return held
+}
+
+// nextWALFile returns the WAL file following walFile on the same timeline.
+func nextWALFile(walFile pg.WALFilename) (pg.WALFilename, error) {
+	timelineID, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return "", err
+	}
+
+	return lsn.AddBytes(pg.WALSegmentSize).WALFilename(timelineID), nil
+}
+
+// acquireDecoder blocks until fewer than the maximum number of pg_waldump(1)
+// processes are running or ctx is done.  Every successful acquireDecoder must
+// be followed by a releaseDecoder.
+func (wc *WALCache) acquireDecoder(ctx context.Context) error {
+	if wc.decoders == nil {
+		return nil
+	}
+
+	select {
+	case wc.decoders <- struct{}{}:
+	default:
+		decoderWaits.Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case wc.decoders <- struct{}{}:
+		}
+	}
+	decodersRunning.Add(1)
+
+	return nil
+}
+
+// releaseDecoder frees the slot held by a pg_waldump(1) process.
+func (wc *WALCache) releaseDecoder() {
+	if wc.decoders == nil {
+		return
+	}
+
+	decodersRunning.Add(-1)
+	<-wc.decoders
+}
+
+// superviseDecoder runs a decoder worker goroutine until shutdown, restarting
+// the goroutine if it panics.  Each run of WAL files is still decoded by its
+// own pg_waldump(1) process.
+func (wc *WALCache) superviseDecoder(threadID int) {
+	defer wc.wg.Done()
+
+	for {
+		err := wc.runDecoder(threadID)
+		if err == nil {
+			return
+		}
+
+		decoderRestarts.Inc()
+		wc.log.Error().Err(err).Int("wal-worker-thread-id", threadID).
+			Dur("restart-delay", decoderRestartDelay).Msg("WAL decoder worker failed, restarting")
+
+		select {
+		case <-wc.shutdownCtx.Done():
+			return
+		case <-time.After(decoderRestartDelay):
+		}
+	}
+}
+
+// runDecoder decodes runs of WAL files until the decode queue is closed.  A
+// panic while decoding is returned as an error so the worker can be restarted.
+func (wc *WALCache) runDecoder(threadID int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	for {
+		walFiles, ok := wc.decodeQueue.pop(wc.decodeBatchSize)
+		if !ok {
+			return nil
+		}
+
+		wc.decode(walFiles)
+	}
+}
+
+// decode prefaults walFiles and marks them as no longer in flight, even if
+// decoding panics.
+func (wc *WALCache) decode(walFiles []pg.WALFilename) {
+	numConcurrentWALLock.Lock()
+	numConcurrentWALs++
+	numConcurrentWALLock.Unlock()
+
+	defer func() {
+		numConcurrentWALLock.Lock()
+		numConcurrentWALs--
+		numConcurrentWALLock.Unlock()
+
+		// Inserts into wc.inFlightWALFile happen in FaultWALFile()
+		wc.inFlightLock.Lock()
+		for _, walFile := range walFiles {
+			delete(wc.inFlightWALFiles, walFile)
+		}
+		wc.inFlightCond.Broadcast()
+		wc.inFlightLock.Unlock()
+	}()
+
+	// pg_waldump(1) only decodes a range of segments from a single directory.
+	// Decode segments individually if any of them need to be fetched from the
+	// archive.
+	runs := [][]pg.WALFilename{walFiles}
+	if len(walFiles) > 1 && !wc.allLocal(walFiles) {
+		runs = runs[:0]
+		for _, walFile := range walFiles {
+			runs = append(runs, []pg.WALFilename{walFile})
+		}
+	}
+
+	for _, run := range runs {
+		decoderInvocations.Inc()
+		decoderSegments.Add(uint64(len(run)))
+
+		start := time.Now()
+		err := wc.prefaultWALFiles(run)
+		switch {
+		case err == nil:
+			atomic.StoreUint64(&wc.failures, 0)
+			for _, walFile := range run {
+				wc.quarantine.release(walFile)
+			}
+			if budget := wc.cfg.SegmentBudget * time.Duration(len(run)); budget > 0 {
+				if elapsed := time.Since(start); elapsed > budget {
+					overBudget.Inc()
+					wc.skipAhead(run[len(run)-1], elapsed, budget)
+				}
+			}
+			continue
+		case errors.Cause(err) == errPartialDecode:
+			// The records decoded so far were prefaulted.  The partially decoded
+			// WAL file, and the WAL files after it, are decoded again from where
+			// this decode stopped the next time they are requested.
+			partialDecodes.Inc()
+			atomic.StoreUint64(&wc.failures, 0)
+
+			resumed := false
+			for _, walFile := range run {
+				wc.quarantine.release(walFile)
+				if !resumed {
+					_, resumed = wc.resumeLSN(walFile)
+				}
+				if resumed {
+					wc.c.Remove(walFile)
+				}
+			}
+			wc.log.Debug().Err(err).Msg("partially decoded WAL")
+			continue
+		case errors.Cause(err) == errDecodeTimeout:
+			// Don't let a wedged WAL file tie up a worker on every scan.
+			decoderTimeouts.Inc()
+			for _, walFile := range run {
+				delay := wc.quarantine.add(walFile)
+				wc.log.Warn().Str("walfile", string(walFile)).Dur("retry-delay", delay).Msg("quarantined WAL file")
+			}
+		default:
+			wc.log.Warn().Err(err).Msg("prefault failed")
+		}
+
+		atomic.AddUint64(&wc.failures, 1)
+
+		// If we had a problem prefaulting in the WAL files, for whatever
+		// reason, attempt to remove them from the cache.
+		for _, walFile := range run {
+			wc.c.Remove(walFile)
+		}
+	}
+}
+
+// skipAhead is called when decoding walFile took longer than its budget and
+// discards the queued WAL files that PostgreSQL has already replayed past.
+// Prefaulting them would only delay the segments still ahead of replay.
+func (wc *WALCache) skipAhead(walFile pg.WALFilename, elapsed, budget time.Duration) {
+	replayPosition := wc.ReplayPosition()
+	if replayPosition == "" {
+		return
+	}
+
+	skipped := wc.decodeQueue.dropBefore(replayPosition)
+	if len(skipped) == 0 {
+		return
+	}
+	segmentsSkipped.Add(uint64(len(skipped)))
+
+	// Skipped WAL files stay in the cache so that they aren't queued again by
+	// the next scan.
+	wc.inFlightLock.Lock()
+	for _, skippedFile := range skipped {
+		delete(wc.inFlightWALFiles, skippedFile)
+	}
+	wc.inFlightCond.Broadcast()
+	wc.inFlightLock.Unlock()
+
+	wc.log.Info().Str("walfile", string(walFile)).Dur("elapsed", elapsed).Dur("budget", budget).
+		Str("replay-walfile", string(replayPosition)).Int("skipped", len(skipped)).
+		Str("first-skipped", string(skipped[0])).Str("last-skipped", string(skipped[len(skipped)-1])).
+		Msg("segment exceeded its processing budget, skipping ahead to the replay position")
+}
+
+// allLocal returns true if all of walFiles are present in the WAL directory.
+func (wc *WALCache) allLocal(walFiles []pg.WALFilename) bool {
+	for _, walFile := range walFiles {
+		if _, err := os.Stat(wc.walFilePath(walFile)); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
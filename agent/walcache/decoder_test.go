@@ -0,0 +1,341 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestNextWALFile(t *testing.T) {
+	tests := []struct {
+		in   pg.WALFilename
+		out  pg.WALFilename
+		fail bool
+	}{
+		{in: "000000010000000000000001", out: "000000010000000000000002"},
+		{in: "0000000200000000000000FF", out: "000000020000000100000000"},
+		{in: "00000001000000000000000", fail: true},
+	}
+
+	for _, test := range tests {
+		out, err := nextWALFile(test.in)
+		if test.fail {
+			if err == nil {
+				t.Fatalf("expected failure for %q", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unable to find successor of %q: %v", test.in, err)
+		}
+		if out != test.out {
+			t.Fatalf("bad successor of %q: got %q, want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestDecodeQueue(t *testing.T) {
+	q := newDecodeQueue(1)
+	for _, walFile := range []pg.WALFilename{
+		"000000010000000000000005",
+		"000000010000000000000003",
+		"000000010000000000000004",
+		"000000010000000000000001",
+		"000000010000000000000006",
+		"000000020000000000000007",
+	} {
+		if !q.push(walFile) {
+			t.Fatalf("unable to push %q", walFile)
+		}
+	}
+
+	var got [][]pg.WALFilename
+	for q.len() > 0 {
+		run, ok := q.pop(2)
+		if !ok {
+			t.Fatalf("unexpected closed queue")
+		}
+		got = append(got, run)
+	}
+
+	// Runs start at the oldest WAL file, stop at gaps, timeline changes, and
+	// the maximum run length.
+	want := [][]pg.WALFilename{
+		{"000000010000000000000001"},
+		{"000000010000000000000003", "000000010000000000000004"},
+		{"000000010000000000000005", "000000010000000000000006"},
+		{"000000020000000000000007"},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("run diff: (-got +want)\n%s", diff)
+	}
+
+	q.close()
+	if _, ok := q.pop(2); ok {
+		t.Fatalf("expected closed queue")
+	}
+	if q.push("000000010000000000000008") {
+		t.Fatalf("push to a closed queue")
+	}
+}
+
+func TestRunLength(t *testing.T) {
+	tests := []struct {
+		pending     int
+		workers     int
+		concurrency int
+		n           uint
+	}{
+		{ // 0: no other worker is idle
+			pending: 8, workers: 1, concurrency: 4, n: 8,
+		},
+		{ // 1
+			pending: 8, workers: 4, concurrency: 4, n: 2,
+		},
+		{ // 2: more idle workers than can decode at once
+			pending: 8, workers: 8, concurrency: 2, n: 4,
+		},
+		{ // 3
+			pending: 3, workers: 4, concurrency: 4, n: 1,
+		},
+		{ // 4: unlimited
+			pending: 9, workers: 2, concurrency: 0, n: 5,
+		},
+	}
+
+	for n, test := range tests {
+		if got := runLength(test.pending, test.workers, test.concurrency); got != test.n {
+			t.Fatalf("%d: got %d, want %d", n, got, test.n)
+		}
+	}
+}
+
+func TestDecodeQueueShare(t *testing.T) {
+	q := newDecodeQueue(4)
+
+	// Three idle workers share a backlog of six consecutive segments
+	runs := make(chan []pg.WALFilename, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			run, _ := q.pop(4)
+			runs <- run
+		}()
+	}
+	for {
+		q.lock.Lock()
+		waiting := q.waiting
+		q.lock.Unlock()
+		if waiting == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	q.lock.Lock()
+	for _, walFile := range []pg.WALFilename{
+		"000000010000000000000001",
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000004",
+		"000000010000000000000005",
+		"000000010000000000000006",
+	} {
+		q.pending[walFile] = struct{}{}
+	}
+	q.cond.Broadcast()
+	q.lock.Unlock()
+
+	var got []int
+	for i := 0; i < 3; i++ {
+		got = append(got, len(<-runs))
+	}
+	if diff := pretty.Compare(got, []int{2, 2, 2}); diff != "" {
+		t.Fatalf("run lengths diff: (-got +want)\n%s", diff)
+	}
+	q.close()
+}
+
+func TestFeedOrder(t *testing.T) {
+	var o feedOrder
+
+	ready2, leave2 := o.enter("000000010000000000000002")
+	if ready2 != nil {
+		t.Fatal("first decode held back")
+	}
+
+	// A later WAL file waits for the earlier one, an earlier WAL file doesn't
+	// wait for the later one already running.
+	ready3, leave3 := o.enter("000000010000000000000003")
+	ready1, leave1 := o.enter("000000010000000000000001")
+	if ready1 != nil {
+		t.Fatal("earlier WAL file held back by a later one")
+	}
+	select {
+	case <-ready3:
+		t.Fatal("later WAL file not held back")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	leave2()
+	select {
+	case <-ready3:
+	case <-time.After(time.Second):
+		t.Fatal("later WAL file still held back")
+	}
+	leave3()
+	leave1()
+
+	if n := len(o.running); n != 0 {
+		t.Fatalf("%d decodes still running", n)
+	}
+}
+
+func TestDecodeQueueDropBefore(t *testing.T) {
+	q := newDecodeQueue(1)
+	for _, walFile := range []pg.WALFilename{
+		"000000010000000000000009",
+		"000000010000000000000003",
+		"000000010000000000000004",
+		"000000020000000000000005",
+		"000000020000000000000008",
+	} {
+		q.push(walFile)
+	}
+
+	// Older segments and earlier timelines are dropped, the replay position and
+	// everything after it stay queued.
+	got := q.dropBefore("000000020000000000000008")
+	want := []pg.WALFilename{
+		"000000010000000000000003",
+		"000000010000000000000004",
+		"000000010000000000000009",
+		"000000020000000000000005",
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("dropped diff: (-got +want)\n%s", diff)
+	}
+
+	if n := q.len(); n != 1 {
+		t.Fatalf("%d WAL files queued, want 1", n)
+	}
+	if got := q.dropBefore("000000020000000000000008"); len(got) != 0 {
+		t.Fatalf("dropped %q twice", got)
+	}
+}
+
+func TestAcquireDecoder(t *testing.T) {
+	wc := &WALCache{decoders: make(chan struct{}, 1)}
+
+	if err := wc.acquireDecoder(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second decoder waits for the first to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wc.acquireDecoder(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("acquired a second decoder: %v", err)
+	}
+
+	wc.releaseDecoder()
+	if err := wc.acquireDecoder(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wc.releaseDecoder()
+
+	// Unlimited
+	wc = &WALCache{}
+	for i := 0; i < 2; i++ {
+		if err := wc.acquireDecoder(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	var nilWatchdog *watchdog
+	nilWatchdog.start()
+	nilWatchdog.stop()
+	if nilWatchdog.Expired() {
+		t.Fatalf("nil watchdog expired")
+	}
+	if newWatchdog(0, func() {}) != nil {
+		t.Fatalf("expected no watchdog without a timeout")
+	}
+
+	expired := make(chan struct{})
+	w := newWatchdog(20*time.Millisecond, func() { close(expired) })
+	defer w.stop()
+
+	// A stopped watchdog doesn't expire no matter how long it is stopped.
+	w.start()
+	w.stop()
+	time.Sleep(50 * time.Millisecond)
+	if w.Expired() {
+		t.Fatalf("stopped watchdog expired")
+	}
+
+	w.start()
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatalf("watchdog didn't expire")
+	}
+	if !w.Expired() {
+		t.Fatalf("expected watchdog to be expired")
+	}
+}
+
+func TestHold(t *testing.T) {
+	ready := make(chan struct{})
+	ioReqs := make(chan structs.IOCacheKey, 4)
+	for i := 0; i < 4; i++ {
+		ioReqs <- structs.IOCacheKey{Block: pg.HeapBlockNumber(i)}
+	}
+
+	held := make(chan []structs.IOCacheKey)
+	go func() {
+		held <- hold(ready, ioReqs, 2)
+	}()
+
+	// Once two pages are held the rest are left unread
+	deadline := time.Now().Add(time.Second)
+	for len(ioReqs) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pages unread, want 2", len(ioReqs))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(ioReqs); n != 2 {
+		t.Fatalf("%d pages unread, want 2", n)
+	}
+
+	close(ready)
+	want := []structs.IOCacheKey{{Block: 0}, {Block: 1}}
+	if diff := pretty.Compare(<-held, want); diff != "" {
+		t.Fatalf("held diff: (-got +want)\n%s", diff)
+	}
+
+	// Without anything to wait for nothing is held
+	if got := hold(nil, ioReqs, 2); len(got) != 0 {
+		t.Fatalf("held %d pages without waiting", len(got))
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// A WAL file whose decode timed out is not decoded again until its retry is
+// due.  The delay starts at quarantineMinDelay and doubles with each
+// consecutive timeout, up to quarantineMaxDelay.
+const (
+	quarantineMinDelay = time.Minute
+	quarantineMaxDelay = 30 * time.Minute
+)
+
+var quarantinedWALFiles = metrics.NewGauge("wal_quarantined_files", "Number of WAL files not decoded because their last decode timed out.")
+
+// quarantine tracks the WAL files whose decode timed out.
+type quarantine struct {
+	lock     sync.Mutex
+	walFiles map[pg.WALFilename]quarantined
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// quarantined is a WAL file's number of consecutive timeouts and when it can
+// next be decoded.
+type quarantined struct {
+	timeouts uint
+	retry    time.Time
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		walFiles: make(map[pg.WALFilename]quarantined),
+		now:      time.Now,
+	}
+}
+
+// add quarantines walFile after a timeout and returns the delay until it can
+// be decoded again.  WAL files that were not retried long after their retry
+// was due are forgotten.
+func (q *quarantine) add(walFile pg.WALFilename) time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := q.now()
+	for f, qf := range q.walFiles {
+		if now.Sub(qf.retry) > quarantineMaxDelay {
+			delete(q.walFiles, f)
+		}
+	}
+
+	qf := q.walFiles[walFile]
+	delay := quarantineMinDelay
+	for i := uint(0); i < qf.timeouts && delay < quarantineMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > quarantineMaxDelay {
+		delay = quarantineMaxDelay
+	}
+
+	qf.timeouts++
+	qf.retry = now.Add(delay)
+	q.walFiles[walFile] = qf
+	quarantinedWALFiles.Set(float64(len(q.walFiles)))
+
+	return delay
+}
+
+// held returns true if walFile is quarantined and its retry is not yet due.
+func (q *quarantine) held(walFile pg.WALFilename) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	qf, found := q.walFiles[walFile]
+	return found && q.now().Before(qf.retry)
+}
+
+// release forgets walFile after it has been decoded.
+func (q *quarantine) release(walFile pg.WALFilename) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, found := q.walFiles[walFile]; !found {
+		return
+	}
+
+	delete(q.walFiles, walFile)
+	quarantinedWALFiles.Set(float64(len(q.walFiles)))
+}
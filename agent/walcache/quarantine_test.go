@@ -0,0 +1,59 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestQuarantine(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	q := newQuarantine()
+	q.now = func() time.Time { return now }
+
+	const walFile = pg.WALFilename("000000010000000000000001")
+	if q.held(walFile) {
+		t.Fatal("held before timing out")
+	}
+
+	// Consecutive timeouts back off up to the maximum delay
+	for n, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 30 * time.Minute, 30 * time.Minute} {
+		if delay := q.add(walFile); delay != want {
+			t.Fatalf("%d: delay %s, want %s", n, delay, want)
+		}
+	}
+
+	if !q.held(walFile) {
+		t.Fatal("not held after timing out")
+	}
+	now = now.Add(30 * time.Minute)
+	if q.held(walFile) {
+		t.Fatal("held after the retry was due")
+	}
+
+	q.release(walFile)
+	if delay := q.add(walFile); delay != time.Minute {
+		t.Fatalf("delay %s after release, want 1m", delay)
+	}
+
+	// WAL files that were never retried are forgotten
+	now = now.Add(time.Hour)
+	q.add("000000010000000000000002")
+	if _, found := q.walFiles[walFile]; found {
+		t.Fatalf("%s not forgotten", walFile)
+	}
+}
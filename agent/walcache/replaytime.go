@@ -0,0 +1,127 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// maxCommitTimeSegments bounds the number of WAL files whose latest commit
+// time is remembered.
+const maxCommitTimeSegments = 1024
+
+// pg_waldump(1) prints the timestamp of commit and abort records as
+// "2017-09-30 17:23:38.416563 UTC", in its own time zone.
+var pgWalDumpCommitTimeRE = regexp.MustCompile(`desc: (?:COMMIT|ABORT) (\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{6}) ([^;\s]+)`)
+
+const (
+	commitTimeLayout     = "2006-01-02 15:04:05.999999"
+	commitTimeZoneLayout = commitTimeLayout + " MST"
+)
+
+// parseCommitTime returns the timestamp of the commit or abort record line.
+// Zones Go can't parse (e.g. "+03") are assumed to be the local time zone,
+// which pg_waldump(1) inherits from the agent.
+func parseCommitTime(line []byte) (time.Time, bool) {
+	m := pgWalDumpCommitTimeRE.FindSubmatch(line)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	if t, err := time.ParseInLocation(commitTimeZoneLayout, string(m[1])+" "+string(m[2]), time.Local); err == nil {
+		return t, true
+	}
+
+	t, err := time.ParseInLocation(commitTimeLayout, string(m[1]), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// _CommitTimes remembers the time of the latest commit or abort record
+// decoded from each WAL file.  Recovery targets are compared against these
+// timestamps, not the time of checkpoints.
+type _CommitTimes struct {
+	lock   sync.Mutex
+	latest map[pg.WALFilename]time.Time
+	order  []pg.WALFilename
+}
+
+func newCommitTimes() *_CommitTimes {
+	return &_CommitTimes{
+		latest: make(map[pg.WALFilename]time.Time),
+	}
+}
+
+// record remembers t if it is the latest commit time decoded from walFile.
+func (ct *_CommitTimes) record(walFile pg.WALFilename, t time.Time) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	prev, found := ct.latest[walFile]
+	if !found {
+		for len(ct.order) >= maxCommitTimeSegments {
+			delete(ct.latest, ct.order[0])
+			ct.order = ct.order[1:]
+		}
+		ct.order = append(ct.order, walFile)
+	}
+
+	if t.After(prev) {
+		ct.latest[walFile] = t
+	}
+}
+
+// before returns the latest commit time decoded from the WAL files before
+// walFile.  found is false if no commit has been decoded from them.
+func (ct *_CommitTimes) before(walFile pg.WALFilename) (latest time.Time, found bool) {
+	_, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	for f, t := range ct.latest {
+		_, fLSN, err := pg.ParseWalfile(f)
+		if err != nil || fLSN >= lsn {
+			continue
+		}
+
+		if t.After(latest) {
+			latest, found = t, true
+		}
+	}
+
+	return latest, found
+}
+
+// ReplayTimestamp returns the time of the latest commit or abort record
+// decoded from the WAL files before walFile.  While recovery is replaying
+// walFile its replay timestamp is at least this time.  found is false if
+// commit times aren't recorded or none were decoded before walFile.
+func (wc *WALCache) ReplayTimestamp(walFile pg.WALFilename) (t time.Time, found bool) {
+	if wc.commitTimes == nil {
+		return time.Time{}, false
+	}
+
+	return wc.commitTimes.before(walFile)
+}
@@ -0,0 +1,70 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCommitTime(t *testing.T) {
+	tests := []struct {
+		input string
+		out   time.Time
+		found bool
+	}{
+		{ // 0
+			input: `rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync`,
+			out:   time.Date(2017, time.September, 30, 17, 23, 38, 416563000, time.UTC),
+			found: true,
+		},
+		{ // 1
+			input: `rmgr: Transaction len (rec/tot):     34/    34, tx:        996, lsn: 0/03000888, prev 0/03000840, desc: ABORT 2017-09-30 17:24:01.000001 UTC`,
+			out:   time.Date(2017, time.September, 30, 17, 24, 1, 1000, time.UTC),
+			found: true,
+		},
+		{ // 2
+			input: `rmgr: Heap        len (rec/tot):     54/  1222, tx:        995, lsn: 0/03000080, prev 0/03000060, desc: INSERT off 4, blkref #0: rel 1664/0/1262 blk 0 FPW`,
+		},
+	}
+
+	for n, test := range tests {
+		out, found := parseCommitTime([]byte(test.input))
+		if found != test.found {
+			t.Fatalf("%d: found %t, want %t", n, found, test.found)
+		}
+		if !out.Equal(test.out) {
+			t.Fatalf("%d: time %s, want %s", n, out, test.out)
+		}
+	}
+}
+
+func TestCommitTimesBefore(t *testing.T) {
+	t0 := time.Date(2019, time.July, 10, 12, 0, 0, 0, time.UTC)
+
+	ct := newCommitTimes()
+	ct.record("000000010000000000000005", t0)
+	ct.record("000000010000000000000005", t0.Add(-time.Second))
+	ct.record("000000010000000000000006", t0.Add(time.Minute))
+
+	if _, found := ct.before("000000010000000000000005"); found {
+		t.Fatalf("found a commit time before the first WAL file")
+	}
+	if latest, found := ct.before("000000010000000000000006"); !found || !latest.Equal(t0) {
+		t.Fatalf("latest commit before 6 is %s (%t), want %s", latest, found, t0)
+	}
+	if latest, _ := ct.before("000000010000000000000009"); !latest.Equal(t0.Add(time.Minute)) {
+		t.Fatalf("latest commit before 9 is %s, want %s", latest, t0.Add(time.Minute))
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// ScanBlocks decodes walFile from the WAL directory, starting at from if it
+// falls within walFile, and calls fn with every relation block referenced by
+// its records.  Unlike FaultWALFile, nothing is prefaulted and the WAL archive
+// is not consulted.  Decoding errors after at least one block was found are
+// ignored: the last segment in pg_wal is usually only partially written.
+func (wc *WALCache) ScanBlocks(ctx context.Context, walFile pg.WALFilename, from pg.LSN, fn func(structs.IOCacheKey)) error {
+	if err := wc.acquireDecoder(ctx); err != nil {
+		return errors.Wrap(err, "unable to start pg_waldump(1)")
+	}
+	defer wc.releaseDecoder()
+
+	walFileAbs := wc.walFilePath(walFile)
+	args := []string{walFileAbs}
+	if _, lsn, err := pg.ParseWalfile(walFile); err == nil && wc.lsnRE != nil &&
+		from != pg.InvalidLSN && from.SegmentNumber() == lsn.SegmentNumber() {
+		args = append([]string{"-s", waldumpLSN(from)}, args...)
+	}
+	cmd := wc.waldumpCommand(ctx, args...)
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+
+	dumpOutReader, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrapf(err, "unable to open stdout for pg_waldump(1): %q", errbuf.String())
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "unable to read from pg_waldump(1): %q", errbuf.String())
+	}
+
+	var blocks uint64
+	scanner := bufio.NewScanner(dumpOutReader)
+	for scanner.Scan() {
+		for _, matches := range wc.re.FindAllSubmatch(scanner.Bytes(), -1) {
+			key, ok := parseBlockRef(matches)
+			if !ok {
+				continue
+			}
+
+			blocks++
+			fn(key)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil && blocks == 0 {
+		return errors.Wrapf(err, "pg_waldump(1) returned uncleanly when reading %+q: %+q", walFileAbs, errbuf.String())
+	}
+
+	return nil
+}
+
+// ParseBlockRefs returns the relation blocks referenced by a line of
+// pg_waldump(1) output.
+func ParseBlockRefs(line []byte) []structs.IOCacheKey {
+	var keys []structs.IOCacheKey
+	for _, matches := range pgWalDumpRE.FindAllSubmatch(line, -1) {
+		if key, ok := parseBlockRef(matches); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// parseBlockRef converts the tablespace, database, relation, and block
+// submatches of a block reference into an IOCacheKey.  parseBlockRef returns
+// false for malformed references and, as in prefaultWALFiles, references to
+// database 0.
+func parseBlockRef(matches [][]byte) (structs.IOCacheKey, bool) {
+	var fields [4]uint64
+	for i := range fields {
+		n, err := strconv.ParseUint(string(matches[i+1]), 10, 64)
+		if err != nil {
+			return structs.IOCacheKey{}, false
+		}
+		fields[i] = n
+	}
+
+	if fields[1] == 0 {
+		return structs.IOCacheKey{}, false
+	}
+
+	return structs.IOCacheKey{
+		Tablespace: pg.OID(fields[0]),
+		Database:   pg.OID(fields[1]),
+		Relation:   pg.OID(fields[2]),
+		Block:      pg.HeapBlockNumber(fields[3]),
+	}, true
+}
@@ -0,0 +1,228 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/walgen"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// fakeWALDumpEnv makes the test binary act as pg_waldump(1), decoding
+// segments written by walgen.
+const fakeWALDumpEnv = "PG_PREFAULTER_TEST_FAKE_WALDUMP"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeWALDumpEnv) == "" {
+		os.Exit(m.Run())
+	}
+
+	// Only the records between -s and -e are printed
+	args := os.Args[1:]
+	start, end := pg.LSN(0), pg.InvalidLSN
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-s", "-e":
+			lsn, err := pg.ParseLSN(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "pg_waldump: FATAL:  %v\n", err)
+				os.Exit(1)
+			}
+			if args[0] == "-s" {
+				start = lsn
+			} else {
+				end = lsn
+			}
+			args = args[2:]
+		default:
+			args = args[1:]
+		}
+	}
+	var endPath string
+	if len(args) > 1 {
+		endPath = args[1]
+	}
+
+	var out bytes.Buffer
+	err := walgen.Dump(&out, args[0], endPath)
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		m := pgWalDumpLSNRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if lsn, _ := pg.ParseLSN(m[1]); lsn >= start && lsn < end {
+			os.Stdout.WriteString(line)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pg_waldump: FATAL:  %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// newGeneratedWALCache writes segments of workload w to a temporary PGDATA and
+// returns a WALCache decoding them with the fake pg_waldump(1).
+func newGeneratedWALCache(tb testing.TB, w walgen.Workload, segments uint) (*WALCache, walgen.Result, func()) {
+	pgdata, err := ioutil.TempDir("", "walcache")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cleanup := func() {
+		os.RemoveAll(pgdata)
+		os.Unsetenv(fakeWALDumpEnv)
+	}
+
+	walDir := filepath.Join(pgdata, pg.WALDirectory)
+	if err := os.Mkdir(walDir, 0700); err != nil {
+		cleanup()
+		tb.Fatal(err)
+	}
+
+	g, err := walgen.NewGenerator(w)
+	if err != nil {
+		cleanup()
+		tb.Fatal(err)
+	}
+	res, err := walgen.Write(g, walgen.Options{Dir: walDir, StartSegment: 1, Segments: segments})
+	if err != nil {
+		cleanup()
+		tb.Fatal(err)
+	}
+
+	os.Setenv(fakeWALDumpEnv, "1")
+	wc := &WALCache{
+		cfg: &config.WALCacheConfig{
+			PGDataPath: pgdata,
+		},
+		walTranslations: &pg.WALTranslations{Directory: pg.WALDirectory},
+		re:              pgWalDumpRE,
+	}
+	wc.SetWalDumpPath(os.Args[0])
+
+	return wc, res, cleanup
+}
+
+func TestParseBlockRef(t *testing.T) {
+	tests := []struct {
+		version string
+		input   string
+		keys    []structs.IOCacheKey
+	}{
+		{ // 0
+			version: "pg15+xlog-fpi",
+			input:   `rmgr: XLOG        len (rec/tot):     49/  8213, tx:          0, lsn: 0/0152A2D0, prev 0/0152A298, desc: FPI , blkref #0: rel 1663/5/1259 blk 0 FPW`,
+			keys:    []structs.IOCacheKey{{Tablespace: 1663, Database: 5, Relation: 1259, Block: 0}},
+		},
+		{ // 1
+			version: "pg16+xlog-fpi-shared",
+			input:   `rmgr: XLOG        len (rec/tot):     49/  8197, tx:          0, lsn: 0/0153B238, prev 0/0153B200, desc: FPI , blkref #0: rel 1664/0/1262 blk 0 FPW`,
+		},
+		{ // 2
+			version: "pg16+update",
+			input:   `rmgr: Heap        len (rec/tot):     89/    89, tx:        745, lsn: 0/0153B278, prev 0/0153B238, desc: UPDATE old_xmax: 745, old_off: 2, old_infobits: [], flags: 0x10, new_xmax: 0, new_off: 3, blkref #0: rel 1663/5/16384 blk 4, blkref #1: rel 1663/5/16384 blk 3`,
+			keys: []structs.IOCacheKey{
+				{Tablespace: 1663, Database: 5, Relation: 16384, Block: 4},
+				{Tablespace: 1663, Database: 5, Relation: 16384, Block: 3},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		var keys []structs.IOCacheKey
+		for _, matches := range pgWalDumpRE.FindAllSubmatch([]byte(test.input), -1) {
+			if key, ok := parseBlockRef(matches); ok {
+				keys = append(keys, key)
+			}
+		}
+
+		if diff := pretty.Compare(keys, test.keys); diff != "" {
+			t.Fatalf("%d (%s) keys diff: (-got +want)\n%s", i, test.version, diff)
+		}
+	}
+}
+
+func TestScanBlocksGenerated(t *testing.T) {
+	w := walgen.Workload{
+		Seed:          7,
+		Mix:           walgen.Mix{walgen.HeapInsert: 1, walgen.Commit: 1},
+		Tablespace:    1663,
+		Database:      16384,
+		FirstRelation: 16385,
+		Relations:     10,
+		Blocks:        100,
+	}
+	wc, res, cleanup := newGeneratedWALCache(t, w, 1)
+	defer cleanup()
+
+	blocks := make(map[structs.IOCacheKey]struct{})
+	var refs int
+	err := wc.ScanBlocks(context.Background(), pg.WALFilename(filepath.Base(res.Files[0])), pg.InvalidLSN, func(key structs.IOCacheKey) {
+		refs++
+		blocks[key] = struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every heap insertion references one block of one of the relations, and
+	// the relations grow by a block every 40 insertions.
+	if refs == 0 || uint64(refs) >= res.Records {
+		t.Fatalf("%d block references in %d records", refs, res.Records)
+	}
+	for key := range blocks {
+		if key.Tablespace != w.Tablespace || key.Database != w.Database ||
+			key.Relation < w.FirstRelation || key.Relation >= w.FirstRelation+pg.OID(w.Relations) ||
+			key.Block < w.Blocks-1 {
+			t.Fatalf("unexpected block %+v", key)
+		}
+	}
+	if want := refs/40 + int(w.Relations); len(blocks) > want {
+		t.Fatalf("%d distinct blocks, want at most %d", len(blocks), want)
+	}
+}
+
+func BenchmarkScanBlocksGenerated(b *testing.B) {
+	wc, res, cleanup := newGeneratedWALCache(b, walgen.Workload{
+		Seed:          7,
+		Mix:           walgen.DefaultMix,
+		Tablespace:    1663,
+		Database:      16384,
+		FirstRelation: 16385,
+		Relations:     100,
+		Blocks:        10000,
+		Skew:          1.1,
+	}, 1)
+	defer cleanup()
+
+	walFile := pg.WALFilename(filepath.Base(res.Files[0]))
+	b.SetBytes(int64(pg.WALSegmentSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := wc.ScanBlocks(context.Background(), walFile, pg.InvalidLSN, func(structs.IOCacheKey) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
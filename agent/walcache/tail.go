@@ -0,0 +1,320 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// tailRescanInterval is how long the WAL segment being tailed may go without
+// growing before pg_wal is searched for a newer segment, e.g. one on a new
+// timeline.
+const tailRescanInterval = 10 * time.Second
+
+var (
+	tailDecodes = metrics.NewCounter("wal_tail_decodes_total", "Number of times the records that landed in the WAL segment being written were decoded.")
+	tailBlocks  = metrics.NewCounter("wal_tail_blocks_total", "Number of blocks prefaulted from the WAL segment being written.")
+)
+
+// walTail is how far TailWAL has decoded the WAL segment being written.
+type walTail struct {
+	walFile  pg.WALFilename
+	segStart pg.LSN
+
+	// validEnd is the end of the last page of walFile with a valid header and
+	// modTime the modification time of walFile when validEnd was found.
+	// grewAt is when either last changed.
+	validEnd pg.LSN
+	modTime  time.Time
+	grewAt   time.Time
+
+	// resume is where the next decode starts.
+	resume pg.LSN
+}
+
+// segmentStart returns the LSN of the first byte of walFile.  ParseWalfile
+// returns the LSN of the second.
+func segmentStart(walFile pg.WALFilename) (pg.LSN, error) {
+	_, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return pg.InvalidLSN, err
+	}
+
+	return pg.NewLSN(lsn.SegmentNumber(), 0), nil
+}
+
+// newWALTail returns the start of tailing walFile.
+func newWALTail(walFile pg.WALFilename) (walTail, error) {
+	segStart, err := segmentStart(walFile)
+	if err != nil {
+		return walTail{}, err
+	}
+
+	return walTail{
+		walFile:  walFile,
+		segStart: segStart,
+		validEnd: segStart,
+		resume:   pg.InvalidLSN,
+	}, nil
+}
+
+// CanTail returns true if TailWAL is supported by the configured WAL decoder.
+func (wc *WALCache) CanTail() bool {
+	return wc.lsnRE != nil
+}
+
+// TailWAL prefaults the blocks referenced by the records that landed in the WAL
+// segment being written since the previous call, rather than waiting for the
+// segment to be predicted and decoded as a whole.  The segment being written
+// is the newest segment in the WAL directory whose first page was written for
+// it, rather than left over from its previous use, and the end of the WAL
+// written to it is tracked with its page headers.  TailWAL moves on to the
+// following segment once the segment is complete and the following segment has
+// been started.
+//
+// The WAL files are still decoded in full when they are predicted, which also
+// prefaults the pages of the commit log.  TailWAL must not be called
+// concurrently.
+func (wc *WALCache) TailWAL(ctx context.Context) error {
+	t := &wc.tail
+	if t.walFile == "" || time.Since(t.grewAt) > tailRescanInterval {
+		walFile, err := wc.newestWALFile()
+		if err != nil {
+			return errors.Wrap(err, "unable to find the WAL segment being written")
+		}
+		switch {
+		case walFile == "":
+			*t = walTail{}
+			return nil
+		case walFile != t.walFile:
+			if *t, err = newWALTail(walFile); err != nil {
+				return errors.Wrap(err, "unable to parse WAL filename")
+			}
+		}
+		t.grewAt = time.Now()
+	}
+
+	for {
+		f, err := os.Open(wc.walFilePath(t.walFile))
+		if err != nil {
+			// The segment was recycled or removed, find the new one next time.
+			*t = walTail{}
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.Wrap(err, "unable to open the WAL segment being written")
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "unable to stat the WAL segment being written")
+		}
+		validEnd, err := pg.ValidWALEnd(f, t.segStart, t.validEnd)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if validEnd < t.validEnd {
+			// The segment was recycled in place
+			*t = walTail{}
+			return nil
+		}
+
+		// Start with the last page written so far, the pages before it are in
+		// WAL that has already been predicted.
+		if t.resume == pg.InvalidLSN {
+			t.resume = t.segStart
+			if validEnd > t.segStart {
+				t.resume = validEnd - pg.LSN(pg.WALPageSize)
+			}
+		}
+
+		if validEnd > t.validEnd || !fi.ModTime().Equal(t.modTime) {
+			t.validEnd, t.modTime, t.grewAt = validEnd, fi.ModTime(), time.Now()
+			if validEnd > t.resume {
+				lastLSN, err := wc.decodeTail(ctx, t.walFile, t.resume, validEnd)
+				if err != nil {
+					return err
+				}
+				if lastLSN != pg.InvalidLSN {
+					// pg_waldump(1) resumes at the record following the byte after
+					// the start of the last record decoded, as in markPartial.
+					t.resume = lastLSN.AddBytes(1)
+				}
+			}
+		}
+
+		if validEnd < t.segStart.AddBytes(pg.WALSegmentSize) {
+			return nil
+		}
+
+		next, err := nextWALFile(t.walFile)
+		if err != nil {
+			return errors.Wrap(err, "unable to find the next WAL segment")
+		}
+		if started, err := wc.startedWALFile(next); err != nil || !started {
+			return err
+		}
+		if *t, err = newWALTail(next); err != nil {
+			return errors.Wrap(err, "unable to parse WAL filename")
+		}
+		t.resume, t.grewAt = t.segStart, time.Now()
+	}
+}
+
+// newestWALFile returns the newest WAL file in the WAL directory that has been
+// started, or an empty string if there is none.  Recycled segments are named
+// ahead of the segment being written, but their first page was written for
+// the name they had before.
+func (wc *WALCache) newestWALFile() (pg.WALFilename, error) {
+	walDir := path.Join(wc.cfg.PGDataPath, wc.walTranslations.Directory)
+	files, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to list the WAL directory")
+	}
+
+	walFiles := make([]pg.WALFilename, 0, len(files))
+	for _, fi := range files {
+		walFile := pg.WALFilename(fi.Name())
+		if _, _, err := pg.ParseWalfile(walFile); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		walFiles = append(walFiles, walFile)
+	}
+	sort.Slice(walFiles, func(i, j int) bool { return walFiles[i] > walFiles[j] })
+
+	for _, walFile := range walFiles {
+		started, err := wc.startedWALFile(walFile)
+		if err != nil {
+			return "", err
+		}
+		if started {
+			return walFile, nil
+		}
+	}
+
+	return "", nil
+}
+
+// startedWALFile returns true if the first page of walFile has been written
+// for it.
+func (wc *WALCache) startedWALFile(walFile pg.WALFilename) (bool, error) {
+	segStart, err := segmentStart(walFile)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(wc.walFilePath(walFile))
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, errors.Wrap(err, "unable to open WAL segment")
+	}
+	defer f.Close()
+
+	validEnd, err := pg.ValidWALEnd(f, segStart, segStart)
+	if err != nil {
+		return false, err
+	}
+
+	return validEnd > segStart, nil
+}
+
+// decodeTail decodes the records of walFile between from and to and prefaults
+// the blocks they reference.  The last record in the range is usually only
+// partially written, so pg_waldump(1) failing once it reaches it is expected.
+// decodeTail returns the LSN of the last record decoded, or InvalidLSN if no
+// record has landed in the range yet.
+func (wc *WALCache) decodeTail(ctx context.Context, walFile pg.WALFilename, from, to pg.LSN) (pg.LSN, error) {
+	if err := wc.acquireDecoder(ctx); err != nil {
+		return pg.InvalidLSN, errors.Wrap(err, "unable to start pg_waldump(1)")
+	}
+	defer wc.releaseDecoder()
+
+	if wc.cfg.DecodeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wc.cfg.DecodeTimeout)
+		defer cancel()
+	}
+
+	walFileAbs := wc.walFilePath(walFile)
+	cmd := wc.waldumpCommand(ctx, "-s", waldumpLSN(from), "-e", waldumpLSN(to), walFileAbs)
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+
+	dumpOutReader, err := cmd.StdoutPipe()
+	if err != nil {
+		return pg.InvalidLSN, errors.Wrapf(err, "unable to open stdout for pg_waldump(1): %q", errbuf.String())
+	}
+	if err := cmd.Start(); err != nil {
+		return pg.InvalidLSN, errors.Wrapf(err, "unable to read from pg_waldump(1): %q", errbuf.String())
+	}
+	tailDecodes.Inc()
+
+	var lastLSNRaw []byte
+	scanner := bufio.NewScanner(dumpOutReader)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if lsnMatch := wc.lsnRE.FindSubmatch(line); lsnMatch != nil {
+			lastLSNRaw = append(lastLSNRaw[:0], lsnMatch[1]...)
+		}
+
+		for _, matches := range wc.re.FindAllSubmatch(line, -1) {
+			if key, ok := parseBlockRef(matches); ok {
+				wc.prefaultTailBlock(key)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		wc.log.Debug().Err(err).Str("walfile", walFileAbs).Str("stderr", errbuf.String()).
+			Msg("reached the end of the WAL written so far")
+	}
+
+	if lastLSNRaw == nil {
+		return pg.InvalidLSN, nil
+	}
+
+	lastLSN, err := pg.ParseLSN(string(lastLSNRaw))
+	if err != nil {
+		return pg.InvalidLSN, errors.Wrapf(err, "unable to parse record LSN %q", lastLSNRaw)
+	}
+
+	return lastLSN, nil
+}
+
+// prefaultTailBlock hands a block referenced by a record in the WAL segment
+// being written to the ioCache.
+func (wc *WALCache) prefaultTailBlock(key structs.IOCacheKey) {
+	tailBlocks.Inc()
+	if wc.ioCache != nil {
+		wc.ioCache.GetIFPresent(key)
+	}
+	if wc.indexCache != nil {
+		wc.indexCache.Observe(key)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/walgen"
+	"github.com/rs/zerolog"
+)
+
+func TestTailWAL(t *testing.T) {
+	wc, res, cleanup := newGeneratedWALCache(t, walgen.Workload{
+		Seed:          7,
+		Mix:           walgen.Mix{walgen.HeapInsert: 1, walgen.Commit: 1},
+		Tablespace:    1663,
+		Database:      16384,
+		FirstRelation: 16385,
+		Relations:     10,
+		Blocks:        100,
+	}, 2)
+	defer cleanup()
+	wc.lsnRE = pgWalDumpLSNRE
+	wc.log = zerolog.Nop()
+
+	current := res.Files[1]
+	segment, err := ioutil.ReadFile(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writeTo writes the first pages of the segment being written, the rest of
+	// it is zeroed as if it were preallocated.
+	writeTo := func(pages int) {
+		buf := make([]byte, len(segment))
+		copy(buf, segment[:pages*int(pg.WALPageSize)])
+		if err := ioutil.WriteFile(current, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A recycled segment is named ahead of the segment being written
+	recycled, err := ioutil.ReadFile(res.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := nextWALFile(pg.WALFilename(filepath.Base(current)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(wc.walFilePath(next), recycled, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := func() (decodes, blocks uint64) {
+		decodes, blocks = tailDecodes.Value(), tailBlocks.Value()
+		if err := wc.TailWAL(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return tailDecodes.Value() - decodes, tailBlocks.Value() - blocks
+	}
+
+	// The records in the last page written so far are decoded
+	writeTo(4)
+	if decodes, blocks := tail(); decodes != 1 || blocks == 0 {
+		t.Fatalf("%d decodes prefaulted %d blocks, want 1 decode and some blocks", decodes, blocks)
+	}
+	if got, want := wc.tail.walFile, pg.WALFilename(filepath.Base(current)); got != want {
+		t.Fatalf("tailing %s, want %s", got, want)
+	}
+	lastPage := wc.tail.segStart.AddBytes(3 * pg.WALPageSize)
+	if resume := wc.tail.resume; resume <= lastPage || resume >= lastPage.AddBytes(pg.WALPageSize) {
+		t.Fatalf("resuming at %s, want within the fourth page", resume)
+	}
+
+	// Nothing is decoded until more WAL lands
+	if decodes, _ := tail(); decodes != 0 {
+		t.Fatalf("%d decodes without new WAL", decodes)
+	}
+
+	resume := wc.tail.resume
+	writeTo(8)
+	if decodes, blocks := tail(); decodes != 1 || blocks == 0 {
+		t.Fatalf("%d decodes prefaulted %d blocks, want 1 decode and some blocks", decodes, blocks)
+	}
+	if wc.tail.resume <= resume || wc.tail.validEnd != wc.tail.segStart.AddBytes(8*pg.WALPageSize) {
+		t.Fatalf("resuming at %s up to %s after resuming at %s", wc.tail.resume, wc.tail.validEnd, resume)
+	}
+
+	// A complete segment is tailed until the next segment is started
+	writeTo(len(segment) / int(pg.WALPageSize))
+	tail()
+	if wc.tail.walFile != pg.WALFilename(filepath.Base(current)) || wc.tail.validEnd != wc.tail.segStart.AddBytes(pg.WALSegmentSize) {
+		t.Fatalf("tailing %s up to %s, want the complete %s", wc.tail.walFile, wc.tail.validEnd, filepath.Base(current))
+	}
+}
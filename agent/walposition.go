@@ -0,0 +1,70 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/bschofield/pg_prefaulter/agent/hooks"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// _WALPosition is an immutable snapshot of the WAL filename and timeline ID
+// from the previous call to getWALFilesDB().
+type _WALPosition struct {
+	timelineID pg.TimelineID
+	walFile    pg.WALFilename
+}
+
+// loadWALPosition returns the most recently stored _WALPosition, or the zero
+// value if no WAL scan has completed.  loadWALPosition does not block.
+func (a *Agent) loadWALPosition() _WALPosition {
+	p, _ := a.walPosition.Load().(_WALPosition)
+	return p
+}
+
+// storeWALPosition publishes p to status readers and the walCache.  Only the
+// WAL scan loop stores a _WALPosition.
+func (a *Agent) storeWALPosition(p _WALPosition) {
+	a.walPosition.Store(p)
+	if a.walCache != nil && p.walFile != "" {
+		a.walCache.SetReplayPosition(p.walFile)
+	}
+}
+
+// switchTimeline records that the database is replaying timelineID.  When the
+// timeline changed, the walCache is purged, assuming new heap data will need
+// to be prefaulted, and the switch is fired as an event.  The new timeline is
+// stored right away, keeping the last WAL file, so that a scan that fails
+// afterwards doesn't purge the walCache again on every retry.  switchTimeline
+// returns true if the timeline changed.
+func (a *Agent) switchTimeline(timelineID pg.TimelineID) bool {
+	prev := a.loadWALPosition()
+	if prev.timelineID == timelineID {
+		return false
+	}
+
+	a.storeWALPosition(_WALPosition{timelineID: timelineID, walFile: prev.walFile})
+	if prev.timelineID == 0 {
+		return false
+	}
+
+	if a.walCache != nil {
+		a.walCache.Purge()
+	}
+	a.fireEvent(hooks.EventTimelineSwitch, map[string]interface{}{
+		"from": uint64(prev.timelineID),
+		"to":   uint64(timelineID),
+	})
+
+	return true
+}
@@ -0,0 +1,63 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestWALPosition(t *testing.T) {
+	a := &Agent{}
+
+	if diff := pretty.Compare(a.loadWALPosition(), _WALPosition{}); diff != "" {
+		t.Fatalf("initial position diff: (-got +want)\n%s", diff)
+	}
+
+	want := _WALPosition{timelineID: 2, walFile: "00000002000000000000000A"}
+	a.storeWALPosition(want)
+
+	s := a.Status()
+	if s.LastTimelineID != want.timelineID || s.LastWALFile != want.walFile {
+		t.Fatalf("bad status: got %d/%q, want %d/%q", s.LastTimelineID, s.LastWALFile, want.timelineID, want.walFile)
+	}
+}
+
+func TestSwitchTimeline(t *testing.T) {
+	a := &Agent{}
+
+	// The first timeline observed isn't a switch
+	if a.switchTimeline(1) {
+		t.Fatal("initial timeline reported as a switch")
+	}
+	a.storeWALPosition(_WALPosition{timelineID: 1, walFile: "000000010000000000000007"})
+
+	// A switch is only reported once, even if the scan that observed it failed
+	// and is retried
+	if !a.switchTimeline(2) {
+		t.Fatal("timeline switch not reported")
+	}
+	if a.switchTimeline(2) {
+		t.Fatal("timeline switch reported twice")
+	}
+
+	want := _WALPosition{timelineID: 2, walFile: "000000010000000000000007"}
+	if diff := pretty.Compare(a.loadWALPosition(), want); diff != "" {
+		t.Fatalf("position diff: (-got +want)\n%s", diff)
+	}
+	if n := len(a.recentEvents.list()); n != 1 {
+		t.Fatalf("fired %d events, want 1", n)
+	}
+}
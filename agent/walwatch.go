@@ -0,0 +1,128 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// walDirCheckInterval is how often the watched WAL directory is compared
+	// with the WAL directory found in PGDATA.
+	walDirCheckInterval = time.Second
+
+	// maxWALWatchRetryDelay bounds how long the agent waits between attempts
+	// to watch a WAL directory that couldn't be watched, e.g. because it
+	// doesn't exist yet.
+	maxWALWatchRetryDelay = time.Minute
+)
+
+var walWatchWakeups = metrics.NewCounter("wal_watch_wakeups_total", "Number of WAL scans started early because a new WAL segment started being written.")
+
+// watchWALDir watches the WAL directory with inotify(7) or kqueue(2) and
+// signals walArrivedCh whenever a WAL segment newer than any seen before is
+// written to.  Segments are recycled by renaming them ahead of the current
+// segment, so only writes mark the arrival of a segment.  While the WAL
+// directory can't be watched the agent falls back to polling, and watching it
+// is retried with a backoff.
+func (a *Agent) watchWALDir() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		a.log.Warn().Err(err).Msg("unable to watch the WAL directory, polling")
+		return
+	}
+	defer watcher.Close()
+
+	ticker := time.NewTicker(walDirCheckInterval)
+	defer ticker.Stop()
+
+	// failed is the WAL directory that couldn't be watched, and retryAt when
+	// watching it is next attempted.
+	var watched, failed string
+	var retryAt time.Time
+	retryDelay := walDirCheckInterval
+
+	var newest pg.WALFilename
+	for {
+		a.pgStateLock.RLock()
+		walDir := a.walDir
+		a.pgStateLock.RUnlock()
+
+		if walDir != watched && (walDir != failed || !time.Now().Before(retryAt)) {
+			if watched != "" {
+				watcher.Remove(watched)
+				watched = ""
+			}
+
+			if err := watcher.Add(walDir); err != nil {
+				if walDir != failed {
+					a.log.Warn().Err(err).Str("wal-directory", walDir).Msg("unable to watch the WAL directory, polling")
+					retryDelay = walDirCheckInterval
+				} else if retryDelay *= 2; retryDelay > maxWALWatchRetryDelay {
+					retryDelay = maxWALWatchRetryDelay
+				}
+				failed = walDir
+				retryAt = time.Now().Add(retryDelay)
+			} else {
+				a.log.Debug().Str("wal-directory", walDir).Msg("watching the WAL directory")
+				watched = walDir
+				failed = ""
+				newest = ""
+			}
+		}
+
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			a.log.Debug().Err(err).Str("wal-directory", watched).Msg("error watching the WAL directory")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			// The WAL directory was removed or renamed, e.g. replaced by a
+			// symlink.  Watch it again once it's back.
+			if event.Name == watched && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				watcher.Remove(watched)
+				watched = ""
+				continue
+			}
+
+			walFile := pg.WALFilename(filepath.Base(event.Name))
+			if event.Op&fsnotify.Write == 0 || walFile <= newest {
+				continue
+			}
+			if _, _, err := pg.ParseWalfile(walFile); err != nil {
+				continue
+			}
+			newest = walFile
+
+			walWatchWakeups.Inc()
+			select {
+			case a.walArrivedCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchWALDir(t *testing.T) {
+	walDir, err := ioutil.TempDir("", "pg_wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(walDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Agent{
+		shutdownCtx:  ctx,
+		walDir:       walDir,
+		walArrivedCh: make(chan struct{}, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.watchWALDir()
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(walDir, name), []byte("WAL"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arrived := func(timeout time.Duration) bool {
+		select {
+		case <-a.walArrivedCh:
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+
+	// The directory is watched shortly after the watcher starts
+	deadline := time.Now().Add(5 * time.Second)
+	for !arrived(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("new segment not signaled")
+		}
+		write("000000010000000000000002")
+	}
+
+	// Older segments and other files don't signal
+	write("000000010000000000000001")
+	write("00000002.history")
+	if arrived(100 * time.Millisecond) {
+		t.Fatal("signaled for an older segment")
+	}
+
+	write("000000010000000000000003")
+	if !arrived(5 * time.Second) {
+		t.Fatal("new segment not signaled")
+	}
+}
+
+func TestWatchWALDirRetry(t *testing.T) {
+	pgdata, err := ioutil.TempDir("", "pgdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pgdata)
+	walDir := filepath.Join(pgdata, "pg_wal")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Agent{
+		shutdownCtx:  ctx,
+		walDir:       walDir,
+		walArrivedCh: make(chan struct{}, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.watchWALDir()
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The WAL directory is watched once it exists, and again after it is
+	// removed and recreated.
+	for i := 0; i < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Mkdir(walDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for arrived := false; !arrived; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d: new segment not signaled", i)
+			}
+			if err := ioutil.WriteFile(filepath.Join(walDir, "000000010000000000000002"), []byte("WAL"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-a.walArrivedCh:
+				arrived = true
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+
+		if err := os.RemoveAll(walDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/lib"
+)
+
+const (
+	// warmSetSaveInterval is how often the warm set is persisted.
+	warmSetSaveInterval = time.Minute
+
+	// warmSetMaxPending bounds the number of IOs outstanding while the warm set
+	// (or the bootstrap warmup) is replayed so that replay doesn't flood the
+	// ioCache.
+	warmSetMaxPending = 4096
+)
+
+// replayWarmSet prefaults the blocks saved by the previous run ahead of WAL
+// replay, throttled by the ioCache's backlog.
+func (a *Agent) replayWarmSet() {
+	start := time.Now()
+	n := a.warmSet.Replay(a.shutdownCtx, func(key structs.IOCacheKey) {
+		a.prefaultThrottled(key)
+	})
+
+	if n > 0 {
+		a.log.Info().Uint64("blocks", n).Dur("duration", time.Since(start)).Msg("replayed warm set")
+	}
+}
+
+// prefaultThrottled schedules key to be prefaulted once the ioCache's backlog
+// drops below warmSetMaxPending.  prefaultThrottled returns false if the agent
+// is draining or shut down while waiting.
+func (a *Agent) prefaultThrottled(key structs.IOCacheKey) bool {
+	if a.isDraining() {
+		return false
+	}
+
+	for a.ioCache.NumPending() >= warmSetMaxPending {
+		if lib.IsShuttingDown(a.shutdownCtx) || a.isDraining() {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := a.ioCache.GetIFPresent(key); err != nil && err != gcache.KeyNotFoundError {
+		a.log.Debug().Err(err).Msg("iocache throttled prefault")
+	}
+
+	return true
+}
@@ -0,0 +1,451 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package warmset remembers the pages most recently prefaulted and persists
+// them as a manifest of block ranges so that the next run, or another replica,
+// can re-warm the filesystem cache before WAL starts flowing.
+package warmset
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/metrics"
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+var (
+	blocksGauge     = metrics.NewGauge("warm_set_blocks", "Number of recently prefaulted blocks in the warm set.")
+	replayedCounter = metrics.NewCounter("warm_set_replayed_blocks_total", "Number of blocks prefaulted from the saved warm set at startup.")
+)
+
+// Range is a run of consecutive blocks of a relation or SLRU.
+type Range struct {
+	Tablespace pg.OID             `json:"tablespace,omitempty"`
+	Database   pg.OID             `json:"database,omitempty"`
+	Relation   pg.OID             `json:"relation,omitempty"`
+	SLRU       pg.SLRU            `json:"slru,omitempty"`
+	Start      pg.HeapBlockNumber `json:"start"`
+	Blocks     uint64             `json:"blocks"`
+}
+
+// key returns the IOCacheKey of the nth block of r.
+func (r Range) key(n uint64) structs.IOCacheKey {
+	return structs.IOCacheKey{
+		Tablespace: r.Tablespace,
+		Database:   r.Database,
+		Relation:   r.Relation,
+		SLRU:       r.SLRU,
+		Block:      r.Start + pg.HeapBlockNumber(n),
+	}
+}
+
+// Manifest is the persisted and portable representation of a Set.  Ranges are
+// ordered from most to least recently prefaulted.
+type Manifest struct {
+	Saved     time.Time `json:"saved"`
+	BlockSize int64     `json:"block-size"`
+	Ranges    []Range   `json:"ranges"`
+}
+
+// Blocks returns the number of blocks in m.
+func (m Manifest) Blocks() uint64 {
+	var blocks uint64
+	for _, r := range m.Ranges {
+		blocks += r.Blocks
+	}
+
+	return blocks
+}
+
+// ReadManifest reads the Manifest persisted to blob.  found is false if no
+// Manifest has been persisted.
+func ReadManifest(blob state.Blob) (m Manifest, found bool, err error) {
+	buf, err := blob.Read()
+	switch {
+	case err != nil:
+		return Manifest{}, false, errors.Wrap(err, "unable to read warm set")
+	case buf == nil:
+		return Manifest{}, false, nil
+	}
+
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return Manifest{}, false, errors.Wrap(err, "unable to parse warm set")
+	}
+
+	return m, true, nil
+}
+
+// WriteManifest persists m to blob.
+func WriteManifest(blob state.Blob, m Manifest) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode warm set")
+	}
+
+	if err := blob.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write warm set")
+	}
+
+	return nil
+}
+
+// Set is the warm set: the most recently prefaulted blocks, bounded by a byte
+// budget.
+type Set struct {
+	blob      state.Blob
+	blockSize units.Base2Bytes
+	maxBlocks int
+
+	lock sync.Mutex
+
+	// recent orders the blocks in the set from most to least recently
+	// prefaulted.  blocks indexes recent.
+	recent *list.List
+	blocks map[structs.IOCacheKey]*list.Element
+
+	// loaded contains the ranges read by Load, to be replayed.
+	loaded []Range
+}
+
+// New creates an empty Set persisted to blob and holding at most budget bytes
+// of blocks of blockSize.
+func New(blob state.Blob, budget, blockSize units.Base2Bytes) *Set {
+	return &Set{
+		blob:      blob,
+		blockSize: blockSize,
+		maxBlocks: int(budget / blockSize),
+		recent:    list.New(),
+		blocks:    make(map[structs.IOCacheKey]*list.Element),
+	}
+}
+
+// Load reads the Set saved by the previous run from its blob.  A missing Set is
+// not an error.  A Set saved with a different block size is ignored and logged
+// to the logger carried by ctx.
+func (s *Set) Load(ctx context.Context) error {
+	m, found, err := ReadManifest(s.blob)
+	if err != nil || !found {
+		return err
+	}
+
+	if err := s.Import(m); err != nil {
+		lib.Logger(ctx).Warn().Err(err).Msg("ignoring saved warm set")
+	}
+
+	return nil
+}
+
+// Import adds the blocks of m to the Set as its most recently prefaulted
+// blocks and queues them to be replayed.  m must have the Set's block size.
+func (s *Set) Import(m Manifest) error {
+	if units.Base2Bytes(m.BlockSize) != s.blockSize {
+		return fmt.Errorf("warm set block size (%d) does not match the block size (%d)", m.BlockSize, int64(s.blockSize))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.loaded = append(append([]Range{}, m.Ranges...), s.loaded...)
+
+	// Seed the set from the least to the most recent range so that the imported
+	// blocks survive a restart, and retain their order.
+	for i := len(m.Ranges) - 1; i >= 0; i-- {
+		r := m.Ranges[i]
+		for n := r.Blocks; n > 0; n-- {
+			s.recordLocked(r.key(n - 1))
+		}
+	}
+	blocksGauge.Set(float64(s.recent.Len()))
+
+	return nil
+}
+
+// Manifest returns the current contents of the Set.
+func (s *Set) Manifest() Manifest {
+	return Manifest{
+		Saved:     time.Now(),
+		BlockSize: int64(s.blockSize),
+		Ranges:    s.Ranges(),
+	}
+}
+
+// Top returns the most recently prefaulted ranges of the Set, truncated to n
+// blocks.  A limit of zero returns the entire Set.
+func (s *Set) Top(n uint64) Manifest {
+	m := s.Manifest()
+	if n == 0 {
+		return m
+	}
+
+	var blocks uint64
+	for i, r := range m.Ranges {
+		if blocks+r.Blocks >= n {
+			m.Ranges[i].Blocks = n - blocks
+			m.Ranges = m.Ranges[:i+1]
+			break
+		}
+		blocks += r.Blocks
+	}
+
+	return m
+}
+
+// Hint adds the blocks of m that the Set doesn't already hold, as its least
+// recently prefaulted blocks, while there is room in the budget.  The added
+// blocks are queued to be replayed.  Unlike Import, Hint never displaces the
+// Set's own blocks.  Hint returns the number of blocks added.
+func (s *Set) Hint(m Manifest) (uint64, error) {
+	if units.Base2Bytes(m.BlockSize) != s.blockSize {
+		return 0, fmt.Errorf("warm set block size (%d) does not match the block size (%d)", m.BlockSize, int64(s.blockSize))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var added uint64
+	var queued []Range
+	for _, r := range m.Ranges {
+		for n := uint64(0); n < r.Blocks; n++ {
+			if s.recent.Len() >= s.maxBlocks {
+				break
+			}
+
+			key := r.key(n)
+			if _, found := s.blocks[key]; found {
+				continue
+			}
+			s.blocks[key] = s.recent.PushBack(key)
+			added++
+
+			if last := len(queued) - 1; last >= 0 && extends(queued[last], key) {
+				queued[last].Blocks++
+				continue
+			}
+			queued = append(queued, Range{
+				Tablespace: key.Tablespace,
+				Database:   key.Database,
+				Relation:   key.Relation,
+				SLRU:       key.SLRU,
+				Start:      key.Block,
+				Blocks:     1,
+			})
+		}
+	}
+	s.loaded = append(s.loaded, queued...)
+	blocksGauge.Set(float64(s.recent.Len()))
+
+	return added, nil
+}
+
+// Save writes the Set to its blob.
+func (s *Set) Save() error {
+	return WriteManifest(s.blob, s.Manifest())
+}
+
+// Run saves the Set every interval until ctx is cancelled, and once more on
+// the way out.
+func (s *Set) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Save(); err != nil {
+				lib.Logger(ctx).Warn().Err(err).Str("state", s.blob.String()).Msg("unable to save warm set")
+			}
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				lib.Logger(ctx).Warn().Err(err).Str("state", s.blob.String()).Msg("unable to save warm set")
+			}
+		}
+	}
+}
+
+// Record notes that key was prefaulted, evicting the least recently
+// prefaulted block if the set is full.
+func (s *Set) Record(key structs.IOCacheKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.recordLocked(key)
+	blocksGauge.Set(float64(s.recent.Len()))
+}
+
+// recordLocked records key.  The caller must hold the lock.
+func (s *Set) recordLocked(key structs.IOCacheKey) {
+	if s.maxBlocks <= 0 {
+		return
+	}
+
+	if e, found := s.blocks[key]; found {
+		s.recent.MoveToFront(e)
+		return
+	}
+
+	s.blocks[key] = s.recent.PushFront(key)
+	for s.recent.Len() > s.maxBlocks {
+		e := s.recent.Back()
+		s.recent.Remove(e)
+		delete(s.blocks, e.Value.(structs.IOCacheKey))
+	}
+}
+
+// Ranges returns the blocks in the set coalesced into ranges, ordered from the
+// most to the least recently prefaulted range.
+func (s *Set) Ranges() []Range {
+	type rankedKey struct {
+		key  structs.IOCacheKey
+		rank int
+	}
+
+	s.lock.Lock()
+	keys := make([]rankedKey, 0, s.recent.Len())
+	for e, rank := s.recent.Front(), 0; e != nil; e, rank = e.Next(), rank+1 {
+		keys = append(keys, rankedKey{key: e.Value.(structs.IOCacheKey), rank: rank})
+	}
+	s.lock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key.Less(keys[j].key) })
+
+	var ranges []Range
+	var ranks []int
+	for _, k := range keys {
+		if n := len(ranges) - 1; n >= 0 && extends(ranges[n], k.key) {
+			ranges[n].Blocks++
+			if k.rank < ranks[n] {
+				ranks[n] = k.rank
+			}
+			continue
+		}
+
+		ranges = append(ranges, Range{
+			Tablespace: k.key.Tablespace,
+			Database:   k.key.Database,
+			Relation:   k.key.Relation,
+			SLRU:       k.key.SLRU,
+			Start:      k.key.Block,
+			Blocks:     1,
+		})
+		ranks = append(ranks, k.rank)
+	}
+
+	order := make([]int, len(ranges))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return ranks[order[i]] < ranks[order[j]] })
+
+	sorted := make([]Range, len(ranges))
+	for i, n := range order {
+		sorted[i] = ranges[n]
+	}
+
+	return sorted
+}
+
+// Replay calls fault for each block loaded from the previous run's warm set or
+// imported since the last Replay, most recently prefaulted first, until the
+// budget is exhausted or ctx is cancelled.  Replay returns the number of blocks
+// replayed.
+func (s *Set) Replay(ctx context.Context, fault func(structs.IOCacheKey)) uint64 {
+	s.lock.Lock()
+	ranges := s.loaded
+	s.loaded = nil
+	s.lock.Unlock()
+
+	var replayed uint64
+	for _, r := range ranges {
+		for n := uint64(0); n < r.Blocks; n++ {
+			if replayed >= uint64(s.maxBlocks) || ctx.Err() != nil {
+				return replayed
+			}
+
+			fault(r.key(n))
+			replayed++
+			replayedCounter.Inc()
+		}
+	}
+
+	return replayed
+}
+
+// extends returns true if key is the block immediately following r.
+func extends(r Range, key structs.IOCacheKey) bool {
+	return r.SLRU == key.SLRU && r.Tablespace == key.Tablespace &&
+		r.Database == key.Database && r.Relation == key.Relation &&
+		r.Start+pg.HeapBlockNumber(r.Blocks) == key.Block
+}
+
+// maxManifestSize bounds the size of a Manifest read from an agent.
+const maxManifestSize = 64 << 20
+
+// URL returns the URL of the warm set endpoint of the agent listening on
+// addr.  addr is either a host:port or a base URL.
+func URL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	return strings.TrimSuffix(addr, "/") + "/warmset"
+}
+
+// Fetch retrieves the n most recently prefaulted blocks of the warm set of the
+// agent listening on addr.  A limit of zero retrieves the entire warm set.
+func Fetch(ctx context.Context, client *http.Client, addr string, n uint64) (Manifest, error) {
+	u := URL(addr)
+	if n > 0 {
+		u += "?limit=" + strconv.FormatUint(n, 10)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "unable to create warm set request")
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Manifest{}, errors.Wrapf(err, "unable to reach agent at %s", addr)
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, maxManifestSize)
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(body, 4096))
+		return Manifest{}, fmt.Errorf("agent at %s: %s: %s", addr, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var m Manifest
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return Manifest{}, errors.Wrapf(err, "unable to parse warm set from %s", addr)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,261 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warmset
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmset")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rel := func(relation pg.OID, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: relation, Block: block}
+	}
+
+	// Room for five blocks
+	blob := state.File(path.Join(dir, "warm-set.json"))
+	s := New(blob, 5*pg.HeapPageSize, pg.HeapPageSize)
+	for _, key := range []structs.IOCacheKey{
+		rel(16385, 9), // evicted
+		rel(16385, 3),
+		rel(16385, 4),
+		{SLRU: pg.SLRUXact, Block: 2},
+		rel(16386, 0),
+		rel(16385, 5),
+		rel(16385, 3), // refreshed
+	} {
+		s.Record(key)
+	}
+
+	want := []Range{
+		{Tablespace: 1663, Database: 16384, Relation: 16385, Start: 3, Blocks: 3},
+		{Tablespace: 1663, Database: 16384, Relation: 16386, Start: 0, Blocks: 1},
+		{SLRU: pg.SLRUXact, Start: 2, Blocks: 1},
+	}
+	if diff := pretty.Compare(s.Ranges(), want); diff != "" {
+		t.Fatalf("ranges diff: (-got +want)\n%s", diff)
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("unable to save: %v", err)
+	}
+
+	// A smaller budget only replays the most recent blocks
+	loaded := New(blob, 4*pg.HeapPageSize, pg.HeapPageSize)
+	if err := loaded.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	var replayed []structs.IOCacheKey
+	n := loaded.Replay(context.Background(), func(key structs.IOCacheKey) {
+		replayed = append(replayed, key)
+	})
+	if n != 4 {
+		t.Fatalf("replayed %d blocks, want 4", n)
+	}
+	if diff := pretty.Compare(replayed, []structs.IOCacheKey{
+		rel(16385, 3), rel(16385, 4), rel(16385, 5), rel(16386, 0),
+	}); diff != "" {
+		t.Fatalf("replayed diff: (-got +want)\n%s", diff)
+	}
+
+	// The loaded set retains the previous run's blocks until they are evicted
+	if diff := pretty.Compare(loaded.Ranges(), want[:2]); diff != "" {
+		t.Fatalf("loaded ranges diff: (-got +want)\n%s", diff)
+	}
+
+	// Replay only happens once
+	if n := loaded.Replay(context.Background(), func(structs.IOCacheKey) {}); n != 0 {
+		t.Fatalf("replayed %d blocks twice", n)
+	}
+
+	// A warm set of a different geometry is ignored
+	other := New(blob, 5*pg.HeapPageSize, 16*units.KiB)
+	if err := other.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	if ranges := other.Ranges(); len(ranges) != 0 {
+		t.Fatalf("loaded %d ranges of a different block size", len(ranges))
+	}
+
+	// A missing warm set is not an error
+	if err := New(state.File(path.Join(dir, "missing.json")), pg.HeapPageSize, pg.HeapPageSize).Load(context.Background()); err != nil {
+		t.Fatalf("unexpected error loading a missing warm set: %v", err)
+	}
+}
+
+func TestSetImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmset")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: 16385, Block: 1}
+	s := New(state.File(path.Join(dir, "warm-set.json")), 4*pg.HeapPageSize, pg.HeapPageSize)
+	s.Record(local)
+
+	m := Manifest{
+		BlockSize: int64(pg.HeapPageSize),
+		Ranges: []Range{
+			{Tablespace: 1663, Database: 16384, Relation: 16390, Start: 10, Blocks: 2},
+			{SLRU: pg.SLRUXact, Start: 0, Blocks: 1},
+		},
+	}
+	if m.Blocks() != 3 {
+		t.Fatalf("manifest has %d blocks, want 3", m.Blocks())
+	}
+
+	if err := s.Import(Manifest{BlockSize: int64(16 * units.KiB)}); err == nil {
+		t.Fatalf("expected a block size mismatch to fail")
+	}
+
+	if err := s.Import(m); err != nil {
+		t.Fatalf("unable to import: %v", err)
+	}
+
+	// Imported blocks are the most recent
+	want := append(append([]Range{}, m.Ranges...), Range{Tablespace: 1663, Database: 16384, Relation: 16385, Start: 1, Blocks: 1})
+	if diff := pretty.Compare(s.Manifest().Ranges, want); diff != "" {
+		t.Fatalf("ranges diff: (-got +want)\n%s", diff)
+	}
+
+	// Only the imported blocks are replayed
+	var replayed uint64
+	if n := s.Replay(context.Background(), func(structs.IOCacheKey) { replayed++ }); n != 3 || replayed != 3 {
+		t.Fatalf("replayed %d/%d blocks, want 3", n, replayed)
+	}
+}
+
+func TestSetHint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmset")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rel := func(relation pg.OID, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: relation, Block: block}
+	}
+
+	peer := New(state.File(path.Join(dir, "peer.json")), 8*pg.HeapPageSize, pg.HeapPageSize)
+	for _, key := range []structs.IOCacheKey{rel(16390, 0), rel(16390, 1), rel(16385, 7), rel(16385, 8)} {
+		peer.Record(key)
+	}
+
+	// Only the most recent blocks are shared
+	top := peer.Top(3)
+	if diff := pretty.Compare(top.Ranges, []Range{
+		{Tablespace: 1663, Database: 16384, Relation: 16385, Start: 7, Blocks: 2},
+		{Tablespace: 1663, Database: 16384, Relation: 16390, Start: 0, Blocks: 1},
+	}); diff != "" {
+		t.Fatalf("top diff: (-got +want)\n%s", diff)
+	}
+	if n := peer.Top(0).Blocks(); n != 4 {
+		t.Fatalf("top(0) returned %d blocks, want 4", n)
+	}
+
+	// Room for three blocks, one of which the peer also has
+	s := New(state.File(path.Join(dir, "warm-set.json")), 3*pg.HeapPageSize, pg.HeapPageSize)
+	s.Record(rel(16385, 8))
+
+	if _, err := s.Hint(Manifest{BlockSize: int64(16 * units.KiB)}); err == nil {
+		t.Fatalf("expected a block size mismatch to fail")
+	}
+
+	added, err := s.Hint(top)
+	if err != nil {
+		t.Fatalf("unable to hint: %v", err)
+	}
+	if added != 2 {
+		t.Fatalf("added %d blocks, want 2", added)
+	}
+
+	// The agent's own block remains the most recent, and its range is first
+	if diff := pretty.Compare(s.Manifest().Ranges, []Range{
+		{Tablespace: 1663, Database: 16384, Relation: 16385, Start: 7, Blocks: 2},
+		{Tablespace: 1663, Database: 16384, Relation: 16390, Start: 0, Blocks: 1},
+	}); diff != "" {
+		t.Fatalf("ranges diff: (-got +want)\n%s", diff)
+	}
+	if diff := pretty.Compare(s.Top(1).Ranges, []Range{
+		{Tablespace: 1663, Database: 16384, Relation: 16385, Start: 7, Blocks: 1},
+	}); diff != "" {
+		t.Fatalf("top diff: (-got +want)\n%s", diff)
+	}
+
+	// Only the added blocks are replayed
+	var replayed []structs.IOCacheKey
+	s.Replay(context.Background(), func(key structs.IOCacheKey) { replayed = append(replayed, key) })
+	if diff := pretty.Compare(replayed, []structs.IOCacheKey{rel(16385, 7), rel(16390, 0)}); diff != "" {
+		t.Fatalf("replayed diff: (-got +want)\n%s", diff)
+	}
+
+	// A full set takes no hints
+	if added, err := s.Hint(peer.Top(0)); err != nil || added != 0 {
+		t.Fatalf("added %d blocks to a full set: %v", added, err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	want := Manifest{
+		BlockSize: int64(pg.HeapPageSize),
+		Ranges:    []Range{{SLRU: pg.SLRUXact, Start: 4, Blocks: 2}},
+	}
+
+	var limit string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/warmset" {
+			http.NotFound(w, r)
+			return
+		}
+		limit = r.URL.Query().Get("limit")
+		json.NewEncoder(w).Encode(want)
+	}))
+	defer srv.Close()
+
+	got, err := Fetch(context.Background(), srv.Client(), strings.TrimPrefix(srv.URL, "http://"), 10)
+	if err != nil {
+		t.Fatalf("unable to fetch: %v", err)
+	}
+	if limit != "10" {
+		t.Fatalf("limit %q, want 10", limit)
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("manifest diff: (-got +want)\n%s", diff)
+	}
+
+	if _, err := Fetch(context.Background(), srv.Client(), srv.URL+"/missing", 0); err == nil {
+		t.Fatalf("expected a missing endpoint to fail")
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package whatif estimates how far WAL replay would fall behind with and
+// without prefaulting.  Recovery is modeled as a single process applying
+// records in order: a record is applied once it has arrived and every block it
+// references is in the page cache, and a block that isn't is read
+// synchronously, taking a latency sampled from recorded storage latencies.
+// With prefaulting, the blocks of records up to the readahead ahead of replay
+// are read by a pool of concurrent workers, and replay only waits for reads
+// that haven't completed by the time it reaches them.
+//
+// The page cache is assumed to be cold, apart from a configurable hit ratio,
+// and to hold every block read during the analyzed WAL.
+package whatif
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/agent/walcache"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+var (
+	lsnRE = regexp.MustCompile(`lsn: ([0-9A-F]+/[0-9A-F]+),`)
+
+	// pg_waldump(1) prints commit timestamps in the server's time zone:
+	//
+	// desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync
+	commitRE = regexp.MustCompile(`desc: COMMIT (\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?:\.\d+)? [^\s;]+)`)
+)
+
+const commitTimeLayout = "2006-01-02 15:04:05.999999 MST"
+
+// Record is a decoded WAL record.
+type Record struct {
+	LSN pg.LSN
+
+	// Time is the timestamp of a commit record and zero for other records.
+	Time time.Time
+
+	Blocks []structs.IOCacheKey
+}
+
+// ParseRecord parses a line of pg_waldump(1) output.  ParseRecord returns false
+// if the line isn't a record.
+func ParseRecord(line []byte) (Record, bool) {
+	m := lsnRE.FindSubmatch(line)
+	if m == nil {
+		return Record{}, false
+	}
+
+	lsn, err := pg.ParseLSN(string(m[1]))
+	if err != nil {
+		return Record{}, false
+	}
+
+	r := Record{
+		LSN:    lsn,
+		Blocks: walcache.ParseBlockRefs(line),
+	}
+	if m := commitRE.FindSubmatch(line); m != nil {
+		// An unknown time zone abbreviation is treated as UTC, which only matters
+		// if it changes mid-stream.
+		r.Time, _ = time.Parse(commitTimeLayout, string(m[1]))
+	}
+
+	return r, true
+}
+
+// Decode decodes the consecutive WAL segments first through last with
+// pg_waldump(1).  As when prefaulting, an error after at least one record was
+// decoded is ignored: the last segment is usually only partially written.
+func Decode(ctx context.Context, walDumpPath, first, last string) ([]Record, error) {
+	cmd := exec.CommandContext(ctx, walDumpPath, first, last)
+	var errbuf strings.Builder
+	cmd.Stderr = &errbuf
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open stdout for pg_waldump(1)")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "unable to run pg_waldump(1)")
+	}
+
+	var records []Record
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		if r, ok := ParseRecord(scanner.Bytes()); ok {
+			records = append(records, r)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil && len(records) == 0 {
+		return nil, errors.Wrapf(err, "pg_waldump(1) returned uncleanly: %+q", errbuf.String())
+	}
+
+	return records, nil
+}
+
+// Latencies are recorded storage read latencies.
+type Latencies []time.Duration
+
+// ParseLatencies reads one latency per line.  A latency is a duration (e.g.
+// "350us") or a number of milliseconds.  Blank lines and lines starting with
+// "#" are ignored.
+func ParseLatencies(r io.Reader) (Latencies, error) {
+	var lats Latencies
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lat, err := time.ParseDuration(line)
+		if err != nil {
+			ms, msErr := strconv.ParseFloat(line, 64)
+			if msErr != nil {
+				return nil, errors.Wrapf(err, "invalid latency on line %d", n)
+			}
+			lat = time.Duration(ms * float64(time.Millisecond))
+		}
+		if lat < 0 {
+			return nil, fmt.Errorf("negative latency on line %d", n)
+		}
+		lats = append(lats, lat)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read latencies")
+	}
+	if len(lats) == 0 {
+		return nil, errors.New("no latencies recorded")
+	}
+
+	return lats, nil
+}
+
+// Percentile returns the p'th percentile latency, 0 <= p <= 1.
+func (l Latencies) Percentile(p float64) time.Duration {
+	sorted := append(Latencies(nil), l...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// Options are the parameters shared by every scenario.
+type Options struct {
+	Latencies Latencies
+
+	// ApplyCost is the time taken to apply a record once its blocks are in
+	// the page cache.
+	ApplyCost time.Duration
+
+	// HitRatio is the fraction of blocks already in the page cache.
+	HitRatio float64
+
+	// WALRate is the rate, in bytes per second, at which WAL arrives.  Zero
+	// derives the arrival of WAL from the records' commit timestamps.
+	WALRate units.Base2Bytes
+
+	// Seed selects which blocks hit and the latency sampled for each read.
+	// Every scenario reads the same blocks with the same latencies.
+	Seed uint64
+}
+
+// Scenario is a prefaulting configuration.
+type Scenario struct {
+	Readahead units.Base2Bytes
+
+	// Concurrency is the number of concurrent reads.  Zero disables
+	// prefaulting.
+	Concurrency int
+}
+
+// String describes the scenario.
+func (s Scenario) String() string {
+	if s.Concurrency == 0 {
+		return "no prefaulting"
+	}
+
+	return fmt.Sprintf("%s readahead, %d IOs", s.Readahead, s.Concurrency)
+}
+
+// Result is the outcome of replaying the records in a scenario.
+type Result struct {
+	Scenario
+
+	// Replay is how long replay took and WALSpan how long the WAL took to
+	// arrive.  Replay keeps up if it finishes shortly after the WAL arrived.
+	Replay  time.Duration
+	WALSpan time.Duration
+
+	// MaxLag is the longest a record waited to be applied after arriving and
+	// MaxLagBytes the most WAL that arrived but wasn't applied.  FinalLag is
+	// the lag of the last record.
+	MaxLag      time.Duration
+	MaxLagBytes units.Base2Bytes
+	FinalLag    time.Duration
+
+	// Reads is the number of blocks read from storage and Stall the time
+	// replay spent waiting for them.
+	Reads int
+	Stall time.Duration
+}
+
+// Arrivals returns the time at which each record arrives, relative to the
+// first.  Without a WAL rate, records arrive with the latest commit at or
+// before them.
+func Arrivals(records []Record, walRate units.Base2Bytes) ([]time.Duration, error) {
+	arrivals := make([]time.Duration, len(records))
+	if len(records) == 0 {
+		return arrivals, nil
+	}
+
+	if walRate > 0 {
+		for i, r := range records {
+			bytes := float64(r.LSN - records[0].LSN)
+			arrivals[i] = time.Duration(bytes / float64(walRate) * float64(time.Second))
+		}
+
+		return arrivals, nil
+	}
+
+	var start time.Time
+	for _, r := range records {
+		if !r.Time.IsZero() {
+			start = r.Time
+			break
+		}
+	}
+	if start.IsZero() {
+		return nil, errors.New("the WAL contains no commit timestamps, a WAL rate is required")
+	}
+
+	var latest time.Duration
+	for i, r := range records {
+		if !r.Time.IsZero() && r.Time.Sub(start) > latest {
+			latest = r.Time.Sub(start)
+		}
+		arrivals[i] = latest
+	}
+
+	return arrivals, nil
+}
+
+// Simulate replays records, which arrive at arrivals, in scenario s.
+func Simulate(records []Record, arrivals []time.Duration, s Scenario, opts Options) Result {
+	res := Result{Scenario: s}
+	if len(records) == 0 {
+		return res
+	}
+
+	// ready is when each block read so far is, or will be, in the page cache
+	ready := make(map[structs.IOCacheKey]time.Duration)
+	read := func(key structs.IOCacheKey, start time.Duration) time.Duration {
+		h := blockHash(key, opts.Seed)
+		if float64(h>>11)/(1<<53) < opts.HitRatio {
+			ready[key] = 0
+			return 0
+		}
+
+		res.Reads++
+		done := start + opts.Latencies[mix64(h)%uint64(len(opts.Latencies))]
+		ready[key] = done
+		return done
+	}
+
+	workers := make(durationHeap, s.Concurrency)
+	var now time.Duration
+	var issued, arrived int
+	for i, r := range records {
+		if arrivals[i] > now {
+			now = arrivals[i]
+		}
+
+		// Hand the prefaulter every record that has come within the readahead.
+		// A record's blocks can't be read before it arrives.
+		for ; s.Concurrency > 0 && issued < len(records) && records[issued].LSN <= r.LSN+pg.LSN(s.Readahead); issued++ {
+			issue := now
+			if arrivals[issued] > issue {
+				issue = arrivals[issued]
+			}
+
+			for _, key := range records[issued].Blocks {
+				if _, found := ready[key]; found {
+					continue
+				}
+
+				start := issue
+				if workers[0] > start {
+					start = workers[0]
+				}
+				if done := read(key, start); done != 0 {
+					workers[0] = done
+					heap.Fix(&workers, 0)
+				}
+			}
+		}
+
+		for _, key := range r.Blocks {
+			done, found := ready[key]
+			if !found {
+				done = read(key, now)
+			}
+			if done > now {
+				res.Stall += done - now
+				now = done
+			}
+		}
+		now += opts.ApplyCost
+
+		if lag := now - arrivals[i]; lag > res.MaxLag {
+			res.MaxLag = lag
+		}
+		for arrived < len(records) && arrivals[arrived] <= now {
+			arrived++
+		}
+		if lagBytes := units.Base2Bytes(records[arrived-1].LSN - r.LSN); lagBytes > res.MaxLagBytes {
+			res.MaxLagBytes = lagBytes
+		}
+	}
+
+	last := len(records) - 1
+	res.Replay = now
+	res.WALSpan = arrivals[last]
+	res.FinalLag = now - arrivals[last]
+
+	return res
+}
+
+// blockHash hashes key so that whether a block hits and the latency of its read
+// are the same in every scenario.
+func blockHash(key structs.IOCacheKey, seed uint64) uint64 {
+	h := mix64(seed)
+	for _, v := range []uint64{uint64(key.Tablespace), uint64(key.Database), uint64(key.Relation), uint64(key.Block)} {
+		h = mix64(h ^ v)
+	}
+
+	return h
+}
+
+// mix64 is the finalizer of splitmix64.
+func mix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// durationHeap is a min-heap of the times at which each worker is free.
+type durationHeap []time.Duration
+
+func (h durationHeap) Len() int            { return len(h) }
+func (h durationHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h durationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *durationHeap) Push(x interface{}) { *h = append(*h, x.(time.Duration)) }
+func (h *durationHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,175 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whatif
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Record
+		ok  bool
+	}{
+		{ // 0
+			in: "rmgr: Heap        len (rec/tot):     54/  1222, tx:        995, lsn: 0/03000080, prev 0/03000060, desc: INSERT off 4, blkref #0: rel 1663/16384/2671 blk 1 FPW",
+			out: Record{
+				LSN:    pg.MustParseLSN("0/03000080"),
+				Blocks: []structs.IOCacheKey{{Tablespace: 1663, Database: 16384, Relation: 2671, Block: 1}},
+			},
+			ok: true,
+		},
+		{ // 1
+			in: "rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync",
+			out: Record{
+				LSN:  pg.MustParseLSN("0/03000840"),
+				Time: time.Date(2017, time.September, 30, 17, 23, 38, 416563000, time.UTC),
+			},
+			ok: true,
+		},
+		{ // 2
+			in: "pg_waldump: FATAL:  error in WAL record at 0/3000140: invalid record length at 0/3000158: wanted 24, got 0",
+		},
+	}
+
+	for n, test := range tests {
+		r, ok := ParseRecord([]byte(test.in))
+		if ok != test.ok {
+			t.Fatalf("%d: ok %t, want %t", n, ok, test.ok)
+		}
+		if !r.Time.Equal(test.out.Time) {
+			t.Fatalf("%d: time %s, want %s", n, r.Time, test.out.Time)
+		}
+		r.Time, test.out.Time = time.Time{}, time.Time{}
+		if diff := pretty.Compare(test.out, r); diff != "" {
+			t.Fatalf("%d: record diff: (-want +got)\n%s", n, diff)
+		}
+	}
+}
+
+func TestParseLatencies(t *testing.T) {
+	lats, err := ParseLatencies(strings.NewReader("# biolatency\n350us\n\n1.5\n2ms\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Latencies{350 * time.Microsecond, 1500 * time.Microsecond, 2 * time.Millisecond}
+	if diff := pretty.Compare(want, lats); diff != "" {
+		t.Fatalf("latencies diff: (-want +got)\n%s", diff)
+	}
+	if p := lats.Percentile(0.5); p != 1500*time.Microsecond {
+		t.Fatalf("p50 %s", p)
+	}
+
+	if _, err := ParseLatencies(strings.NewReader("fast\n")); err == nil {
+		t.Fatalf("parsed an invalid latency")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	// Three records, 8KiB apart, referencing a block each, all of which
+	// arrived at once.
+	records := make([]Record, 3)
+	for i := range records {
+		records[i] = Record{
+			LSN:    pg.LSN(0x1000000 + i*8192),
+			Blocks: []structs.IOCacheKey{{Tablespace: 1663, Database: 16384, Relation: 16385, Block: pg.HeapBlockNumber(i)}},
+		}
+	}
+	arrivals := make([]time.Duration, len(records))
+	ms := time.Millisecond
+
+	tests := []struct {
+		scenario Scenario
+		hitRatio float64
+		replay   time.Duration
+		maxLag   time.Duration
+		reads    int
+	}{
+		{ // 0: every read stalls replay
+			replay: 3 * ms,
+			maxLag: 3 * ms,
+			reads:  3,
+		},
+		{ // 1: all three reads are in flight at once
+			scenario: Scenario{Readahead: units.MiB, Concurrency: 3},
+			replay:   ms,
+			maxLag:   ms,
+			reads:    3,
+		},
+		{ // 2: a single IO reads the blocks back to back
+			scenario: Scenario{Readahead: units.MiB, Concurrency: 1},
+			replay:   3 * ms,
+			maxLag:   3 * ms,
+			reads:    3,
+		},
+		{ // 3: the readahead only reaches the next record
+			scenario: Scenario{Readahead: 8 * units.KiB, Concurrency: 3},
+			replay:   2 * ms,
+			maxLag:   2 * ms,
+			reads:    3,
+		},
+		{ // 4: everything is cached
+			hitRatio: 1,
+		},
+	}
+
+	for n, test := range tests {
+		res := Simulate(records, arrivals, test.scenario, Options{
+			Latencies: Latencies{ms},
+			HitRatio:  test.hitRatio,
+		})
+		if res.Replay != test.replay || res.MaxLag != test.maxLag || res.Reads != test.reads {
+			t.Fatalf("%d: replay %s, max lag %s, reads %d, want %s, %s, %d", n,
+				res.Replay, res.MaxLag, res.Reads, test.replay, test.maxLag, test.reads)
+		}
+	}
+}
+
+func TestArrivals(t *testing.T) {
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{LSN: 0x1000000},
+		{LSN: 0x1000100, Time: start},
+		{LSN: 0x1000200},
+		{LSN: 0x1000300, Time: start.Add(time.Second)},
+	}
+
+	arrivals, err := Arrivals(records, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare([]time.Duration{0, 0, 0, time.Second}, arrivals); diff != "" {
+		t.Fatalf("arrivals diff: (-want +got)\n%s", diff)
+	}
+
+	arrivals, err = Arrivals(records, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrivals[3] != 3*time.Second {
+		t.Fatalf("last record arrived after %s, want 3s", arrivals[3])
+	}
+
+	if _, err := Arrivals(records[:1], 0); err == nil {
+		t.Fatalf("derived arrivals without commit timestamps")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ioWorkersScaleInterval is how often the backpressure controller samples
+	// the IOs pending.
+	ioWorkersScaleInterval = 10 * time.Second
+
+	// ioWorkersIdleIntervals is the number of samples in a row without pending
+	// IOs before the backpressure controller shrinks the IO workers.
+	ioWorkersIdleIntervals = 6
+)
+
+// IOWorkers is the number of IO workers in the shared pool and in each
+// device's elevator.
+type IOWorkers struct {
+	Workers uint `json:"io-workers"`
+}
+
+// errIOCacheNotRunning is returned when the IO workers are resized before the
+// IO cache has started.
+var errIOCacheNotRunning = errors.New("IO cache not running")
+
+// setIOWorkers grows or shrinks the IO worker pools.  The change is logged
+// along with who requested it.
+func (a *Agent) setIOWorkers(w IOWorkers, requester string) error {
+	if a.ioCache == nil {
+		return errIOCacheNotRunning
+	}
+
+	old := a.ioCache.Workers()
+	if err := a.ioCache.SetWorkers(w.Workers); err != nil {
+		return err
+	}
+
+	a.recentEvents.add(recentEvent{
+		Time: time.Now().UTC(),
+		Name: "io-workers-change",
+		Details: map[string]interface{}{
+			"requester": requester,
+			"old":       old,
+			"new":       w.Workers,
+		},
+	})
+	a.log.Info().Str("requester", requester).Uint("old", old).Uint("new", w.Workers).
+		Msg("resized IO worker pools")
+
+	return nil
+}
+
+// scaleIOWorkers is the backpressure controller.  It resizes the IO workers
+// with nextIOWorkers, never below the number the agent started with, until the
+// agent shuts down.
+func (a *Agent) scaleIOWorkers() {
+	ticker := time.NewTicker(ioWorkersScaleInterval)
+	defer ticker.Stop()
+
+	min := a.ioCache.Workers()
+	throttled := a.ioCache.Throttled()
+	var idle int
+	for {
+		select {
+		case <-a.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending := a.ioCache.NumPending()
+		if pending > 0 {
+			idle = 0
+		} else {
+			idle++
+		}
+
+		// IOs held back by the cgroup's io.max or a maintenance window aren't
+		// waiting for workers.
+		held := a.ioCache.Throttled() != throttled ||
+			(a.maintenance != nil && a.maintenance.Open(time.Now()))
+		throttled = a.ioCache.Throttled()
+
+		workers := a.ioCache.Workers()
+		next := nextIOWorkers(workers, pending, held, idle, min, a.ioCache.MaxWorkers())
+		if next == workers {
+			continue
+		}
+		if err := a.setIOWorkers(IOWorkers{Workers: next}, "backpressure controller"); err != nil {
+			a.log.Warn().Err(err).Uint("io-workers", next).Msg("unable to resize IO worker pools")
+			continue
+		}
+		idle = 0
+	}
+}
+
+// nextIOWorkers returns the number of IO workers to resize to.  The workers
+// grow by half while more IOs are pending than there are workers, unless the
+// IOs are held back, and shrink by a quarter after ioWorkersIdleIntervals
+// samples without pending IOs.  The result is kept within min and max.
+func nextIOWorkers(workers uint, pending int64, held bool, idle int, min, max uint) uint {
+	next := workers
+	switch {
+	case pending > int64(workers) && !held:
+		next = workers + (workers+1)/2
+	case idle >= ioWorkersIdleIntervals:
+		next = workers - workers/4
+	}
+
+	switch {
+	case next > max:
+		next = max
+	case next < min:
+		next = min
+	}
+
+	return next
+}
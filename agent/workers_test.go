@@ -0,0 +1,69 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import "testing"
+
+func TestNextIOWorkers(t *testing.T) {
+	tests := []struct {
+		workers uint
+		pending int64
+		held    bool
+		idle    int
+		next    uint
+	}{
+		{ // 0: keeping up
+			workers: 16,
+			pending: 8,
+			next:    16,
+		},
+		{ // 1: IOs queue behind the workers
+			workers: 16,
+			pending: 40,
+			next:    24,
+		},
+		{ // 2: IOs are held back by io.max or a maintenance window
+			workers: 16,
+			pending: 40,
+			held:    true,
+			next:    16,
+		},
+		{ // 3: capped
+			workers: 60,
+			pending: 400,
+			next:    64,
+		},
+		{ // 4: idle, but not for long enough
+			workers: 32,
+			idle:    ioWorkersIdleIntervals - 1,
+			next:    32,
+		},
+		{ // 5
+			workers: 32,
+			idle:    ioWorkersIdleIntervals,
+			next:    24,
+		},
+		{ // 6: never below the workers started with
+			workers: 18,
+			idle:    ioWorkersIdleIntervals,
+			next:    16,
+		},
+	}
+
+	for n, test := range tests {
+		if next := nextIOWorkers(test.workers, test.pending, test.held, test.idle, 16, 64); next != test.next {
+			t.Fatalf("%d: %d IO workers, want %d", n, next, test.next)
+		}
+	}
+}
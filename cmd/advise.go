@@ -0,0 +1,104 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/advisor"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// adviseHTTPTimeout bounds the request made to a running agent's /advice
+// endpoint.
+const adviseHTTPTimeout = 30 * time.Second
+
+var adviseArgs struct {
+	url  string
+	json bool
+}
+
+// adviseCmd prints the tuning advisor's recommendations from a running agent
+var adviseCmd = &cobra.Command{
+	Use:   "advise",
+	Short: "Print tuning recommendations from a running agent",
+	Long: fmt.Sprintf(`Print the recommendations of a running %s's tuning advisor.  The advisor
+correlates the agent's recent metrics, e.g. queued IOs, read latency, the lag,
+and dropped work, and suggests configuration changes.  The agent is reached at
+--url, which defaults to the configured HTTP listener.`, buildtime.PROGNAME),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addr := adviseArgs.url
+		if addr == "" {
+			addr = viper.GetString(config.KeyHTTPListenAddr)
+		}
+		if addr == "" {
+			return fmt.Errorf("--url is required when %s is not set", config.KeyHTTPListenAddr)
+		}
+
+		auth, err := config.NewHTTPAuth()
+		if err != nil {
+			return err
+		}
+		client, err := lib.NewHTTPClient(auth, adviseHTTPTimeout)
+		if err != nil {
+			return err
+		}
+
+		r, err := advisor.Fetch(context.Background(), client, addr)
+		if err != nil {
+			return err
+		}
+
+		if adviseArgs.json {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return errors.Wrap(enc.Encode(r), "unable to encode advice")
+		}
+
+		printAdvice(os.Stdout, r)
+		return nil
+	},
+}
+
+// printAdvice renders r for a human.
+func printAdvice(w io.Writer, r advisor.Report) {
+	fmt.Fprintf(w, "%d observations over %s\n", r.Observations, r.Window)
+	if len(r.Advice) == 0 {
+		fmt.Fprintln(w, "No recommendations.")
+		return
+	}
+
+	for _, advice := range r.Advice {
+		fmt.Fprintf(w, "\n[%s]\n  finding:        %s\n  recommendation: %s\n",
+			advice.Check, advice.Finding, advice.Recommendation)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(adviseCmd)
+
+	adviseCmd.Flags().StringVar(&adviseArgs.url, "url", "", "Address of a running agent's HTTP listener (default from the configuration)")
+	adviseCmd.Flags().BoolVar(&adviseArgs.json, "json", false, "Print the report as JSON")
+}
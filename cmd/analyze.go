@@ -0,0 +1,253 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/whatif"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/waldump"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var analyzeArgs struct {
+	walDir      string
+	walDumpPath string
+	start       string
+	end         string
+	latencyFile string
+	latency     time.Duration
+	readahead   []string
+	concurrency []int
+	applyCost   time.Duration
+	hitRatio    float64
+	walRate     string
+	seed        uint64
+}
+
+// analyzeCmd estimates replay lag with and without prefaulting
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Estimate replay lag with and without prefaulting",
+	Long: `Decode a directory of WAL segments and estimate how far behind recovery
+would fall replaying them, without prefaulting and with prefaulting at each
+combination of --readahead and --concurrency.
+
+Recovery is modeled as a single process that applies each record once it has
+arrived and every block it references is in the page cache, reading missing
+blocks synchronously.  Read latencies are sampled from --latency-file, one
+recorded latency per line (e.g. "350us", or a number of milliseconds), or fixed
+at --latency.  WAL arrives as it was committed, per the commit timestamps in the
+WAL, or at --wal-rate bytes per second.  The page cache starts cold, except for
+--hit-ratio of the blocks.`,
+	Args: cobra.NoArgs,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, scenarios, err := analyzeOptions()
+		if err != nil {
+			return lib.ConfigError(err)
+		}
+
+		walDir := analyzeArgs.walDir
+		if walDir == "" {
+			walDir = filepath.Join(viper.GetString(config.KeyPGData), pg.WALDirectory)
+		}
+		first, last, err := walSegmentRange(walDir, analyzeArgs.start, analyzeArgs.end)
+		if err != nil {
+			return err
+		}
+
+		walDumpPath := analyzeArgs.walDumpPath
+		if walDumpPath == "" {
+			walDumpPath = viper.GetString(config.KeyXLogPath)
+		}
+		if walDumpPath == "" {
+			// The WAL isn't necessarily PGDATA's, in which case the newest
+			// pg_waldump(1) will have to do.
+			pgMajor, _ := pg.ReadVersion(viper.GetString(config.KeyPGData))
+			if walDumpPath, err = waldump.Find(context.Background(), pgMajor); err != nil {
+				return lib.ConfigError(errors.Wrap(err, "--waldump-bin is required"))
+			}
+		}
+		records, err := whatif.Decode(context.Background(), walDumpPath, first, last)
+		if err != nil {
+			return errors.Wrap(err, "unable to decode WAL")
+		}
+
+		arrivals, err := whatif.Arrivals(records, opts.WALRate)
+		if err != nil {
+			return lib.ConfigError(err)
+		}
+
+		results := make([]whatif.Result, 0, len(scenarios))
+		for _, s := range scenarios {
+			results = append(results, whatif.Simulate(records, arrivals, s, opts))
+		}
+
+		fmt.Printf("Analyzed %d records in %s through %s, read latency p50 %s, p99 %s\n\n",
+			len(records), filepath.Base(first), filepath.Base(last),
+			opts.Latencies.Percentile(0.5), opts.Latencies.Percentile(0.99))
+		return renderAnalysis(os.Stdout, results)
+	},
+}
+
+// analyzeOptions returns the options and scenarios given on the command line.
+func analyzeOptions() (whatif.Options, []whatif.Scenario, error) {
+	opts := whatif.Options{
+		ApplyCost: analyzeArgs.applyCost,
+		HitRatio:  analyzeArgs.hitRatio,
+		Seed:      analyzeArgs.seed,
+	}
+
+	switch {
+	case analyzeArgs.latencyFile != "":
+		f, err := os.Open(analyzeArgs.latencyFile)
+		if err != nil {
+			return opts, nil, errors.Wrap(err, "unable to open the latency file")
+		}
+		defer f.Close()
+
+		if opts.Latencies, err = whatif.ParseLatencies(f); err != nil {
+			return opts, nil, err
+		}
+	case analyzeArgs.latency > 0:
+		opts.Latencies = whatif.Latencies{analyzeArgs.latency}
+	default:
+		return opts, nil, errors.New("--latency-file or --latency is required")
+	}
+
+	if opts.HitRatio < 0 || opts.HitRatio > 1 {
+		return opts, nil, fmt.Errorf("--hit-ratio must be between 0 and 1 (%g)", opts.HitRatio)
+	}
+
+	if analyzeArgs.walRate != "" {
+		rate, err := units.ParseBase2Bytes(analyzeArgs.walRate)
+		if err != nil {
+			return opts, nil, errors.Wrap(err, "invalid --wal-rate")
+		}
+		opts.WALRate = rate
+	}
+
+	scenarios := []whatif.Scenario{{}}
+	for _, raw := range analyzeArgs.readahead {
+		readahead, err := units.ParseBase2Bytes(raw)
+		if err != nil {
+			return opts, nil, errors.Wrap(err, "invalid --readahead")
+		}
+
+		for _, concurrency := range analyzeArgs.concurrency {
+			if concurrency < 1 {
+				return opts, nil, fmt.Errorf("--concurrency must be at least 1 (%d)", concurrency)
+			}
+			scenarios = append(scenarios, whatif.Scenario{Readahead: readahead, Concurrency: concurrency})
+		}
+	}
+
+	return opts, scenarios, nil
+}
+
+// walSegmentRange returns the paths of the first and last segments to analyze
+// in dir.  Unless start and end name them, the first and last segments in dir
+// are used.
+func walSegmentRange(dir, start, end string) (string, string, error) {
+	if start == "" || end == "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", "", errors.Wrap(err, "unable to list the WAL directory")
+		}
+
+		var segments []string
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			if _, _, err := pg.ParseWalfile(pg.WALFilename(fi.Name())); err == nil {
+				segments = append(segments, fi.Name())
+			}
+		}
+		if len(segments) == 0 {
+			return "", "", lib.ConfigError(fmt.Errorf("no WAL segments in %q", dir))
+		}
+		sort.Strings(segments)
+
+		if start == "" {
+			start = segments[0]
+		}
+		if end == "" {
+			end = segments[len(segments)-1]
+		}
+	}
+
+	return filepath.Join(dir, start), filepath.Join(dir, end), nil
+}
+
+// renderAnalysis writes a table of results.
+func renderAnalysis(w io.Writer, results []whatif.Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SCENARIO\tREPLAY\tWAL SPAN\tMAX LAG\tMAX LAG BYTES\tFINAL LAG\tREADS\tSTALLED\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t\n", r.Scenario,
+			r.Replay.Round(time.Millisecond), r.WALSpan.Round(time.Millisecond),
+			r.MaxLag.Round(time.Millisecond), formatBytes(r.MaxLagBytes), r.FinalLag.Round(time.Millisecond),
+			r.Reads, r.Stall.Round(time.Millisecond))
+	}
+
+	return tw.Flush()
+}
+
+// formatBytes formats b to one decimal place in the largest unit it spans.
+func formatBytes(b units.Base2Bytes) string {
+	for _, u := range []struct {
+		size units.Base2Bytes
+		name string
+	}{{units.GiB, "GiB"}, {units.MiB, "MiB"}, {units.KiB, "KiB"}} {
+		if b >= u.size {
+			return fmt.Sprintf("%.1f%s", float64(b)/float64(u.size), u.name)
+		}
+	}
+
+	return fmt.Sprintf("%dB", b)
+}
+
+func init() {
+	RootCmd.AddCommand(analyzeCmd)
+
+	flags := analyzeCmd.Flags()
+	flags.StringVar(&analyzeArgs.walDir, "wal-dir", "", "Directory of WAL segments (default PGDATA/pg_wal)")
+	flags.StringVar(&analyzeArgs.walDumpPath, "waldump-bin", "", "Path to pg_waldump(1) (default from the configuration, or discovered)")
+	flags.StringVar(&analyzeArgs.start, "start-segment", "", "Name of the first segment to analyze (default the oldest in --wal-dir)")
+	flags.StringVar(&analyzeArgs.end, "end-segment", "", "Name of the last segment to analyze (default the newest in --wal-dir)")
+	flags.StringVar(&analyzeArgs.latencyFile, "latency-file", "", "File of recorded read latencies, one per line")
+	flags.DurationVar(&analyzeArgs.latency, "latency", 0, "Fixed read latency, in lieu of --latency-file")
+	flags.StringSliceVar(&analyzeArgs.readahead, "readahead", []string{"16MiB", "64MiB", "256MiB"}, "Readaheads to estimate")
+	flags.IntSliceVar(&analyzeArgs.concurrency, "concurrency", []int{4, 16, 64}, "Numbers of concurrent IOs to estimate")
+	flags.DurationVar(&analyzeArgs.applyCost, "apply-cost", 5*time.Microsecond, "Time to apply a record whose blocks are cached")
+	flags.Float64Var(&analyzeArgs.hitRatio, "hit-ratio", 0, "Fraction of blocks already in the page cache")
+	flags.StringVar(&analyzeArgs.walRate, "wal-rate", "", "Rate at which WAL arrives per second, e.g. 16MiB (default from commit timestamps)")
+	flags.Uint64Var(&analyzeArgs.seed, "seed", 1, "Seed for sampling hits and latencies")
+}
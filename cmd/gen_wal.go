@@ -0,0 +1,158 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/walgen"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var genWALArgs struct {
+	dir           string
+	startSegment  string
+	segments      uint
+	version       uint
+	seed          int64
+	mix           string
+	tablespace    uint64
+	database      uint64
+	firstRelation uint64
+	relations     uint
+	blocks        uint64
+	skew          float64
+}
+
+// genWALCmd synthesizes WAL segments for benchmarks and integration tests
+var genWALCmd = &cobra.Command{
+	Use:   "gen-wal",
+	Short: "Generate synthetic WAL segments for testing",
+	Long: fmt.Sprintf(`Write WAL segments filled with a synthetic workload of heap, B-tree, and
+commit records.  The records reference --relations relations, chosen with a
+Zipf distribution of exponent --skew (0 chooses uniformly), and are drawn from
+--mix.  The same --seed generates the same segments.
+
+The segments can be decoded by "%s gen-wal dump", which accepts the
+arguments of pg_waldump(1) and can stand in for it via --waldump-bin, e.g. with
+a wrapper script running:
+
+    exec %s gen-wal dump "$@"`, buildtime.PROGNAME, buildtime.PROGNAME),
+	Args: cobra.NoArgs,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mix, err := walgen.ParseMix(genWALArgs.mix)
+		if err != nil {
+			return lib.ConfigError(err)
+		}
+
+		tli, startLSN, err := pg.ParseWalfile(pg.WALFilename(genWALArgs.startSegment))
+		if err != nil {
+			return lib.ConfigError(errors.Wrap(err, "invalid start segment"))
+		}
+
+		g, err := walgen.NewGenerator(walgen.Workload{
+			Seed:          genWALArgs.seed,
+			Mix:           mix,
+			Tablespace:    pg.OID(genWALArgs.tablespace),
+			Database:      pg.OID(genWALArgs.database),
+			FirstRelation: pg.OID(genWALArgs.firstRelation),
+			Relations:     genWALArgs.relations,
+			Blocks:        pg.HeapBlockNumber(genWALArgs.blocks),
+			Skew:          genWALArgs.skew,
+		})
+		if err != nil {
+			return lib.ConfigError(err)
+		}
+
+		if err := os.MkdirAll(genWALArgs.dir, 0700); err != nil {
+			return errors.Wrap(err, "unable to create the WAL directory")
+		}
+
+		res, err := walgen.Write(g, walgen.Options{
+			Dir:          genWALArgs.dir,
+			Timeline:     tli,
+			StartSegment: startLSN.SegmentNumber(),
+			Segments:     genWALArgs.segments,
+			Version:      genWALArgs.version,
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Info().Strs("files", res.Files).Uint64("records", res.Records).
+			Str("mix", mix.String()).Msg("generated WAL")
+
+		return nil
+	},
+}
+
+var genWALDumpArgs struct {
+	follow bool
+}
+
+// genWALDumpCmd decodes generated WAL segments like pg_waldump(1)
+var genWALDumpCmd = &cobra.Command{
+	Use:   "dump STARTSEG [ENDSEG]",
+	Short: "Decode generated WAL segments like pg_waldump(1)",
+	Long: `Decode segments written by gen-wal and print their records in the format of
+pg_waldump(1).  As with pg_waldump(1), running out of WAL is reported on
+stderr and exits with status 1.`,
+	Args: cobra.RangeArgs(1, 2),
+
+	// Standing in for pg_waldump(1), stdout must only carry records and the
+	// agent invoking dump already owns the pprof listener.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+
+	Run: func(cmd *cobra.Command, args []string) {
+		var endPath string
+		if len(args) > 1 {
+			endPath = args[1]
+		}
+
+		if err := walgen.Dump(os.Stdout, args[0], endPath); err != nil {
+			fmt.Fprintf(os.Stderr, "pg_waldump: FATAL:  %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(genWALCmd)
+	genWALCmd.AddCommand(genWALDumpCmd)
+
+	flags := genWALCmd.Flags()
+	flags.StringVar(&genWALArgs.dir, "dir", ".", "Directory to write the segments to")
+	flags.StringVar(&genWALArgs.startSegment, "start-segment", "000000010000000000000001", "Name of the first segment, which determines the timeline")
+	flags.UintVar(&genWALArgs.segments, "segments", 1, "Number of segments to write")
+	flags.UintVar(&genWALArgs.version, "pg-version", 12, "Major version of PostgreSQL whose WAL format is written (10 through 16)")
+	flags.Int64Var(&genWALArgs.seed, "seed", 1, "Seed of the generated workload")
+	flags.StringVar(&genWALArgs.mix, "mix", walgen.DefaultMix.String(), "Relative frequency of each kind of record")
+	flags.Uint64Var(&genWALArgs.tablespace, "tablespace", 1663, "OID of the relations' tablespace")
+	flags.Uint64Var(&genWALArgs.database, "database-oid", 16384, "OID of the relations' database")
+	flags.Uint64Var(&genWALArgs.firstRelation, "first-relation", 16385, "Relfilenode of the first relation")
+	flags.UintVar(&genWALArgs.relations, "relations", 100, "Number of heap relations, each with one B-tree index")
+	flags.Uint64Var(&genWALArgs.blocks, "blocks", 10000, "Initial size of each relation in blocks")
+	flags.Float64Var(&genWALArgs.skew, "skew", 1.1, "Exponent of the Zipf distribution relations are chosen with (must be greater than 1, or 0 for uniform)")
+
+	genWALDumpCmd.Flags().BoolVarP(&genWALDumpArgs.follow, "follow", "f", false, "Accepted for compatibility with pg_waldump(1), ignored")
+}
@@ -0,0 +1,413 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/waldump"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Formats supported by generate-config
+const (
+	configFormatTOML = "toml"
+	configFormatYAML = "yaml"
+)
+
+// boundFlags maps configuration keys to the flag bound to each key.  A flag's
+// usage documents its key in generated configurations.
+var boundFlags = map[string]*pflag.Flag{}
+
+// bindFlag binds key to flag and remembers the binding for generate-config.
+func bindFlag(key string, flag *pflag.Flag) {
+	viper.BindPFlag(key, flag)
+	boundFlags[key] = flag
+}
+
+// keyDescriptions documents the configuration keys that have no flag.
+var keyDescriptions = map[string]string{
+	config.KeyArchiveBinPath:          "Path to wal-g(1) or pgbackrest(1) (defaults to searching PATH)",
+	config.KeyArchiveCommand:          `Command run when the archive fetcher is "command": %f is replaced with the WAL filename and %p with the destination path, like restore_command`,
+	config.KeyArchiveFetchTimeout:     "Maximum time to fetch one WAL segment from the archive",
+	config.KeyArchivePGBackRestStanza: "pgBackRest stanza of the archive",
+	config.KeyAlertClearAfter:         "How long the lag must stay at or below the threshold before the alert is cleared",
+	config.KeyAlertFor:                "How long the lag must stay above the threshold before alerting",
+	config.KeyAlertFormat:             `Alert payload: "json", "slack", or "pagerduty" (Events API v2)`,
+	config.KeyAlertRoutingKey:         "Integration key of the PagerDuty service alerted",
+	config.KeyAlertTimeout:            "Time allowed to send an alert",
+	config.KeyCloudWatchDimensions:    `Dimensions added to every metric published to CloudWatch (e.g. "Cluster=orders")`,
+	config.KeyCloudWatchInterval:      "Interval between publications to CloudWatch",
+	config.KeyCloudWatchMetrics:       `Metrics published to CloudWatch, without the "pg_prefaulter_" prefix`,
+	config.KeyCloudWatchNamespace:     "CloudWatch namespace of the published metrics",
+	config.KeyCloudWatchRegion:        "AWS region metrics are published to (defaults to AWS_REGION or the EC2 instance's region)",
+	config.KeyHooksEvents:             `Events delivered to the hook command and URL (empty for all): "lag-threshold", "prefault-failures", "role-change", or "timeline-switch"`,
+	config.KeyHooksFailureThreshold:   "Consecutive failed WAL prefaults that fire the prefault-failures event (0 disables)",
+	config.KeyHooksLagThreshold:       "Lag at which the lag-threshold event fires (0B disables)",
+	config.KeyHooksTimeout:            "Time allowed for the hook command and URL to handle an event",
+	config.KeyPGLogFormat:             `Format of the server log tailed by --pg-log: "auto" (from the file extension), "csvlog", or "jsonlog"`,
+	config.KeyPGQueries:               `SQL replacing the queries generated for the server's version, keyed by query name, e.g. "lag-follower"`,
+	config.KeyPGQueryDir:              `Directory of SQL files replacing the queries generated for the server's version, e.g. "lag-follower.sql" (an escape hatch)`,
+	config.KeyPGSession:               `Session parameters set on every connection to PostgreSQL, e.g. statement_timeout = "30s"`,
+	config.KeyConsulAddress:           "Address of the local Consul agent (CONSUL_HTTP_ADDR)",
+	config.KeyConsulCheckTTL:          "TTL of the Consul check",
+	config.KeyConsulDeregisterAfter:   "How long the Consul check may be critical before the service is deregistered",
+	config.KeyConsulMaxLag:            `The Consul check warns when the replay lag exceeds this size ("0B" disables the warning)`,
+	config.KeyConsulMaxScanAge:        "The Consul check fails if no WAL scan completes within this duration",
+	config.KeyConsulServiceID:         "ID of the Consul service (defaults to the service name and hostname)",
+	config.KeyConsulServiceName:       "Name of the Consul service",
+	config.KeyConsulTags:              "Tags of the Consul service",
+	config.KeyConsulToken:             "Consul ACL token (CONSUL_HTTP_TOKEN)",
+	config.KeyPGPassword:              "Password to connect to PostgreSQL (PGPASSWORD)",
+}
+
+// secretKeys are the configuration keys that may hold credentials: their
+// values are never written to a generated configuration.
+var secretKeys = map[string]bool{
+	config.KeyAlertRoutingKey:     true,
+	config.KeyAlertURL:            true,
+	config.KeyBufferCacheConninfo: true,
+	config.KeyConsulToken:         true,
+	config.KeyHooksURL:            true,
+	config.KeyPGPassword:          true,
+}
+
+var generateConfigArgs struct {
+	format string
+	output string
+	probe  bool
+}
+
+// generateConfigCmd emits a commented configuration file
+var generateConfigCmd = &cobra.Command{
+	Use:   "generate-config",
+	Short: "Generate a commented sample configuration",
+	Long: fmt.Sprintf(`Emit a configuration file documenting every configuration key and its
+default value.  Keys are commented out unless they were found by --probe, which
+inspects PGDATA and its running postmaster to fill in the data directory, the
+PostgreSQL port and socket directory, and the path to pg_waldump(1).  Values
+taken from the environment or an existing configuration file are reflected as
+well.  %s reads the configuration via --config.`, buildtime.PROGNAME),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var probed map[string]interface{}
+		if generateConfigArgs.probe {
+			probed = probeConfig(viper.GetString(config.KeyPGData))
+		}
+
+		var buf bytes.Buffer
+		if err := renderConfig(&buf, generateConfigArgs.format, configEntries(probed)); err != nil {
+			return err
+		}
+
+		if generateConfigArgs.output == "" || generateConfigArgs.output == "-" {
+			_, err := os.Stdout.Write(buf.Bytes())
+			return err
+		}
+
+		if err := ioutil.WriteFile(generateConfigArgs.output, buf.Bytes(), 0600); err != nil {
+			return errors.Wrap(err, "unable to write configuration")
+		}
+
+		return nil
+	},
+}
+
+// configEntry is a key of a generated configuration.
+type configEntry struct {
+	section     string
+	name        string
+	value       interface{}
+	description string
+
+	// set is true if the key is written uncommented.
+	set bool
+}
+
+// configEntries returns every configuration key, except those of hidden flags,
+// ordered by section.  Keys present in probed take the probed value and are
+// set.  The values of secretKeys are left empty.
+func configEntries(probed map[string]interface{}) []configEntry {
+	keys := viper.AllKeys()
+	entries := make([]configEntry, 0, len(keys))
+	for _, key := range keys {
+		flag, found := boundFlags[key]
+		if found && flag.Hidden {
+			continue
+		}
+
+		e := configEntry{
+			name:        key,
+			value:       viper.Get(key),
+			description: keyDescriptions[key],
+		}
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			e.section, e.name = key[:i], key[i+1:]
+		}
+		if found {
+			e.description = fmt.Sprintf("%s (--%s)", flag.Usage, flag.Name)
+		}
+		if v, found := probed[key]; found {
+			e.value = v
+			e.set = true
+		}
+		if secretKeys[key] {
+			e.value = ""
+			e.description += ", redacted from generated configurations"
+		}
+
+		entries = append(entries, e)
+	}
+
+	// Keys outside of a section must precede the first TOML table
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].section != entries[j].section {
+			return entries[i].section < entries[j].section
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	return entries
+}
+
+// renderConfig writes entries to w as a configuration file in format.
+func renderConfig(w io.Writer, format string, entries []configEntry) error {
+	switch format {
+	case configFormatTOML, configFormatYAML:
+	default:
+		return fmt.Errorf("unsupported configuration format %q (supported formats: %q, %q)", format, configFormatTOML, configFormatYAML)
+	}
+
+	bw := bufio.NewWriter(w)
+	writeComment(bw, "", fmt.Sprintf(`%s configuration generated by "%s generate-config".
+Keys that are commented out show their default value.  Every key can also be
+set from the environment, e.g. run.sidecar as %s_RUN_SIDECAR.`, buildtime.PROGNAME, buildtime.PROGNAME, config.EnvPrefix))
+
+	// YAML section headers containing a set key are written uncommented
+	live := make(map[string]bool)
+	for _, e := range entries {
+		if e.set {
+			for s := e.section; s != ""; s = parentSection(s) {
+				live[s] = true
+			}
+		}
+	}
+
+	written := map[string]bool{"": true}
+	for _, e := range entries {
+		var indent, assign string
+		switch format {
+		case configFormatTOML:
+			if !written[e.section] {
+				written[e.section] = true
+				fmt.Fprintf(bw, "\n[%s]\n", e.section)
+			}
+			assign = " = "
+		case configFormatYAML:
+			// Write the headers of the enclosing sections not yet written
+			var headers []string
+			for s := e.section; !written[s]; s = parentSection(s) {
+				headers = append([]string{s}, headers...)
+			}
+			for _, s := range headers {
+				written[s] = true
+				comment := "#"
+				if live[s] {
+					comment = ""
+				}
+				fmt.Fprintf(bw, "\n%s%s%s:\n", yamlIndent(s), comment, s[strings.LastIndex(s, ".")+1:])
+			}
+			if e.section != "" {
+				indent = yamlIndent(e.section) + "  "
+			}
+			assign = ": "
+		}
+
+		writeComment(bw, indent, e.description)
+		if !e.set {
+			indent += "#"
+		}
+		fmt.Fprintf(bw, "%s%s%s%s\n", indent, e.name, assign, formatConfigValue(e.value))
+	}
+
+	return bw.Flush()
+}
+
+// parentSection returns the section enclosing section.
+func parentSection(section string) string {
+	i := strings.LastIndex(section, ".")
+	if i < 0 {
+		return ""
+	}
+
+	return section[:i]
+}
+
+// yamlIndent returns the indentation of the YAML header of section.
+func yamlIndent(section string) string {
+	return strings.Repeat("  ", strings.Count(section, "."))
+}
+
+// writeComment writes text as comment lines wrapped at 80 columns.
+func writeComment(w io.Writer, indent, text string) {
+	const width = 80
+
+	prefix := indent + "#"
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := prefix
+		for _, word := range strings.Fields(paragraph) {
+			if len(line)+1+len(word) > width && line != prefix {
+				fmt.Fprintln(w, line)
+				line = prefix
+			}
+			line += " " + word
+		}
+		if line != prefix {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// formatConfigValue formats v as a TOML value.  The values used by the
+// configuration are also valid YAML.
+func formatConfigValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return `""`
+	case string:
+		return strconv.Quote(v)
+	case time.Duration:
+		return strconv.Quote(v.String())
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	case []string:
+		values := make([]string, 0, len(v))
+		for _, s := range v {
+			values = append(values, strconv.Quote(s))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, formatConfigValue(e))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case map[string]string:
+		// Populated tables are flattened into their keys by viper, leaving
+		// only empty tables, which are written the same in TOML and YAML.
+		if len(v) == 0 {
+			return "{}"
+		}
+		return strconv.Quote(fmt.Sprint(v))
+	default:
+		return strconv.Quote(fmt.Sprint(v))
+	}
+}
+
+// probeConfig inspects pgdata and its running postmaster, if any, and returns
+// the configuration values they imply.
+func probeConfig(pgdata string) map[string]interface{} {
+	probed := make(map[string]interface{})
+
+	pgdata, err := filepath.Abs(pgdata)
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to probe PGDATA")
+		return probed
+	}
+
+	version, err := ioutil.ReadFile(path.Join(pgdata, "PG_VERSION"))
+	if err != nil {
+		log.Warn().Err(err).Str("pgdata", pgdata).Msg("not a PostgreSQL data directory, skipping probe (see --pgdata)")
+		return probed
+	}
+	probed[config.KeyPGData] = pgdata
+
+	// pg_waldump(1) was named pg_xlogdump(1) prior to PostgreSQL 10
+	walDump := "pg_waldump"
+	if strings.HasPrefix(string(version), "9.") {
+		walDump = "pg_xlogdump"
+	}
+
+	// postmaster.pid holds the postmaster's PID, PGDATA, start time, port, and
+	// socket directory, one per line.
+	if buf, err := ioutil.ReadFile(path.Join(pgdata, "postmaster.pid")); err == nil {
+		lines := strings.Split(string(buf), "\n")
+		if len(lines) > 3 {
+			if port, err := strconv.Atoi(strings.TrimSpace(lines[3])); err == nil {
+				probed[config.KeyPGPort] = port
+			}
+		}
+		if len(lines) > 4 {
+			if socketDir := strings.TrimSpace(lines[4]); socketDir != "" {
+				probed[config.KeyPGHost] = socketDir
+			}
+		}
+
+		// pg_waldump(1) is installed alongside the postgres binary
+		if exe, err := os.Readlink(path.Join("/proc", strings.TrimSpace(lines[0]), "exe")); err == nil {
+			if p := path.Join(path.Dir(exe), walDump); isExecutable(p) {
+				probed[config.KeyXLogPath] = p
+			}
+		}
+	}
+
+	if _, found := probed[config.KeyXLogPath]; !found {
+		if pgMajor, err := pg.ParseVersion(string(version)); err == nil {
+			if p, err := waldump.Find(context.Background(), pgMajor); err == nil {
+				probed[config.KeyXLogPath] = p
+			} else {
+				log.Warn().Err(err).Msg("unable to probe " + config.KeyXLogPath)
+			}
+		}
+	}
+
+	for key, value := range probed {
+		log.Info().Str("key", key).Interface("value", value).Msg("probed configuration")
+	}
+
+	return probed
+}
+
+// isExecutable returns true if p is an executable file.
+func isExecutable(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0
+}
+
+func init() {
+	RootCmd.AddCommand(generateConfigCmd)
+
+	generateConfigCmd.Flags().StringVar(&generateConfigArgs.format, "format", configFormatTOML, `Configuration format ("toml" or "yaml")`)
+	generateConfigCmd.Flags().StringVarP(&generateConfigArgs.output, "output", "o", "", "File to write the configuration to (default stdout)")
+	generateConfigCmd.Flags().BoolVar(&generateConfigArgs.probe, "probe", false, "Fill in the configuration by inspecting PGDATA and its running postmaster")
+}
@@ -0,0 +1,104 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/viper"
+)
+
+func TestConfigEntriesDescribed(t *testing.T) {
+	for _, e := range configEntries(nil) {
+		if e.description == "" {
+			t.Errorf("%s.%s has no description", e.section, e.name)
+		}
+	}
+}
+
+func TestConfigEntriesRedacted(t *testing.T) {
+	for key, secret := range map[string]string{
+		config.KeyPGPassword:  "hunter2",
+		config.KeyConsulToken: "0b6c1a52-7c4c-4f0e-a1a4-4e1c0d2b9f11",
+	} {
+		defer viper.Set(key, viper.Get(key))
+		viper.Set(key, secret)
+	}
+
+	for _, e := range configEntries(map[string]interface{}{config.KeyAlertURL: "https://hooks.slack.com/services/T0/B0/secret"}) {
+		key := e.name
+		if e.section != "" {
+			key = e.section + "." + e.name
+		}
+		if secretKeys[key] && e.value != "" {
+			t.Errorf("%s not redacted: %v", key, e.value)
+		}
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	probed := map[string]interface{}{
+		config.KeyPGData:   "/var/lib/postgresql/data",
+		config.KeyPGPort:   5433,
+		config.KeyXLogPath: "/usr/lib/postgresql/11/bin/pg_waldump",
+	}
+	entries := configEntries(probed)
+
+	tests := []struct {
+		format string
+	}{
+		{ // 0
+			format: configFormatTOML,
+		},
+		{ // 1
+			format: configFormatYAML,
+		},
+	}
+
+	for n, test := range tests {
+		var buf bytes.Buffer
+		if err := renderConfig(&buf, test.format, entries); err != nil {
+			t.Fatalf("%d: unable to render: %v", n, err)
+		}
+
+		// Only the probed keys are set
+		v := viper.New()
+		v.SetConfigType(test.format)
+		if err := v.ReadConfig(&buf); err != nil {
+			t.Fatalf("%d: unable to parse:\n%s\n%v", n, buf.String(), err)
+		}
+		got := make(map[string]interface{})
+		for _, key := range v.AllKeys() {
+			got[key] = v.Get(key)
+		}
+		want := map[string]interface{}{
+			config.KeyPGData:   "/var/lib/postgresql/data",
+			config.KeyPGPort:   int64(5433),
+			config.KeyXLogPath: "/usr/lib/postgresql/11/bin/pg_waldump",
+		}
+		if test.format == configFormatYAML {
+			want[config.KeyPGPort] = 5433
+		}
+		if diff := pretty.Compare(got, want); diff != "" {
+			t.Fatalf("%d: config diff: (-got +want)\n%s", n, diff)
+		}
+	}
+
+	if err := renderConfig(&bytes.Buffer{}, "json", entries); err == nil {
+		t.Fatalf("expected an unsupported format to fail")
+	}
+}
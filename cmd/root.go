@@ -24,6 +24,8 @@ import (
 
 	"github.com/bschofield/pg_prefaulter/buildtime"
 	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/lib/journald"
 	isatty "github.com/mattn/go-isatty"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -76,7 +78,9 @@ already loaded into the OS'es filesystem cache.
 			}
 
 			if logFmt == config.LogFormatAuto {
-				if isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+				if journald.Connected() {
+					logFmt = config.LogFormatJournald
+				} else if isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()) {
 					logFmt = config.LogFormatHuman
 				} else {
 					logFmt = config.LogFormatZerolog
@@ -96,6 +100,13 @@ already loaded into the OS'es filesystem cache.
 				}
 				zlog = zerolog.New(w).With().Timestamp().Logger()
 
+			case config.LogFormatJournald:
+				w, err := journald.NewWriter()
+				if err != nil {
+					return errors.Wrap(err, "unable to initialize journald logging")
+				}
+				zlog = zerolog.New(w).With().Caller().Logger()
+
 			default:
 				return fmt.Errorf("unsupported log format: %q", logFmt)
 			}
@@ -142,16 +153,22 @@ already loaded into the OS'es filesystem cache.
 	},
 }
 
+// Execute runs the command line.  Errors exit with the code of their category
+// (see lib.ErrorCategory).
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(lib.CategoryOf(err).ExitCode())
 	}
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
+	RootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return lib.ConfigError(err)
+	})
+
 	zerolog.TimeFieldFormat = config.LogTimeFormat
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 
@@ -175,7 +192,7 @@ func init() {
 		)
 
 		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
@@ -184,12 +201,12 @@ func init() {
 			key         = config.KeyAgentLogFormat
 			longName    = "log-format"
 			shortName   = "F"
-			description = `Specify the log format ("auto", "zerolog" or "human")`
+			description = `Specify the log format ("auto", "zerolog", "human", or "journald")`
 		)
 
 		defaultValue := config.LogFormatAuto.String()
 		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
@@ -207,7 +224,7 @@ func init() {
 		}
 
 		RootCmd.PersistentFlags().BoolP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
@@ -222,7 +239,7 @@ func init() {
 		)
 
 		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.BindEnv(key, envVar)
 		viper.SetDefault(key, defaultValue)
 	}
@@ -238,7 +255,7 @@ func init() {
 		)
 
 		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.BindEnv(key, envVar)
 		viper.SetDefault(key, defaultValue)
 	}
@@ -250,11 +267,11 @@ func init() {
 			shortName    = "p"
 			defaultValue = 5432
 			envVar       = "PGPORT"
-			description  = "Hostname to connect to PostgreSQL"
+			description  = "Port to connect to PostgreSQL"
 		)
 
 		RootCmd.PersistentFlags().UintP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.BindEnv(key, envVar)
 		viper.SetDefault(key, defaultValue)
 	}
@@ -269,8 +286,8 @@ func init() {
 			description  = "Database name to connect to"
 		)
 
-		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, defaultValue)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, description)
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.BindEnv(key, envVar)
 		viper.SetDefault(key, defaultValue)
 	}
@@ -286,7 +303,7 @@ func init() {
 		)
 
 		RootCmd.PersistentFlags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.BindEnv(key, envVar)
 		viper.SetDefault(key, defaultValue)
 	}
@@ -312,7 +329,7 @@ func init() {
 		)
 
 		RootCmd.PersistentFlags().BoolP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
@@ -326,7 +343,7 @@ func init() {
 		)
 
 		RootCmd.PersistentFlags().Uint16P(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(longName))
+		bindFlag(key, RootCmd.PersistentFlags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 }
@@ -335,6 +352,13 @@ func init() {
 func initConfig() {
 	viper.SetConfigName(buildtime.PROGNAME)
 
+	// Every key can be set from the environment (e.g. run.sidecar ==
+	// PG_PREFAULTER_RUN_SIDECAR) so that a container can be configured entirely
+	// via its environment and the downward API.
+	viper.SetEnvPrefix(config.EnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
+
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
@@ -14,12 +14,18 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/bschofield/pg_prefaulter/agent"
+	"github.com/bschofield/pg_prefaulter/agent/pglog"
 	"github.com/bschofield/pg_prefaulter/buildtime"
 	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/bschofield/pg_prefaulter/pg/waldump"
 	"github.com/pkg/errors"
 	log "github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -38,26 +44,37 @@ var runCmd = &cobra.Command{
 
 		// Perform input validation
 		{
-			validArgs := []string{"auto", "primary", "follower"}
+			validArgs := []string{"auto", "primary", "follower", "repmgr", "pitr"}
 			if err := config.ValidStringArg(config.KeyPGMode, validArgs); err != nil {
-				return errors.Wrapf(err, "%q validation", config.KeyPGMode)
+				return lib.ConfigError(errors.Wrapf(err, "%q validation", config.KeyPGMode))
 			}
 		}
 
 		{
 			validArgs := []string{"pg", "xlog"}
 			if err := config.ValidStringArg(config.KeyXLogMode, validArgs); err != nil {
-				return errors.Wrapf(err, "%q validation", config.KeyXLogMode)
+				return lib.ConfigError(errors.Wrapf(err, "%q validation", config.KeyXLogMode))
 			}
 		}
 
 		{
-			_, err := os.Stat(viper.GetString(config.KeyXLogPath))
-			if err != nil {
-				return errors.Wrapf(err, "failed to stat %s (%q)", config.KeyXLogPath, viper.GetString(config.KeyXLogPath))
+			validArgs := []string{"default", "best-effort", "idle"}
+			if err := config.ValidStringArg(config.KeyIOClass, validArgs); err != nil {
+				return lib.ConfigError(errors.Wrapf(err, "%q validation", config.KeyIOClass))
 			}
 		}
 
+		{
+			validArgs := []string{"none", "wal-g", "pgbackrest", "command", "sql"}
+			if err := config.ValidStringArg(config.KeyArchiveFetcher, validArgs); err != nil {
+				return lib.ConfigError(errors.Wrapf(err, "%q validation", config.KeyArchiveFetcher))
+			}
+		}
+
+		if err := resolveWALDump(); err != nil {
+			return err
+		}
+
 		defer func() {
 			// FIXME(seanc@): Iterate over known viper keys and automatically log
 			// values.
@@ -65,10 +82,18 @@ var runCmd = &cobra.Command{
 				Str(config.KeyPGData, viper.GetString(config.KeyPGData)).
 				Str(config.KeyPGHost, viper.GetString(config.KeyPGHost)).
 				Uint(config.KeyPGPort, uint(viper.GetInt(config.KeyPGPort))).
+				Strs(config.KeyPGHosts, viper.GetStringSlice(config.KeyPGHosts)).
 				Str(config.KeyPGUser, viper.GetString(config.KeyPGUser)).
 				Str(config.KeyXLogMode, viper.GetString(config.KeyXLogMode)).
 				Str(config.KeyXLogPath, viper.GetString(config.KeyXLogPath)).
+				Strs(config.KeyXLogArgs, viper.GetStringSlice(config.KeyXLogArgs)).
+				Strs(config.KeyXLogEnv, viper.GetStringSlice(config.KeyXLogEnv)).
+				Strs(config.KeyXLogWrapper, viper.GetStringSlice(config.KeyXLogWrapper)).
 				Dur(config.KeyPGPollInterval, viper.GetDuration(config.KeyPGPollInterval)).
+				Dur(config.KeyPGPollMaxInterval, viper.GetDuration(config.KeyPGPollMaxInterval)).
+				Bool(config.KeySidecar, viper.GetBool(config.KeySidecar)).
+				Str(config.KeyHTTPListenAddr, viper.GetString(config.KeyHTTPListenAddr)).
+				Bool(config.KeyVerifyChecksums, viper.GetBool(config.KeyVerifyChecksums)).
 				Msg("flags")
 		}()
 
@@ -81,20 +106,118 @@ var runCmd = &cobra.Command{
 
 		cfg, err := config.NewDefault()
 		if err != nil {
-			return errors.Wrap(err, "unable to generate default config")
+			return configError(errors.Wrap(err, "unable to generate default config"))
+		}
+
+		if err := dropPrivileges(&cfg.Agent); err != nil {
+			return err
 		}
 
-		a, err := agent.New(cfg)
+		a, err := agent.New(cfg, agent.WithSignals())
 		if err != nil {
 			return errors.Wrap(err, "unable to start agent")
 		}
-		go a.Start()
+
+		// The agent labels its own logger, label everything else that logs
+		log.Logger = lib.LabelLogger(log.Logger, cfg.Agent.Labels)
+		go a.Start(context.Background())
 		defer a.Stop()
 
 		return a.Wait()
 	},
 }
 
+// resolveWALDump verifies the configured pg_waldump(1) exists or, when none is
+// configured, finds the one matching PG_VERSION.  In sidecar mode PGDATA may
+// not exist yet, in which case only the presence of a pg_waldump(1) is checked
+// and the agent finds the matching one once PG_VERSION can be read.
+func resolveWALDump() error {
+	if p := viper.GetString(config.KeyXLogPath); p != "" {
+		if _, err := os.Stat(p); err != nil {
+			return configError(errors.Wrapf(err, "failed to stat %s (%q)", config.KeyXLogPath, p))
+		}
+		return nil
+	}
+
+	// Only pg_waldump(1) is discovered, not the xlog variant
+	if viper.GetString(config.KeyXLogMode) != "pg" {
+		return lib.ConfigError(fmt.Errorf("%s is required with %s %q", config.KeyXLogPath, config.KeyXLogMode, viper.GetString(config.KeyXLogMode)))
+	}
+
+	pgMajor, versionErr := pg.ReadVersion(viper.GetString(config.KeyPGData))
+	if versionErr != nil {
+		pgMajor = 0
+	}
+
+	p, err := waldump.Find(context.Background(), pgMajor)
+	if err != nil {
+		return lib.ConfigError(errors.Wrapf(err, "%s is unset", config.KeyXLogPath))
+	}
+	if versionErr != nil {
+		log.Warn().Err(versionErr).Str("candidate", p).
+			Msg("unable to determine the PostgreSQL version, finding pg_waldump(1) once PG_VERSION is readable")
+		return nil
+	}
+	viper.Set(config.KeyXLogPath, p)
+	log.Info().Str(config.KeyXLogPath, p).Uint64("pg-version", pgMajor).Msg("found pg_waldump(1)")
+
+	return nil
+}
+
+// configError annotates err as a configuration error unless it was caused by a
+// denied operation, e.g. a file the agent isn't permitted to read.
+func configError(err error) error {
+	if lib.CategoryOf(err) == lib.ErrorCategoryPermission {
+		return lib.PermissionError(err)
+	}
+
+	return lib.ConfigError(err)
+}
+
+// dropPrivileges switches to the configured user when started as root.  The
+// open files limit has already been raised by config.New and the HTTP listener,
+// which may use a privileged port, is bound first.  Running as root without a
+// user is refused unless explicitly allowed.
+func dropPrivileges(cfg *config.Agent) error {
+	if os.Geteuid() != 0 {
+		if cfg.User != "" {
+			log.Debug().Str("user", cfg.User).Msg("not running as root, ignoring " + config.KeyUser)
+		}
+		return nil
+	}
+
+	if cfg.User == "" {
+		if !cfg.AllowRoot {
+			return lib.ConfigError(fmt.Errorf("refusing to run as root: use --run-as-user (%s) to drop privileges or --allow-root (%s) to override", config.KeyUser, config.KeyAllowRoot))
+		}
+
+		log.Warn().Msg("running as root")
+		return nil
+	}
+
+	uid, gid, err := lib.LookupIDs(cfg.User, cfg.Group)
+	if err != nil {
+		return lib.ConfigError(err)
+	}
+	if uid == 0 {
+		return lib.ConfigError(fmt.Errorf("%s %q is root", config.KeyUser, cfg.User))
+	}
+
+	if cfg.HTTPListenAddr != "" {
+		if cfg.HTTPListener, err = net.Listen("tcp", cfg.HTTPListenAddr); err != nil {
+			return errors.Wrap(err, "unable to start the http listener")
+		}
+	}
+
+	if err := lib.DropPrivileges(uid, gid); err != nil {
+		return lib.PermissionError(err)
+	}
+
+	log.Info().Str("user", cfg.User).Int("uid", uid).Int("gid", gid).Msg("dropped root privileges")
+
+	return nil
+}
+
 func init() {
 	RootCmd.AddCommand(runCmd)
 
@@ -104,13 +227,118 @@ func init() {
 			longName     = "mode"
 			shortName    = "m"
 			defaultValue = "auto"
-			description  = `Mode of operation of the database: "auto", "primary", "follower"`
+			description  = `Mode of operation of the database: "auto", "primary", "follower", "repmgr", "pitr"`
 		)
 		// FIXME(seanc@): the list of available options needs to be pulled from a
 		// global constant.  This information is duplicated elsewhere in the
 		// validation.
 		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyRepmgrConfig
+			longName     = "repmgr-config"
+			defaultValue = "/etc/repmgr.conf"
+			description  = `Path to repmgr.conf(5) (used when --mode is "repmgr")`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyBufferCacheConninfo
+			longName     = "buffercache-conninfo"
+			defaultValue = ""
+			description  = `Connection string of the primary whose shared buffers, as reported by pg_buffercache, are mirrored (e.g. "host=primary dbname=postgres")`
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyBufferCacheInterval
+			longName     = "buffercache-interval"
+			defaultValue = "5m"
+			description  = "Interval between snapshots of the primary's shared buffers"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key         = config.KeyPGHosts
+			longName    = "hosts"
+			description = `PostgreSQL listeners tried in order, e.g. "/tmp,localhost:5432,10.0.0.5:5432" (overrides --hostname and --port)`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPGConnectTimeout
+			longName     = "connect-timeout"
+			defaultValue = "10s"
+			description  = "Time each PostgreSQL listener has to accept a connection before the next is tried (0 disables the timeout)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPGLogPath
+			longName     = "pg-log"
+			defaultValue = ""
+			description  = "Server csvlog or jsonlog file, or log_directory, to tail for recovery conflicts and stalls"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.SetDefault(config.KeyPGLogFormat, pglog.FormatAuto)
+	}
+
+	{
+		const (
+			key          = config.KeyPITRTargetLSN
+			longName     = "pitr-target-lsn"
+			defaultValue = ""
+			description  = `Stop prefaulting once recovery reaches this LSN (used when --mode is "pitr")`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPITRTargetTime
+			longName     = "pitr-target-time"
+			defaultValue = ""
+			description  = `Stop prefaulting once recovery passes this RFC 3339 time (used when --mode is "pitr")`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
@@ -120,11 +348,24 @@ func init() {
 			longName     = "poll-interval"
 			shortName    = "i"
 			defaultValue = "1s"
-			description  = "Interval to poll the database for state change"
+			description  = "Minimum interval to poll the database for state change"
 		)
 
 		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPGPollMaxInterval
+			longName     = "poll-max-interval"
+			defaultValue = "8s"
+			description  = "Maximum interval between polls while the database's state is unchanged"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
@@ -136,65 +377,972 @@ func init() {
 			description  = `Retry connecting to the database during initialization`
 		)
 		runCmd.Flags().Bool(longName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
 	{
 		const (
-			key          = config.KeyWALReadahead
-			longName     = "wal-readahead-bytes"
-			shortName    = "n"
-			defaultValue = "32MiB"
-			description  = "Maximum number of bytes to pre-fault"
+			key          = config.KeySidecar
+			longName     = "sidecar"
+			defaultValue = false
+			description  = `Run as a sidecar next to a PostgreSQL container (implies --retry-db-init)`
 		)
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
 
-		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+	{
+		const (
+			key          = config.KeyStatePath
+			longName     = "state-path"
+			defaultValue = ""
+			description  = "Embedded store used to persist the agent's WAL position, stall history, and warm set across restarts (disabled if empty)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
 	{
 		const (
-			key          = config.KeyNumIOThreads
-			longName     = "num-io-threads"
-			shortName    = "N"
+			key          = config.KeyStallHistory
+			longName     = "stall-history-path"
+			defaultValue = ""
+			description  = "File used to persist the relations implicated in replay stalls and prioritize their IOs (disabled if empty)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWarmSet
+			longName     = "warm-set-path"
+			defaultValue = ""
+			description  = "File used to persist the most recently prefaulted blocks and re-warm them at startup (disabled if empty)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWarmSetBudget
+			longName     = "warm-set-budget"
+			defaultValue = "1GiB"
+			description  = "Maximum size of the blocks remembered in, and replayed from, the warm set"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key         = config.KeyPeers
+			longName    = "peers"
+			description = `HTTP listeners of peer agents whose hot blocks are shared with this agent (e.g. "replica-2:4243")`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPushGatewayURL
+			longName     = "pushgateway-url"
+			defaultValue = ""
+			description  = "Prometheus Pushgateway the final metrics are pushed to when the agent exits (e.g. \"http://pushgateway:9091\")"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPushGatewayJob
+			longName     = "pushgateway-job"
+			defaultValue = buildtime.PROGNAME
+			description  = "job label of the metrics pushed to the Pushgateway"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPushGatewayInstance
+			longName     = "pushgateway-instance"
+			defaultValue = ""
+			description  = "instance label of the metrics pushed to the Pushgateway (defaults to the hostname)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPeerInterval
+			longName     = "peer-interval"
+			defaultValue = "5m"
+			description  = "Interval between exchanges of hot blocks with peers"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPeerTopBlocks
+			longName     = "peer-top-blocks"
+			defaultValue = 65536
+			description  = "Number of each peer's most recently prefaulted blocks requested per exchange"
+		)
+		runCmd.Flags().Uint64(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyUser
+			longName     = "run-as-user"
+			defaultValue = ""
+			description  = "User (name or uid) to switch to after starting as root"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyGroup
+			longName     = "run-as-group"
+			defaultValue = ""
+			description  = "Group (name or gid) to switch to after starting as root (default the user's primary group)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyAllowRoot
+			longName     = "allow-root"
+			defaultValue = false
+			description  = "Allow running as root without --run-as-user"
+		)
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyOpenFilesLimit
+			longName     = "rlimit-nofile"
 			defaultValue = 0
-			description  = "Number of IO threads to spawn for IOs"
+			description  = "Raise the open files limit (RLIMIT_NOFILE) at startup, 0 to leave it unchanged"
 		)
+		runCmd.Flags().Uint64(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
 
-		runCmd.Flags().UintP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+	{
+		const (
+			key          = config.KeyHTTPListenAddr
+			longName     = "http-listen-addr"
+			defaultValue = ""
+			description  = `Address for the health, readiness, status, and metrics listener (e.g. ":4243")`
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
 	{
 		const (
-			key       = config.KeyXLogPath
-			longName  = "waldump-bin"
-			shortName = "x"
-			// TODO(seanc@): This could/should probably be a build-time constant that
-			// is platform specific.  Similarly, there should probably be a path that
-			// is independent of the binary name.
-			defaultValue = "/usr/local/bin/pg_waldump"
-			description  = "Path to pg_waldump(1)"
+			key          = config.KeyHTTPTLSCert
+			longName     = "http-tls-cert"
+			defaultValue = ""
+			description  = "PEM certificate to serve the HTTP listener over TLS, also presented to peers"
 		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
 
-		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+	{
+		const (
+			key          = config.KeyHTTPTLSKey
+			longName     = "http-tls-key"
+			defaultValue = ""
+			description  = "PEM private key of --http-tls-cert"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 
 	{
 		const (
-			key          = config.KeyXLogMode
-			longName     = "xlog-mode"
-			shortName    = "X"
-			defaultValue = "pg"
-			description  = `pg_waldump(1) variant: "xlog" or "pg"`
+			key          = config.KeyHTTPTLSCA
+			longName     = "http-tls-ca"
+			defaultValue = ""
+			description  = "PEM CA bundle that authenticates client certificates (mTLS) and peers' certificates"
 		)
-		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
-		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyHTTPTokenFile
+			longName     = "http-auth-token-file"
+			defaultValue = ""
+			description  = "File containing a bearer token required by the HTTP listener and sent to peers"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPublicMetrics
+			longName     = "http-public-metrics"
+			defaultValue = false
+			description  = "Serve /metrics without authentication when the HTTP listener requires it"
+		)
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyStartupTimeout
+			longName     = "startup-timeout"
+			defaultValue = "5m"
+			description  = "Maximum time to wait for PGDATA to appear in sidecar mode"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyAdviseInterval
+			longName     = "advise-interval"
+			defaultValue = "10m"
+			description  = "Interval between logging the tuning advisor's recommendations (0 disables logging)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyDrainTimeout
+			longName     = "drain-timeout"
+			defaultValue = "0s"
+			description  = "Maximum time to drain queued work after SIGTERM (0 exits immediately)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPGControlDataPath
+			longName     = "controldata-bin"
+			defaultValue = ""
+			description  = "Path to pg_controldata(1) (defaults to the directory containing pg_waldump(1))"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.SetDefault(config.KeyPGQueryDir, "")
+		viper.SetDefault(config.KeyPGQueries, map[string]string{})
+	}
+
+	{
+		const (
+			key          = config.KeyPGApplicationName
+			longName     = "application-name"
+			defaultValue = buildtime.PROGNAME
+			description  = "application_name identifying the agent's sessions in pg_stat_activity"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.SetDefault(config.KeyPGSession, map[string]string{})
+	}
+
+	{
+		const (
+			key          = config.KeyVerifyChecksums
+			longName     = "verify-checksums"
+			defaultValue = false
+			description  = "Verify the checksum of every page read and report corrupt pages (requires data checksums)"
+		)
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyConsulEnable
+			longName     = "consul"
+			defaultValue = false
+			description  = "Register with the local Consul agent and report progress via a TTL check"
+		)
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.BindEnv(config.KeyConsulAddress, "CONSUL_HTTP_ADDR")
+		viper.SetDefault(config.KeyConsulAddress, "http://127.0.0.1:8500")
+		viper.BindEnv(config.KeyConsulToken, "CONSUL_HTTP_TOKEN")
+		viper.SetDefault(config.KeyConsulToken, "")
+		viper.SetDefault(config.KeyConsulServiceName, "pg-prefaulter")
+		viper.SetDefault(config.KeyConsulServiceID, "")
+		viper.SetDefault(config.KeyConsulTags, []string{})
+		viper.SetDefault(config.KeyConsulCheckTTL, "15s")
+		viper.SetDefault(config.KeyConsulDeregisterAfter, "10m")
+		viper.SetDefault(config.KeyConsulMaxScanAge, "60s")
+		viper.SetDefault(config.KeyConsulMaxLag, "0B")
+	}
+
+	{
+		const (
+			key          = config.KeyCloudWatchEnable
+			longName     = "cloudwatch"
+			defaultValue = false
+			description  = "Publish the lag, prefault rate, and IO queue depth to Amazon CloudWatch"
+		)
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.SetDefault(config.KeyCloudWatchRegion, "")
+		viper.SetDefault(config.KeyCloudWatchNamespace, "pg_prefaulter")
+		viper.SetDefault(config.KeyCloudWatchDimensions, []string{})
+		viper.SetDefault(config.KeyCloudWatchMetrics, []string{"lag_bytes", "prefault_pages_total", "io_pending"})
+		viper.SetDefault(config.KeyCloudWatchInterval, "60s")
+	}
+
+	{
+		const (
+			key         = config.KeyLabels
+			longName    = "labels"
+			description = `Labels attached to every metric, log line, and webhook payload, as "name=value" (e.g. "cluster=orders,datacenter=us-east-1,role=replica")`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyHooksCommand
+			longName     = "hook-command"
+			defaultValue = ""
+			description  = "Shell command run with each event, as JSON, on its stdin"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyHooksURL
+			longName     = "hook-url"
+			defaultValue = ""
+			description  = "Webhook URL each event is POSTed to as JSON"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyAlertLagThreshold
+			longName     = "alert-lag-threshold"
+			defaultValue = "0B"
+			description  = "Alert when the lag stays above this threshold (0B disables alerting)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyAlertURL
+			longName     = "alert-url"
+			defaultValue = ""
+			description  = "Webhook URL alerts are sent to"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.SetDefault(config.KeyAlertClearAfter, "5m")
+		viper.SetDefault(config.KeyAlertFor, "5m")
+		viper.SetDefault(config.KeyAlertFormat, config.AlertFormatJSON)
+		viper.SetDefault(config.KeyAlertRoutingKey, "")
+		viper.SetDefault(config.KeyAlertTimeout, "10s")
+	}
+
+	{
+		viper.SetDefault(config.KeyHooksEvents, []string{})
+		viper.SetDefault(config.KeyHooksFailureThreshold, 5)
+		viper.SetDefault(config.KeyHooksLagThreshold, "0B")
+		viper.SetDefault(config.KeyHooksTimeout, "10s")
+	}
+
+	{
+		const (
+			key          = config.KeyWALDecodeBatchSize
+			longName     = "wal-decode-batch-size"
+			defaultValue = 4
+			description  = "Maximum number of consecutive WAL segments decoded by one pg_waldump(1) invocation"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALDecodeTimeout
+			longName     = "wal-decode-timeout"
+			defaultValue = "60s"
+			description  = "Time pg_waldump(1) may go without printing a record before it is killed (0 disables the timeout)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALSegmentBudget
+			longName     = "wal-segment-budget"
+			defaultValue = "30s"
+			description  = "Time decoding and prefaulting each WAL segment may take before queued segments already replayed are skipped (0 disables skipping)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALMaxDecoders
+			longName     = "wal-max-decoders"
+			defaultValue = 0
+			description  = "Maximum number of concurrent pg_waldump(1) processes (0 uses the number of CPUs)"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALWatch
+			longName     = "wal-watch"
+			defaultValue = true
+			description  = "Rescan as soon as a new WAL segment starts being written instead of waiting for the poll interval"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALTailInterval
+			longName     = "wal-tail-interval"
+			defaultValue = "250ms"
+			description  = "Interval at which the records landing in the WAL segment being written are prefaulted (0 disables tailing)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALReadahead
+			longName     = "wal-readahead-bytes"
+			shortName    = "n"
+			defaultValue = "32MiB"
+			description  = "Maximum number of bytes to pre-fault"
+		)
+
+		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALReadaheadMin
+			longName     = "wal-readahead-min-bytes"
+			defaultValue = "0B"
+			description  = "Least readahead the WAL readahead may be changed to at runtime"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALReadaheadMax
+			longName     = "wal-readahead-max-bytes"
+			defaultValue = "1GiB"
+			description  = "Greatest readahead the WAL readahead may be changed to at runtime (at most 16GiB)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyNumIOThreads
+			longName     = "num-io-threads"
+			shortName    = "N"
+			defaultValue = 0
+			description  = "Number of IO threads to spawn for IOs"
+		)
+
+		runCmd.Flags().UintP(longName, shortName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOWorkersMax
+			longName     = "io-workers-max"
+			defaultValue = config.MaxIOWorkers
+			description  = "Maximum number of IO threads when resized at runtime"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOWorkersAutoscale
+			longName     = "io-workers-autoscale"
+			defaultValue = false
+			description  = "Add IO threads while IOs queue behind them, up to --io-workers-max"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOBatchWindow
+			longName     = "io-batch-window"
+			defaultValue = "5ms"
+			description  = "Time to accumulate IOs before sorting and deduplicating them (0 disables batching)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIndexPrefault
+			longName     = "index-prefault"
+			defaultValue = false
+			description  = "Look up the B-tree indexes of each relation seen in the WAL and prefault their metapage and tail blocks"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIndexTailBlocks
+			longName     = "index-tail-blocks"
+			defaultValue = 4
+			description  = "Number of blocks prefaulted from the end of each index and TOAST table when index-prefault or toast-prefault is enabled"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyToastPrefault
+			longName     = "toast-prefault"
+			defaultValue = false
+			description  = "Look up the TOAST table of each relation seen in the WAL and prefault the tail blocks of the TOAST table and its index"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyLogicalApply
+			longName     = "logical-apply"
+			defaultValue = false
+			description  = "Prefault the tail blocks of the tables and indexes replicated to this database by logical replication subscriptions as changes arrive"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyBootstrapWarm
+			longName     = "bootstrap-warm"
+			defaultValue = false
+			description  = "At startup, decode the WAL present in pg_wal and prefault the blocks it references, relations with the most pending WAL first"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeySandbox
+			longName     = "sandbox"
+			defaultValue = false
+			description  = "Confine the IO workers to reading relation files (seccomp-bpf on Linux, capsicum on FreeBSD)"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPrefaultBackend
+			longName     = "prefault-backend"
+			defaultValue = config.PrefaultBackendPread
+			description  = `How pages are faulted in: "pread", "mmap" (MAP_POPULATE on Linux), or "rdadvise" (macOS only)`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyRecordSize
+			longName     = "record-size"
+			defaultValue = config.RecordSizeAuto
+			description  = `Read relations in aligned records of this size, e.g. a ZFS recordsize ("auto" detects ZFS, "0" reads pages)`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOElevator
+			longName     = "io-elevator"
+			defaultValue = false
+			description  = "Queue IOs per device and issue them in file and offset order (for spinning disks)"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOMaxFraction
+			longName     = "io-max-fraction"
+			defaultValue = 0.5
+			description  = "Throttle reads to this fraction of the read limits in the agent's cgroup io.max (0 disables)"
+		)
+		runCmd.Flags().Float64(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key         = config.KeyMaintenanceWindows
+			longName    = "maintenance-windows"
+			description = `Windows during which prefaulting is paused or throttled, as a crontab(5) schedule and a duration (e.g. "0 2 * * * 3h")`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyMaintenanceIOPS
+			longName     = "maintenance-iops"
+			defaultValue = 0
+			description  = "Reads per second allowed during maintenance windows (0 pauses prefaulting)"
+		)
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIONice
+			longName     = "io-nice"
+			defaultValue = 0
+			description  = "nice(1) level of the IO worker threads (0 leaves it unchanged, e.g. 10 to yield CPU to PostgreSQL, Linux only)"
+		)
+
+		runCmd.Flags().Int(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOClass
+			longName     = "io-class"
+			defaultValue = "default"
+			description  = `ionice(1) scheduling class of the IO worker threads: "default" (unchanged), "best-effort", or "idle" (Linux only)`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOPriority
+			longName     = "io-priority"
+			defaultValue = 7
+			description  = "ionice(1) priority of the IO worker threads in the best-effort class, from 0 (highest) to 7 (lowest)"
+		)
+
+		runCmd.Flags().Int(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyXLogPath
+			longName     = "waldump-bin"
+			shortName    = "x"
+			defaultValue = ""
+			description  = "Path to pg_waldump(1) (defaults to the one matching PGDATA's PG_VERSION)"
+		)
+
+		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key         = config.KeyXLogArgs
+			longName    = "waldump-args"
+			description = `Additional arguments passed to pg_waldump(1) ahead of the WAL files (e.g. "--timeline=2")`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key         = config.KeyXLogEnv
+			longName    = "waldump-env"
+			description = `Environment variables set for pg_waldump(1) as KEY=VALUE pairs (e.g. "LC_ALL=C")`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key         = config.KeyXLogWrapper
+			longName    = "waldump-wrapper"
+			description = `Command and arguments pg_waldump(1) is run under (e.g. "nice,-n,10")`
+		)
+		defaultValue := []string{}
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyArchiveFetcher
+			longName     = "archive-fetcher"
+			defaultValue = "none"
+			description  = `Fetch WAL segments missing from pg_wal from an archive: "none", "wal-g", "pgbackrest", "command", or "sql" (PostgreSQL's own pg_wal, via pg_read_binary_file())`
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyArchiveScratchDir
+			longName     = "archive-scratch-dir"
+			defaultValue = "/var/tmp/" + buildtime.PROGNAME
+			description  = "Directory archived WAL segments are fetched into for decoding"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		viper.SetDefault(config.KeyArchiveBinPath, "")
+		viper.SetDefault(config.KeyArchiveCommand, "")
+		viper.SetDefault(config.KeyArchivePGBackRestStanza, "")
+		viper.SetDefault(config.KeyArchiveFetchTimeout, "60s")
+	}
+
+	{
+		const (
+			key          = config.KeyXLogMode
+			longName     = "xlog-mode"
+			shortName    = "X"
+			defaultValue = "pg"
+			description  = `pg_waldump(1) variant: "xlog" or "pg"`
+		)
+		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	// The fault injection flags are hidden: they're only for testing the agent.
+	{
+		const (
+			key          = config.KeyFaultDelay
+			longName     = "fault-pread-delay"
+			defaultValue = "0s"
+			description  = "Latency injected into pread(2)s (testing only)"
+		)
+		runCmd.Flags().String(longName, defaultValue, description)
+		runCmd.Flags().MarkHidden(longName)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyFaultDelayRate
+			longName     = "fault-pread-delay-rate"
+			defaultValue = 0.0
+			description  = "Fraction of pread(2)s delayed by --fault-pread-delay (testing only)"
+		)
+		runCmd.Flags().Float64(longName, defaultValue, description)
+		runCmd.Flags().MarkHidden(longName)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyFaultEIORate
+			longName     = "fault-pread-eio-rate"
+			defaultValue = 0.0
+			description  = "Fraction of pread(2)s that fail with EIO (testing only)"
+		)
+		runCmd.Flags().Float64(longName, defaultValue, description)
+		runCmd.Flags().MarkHidden(longName)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyFaultDecodeRate
+			longName     = "fault-decode-failure-rate"
+			defaultValue = 0.0
+			description  = "Fraction of pg_waldump(1) invocations that fail (testing only)"
+		)
+		runCmd.Flags().Float64(longName, defaultValue, description)
+		runCmd.Flags().MarkHidden(longName)
+		bindFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
 }
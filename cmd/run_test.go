@@ -0,0 +1,43 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/viper"
+)
+
+func TestConfigPeers(t *testing.T) {
+	for key, value := range map[string]interface{}{
+		config.KeyPeers:        []string{"http://replica-1:4242", "http://replica-2:4242"},
+		config.KeyPeerInterval: 30 * time.Second,
+	} {
+		defer viper.Set(key, viper.Get(key))
+		viper.Set(key, value)
+	}
+
+	cfg, err := config.NewDefault()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"http://replica-1:4242", "http://replica-2:4242"}
+	if diff := pretty.Compare(cfg.Peers, want); diff != "" {
+		t.Fatalf("peers diff: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var selfTestArgs struct {
+	duration time.Duration
+	json     bool
+}
+
+// selfTestCmd runs the pipeline against a live follower and reports whether
+// it is prefaulting
+var selfTestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Verify prefaulting works against a live follower",
+	Long: fmt.Sprintf(`Run %s's full pipeline against a live follower for --duration and report
+whether each stage produced output: WAL segments decoded, blocks queued, and
+pages prefaulted.  The residency of a sample of the pages prefaulted is checked
+in the filesystem cache before and after each is read to measure how much
+prefaulting is doing.
+
+The self-test reads the configuration file, the environment, and the global
+flags as "run" does but doesn't serve HTTP, save state, or notify hooks,
+alerts, Consul, or metrics sinks, so it may run next to a running agent.  It
+exits non-zero if any check fails.`, buildtime.PROGNAME),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if selfTestArgs.duration <= 0 {
+			return lib.ConfigError(fmt.Errorf("--duration must be positive (%s)", selfTestArgs.duration))
+		}
+
+		if err := resolveWALDump(); err != nil {
+			return err
+		}
+
+		cfg, err := config.NewDefault()
+		if err != nil {
+			return configError(errors.Wrap(err, "unable to generate default config"))
+		}
+		isolateSelfTest(cfg)
+
+		if err := dropPrivileges(&cfg.Agent); err != nil {
+			return err
+		}
+
+		a, err := agent.New(cfg, agent.WithSignals())
+		if err != nil {
+			return errors.Wrap(err, "unable to start agent")
+		}
+
+		r, err := a.SelfTest(context.Background(), selfTestArgs.duration)
+		if err != nil {
+			return errors.Wrap(err, "self-test stopped")
+		}
+
+		if selfTestArgs.json {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(r); err != nil {
+				return errors.Wrap(err, "unable to encode self-test report")
+			}
+		} else {
+			printSelfTest(os.Stdout, r)
+		}
+
+		if !r.Passed {
+			return errors.New("self-test failed")
+		}
+
+		return nil
+	},
+}
+
+// isolateSelfTest disables everything that would be shared with, or be
+// mistaken for, an agent already running against the same database.
+func isolateSelfTest(cfg *config.Config) {
+	cfg.Agent.HTTPListenAddr = ""
+	cfg.Agent.StatePath = ""
+	cfg.Agent.StallHistoryPath = ""
+	cfg.Agent.WarmSetPath = ""
+	cfg.Agent.PushGatewayURL = ""
+	cfg.Agent.Peers = nil
+	cfg.AlertConfig.LagThreshold = 0
+	cfg.CloudWatchConfig.Enable = false
+	cfg.ConsulConfig.Enable = false
+	cfg.HooksConfig.Command = ""
+	cfg.HooksConfig.URL = ""
+}
+
+// printSelfTest renders r for a human.
+func printSelfTest(w io.Writer, r agent.SelfTestReport) {
+	fmt.Fprintf(w, "Ran for %s against a %s\n\n", r.Duration, r.Role)
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "[%s] %-9s %s\n", c.Result, c.Name, c.Detail)
+	}
+
+	if r.Passed {
+		fmt.Fprintln(w, "\nPASS")
+	} else {
+		fmt.Fprintln(w, "\nFAIL")
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(selfTestCmd)
+
+	selfTestCmd.Flags().DurationVar(&selfTestArgs.duration, "duration", time.Minute, "How long to run the pipeline for")
+	selfTestCmd.Flags().BoolVar(&selfTestArgs.json, "json", false, "Print the report as JSON")
+}
@@ -0,0 +1,157 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// sidecarManifestTmpl is an example Pod running PostgreSQL with
+// pg_prefaulter(1) as a sidecar.  The two containers share PGDATA and the
+// PostgreSQL socket directory.  The sidecar is configured entirely via its
+// environment.
+var sidecarManifestTmpl = template.Must(template.New("sidecar").Parse(`---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Name }}
+  labels:
+    app: {{ .Name }}
+spec:
+  terminationGracePeriodSeconds: 30
+  volumes:
+    - name: pgdata
+      persistentVolumeClaim:
+        claimName: {{ .Name }}-pgdata
+    - name: pgsocket
+      emptyDir: {}
+  containers:
+    - name: postgresql
+      image: {{ .PostgreSQLImage }}
+      env:
+        - name: PGDATA
+          value: {{ .PGData }}
+      volumeMounts:
+        - name: pgdata
+          mountPath: {{ .PGDataMount }}
+        - name: pgsocket
+          mountPath: {{ .SocketDir }}
+    - name: prefaulter
+      image: {{ .Image }}
+      args: ["run"]
+      securityContext:
+        runAsUser: {{ .RunAsUID }}
+        runAsNonRoot: true
+      env:
+        - name: POD_IP
+          valueFrom:
+            fieldRef:
+              fieldPath: status.podIP
+        - name: {{ .EnvPrefix }}_RUN_SIDECAR
+          value: "true"
+        - name: {{ .EnvPrefix }}_RUN_HTTP_LISTEN_ADDR
+          value: "$(POD_IP):{{ .HTTPPort }}"
+        - name: {{ .EnvPrefix }}_RUN_DRAIN_TIMEOUT
+          value: "25s"
+        - name: {{ .EnvPrefix }}_RUN_STARTUP_TIMEOUT
+          value: "10m"
+        - name: {{ .EnvPrefix }}_RUN_LOG_FORMAT
+          value: "json"
+        - name: {{ .EnvPrefix }}_POSTGRESQL_XLOG_PG_WALDUMP_PATH
+          value: {{ .WALDumpPath }}
+        - name: PGDATA
+          value: {{ .PGData }}
+        - name: PGHOST
+          value: {{ .SocketDir }}
+        - name: PGUSER
+          value: postgres
+        - name: PGPASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: {{ .Name }}-credentials
+              key: password
+      ports:
+        - name: http
+          containerPort: {{ .HTTPPort }}
+      readinessProbe:
+        httpGet:
+          path: /readyz
+          port: http
+        periodSeconds: 5
+      livenessProbe:
+        httpGet:
+          path: /healthz
+          port: http
+        periodSeconds: 10
+      volumeMounts:
+        - name: pgdata
+          mountPath: {{ .PGDataMount }}
+          readOnly: true
+        - name: pgsocket
+          mountPath: {{ .SocketDir }}
+`))
+
+type sidecarManifest struct {
+	Name            string
+	Image           string
+	PostgreSQLImage string
+	PGData          string
+	PGDataMount     string
+	SocketDir       string
+	WALDumpPath     string
+	HTTPPort        uint
+	RunAsUID        uint
+	EnvPrefix       string
+}
+
+var sidecarManifestArgs = sidecarManifest{
+	EnvPrefix: config.EnvPrefix,
+}
+
+// sidecarManifestCmd emits an example Kubernetes manifest
+var sidecarManifestCmd = &cobra.Command{
+	Use:   "sidecar-manifest",
+	Short: "Generate an example Kubernetes sidecar manifest",
+	Long:  fmt.Sprintf(`Emit an example Kubernetes Pod manifest running %s as a sidecar next to PostgreSQL`, buildtime.PROGNAME),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := sidecarManifestTmpl.Execute(os.Stdout, sidecarManifestArgs); err != nil {
+			return errors.Wrap(err, "unable to render sidecar manifest")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(sidecarManifestCmd)
+
+	flags := sidecarManifestCmd.Flags()
+	flags.StringVar(&sidecarManifestArgs.Name, "name", "postgresql", "Name of the Pod")
+	flags.StringVar(&sidecarManifestArgs.Image, "image", buildtime.PROGNAME+":latest", "Image containing "+buildtime.PROGNAME)
+	flags.StringVar(&sidecarManifestArgs.PostgreSQLImage, "postgresql-image", "postgres:13", "Image containing PostgreSQL")
+	flags.StringVar(&sidecarManifestArgs.PGDataMount, "pgdata-mount", "/var/lib/postgresql/data", "Mount point of the PGDATA volume")
+	flags.StringVar(&sidecarManifestArgs.PGData, "pgdata-path", "/var/lib/postgresql/data/pgdata", "Path to PGDATA inside of the volume")
+	flags.StringVar(&sidecarManifestArgs.SocketDir, "socket-dir", "/var/run/postgresql", "Directory containing the PostgreSQL socket")
+	flags.StringVar(&sidecarManifestArgs.WALDumpPath, "waldump-bin", "/usr/local/bin/pg_waldump", "Path to pg_waldump(1) inside of the sidecar image")
+	flags.UintVar(&sidecarManifestArgs.HTTPPort, "http-port", 4243, "Port of the readiness listener")
+	flags.UintVar(&sidecarManifestArgs.RunAsUID, "run-as-uid", 999, "UID the sidecar runs as (the owner of PGDATA in the PostgreSQL image)")
+}
@@ -14,28 +14,66 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"github.com/bschofield/pg_prefaulter/agent"
 	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
+var versionArgs struct {
+	json bool
+}
+
 // versionCmd displays version information
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: buildtime.PROGNAME + ` version information`,
-	Long:  fmt.Sprintf(`Display %s version information`, buildtime.PROGNAME),
+	Long: fmt.Sprintf(`Display %s version information: how the binary was built, the versions of
+PostgreSQL it supports, and the features compiled in for its platform.`, buildtime.PROGNAME),
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		fmt.Printf("%s:\n", buildtime.PROGNAME)
-		fmt.Printf("\tversion: %s\n", buildtime.VERSION)
-		fmt.Printf("\tcommit: %s\n", buildtime.COMMIT)
-		fmt.Printf("\tdate: %s\n", buildtime.DATE)
-		fmt.Printf("\ttag: %s\n", buildtime.TAG)
+		b := agent.Build()
+		if versionArgs.json {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return errors.Wrap(enc.Encode(b), "unable to encode version information")
+		}
+
+		printVersion(os.Stdout, b)
 		return nil
 	},
 }
 
+// printVersion renders b for a human.
+func printVersion(w io.Writer, b agent.BuildInfo) {
+	list := func(l []string) string {
+		if len(l) == 0 {
+			return "none"
+		}
+		return strings.Join(l, ", ")
+	}
+
+	fmt.Fprintf(w, "%s:\n", buildtime.PROGNAME)
+	fmt.Fprintf(w, "\tversion: %s\n", b.Version)
+	fmt.Fprintf(w, "\tcommit: %s\n", b.Commit)
+	fmt.Fprintf(w, "\tdate: %s\n", b.Date)
+	fmt.Fprintf(w, "\ttag: %s\n", b.Tag)
+	fmt.Fprintf(w, "\tgo version: %s\n", b.GoVersion)
+	fmt.Fprintf(w, "\tplatform: %s\n", b.Platform)
+	fmt.Fprintf(w, "\tpostgresql versions: %s\n", list(b.PostgreSQLVersions))
+	fmt.Fprintf(w, "\twal decoders: %s\n", list(b.WALDecoders))
+	fmt.Fprintf(w, "\tprefault backends: %s\n", list(b.PrefaultBackends))
+	fmt.Fprintf(w, "\tfeatures: %s\n", list(b.Features))
+}
+
 func init() {
 	RootCmd.AddCommand(versionCmd)
+
+	versionCmd.Flags().BoolVar(&versionArgs.json, "json", false, "Print the version information as JSON")
 }
@@ -0,0 +1,253 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/agent/state"
+	"github.com/bschofield/pg_prefaulter/agent/warmset"
+	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// warmSetHTTPTimeout bounds requests made to a running agent's /warmset
+// endpoint.
+const warmSetHTTPTimeout = 30 * time.Second
+
+// warmSetArgs are the flags shared by export-warmset and import-warmset.
+type warmSetArgs struct {
+	statePath   string
+	warmSetPath string
+	file        string
+	url         string
+}
+
+var (
+	exportWarmSetArgs warmSetArgs
+	importWarmSetArgs warmSetArgs
+)
+
+// exportWarmSetCmd writes a warm set manifest for use by another replica
+var exportWarmSetCmd = &cobra.Command{
+	Use:   "export-warmset",
+	Short: "Export the warm set as a manifest of hot blocks",
+	Long: fmt.Sprintf(`Export the blocks most recently prefaulted by %s as a compact manifest of
+block ranges.  The manifest is read from a running agent when --url is given,
+otherwise from the warm set saved in --state-path or --warm-set-path.`, buildtime.PROGNAME),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		wsArgs := exportWarmSetArgs.resolve(cmd)
+
+		var m warmset.Manifest
+		if wsArgs.url != "" {
+			client, err := warmSetClient()
+			if err != nil {
+				return err
+			}
+			if m, err = warmset.Fetch(context.Background(), client, wsArgs.url, 0); err != nil {
+				return err
+			}
+		} else {
+			blob, closeFn, err := wsArgs.blob()
+			if err != nil {
+				return err
+			}
+			defer closeFn()
+
+			var found bool
+			if m, found, err = warmset.ReadManifest(blob); err != nil {
+				return err
+			} else if !found {
+				return fmt.Errorf("no warm set saved in %s", blob)
+			}
+		}
+
+		buf, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "unable to encode warm set")
+		}
+		buf = append(buf, '\n')
+
+		if wsArgs.file == "" || wsArgs.file == "-" {
+			_, err = os.Stdout.Write(buf)
+		} else {
+			err = ioutil.WriteFile(wsArgs.file, buf, 0644)
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to write warm set")
+		}
+
+		return nil
+	},
+}
+
+// importWarmSetCmd seeds the warm set from a manifest exported by another
+// replica
+var importWarmSetCmd = &cobra.Command{
+	Use:   "import-warmset",
+	Short: "Import a warm set manifest exported by another replica",
+	Long: fmt.Sprintf(`Import a warm set manifest produced by export-warmset.  When --url is given the
+manifest is sent to a running agent, which prefaults its blocks immediately.
+Otherwise the manifest is merged into the warm set saved in --state-path or
+--warm-set-path and is prefaulted the next time %s starts.`, buildtime.PROGNAME),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		wsArgs := importWarmSetArgs.resolve(cmd)
+
+		var buf []byte
+		var err error
+		if wsArgs.file == "" || wsArgs.file == "-" {
+			buf, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			buf, err = ioutil.ReadFile(wsArgs.file)
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to read warm set")
+		}
+
+		var m warmset.Manifest
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return errors.Wrap(err, "unable to parse warm set")
+		}
+
+		if wsArgs.url != "" {
+			return postWarmSet(wsArgs.url, buf)
+		}
+
+		budget, err := units.ParseBase2Bytes(viper.GetString(config.KeyWarmSetBudget))
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse %s", config.KeyWarmSetBudget)
+		}
+		if m.BlockSize <= 0 {
+			return fmt.Errorf("invalid warm set block size (%d)", m.BlockSize)
+		}
+
+		blob, closeFn, err := wsArgs.blob()
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		// The replica's geometry isn't known offline: the manifest's block size is
+		// used and the agent discards the warm set at startup if it differs.
+		s := warmset.New(blob, budget, units.Base2Bytes(m.BlockSize))
+		if err := s.Load(context.Background()); err != nil {
+			return err
+		}
+		if err := s.Import(m); err != nil {
+			return err
+		}
+
+		return s.Save()
+	},
+}
+
+// resolve returns a's flags with --state-path and --warm-set-path defaulting
+// to the agent's configuration.
+func (a warmSetArgs) resolve(cmd *cobra.Command) warmSetArgs {
+	if !cmd.Flags().Changed("state-path") {
+		a.statePath = viper.GetString(config.KeyStatePath)
+	}
+	if !cmd.Flags().Changed("warm-set-path") {
+		a.warmSetPath = viper.GetString(config.KeyWarmSet)
+	}
+
+	return a
+}
+
+// blob opens where the warm set is persisted, following the same precedence
+// as the agent.  The returned func releases the state store.
+func (a warmSetArgs) blob() (state.Blob, func(), error) {
+	switch {
+	case a.warmSetPath != "":
+		return state.File(a.warmSetPath), func() {}, nil
+	case a.statePath != "":
+		store, err := state.Open(a.statePath)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to open state store (use --url if the agent is running)")
+		}
+
+		return store.Blob(state.BucketWarmSet, "manifest"), func() { store.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("one of --url, --state-path, or --warm-set-path is required")
+	}
+}
+
+// postWarmSet sends a manifest to the warm set endpoint of the agent listening
+// on addr.
+func postWarmSet(addr string, manifest []byte) error {
+	client, err := warmSetClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(warmset.URL(addr), "application/json", bytes.NewReader(manifest))
+	if err != nil {
+		return errors.Wrapf(err, "unable to reach agent at %s", addr)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("agent at %s: %s: %s", addr, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// warmSetClient returns a client for a running agent's /warmset endpoint that
+// authenticates the same way the agent's peers do.
+func warmSetClient() (*http.Client, error) {
+	auth, err := config.NewHTTPAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	return lib.NewHTTPClient(auth, warmSetHTTPTimeout)
+}
+
+func init() {
+	for _, c := range []struct {
+		cmd      *cobra.Command
+		args     *warmSetArgs
+		fileFlag string
+		fileDesc string
+	}{
+		{exportWarmSetCmd, &exportWarmSetArgs, "output", "File to write the manifest to (default stdout)"},
+		{importWarmSetCmd, &importWarmSetArgs, "input", "File to read the manifest from (default stdin)"},
+	} {
+		RootCmd.AddCommand(c.cmd)
+
+		flags := c.cmd.Flags()
+		flags.StringVar(&c.args.statePath, "state-path", "", "Path to the agent's state store (default from the configuration)")
+		flags.StringVar(&c.args.warmSetPath, "warm-set-path", "", "Path to the agent's warm set file (default from the configuration)")
+		flags.StringVar(&c.args.url, "url", "", "Address of a running agent's HTTP listener")
+		flags.StringVarP(&c.args.file, c.fileFlag, "", "", c.fileDesc)
+	}
+}
@@ -15,12 +15,18 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"os"
 	"path"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/units"
-	"github.com/bschofield/pg_prefaulter/buildtime"
+	"github.com/bschofield/pg_prefaulter/agent/hooks"
+	"github.com/bschofield/pg_prefaulter/agent/maintenance"
+	"github.com/bschofield/pg_prefaulter/agent/pglog"
 	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/jackc/pgx"
 	"github.com/pkg/errors"
@@ -37,16 +43,235 @@ type Config struct {
 	DBPool
 
 	Agent
+	AlertConfig
+	CloudWatchConfig
+	ConsulConfig
+	FaultConfig
 	FHCacheConfig
+	HooksConfig
+	IndexCacheConfig
 	IOCacheConfig
 	WALCacheConfig
 }
 
 type Agent struct {
 	PostgreSQLPIDPath string
+	ControlDataPath   string
 	LogFormat         LogFormat
 	RetryInit         bool
 	UseColors         bool
+
+	// PGData is the PostgreSQL data directory.  PGMode is how the database's
+	// role is determined: "auto", "primary", "follower", "repmgr", or "pitr".
+	// RepmgrConfigPath is repmgr.conf(5) in "repmgr" mode.
+	PGData           string
+	PGMode           string
+	RepmgrConfigPath string
+
+	// DBHosts are the listeners tried, in order, whenever the agent connects
+	// to PostgreSQL.  Each one has DBConnectTimeout to establish a connection
+	// before the next is tried.  DBHosts is empty when only the host and port
+	// in the DBPool are used.
+	DBHosts          []DBHost
+	DBConnectTimeout time.Duration
+
+	// PGLogPath is the server's csvlog or jsonlog file, or the log_directory
+	// holding them, tailed for recovery conflicts and stalls.  PGLogFormat is
+	// one of pglog.Formats.  An empty PGLogPath disables the tailer.
+	PGLogPath   string
+	PGLogFormat string
+
+	// PollInterval and PollMaxInterval bound the delay between WAL scans.
+	PollInterval    time.Duration
+	PollMaxInterval time.Duration
+
+	// QueryOverrides replace the queries generated for the server's version,
+	// keyed by query name.  They are read from the directory named by
+	// KeyPGQueryDir and the KeyPGQueries section.
+	QueryOverrides map[string]string
+
+	// Labels, e.g. the cluster name, datacenter, and role, are attached to
+	// every metric, log line, and webhook payload emitted by the agent.
+	Labels map[string]string
+
+	// HTTPListenAddr is the address of the health, readiness, status, and
+	// metrics listener.  An empty string disables the listener.  HTTPAuth
+	// secures the listener and the agent's requests to other agents.
+	HTTPListenAddr string
+	HTTPAuth       HTTPAuth
+
+	// HTTPListener is the HTTP listener bound before privileges were dropped.
+	// The agent binds HTTPListenAddr itself when HTTPListener is nil.
+	HTTPListener net.Listener
+
+	// User and Group are who the agent switches to after starting as root.
+	// AllowRoot permits running as root without a User.
+	User      string
+	Group     string
+	AllowRoot bool
+
+	// Sidecar enables the behavior required to run next to a PostgreSQL
+	// container: wait for PGDATA to appear, gate readiness on the first
+	// successful WAL scan, and drain the work queue on SIGTERM.
+	Sidecar        bool
+	StartupTimeout time.Duration
+	DrainTimeout   time.Duration
+
+	// StatePath is the agent's embedded state store.  When set, the stall
+	// history and warm set are kept in the store unless their own paths are
+	// set.  An empty string disables the store.
+	StatePath string
+
+	// StallHistoryPath is where the relations implicated in replay stalls are
+	// persisted.  Stall-driven prioritization is disabled if neither
+	// StallHistoryPath nor StatePath is set.
+	StallHistoryPath string
+
+	// WarmSetPath is where the most recently prefaulted blocks are persisted and
+	// replayed from at startup.  The warm set is disabled if neither WarmSetPath
+	// nor StatePath is set.  WarmSetBudget bounds the size of the warm set.
+	WarmSetPath   string
+	WarmSetBudget units.Base2Bytes
+
+	// BootstrapWarm prefaults the relations referenced by the WAL present in
+	// pg_wal at startup, before the first WAL scan.
+	BootstrapWarm bool
+
+	// WatchWAL rescans as soon as a new WAL segment starts being written
+	// instead of waiting for the poll interval.
+	WatchWAL bool
+
+	// WALTailInterval is how often the records landing in the WAL segment
+	// being written are decoded and prefaulted.  Zero disables tailing.
+	WALTailInterval time.Duration
+
+	// LogicalApply prefaults the tables and indexes replicated to this
+	// database by logical replication subscriptions as the subscriptions
+	// receive changes.
+	LogicalApply bool
+
+	// PITRTargetLSN and PITRTargetTime are where point-in-time recovery stops.
+	// In "pitr" mode prefaulting stops once recovery reaches either target.
+	// PITRTargetLSN is pg.InvalidLSN and PITRTargetTime is zero when unset.
+	PITRTargetLSN  pg.LSN
+	PITRTargetTime time.Time
+
+	// MaintenanceWindows are when prefaulting is paused or, if MaintenanceIOPS
+	// is non-zero, limited to MaintenanceIOPS reads per second, e.g. during
+	// nightly backups.
+	MaintenanceWindows []maintenance.Window
+	MaintenanceIOPS    uint
+
+	// PushGatewayURL is a Prometheus Pushgateway the agent's final metrics are
+	// pushed to when it exits, grouped by PushGatewayJob and
+	// PushGatewayInstance.  An empty string disables the push.
+	PushGatewayURL      string
+	PushGatewayJob      string
+	PushGatewayInstance string
+
+	// Peers are the HTTP listeners of other agents, e.g. the rest of a fleet of
+	// identical read replicas.  Every PeerInterval the PeerTopBlocks most
+	// recently prefaulted blocks of each peer's warm set are added to this
+	// agent's warm set and prefaulted.  Requires the warm set.
+	Peers         []string
+	PeerInterval  time.Duration
+	PeerTopBlocks uint64
+
+	// BufferCacheConninfo connects to the primary.  Every BufferCacheInterval
+	// the blocks in the primary's shared buffers, as reported by
+	// pg_buffercache, are prefaulted on this follower so that after a failover
+	// its page cache already resembles the old primary's working set.  An
+	// empty BufferCacheConninfo disables mirroring.
+	BufferCacheConninfo string
+	BufferCacheInterval time.Duration
+
+	// AdviseInterval is how often the tuning advisor's recommendations are
+	// logged.  Zero disables logging; the advice is still served on /advice.
+	AdviseInterval time.Duration
+
+	// IOWorkersAutoscale grows the IO workers while IOs queue behind them and
+	// shrinks them back once the queue drains.
+	IOWorkersAutoscale bool
+}
+
+// Alert formats, i.e. the payload sent to AlertConfig.URL.
+const (
+	AlertFormatJSON      = "json"
+	AlertFormatSlack     = "slack"
+	AlertFormatPagerDuty = "pagerduty"
+)
+
+// AlertConfig configures the optional alert raised when the lag stays above
+// LagThreshold for For.  The alert is cleared once the lag has stayed at or
+// below LagThreshold for ClearAfter, which suppresses alerts from a flapping
+// lag.  A zero LagThreshold disables alerting.  RoutingKey is the integration
+// key of a PagerDuty service.
+type AlertConfig struct {
+	LagThreshold units.Base2Bytes
+	For          time.Duration
+	ClearAfter   time.Duration
+	Format       string
+	URL          string
+	RoutingKey   string
+	Timeout      time.Duration
+	Labels       map[string]string
+}
+
+// CloudWatchConfig configures the optional publication of a subset of the
+// agent's metrics to Amazon CloudWatch.  Metrics are named without the
+// "pg_prefaulter_" prefix.  An empty Region is the region of the EC2 instance
+// the agent runs on.
+type CloudWatchConfig struct {
+	Enable     bool
+	Region     string
+	Namespace  string
+	Dimensions map[string]string
+	Metrics    []string
+	Interval   time.Duration
+}
+
+// ConsulConfig configures the optional registration of the agent as a Consul
+// service with a TTL check tied to the agent's progress.
+type ConsulConfig struct {
+	Enable          bool
+	Address         string
+	Token           string
+	ServiceName     string
+	ServiceID       string
+	Tags            []string
+	CheckTTL        time.Duration
+	DeregisterAfter time.Duration
+	MaxScanAge      time.Duration
+	MaxLag          units.Base2Bytes
+}
+
+// HooksConfig configures the command and webhook notified of significant
+// events.  EventLagThreshold fires when the lag crosses LagThreshold and
+// EventPrefaultFailures when FailureThreshold WAL prefaults in a row have
+// failed.  Zero disables either event.
+type HooksConfig struct {
+	hooks.Config
+	LagThreshold     units.Base2Bytes
+	FailureThreshold uint
+}
+
+// FaultConfig injects artificial failures in order to exercise the agent's
+// handling of slow and failing IO.  Rates are probabilities between 0 and 1.
+type FaultConfig struct {
+	// PreadDelay is added to the given fraction of pread(2)s.
+	PreadDelay     time.Duration
+	PreadDelayRate float64
+
+	// PreadEIORate is the fraction of pread(2)s that fail with EIO.
+	PreadEIORate float64
+
+	// DecodeFailRate is the fraction of pg_waldump(1) invocations that fail.
+	DecodeFailRate float64
+}
+
+// Enabled returns true if any faults are injected.
+func (c FaultConfig) Enabled() bool {
+	return (c.PreadDelay > 0 && c.PreadDelayRate > 0) || c.PreadEIORate > 0 || c.DecodeFailRate > 0
 }
 
 type FHCacheConfig struct {
@@ -54,12 +279,141 @@ type FHCacheConfig struct {
 	Size         uint
 	TTL          time.Duration
 	PGDataPath   string
+
+	// BlockSize and BlocksPerSegment describe the heap's geometry and are
+	// refreshed from pg_control at startup.
+	BlockSize        units.Base2Bytes
+	BlocksPerSegment uint64
+
+	// VerifyChecksums requests that the checksum of every page read be
+	// verified.  Verification only happens when data checksums are enabled.
+	VerifyChecksums bool
+
+	// Sandbox limits the file descriptors of relation segments to reading
+	// where the platform supports it.
+	Sandbox bool
+
+	// Backend is how pages are faulted in, one of PrefaultBackends.
+	Backend string
+
+	// RecordSize is the size of the filesystem records relation segments are
+	// read in, e.g. the recordsize of a ZFS dataset.  Zero reads individual
+	// pages.  DetectRecordSize requests that the recordsize of the ZFS dataset
+	// holding PGDATA be detected at startup.
+	RecordSize       units.Base2Bytes
+	DetectRecordSize bool
+}
+
+// RecordSizeAuto detects the recordsize of the ZFS dataset holding PGDATA.
+const RecordSizeAuto = "auto"
+
+// maxRecordSize is the largest recordsize ZFS supports.
+const maxRecordSize = 16 * units.MiB
+
+// Prefault backends.  PrefaultBackendPread reads each page with pread(2).
+// PrefaultBackendMmap maps each page, with MAP_POPULATE on Linux and by
+// touching the mapping elsewhere, which on some kernels and filesystems warms
+// the page cache with less overhead.  PrefaultBackendRdadvise asks macOS to
+// read each page with fcntl(F_RDADVISE) without waiting for it, for developers
+// running the agent against a local PostgreSQL.
+const (
+	PrefaultBackendPread    = "pread"
+	PrefaultBackendMmap     = "mmap"
+	PrefaultBackendRdadvise = "rdadvise"
+)
+
+// PrefaultBackends lists the prefault backends.
+var PrefaultBackends = []string{PrefaultBackendPread, PrefaultBackendMmap, PrefaultBackendRdadvise}
+
+// AvailablePrefaultBackends lists the prefault backends supported on this
+// platform.
+func AvailablePrefaultBackends() []string {
+	if runtime.GOOS == "darwin" {
+		return PrefaultBackends
+	}
+
+	return []string{PrefaultBackendPread, PrefaultBackendMmap}
+}
+
+// IndexCacheConfig configures the optional prefaulting of the indexes and
+// TOAST tables of the relations referenced by the WAL.
+type IndexCacheConfig struct {
+	// Enable looks up the indexes of each relation the first time the relation
+	// is seen and prefaults the indexes' metapage and tail blocks.
+	Enable bool
+
+	// Toast looks up the TOAST table of each relation the first time the
+	// relation is seen and prefaults the tail blocks of the TOAST table and its
+	// index.
+	Toast bool
+
+	// TailBlocks is the number of blocks prefaulted from the end of each index
+	// and TOAST table.
+	TailBlocks uint
+
+	// Size is the number of relations whose indexes are remembered and TTL is
+	// how long they are remembered for.
+	Size uint
+	TTL  time.Duration
 }
 
 type IOCacheConfig struct {
 	MaxConcurrentIOs uint
 	Size             uint
 	TTL              time.Duration
+
+	// Elevator queues IOs per device and dispatches them in file and offset
+	// order.  The devices share the MaxConcurrentIOs workers.
+	Elevator bool
+
+	// BatchWindow is how long requests are accumulated, sorted, and
+	// deduplicated before being dispatched.  Zero disables batching.
+	BatchWindow time.Duration
+
+	// Sandbox confines the IO workers to the system calls needed to read
+	// relation segments and, where supported, to reading files in PGDATA.
+	Sandbox bool
+
+	// Nice is the nice(1) level of the IO workers' threads and IOClass and
+	// IOPriority are their ionice(1) scheduling class and priority.  A zero
+	// Nice and IOClassDefault leave the workers' priorities unchanged.
+	Nice       int
+	IOClass    IOClass
+	IOPriority int
+
+	// IOMaxFraction is the fraction of the read limits in the agent's cgroup
+	// io.max the IO workers are throttled to.  Zero disables throttling.
+	IOMaxFraction float64
+
+	// MaxWorkers caps the number of IO workers when they are resized at
+	// runtime.
+	MaxWorkers uint
+}
+
+// MaxIOWorkers caps MaxWorkers.  Each IO worker may lock an OS thread and the
+// Go runtime exits once a process has 10000 threads.
+const MaxIOWorkers = 4096
+
+// IOClass is an IO scheduling class, see ionice(1).
+type IOClass int
+
+const (
+	IOClassDefault IOClass = iota
+	IOClassBestEffort
+	IOClassIdle
+)
+
+func (c IOClass) String() string {
+	switch c {
+	case IOClassDefault:
+		return "default"
+	case IOClassBestEffort:
+		return "best-effort"
+	case IOClassIdle:
+		return "idle"
+	default:
+		panic(fmt.Sprintf("unknown IO class: %d", c))
+	}
 }
 
 type WALMode int
@@ -70,11 +424,73 @@ const (
 	WALModeXLog
 )
 
+// MaxReadaheadBytes caps the WAL readahead, which is bounded by the number of
+// WAL files the agent is willing to predict on each scan.
+const MaxReadaheadBytes = 16 * units.GiB
+
 type WALCacheConfig struct {
 	Mode           WALMode
 	ReadaheadBytes units.Base2Bytes
 	PGDataPath     string
 	WalDumpPath    string
+
+	// ReadaheadMinBytes and ReadaheadMaxBytes bound the readahead when it is
+	// changed at runtime.
+	ReadaheadMinBytes units.Base2Bytes
+	ReadaheadMaxBytes units.Base2Bytes
+
+	// WalDumpArgs are passed to pg_waldump(1) ahead of the WAL files and
+	// WalDumpEnv, a list of KEY=VALUE pairs, is added to its environment.
+	// WalDumpWrapper, if set, is a command and its arguments that pg_waldump(1)
+	// is run under, e.g. numactl(8) or nice(1).
+	WalDumpArgs    []string
+	WalDumpEnv     []string
+	WalDumpWrapper []string
+
+	// SegmentSize is the size of a WAL segment and is refreshed from pg_control
+	// at startup.
+	SegmentSize units.Base2Bytes
+
+	// DecodeBatchSize is the maximum number of consecutive WAL segments decoded
+	// by a single pg_waldump(1) invocation.
+	DecodeBatchSize uint
+
+	// DecodeTimeout is how long pg_waldump(1) may go without printing a record
+	// before it is killed.  Zero disables the timeout.
+	DecodeTimeout time.Duration
+
+	// SegmentBudget is how long decoding and prefaulting each WAL segment may
+	// take before the queued segments PostgreSQL has already replayed past are
+	// skipped.  Zero disables skipping.
+	SegmentBudget time.Duration
+
+	// MaxDecoders is the maximum number of pg_waldump(1) processes run at once,
+	// independent of the number of WAL workers.
+	MaxDecoders uint
+
+	Archive ArchiveConfig
+}
+
+type ArchiveFetcher int
+
+const (
+	ArchiveFetcherNone ArchiveFetcher = iota
+	ArchiveFetcherWALG
+	ArchiveFetcherPGBackRest
+	ArchiveFetcherCommand
+	ArchiveFetcherSQL
+)
+
+// ArchiveConfig configures how WAL segments missing from pg_wal are fetched
+// from a WAL archive.  Fetched segments are written to ScratchDir and removed
+// once they have been decoded.
+type ArchiveConfig struct {
+	Fetcher          ArchiveFetcher
+	BinPath          string
+	PGBackRestStanza string
+	Command          string
+	ScratchDir       string
+	FetchTimeout     time.Duration
 }
 
 func NewDefault() (cfg *Config, err error) {
@@ -100,21 +516,372 @@ func NewDefault() (cfg *Config, err error) {
 	agentConfig := Agent{}
 	{
 		const postmasterPIDFilename = "postmaster.pid"
-		agentConfig.PostgreSQLPIDPath = path.Join(viper.GetString(KeyPGData), postmasterPIDFilename)
+		agentConfig.PGData = viper.GetString(KeyPGData)
+		agentConfig.PGMode = viper.GetString(KeyPGMode)
+		agentConfig.RepmgrConfigPath = viper.GetString(KeyRepmgrConfig)
+		if agentConfig.DBHosts, err = ParseDBHosts(viper.GetStringSlice(KeyPGHosts), cast.ToUint16(viper.GetInt(KeyPGPort))); err != nil {
+			return nil, err
+		}
+		agentConfig.DBConnectTimeout = viper.GetDuration(KeyPGConnectTimeout)
+		if agentConfig.DBConnectTimeout < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyPGConnectTimeout, agentConfig.DBConnectTimeout)
+		}
+		agentConfig.PGLogPath = viper.GetString(KeyPGLogPath)
+		switch agentConfig.PGLogFormat = viper.GetString(KeyPGLogFormat); agentConfig.PGLogFormat {
+		case pglog.FormatAuto, pglog.FormatCSVLog, pglog.FormatJSONLog:
+		default:
+			return nil, fmt.Errorf("%s must be one of %s (%q)", KeyPGLogFormat, strings.Join(pglog.Formats, ", "), agentConfig.PGLogFormat)
+		}
+		agentConfig.PollInterval = viper.GetDuration(KeyPGPollInterval)
+		agentConfig.PollMaxInterval = viper.GetDuration(KeyPGPollMaxInterval)
+		agentConfig.PostgreSQLPIDPath = path.Join(agentConfig.PGData, postmasterPIDFilename)
+		agentConfig.ControlDataPath = viper.GetString(KeyPGControlDataPath)
+		if agentConfig.ControlDataPath == "" && viper.GetString(KeyXLogPath) != "" {
+			// pg_controldata(1) is installed alongside pg_waldump(1).  If
+			// pg_waldump(1) has yet to be found the agent sets the path once
+			// it is.
+			agentConfig.ControlDataPath = path.Join(path.Dir(viper.GetString(KeyXLogPath)), "pg_controldata")
+		}
+
+		if dir := viper.GetString(KeyPGQueryDir); dir != "" {
+			if agentConfig.QueryOverrides, err = pg.ReadQueryOverrides(dir); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", KeyPGQueryDir)
+			}
+		}
+		if queries := viper.GetStringMapString(KeyPGQueries); len(queries) > 0 {
+			if err := pg.ValidateQueryOverrides(queries); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", KeyPGQueries)
+			}
+			if agentConfig.QueryOverrides == nil {
+				agentConfig.QueryOverrides = make(map[string]string, len(queries))
+			}
+			for name, sql := range queries {
+				if _, found := agentConfig.QueryOverrides[name]; found {
+					return nil, fmt.Errorf("query %q is overridden by both %s and %s", name, KeyPGQueryDir, KeyPGQueries)
+				}
+				agentConfig.QueryOverrides[name] = sql
+			}
+		}
+
+		if agentConfig.Labels, err = NewLabels(); err != nil {
+			return nil, err
+		}
+
 		agentConfig.UseColors = viper.GetBool(KeyAgentUseColor)
 		agentConfig.RetryInit = viper.GetBool(KeyRetryDBInit)
 		agentConfig.LogFormat, err = LogLevelParse(viper.GetString(KeyAgentLogFormat))
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to parse the log format")
 		}
+
+		agentConfig.User = viper.GetString(KeyUser)
+		agentConfig.Group = viper.GetString(KeyGroup)
+		agentConfig.AllowRoot = viper.GetBool(KeyAllowRoot)
+		if agentConfig.Group != "" && agentConfig.User == "" {
+			return nil, fmt.Errorf("%s requires %s", KeyGroup, KeyUser)
+		}
+
+		agentConfig.HTTPListenAddr = viper.GetString(KeyHTTPListenAddr)
+		if agentConfig.HTTPAuth, err = NewHTTPAuth(); err != nil {
+			return nil, err
+		}
+		if agentConfig.HTTPAuth.TLSCA != "" && agentConfig.HTTPAuth.TLSCert == "" {
+			return nil, fmt.Errorf("%s requires %s", KeyHTTPTLSCA, KeyHTTPTLSCert)
+		}
+		agentConfig.Sidecar = viper.GetBool(KeySidecar)
+		agentConfig.StartupTimeout = viper.GetDuration(KeyStartupTimeout)
+		agentConfig.DrainTimeout = viper.GetDuration(KeyDrainTimeout)
+		agentConfig.StatePath = viper.GetString(KeyStatePath)
+		agentConfig.StallHistoryPath = viper.GetString(KeyStallHistory)
+
+		agentConfig.WarmSetPath = viper.GetString(KeyWarmSet)
+		switch budget, err := units.ParseBase2Bytes(viper.GetString(KeyWarmSetBudget)); {
+		case err != nil:
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyWarmSetBudget)
+		case budget < 0:
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyWarmSetBudget, budget)
+		default:
+			agentConfig.WarmSetBudget = budget
+		}
+
+		agentConfig.PITRTargetLSN = pg.InvalidLSN
+		if s := viper.GetString(KeyPITRTargetLSN); s != "" {
+			if agentConfig.PITRTargetLSN, err = pg.ParseLSN(s); err != nil {
+				return nil, errors.Wrapf(err, "unable to parse %s", KeyPITRTargetLSN)
+			}
+		}
+		if s := viper.GetString(KeyPITRTargetTime); s != "" {
+			if agentConfig.PITRTargetTime, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, errors.Wrapf(err, "unable to parse %s", KeyPITRTargetTime)
+			}
+		}
+
+		agentConfig.BootstrapWarm = viper.GetBool(KeyBootstrapWarm)
+		agentConfig.WatchWAL = viper.GetBool(KeyWALWatch)
+		agentConfig.WALTailInterval = viper.GetDuration(KeyWALTailInterval)
+		if agentConfig.WALTailInterval < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyWALTailInterval, agentConfig.WALTailInterval)
+		}
+		agentConfig.LogicalApply = viper.GetBool(KeyLogicalApply)
+		for _, spec := range viper.GetStringSlice(KeyMaintenanceWindows) {
+			w, err := maintenance.ParseWindow(spec)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", KeyMaintenanceWindows)
+			}
+			agentConfig.MaintenanceWindows = append(agentConfig.MaintenanceWindows, w)
+		}
+		if iops := viper.GetInt(KeyMaintenanceIOPS); iops < 0 {
+			return nil, fmt.Errorf("%s must be at least 0 (%d)", KeyMaintenanceIOPS, iops)
+		}
+		agentConfig.MaintenanceIOPS = uint(viper.GetInt(KeyMaintenanceIOPS))
+		agentConfig.PushGatewayURL = viper.GetString(KeyPushGatewayURL)
+		agentConfig.PushGatewayJob = viper.GetString(KeyPushGatewayJob)
+		agentConfig.PushGatewayInstance = viper.GetString(KeyPushGatewayInstance)
+		if agentConfig.PushGatewayURL != "" {
+			if u, err := url.Parse(agentConfig.PushGatewayURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("%s must be an http or https URL", KeyPushGatewayURL)
+			}
+			if agentConfig.PushGatewayJob == "" {
+				return nil, fmt.Errorf("%s must not be empty", KeyPushGatewayJob)
+			}
+			if agentConfig.PushGatewayInstance == "" {
+				if agentConfig.PushGatewayInstance, err = os.Hostname(); err != nil {
+					return nil, errors.Wrapf(err, "unable to determine the hostname for %s", KeyPushGatewayInstance)
+				}
+			}
+		}
+
+		agentConfig.Peers = viper.GetStringSlice(KeyPeers)
+		agentConfig.PeerInterval = viper.GetDuration(KeyPeerInterval)
+		topBlocks := viper.GetInt64(KeyPeerTopBlocks)
+		if topBlocks < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyPeerTopBlocks, topBlocks)
+		}
+		agentConfig.PeerTopBlocks = uint64(topBlocks)
+		if len(agentConfig.Peers) > 0 && agentConfig.PeerInterval <= 0 {
+			return nil, fmt.Errorf("%s must be positive (%s)", KeyPeerInterval, agentConfig.PeerInterval)
+		}
+
+		agentConfig.BufferCacheConninfo = viper.GetString(KeyBufferCacheConninfo)
+		agentConfig.BufferCacheInterval = viper.GetDuration(KeyBufferCacheInterval)
+		if agentConfig.BufferCacheConninfo != "" {
+			if _, err := pgx.ParseConnectionString(agentConfig.BufferCacheConninfo); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", KeyBufferCacheConninfo)
+			}
+			if agentConfig.BufferCacheInterval <= 0 {
+				return nil, fmt.Errorf("%s must be positive (%s)", KeyBufferCacheInterval, agentConfig.BufferCacheInterval)
+			}
+		}
+
+		agentConfig.AdviseInterval = viper.GetDuration(KeyAdviseInterval)
+		if agentConfig.AdviseInterval < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyAdviseInterval, agentConfig.AdviseInterval)
+		}
+
+		agentConfig.IOWorkersAutoscale = viper.GetBool(KeyIOWorkersAutoscale)
+
+		if agentConfig.Sidecar {
+			const (
+				// Match the readiness port used in the generated sidecar manifest.
+				defaultSidecarHTTPListenAddr = ":4243"
+
+				// Kubernetes' default terminationGracePeriodSeconds is 30s, leave a
+				// few seconds to close file handles and exit.
+				defaultSidecarDrainTimeout = 25 * time.Second
+			)
+
+			// The PostgreSQL container may not be accepting connections yet.
+			agentConfig.RetryInit = true
+
+			if agentConfig.HTTPListenAddr == "" {
+				agentConfig.HTTPListenAddr = defaultSidecarHTTPListenAddr
+			}
+
+			if agentConfig.DrainTimeout == 0 {
+				agentConfig.DrainTimeout = defaultSidecarDrainTimeout
+			}
+		}
+	}
+
+	consulConfig := ConsulConfig{}
+	{
+		consulConfig.Enable = viper.GetBool(KeyConsulEnable)
+		consulConfig.Address = viper.GetString(KeyConsulAddress)
+		consulConfig.Token = viper.GetString(KeyConsulToken)
+		consulConfig.ServiceName = viper.GetString(KeyConsulServiceName)
+		consulConfig.ServiceID = viper.GetString(KeyConsulServiceID)
+		consulConfig.Tags = viper.GetStringSlice(KeyConsulTags)
+		consulConfig.CheckTTL = viper.GetDuration(KeyConsulCheckTTL)
+		consulConfig.DeregisterAfter = viper.GetDuration(KeyConsulDeregisterAfter)
+		consulConfig.MaxScanAge = viper.GetDuration(KeyConsulMaxScanAge)
+
+		if consulConfig.ServiceID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to determine hostname for the consul service ID")
+			}
+			consulConfig.ServiceID = consulConfig.ServiceName + "-" + hostname
+		}
+
+		switch maxLag, err := units.ParseBase2Bytes(viper.GetString(KeyConsulMaxLag)); {
+		case err != nil:
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyConsulMaxLag)
+		case maxLag < 0:
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyConsulMaxLag, maxLag)
+		default:
+			consulConfig.MaxLag = maxLag
+		}
+	}
+
+	alertConfig := AlertConfig{Labels: agentConfig.Labels}
+	{
+		const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+		switch lag, err := units.ParseBase2Bytes(viper.GetString(KeyAlertLagThreshold)); {
+		case err != nil:
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyAlertLagThreshold)
+		case lag < 0:
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyAlertLagThreshold, lag)
+		default:
+			alertConfig.LagThreshold = lag
+		}
+
+		alertConfig.For = viper.GetDuration(KeyAlertFor)
+		alertConfig.ClearAfter = viper.GetDuration(KeyAlertClearAfter)
+		alertConfig.Format = viper.GetString(KeyAlertFormat)
+		alertConfig.URL = viper.GetString(KeyAlertURL)
+		alertConfig.RoutingKey = viper.GetString(KeyAlertRoutingKey)
+		alertConfig.Timeout = viper.GetDuration(KeyAlertTimeout)
+
+		if alertConfig.LagThreshold > 0 {
+			switch alertConfig.Format {
+			case AlertFormatJSON, AlertFormatSlack:
+			case AlertFormatPagerDuty:
+				if alertConfig.URL == "" {
+					alertConfig.URL = pagerDutyURL
+				}
+				if alertConfig.RoutingKey == "" {
+					return nil, fmt.Errorf("%s must be set when %s is %q", KeyAlertRoutingKey, KeyAlertFormat, AlertFormatPagerDuty)
+				}
+			default:
+				return nil, fmt.Errorf("%s must be one of %q, %q, or %q (%q)", KeyAlertFormat,
+					AlertFormatJSON, AlertFormatSlack, AlertFormatPagerDuty, alertConfig.Format)
+			}
+
+			switch u, err := url.Parse(alertConfig.URL); {
+			case alertConfig.URL == "":
+				return nil, fmt.Errorf("%s must be set when %s is set", KeyAlertURL, KeyAlertLagThreshold)
+			case err != nil || (u.Scheme != "http" && u.Scheme != "https"):
+				return nil, fmt.Errorf("%s must be an http or https URL", KeyAlertURL)
+			case alertConfig.For < 0:
+				return nil, fmt.Errorf("%s can not be negative (%s)", KeyAlertFor, alertConfig.For)
+			case alertConfig.ClearAfter < 0:
+				return nil, fmt.Errorf("%s can not be negative (%s)", KeyAlertClearAfter, alertConfig.ClearAfter)
+			case alertConfig.Timeout <= 0:
+				return nil, fmt.Errorf("%s must be positive (%s)", KeyAlertTimeout, alertConfig.Timeout)
+			}
+		}
+	}
+
+	cloudWatchConfig := CloudWatchConfig{}
+	{
+		// CloudWatch accepts at most 10 dimensions per metric, leave room for the
+		// metrics' own labels.
+		const maxDimensions = 8
+
+		cloudWatchConfig.Enable = viper.GetBool(KeyCloudWatchEnable)
+		cloudWatchConfig.Region = viper.GetString(KeyCloudWatchRegion)
+		cloudWatchConfig.Namespace = viper.GetString(KeyCloudWatchNamespace)
+		cloudWatchConfig.Metrics = viper.GetStringSlice(KeyCloudWatchMetrics)
+		cloudWatchConfig.Interval = viper.GetDuration(KeyCloudWatchInterval)
+
+		cloudWatchConfig.Dimensions = make(map[string]string)
+		for _, d := range viper.GetStringSlice(KeyCloudWatchDimensions) {
+			kv := strings.SplitN(d, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("%s must be of the form name=value (%q)", KeyCloudWatchDimensions, d)
+			}
+			cloudWatchConfig.Dimensions[kv[0]] = kv[1]
+		}
+
+		if cloudWatchConfig.Enable {
+			if cloudWatchConfig.Region == "" {
+				cloudWatchConfig.Region = os.Getenv("AWS_REGION")
+			}
+			if cloudWatchConfig.Region == "" {
+				cloudWatchConfig.Region = os.Getenv("AWS_DEFAULT_REGION")
+			}
+
+			switch {
+			case cloudWatchConfig.Namespace == "":
+				return nil, fmt.Errorf("%s must not be empty", KeyCloudWatchNamespace)
+			case len(cloudWatchConfig.Metrics) == 0:
+				return nil, fmt.Errorf("%s must not be empty", KeyCloudWatchMetrics)
+			case cloudWatchConfig.Interval < time.Second:
+				return nil, fmt.Errorf("%s must be at least 1s (%s)", KeyCloudWatchInterval, cloudWatchConfig.Interval)
+			case len(cloudWatchConfig.Dimensions) > maxDimensions:
+				return nil, fmt.Errorf("%s must have at most %d dimensions (%d)", KeyCloudWatchDimensions, maxDimensions, len(cloudWatchConfig.Dimensions))
+			}
+		}
+	}
+
+	hooksConfig := HooksConfig{}
+	{
+		hooksConfig.Labels = agentConfig.Labels
+		hooksConfig.Command = viper.GetString(KeyHooksCommand)
+		hooksConfig.URL = viper.GetString(KeyHooksURL)
+		hooksConfig.Events = viper.GetStringSlice(KeyHooksEvents)
+		hooksConfig.Timeout = viper.GetDuration(KeyHooksTimeout)
+
+		if hooksConfig.URL != "" {
+			if u, err := url.Parse(hooksConfig.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("%s must be an http or https URL", KeyHooksURL)
+			}
+		}
+		for _, e := range hooksConfig.Events {
+			if !hooks.ValidEvent(e) {
+				return nil, fmt.Errorf("%s has an unknown event %q, expected one of %s", KeyHooksEvents, e, strings.Join(hooks.Events, ", "))
+			}
+		}
+		if hooksConfig.Timeout <= 0 {
+			return nil, fmt.Errorf("%s must be positive (%s)", KeyHooksTimeout, hooksConfig.Timeout)
+		}
+
+		if n := viper.GetInt(KeyHooksFailureThreshold); n < 0 {
+			return nil, fmt.Errorf("%s must be at least 0 (%d)", KeyHooksFailureThreshold, n)
+		}
+		hooksConfig.FailureThreshold = uint(viper.GetInt(KeyHooksFailureThreshold))
+
+		switch lag, err := units.ParseBase2Bytes(viper.GetString(KeyHooksLagThreshold)); {
+		case err != nil:
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyHooksLagThreshold)
+		case lag < 0:
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyHooksLagThreshold, lag)
+		default:
+			hooksConfig.LagThreshold = lag
+		}
 	}
 
 	fhConfig := FHCacheConfig{}
 	{
-		const (
-			defaultTTL          = 300 * time.Second
-			numReservedFDs uint = 50
-		)
+		const defaultTTL = 300 * time.Second
+
+		// Raise the limit before it is sized against.  Raising the hard limit
+		// requires root, which is why this happens before privileges are dropped.
+		limit := viper.GetInt64(KeyOpenFilesLimit)
+		if limit < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyOpenFilesLimit, limit)
+		}
+		if limit > 0 {
+			var rlimit unix.Rlimit
+			if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+				return nil, errors.Wrap(err, "unable to determine rlimits for number of files")
+			}
+			raiseRlimit(&rlimit, uint64(limit))
+			if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+				return nil, errors.Wrapf(err, "unable to raise the open files limit to %d", limit)
+			}
+		}
 
 		if fhConfig.MaxOpenFiles == 0 {
 			var procNumFiles unix.Rlimit
@@ -122,7 +889,7 @@ func NewDefault() (cfg *Config, err error) {
 				return nil, errors.Wrap(err, "unable to determine rlimits for number of files")
 			}
 			fhConfig.MaxOpenFiles = uint(procNumFiles.Cur)
-			fhConfig.Size = fhConfig.MaxOpenFiles - numReservedFDs
+			fhConfig.Size = fhConfig.MaxOpenFiles - NumReservedFDs
 
 			//lint:ignore SA9003 TODO below
 		} else {
@@ -141,6 +908,38 @@ func NewDefault() (cfg *Config, err error) {
 		}
 
 		fhConfig.TTL = defaultTTL
+
+		controlData := pg.DefaultControlData()
+		fhConfig.BlockSize = controlData.BlockSize
+		fhConfig.BlocksPerSegment = controlData.BlocksPerSegment
+		fhConfig.VerifyChecksums = viper.GetBool(KeyVerifyChecksums)
+		fhConfig.Sandbox = viper.GetBool(KeySandbox)
+
+		switch fhConfig.Backend = viper.GetString(KeyPrefaultBackend); fhConfig.Backend {
+		case PrefaultBackendPread, PrefaultBackendMmap:
+		case PrefaultBackendRdadvise:
+			if runtime.GOOS != "darwin" {
+				return nil, fmt.Errorf("%s=%s is only supported on macOS", KeyPrefaultBackend, fhConfig.Backend)
+			}
+			if fhConfig.VerifyChecksums {
+				return nil, fmt.Errorf("%s requires a %s that reads pages, not %q", KeyVerifyChecksums, KeyPrefaultBackend, fhConfig.Backend)
+			}
+		default:
+			return nil, fmt.Errorf("%s must be one of %s (%q)", KeyPrefaultBackend, strings.Join(PrefaultBackends, ", "), fhConfig.Backend)
+		}
+
+		if recordSize := viper.GetString(KeyRecordSize); recordSize == RecordSizeAuto {
+			fhConfig.DetectRecordSize = true
+		} else {
+			switch size, err := units.ParseBase2Bytes(recordSize); {
+			case err != nil:
+				return nil, errors.Wrapf(err, "unable to parse %s", KeyRecordSize)
+			case size < 0 || size > maxRecordSize || size&(size-1) != 0:
+				return nil, fmt.Errorf("%s must be %q or a power of two no larger than %s (%s)", KeyRecordSize, RecordSizeAuto, maxRecordSize, size)
+			default:
+				fhConfig.RecordSize = size
+			}
+		}
 	}
 
 	ioConfig := IOCacheConfig{}
@@ -170,8 +969,86 @@ func NewDefault() (cfg *Config, err error) {
 			ioConfig.MaxConcurrentIOs = uint(viper.GetInt(KeyNumIOThreads))
 		}
 
+		switch maxWorkers := viper.GetInt(KeyIOWorkersMax); {
+		case maxWorkers < 1 || maxWorkers > MaxIOWorkers:
+			return nil, fmt.Errorf("%s must be between 1 and %d (%d)", KeyIOWorkersMax, MaxIOWorkers, maxWorkers)
+		case uint(maxWorkers) < ioConfig.MaxConcurrentIOs:
+			return nil, fmt.Errorf("%s (%d) can not be less than %s (%d)", KeyIOWorkersMax, maxWorkers, KeyNumIOThreads, ioConfig.MaxConcurrentIOs)
+		default:
+			ioConfig.MaxWorkers = uint(maxWorkers)
+		}
+
 		ioConfig.Size = ioCacheSize
 		ioConfig.TTL = defaultTTL
+		ioConfig.Elevator = viper.GetBool(KeyIOElevator)
+		ioConfig.Sandbox = viper.GetBool(KeySandbox)
+		ioConfig.BatchWindow = viper.GetDuration(KeyIOBatchWindow)
+		if ioConfig.BatchWindow < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyIOBatchWindow, ioConfig.BatchWindow)
+		}
+
+		ioConfig.Nice = viper.GetInt(KeyIONice)
+		if ioConfig.Nice < -20 || ioConfig.Nice > 19 {
+			return nil, fmt.Errorf("%s must be between -20 and 19 (%d)", KeyIONice, ioConfig.Nice)
+		}
+
+		switch class := viper.GetString(KeyIOClass); class {
+		case "default", "":
+			ioConfig.IOClass = IOClassDefault
+		case "best-effort":
+			ioConfig.IOClass = IOClassBestEffort
+		case "idle":
+			ioConfig.IOClass = IOClassIdle
+		default:
+			return nil, fmt.Errorf("unsupported %s: %q", KeyIOClass, class)
+		}
+
+		ioConfig.IOPriority = viper.GetInt(KeyIOPriority)
+		if ioConfig.IOPriority < 0 || ioConfig.IOPriority > 7 {
+			return nil, fmt.Errorf("%s must be between 0 and 7 (%d)", KeyIOPriority, ioConfig.IOPriority)
+		}
+
+		ioConfig.IOMaxFraction = viper.GetFloat64(KeyIOMaxFraction)
+		if ioConfig.IOMaxFraction < 0 || ioConfig.IOMaxFraction > 1 {
+			return nil, fmt.Errorf("%s must be between 0 and 1 (%g)", KeyIOMaxFraction, ioConfig.IOMaxFraction)
+		}
+	}
+
+	faultConfig := FaultConfig{}
+	{
+		faultConfig.PreadDelay = viper.GetDuration(KeyFaultDelay)
+		if faultConfig.PreadDelay < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyFaultDelay, faultConfig.PreadDelay)
+		}
+
+		for key, rate := range map[string]*float64{
+			KeyFaultDelayRate:  &faultConfig.PreadDelayRate,
+			KeyFaultEIORate:    &faultConfig.PreadEIORate,
+			KeyFaultDecodeRate: &faultConfig.DecodeFailRate,
+		} {
+			*rate = viper.GetFloat64(key)
+			if *rate < 0 || *rate > 1 {
+				return nil, fmt.Errorf("%s must be between 0 and 1 (%g)", key, *rate)
+			}
+		}
+	}
+
+	indexConfig := IndexCacheConfig{}
+	{
+		const (
+			defaultSize = 10000
+			defaultTTL  = 10 * time.Minute
+		)
+
+		indexConfig.Enable = viper.GetBool(KeyIndexPrefault)
+		indexConfig.Toast = viper.GetBool(KeyToastPrefault)
+		tailBlocks := viper.GetInt(KeyIndexTailBlocks)
+		if tailBlocks < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyIndexTailBlocks, tailBlocks)
+		}
+		indexConfig.TailBlocks = uint(tailBlocks)
+		indexConfig.Size = defaultSize
+		indexConfig.TTL = defaultTTL
 	}
 
 	walConfig := WALCacheConfig{}
@@ -196,7 +1073,85 @@ func NewDefault() (cfg *Config, err error) {
 			walConfig.ReadaheadBytes = readAheadBytes
 		}
 
+		readaheadMin, err := units.ParseBase2Bytes(viper.GetString(KeyWALReadaheadMin))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyWALReadaheadMin)
+		}
+		readaheadMax, err := units.ParseBase2Bytes(viper.GetString(KeyWALReadaheadMax))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyWALReadaheadMax)
+		}
+		switch {
+		case readaheadMin < 0:
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyWALReadaheadMin, readaheadMin)
+		case readaheadMax > MaxReadaheadBytes:
+			return nil, fmt.Errorf("%s can not exceed %s (%s)", KeyWALReadaheadMax, MaxReadaheadBytes, readaheadMax)
+		case walConfig.ReadaheadBytes < readaheadMin || walConfig.ReadaheadBytes > readaheadMax:
+			return nil, fmt.Errorf("%s must be between %s (%s) and %s (%s): %s", KeyWALReadahead,
+				KeyWALReadaheadMin, readaheadMin, KeyWALReadaheadMax, readaheadMax, walConfig.ReadaheadBytes)
+		}
+		walConfig.ReadaheadMinBytes = readaheadMin
+		walConfig.ReadaheadMaxBytes = readaheadMax
+
 		walConfig.WalDumpPath = viper.GetString(KeyXLogPath)
+		walConfig.WalDumpArgs = viper.GetStringSlice(KeyXLogArgs)
+		walConfig.WalDumpEnv = viper.GetStringSlice(KeyXLogEnv)
+		for _, kv := range walConfig.WalDumpEnv {
+			if i := strings.Index(kv, "="); i < 1 {
+				return nil, fmt.Errorf("%s must be a list of KEY=VALUE pairs (%q)", KeyXLogEnv, kv)
+			}
+		}
+		walConfig.WalDumpWrapper = viper.GetStringSlice(KeyXLogWrapper)
+		if len(walConfig.WalDumpWrapper) > 0 && walConfig.WalDumpWrapper[0] == "" {
+			return nil, fmt.Errorf("%s must start with a command", KeyXLogWrapper)
+		}
+		walConfig.DecodeBatchSize = uint(viper.GetInt(KeyWALDecodeBatchSize))
+		if walConfig.DecodeBatchSize < 1 {
+			return nil, fmt.Errorf("%s must be at least 1 (%d)", KeyWALDecodeBatchSize, viper.GetInt(KeyWALDecodeBatchSize))
+		}
+		walConfig.DecodeTimeout = viper.GetDuration(KeyWALDecodeTimeout)
+		if walConfig.DecodeTimeout < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyWALDecodeTimeout, walConfig.DecodeTimeout)
+		}
+		walConfig.SegmentBudget = viper.GetDuration(KeyWALSegmentBudget)
+		if walConfig.SegmentBudget < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyWALSegmentBudget, walConfig.SegmentBudget)
+		}
+		switch maxDecoders := viper.GetInt(KeyWALMaxDecoders); {
+		case maxDecoders < 0:
+			return nil, fmt.Errorf("%s can not be negative (%d)", KeyWALMaxDecoders, maxDecoders)
+		case maxDecoders == 0:
+			walConfig.MaxDecoders = uint(runtime.NumCPU())
+		default:
+			walConfig.MaxDecoders = uint(maxDecoders)
+		}
+		walConfig.SegmentSize = pg.DefaultControlData().WALSegmentSize
+
+		switch fetcher := viper.GetString(KeyArchiveFetcher); fetcher {
+		case "none", "":
+			walConfig.Archive.Fetcher = ArchiveFetcherNone
+		case "wal-g":
+			walConfig.Archive.Fetcher = ArchiveFetcherWALG
+		case "pgbackrest":
+			walConfig.Archive.Fetcher = ArchiveFetcherPGBackRest
+		case "command":
+			walConfig.Archive.Fetcher = ArchiveFetcherCommand
+		case "sql":
+			walConfig.Archive.Fetcher = ArchiveFetcherSQL
+		default:
+			return nil, fmt.Errorf("unsupported %s: %q", KeyArchiveFetcher, fetcher)
+		}
+
+		walConfig.Archive.BinPath = viper.GetString(KeyArchiveBinPath)
+		walConfig.Archive.PGBackRestStanza = viper.GetString(KeyArchivePGBackRestStanza)
+		walConfig.Archive.Command = viper.GetString(KeyArchiveCommand)
+		walConfig.Archive.ScratchDir = viper.GetString(KeyArchiveScratchDir)
+		walConfig.Archive.FetchTimeout = viper.GetDuration(KeyArchiveFetchTimeout)
+	}
+
+	runtimeParams, err := NewRuntimeParams()
+	if err != nil {
+		return nil, err
 	}
 
 	return &Config{
@@ -216,17 +1171,21 @@ func NewDefault() (cfg *Config, err error) {
 
 				// FIXME(seanc@): Need to write a zerolog facade that satisfies the pgx logger interface
 				// Logger:   log.Logger.With().Str("module", "pgx").Logger(),
-				LogLevel: pgxLogLevel,
-				RuntimeParams: map[string]string{
-					"application_name": buildtime.PROGNAME,
-				},
+				LogLevel:      pgxLogLevel,
+				RuntimeParams: runtimeParams,
 			},
 		},
 
-		Agent:          agentConfig,
-		FHCacheConfig:  fhConfig,
-		IOCacheConfig:  ioConfig,
-		WALCacheConfig: walConfig,
+		Agent:            agentConfig,
+		AlertConfig:      alertConfig,
+		CloudWatchConfig: cloudWatchConfig,
+		ConsulConfig:     consulConfig,
+		FaultConfig:      faultConfig,
+		FHCacheConfig:    fhConfig,
+		HooksConfig:      hooksConfig,
+		IndexCacheConfig: indexConfig,
+		IOCacheConfig:    ioConfig,
+		WALCacheConfig:   walConfig,
 	}, nil
 }
 
@@ -11,27 +11,144 @@ import (
 const (
 	KeyLogLevel = "log.level"
 
-	KeyAgentLogFormat = "run.log-format"
-	KeyNumIOThreads   = "run.num-io-threads"
-	KeyPProfEnable    = "run.pprof.enable"
-	KeyPProfPort      = "run.pprof.port"
-	KeyRetryDBInit    = "run.retry-db-init"
-	KeyAgentUseColor  = "run.use-color"
-
-	KeyPGData         = "postgresql.pgdata"
-	KeyPGDatabase     = "postgresql.database"
-	KeyPGHost         = "postgresql.host"
-	KeyPGMode         = "postgresql.mode"
-	KeyPGPassword     = "postgresql.password"
-	KeyPGPollInterval = "postgresql.poll-interval"
-	KeyPGPort         = "postgresql.port"
-	KeyPGUser         = "postgresql.user"
-
-	KeyWALReadahead = "postgresql.wal.readahead-bytes"
-	KeyWALThreads   = "postgresql.wal.threads"
-
-	KeyXLogMode = "postgresql.xlog.mode"
-	KeyXLogPath = "postgresql.xlog.pg_waldump-path"
+	KeyAdviseInterval      = "run.advise-interval"
+	KeyAllowRoot           = "run.allow-root"
+	KeyAgentLogFormat      = "run.log-format"
+	KeyBootstrapWarm       = "run.bootstrap-warm"
+	KeyDrainTimeout        = "run.drain-timeout"
+	KeyFaultDecodeRate     = "run.fault.decode-failure-rate"
+	KeyFaultDelay          = "run.fault.pread-delay"
+	KeyFaultDelayRate      = "run.fault.pread-delay-rate"
+	KeyFaultEIORate        = "run.fault.pread-eio-rate"
+	KeyGroup               = "run.group"
+	KeyHTTPTokenFile       = "run.http.auth-token-file"
+	KeyHTTPListenAddr      = "run.http.listen-addr"
+	KeyPublicMetrics       = "run.http.public-metrics"
+	KeyHTTPTLSCA           = "run.http.tls-ca"
+	KeyHTTPTLSCert         = "run.http.tls-cert"
+	KeyHTTPTLSKey          = "run.http.tls-key"
+	KeyIndexPrefault       = "run.index-prefault"
+	KeyIndexTailBlocks     = "run.index-tail-blocks"
+	KeyIOBatchWindow       = "run.io-batch-window"
+	KeyIOClass             = "run.io-class"
+	KeyIOElevator          = "run.io-elevator"
+	KeyIOMaxFraction       = "run.io-max-fraction"
+	KeyIONice              = "run.io-nice"
+	KeyIOPriority          = "run.io-priority"
+	KeyIOWorkersAutoscale  = "run.io-workers-autoscale"
+	KeyIOWorkersMax        = "run.io-workers-max"
+	KeyLabels              = "run.labels"
+	KeyLogicalApply        = "run.logical-apply"
+	KeyMaintenanceIOPS     = "run.maintenance.iops"
+	KeyMaintenanceWindows  = "run.maintenance.windows"
+	KeyNumIOThreads        = "run.num-io-threads"
+	KeyPeerInterval        = "run.peer-interval"
+	KeyPeerTopBlocks       = "run.peer-top-blocks"
+	KeyPeers               = "run.peers"
+	KeyPProfEnable         = "run.pprof.enable"
+	KeyPProfPort           = "run.pprof.port"
+	KeyPrefaultBackend     = "run.prefault-backend"
+	KeyPushGatewayInstance = "run.pushgateway.instance"
+	KeyPushGatewayJob      = "run.pushgateway.job"
+	KeyPushGatewayURL      = "run.pushgateway.url"
+	KeyRecordSize          = "run.record-size"
+	KeyRetryDBInit         = "run.retry-db-init"
+	KeyOpenFilesLimit      = "run.rlimit-nofile"
+	KeySandbox             = "run.sandbox"
+	KeySidecar             = "run.sidecar"
+	KeyStallHistory        = "run.stall-history-path"
+	KeyStartupTimeout      = "run.startup-timeout"
+	KeyStatePath           = "run.state-path"
+	KeyToastPrefault       = "run.toast-prefault"
+	KeyAgentUseColor       = "run.use-color"
+	KeyUser                = "run.user"
+	KeyVerifyChecksums     = "run.verify-checksums"
+	KeyWarmSetBudget       = "run.warm-set-budget"
+	KeyWarmSet             = "run.warm-set-path"
+
+	KeyAlertClearAfter   = "alert.clear-after"
+	KeyAlertFor          = "alert.for"
+	KeyAlertFormat       = "alert.format"
+	KeyAlertLagThreshold = "alert.lag-threshold"
+	KeyAlertRoutingKey   = "alert.routing-key"
+	KeyAlertTimeout      = "alert.timeout"
+	KeyAlertURL          = "alert.url"
+
+	KeyCloudWatchDimensions = "cloudwatch.dimensions"
+	KeyCloudWatchEnable     = "cloudwatch.enable"
+	KeyCloudWatchInterval   = "cloudwatch.interval"
+	KeyCloudWatchMetrics    = "cloudwatch.metrics"
+	KeyCloudWatchNamespace  = "cloudwatch.namespace"
+	KeyCloudWatchRegion     = "cloudwatch.region"
+
+	KeyConsulAddress         = "consul.address"
+	KeyConsulCheckTTL        = "consul.check-ttl"
+	KeyConsulDeregisterAfter = "consul.deregister-after"
+	KeyConsulEnable          = "consul.enable"
+	KeyConsulMaxLag          = "consul.max-lag"
+	KeyConsulMaxScanAge      = "consul.max-scan-age"
+	KeyConsulServiceID       = "consul.service-id"
+	KeyConsulServiceName     = "consul.service-name"
+	KeyConsulTags            = "consul.tags"
+	KeyConsulToken           = "consul.token"
+
+	KeyHooksCommand          = "hooks.command"
+	KeyHooksEvents           = "hooks.events"
+	KeyHooksFailureThreshold = "hooks.failure-threshold"
+	KeyHooksLagThreshold     = "hooks.lag-threshold"
+	KeyHooksTimeout          = "hooks.timeout"
+	KeyHooksURL              = "hooks.url"
+
+	KeyPGApplicationName = "postgresql.application-name"
+	KeyPGConnectTimeout  = "postgresql.connect-timeout"
+	KeyPGControlDataPath = "postgresql.pg_controldata-path"
+	KeyPGData            = "postgresql.pgdata"
+	KeyPGDatabase        = "postgresql.database"
+	KeyPGHost            = "postgresql.host"
+	KeyPGHosts           = "postgresql.hosts"
+	KeyPGMode            = "postgresql.mode"
+	KeyPGPassword        = "postgresql.password"
+	KeyPITRTargetLSN     = "postgresql.pitr.target-lsn"
+	KeyPITRTargetTime    = "postgresql.pitr.target-time"
+	KeyPGPollInterval    = "postgresql.poll-interval"
+	KeyPGPollMaxInterval = "postgresql.poll-max-interval"
+	KeyPGPort            = "postgresql.port"
+	KeyPGQueries         = "postgresql.queries"
+	KeyPGQueryDir        = "postgresql.query-dir"
+	KeyPGSession         = "postgresql.session"
+	KeyPGUser            = "postgresql.user"
+
+	KeyRepmgrConfig = "postgresql.repmgr.config-file"
+
+	KeyBufferCacheConninfo = "postgresql.buffercache.conninfo"
+	KeyBufferCacheInterval = "postgresql.buffercache.interval"
+
+	KeyPGLogFormat = "postgresql.log.format"
+	KeyPGLogPath   = "postgresql.log.path"
+
+	KeyArchiveBinPath          = "postgresql.archive.bin-path"
+	KeyArchiveCommand          = "postgresql.archive.command"
+	KeyArchiveFetchTimeout     = "postgresql.archive.fetch-timeout"
+	KeyArchiveFetcher          = "postgresql.archive.fetcher"
+	KeyArchivePGBackRestStanza = "postgresql.archive.pgbackrest-stanza"
+	KeyArchiveScratchDir       = "postgresql.archive.scratch-dir"
+
+	KeyWALDecodeBatchSize = "postgresql.wal.decode-batch-size"
+	KeyWALDecodeTimeout   = "postgresql.wal.decode-timeout"
+	KeyWALMaxDecoders     = "postgresql.wal.max-decoders"
+	KeyWALReadahead       = "postgresql.wal.readahead-bytes"
+	KeyWALReadaheadMax    = "postgresql.wal.readahead-max-bytes"
+	KeyWALReadaheadMin    = "postgresql.wal.readahead-min-bytes"
+	KeyWALSegmentBudget   = "postgresql.wal.segment-budget"
+	KeyWALTailInterval    = "postgresql.wal.tail-interval"
+	KeyWALThreads         = "postgresql.wal.threads"
+	KeyWALWatch           = "postgresql.wal.watch"
+
+	KeyXLogMode    = "postgresql.xlog.mode"
+	KeyXLogArgs    = "postgresql.xlog.pg_waldump-args"
+	KeyXLogEnv     = "postgresql.xlog.pg_waldump-env"
+	KeyXLogPath    = "postgresql.xlog.pg_waldump-path"
+	KeyXLogWrapper = "postgresql.xlog.pg_waldump-wrapper"
 )
 
 const (
@@ -40,6 +157,14 @@ const (
 	LogTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
 
 	StatsInterval = 60 * time.Second
+
+	// NumReservedFDs is the number of file descriptors not available to the
+	// filehandle cache.
+	NumReservedFDs = 50
+
+	// EnvPrefix is the prefix used when mapping config keys to environment
+	// variables (e.g. run.http.listen-addr == PG_PREFAULTER_RUN_HTTP_LISTEN_ADDR).
+	EnvPrefix = "PG_PREFAULTER"
 )
 
 type LogFormat uint
@@ -48,6 +173,7 @@ const (
 	LogFormatAuto LogFormat = iota
 	LogFormatZerolog
 	LogFormatHuman
+	LogFormatJournald
 )
 
 func (f LogFormat) String() string {
@@ -58,6 +184,8 @@ func (f LogFormat) String() string {
 		return "zerolog"
 	case LogFormatHuman:
 		return "human"
+	case LogFormatJournald:
+		return "journald"
 	default:
 		panic(fmt.Sprintf("unknown log format: %d", f))
 	}
@@ -71,6 +199,8 @@ func LogLevelParse(s string) (LogFormat, error) {
 		return LogFormatZerolog, nil
 	case "human":
 		return LogFormatHuman, nil
+	case "journal", "journald":
+		return LogFormatJournald, nil
 	default:
 		return LogFormatAuto, fmt.Errorf("unsupported log format: %q", logFormat)
 	}
@@ -0,0 +1,75 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DBHost is one of the PostgreSQL listeners the agent connects to.  Host is a
+// hostname, an IP address, or the directory holding a Unix domain socket.
+type DBHost struct {
+	Host string
+	Port uint16
+}
+
+func (h DBHost) String() string {
+	if strings.HasPrefix(h.Host, "/") {
+		return fmt.Sprintf("%s/.s.PGSQL.%d", h.Host, h.Port)
+	}
+
+	return net.JoinHostPort(h.Host, strconv.Itoa(int(h.Port)))
+}
+
+// ParseDBHosts parses a list of "host:port" targets.  A target without a port,
+// including a Unix domain socket directory, uses defaultPort.
+func ParseDBHosts(targets []string, defaultPort uint16) ([]DBHost, error) {
+	hosts := make([]DBHost, 0, len(targets))
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			return nil, fmt.Errorf("empty host in %s", KeyPGHosts)
+		}
+
+		if strings.HasPrefix(target, "/") {
+			hosts = append(hosts, DBHost{Host: target, Port: defaultPort})
+			continue
+		}
+
+		host, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			// A bare hostname or IP address, including an unbracketed IPv6 address
+			host, portStr = strings.Trim(target, "[]"), ""
+		}
+		if host == "" {
+			return nil, fmt.Errorf("missing hostname in %s: %q", KeyPGHosts, target)
+		}
+
+		port := defaultPort
+		if portStr != "" {
+			p, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil || p == 0 {
+				return nil, fmt.Errorf("invalid port in %s: %q", KeyPGHosts, target)
+			}
+			port = uint16(p)
+		}
+
+		hosts = append(hosts, DBHost{Host: host, Port: port})
+	}
+
+	return hosts, nil
+}
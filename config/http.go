@@ -0,0 +1,78 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// HTTPAuth secures the agent's HTTP listener.  The same settings are used
+// when talking to other agents (peers, export-warmset, and import-warmset) so
+// that a fleet can share one configuration.
+type HTTPAuth struct {
+	// TLSCert and TLSKey serve the listener over TLS and are presented as the
+	// client certificate to other agents.  Both are empty when TLS is disabled.
+	TLSCert string
+	TLSKey  string
+
+	// TLSCA is the CA bundle client certificates are verified against.  Other
+	// agents' certificates are also trusted if they chain to TLSCA.
+	TLSCA string
+
+	// Token is the bearer token required by the listener and sent to other
+	// agents.  Token is empty when token authentication is disabled.
+	Token string
+
+	// PublicMetrics exempts /metrics from authentication.  /healthz and
+	// /readyz never require authentication.
+	PublicMetrics bool
+}
+
+// Enabled returns true if requests to the listener must be authenticated.
+func (h HTTPAuth) Enabled() bool {
+	return h.Token != "" || h.TLSCA != ""
+}
+
+// NewHTTPAuth reads the HTTP listener's TLS and authentication settings.
+func NewHTTPAuth() (HTTPAuth, error) {
+	h := HTTPAuth{
+		TLSCert:       viper.GetString(KeyHTTPTLSCert),
+		TLSKey:        viper.GetString(KeyHTTPTLSKey),
+		TLSCA:         viper.GetString(KeyHTTPTLSCA),
+		PublicMetrics: viper.GetBool(KeyPublicMetrics),
+	}
+
+	if (h.TLSCert == "") != (h.TLSKey == "") {
+		return HTTPAuth{}, fmt.Errorf("%s and %s must be set together", KeyHTTPTLSCert, KeyHTTPTLSKey)
+	}
+
+	if tokenFile := viper.GetString(KeyHTTPTokenFile); tokenFile != "" {
+		buf, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return HTTPAuth{}, errors.Wrapf(err, "unable to read %s", KeyHTTPTokenFile)
+		}
+
+		h.Token = strings.TrimSpace(string(buf))
+		if h.Token == "" {
+			return HTTPAuth{}, fmt.Errorf("%s %q is empty", KeyHTTPTokenFile, tokenFile)
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// labelNameRE matches a Prometheus label name.  Names starting with "__" are
+// reserved.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// NewLabels reads the static labels, e.g. the cluster name, datacenter, and
+// role, attached to the agent's metrics, log lines, and webhook payloads.
+// Each label is "name=value".
+func NewLabels() (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, l := range viper.GetStringSlice(KeyLabels) {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%s must be of the form name=value (%q)", KeyLabels, l)
+		}
+		if !labelNameRE.MatchString(kv[0]) || strings.HasPrefix(kv[0], "__") {
+			return nil, fmt.Errorf("invalid label name in %s: %q", KeyLabels, kv[0])
+		}
+		switch kv[0] {
+		case zerolog.TimestampFieldName, zerolog.LevelFieldName, zerolog.MessageFieldName, zerolog.ErrorFieldName, zerolog.CallerFieldName:
+			return nil, fmt.Errorf("label %q in %s is reserved for log lines", kv[0], KeyLabels)
+		}
+		if _, found := labels[kv[0]]; found {
+			return nil, fmt.Errorf("label %q is repeated in %s", kv[0], KeyLabels)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,61 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// gucNameRE matches the name of a run-time parameter, including the
+// "extension.name" form of custom parameters.
+var gucNameRE = regexp.MustCompile(`^[a-z_][a-z0-9_$]*(?:\.[a-z_][a-z0-9_$]*)?$`)
+
+// NewRuntimeParams returns the run-time parameters set on every connection to
+// PostgreSQL: the application_name that identifies the agent in
+// pg_stat_activity and the session GUCs in the KeyPGSession section, e.g.
+// statement_timeout or tcp_keepalives_idle.
+func NewRuntimeParams() (map[string]string, error) {
+	applicationName := viper.GetString(KeyPGApplicationName)
+	if applicationName == "" {
+		return nil, fmt.Errorf("%s can not be empty", KeyPGApplicationName)
+	}
+
+	gucs := viper.GetStringMapString(KeyPGSession)
+	params := make(map[string]string, len(gucs)+1)
+
+	names := make([]string, 0, len(gucs))
+	for name := range gucs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		guc := strings.ToLower(name)
+		switch {
+		case !gucNameRE.MatchString(guc):
+			return nil, fmt.Errorf("invalid parameter name in %s: %q", KeyPGSession, name)
+		case guc == "application_name":
+			return nil, fmt.Errorf("application_name can not be set in %s, use %s", KeyPGSession, KeyPGApplicationName)
+		}
+		params[guc] = gucs[name]
+	}
+	params["application_name"] = applicationName
+
+	return params, nil
+}
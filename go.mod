@@ -5,7 +5,7 @@ go 1.16
 require (
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf
 	github.com/bluele/gcache v0.0.0-20171010155617-472614239ac7
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/hashicorp/go-version v1.3.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
@@ -25,9 +25,10 @@ require (
 	github.com/spf13/cast v1.1.0
 	github.com/spf13/cobra v0.0.1
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.0.0
 	github.com/stretchr/testify v1.7.0 // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -0,0 +1,305 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluele/gcache"
+)
+
+// CacheStats is the subset of gcache.Cache reported by LogCacheStats.
+type CacheStats interface {
+	HitCount() uint64
+	MissCount() uint64
+	LookupCount() uint64
+	HitRate() float64
+}
+
+// CacheStatistics is a point-in-time snapshot of a TunableCache's counters.
+// Hits, Misses, and Evictions count since the TunableCache was created.
+// Evictions include expired entries but not entries removed or purged.
+type CacheStatistics struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// Lookups returns the number of lookups counted by s.
+func (s CacheStatistics) Lookups() uint64 {
+	return s.Hits + s.Misses
+}
+
+// HitRatio returns the ratio of hits to lookups counted by s.
+func (s CacheStatistics) HitRatio() float64 {
+	if s.Lookups() == 0 {
+		return 0.0
+	}
+
+	return float64(s.Hits) / float64(s.Lookups())
+}
+
+// TunableCache is a gcache.Cache whose capacity and TTL can be changed while
+// it is in use.  gcache fixes a cache's capacity when it is built, so a resize
+// builds a new cache and carries over the unexpired entries of the old one.
+// Entries that no longer fit are evicted from the new cache as usual.
+type TunableCache struct {
+	build   func(size int) *gcache.CacheBuilder
+	evicted gcache.EvictedFunc
+
+	// ttl, evictions, and removals are accessed atomically.  gcache calls the
+	// EvictedFunc for entries removed with Remove, which are counted by
+	// removals and are not evictions.
+	ttl       int64
+	evictions uint64
+	removals  uint64
+
+	lock sync.RWMutex
+	c    gcache.Cache
+	size int
+
+	// entries is the number of entries in c and is accessed atomically.
+	// gcache's Len() looks up every entry, which would skew the counters and
+	// ARC's recency and frequency lists.
+	entries *int64
+
+	// hits and misses accumulate the counters of the caches replaced by
+	// Resize.
+	hits   uint64
+	misses uint64
+}
+
+// NewTunableCache returns a TunableCache of size entries built by build.  The
+// loader installed by build is expected to return TTL() as its expiration.
+// evicted, if not nil, is called for every entry evicted or removed.
+func NewTunableCache(size int, ttl time.Duration, build func(size int) *gcache.CacheBuilder, evicted gcache.EvictedFunc) *TunableCache {
+	tc := &TunableCache{
+		build:   build,
+		evicted: evicted,
+		ttl:     int64(ttl),
+		size:    size,
+	}
+	tc.c, tc.entries = tc.newCache(size)
+
+	return tc
+}
+
+// newCache builds a cache of size entries that counts its entries.
+func (tc *TunableCache) newCache(size int) (gcache.Cache, *int64) {
+	entries := new(int64)
+	c := tc.build(size).
+		AddedFunc(func(key, value interface{}) {
+			atomic.AddInt64(entries, 1)
+		}).
+		EvictedFunc(func(key, value interface{}) {
+			atomic.AddInt64(entries, -1)
+			atomic.AddUint64(&tc.evictions, 1)
+			if tc.evicted != nil {
+				tc.evicted(key, value)
+			}
+		}).
+		Build()
+
+	return c, entries
+}
+
+// Get forwards to gcache.Cache's Get().
+func (tc *TunableCache) Get(k interface{}) (interface{}, error) {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	return tc.c.Get(k)
+}
+
+// GetIFPresent forwards to gcache.Cache's GetIFPresent().
+func (tc *TunableCache) GetIFPresent(k interface{}) (interface{}, error) {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	return tc.c.GetIFPresent(k)
+}
+
+// Remove forwards to gcache.Cache's Remove().
+func (tc *TunableCache) Remove(k interface{}) bool {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	removed := tc.c.Remove(k)
+	if removed {
+		atomic.AddUint64(&tc.removals, 1)
+	}
+
+	return removed
+}
+
+// RemoveIf removes every entry whose key matches and returns the number of
+// entries removed.  RemoveIf visits every entry so it is intended for rare
+// invalidations, not routine lookups.
+func (tc *TunableCache) RemoveIf(match func(k interface{}) bool) int {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	// Keys() looks up every entry, don't count those lookups.
+	hits, misses := tc.c.HitCount(), tc.c.MissCount()
+	keys := tc.c.Keys()
+	tc.hits += hits - tc.c.HitCount()
+	tc.misses += misses - tc.c.MissCount()
+
+	var removed int
+	for _, k := range keys {
+		if match(k) && tc.c.Remove(k) {
+			atomic.AddUint64(&tc.removals, 1)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Purge forwards to gcache.Cache's Purge().
+func (tc *TunableCache) Purge() {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	tc.c.Purge()
+	atomic.StoreInt64(tc.entries, 0)
+}
+
+// TTL returns the expiration given to newly loaded entries.  TTL returns a
+// pointer so that it can be returned directly from a gcache.LoaderExpireFunc.
+func (tc *TunableCache) TTL() *time.Duration {
+	ttl := time.Duration(atomic.LoadInt64(&tc.ttl))
+	return &ttl
+}
+
+// SetTTL changes the expiration given to newly loaded entries.  Existing
+// entries keep their expiration.
+func (tc *TunableCache) SetTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be positive (%s)", ttl)
+	}
+
+	atomic.StoreInt64(&tc.ttl, int64(ttl))
+
+	return nil
+}
+
+// Resize changes the capacity of the cache.  Unexpired entries are carried
+// over and expire after the current TTL.  When shrinking, the entries that do
+// not fit are evicted.
+func (tc *TunableCache) Resize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("size must be at least 1 (%d)", size)
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if size == tc.size {
+		return nil
+	}
+
+	// Collect the counters before GetALL() counts its own lookups.
+	hits, misses := tc.c.HitCount(), tc.c.MissCount()
+
+	c, entries := tc.newCache(size)
+	ttl := *tc.TTL()
+	for k, v := range tc.c.GetALL() {
+		var err error
+		if ttl > 0 {
+			err = c.SetWithExpire(k, v, ttl)
+		} else {
+			err = c.Set(k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	tc.c = c
+	tc.entries = entries
+	tc.size = size
+	tc.hits += hits
+	tc.misses += misses
+
+	return nil
+}
+
+// Size returns the capacity of the cache.
+func (tc *TunableCache) Size() int {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	return tc.size
+}
+
+// Statistics returns the cache's current number of entries and counters.
+func (tc *TunableCache) Statistics() CacheStatistics {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	// Loads racing Purge leave the count approximate.
+	entries := int(atomic.LoadInt64(tc.entries))
+	switch {
+	case entries < 0:
+		entries = 0
+	case entries > tc.size:
+		entries = tc.size
+	}
+
+	// Removals are counted after their eviction, so load them first.
+	removals := atomic.LoadUint64(&tc.removals)
+
+	return CacheStatistics{
+		Entries:   entries,
+		Hits:      tc.hits + tc.c.HitCount(),
+		Misses:    tc.misses + tc.c.MissCount(),
+		Evictions: atomic.LoadUint64(&tc.evictions) - removals,
+	}
+}
+
+// HitCount returns the number of hits since the cache was created.
+func (tc *TunableCache) HitCount() uint64 {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	return tc.hits + tc.c.HitCount()
+}
+
+// MissCount returns the number of misses since the cache was created.
+func (tc *TunableCache) MissCount() uint64 {
+	tc.lock.RLock()
+	defer tc.lock.RUnlock()
+
+	return tc.misses + tc.c.MissCount()
+}
+
+// LookupCount returns the number of lookups since the cache was created.
+func (tc *TunableCache) LookupCount() uint64 {
+	return tc.HitCount() + tc.MissCount()
+}
+
+// HitRate returns the ratio of hits to lookups since the cache was created.
+func (tc *TunableCache) HitRate() float64 {
+	hits, misses := tc.HitCount(), tc.MissCount()
+	if hits+misses == 0 {
+		return 0.0
+	}
+
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,152 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestTunableCacheResize(t *testing.T) {
+	var evicted []int
+	var tc *lib.TunableCache
+	tc = lib.NewTunableCache(4, time.Hour, func(size int) *gcache.CacheBuilder {
+		return gcache.New(size).
+			LRU().
+			LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
+				return key.(int) * 10, tc.TTL(), nil
+			})
+	}, func(key, value interface{}) {
+		evicted = append(evicted, key.(int))
+	})
+
+	for i := 0; i < 4; i++ {
+		if _, err := tc.Get(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Growing carries over every entry without evicting any
+	if err := tc.Resize(8); err != nil {
+		t.Fatal(err)
+	}
+	if size := tc.Size(); size != 8 {
+		t.Fatalf("size %d, want 8", size)
+	}
+	for i := 0; i < 4; i++ {
+		if v, err := tc.GetIFPresent(i); err != nil || v.(int) != i*10 {
+			t.Fatalf("%d: lost by resize: %v, %v", i, v, err)
+		}
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("evicted %v", evicted)
+	}
+
+	// Shrinking evicts the entries that no longer fit
+	if err := tc.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 3 {
+		t.Fatalf("evicted %v", evicted)
+	}
+	kept := 0 + 1 + 2 + 3
+	for _, k := range evicted {
+		kept -= k
+	}
+	if _, err := tc.GetIFPresent(kept); err != nil {
+		t.Fatalf("%d: lost by resize: %v", kept, err)
+	}
+	if entries := tc.Statistics().Entries; entries != 1 {
+		t.Fatalf("%d entries, want 1", entries)
+	}
+
+	// Counters survive the rebuilt caches: the four loads, the four entries
+	// found after growing, and the one found after shrinking.  Removals aren't
+	// evictions.
+	if !tc.Remove(kept) {
+		t.Fatalf("%d: not removed", kept)
+	}
+	want := lib.CacheStatistics{Hits: 5, Misses: 4, Evictions: 3}
+	if diff := pretty.Compare(tc.Statistics(), want); diff != "" {
+		t.Fatalf("statistics diff: (-got +want)\n%s", diff)
+	}
+	if ratio := want.HitRatio(); ratio != 5.0/9.0 {
+		t.Fatalf("hit ratio %f", ratio)
+	}
+
+	if err := tc.Resize(0); err == nil {
+		t.Fatal("resized to zero")
+	}
+}
+
+func TestTunableCacheTTL(t *testing.T) {
+	tc := lib.NewTunableCache(1, time.Hour, func(size int) *gcache.CacheBuilder {
+		return gcache.New(size).LRU()
+	}, nil)
+
+	if err := tc.SetTTL(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := *tc.TTL(); ttl != time.Minute {
+		t.Fatalf("ttl %s, want 1m", ttl)
+	}
+
+	if err := tc.SetTTL(0); err == nil {
+		t.Fatal("set a zero TTL")
+	}
+}
+
+func TestTunableCacheRemoveIf(t *testing.T) {
+	var evicted []int
+	var tc *lib.TunableCache
+	tc = lib.NewTunableCache(8, time.Hour, func(size int) *gcache.CacheBuilder {
+		return gcache.New(size).
+			ARC().
+			LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
+				return key.(int) * 10, tc.TTL(), nil
+			})
+	}, func(key, value interface{}) {
+		evicted = append(evicted, key.(int))
+	})
+
+	for i := 0; i < 6; i++ {
+		if _, err := tc.Get(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	odd := func(k interface{}) bool { return k.(int)%2 == 1 }
+	if removed := tc.RemoveIf(odd); removed != 3 {
+		t.Fatalf("removed %d, want 3", removed)
+	}
+	if len(evicted) != 3 {
+		t.Fatalf("evicted %v", evicted)
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := tc.GetIFPresent(i); (err == nil) == odd(i) {
+			t.Fatalf("%d: present %t", i, err == nil)
+		}
+	}
+
+	// Visiting the entries isn't counted as lookups and removals aren't
+	// evictions.
+	want := lib.CacheStatistics{Entries: 3, Hits: 3, Misses: 9}
+	if diff := pretty.Compare(tc.Statistics(), want); diff != "" {
+		t.Fatalf("statistics diff: (-got +want)\n%s", diff)
+	}
+}
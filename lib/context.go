@@ -17,11 +17,29 @@ import (
 	"context"
 	"time"
 
-	"github.com/bluele/gcache"
 	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/rs/zerolog"
 	log "github.com/rs/zerolog/log"
 )
 
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that carries logger.  The caches log to the
+// logger carried by the context they are created with.
+func WithLogger(ctx context.Context, logger *zerolog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger carried by ctx, or the global logger if ctx does
+// not carry one.
+func Logger(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+
+	return &log.Logger
+}
+
 // IsShuttingDown is a convenience helper that returns true when the context is
 // Done.  True indicates an orderly shutdown is to begin immediately.
 func IsShuttingDown(ctx context.Context) bool {
@@ -35,13 +53,13 @@ func IsShuttingDown(ctx context.Context) bool {
 
 // LogCacheStats emits logs periodically with cache hit, miss, lookup count, and
 // hit rates.
-func LogCacheStats(ctx context.Context, c gcache.Cache, cacheName string) {
+func LogCacheStats(ctx context.Context, c CacheStats, cacheName string) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-time.After(config.StatsInterval):
-			log.Debug().
+			Logger(ctx).Debug().
 				Uint64("hit", c.HitCount()).
 				Uint64("miss", c.MissCount()).
 				Uint64("lookup", c.LookupCount()).
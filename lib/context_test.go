@@ -0,0 +1,41 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestLogger(t *testing.T) {
+	if l := lib.Logger(context.Background()); l != &log.Logger {
+		t.Fatal("context without a logger doesn't use the global logger")
+	}
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	ctx, cancel := context.WithCancel(lib.WithLogger(context.Background(), &logger))
+	defer cancel()
+
+	lib.Logger(ctx).Info().Msg("embedded")
+	if !strings.Contains(buf.String(), `"message":"embedded"`) {
+		t.Fatalf("logged %q to the injected logger", buf.String())
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorCategory classifies an error by how the agent responds to it: whether
+// the operation is retried and, if not, the process's exit code.
+type ErrorCategory int
+
+const (
+	// ErrorCategoryFatal is an unexpected error.  Errors without a category
+	// are fatal.
+	ErrorCategoryFatal ErrorCategory = iota
+
+	// ErrorCategoryConfig is an invalid configuration or command line.
+	ErrorCategoryConfig
+
+	// ErrorCategoryPermission is a denied operation, e.g. a file that can't be
+	// read or a database role that lacks a privilege.
+	ErrorCategoryPermission
+
+	// ErrorCategoryTransientDB is a database that is unavailable, starting up,
+	// or shutting down.  Retrying may succeed.
+	ErrorCategoryTransientDB
+)
+
+// Exit codes of each error category.  Except for fatal errors these are the
+// sysexits(3) codes so that a supervisor can tell them apart, e.g. to not
+// restart after a configuration error.
+const (
+	ExitCodeFatal       = 1
+	ExitCodeTransientDB = 75 // EX_TEMPFAIL
+	ExitCodePermission  = 77 // EX_NOPERM
+	ExitCodeConfig      = 78 // EX_CONFIG
+)
+
+// String returns the name of the category.
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorCategoryConfig:
+		return "config"
+	case ErrorCategoryPermission:
+		return "permission"
+	case ErrorCategoryTransientDB:
+		return "transient-db"
+	default:
+		return "fatal"
+	}
+}
+
+// ExitCode returns the process exit code for errors of the category.
+func (c ErrorCategory) ExitCode() int {
+	switch c {
+	case ErrorCategoryConfig:
+		return ExitCodeConfig
+	case ErrorCategoryPermission:
+		return ExitCodePermission
+	case ErrorCategoryTransientDB:
+		return ExitCodeTransientDB
+	default:
+		return ExitCodeFatal
+	}
+}
+
+// Retryable returns true if retrying an operation that failed with an error of
+// the category may succeed.
+func (c ErrorCategory) Retryable() bool {
+	return c == ErrorCategoryTransientDB
+}
+
+// categorizer is implemented by errors that carry an ErrorCategory.
+type categorizer interface {
+	ErrorCategory() ErrorCategory
+}
+
+// categorizedError associates a category with an error.
+type categorizedError struct {
+	err      error
+	category ErrorCategory
+}
+
+func (e categorizedError) Error() string                { return e.err.Error() }
+func (e categorizedError) Cause() error                 { return e.err }
+func (e categorizedError) Unwrap() error                { return e.err }
+func (e categorizedError) ErrorCategory() ErrorCategory { return e.category }
+
+// WithCategory annotates err with category.  WithCategory returns nil if err
+// is nil.
+func WithCategory(err error, category ErrorCategory) error {
+	if err == nil {
+		return nil
+	}
+
+	return categorizedError{err: err, category: category}
+}
+
+// ConfigError annotates err as a configuration error.
+func ConfigError(err error) error {
+	return WithCategory(err, ErrorCategoryConfig)
+}
+
+// PermissionError annotates err as a permission error.
+func PermissionError(err error) error {
+	return WithCategory(err, ErrorCategoryPermission)
+}
+
+// TransientDBError annotates err as a transient database error.
+func TransientDBError(err error) error {
+	return WithCategory(err, ErrorCategoryTransientDB)
+}
+
+// CategoryOf returns the category of the outermost categorized error in err's
+// chain.  Uncategorized errors caused by a denied operation (EACCES or EPERM)
+// are permission errors and all others are fatal.
+func CategoryOf(err error) ErrorCategory {
+	var c categorizer
+	switch {
+	case err == nil:
+		return ErrorCategoryFatal
+	case errors.As(err, &c):
+		return c.ErrorCategory()
+	case errors.Is(err, os.ErrPermission):
+		return ErrorCategoryPermission
+	default:
+		return ErrorCategoryFatal
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+)
+
+// LoadCertPool returns a certificate pool containing the PEM certificates in
+// caFile.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := appendCAFile(pool, caFile); err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// appendCAFile adds the PEM certificates in caFile to pool.
+func appendCAFile(pool *x509.CertPool, caFile string) error {
+	buf, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to read CA bundle")
+	}
+
+	if !pool.AppendCertsFromPEM(buf) {
+		return fmt.Errorf("no certificates found in CA bundle %q", caFile)
+	}
+
+	return nil
+}
+
+// NewHTTPClient returns a client for the HTTP listeners of other agents.  The
+// client trusts auth's CA bundle in addition to the system roots, presents
+// auth's certificate, and sends auth's bearer token.
+func NewHTTPClient(auth config.HTTPAuth, timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if auth.TLSCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := appendCAFile(pool, auth.TLSCA); err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if auth.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(auth.TLSCert, auth.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load the TLS certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+	if auth.Token != "" {
+		client.Transport = &bearerTransport{token: auth.Token, next: transport}
+	}
+
+	return client, nil
+}
+
+// bearerTransport adds a bearer token to every request.
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+
+	return t.next.RoundTrip(req)
+}
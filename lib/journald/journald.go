@@ -0,0 +1,176 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package journald implements a zerolog writer that emits events to the
+// systemd journal using the journal's native protocol.  Each field of a
+// zerolog event is translated into a journal field so that records can be
+// queried with journalctl(1) (e.g. `journalctl -u pg_prefaulter WALFILE=...`).
+package journald
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// SyslogIdentifier is the value of the SYSLOG_IDENTIFIER field attached to
+// every record.
+const SyslogIdentifier = "pg_prefaulter"
+
+// Syslog priorities as defined in syslog(3).
+const (
+	priAlert   = 1
+	priCrit    = 2
+	priErr     = 3
+	priWarning = 4
+	priNotice  = 5
+	priInfo    = 6
+	priDebug   = 7
+)
+
+// encode translates a single zerolog JSON event into the journal's native
+// protocol.
+func encode(event []byte) ([]byte, error) {
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(event))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return nil, errors.Wrap(err, "unable to decode log event")
+	}
+
+	buf := &bytes.Buffer{}
+	writeField(buf, "PRIORITY", strconv.Itoa(priority(fields[zerolog.LevelFieldName])))
+	writeField(buf, "SYSLOG_IDENTIFIER", SyslogIdentifier)
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := fields[k]
+		switch k {
+		case zerolog.LevelFieldName, zerolog.TimestampFieldName:
+			// The level is carried by PRIORITY and the journal timestamps every
+			// record on receipt.
+			continue
+		case zerolog.MessageFieldName:
+			writeField(buf, "MESSAGE", valueString(v))
+		case zerolog.CallerFieldName:
+			caller := valueString(v)
+			if i := strings.LastIndexByte(caller, ':'); i > 0 {
+				writeField(buf, "CODE_FILE", caller[:i])
+				writeField(buf, "CODE_LINE", caller[i+1:])
+			} else {
+				writeField(buf, "CODE_FILE", caller)
+			}
+		default:
+			name := fieldName(k)
+			if name == "" {
+				continue
+			}
+			writeField(buf, name, valueString(v))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fieldName maps a zerolog field name to a valid journal field name.  Journal
+// field names may only contain uppercase letters, digits, and underscores and
+// may not begin with an underscore or a digit.  Fields that can not be mapped
+// return an empty string.
+func fieldName(k string) string {
+	name := make([]byte, 0, len(k))
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			name = append(name, c-'a'+'A')
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			name = append(name, c)
+		default:
+			name = append(name, '_')
+		}
+	}
+
+	name = bytes.TrimLeft(name, "_0123456789")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return string(name)
+}
+
+// priority maps a zerolog level to a syslog priority.
+func priority(level interface{}) int {
+	l, _ := level.(string)
+	switch lvl, _ := zerolog.ParseLevel(l); lvl {
+	case zerolog.DebugLevel, zerolog.TraceLevel:
+		return priDebug
+	case zerolog.InfoLevel:
+		return priInfo
+	case zerolog.WarnLevel:
+		return priWarning
+	case zerolog.ErrorLevel:
+		return priErr
+	case zerolog.FatalLevel:
+		return priCrit
+	case zerolog.PanicLevel:
+		return priAlert
+	default:
+		return priNotice
+	}
+}
+
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(b)
+	}
+}
+
+// writeField appends a single field in the journal's native format.  Values
+// containing a newline use the length-prefixed binary form.
+func writeField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.IndexByte(value, '\n') == -1 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
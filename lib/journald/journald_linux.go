@@ -0,0 +1,119 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journald
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// socketPath is the journal's native protocol socket.
+const socketPath = "/run/systemd/journal/socket"
+
+// Writer sends zerolog events to the systemd journal.  Writer is safe for
+// concurrent use.
+type Writer struct {
+	lock sync.Mutex
+	conn *net.UnixConn
+}
+
+// NewWriter connects to the local journal.
+func NewWriter() (*Writer, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to the journal")
+	}
+
+	return &Writer{conn: conn}, nil
+}
+
+// Connected returns true when stderr or stdout is connected to the journal
+// (i.e. the process was started by systemd with StandardOutput=journal).
+func Connected() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+
+	for _, f := range []*os.File{os.Stderr, os.Stdout} {
+		var st unix.Stat_t
+		if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+			continue
+		}
+
+		if stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Write implements io.Writer.  p must contain a single zerolog JSON event.
+func (w *Writer) Write(p []byte) (int, error) {
+	msg, err := encode(p)
+	if err != nil {
+		return 0, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := w.conn.Write(msg); err != nil {
+		if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+			return 0, errors.Wrap(err, "unable to write to the journal")
+		}
+
+		// Large records must be passed to journald via a file descriptor.
+		if err := w.writeViaFD(msg); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close closes the connection to the journal.
+func (w *Writer) Close() error {
+	return w.conn.Close()
+}
+
+func (w *Writer) writeViaFD(msg []byte) error {
+	fd, err := unix.MemfdCreate("journal-message", unix.MFD_ALLOW_SEALING|unix.MFD_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "unable to create memfd for journal message")
+	}
+	f := os.NewFile(uintptr(fd), "journal-message")
+	defer f.Close()
+
+	if _, err := f.Write(msg); err != nil {
+		return errors.Wrap(err, "unable to write journal message to memfd")
+	}
+
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return errors.Wrap(err, "unable to seal journal memfd")
+	}
+
+	if _, _, err := w.conn.WriteMsgUnix(nil, unix.UnixRights(int(f.Fd())), nil); err != nil {
+		return errors.Wrap(err, "unable to pass journal memfd")
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package journald
+
+import "github.com/pkg/errors"
+
+// Writer sends zerolog events to the systemd journal.  The journal is only
+// available on Linux.
+type Writer struct{}
+
+// NewWriter always fails on platforms without systemd.
+func NewWriter() (*Writer, error) {
+	return nil, errors.New("the systemd journal is not supported on this platform")
+}
+
+// Connected always returns false on platforms without systemd.
+func Connected() bool {
+	return false
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	return 0, errors.New("the systemd journal is not supported on this platform")
+}
+
+// Close implements io.Closer.
+func (w *Writer) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journald
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_encode(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantFail bool
+		out      string
+	}{
+		{ // 0
+			in:  `{"level":"warn","walfile":"000000010000000000000001","relation":16384,"caller":"/src/agent/db.go:42","time":"2019-01-01T00:00:00Z","message":"unable to prefault"}`,
+			out: "PRIORITY=4\nSYSLOG_IDENTIFIER=pg_prefaulter\nCODE_FILE=/src/agent/db.go\nCODE_LINE=42\nMESSAGE=unable to prefault\nRELATION=16384\nWALFILE=000000010000000000000001\n",
+		},
+		{ // 1
+			in:  `{"level":"debug","io-worker-thread-id":3,"tags":["a","b"]}`,
+			out: "PRIORITY=7\nSYSLOG_IDENTIFIER=pg_prefaulter\nIO_WORKER_THREAD_ID=3\nTAGS=[\"a\",\"b\"]\n",
+		},
+		{ // 2
+			in:  `{"level":"error","error":"a\nb"}`,
+			out: "PRIORITY=3\nSYSLOG_IDENTIFIER=pg_prefaulter\nERROR\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n",
+		},
+		{ // 3
+			in:       `not json`,
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		out, err := encode([]byte(test.in))
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+
+		if diff := pretty.Compare(string(out), test.out); diff != "" {
+			t.Fatalf("%d: encode diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func Test_fieldName(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"walfile", "WALFILE"},
+		{"hit-rate", "HIT_RATE"},
+		{"_private", "PRIVATE"},
+		{"1st", "ST"},
+		{"-", ""},
+	}
+
+	for n, test := range tests {
+		if diff := pretty.Compare(fieldName(test.in), test.out); diff != "" {
+			t.Fatalf("%d: fieldName diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"sort"
+
+	"github.com/rs/zerolog"
+)
+
+// LabelLogger returns logger with labels, e.g. the cluster name, added to every
+// log line.
+func LabelLogger(logger zerolog.Logger, labels map[string]string) zerolog.Logger {
+	if len(labels) == 0 {
+		return logger
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx := logger.With()
+	for _, name := range names {
+		ctx = ctx.Str(name, labels[name])
+	}
+
+	return ctx.Logger()
+}
@@ -0,0 +1,79 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// LookupIDs resolves userName and groupName, either of which may be a name or
+// a numeric ID.  An empty groupName selects the user's primary group.
+func LookupIDs(userName, groupName string) (uid, gid int, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return -1, -1, errors.Wrapf(err, "unable to find user %q", userName)
+		}
+	}
+
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return -1, -1, errors.Wrapf(err, "invalid uid for user %q", userName)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return -1, -1, errors.Wrapf(err, "unable to find group %q", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return -1, -1, errors.Wrapf(err, "invalid gid for group %q", groupName)
+	}
+
+	return uid, gid, nil
+}
+
+// DropPrivileges permanently switches the process to uid and gid and clears
+// its supplementary groups.  The process must be running as root.
+func DropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return errors.Wrap(err, "unable to clear supplementary groups")
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return errors.Wrapf(err, "unable to set gid to %d", gid)
+	}
+
+	if err := syscall.Setuid(uid); err != nil {
+		return errors.Wrapf(err, "unable to set uid to %d", uid)
+	}
+
+	// Paranoia: a partial drop must not go unnoticed.
+	if uid != 0 && (os.Geteuid() == 0 || syscall.Setuid(0) == nil) {
+		return fmt.Errorf("unable to drop root privileges")
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// BufferCacheBlock is a block of a relation's main fork held in shared
+// buffers.
+type BufferCacheBlock struct {
+	Tablespace OID
+	Database   OID
+	Relation   OID
+	Block      HeapBlockNumber
+}
+
+// queryBufferCache returns the blocks of the main fork of every relation in
+// shared buffers, across all databases.  Shared catalogs (database 0) are
+// excluded.
+const queryBufferCache = `SELECT reltablespace, reldatabase, relfilenode, relblocknumber
+FROM pg_buffercache
+WHERE relfilenode IS NOT NULL AND relforknumber = 0 AND reldatabase <> 0`
+
+// QueryBufferCache queries the pg_buffercache extension for the blocks in
+// shared buffers and calls fn with each one as it is read.  QueryBufferCache
+// returns the number of blocks read.
+func QueryBufferCache(ctx context.Context, pool *pgx.ConnPool, fn func(BufferCacheBlock)) (uint64, error) {
+	rows, err := pool.QueryEx(ctx, queryBufferCache, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to query pg_buffercache")
+	}
+	defer rows.Close()
+
+	var n uint64
+	for rows.Next() {
+		var spcNode, dbNode, relNode uint32
+		var block int64
+		if err := rows.Scan(&spcNode, &dbNode, &relNode, &block); err != nil {
+			return n, errors.Wrap(err, "unable to scan pg_buffercache")
+		}
+
+		fn(BufferCacheBlock{
+			Tablespace: OID(spcNode),
+			Database:   OID(dbNode),
+			Relation:   OID(relNode),
+			Block:      HeapBlockNumber(block),
+		})
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return n, errors.Wrap(err, "unable to query pg_buffercache")
+	}
+
+	return n, nil
+}
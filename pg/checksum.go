@@ -0,0 +1,136 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// pageChecksumOffset and pageUpperOffset are the offsets of pd_checksum
+	// and pd_upper in PageHeaderData.
+	pageChecksumOffset = 8
+	pageUpperOffset    = 14
+	pageHeaderSize     = 24
+
+	// checksumNumSums is the number of parallel sums (N_SUMS) used by
+	// PostgreSQL's page checksum algorithm.
+	checksumNumSums  = 32
+	checksumFNVPrime = 16777619
+)
+
+// checksumBaseOffsets are the random initial values for each of the parallel
+// sums.  See src/include/storage/checksum_impl.h.
+var checksumBaseOffsets = [checksumNumSums]uint32{
+	0x5B1F36E9, 0xB8525960, 0x02AB50AA, 0x1DE66D2A,
+	0x79FF467A, 0x9BB9F8A3, 0x217E7CD2, 0x83E13D2C,
+	0xF8D4474F, 0xE39EB970, 0x42C6AE16, 0x993216FA,
+	0x7B093B5D, 0x98DAFF3C, 0xF718902A, 0x0B1C9CDB,
+	0xE58F764B, 0x187636BC, 0x5D7B3BB1, 0xE73DE7DE,
+	0x92BEC979, 0xCCA6C0B2, 0x304A0979, 0x85AA43D4,
+	0x783125BB, 0x6CA8EAA2, 0xE407EAC6, 0x4B5CFC3E,
+	0x9FBF8C76, 0x15CA20BE, 0xF2CA9FFF, 0x4B6ADBAE,
+}
+
+// ChecksumError is returned when a page's stored checksum does not match the
+// checksum computed from its contents.
+type ChecksumError struct {
+	Block    HeapBlockNumber
+	Expected uint16
+	Actual   uint16
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("page verification failed for block %d: calculated checksum %d but expected %d", e.Block, e.Actual, e.Expected)
+}
+
+// PageIsNew returns true if the page has not been initialized (pd_upper is
+// zero).  New pages do not carry a checksum.
+func PageIsNew(page []byte) bool {
+	return binary.LittleEndian.Uint16(page[pageUpperOffset:]) == 0
+}
+
+// PageChecksum computes the checksum of page as it would be stored in
+// pd_checksum for the given block number.  block is the block's number within
+// the relation, not within the relation's segment.  The stored pd_checksum is
+// excluded from the calculation.
+//
+// FIXME: pages are written in the server's native byte order.  Only
+// little-endian servers are currently supported.
+func PageChecksum(page []byte, block HeapBlockNumber) uint16 {
+	var sums [checksumNumSums]uint32
+	copy(sums[:], checksumBaseOffsets[:])
+
+	comp := func(sum *uint32, v uint32) {
+		tmp := *sum ^ v
+		*sum = tmp*checksumFNVPrime ^ (tmp >> 17)
+	}
+
+	const rowSize = 4 * checksumNumSums
+	for row := 0; row+rowSize <= len(page); row += rowSize {
+		for i := 0; i < checksumNumSums; i++ {
+			off := row + 4*i
+			var v uint32
+			// pd_checksum is treated as zero, pd_flags is the other half of the
+			// word.
+			if off == pageChecksumOffset {
+				v = uint32(binary.LittleEndian.Uint16(page[off+2:])) << 16
+			} else {
+				v = binary.LittleEndian.Uint32(page[off:])
+			}
+			comp(&sums[i], v)
+		}
+	}
+
+	// Two extra rounds of zeros to mix the final bits
+	for round := 0; round < 2; round++ {
+		for i := 0; i < checksumNumSums; i++ {
+			comp(&sums[i], 0)
+		}
+	}
+
+	var checksum uint32
+	for i := 0; i < checksumNumSums; i++ {
+		checksum ^= sums[i]
+	}
+
+	checksum ^= uint32(block)
+
+	// Reduce to a uint16 with an offset of one so that a checksum is never zero
+	return uint16(checksum%65535) + 1
+}
+
+// VerifyPage verifies page's stored checksum.  New pages are not verified.  A
+// *ChecksumError is returned when the checksum does not match.
+func VerifyPage(page []byte, block HeapBlockNumber) error {
+	if len(page) < pageHeaderSize {
+		return fmt.Errorf("page too short: %d bytes", len(page))
+	}
+
+	if PageIsNew(page) {
+		return nil
+	}
+
+	expected := binary.LittleEndian.Uint16(page[pageChecksumOffset:])
+	if actual := PageChecksum(page, block); actual != expected {
+		return &ChecksumError{
+			Block:    block,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testPage returns a BLCKSZ page filled with a deterministic pattern.
+func testPage() []byte {
+	page := make([]byte, HeapPageSize)
+	for i := range page {
+		page[i] = byte(i*7 + 3)
+	}
+	return page
+}
+
+func TestPageChecksum(t *testing.T) {
+	// Expected values were computed with PostgreSQL's checksum_impl.h
+	tests := []struct {
+		block HeapBlockNumber
+		out   uint16
+	}{
+		{block: 0, out: 28951},
+		{block: 12345, out: 41184},
+		{block: 131073, out: 28954},
+	}
+
+	for n, test := range tests {
+		if got := PageChecksum(testPage(), test.block); got != test.out {
+			t.Errorf("%d: checksum mismatch: got %d, want %d", n, got, test.out)
+		}
+	}
+}
+
+func TestVerifyPage(t *testing.T) {
+	const block HeapBlockNumber = 12345
+
+	page := testPage()
+	binary.LittleEndian.PutUint16(page[pageChecksumOffset:], PageChecksum(page, block))
+	if err := VerifyPage(page, block); err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	// The checksum covers the block number
+	if err := VerifyPage(page, block+1); err == nil {
+		t.Fatalf("expected failure for the wrong block number")
+	}
+
+	page[4096] ^= 0x01
+	err := VerifyPage(page, block)
+	cerr, ok := err.(*ChecksumError)
+	if !ok {
+		t.Fatalf("expected a *ChecksumError, got %T: %v", err, err)
+	}
+	if cerr.Block != block || cerr.Actual == cerr.Expected {
+		t.Fatalf("unexpected checksum error: %+v", cerr)
+	}
+
+	// New pages are not verified
+	binary.LittleEndian.PutUint16(page[pageUpperOffset:], 0)
+	if err := VerifyPage(page, block); err != nil {
+		t.Fatalf("unexpected failure for a new page: %v", err)
+	}
+}
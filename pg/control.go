@@ -0,0 +1,312 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// ControlData contains the storage geometry of a PostgreSQL cluster as
+// recorded in pg_control.  These values are fixed when a cluster is initdb'ed
+// (or when PostgreSQL is compiled) and can not change for the life of a
+// cluster.
+type ControlData struct {
+	// BlockSize is the size of a heap page (BLCKSZ).
+	BlockSize units.Base2Bytes
+
+	// BlocksPerSegment is the number of heap pages in a single relation segment
+	// file (RELSEG_SIZE).
+	BlocksPerSegment uint64
+
+	// WALBlockSize is the size of a WAL page (XLOG_BLCKSZ).
+	WALBlockSize units.Base2Bytes
+
+	// WALSegmentSize is the size of a single WAL segment file.
+	WALSegmentSize units.Base2Bytes
+
+	// DataChecksumVersion is non-zero when data page checksums are enabled.
+	DataChecksumVersion uint32
+
+	// TrackCommitTimestamp is true when commit timestamps are being recorded.
+	// Unlike the geometry, track_commit_timestamp can be changed by restarting
+	// the primary.
+	TrackCommitTimestamp bool
+}
+
+// Geometry returns the storage geometry of cd, ignoring the settings that do
+// not affect the layout of the heap or WAL.
+func (cd ControlData) Geometry() ControlData {
+	cd.DataChecksumVersion = 0
+	cd.TrackCommitTimestamp = false
+	return cd
+}
+
+// DefaultControlData returns the storage geometry pg_prefaulter was built to
+// assume.
+func DefaultControlData() ControlData {
+	return ControlData{
+		BlockSize:        HeapPageSize,
+		BlocksPerSegment: uint64(HeapMaxSegmentSize / HeapPageSize),
+		WALBlockSize:     WALPageSize,
+		WALSegmentSize:   WALSegmentSize,
+	}
+}
+
+// Check verifies the ControlData is usable.  The heap geometry is threaded
+// through at runtime, however the LSN and WAL filename math is derived from
+// compile-time constants so a WAL segment size other than the build's
+// assumption is fatal.
+func (cd ControlData) Check() error {
+	if cd.BlockSize < 1*units.KiB || cd.BlockSize > 32*units.KiB || cd.BlockSize&(cd.BlockSize-1) != 0 {
+		return fmt.Errorf("unsupported block size: %d", cd.BlockSize)
+	}
+
+	if cd.BlocksPerSegment == 0 {
+		return fmt.Errorf("invalid number of blocks per relation segment: %d", cd.BlocksPerSegment)
+	}
+
+	if cd.WALSegmentSize != WALSegmentSize {
+		return fmt.Errorf("WAL segment size is %s, pg_prefaulter was built for %s", cd.WALSegmentSize, units.Base2Bytes(WALSegmentSize))
+	}
+
+	if cd.WALBlockSize != WALPageSize {
+		return fmt.Errorf("WAL block size is %s, pg_prefaulter was built for %s", cd.WALBlockSize, units.Base2Bytes(WALPageSize))
+	}
+
+	return nil
+}
+
+// controlFileCheckpointOffset is the offset of ControlFileData.checkPoint.  The
+// fields preceding it (system_identifier, pg_control_version,
+// catalog_version_no, state, and time) have been stable since PostgreSQL 9.3.
+const controlFileCheckpointOffset = 32
+
+// ParseControlFileCheckpoint extracts the LSN of the latest checkpoint (or
+// restartpoint on a follower) from the raw contents of global/pg_control.
+//
+// FIXME: pg_control is written in the server's native byte order.  Only
+// little-endian servers are currently supported.
+func ParseControlFileCheckpoint(buf []byte) (LSN, error) {
+	if len(buf) < controlFileCheckpointOffset+8 {
+		return InvalidLSN, fmt.Errorf("pg_control too short: %d bytes", len(buf))
+	}
+
+	return LSN(binary.LittleEndian.Uint64(buf[controlFileCheckpointOffset:])), nil
+}
+
+// controlFileVersionOffset is the offset of ControlFileData.pg_control_version.
+const controlFileVersionOffset = 8
+
+// controlFileNoPrevCheckpointVersion is the first pg_control_version
+// (PostgreSQL 11) without ControlFileData.prevCheckPoint, which precedes the
+// copy of the latest checkpoint record.
+const controlFileNoPrevCheckpointVersion = 1100
+
+// ParseControlFileRedo extracts the REDO location of the latest checkpoint (or
+// restartpoint on a follower) from the raw contents of global/pg_control.  The
+// REDO location is where crash recovery would start replaying.
+//
+// FIXME: pg_control is written in the server's native byte order.  Only
+// little-endian servers are currently supported.
+func ParseControlFileRedo(buf []byte) (LSN, error) {
+	if len(buf) < controlFileVersionOffset+4 {
+		return InvalidLSN, fmt.Errorf("pg_control too short: %d bytes", len(buf))
+	}
+
+	// checkPointCopy, whose first field is the REDO location, follows
+	// checkPoint and, prior to PostgreSQL 11, prevCheckPoint.
+	offset := controlFileCheckpointOffset + 8
+	if binary.LittleEndian.Uint32(buf[controlFileVersionOffset:]) < controlFileNoPrevCheckpointVersion {
+		offset += 8
+	}
+
+	if len(buf) < offset+8 {
+		return InvalidLSN, fmt.Errorf("pg_control too short: %d bytes", len(buf))
+	}
+
+	return LSN(binary.LittleEndian.Uint64(buf[offset:])), nil
+}
+
+// ParseControlData parses the output of pg_controldata(1).
+func ParseControlData(r io.Reader) (ControlData, error) {
+	var cd ControlData
+	var found int
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		name := strings.TrimSpace(parts[0])
+		switch name {
+		case "Data page checksum version":
+			// Optional, a cluster without checksums reports zero.
+			v, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+			if err != nil {
+				return ControlData{}, errors.Wrapf(err, "unable to parse %q", name)
+			}
+			cd.DataChecksumVersion = uint32(v)
+			continue
+		case "track_commit_timestamp setting":
+			// Optional, added in PostgreSQL 9.5.
+			cd.TrackCommitTimestamp = strings.TrimSpace(parts[1]) == "on"
+			continue
+		case "Database block size",
+			"Blocks per segment of large relation",
+			"WAL block size",
+			"Bytes per WAL segment":
+		default:
+			continue
+		}
+
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return ControlData{}, errors.Wrapf(err, "unable to parse %q", name)
+		}
+
+		switch name {
+		case "Database block size":
+			cd.BlockSize = units.Base2Bytes(v)
+		case "Blocks per segment of large relation":
+			cd.BlocksPerSegment = v
+		case "WAL block size":
+			cd.WALBlockSize = units.Base2Bytes(v)
+		case "Bytes per WAL segment":
+			cd.WALSegmentSize = units.Base2Bytes(v)
+		}
+		found++
+	}
+	if err := scanner.Err(); err != nil {
+		return ControlData{}, errors.Wrap(err, "unable to read pg_controldata output")
+	}
+
+	if found != 4 {
+		return ControlData{}, fmt.Errorf("pg_controldata output incomplete: found %d of 4 fields", found)
+	}
+
+	return cd, nil
+}
+
+// QueryControlData obtains the storage geometry from a running database.
+func QueryControlData(ctx context.Context, pool *pgx.ConnPool) (ControlData, error) {
+	rows, err := pool.QueryEx(ctx, `SELECT name, setting, COALESCE(unit, '') FROM pg_catalog.pg_settings WHERE name IN ('block_size', 'data_checksums', 'segment_size', 'track_commit_timestamp', 'wal_block_size', 'wal_segment_size')`, nil)
+	if err != nil {
+		return ControlData{}, errors.Wrap(err, "unable to query storage settings")
+	}
+	defer rows.Close()
+
+	var cd ControlData
+	var found int
+	for rows.Next() {
+		var name, setting, unit string
+		if err := rows.Scan(&name, &setting, &unit); err != nil {
+			return ControlData{}, errors.Wrap(err, "unable to scan storage settings")
+		}
+
+		// data_checksums and track_commit_timestamp are booleans and do not
+		// describe the geometry.
+		switch name {
+		case "data_checksums":
+			if setting == "on" {
+				cd.DataChecksumVersion = 1
+			}
+			continue
+		case "track_commit_timestamp":
+			cd.TrackCommitTimestamp = setting == "on"
+			continue
+		}
+
+		v, err := settingBytes(setting, unit)
+		if err != nil {
+			return ControlData{}, errors.Wrapf(err, "unable to parse %s", name)
+		}
+
+		switch name {
+		case "block_size":
+			cd.BlockSize = v
+		case "segment_size":
+			// segment_size is reported in blocks, convert it back once all
+			// settings have been read.
+			cd.BlocksPerSegment = uint64(v)
+		case "wal_block_size":
+			cd.WALBlockSize = v
+		case "wal_segment_size":
+			cd.WALSegmentSize = v
+		}
+		found++
+	}
+
+	if err := rows.Err(); err != nil {
+		return ControlData{}, errors.Wrap(err, "unable to query storage settings")
+	}
+
+	if found != 4 || cd.BlockSize == 0 {
+		return ControlData{}, fmt.Errorf("storage settings incomplete: found %d of 4 settings", found)
+	}
+	cd.BlocksPerSegment /= uint64(cd.BlockSize)
+
+	return cd, nil
+}
+
+// settingBytes converts a pg_settings value and unit into bytes.
+func settingBytes(setting, unit string) (units.Base2Bytes, error) {
+	v, err := strconv.ParseUint(setting, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to parse setting")
+	}
+
+	var multiplier units.Base2Bytes = 1
+	if unit != "" {
+		// PostgreSQL's units are either a plain unit ("B", "kB", "MB") or a
+		// multiple of a unit (e.g. "8kB" or "16MB").
+		i := strings.IndexFunc(unit, func(r rune) bool { return r < '0' || r > '9' })
+		if i < 0 {
+			return 0, fmt.Errorf("unsupported unit: %q", unit)
+		}
+
+		if i > 0 {
+			n, err := strconv.ParseUint(unit[:i], 10, 64)
+			if err != nil {
+				return 0, errors.Wrapf(err, "unable to parse unit %q", unit)
+			}
+			multiplier = units.Base2Bytes(n)
+		}
+
+		switch unit[i:] {
+		case "B":
+		case "kB":
+			multiplier *= units.KiB
+		case "MB":
+			multiplier *= units.MiB
+		case "GB":
+			multiplier *= units.GiB
+		default:
+			return 0, fmt.Errorf("unsupported unit: %q", unit)
+		}
+	}
+
+	return units.Base2Bytes(v) * multiplier, nil
+}
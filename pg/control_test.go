@@ -0,0 +1,303 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseControlData(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantFail bool
+		out      ControlData
+	}{
+		{ // 0
+			in: `pg_control version number:            1300
+Database cluster state:               in archive recovery
+Maximum data alignment:               8
+Database block size:                  8192
+Blocks per segment of large relation: 131072
+WAL block size:                       8192
+Bytes per WAL segment:                16777216
+Maximum length of identifiers:        64
+`,
+			out: DefaultControlData(),
+		},
+		{ // 1
+			in: `Database block size:                  32768
+Blocks per segment of large relation: 32768
+WAL block size:                       8192
+Bytes per WAL segment:                16777216
+Data page checksum version:           1
+track_commit_timestamp setting:       on
+`,
+			out: ControlData{
+				BlockSize:            32 * units.KiB,
+				BlocksPerSegment:     32768,
+				WALBlockSize:         8 * units.KiB,
+				WALSegmentSize:       16 * units.MiB,
+				DataChecksumVersion:  1,
+				TrackCommitTimestamp: true,
+			},
+		},
+		{ // 2
+			in:       "Database block size:                  8192\n",
+			wantFail: true,
+		},
+		{ // 3
+			in:       "Database block size:                  eight\n",
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		out, err := ParseControlData(strings.NewReader(test.in))
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+
+		if diff := pretty.Compare(out, test.out); diff != "" {
+			t.Fatalf("%d: ParseControlData diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestControlData_Check(t *testing.T) {
+	large := DefaultControlData()
+	large.WALSegmentSize = 64 * units.MiB
+
+	odd := DefaultControlData()
+	odd.BlockSize = 12 * units.KiB
+
+	blcksz16 := DefaultControlData()
+	blcksz16.BlockSize = 16 * units.KiB
+	blcksz16.BlocksPerSegment = 65536
+
+	blcksz32 := DefaultControlData()
+	blcksz32.BlockSize = 32 * units.KiB
+	blcksz32.BlocksPerSegment = 32768
+
+	huge := DefaultControlData()
+	huge.BlockSize = 64 * units.KiB
+
+	tests := []struct {
+		in       ControlData
+		wantFail bool
+	}{
+		{in: DefaultControlData()},
+		{in: large, wantFail: true},
+		{in: odd, wantFail: true},
+		{in: blcksz16},
+		{in: blcksz32},
+		{in: huge, wantFail: true},
+	}
+
+	for n, test := range tests {
+		err := test.in.Check()
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+	}
+}
+
+func Test_settingBytes(t *testing.T) {
+	tests := []struct {
+		setting  string
+		unit     string
+		wantFail bool
+		out      units.Base2Bytes
+	}{
+		{setting: "8192", unit: "", out: 8 * units.KiB},
+		{setting: "16777216", unit: "B", out: 16 * units.MiB},
+		{setting: "2048", unit: "8kB", out: 16 * units.MiB},
+		{setting: "131072", unit: "8kB", out: 1 * units.GiB},
+		{setting: "1", unit: "16MB", out: 16 * units.MiB},
+		{setting: "1", unit: "s", wantFail: true},
+	}
+
+	for n, test := range tests {
+		out, err := settingBytes(test.setting, test.unit)
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+
+		if diff := pretty.Compare(out, test.out); diff != "" {
+			t.Fatalf("%d: settingBytes diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestParseControlFileCheckpoint(t *testing.T) {
+	buf := make([]byte, 40)
+	buf[32], buf[33], buf[34], buf[36] = 0x28, 0x00, 0x00, 0x01
+
+	lsn, err := ParseControlFileCheckpoint(buf)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+
+	if diff := pretty.Compare(lsn, LSN(1<<32|0x28)); diff != "" {
+		t.Fatalf("checkpoint diff: (-got +want)\n%s", diff)
+	}
+
+	if _, err := ParseControlFileCheckpoint(buf[:39]); err == nil {
+		t.Fatalf("expected failure")
+	}
+}
+
+func TestParseControlFileRedo(t *testing.T) {
+	tests := []struct {
+		version uint32
+		offset  int
+	}{
+		{ // 0: PostgreSQL 10
+			version: 1002,
+			offset:  48,
+		},
+		{ // 1: PostgreSQL 11
+			version: 1100,
+			offset:  40,
+		},
+		{ // 2: PostgreSQL 13
+			version: 1300,
+			offset:  40,
+		},
+	}
+
+	for n, test := range tests {
+		buf := make([]byte, 64)
+		binary.LittleEndian.PutUint32(buf[8:], test.version)
+		binary.LittleEndian.PutUint64(buf[test.offset:], 1<<32|0x28)
+
+		lsn, err := ParseControlFileRedo(buf)
+		if err != nil {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+
+		if diff := pretty.Compare(lsn, LSN(1<<32|0x28)); diff != "" {
+			t.Fatalf("%d: redo diff: (-got +want)\n%s", n, diff)
+		}
+
+		if _, err := ParseControlFileRedo(buf[:test.offset+7]); err == nil {
+			t.Fatalf("%d: expected failure", n)
+		}
+	}
+}
+
+func TestParseRecoveryProgress(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantFail bool
+		out      RecoveryProgress
+		time     time.Time
+		timeline TimelineID
+		position LSN
+	}{
+		{ // 0
+			in: `pg_control version number:            1300
+Database cluster state:               in archive recovery
+pg_control last modified:             Wed Jul 10 12:05:00 2019
+Latest checkpoint location:           0/5000060
+Latest checkpoint's REDO location:    0/5000028
+Latest checkpoint's REDO WAL file:    000000010000000000000005
+Latest checkpoint's TimeLineID:       1
+Time of latest checkpoint:            Wed Jul 10 12:00:00 2019
+Minimum recovery ending location:     0/7000100
+Min recovery ending loc's timeline:   1
+`,
+			out: RecoveryProgress{
+				State:                 ClusterStateArchiveRecovery,
+				RedoLSN:               0x5000028,
+				TimelineID:            1,
+				MinRecoveryLSN:        0x7000100,
+				MinRecoveryTimelineID: 1,
+			},
+			time:     time.Date(2019, time.July, 10, 12, 0, 0, 0, time.Local),
+			timeline: 1,
+			position: 0x7000100,
+		},
+		{ // 1: minimum recovery point unset
+			in: `Database cluster state:               in production
+Latest checkpoint's REDO location:    1/28
+Latest checkpoint's TimeLineID:       2
+Time of latest checkpoint:            Thu Jan  2 03:04:05 2020
+Minimum recovery ending location:     0/0
+Min recovery ending loc's timeline:   0
+`,
+			out: RecoveryProgress{
+				State:          ClusterStateProduction,
+				RedoLSN:        0x100000028,
+				TimelineID:     2,
+				MinRecoveryLSN: InvalidLSN,
+			},
+			time:     time.Date(2020, time.January, 2, 3, 4, 5, 0, time.Local),
+			timeline: 2,
+			position: 0x100000028,
+		},
+		{ // 2
+			in:       "Database cluster state:               in archive recovery\n",
+			wantFail: true,
+		},
+		{ // 3
+			in: `Database cluster state:               in archive recovery
+Latest checkpoint's REDO location:    0/5000028
+Latest checkpoint's TimeLineID:       1
+Time of latest checkpoint:            yesterday
+`,
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		out, err := ParseRecoveryProgress(strings.NewReader(test.in))
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+		if test.wantFail {
+			continue
+		}
+
+		if !out.CheckpointTime.Equal(test.time) {
+			t.Fatalf("%d: checkpoint time %v, want %v", n, out.CheckpointTime, test.time)
+		}
+		out.CheckpointTime = time.Time{}
+
+		if diff := pretty.Compare(out, test.out); diff != "" {
+			t.Fatalf("%d: ParseRecoveryProgress diff: (-got +want)\n%s", n, diff)
+		}
+
+		if timeline, position := out.Position(); timeline != test.timeline || position != test.position {
+			t.Fatalf("%d: position %d/%s, want %d/%s", n, timeline, position, test.timeline, test.position)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// Index identifies the files of a B-tree index and its size.
+type Index struct {
+	Tablespace OID
+	Relation   OID
+	Blocks     HeapBlockNumber
+}
+
+// queryIndexes returns the valid B-tree indexes of the relation stored in
+// tablespace/relfilenode.  pg_filenode_relation() only resolves relations in
+// the connected database, so nothing is returned for other databases.
+const queryIndexes = `SELECT COALESCE(NULLIF(i.reltablespace, 0), d.dattablespace), pg_catalog.pg_relation_filenode(i.oid), pg_catalog.pg_relation_size(i.oid) / pg_catalog.current_setting('block_size')::int8
+FROM pg_catalog.pg_index x
+JOIN pg_catalog.pg_class i ON i.oid = x.indexrelid
+JOIN pg_catalog.pg_am am ON am.oid = i.relam
+JOIN pg_catalog.pg_database d ON d.datname = pg_catalog.current_database()
+WHERE d.oid = $1 AND x.indrelid = pg_catalog.pg_filenode_relation($2, $3) AND x.indisvalid AND am.amname = 'btree'`
+
+// QueryIndexes queries the catalog for the B-tree indexes of the relation
+// identified by its tablespace, database, and relfilenode.  Requires
+// PostgreSQL 9.4 or newer.
+func QueryIndexes(ctx context.Context, pool *pgx.ConnPool, tablespace, database, relation OID) ([]Index, error) {
+	rows, err := pool.QueryEx(ctx, queryIndexes, nil, uint32(database), uint32(tablespace), uint32(relation))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query indexes")
+	}
+	defer rows.Close()
+
+	var indexes []Index
+	for rows.Next() {
+		var spcNode, relNode uint32
+		var blocks int64
+		if err := rows.Scan(&spcNode, &relNode, &blocks); err != nil {
+			return nil, errors.Wrap(err, "unable to scan indexes")
+		}
+
+		if blocks <= 0 {
+			continue
+		}
+
+		indexes = append(indexes, Index{
+			Tablespace: OID(spcNode),
+			Relation:   OID(relNode),
+			Blocks:     HeapBlockNumber(blocks),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to query indexes")
+	}
+
+	return indexes, nil
+}
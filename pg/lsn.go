@@ -145,6 +145,14 @@ func (lsn LSN) ByteOffset() WALByteOffset {
 	return WALByteOffset(uint64(lsn) % uint64(WALSegmentSize))
 }
 
+// IsSegmentBoundary returns true if the LSN refers to the first byte of a WAL
+// segment.  Replay positions land on a segment boundary after an XLOG_SWITCH
+// (or when a record ends exactly at the end of a segment), in which case the
+// next record will be read from the following segment.
+func (lsn LSN) IsSegmentBoundary() bool {
+	return lsn.ByteOffset() == 0
+}
+
 // Readahead returns all of the anticipated WAL filenames that will be present
 // in the future based on the lsn and the readahead.
 func (lsn LSN) Readahead(timelineID TimelineID, maxBytes units.Base2Bytes) WALFiles {
@@ -0,0 +1,52 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import "github.com/alecthomas/units"
+
+type (
+	// MultiXactID is a 32 bit multixact ID.
+	MultiXactID uint32
+
+	// MultiXactOffset is a 32 bit offset into the multixact members SLRU.
+	MultiXactOffset uint32
+)
+
+const (
+	// MultiXactOffsetsDirectory and MultiXactMembersDirectory are the names of
+	// the multixact SLRU directories in PGDATA.
+	MultiXactOffsetsDirectory = "pg_multixact/offsets"
+	MultiXactMembersDirectory = "pg_multixact/members"
+
+	// multiXactOffsetSize is the size of an entry in the offsets SLRU.
+	multiXactOffsetSize = 4
+
+	// Members are stored in groups of four transaction IDs preceded by one flag
+	// byte per member.  Groups never span pages.
+	multiXactMembersPerGroup = 4
+	multiXactMemberGroupSize = 4*multiXactMembersPerGroup + multiXactMembersPerGroup
+)
+
+// MultiXactOffsetPage returns the page of the offsets SLRU containing mxid's
+// starting offset.
+func MultiXactOffsetPage(mxid MultiXactID, blockSize units.Base2Bytes) HeapBlockNumber {
+	return HeapBlockNumber(uint64(mxid) / (uint64(blockSize) / multiXactOffsetSize))
+}
+
+// MultiXactMemberPage returns the page of the members SLRU containing the
+// member at offset.
+func MultiXactMemberPage(offset MultiXactOffset, blockSize units.Base2Bytes) HeapBlockNumber {
+	membersPerPage := (uint64(blockSize) / multiXactMemberGroupSize) * multiXactMembersPerGroup
+	return HeapBlockNumber(uint64(offset) / membersPerPage)
+}
@@ -0,0 +1,50 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestMultiXactPages(t *testing.T) {
+	tests := []struct {
+		mxid       pg.MultiXactID
+		offset     pg.MultiXactOffset
+		offsetPage pg.HeapBlockNumber
+		memberPage pg.HeapBlockNumber
+	}{
+		{mxid: 1, offset: 1, offsetPage: 0, memberPage: 0},
+		{mxid: 2047, offset: 1635, offsetPage: 0, memberPage: 0},
+		{mxid: 2048, offset: 1636, offsetPage: 1, memberPage: 1},
+		{mxid: math.MaxUint32, offset: math.MaxUint32, offsetPage: 2097151, memberPage: 2625285},
+	}
+
+	for n, test := range tests {
+		if page := pg.MultiXactOffsetPage(test.mxid, pg.HeapPageSize); page != test.offsetPage {
+			t.Fatalf("%d: offset page: got %d, want %d", n, page, test.offsetPage)
+		}
+
+		if page := pg.MultiXactMemberPage(test.offset, pg.HeapPageSize); page != test.memberPage {
+			t.Fatalf("%d: member page: got %d, want %d", n, page, test.memberPage)
+		}
+	}
+
+	// Segment filenames of the members SLRU outgrow four hex digits
+	if filename := pg.SLRUSegmentFilename(2625285); filename != "14078" {
+		t.Fatalf("bad members segment filename: %q", filename)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Values of pg_controldata(1)'s "Database cluster state".
+const (
+	ClusterStateArchiveRecovery    = "in archive recovery"
+	ClusterStateCrashRecovery      = "in crash recovery"
+	ClusterStateProduction         = "in production"
+	ClusterStateShutdownInRecovery = "shut down in recovery"
+)
+
+// controlDataTimeLayout is the format of the timestamps printed by
+// pg_controldata(1) in the C locale (strftime(3)'s "%c").  Timestamps are in
+// the local time zone.
+const controlDataTimeLayout = "Mon Jan _2 15:04:05 2006"
+
+// RecoveryProgress is the progress of recovery as recorded in pg_control.
+// pg_control is updated at every restartpoint during archive recovery, so
+// RecoveryProgress trails the startup process by up to a checkpoint interval.
+type RecoveryProgress struct {
+	// State is the cluster's state (e.g. ClusterStateArchiveRecovery).
+	State string
+
+	// CheckpointTime is the time of the latest checkpoint record replayed.
+	CheckpointTime time.Time
+
+	// RedoLSN and TimelineID locate the REDO record of the latest checkpoint.
+	RedoLSN    LSN
+	TimelineID TimelineID
+
+	// MinRecoveryLSN is the minimum LSN recovery must reach before the cluster
+	// is consistent, or InvalidLSN if it hasn't been set.
+	MinRecoveryLSN        LSN
+	MinRecoveryTimelineID TimelineID
+}
+
+// InRecovery returns true if the cluster is performing recovery.
+func (p RecoveryProgress) InRecovery() bool {
+	return p.State == ClusterStateArchiveRecovery || p.State == ClusterStateCrashRecovery
+}
+
+// Position returns the furthest point recovery is known to have reached.
+func (p RecoveryProgress) Position() (TimelineID, LSN) {
+	if p.MinRecoveryLSN != InvalidLSN && p.MinRecoveryTimelineID != 0 && p.MinRecoveryLSN > p.RedoLSN {
+		return p.MinRecoveryTimelineID, p.MinRecoveryLSN
+	}
+
+	return p.TimelineID, p.RedoLSN
+}
+
+// ParseRecoveryProgress parses the output of pg_controldata(1).
+func ParseRecoveryProgress(r io.Reader) (RecoveryProgress, error) {
+	p := RecoveryProgress{
+		RedoLSN:        InvalidLSN,
+		MinRecoveryLSN: InvalidLSN,
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var err error
+		switch name {
+		case "Database cluster state":
+			p.State = value
+		case "Time of latest checkpoint":
+			p.CheckpointTime, err = time.ParseInLocation(controlDataTimeLayout, value, time.Local)
+		case "Latest checkpoint's REDO location":
+			p.RedoLSN, err = ParseLSN(value)
+		case "Latest checkpoint's TimeLineID":
+			p.TimelineID, err = parseTimelineID(value)
+		case "Minimum recovery ending location":
+			p.MinRecoveryLSN, err = ParseLSN(value)
+		case "Min recovery ending loc's timeline":
+			p.MinRecoveryTimelineID, err = parseTimelineID(value)
+		}
+		if err != nil {
+			return RecoveryProgress{}, errors.Wrapf(err, "unable to parse %q", name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return RecoveryProgress{}, errors.Wrap(err, "unable to read pg_controldata output")
+	}
+
+	if p.State == "" || p.RedoLSN == InvalidLSN || p.TimelineID == 0 {
+		return RecoveryProgress{}, fmt.Errorf("pg_controldata output incomplete")
+	}
+
+	// An unset minimum recovery point is reported as 0/0.
+	if p.MinRecoveryLSN == 0 {
+		p.MinRecoveryLSN = InvalidLSN
+	}
+
+	return p, nil
+}
+
+func parseTimelineID(s string) (TimelineID, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return TimelineID(v), nil
+}
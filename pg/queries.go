@@ -0,0 +1,197 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// queryShape is the number of parameters a query is passed and the number of
+// columns the agent scans from its rows.
+type queryShape struct {
+	params  int
+	columns int
+}
+
+// queryShapes holds the shape of each query, keyed by the name used by query
+// overrides.
+var queryShapes = map[string]queryShape{
+	"oldest-lsns":       {params: 0, columns: 3},
+	"lag-primary":       {params: 0, columns: 6},
+	"lag-follower":      {params: 0, columns: 6},
+	"lag-upstream":      {params: 1, columns: 6},
+	"lag-cascade":       {params: 1, columns: 6},
+	"upstream-position": {params: 0, columns: 2},
+	"recovery-state":    {params: 0, columns: 7},
+	"replication-slots": {params: 0, columns: 7},
+	"wal-retention":     {params: 0, columns: 3},
+	"wal-receiver":      {params: 0, columns: 4},
+	"role":              {params: 0, columns: 1},
+}
+
+// placeholderRE matches a named placeholder, e.g. "{{lsn}}", in a query
+// override.
+var placeholderRE = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+
+// placeholder returns the value of a named placeholder, e.g. "{{wal}}" is
+// "xlog" prior to PostgreSQL 10 and "wal" after, so one override can serve
+// every version.
+func (t WALTranslations) placeholder(name string) (string, bool) {
+	switch name {
+	case "lsn":
+		return t.Lsn, true
+	case "wal":
+		return t.Wal, true
+	default:
+		return "", false
+	}
+}
+
+// expand replaces the placeholders in sql.  Unknown placeholders are left
+// as-is; ValidateQueryOverrides rejects them.
+func (t WALTranslations) expand(sql string) string {
+	return placeholderRE.ReplaceAllStringFunc(sql, func(m string) string {
+		if v, found := t.placeholder(placeholderRE.FindStringSubmatch(m)[1]); found {
+			return v
+		}
+		return m
+	})
+}
+
+// names maps the name of each query, as used by query overrides, to the query.
+func (q *WALQueries) names() map[string]*string {
+	return map[string]*string{
+		"oldest-lsns":       &q.OldestLSNs,
+		"lag-primary":       &q.LagPrimary,
+		"lag-follower":      &q.LagFollower,
+		"lag-upstream":      &q.LagUpstream,
+		"lag-cascade":       &q.LagCascade,
+		"upstream-position": &q.UpstreamPosition,
+		"recovery-state":    &q.RecoveryState,
+		"replication-slots": &q.ReplicationSlots,
+		"wal-retention":     &q.WALRetention,
+		"wal-receiver":      &q.WALReceiver,
+		"role":              &q.Role,
+	}
+}
+
+// Override replaces the queries in t with overrides, keyed by query name, after
+// expanding their placeholders.
+func (t *WALTranslations) Override(overrides map[string]string) {
+	names := t.Queries.names()
+	for name, sql := range overrides {
+		if query, found := names[name]; found {
+			*query = t.expand(sql)
+		}
+	}
+}
+
+// ValidateQueryOverrides checks that overrides only replace known queries, are
+// not empty, and only use known placeholders.
+func ValidateQueryOverrides(overrides map[string]string) error {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, found := queryShapes[name]; !found {
+			valid := make([]string, 0, len(queryShapes))
+			for n := range queryShapes {
+				valid = append(valid, n)
+			}
+			sort.Strings(valid)
+			return fmt.Errorf("unknown query %q, expected one of %s", name, strings.Join(valid, ", "))
+		}
+
+		sql := overrides[name]
+		if strings.TrimSpace(sql) == "" {
+			return fmt.Errorf("query %q is empty", name)
+		}
+
+		for _, m := range placeholderRE.FindAllStringSubmatch(sql, -1) {
+			if _, found := (WALTranslations{}).placeholder(m[1]); !found {
+				return fmt.Errorf("unknown placeholder %q in query %q, expected {{lsn}} or {{wal}}", m[0], name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadQueryOverrides reads the queries in dir that replace the queries
+// generated by Translate.  Each file is named after the query it replaces,
+// e.g. "lag-follower.sql".  Files without a ".sql" extension are ignored.
+func ReadQueryOverrides(dir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list query overrides")
+	}
+
+	overrides := make(map[string]string)
+	for _, fi := range files {
+		if fi.IsDir() || path.Ext(fi.Name()) != ".sql" {
+			continue
+		}
+
+		sql, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read query override")
+		}
+		overrides[strings.TrimSuffix(fi.Name(), ".sql")] = string(sql)
+	}
+
+	if err := ValidateQueryOverrides(overrides); err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+// CheckQueryOverrides prepares each override, as expanded for the server that
+// conn is connected to, and checks that it is passed the parameters and returns
+// the columns the agent expects.  Overrides are not executed.
+func CheckQueryOverrides(ctx context.Context, conn *pgx.Conn, translations WALTranslations, overrides map[string]string) error {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		shape := queryShapes[name]
+		ps, err := conn.PrepareEx(ctx, "", translations.expand(overrides[name]), nil)
+		if err != nil {
+			return errors.Wrapf(err, "invalid query %q", name)
+		}
+		if len(ps.ParameterOIDs) != shape.params {
+			return fmt.Errorf("query %q takes %d parameters, expected %d", name, len(ps.ParameterOIDs), shape.params)
+		}
+		if len(ps.FieldDescriptions) != shape.columns {
+			return fmt.Errorf("query %q returns %d columns, expected %d", name, len(ps.FieldDescriptions), shape.columns)
+		}
+	}
+
+	return nil
+}
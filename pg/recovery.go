@@ -0,0 +1,68 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// RecoveryConflicts is the number of queries cancelled on a follower due to
+// conflicts with recovery, summed across all databases.  See
+// pg_stat_database_conflicts.
+type RecoveryConflicts struct {
+	Tablespace int64 `json:"tablespace"`
+	Lock       int64 `json:"lock"`
+	Snapshot   int64 `json:"snapshot"`
+	BufferPin  int64 `json:"bufferpin"`
+	Deadlock   int64 `json:"deadlock"`
+}
+
+// RecoveryState is a follower's replay state.
+type RecoveryState struct {
+	// ReplayPaused is true when replay has been paused (e.g. via
+	// pg_wal_replay_pause()).
+	ReplayPaused bool
+
+	// ReplayLSN is the LSN of the last record replayed, or InvalidLSN if no
+	// record has been replayed.
+	ReplayLSN LSN
+
+	Conflicts RecoveryConflicts
+}
+
+// QueryRecoveryState queries a follower for its replay state.
+func QueryRecoveryState(ctx context.Context, pool *pgx.ConnPool, walTranslations *WALTranslations) (RecoveryState, error) {
+	var rs RecoveryState
+	var replayLocation *string
+	c := &rs.Conflicts
+	err := pool.QueryRowEx(ctx, walTranslations.Queries.RecoveryState, nil).
+		Scan(&rs.ReplayPaused, &replayLocation, &c.Tablespace, &c.Lock, &c.Snapshot, &c.BufferPin, &c.Deadlock)
+	if err != nil {
+		return RecoveryState{}, errors.Wrap(err, "unable to query recovery state")
+	}
+
+	rs.ReplayLSN = InvalidLSN
+	if replayLocation != nil {
+		lsn, err := ParseLSN(*replayLocation)
+		if err != nil {
+			return RecoveryState{}, errors.Wrap(err, "unable to parse replay LSN")
+		}
+		rs.ReplayLSN = lsn
+	}
+
+	return rs, nil
+}
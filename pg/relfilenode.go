@@ -0,0 +1,81 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultTablespaceOID is the OID of pg_default, whose relations live in
+	// base/.
+	DefaultTablespaceOID OID = 1663
+
+	// GlobalTablespaceOID is the OID of pg_global, whose shared relations live
+	// in global/.
+	GlobalTablespaceOID OID = 1664
+)
+
+// RelFileNode identifies the files of a relation.  VACUUM FULL, CLUSTER, and
+// TRUNCATE give a relation a new RelFileNode and drop the files of the old
+// one.
+type RelFileNode struct {
+	Tablespace OID
+	Database   OID
+	Relation   OID
+}
+
+// ParseRelPath parses the path, relative to PGDATA, of a relation's main fork
+// as printed by pg_waldump(1), e.g. "base/16384/16385", "global/1262", or
+// "pg_tblspc/16400/PG_11_201809051/16384/16385".
+func ParseRelPath(relPath string) (RelFileNode, error) {
+	parts := strings.Split(relPath, "/")
+
+	var rfn RelFileNode
+	var oids []string
+	switch {
+	case len(parts) == 3 && parts[0] == "base":
+		rfn.Tablespace = DefaultTablespaceOID
+		oids = parts[1:]
+	case len(parts) == 2 && parts[0] == "global":
+		rfn.Tablespace = GlobalTablespaceOID
+		oids = []string{"0", parts[1]}
+	case len(parts) == 5 && parts[0] == "pg_tblspc":
+		tablespace, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return RelFileNode{}, fmt.Errorf("invalid tablespace in relation path %q", relPath)
+		}
+		rfn.Tablespace = OID(tablespace)
+		oids = parts[3:]
+	default:
+		return RelFileNode{}, fmt.Errorf("unrecognized relation path %q", relPath)
+	}
+
+	database, err := strconv.ParseUint(oids[0], 10, 32)
+	if err != nil {
+		return RelFileNode{}, fmt.Errorf("invalid database in relation path %q", relPath)
+	}
+	rfn.Database = OID(database)
+
+	// Only the main fork is named without a suffix, e.g. "16385_fsm".
+	relation, err := strconv.ParseUint(oids[1], 10, 32)
+	if err != nil {
+		return RelFileNode{}, fmt.Errorf("invalid relation in relation path %q", relPath)
+	}
+	rfn.Relation = OID(relation)
+
+	return rfn, nil
+}
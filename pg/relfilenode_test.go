@@ -0,0 +1,70 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseRelPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want pg.RelFileNode
+		fail bool
+	}{
+		{ // 0
+			path: "base/16384/16385",
+			want: pg.RelFileNode{Tablespace: 1663, Database: 16384, Relation: 16385},
+		},
+		{ // 1
+			path: "global/1262",
+			want: pg.RelFileNode{Tablespace: 1664, Database: 0, Relation: 1262},
+		},
+		{ // 2
+			path: "pg_tblspc/16400/PG_11_201809051/16384/16401",
+			want: pg.RelFileNode{Tablespace: 16400, Database: 16384, Relation: 16401},
+		},
+		{ // 3
+			path: "base/16384/16385_fsm",
+			fail: true,
+		},
+		{ // 4
+			path: "base/16384",
+			fail: true,
+		},
+		{ // 5
+			path: "pg_xact/0000",
+			fail: true,
+		},
+	}
+
+	for n, test := range tests {
+		got, err := pg.ParseRelPath(test.path)
+		if test.fail {
+			if err == nil {
+				t.Fatalf("%d: parsed %q", n, test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unable to parse %q: %v", n, test.path, err)
+		}
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Fatalf("%d: diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
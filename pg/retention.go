@@ -0,0 +1,72 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/alecthomas/units"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// UnlimitedWALKeepSize is the max_slot_wal_keep_size of an upstream whose
+// replication slots retain WAL without limit, as is always the case prior to
+// PostgreSQL 13.
+const UnlimitedWALKeepSize = units.Base2Bytes(-1)
+
+// WALRetention is how much WAL an upstream keeps for its followers.
+type WALRetention struct {
+	// KeepSize is the WAL kept for followers without a replication slot, i.e.
+	// wal_keep_size, or wal_keep_segments prior to PostgreSQL 13.  The upstream
+	// may keep more until its next checkpoint.
+	KeepSize units.Base2Bytes
+
+	// MaxSlotKeepSize is the most WAL a replication slot may retain, i.e.
+	// max_slot_wal_keep_size, or UnlimitedWALKeepSize.
+	MaxSlotKeepSize units.Base2Bytes
+
+	// MaxWALSize is the upstream's max_wal_size, or 0 if it has none (prior to
+	// PostgreSQL 9.5).  The WAL since the upstream's last checkpoint is kept
+	// regardless of KeepSize and MaxSlotKeepSize, and a checkpoint is
+	// triggered at the latest once max_wal_size of WAL has been written.
+	MaxWALSize units.Base2Bytes
+
+	// Position is the newest LSN the upstream can send.
+	Position LSN
+}
+
+// QueryWALRetention queries pool for the WAL it keeps for its followers.
+func QueryWALRetention(ctx context.Context, pool *pgx.ConnPool, walTranslations *WALTranslations) (WALRetention, error) {
+	var keepSize, maxSlotKeepSize, maxWALSize int64
+	var position *string
+	if err := pool.QueryRowEx(ctx, walTranslations.Queries.WALRetention, nil).Scan(&keepSize, &maxSlotKeepSize, &maxWALSize, &position); err != nil {
+		return WALRetention{}, errors.Wrap(err, "unable to query WAL retention")
+	}
+
+	r := WALRetention{
+		KeepSize:        units.Base2Bytes(keepSize),
+		MaxSlotKeepSize: units.Base2Bytes(maxSlotKeepSize),
+		MaxWALSize:      units.Base2Bytes(maxWALSize),
+		Position:        InvalidLSN,
+	}
+	if position != nil {
+		var err error
+		if r.Position, err = ParseLSN(*position); err != nil {
+			return WALRetention{}, errors.Wrap(err, "unable to parse upstream position")
+		}
+	}
+
+	return r, nil
+}
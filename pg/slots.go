@@ -0,0 +1,101 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/alecthomas/units"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// Values of pg_replication_slots.wal_status (PostgreSQL 13+).
+const (
+	SlotWALReserved    = "reserved"
+	SlotWALExtended    = "extended"
+	SlotWALUnreserved  = "unreserved"
+	SlotWALLost        = "lost"
+	UnknownSafeWALSize = units.Base2Bytes(-1)
+)
+
+// ReplicationSlot is a row of pg_replication_slots.
+type ReplicationSlot struct {
+	Name   string
+	Type   string
+	Active bool
+
+	// RestartLSN is the oldest LSN retained for the slot, or InvalidLSN if the
+	// slot has never reserved WAL.
+	RestartLSN LSN
+
+	// WALStatus and SafeWALSize describe the slot's retention relative to
+	// max_slot_wal_keep_size.  Prior to PostgreSQL 13 WALStatus is empty and
+	// SafeWALSize is UnknownSafeWALSize, as is SafeWALSize when retention is
+	// unlimited.
+	WALStatus   string
+	SafeWALSize units.Base2Bytes
+}
+
+// Lag returns the amount of WAL between the slot's restart LSN and position,
+// or zero if either is unknown.
+func (s ReplicationSlot) Lag(position LSN) units.Base2Bytes {
+	if s.RestartLSN == InvalidLSN || position == InvalidLSN || position <= s.RestartLSN {
+		return 0
+	}
+
+	return units.Base2Bytes(position - s.RestartLSN)
+}
+
+// QueryReplicationSlots queries pool for its replication slots and the newest
+// LSN it can send.
+func QueryReplicationSlots(ctx context.Context, pool *pgx.ConnPool, walTranslations *WALTranslations) (slots []ReplicationSlot, position LSN, err error) {
+	rows, err := pool.QueryEx(ctx, walTranslations.Queries.ReplicationSlots, nil)
+	if err != nil {
+		return nil, InvalidLSN, errors.Wrap(err, "unable to query replication slots")
+	}
+	defer rows.Close()
+
+	position = InvalidLSN
+	for rows.Next() {
+		var slot ReplicationSlot
+		var restartLSN, currentLSN *string
+		var safeWALSize int64
+		if err := rows.Scan(&slot.Name, &slot.Type, &slot.Active, &restartLSN, &slot.WALStatus, &safeWALSize, &currentLSN); err != nil {
+			return nil, InvalidLSN, errors.Wrap(err, "unable to scan replication slots")
+		}
+		slot.SafeWALSize = units.Base2Bytes(safeWALSize)
+
+		slot.RestartLSN = InvalidLSN
+		if restartLSN != nil {
+			if slot.RestartLSN, err = ParseLSN(*restartLSN); err != nil {
+				return nil, InvalidLSN, errors.Wrap(err, "unable to parse restart LSN")
+			}
+		}
+
+		if currentLSN != nil {
+			if position, err = ParseLSN(*currentLSN); err != nil {
+				return nil, InvalidLSN, errors.Wrap(err, "unable to parse current LSN")
+			}
+		}
+
+		slots = append(slots, slot)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, InvalidLSN, errors.Wrap(err, "unable to query replication slots")
+	}
+
+	return slots, position, nil
+}
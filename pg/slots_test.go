@@ -0,0 +1,41 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestReplicationSlotLag(t *testing.T) {
+	tests := []struct {
+		restart  pg.LSN
+		position pg.LSN
+		lag      units.Base2Bytes
+	}{
+		{restart: pg.MustParseLSN("0/3000000"), position: pg.MustParseLSN("0/5000000"), lag: 0x2000000},
+		{restart: pg.MustParseLSN("0/5000000"), position: pg.MustParseLSN("0/5000000"), lag: 0},
+		{restart: pg.MustParseLSN("0/5000000"), position: pg.InvalidLSN, lag: 0},
+		{restart: pg.InvalidLSN, position: pg.MustParseLSN("0/5000000"), lag: 0},
+	}
+
+	for n, test := range tests {
+		slot := pg.ReplicationSlot{Name: "replica1", RestartLSN: test.restart}
+		if lag := slot.Lag(test.position); lag != test.lag {
+			t.Fatalf("%d: lag %d, want %d", n, lag, test.lag)
+		}
+	}
+}
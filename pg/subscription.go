@@ -0,0 +1,126 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// Subscription is a logical replication subscription's apply worker as
+// reported by pg_stat_subscription.
+type Subscription struct {
+	OID  OID
+	Name string
+
+	// ReceivedLSN is the last LSN received from the publisher, or InvalidLSN if
+	// the apply worker isn't running.
+	ReceivedLSN LSN
+}
+
+// SubscriptionTable identifies the files of a table replicated by a
+// subscription and its size.
+type SubscriptionTable struct {
+	Tablespace OID
+	Database   OID
+	Relation   OID
+	Blocks     HeapBlockNumber
+}
+
+// querySubscriptions returns the apply workers of the subscriptions in the
+// connected database.  Table synchronization workers have a relid and are
+// excluded.
+const querySubscriptions = `SELECT s.subid, s.subname::TEXT, s.received_lsn::TEXT
+FROM pg_catalog.pg_stat_subscription s
+JOIN pg_catalog.pg_database d ON d.datname = pg_catalog.current_database()
+JOIN pg_catalog.pg_subscription sub ON sub.oid = s.subid
+WHERE s.relid IS NULL AND sub.subdbid = d.oid
+ORDER BY s.subid`
+
+// querySubscriptionTables returns the tables of subscription $1 whose initial
+// synchronization has completed.
+const querySubscriptionTables = `SELECT COALESCE(NULLIF(c.reltablespace, 0), d.dattablespace), d.oid, pg_catalog.pg_relation_filenode(c.oid), pg_catalog.pg_relation_size(c.oid) / pg_catalog.current_setting('block_size')::int8
+FROM pg_catalog.pg_subscription_rel sr
+JOIN pg_catalog.pg_class c ON c.oid = sr.srrelid
+JOIN pg_catalog.pg_database d ON d.datname = pg_catalog.current_database()
+WHERE sr.srsubid = $1 AND sr.srsubstate IN ('s', 'r')`
+
+// QuerySubscriptions queries a subscriber for the logical replication
+// subscriptions of the connected database.  Requires PostgreSQL 10 or newer.
+func QuerySubscriptions(ctx context.Context, pool *pgx.ConnPool) ([]Subscription, error) {
+	rows, err := pool.QueryEx(ctx, querySubscriptions, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query subscriptions")
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var subID uint32
+		var receivedLSN *string
+		sub := Subscription{ReceivedLSN: InvalidLSN}
+		if err := rows.Scan(&subID, &sub.Name, &receivedLSN); err != nil {
+			return nil, errors.Wrap(err, "unable to scan subscriptions")
+		}
+		sub.OID = OID(subID)
+
+		if receivedLSN != nil {
+			if sub.ReceivedLSN, err = ParseLSN(*receivedLSN); err != nil {
+				return nil, errors.Wrap(err, "unable to parse received LSN")
+			}
+		}
+
+		subs = append(subs, sub)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to query subscriptions")
+	}
+
+	return subs, nil
+}
+
+// QuerySubscriptionTables queries a subscriber for the tables replicated by
+// subscription subID.
+func QuerySubscriptionTables(ctx context.Context, pool *pgx.ConnPool, subID OID) ([]SubscriptionTable, error) {
+	rows, err := pool.QueryEx(ctx, querySubscriptionTables, nil, uint32(subID))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query subscription tables")
+	}
+	defer rows.Close()
+
+	var tables []SubscriptionTable
+	for rows.Next() {
+		var spcNode, dbNode, relNode uint32
+		var blocks int64
+		if err := rows.Scan(&spcNode, &dbNode, &relNode, &blocks); err != nil {
+			return nil, errors.Wrap(err, "unable to scan subscription tables")
+		}
+
+		tables = append(tables, SubscriptionTable{
+			Tablespace: OID(spcNode),
+			Database:   OID(dbNode),
+			Relation:   OID(relNode),
+			Blocks:     HeapBlockNumber(blocks),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to query subscription tables")
+	}
+
+	return tables, nil
+}
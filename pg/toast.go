@@ -0,0 +1,58 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// Toast identifies the files of a relation's TOAST table and its size.
+type Toast struct {
+	Tablespace OID
+	Relation   OID
+	Blocks     HeapBlockNumber
+}
+
+// queryToast returns the TOAST table of the relation stored in
+// tablespace/relfilenode.  As with queryIndexes, only relations in the
+// connected database are resolved.
+const queryToast = `SELECT COALESCE(NULLIF(t.reltablespace, 0), d.dattablespace), pg_catalog.pg_relation_filenode(t.oid), pg_catalog.pg_relation_size(t.oid) / pg_catalog.current_setting('block_size')::int8
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_class t ON t.oid = c.reltoastrelid
+JOIN pg_catalog.pg_database d ON d.datname = pg_catalog.current_database()
+WHERE d.oid = $1 AND c.oid = pg_catalog.pg_filenode_relation($2, $3)`
+
+// QueryToast queries the catalog for the TOAST table of the relation
+// identified by its tablespace, database, and relfilenode.  found is false if
+// the relation has no TOAST table or can't be resolved.  Requires PostgreSQL
+// 9.4 or newer.
+func QueryToast(ctx context.Context, pool *pgx.ConnPool, tablespace, database, relation OID) (toast Toast, found bool, err error) {
+	var spcNode, relNode uint32
+	var blocks int64
+	switch err := pool.QueryRowEx(ctx, queryToast, nil, uint32(database), uint32(tablespace), uint32(relation)).Scan(&spcNode, &relNode, &blocks); {
+	case err == pgx.ErrNoRows:
+		return Toast{}, false, nil
+	case err != nil:
+		return Toast{}, false, errors.Wrap(err, "unable to query TOAST table")
+	}
+
+	return Toast{
+		Tablespace: OID(spcNode),
+		Relation:   OID(relNode),
+		Blocks:     HeapBlockNumber(blocks),
+	}, true, nil
+}
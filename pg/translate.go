@@ -15,8 +15,36 @@ package pg
 
 import (
 	"fmt"
+	"os"
+	"path"
 )
 
+const (
+	// WALDirectory and XLogDirectory are the names of the WAL directory in
+	// PGDATA as of PostgreSQL 10 and prior to PostgreSQL 10, respectively.
+	WALDirectory  = "pg_wal"
+	XLogDirectory = "pg_xlog"
+)
+
+// OldestVersion and LatestVersion are the oldest and newest major versions of
+// PostgreSQL whose WAL, as decoded by pg_waldump(1) or pg_xlogdump(1), is known
+// to be understood.
+const (
+	OldestVersion uint64 = 90600  // PostgreSQL version 9.6
+	LatestVersion uint64 = 160000 // PostgreSQL version 16
+)
+
+// SupportedVersions returns the major versions from OldestVersion through
+// LatestVersion, oldest first, in the format of server_version_num.
+func SupportedVersions() []uint64 {
+	versions := []uint64{OldestVersion}
+	for v := uint64(100000); v <= LatestVersion; v += 10000 {
+		versions = append(versions, v)
+	}
+
+	return versions
+}
+
 type WALTranslations struct {
 	Major     uint64
 	Directory string
@@ -29,11 +57,45 @@ type WALQueries struct {
 	OldestLSNs  string
 	LagPrimary  string
 	LagFollower string
+	LagUpstream string
+	LagCascade  string
+
+	// UpstreamPosition is run against a follower's upstream and reports
+	// whether the upstream is itself in recovery along with the newest LSN the
+	// upstream can send.
+	UpstreamPosition string
+
+	// RecoveryState reports a follower's replay-pause state, replay LSN, and
+	// recovery conflicts summed across all databases.
+	RecoveryState string
+
+	// ReplicationSlots reports the replication slots of an upstream along with
+	// the newest LSN the upstream can send.
+	ReplicationSlots string
+
+	// WALRetention is run against a follower's upstream and reports how much
+	// WAL the upstream keeps for followers without a replication slot
+	// (wal_keep_size) and for replication slots (max_slot_wal_keep_size, -1 if
+	// unlimited), and its max_wal_size (0 if it has none), in bytes, along with
+	// the newest LSN the upstream can send.
+	WALRetention string
+
+	// WALReceiver reports a follower's WAL receiver status, written and flushed
+	// LSNs, and replay LSN.  WALReceiver is empty prior to PostgreSQL 10.
+	WALReceiver string
+
+	// Role reports whether the server is in recovery, i.e. a follower.  Role is
+	// used to detect the server's role in the "auto" mode.
+	Role string
 }
 
-func Translate(pgMajor uint64) WALTranslations {
+// Translate generates the translations and queries for a server whose version,
+// in the format of server_version_num (e.g. 130004), is pgVersion.  A major
+// version, e.g. as read from PG_VERSION, is also accepted.
+func Translate(pgVersion uint64) WALTranslations {
 	var translations WALTranslations
 	var translateHorizon uint64 = 100000 // PostgreSQL version 10
+	var pg13Horizon uint64 = 130000      // PostgreSQL version 13
 
 	var lagPrimaryFmt = `SELECT
 	    state,
@@ -47,6 +109,20 @@ func Translate(pgMajor uint64) WALTranslations {
 	    ORDER BY visibility_lag_bytes
 	    LIMIT 1`
 
+	// lagUpstreamFmt is run against a follower's upstream and reports the lag
+	// for a single standby identified by its application_name ($1).
+	var lagUpstreamFmt = `SELECT
+	    state,
+	    sync_state,
+	    (pg_%[2]s_%[1]s_diff(sent_%[1]s, write_%[1]s))::FLOAT8 AS durability_lag_bytes,
+	    (pg_%[2]s_%[1]s_diff(sent_%[1]s, flush_%[1]s))::FLOAT8 AS flush_lag_bytes,
+	    (pg_%[2]s_%[1]s_diff(sent_%[1]s, replay_%[1]s))::FLOAT8 AS visibility_lag_bytes,
+	    COALESCE(EXTRACT(EPOCH FROM '0'::INTERVAL), 0.0)::FLOAT8 AS visibility_lag_ms
+	    FROM
+	    pg_catalog.pg_stat_replication
+	    WHERE application_name = $1
+	    LIMIT 1`
+
 	var lagFollowerFmt = `SELECT
 	    'receiving' AS state,
 	    'applying' AS sync_state,
@@ -56,17 +132,95 @@ func Translate(pgMajor uint64) WALTranslations {
 	    COALESCE(EXTRACT(EPOCH FROM (NOW() - pg_last_xact_replay_timestamp())::INTERVAL), 0.0)::FLOAT8 AS visibility_lag_ms
 	    LIMIT 1`
 
+	// lagCascadeFmt reports this follower's lag relative to the LSN ($1)
+	// reported by its upstream.  Used when the upstream is itself a follower
+	// and pg_stat_replication on the upstream does not reflect the primary.
+	var lagCascadeFmt = `SELECT
+	    'receiving' AS state,
+	    'cascading' AS sync_state,
+	    0.0::FLOAT8 AS durability_lag_bytes,
+	    0.0::FLOAT8 AS flush_lag_bytes,
+	    GREATEST(COALESCE((pg_%[2]s_%[1]s_diff($1::TEXT::pg_lsn, pg_last_%[2]s_replay_%[1]s()))::FLOAT8, 0.0), 0.0)::FLOAT8 AS visibility_lag_bytes,
+	    COALESCE(EXTRACT(EPOCH FROM (NOW() - pg_last_xact_replay_timestamp())::INTERVAL), 0.0)::FLOAT8 AS visibility_lag_ms
+	    LIMIT 1`
+
+	var upstreamPositionFmt = `SELECT
+	    pg_is_in_recovery(),
+	    (CASE WHEN pg_is_in_recovery()
+	        THEN COALESCE(pg_last_%[2]s_receive_%[1]s(), pg_last_%[2]s_replay_%[1]s())
+	        ELSE pg_current_%[2]s_%[1]s()
+	    END)::TEXT`
+
+	var recoveryStateFmt = `SELECT
+	    pg_is_%[2]s_replay_paused(),
+	    pg_last_%[2]s_replay_%[1]s()::TEXT,
+	    COALESCE(SUM(confl_tablespace), 0)::INT8,
+	    COALESCE(SUM(confl_lock), 0)::INT8,
+	    COALESCE(SUM(confl_snapshot), 0)::INT8,
+	    COALESCE(SUM(confl_bufferpin), 0)::INT8,
+	    COALESCE(SUM(confl_deadlock), 0)::INT8
+	    FROM
+	    pg_catalog.pg_stat_database_conflicts`
+
+	// wal_status and safe_wal_size were added in PostgreSQL 13.
+	var replicationSlotsFmt = `SELECT
+	    slot_name::TEXT,
+	    slot_type,
+	    active,
+	    restart_lsn::TEXT,
+	    %[3]s,
+	    %[4]s::INT8,
+	    (CASE WHEN pg_is_in_recovery()
+	        THEN COALESCE(pg_last_%[2]s_receive_%[1]s(), pg_last_%[2]s_replay_%[1]s())
+	        ELSE pg_current_%[2]s_%[1]s()
+	    END)::TEXT
+	    FROM
+	    pg_catalog.pg_replication_slots
+	    ORDER BY slot_name`
+
+	// wal_keep_size replaced wal_keep_segments, and max_slot_wal_keep_size was
+	// added, in PostgreSQL 13.
+	var walRetentionFmt = `SELECT
+	    %[3]s::INT8,
+	    %[4]s::INT8,
+	    %[5]s::INT8,
+	    (CASE WHEN pg_is_in_recovery()
+	        THEN COALESCE(pg_last_%[2]s_receive_%[1]s(), pg_last_%[2]s_replay_%[1]s())
+	        ELSE pg_current_%[2]s_%[1]s()
+	    END)::TEXT`
+
+	// settingBytesFmt is the size of a setting in bytes.  pg_size_bytes() was
+	// added in PostgreSQL 9.6, and the units of wal_segment_size and
+	// max_wal_size changed in PostgreSQL 11, so the setting is scaled by its
+	// unit in pg_settings instead.
+	var settingBytesFmt = `(SELECT setting::INT8 * CASE unit
+	        WHEN 'kB' THEN 1024
+	        WHEN '8kB' THEN 8192
+	        WHEN 'MB' THEN 1048576
+	        WHEN '16MB' THEN 16777216
+	        ELSE 1
+	    END FROM pg_catalog.pg_settings WHERE name = '%s')`
+
+	// written_lsn and flushed_lsn replaced received_lsn in PostgreSQL 13.
+	var walReceiverFmt = `SELECT
+	    status,
+	    %[1]s::TEXT,
+	    %[2]s::TEXT,
+	    pg_last_wal_replay_lsn()::TEXT
+	    FROM
+	    pg_catalog.pg_stat_wal_receiver`
+
 	translations = WALTranslations{}
 	queries := WALQueries{}
-	if pgMajor < translateHorizon {
-		translations.Major = pgMajor
-		translations.Directory = "pg_xlog"
+	if pgVersion < translateHorizon {
+		translations.Major = MajorVersion(pgVersion)
+		translations.Directory = XLogDirectory
 		translations.Lsn = "location"
 		translations.Wal = "xlog"
 		queries.OldestLSNs = "SELECT timeline_id, redo_location, pg_last_xlog_replay_location() FROM pg_control_checkpoint()"
 	} else {
-		translations.Major = pgMajor
-		translations.Directory = "pg_wal"
+		translations.Major = MajorVersion(pgVersion)
+		translations.Directory = WALDirectory
 		translations.Lsn = "lsn"
 		translations.Wal = "wal"
 		queries.OldestLSNs = "SELECT timeline_id, redo_lsn, pg_last_wal_replay_lsn() FROM pg_control_checkpoint()"
@@ -74,8 +228,62 @@ func Translate(pgMajor uint64) WALTranslations {
 
 	queries.LagPrimary = fmt.Sprintf(lagPrimaryFmt, translations.Lsn, translations.Wal)
 	queries.LagFollower = fmt.Sprintf(lagFollowerFmt, translations.Lsn, translations.Wal)
+	queries.LagUpstream = fmt.Sprintf(lagUpstreamFmt, translations.Lsn, translations.Wal)
+	queries.LagCascade = fmt.Sprintf(lagCascadeFmt, translations.Lsn, translations.Wal)
+	queries.UpstreamPosition = fmt.Sprintf(upstreamPositionFmt, translations.Lsn, translations.Wal)
+	queries.RecoveryState = fmt.Sprintf(recoveryStateFmt, translations.Lsn, translations.Wal)
+	queries.Role = "SELECT pg_is_in_recovery()"
+
+	switch {
+	case pgVersion < translateHorizon:
+	case pgVersion < pg13Horizon:
+		queries.WALReceiver = fmt.Sprintf(walReceiverFmt, "received_lsn", "received_lsn")
+	default:
+		queries.WALReceiver = fmt.Sprintf(walReceiverFmt, "written_lsn", "flushed_lsn")
+	}
+
+	if pgVersion < pg13Horizon {
+		queries.ReplicationSlots = fmt.Sprintf(replicationSlotsFmt, translations.Lsn, translations.Wal, "''::TEXT", "-1")
+		queries.WALRetention = fmt.Sprintf(walRetentionFmt, translations.Lsn, translations.Wal,
+			"current_setting('wal_keep_segments')::INT8 * "+fmt.Sprintf(settingBytesFmt, "wal_segment_size"), "-1",
+			"COALESCE("+fmt.Sprintf(settingBytesFmt, "max_wal_size")+", 0)")
+	} else {
+		queries.ReplicationSlots = fmt.Sprintf(replicationSlotsFmt, translations.Lsn, translations.Wal, "COALESCE(wal_status, '')", "COALESCE(safe_wal_size, -1)")
+		queries.WALRetention = fmt.Sprintf(walRetentionFmt, translations.Lsn, translations.Wal,
+			"pg_size_bytes(current_setting('wal_keep_size'))", "pg_size_bytes(current_setting('max_slot_wal_keep_size'))",
+			"pg_size_bytes(current_setting('max_wal_size'))")
+	}
 
 	translations.Queries = queries
 
 	return translations
 }
+
+// MajorVersion truncates a version in the format of server_version_num to its
+// major version, e.g. 90613 to 90600 and 130004 to 130000.
+func MajorVersion(pgVersion uint64) uint64 {
+	if pgVersion < 100000 {
+		return pgVersion - pgVersion%100
+	}
+
+	return pgVersion - pgVersion%10000
+}
+
+// FindWALDirectory probes pgdata for the WAL directory and returns its name
+// relative to pgdata.  pg_wal is preferred if, for whatever reason, both
+// directories exist.
+func FindWALDirectory(pgdata string) (string, error) {
+	for _, dir := range []string{WALDirectory, XLogDirectory} {
+		fi, err := os.Stat(path.Join(pgdata, dir))
+		switch {
+		case err == nil && fi.IsDir():
+			return dir, nil
+		case err == nil, os.IsNotExist(err):
+			continue
+		default:
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("neither %s nor %s found in %q", WALDirectory, XLogDirectory, pgdata)
+}
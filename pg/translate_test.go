@@ -0,0 +1,271 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestFindWALDirectory(t *testing.T) {
+	tests := []struct {
+		dirs     []string
+		files    []string
+		out      string
+		wantFail bool
+	}{
+		{ // 0
+			dirs: []string{"pg_wal"},
+			out:  pg.WALDirectory,
+		},
+		{ // 1
+			dirs: []string{"pg_xlog"},
+			out:  pg.XLogDirectory,
+		},
+		{ // 2
+			dirs: []string{"pg_xlog", "pg_wal"},
+			out:  pg.WALDirectory,
+		},
+		{ // 3
+			files: []string{"pg_wal"},
+			dirs:  []string{"pg_xlog"},
+			out:   pg.XLogDirectory,
+		},
+		{ // 4
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		pgdata, err := ioutil.TempDir("", "pgdata")
+		if err != nil {
+			t.Fatalf("%d: unable to create PGDATA: %v", n, err)
+		}
+		defer os.RemoveAll(pgdata)
+
+		for _, dir := range test.dirs {
+			if err := os.Mkdir(path.Join(pgdata, dir), 0700); err != nil {
+				t.Fatalf("%d: unable to create %s: %v", n, dir, err)
+			}
+		}
+		for _, file := range test.files {
+			if err := ioutil.WriteFile(path.Join(pgdata, file), nil, 0600); err != nil {
+				t.Fatalf("%d: unable to create %s: %v", n, file, err)
+			}
+		}
+
+		out, err := pg.FindWALDirectory(pgdata)
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+
+		if out != test.out {
+			t.Fatalf("%d: got %q, want %q", n, out, test.out)
+		}
+	}
+}
+
+func TestTranslateServerVersion(t *testing.T) {
+	tests := []struct {
+		version     uint64
+		major       uint64
+		wal         string
+		walReceiver string
+	}{
+		{version: 90600, major: 90600, wal: "xlog"},                               // 0
+		{version: 90624, major: 90600, wal: "xlog"},                               // 1
+		{version: 120000, major: 120000, wal: "wal", walReceiver: "received_lsn"}, // 2
+		{version: 120017, major: 120000, wal: "wal", walReceiver: "received_lsn"}, // 3
+		{version: 130004, major: 130000, wal: "wal", walReceiver: "written_lsn"},  // 4
+		{version: 160002, major: 160000, wal: "wal", walReceiver: "written_lsn"},  // 5
+	}
+
+	for n, test := range tests {
+		tr := pg.Translate(test.version)
+		if tr.Major != test.major {
+			t.Fatalf("%d: major %d, want %d", n, tr.Major, test.major)
+		}
+		if tr.Wal != test.wal {
+			t.Fatalf("%d: wal %q, want %q", n, tr.Wal, test.wal)
+		}
+		if !strings.Contains(tr.Queries.WALReceiver, test.walReceiver) || (test.walReceiver == "") != (tr.Queries.WALReceiver == "") {
+			t.Fatalf("%d: WAL receiver query %q doesn't use %q", n, tr.Queries.WALReceiver, test.walReceiver)
+		}
+
+		// pg_replication_slots.restart_lsn kept its name when the functions
+		// were renamed in PostgreSQL 10.
+		if !strings.Contains(tr.Queries.ReplicationSlots, "restart_lsn::TEXT") {
+			t.Fatalf("%d: replication slots query %q doesn't use restart_lsn", n, tr.Queries.ReplicationSlots)
+		}
+	}
+}
+
+func TestReadQueryOverrides(t *testing.T) {
+	tests := []struct {
+		files    map[string]string
+		out      map[string]string
+		wantFail bool
+	}{
+		{ // 0
+			files: map[string]string{},
+			out:   map[string]string{},
+		},
+		{ // 1
+			files: map[string]string{
+				"lag-follower.sql": "SELECT 1",
+				"README":           "ignored",
+			},
+			out: map[string]string{"lag-follower": "SELECT 1"},
+		},
+		{ // 2
+			files:    map[string]string{"lag.sql": "SELECT 1"},
+			wantFail: true,
+		},
+		{ // 3
+			files:    map[string]string{"lag-primary.sql": "\n"},
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		dir, err := ioutil.TempDir("", "queries")
+		if err != nil {
+			t.Fatalf("%d: unable to create query directory: %v", n, err)
+		}
+		defer os.RemoveAll(dir)
+
+		for name, sql := range test.files {
+			if err := ioutil.WriteFile(path.Join(dir, name), []byte(sql), 0600); err != nil {
+				t.Fatalf("%d: unable to create %s: %v", n, name, err)
+			}
+		}
+
+		out, err := pg.ReadQueryOverrides(dir)
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+		if test.wantFail {
+			continue
+		}
+
+		if diff := pretty.Compare(out, test.out); diff != "" {
+			t.Fatalf("%d: overrides diff: (-got +want)\n%s", n, diff)
+		}
+
+		tr := pg.Translate(130000)
+		tr.Override(out)
+		if sql, found := out["lag-follower"]; found && tr.Queries.LagFollower != sql {
+			t.Fatalf("%d: lag-follower not overridden: %q", n, tr.Queries.LagFollower)
+		}
+	}
+}
+
+func TestValidateQueryOverrides(t *testing.T) {
+	tests := []struct {
+		overrides map[string]string
+		wantFail  bool
+	}{
+		{ // 0
+			overrides: map[string]string{},
+		},
+		{ // 1
+			overrides: map[string]string{
+				"role":        "SELECT pg_is_in_recovery()",
+				"oldest-lsns": "SELECT timeline_id, redo_{{lsn}}, pg_last_{{ wal }}_replay_{{lsn}}() FROM pg_control_checkpoint()",
+			},
+		},
+		{ // 2
+			overrides: map[string]string{"lag": "SELECT 1"},
+			wantFail:  true,
+		},
+		{ // 3
+			overrides: map[string]string{"role": " \n"},
+			wantFail:  true,
+		},
+		{ // 4
+			overrides: map[string]string{"role": "SELECT {{directory}}"},
+			wantFail:  true,
+		},
+	}
+
+	for n, test := range tests {
+		err := pg.ValidateQueryOverrides(test.overrides)
+		if err != nil && !test.wantFail {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+		if err == nil && test.wantFail {
+			t.Fatalf("%d: expected failure", n)
+		}
+	}
+}
+
+func TestOverridePlaceholders(t *testing.T) {
+	overrides := map[string]string{
+		"oldest-lsns": "SELECT timeline_id, redo_{{lsn}}, pg_last_{{ wal }}_replay_{{lsn}}() FROM pg_control_checkpoint()",
+		"role":        "SELECT true",
+	}
+
+	tests := []struct {
+		version    uint64
+		oldestLSNs string
+	}{
+		{ // 0
+			version:    90600,
+			oldestLSNs: "SELECT timeline_id, redo_location, pg_last_xlog_replay_location() FROM pg_control_checkpoint()",
+		},
+		{ // 1
+			version:    130004,
+			oldestLSNs: "SELECT timeline_id, redo_lsn, pg_last_wal_replay_lsn() FROM pg_control_checkpoint()",
+		},
+	}
+
+	for n, test := range tests {
+		tr := pg.Translate(test.version)
+		if tr.Queries.Role != "SELECT pg_is_in_recovery()" {
+			t.Fatalf("%d: role query %q", n, tr.Queries.Role)
+		}
+
+		tr.Override(overrides)
+		if tr.Queries.OldestLSNs != test.oldestLSNs {
+			t.Fatalf("%d: oldest LSNs query %q, want %q", n, tr.Queries.OldestLSNs, test.oldestLSNs)
+		}
+		if tr.Queries.Role != "SELECT true" {
+			t.Fatalf("%d: role not overridden: %q", n, tr.Queries.Role)
+		}
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	var got []string
+	for _, v := range pg.SupportedVersions() {
+		got = append(got, pg.MajorVersionString(v))
+	}
+
+	want := []string{"9.6", "10", "11", "12", "13", "14", "15", "16"}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("SupportedVersions diff: (-got +want)\n%s", diff)
+	}
+}
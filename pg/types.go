@@ -29,23 +29,25 @@ type (
 const (
 	InvalidTimelineID TimelineID = 0
 
+	// HeapPageSize is the default heap page size (BLCKSZ).  Clusters built
+	// with another block size are supported, the actual size is read from
+	// pg_control into ControlData.
 	HeapPageSize = WALPageSize
 
-	// HeapMaxSegmentSize is the max size of a single file in a relation.
-	//
-	// TODO(seanc@): pull this value from: `SELECT blocks_per_segment FROM
-	// pg_control_init()` and multiply it by HeapPageSize.
+	// HeapMaxSegmentSize is the default max size of a single file in a
+	// relation.  The actual number of blocks per segment is read from
+	// pg_control into ControlData.
 	HeapMaxSegmentSize = 1 * units.GiB
 )
 
-// HeapSegmentPageNum returns the page number of a given page inside of a heap
-// segment.
-func HeapSegmentPageNum(block HeapBlockNumber) HeapPageNumber {
-	return HeapPageNumber(uint64(block) % uint64(HeapMaxSegmentSize/HeapPageSize))
+// SegmentPageNum returns the page number of a given block inside of a heap
+// segment containing blocksPerSegment pages.
+func (heapBlockNo HeapBlockNumber) SegmentPageNum(blocksPerSegment uint64) HeapPageNumber {
+	return HeapPageNumber(uint64(heapBlockNo) % blocksPerSegment)
 }
 
-// SegmentNumber returns a HeapSegmentNumber corresponding to the SegmentNumber
-// for a given relation.
-func (heapBlockNo HeapBlockNumber) SegmentNumber() HeapSegmentNumber {
-	return HeapSegmentNumber(uint64(heapBlockNo) / uint64(HeapMaxSegmentSize/HeapPageSize))
+// SegmentNumberOf returns the HeapSegmentNumber of a block in a relation whose
+// segments contain blocksPerSegment pages.
+func (heapBlockNo HeapBlockNumber) SegmentNumberOf(blocksPerSegment uint64) HeapSegmentNumber {
+	return HeapSegmentNumber(uint64(heapBlockNo) / blocksPerSegment)
 }
@@ -0,0 +1,89 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// versionRE matches the leading numeric part of a version, ignoring suffixes
+// such as "devel" or "beta1".
+var versionRE = regexp.MustCompile(`^(\d+)(?:\.(\d+))?`)
+
+// ParseVersion parses a version string such as "9.6", "16" or "16.2" and
+// returns its major version in the format of server_version_num, e.g. 90600 or
+// 160000.  The minor version is discarded.
+func ParseVersion(version string) (uint64, error) {
+	m := versionRE.FindStringSubmatch(strings.TrimSpace(version))
+	if m == nil {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+
+	first, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to parse first section of version")
+	}
+
+	// Prior to PostgreSQL 10 the major version had two parts
+	if first >= 10 {
+		return first * 10000, nil
+	}
+	if m[2] == "" {
+		return 0, fmt.Errorf("version %q is missing its second section", version)
+	}
+	second, err := strconv.ParseUint(m[2], 10, 32)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to parse second section of version")
+	}
+
+	return first*10000 + second*100, nil
+}
+
+// ReadVersion reads PG_VERSION in pgdata and returns its major version.
+func ReadVersion(pgdata string) (uint64, error) {
+	buf, err := ioutil.ReadFile(path.Join(pgdata, "PG_VERSION"))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to read PG_VERSION")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	var version string
+	if scanner.Scan() {
+		version = scanner.Text()
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "unable to extract PostgreSQL's version string")
+	}
+
+	return ParseVersion(version)
+}
+
+// MajorVersionString formats a major version the way PostgreSQL names it,
+// e.g. "9.6" or "16".
+func MajorVersionString(major uint64) string {
+	if major < 100000 {
+		return fmt.Sprintf("%d.%d", major/10000, major/100%100)
+	}
+
+	return strconv.FormatUint(major/10000, 10)
+}
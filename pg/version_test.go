@@ -0,0 +1,83 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in       string
+		major    uint64
+		name     string
+		wantFail bool
+	}{
+		{ // 0
+			in:    "9.6",
+			major: 90600,
+			name:  "9.6",
+		},
+		{ // 1
+			in:    "9.6.24",
+			major: 90600,
+			name:  "9.6",
+		},
+		{ // 2
+			in:    "16\n",
+			major: 160000,
+			name:  "16",
+		},
+		{ // 3
+			in:    "15.4",
+			major: 150000,
+			name:  "15",
+		},
+		{ // 4
+			in:    "17devel",
+			major: 170000,
+			name:  "17",
+		},
+		{ // 5
+			in:       "9",
+			wantFail: true,
+		},
+		{ // 6
+			in:       "devel",
+			wantFail: true,
+		},
+	}
+
+	for n, test := range tests {
+		major, err := pg.ParseVersion(test.in)
+		if test.wantFail {
+			if err == nil {
+				t.Fatalf("%d: parsed %q as %d", n, test.in, major)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		}
+
+		if major != test.major {
+			t.Fatalf("%d: major %d, want %d", n, major, test.major)
+		}
+		if name := pg.MajorVersionString(major); name != test.name {
+			t.Fatalf("%d: name %q, want %q", n, name, test.name)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package waldump locates the pg_waldump(1) matching the major version of a
+// PostgreSQL cluster.  pg_waldump(1) only decodes the WAL of its own major
+// version, and hosts with several versions installed keep each in its own
+// directory.
+package waldump
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// probeTimeout bounds each invocation of pg_config(1) and --version.
+const probeTimeout = 5 * time.Second
+
+var (
+	// debianRoot holds an installation per major version in the layout of the
+	// Debian and Ubuntu packages, e.g. /usr/lib/postgresql/16/bin.
+	debianRoot = "/usr/lib/postgresql"
+
+	// rhelPrefix prefixes an installation per major version in the layout of
+	// the PGDG RPMs, e.g. /usr/pgsql-16/bin.
+	rhelPrefix = "/usr/pgsql-"
+
+	// fallbackDirs are searched after PATH.  /usr/local/bin was the default
+	// location of pg_waldump(1) before it was discovered.
+	fallbackDirs = []string{"/usr/local/bin"}
+)
+
+// versionOutputRE matches the output of --version, e.g.:
+//
+// pg_waldump (PostgreSQL) 16.2 (Debian 16.2-1.pgdg120+2)
+var versionOutputRE = regexp.MustCompile(`\(PostgreSQL\) (\S+)`)
+
+var (
+	cacheLock sync.Mutex
+	cache     = make(map[uint64]string)
+)
+
+// Name returns the name of pg_waldump(1) in major, which was named
+// pg_xlogdump(1) prior to PostgreSQL 10.
+func Name(major uint64) string {
+	if major != 0 && major < 100000 {
+		return "pg_xlogdump"
+	}
+
+	return "pg_waldump"
+}
+
+// Version runs path with --version and returns the major version of
+// PostgreSQL it was built for.
+func Version(ctx context.Context, path string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to run %s --version", path)
+	}
+
+	m := versionOutputRE.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("unrecognized %s --version output: %q", path, strings.TrimSpace(string(out)))
+	}
+
+	return pg.ParseVersion(string(m[1]))
+}
+
+// Find returns the path of the pg_waldump(1) for major, which is verified with
+// --version.  The directories searched are, in order, pg_config(1)'s bindir,
+// major's Debian and RHEL installations, PATH, and /usr/local/bin.  If major is
+// zero, e.g. because PGDATA has yet to be initialized, the first pg_waldump(1)
+// or pg_xlogdump(1) found is returned and every Debian and RHEL installation is
+// searched, newest first.  Results are cached for the life of the process
+// unless major is zero, in which case the result is only a guess.
+func Find(ctx context.Context, major uint64) (string, error) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if p, found := cache[major]; found {
+		return p, nil
+	}
+
+	names := []string{Name(major)}
+	if major == 0 {
+		names = append(names, "pg_xlogdump")
+	}
+
+	var mismatched []string
+	for _, dir := range searchDirs(ctx, major, names) {
+		for _, name := range names {
+			p := filepath.Join(dir, name)
+			if fi, err := os.Stat(p); err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+				continue
+			}
+
+			version, err := Version(ctx, p)
+			if err != nil {
+				log.Debug().Err(err).Str("path", p).Msg("skipping pg_waldump(1) candidate")
+				continue
+			}
+			if major == 0 {
+				return p, nil
+			}
+			if version != major {
+				mismatched = append(mismatched, fmt.Sprintf("%s (PostgreSQL %s)", p, pg.MajorVersionString(version)))
+				continue
+			}
+
+			cache[major] = p
+			return p, nil
+		}
+	}
+
+	if major == 0 {
+		return "", fmt.Errorf("unable to find %s", strings.Join(names, " or "))
+	}
+	if len(mismatched) > 0 {
+		return "", fmt.Errorf("unable to find %s for PostgreSQL %s, only %s", names[0], pg.MajorVersionString(major), strings.Join(mismatched, ", "))
+	}
+
+	return "", fmt.Errorf("unable to find %s for PostgreSQL %s", names[0], pg.MajorVersionString(major))
+}
+
+// searchDirs returns the directories to search for names, without duplicates.
+func searchDirs(ctx context.Context, major uint64, names []string) []string {
+	var dirs []string
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, "pg_config", "--bindir").Output(); err == nil {
+		dirs = append(dirs, strings.TrimSpace(string(out)))
+	}
+
+	if major != 0 {
+		version := pg.MajorVersionString(major)
+		dirs = append(dirs, filepath.Join(debianRoot, version, "bin"), rhelPrefix+version+"/bin")
+	} else {
+		dirs = append(dirs, installations()...)
+	}
+
+	for _, name := range names {
+		if p, err := exec.LookPath(name); err == nil {
+			dirs = append(dirs, filepath.Dir(p))
+		}
+	}
+	dirs = append(dirs, fallbackDirs...)
+
+	seen := make(map[string]bool, len(dirs))
+	unique := dirs[:0]
+	for _, dir := range dirs {
+		if dir != "" && !seen[filepath.Clean(dir)] {
+			seen[filepath.Clean(dir)] = true
+			unique = append(unique, dir)
+		}
+	}
+
+	return unique
+}
+
+// installations returns the bin directories of every Debian and RHEL
+// installation, newest version first.
+func installations() []string {
+	type installation struct {
+		dir     string
+		version uint64
+	}
+
+	var found []installation
+	for _, pattern := range []string{filepath.Join(debianRoot, "*", "bin"), rhelPrefix + "*/bin"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, dir := range matches {
+			version, err := pg.ParseVersion(strings.TrimPrefix(filepath.Base(filepath.Dir(dir)), filepath.Base(rhelPrefix)))
+			if err != nil {
+				continue
+			}
+			found = append(found, installation{dir: dir, version: version})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].version > found[j].version })
+
+	dirs := make([]string, 0, len(found))
+	for _, inst := range found {
+		dirs = append(dirs, inst.dir)
+	}
+
+	return dirs
+}
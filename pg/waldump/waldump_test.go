@@ -0,0 +1,121 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package waldump
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	root, err := ioutil.TempDir("", "waldump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Neither pg_config(1) nor pg_waldump(1) are on PATH
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", filepath.Join(root, "empty"))
+
+	defer func(d, r string, f []string) { debianRoot, rhelPrefix, fallbackDirs = d, r, f }(debianRoot, rhelPrefix, fallbackDirs)
+	debianRoot = filepath.Join(root, "usr/lib/postgresql")
+	rhelPrefix = filepath.Join(root, "usr/pgsql-")
+	fallbackDirs = nil
+
+	// Each binary reports its version the way its packaging does.  The
+	// binary in 13 was built for 12.
+	for p, version := range map[string]string{
+		"usr/lib/postgresql/9.6/bin/pg_xlogdump": "pg_xlogdump (PostgreSQL) 9.6.24",
+		"usr/lib/postgresql/13/bin/pg_waldump":   "pg_waldump (PostgreSQL) 12.9",
+		"usr/lib/postgresql/15/bin/pg_waldump":   "pg_waldump (PostgreSQL) 15.4 (Debian 15.4-1.pgdg120+1)",
+		"usr/pgsql-16/bin/pg_waldump":            "pg_waldump (PostgreSQL) 16.2",
+	} {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		script := fmt.Sprintf("#!/bin/sh\necho '%s'\n", version)
+		if err := ioutil.WriteFile(p, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		major   uint64
+		path    string
+		wantErr string
+	}{
+		{ // 0
+			major: 150000,
+			path:  "usr/lib/postgresql/15/bin/pg_waldump",
+		},
+		{ // 1
+			major: 160000,
+			path:  "usr/pgsql-16/bin/pg_waldump",
+		},
+		{ // 2
+			major: 90600,
+			path:  "usr/lib/postgresql/9.6/bin/pg_xlogdump",
+		},
+		{ // 3: the newest
+			major: 0,
+			path:  "usr/pgsql-16/bin/pg_waldump",
+		},
+		{ // 4
+			major:   130000,
+			wantErr: "unable to find pg_waldump for PostgreSQL 13, only " + filepath.Join(root, "usr/lib/postgresql/13/bin/pg_waldump") + " (PostgreSQL 12)",
+		},
+		{ // 5
+			major:   140000,
+			wantErr: "unable to find pg_waldump for PostgreSQL 14",
+		},
+	}
+
+	for n, test := range tests {
+		p, err := Find(context.Background(), test.major)
+		switch {
+		case test.wantErr != "" && (err == nil || err.Error() != test.wantErr):
+			t.Fatalf("%d: error %v, want %q", n, err, test.wantErr)
+		case test.wantErr == "" && err != nil:
+			t.Fatalf("%d: unexpected failure: %v", n, err)
+		case test.wantErr == "" && p != filepath.Join(root, test.path):
+			t.Fatalf("%d: found %q, want %q", n, p, test.path)
+		}
+	}
+
+	// Results are cached
+	if err := os.RemoveAll(filepath.Join(root, "usr/lib/postgresql/15")); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := Find(context.Background(), 150000); err != nil || !strings.HasSuffix(p, "15/bin/pg_waldump") {
+		t.Fatalf("cached result %q, %v", p, err)
+	}
+
+	// Guesses aren't cached, and pg_xlogdump(1) is found when it's the only
+	// installation
+	for _, dir := range []string{"usr/lib/postgresql/13", "usr/pgsql-16"} {
+		if err := os.RemoveAll(filepath.Join(root, dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p, err := Find(context.Background(), 0); err != nil || p != filepath.Join(root, "usr/lib/postgresql/9.6/bin/pg_xlogdump") {
+		t.Fatalf("guessed %q, %v", p, err)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walgen
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+var forkNames = []string{"main", "fsm", "vm", "init"}
+
+// formatLSN formats lsn the way PostgreSQL does.
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%08X", uint32(lsn>>32), uint32(lsn))
+}
+
+// Dump decodes the records in the segment at startPath, and any following
+// segments in the same directory, and writes them to w in the format of
+// pg_waldump(1).  If endPath is not empty, decoding stops at the end of the
+// segment at endPath.  Otherwise decoding continues until the WAL runs out,
+// which, as with pg_waldump(1), is reported as an error such as:
+//
+// error in WAL record at 0/3000140: invalid record length at 0/3000158: wanted 24, got 0
+//
+// Records, and the end of the WAL, are described as the pg_waldump(1) of the
+// version that wrote the segments would.  Only the records written by Write
+// can be described.
+func Dump(w io.Writer, startPath, endPath string) error {
+	tli, startLSN, err := pg.ParseWalfile(pg.WALFilename(filepath.Base(startPath)))
+	if err != nil {
+		return errors.Wrap(err, "unable to parse the start segment")
+	}
+	end := ^uint64(0)
+	if endPath != "" {
+		_, endLSN, err := pg.ParseWalfile(pg.WALFilename(filepath.Base(endPath)))
+		if err != nil {
+			return errors.Wrap(err, "unable to parse the end segment")
+		}
+		if endLSN < startLSN {
+			return fmt.Errorf("start WAL location %s is not before end segment %s", formatLSN(uint64(startLSN)), filepath.Base(endPath))
+		}
+		end = (uint64(endLSN.SegmentNumber()) + 1) * segmentSize
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	r := &segmentReader{dir: filepath.Dir(startPath), tli: tli}
+	pos := uint64(startLSN.SegmentNumber()) * segmentSize
+
+	// Skip the remainder of a record continued from the previous segment
+	remaining, err := r.pageHeader(pos, false)
+	if err != nil {
+		return err
+	}
+	pos += pageHeaderSize(pos)
+	version := r.version()
+	if remaining > 0 {
+		_, _, next, err := r.read(pos, int(remaining), true)
+		if err != nil {
+			return err
+		}
+		pos = (next + 7) &^ 7
+	}
+
+	var prev uint64
+	for pos < end {
+		lsn, hdr, next, err := r.read(pos, recordHeaderSize, false)
+		if err != nil {
+			return recordError(prev, err)
+		}
+
+		totLen := binary.LittleEndian.Uint32(hdr[0:])
+		if totLen < recordHeaderSize {
+			return recordError(prev, invalidLengthError(version, lsn, totLen))
+		}
+		_, body, next, err := r.read(next, int(totLen)-recordHeaderSize, true)
+		if err != nil {
+			return recordError(prev, err)
+		}
+
+		rec := append(hdr, body...)
+		if crc := binary.LittleEndian.Uint32(rec[20:]); crc != recordCRC(rec) {
+			return recordError(prev, fmt.Errorf("incorrect resource manager data checksum in record at %s", formatLSN(lsn)))
+		}
+
+		// The first record's predecessor wasn't read
+		if xlPrev := binary.LittleEndian.Uint64(rec[8:]); prev != 0 && xlPrev != prev {
+			return recordError(prev, fmt.Errorf("record with incorrect prev-link %s at %s", formatLSN(xlPrev), formatLSN(lsn)))
+		}
+
+		line, err := describeRecord(lsn, rec, version)
+		if err != nil {
+			return recordError(prev, errors.Wrapf(err, "unable to describe record at %s", formatLSN(lsn)))
+		}
+		if _, err := fmt.Fprintln(bw, line); err != nil {
+			return err
+		}
+
+		prev = lsn
+		pos = (next + 7) &^ 7
+	}
+
+	return nil
+}
+
+func recordError(lsn uint64, err error) error {
+	return fmt.Errorf("error in WAL record at %s: %v", formatLSN(lsn), err)
+}
+
+// invalidLengthError reports a record at lsn shorter than its header, which is
+// how the end of the WAL is found.  PostgreSQL 16 reworded the report.
+func invalidLengthError(version uint, lsn uint64, totLen uint32) error {
+	if version >= 16 {
+		return fmt.Errorf("invalid record length at %s: expected at least %d, got %d", formatLSN(lsn), recordHeaderSize, totLen)
+	}
+
+	return fmt.Errorf("invalid record length at %s: wanted %d, got %d", formatLSN(lsn), recordHeaderSize, totLen)
+}
+
+// segmentReader reads records from consecutive segments.
+type segmentReader struct {
+	dir   string
+	tli   pg.TimelineID
+	magic uint16
+
+	// buf holds segment segNo
+	segNo  pg.WALSegmentNumber
+	buf    []byte
+	loaded bool
+}
+
+// segment returns the contents of segNo.
+func (r *segmentReader) segment(segNo pg.WALSegmentNumber) ([]byte, error) {
+	if r.loaded && r.segNo == segNo {
+		return r.buf, nil
+	}
+
+	name := segmentFilename(r.tli, segNo)
+	buf, err := ioutil.ReadFile(filepath.Join(r.dir, name))
+	switch {
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("could not find file \"%s\": %v", name, err)
+	case err != nil:
+		return nil, errors.Wrapf(err, "could not read file \"%s\"", name)
+	case uint64(len(buf)) != segmentSize:
+		return nil, fmt.Errorf("WAL segment %s is %d bytes, expected %d", name, len(buf), segmentSize)
+	}
+
+	r.segNo, r.buf, r.loaded = segNo, buf, true
+
+	return buf, nil
+}
+
+// version returns the major version whose XLOG_PAGE_MAGIC the segments carry.
+func (r *segmentReader) version() uint {
+	for version, magic := range pageMagic {
+		if magic == r.magic {
+			return version
+		}
+	}
+
+	return 0
+}
+
+// pageHeader validates the header of the page at pos and returns the length of
+// the record continued on the page.
+func (r *segmentReader) pageHeader(pos uint64, continued bool) (uint32, error) {
+	buf, err := r.segment(pg.WALSegmentNumber(pos / segmentSize))
+	if err != nil {
+		return 0, err
+	}
+
+	off := pos % segmentSize
+	hdr := buf[off:]
+	magic := binary.LittleEndian.Uint16(hdr[0:])
+	if r.magic == 0 {
+		r.magic = magic
+	}
+
+	name := segmentFilename(r.tli, r.segNo)
+	info := binary.LittleEndian.Uint16(hdr[2:])
+	switch {
+	case magic != r.magic:
+		return 0, fmt.Errorf("invalid magic number %04X in log segment %s, offset %d", magic, name, off)
+	case binary.LittleEndian.Uint64(hdr[8:]) != pos:
+		return 0, fmt.Errorf("unexpected pageaddr %s in log segment %s, offset %d", formatLSN(binary.LittleEndian.Uint64(hdr[8:])), name, off)
+	case continued && info&xlpFirstIsContrecord == 0:
+		return 0, fmt.Errorf("there is no contrecord flag at %s", formatLSN(pos))
+	}
+
+	return binary.LittleEndian.Uint32(hdr[16:]), nil
+}
+
+// read reads n bytes of a record starting at pos, skipping page headers.  The
+// position of the first byte read and the position following the last byte
+// read are returned along with the bytes.  continued is true if the bytes
+// continue a record from a previous page.
+func (r *segmentReader) read(pos uint64, n int, continued bool) (uint64, []byte, uint64, error) {
+	start := pos
+	if n > 0 && pos%pageSize == 0 {
+		start += pageHeaderSize(pos)
+	}
+
+	data := make([]byte, 0, n)
+	for len(data) < n {
+		if pos%pageSize == 0 {
+			if _, err := r.pageHeader(pos, continued || len(data) > 0); err != nil {
+				return 0, nil, 0, err
+			}
+			pos += pageHeaderSize(pos)
+		}
+
+		buf, err := r.segment(pg.WALSegmentNumber(pos / segmentSize))
+		if err != nil {
+			return 0, nil, 0, err
+		}
+
+		off := pos % segmentSize
+		chunk := pageSize - pos%pageSize
+		if left := uint64(n - len(data)); chunk > left {
+			chunk = left
+		}
+		data = append(data, buf[off:off+chunk]...)
+		pos += chunk
+	}
+
+	return start, data, pos, nil
+}
+
+// describeRecord returns rec in the format of the pg_waldump(1) of version.
+// PostgreSQL 16 labels each field of the heap and B-tree descriptions.
+func describeRecord(lsn uint64, rec []byte, version uint) (string, error) {
+	le := binary.LittleEndian
+
+	var refs []string
+	var dataLen, mainLen int
+	var rel [3]uint32
+	body := rec[recordHeaderSize:]
+	for len(body) > 0 {
+		id := body[0]
+		if id == blockIDDataShort {
+			mainLen, body = int(body[1]), body[2:]
+			break
+		}
+		if id == blockIDDataLong {
+			mainLen, body = int(le.Uint32(body[1:])), body[5:]
+			break
+		}
+
+		// XLogRecordBlockHeader
+		forkFlags := body[1]
+		dataLen += int(le.Uint16(body[2:]))
+		body = body[4:]
+		if forkFlags&bkpBlockHasImage != 0 {
+			return "", errors.New("full page images are not supported")
+		}
+		if forkFlags&bkpBlockSameRel == 0 {
+			for i := range rel {
+				rel[i] = le.Uint32(body[4*i:])
+			}
+			body = body[12:]
+		}
+		blk := le.Uint32(body)
+		body = body[4:]
+
+		ref := fmt.Sprintf(", blkref #%d: rel %d/%d/%d", id, rel[0], rel[1], rel[2])
+		if fork := int(forkFlags & forkMask); fork != 0 && fork < len(forkNames) {
+			ref += " fork " + forkNames[fork]
+		}
+		refs = append(refs, ref+fmt.Sprintf(" blk %d", blk))
+	}
+	if len(body) != dataLen+mainLen {
+		return "", fmt.Errorf("record data is %d bytes, expected %d", len(body), dataLen+mainLen)
+	}
+	main := body[dataLen:]
+
+	var rmgr, desc string
+	info, rmid := rec[16], rec[17]
+	labeled := version >= 16
+	switch {
+	case rmid == rmHeap && info&xlogHeapOpMask == xlogHeapInsert && len(main) >= 3 && labeled:
+		rmgr, desc = "Heap", fmt.Sprintf("INSERT off: %d, flags: 0x%02X", le.Uint16(main[0:]), main[2])
+	case rmid == rmHeap && info&xlogHeapOpMask == xlogHeapDelete && len(main) >= 8 && labeled:
+		rmgr, desc = "Heap", fmt.Sprintf("DELETE xmax: %d, off: %d, %s, flags: 0x%02X",
+			le.Uint32(main[0:]), le.Uint16(main[4:]), infobitsDesc("infobits", main[6]), main[7])
+	case rmid == rmHeap && info&xlogHeapOpMask == xlogHeapUpdate && len(main) >= 14 && labeled:
+		rmgr, desc = "Heap", fmt.Sprintf("UPDATE old_xmax: %d, old_off: %d, %s, flags: 0x%02X, new_xmax: %d, new_off: %d",
+			le.Uint32(main[0:]), le.Uint16(main[4:]), infobitsDesc("old_infobits", main[6]), main[7],
+			le.Uint32(main[8:]), le.Uint16(main[12:]))
+	case rmid == rmBtree && info&xlogBtreeOpMask == xlogBtreeInsertLeaf && len(main) >= 2 && labeled:
+		rmgr, desc = "Btree", fmt.Sprintf("INSERT_LEAF off: %d", le.Uint16(main[0:]))
+	case rmid == rmHeap && info&xlogHeapOpMask == xlogHeapInsert && len(main) >= 3:
+		rmgr, desc = "Heap", fmt.Sprintf("INSERT off %d flags 0x%02X", le.Uint16(main[0:]), main[2])
+	case rmid == rmHeap && info&xlogHeapOpMask == xlogHeapDelete && len(main) >= 8:
+		rmgr, desc = "Heap", fmt.Sprintf("DELETE off %d flags 0x%02X", le.Uint16(main[4:]), main[7])
+	case rmid == rmHeap && info&xlogHeapOpMask == xlogHeapUpdate && len(main) >= 14:
+		rmgr, desc = "Heap", fmt.Sprintf("UPDATE off %d xmax %d flags 0x%02X ; new off %d xmax %d",
+			le.Uint16(main[4:]), le.Uint32(main[0:]), main[7], le.Uint16(main[12:]), le.Uint32(main[8:]))
+	case rmid == rmBtree && info&xlogBtreeOpMask == xlogBtreeInsertLeaf && len(main) >= 2:
+		rmgr, desc = "Btree", fmt.Sprintf("INSERT_LEAF off %d", le.Uint16(main[0:]))
+	case rmid == rmXact && info&xlogXactOpMask == xlogXactCommit && len(main) >= 8:
+		t := time.Unix(postgresEpochSeconds, 0).Add(time.Duration(int64(le.Uint64(main))) * time.Microsecond)
+		rmgr, desc = "Transaction", "COMMIT "+t.UTC().Format("2006-01-02 15:04:05.000000 MST")
+	default:
+		return "", fmt.Errorf("unknown record: rmid %d, info 0x%02X", rmid, info)
+	}
+
+	totLen := le.Uint32(rec[0:])
+	return fmt.Sprintf("rmgr: %-11s len (rec/tot): %6d/%6d, tx: %10d, lsn: %s, prev %s, desc: %s%s",
+		rmgr, totLen, totLen, le.Uint32(rec[4:]), formatLSN(lsn), formatLSN(le.Uint64(rec[8:])),
+		desc, strings.Join(refs, "")), nil
+}
+
+// infobitNames are the names of the xl_heap infobits, in bit order.
+var infobitNames = []string{"IS_MULTI", "LOCK_ONLY", "EXCL_LOCK", "KEYSHR_LOCK", "KEYS_UPDATED"}
+
+// infobitsDesc describes infobits the way PostgreSQL 16 does, e.g.
+// "infobits: [LOCK_ONLY, EXCL_LOCK]".
+func infobitsDesc(key string, infobits byte) string {
+	var names []string
+	for i, name := range infobitNames {
+		if infobits&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return fmt.Sprintf("%s: [%s]", key, strings.Join(names, ", "))
+}
@@ -0,0 +1,380 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// The layout of WAL pages and records.  See
+// postgresql/src/include/access/xlog_internal.h and xlogrecord.h.
+const (
+	pageSize    = uint64(pg.WALPageSize)
+	segmentSize = uint64(pg.WALSegmentSize)
+
+	shortPageHeaderSize = 24
+	longPageHeaderSize  = 40
+	recordHeaderSize    = 24
+
+	xlpFirstIsContrecord = 0x0001
+	xlpLongHeader        = 0x0002
+
+	blockIDDataShort = 255
+	blockIDDataLong  = 254
+	bkpBlockHasImage = 0x10
+	bkpBlockSameRel  = 0x80
+	forkMask         = 0x0F
+
+	rmXact  = 1
+	rmHeap  = 10
+	rmBtree = 11
+
+	xlogXactCommit       = 0x00
+	xlogHeapInsert       = 0x00
+	xlogHeapDelete       = 0x10
+	xlogHeapUpdate       = 0x20
+	xlogBtreeInsertLeaf  = 0x00
+	xlogXactOpMask       = 0x70
+	xlogHeapOpMask       = 0x70
+	xlogBtreeOpMask      = 0xF0
+	firstNormalXID       = 3
+	defaultSystemID      = 0x5C4B2F1D00000000
+	defaultMajorVersion  = 12
+	postgresEpochSeconds = 946684800
+)
+
+// pageMagic is XLOG_PAGE_MAGIC of each major version.  pg_waldump(1) only
+// decodes segments written by its own major version.
+var pageMagic = map[uint]uint16{
+	10: 0xD097,
+	11: 0xD098,
+	12: 0xD101,
+	13: 0xD106,
+	14: 0xD10D,
+	15: 0xD110,
+	16: 0xD113,
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Options control where and how segments are written.
+type Options struct {
+	Dir          string
+	Timeline     pg.TimelineID
+	StartSegment pg.WALSegmentNumber
+	Segments     uint
+
+	// Version is the major version of PostgreSQL whose page format is
+	// written.  Zero selects PostgreSQL 12.
+	Version  uint
+	SystemID uint64
+}
+
+// Result describes the segments written.
+type Result struct {
+	Files   []string
+	Records uint64
+
+	// End is the position following the last record.
+	End pg.LSN
+}
+
+// segmentFilename returns the name of segNo's file on timeline tli.
+func segmentFilename(tli pg.TimelineID, segNo pg.WALSegmentNumber) string {
+	return fmt.Sprintf("%08X%08X%08X", tli, segNo.High(), segNo.Low())
+}
+
+// Write fills opts.Segments consecutive segments with records from g and
+// writes them to opts.Dir.  Records span pages and segments as necessary.  The
+// remainder of the last segment, after the last record that fits, is left
+// zeroed, as it is in a segment PostgreSQL is still writing to.
+func Write(g *Generator, opts Options) (Result, error) {
+	if opts.Segments == 0 {
+		return Result{}, errors.New("at least one segment must be written")
+	}
+	if opts.Timeline == pg.InvalidTimelineID {
+		opts.Timeline = 1
+	}
+	if opts.Version == 0 {
+		opts.Version = defaultMajorVersion
+	}
+	if opts.SystemID == 0 {
+		opts.SystemID = defaultSystemID
+	}
+	magic, found := pageMagic[opts.Version]
+	if !found {
+		return Result{}, fmt.Errorf("unsupported PostgreSQL version %d", opts.Version)
+	}
+
+	w := &segmentWriter{
+		opts:  opts,
+		magic: magic,
+		segNo: opts.StartSegment,
+		buf:   make([]byte, segmentSize),
+		pos:   uint64(opts.StartSegment) * segmentSize,
+		limit: uint64(opts.StartSegment+pg.WALSegmentNumber(opts.Segments)) * segmentSize,
+	}
+
+	var res Result
+	var prev uint64
+	for {
+		r := g.Next()
+		rec := encodeRecord(r, prev)
+		if !w.fits(len(rec)) {
+			break
+		}
+
+		lsn, err := w.writeRecord(rec)
+		if err != nil {
+			return res, err
+		}
+		prev = lsn
+		res.Records++
+	}
+
+	if err := w.flush(); err != nil {
+		return res, err
+	}
+	res.Files = w.files
+	res.End = pg.LSN(w.pos)
+
+	return res, nil
+}
+
+// segmentWriter lays records out in pages and writes out each segment once it
+// is full.
+type segmentWriter struct {
+	opts  Options
+	magic uint16
+
+	// buf holds segment segNo.  pos is the position the next byte is written
+	// to and limit is the end of the last segment.
+	segNo pg.WALSegmentNumber
+	buf   []byte
+	pos   uint64
+	limit uint64
+
+	files []string
+}
+
+// pageHeaderSize returns the size of the header of the page starting at pos.
+func pageHeaderSize(pos uint64) uint64 {
+	if pos%segmentSize == 0 {
+		return longPageHeaderSize
+	}
+
+	return shortPageHeaderSize
+}
+
+// fits returns true if a record of n bytes can be written before the end of
+// the last segment.
+func (w *segmentWriter) fits(n int) bool {
+	pos, left := w.pos, uint64(n)
+	for left > 0 {
+		if pos%pageSize == 0 {
+			pos += pageHeaderSize(pos)
+		}
+
+		chunk := pageSize - pos%pageSize
+		if chunk > left {
+			chunk = left
+		}
+		pos += chunk
+		left -= chunk
+	}
+
+	return pos <= w.limit
+}
+
+// writeRecord writes rec at the current position and returns its LSN.  rec
+// must fit.
+func (w *segmentWriter) writeRecord(rec []byte) (uint64, error) {
+	lsn := w.pos
+	if lsn%pageSize == 0 {
+		lsn += pageHeaderSize(lsn)
+	}
+
+	for written := 0; written < len(rec); {
+		if w.pos%pageSize == 0 {
+			var remaining uint32
+			if written > 0 {
+				remaining = uint32(len(rec) - written)
+			}
+			if err := w.pageHeader(remaining); err != nil {
+				return 0, err
+			}
+		}
+
+		off := w.pos % segmentSize
+		n := copy(w.buf[off:off+pageSize-w.pos%pageSize], rec[written:])
+		written += n
+		w.pos += uint64(n)
+	}
+
+	// Records start MAXALIGNed
+	w.pos = (w.pos + 7) &^ 7
+
+	return lsn, nil
+}
+
+// pageInfo returns the xlp_info of the page at the current position.
+func (w *segmentWriter) pageInfo(remaining uint32) uint16 {
+	var info uint16
+	if w.pos%segmentSize == 0 {
+		info |= xlpLongHeader
+	}
+	if remaining > 0 {
+		info |= xlpFirstIsContrecord
+	}
+
+	return info
+}
+
+// pageHeader writes the header of the page at the current position, moving on
+// to the next segment if necessary.  remaining is the length of the remainder
+// of the record continued on the page.
+func (w *segmentWriter) pageHeader(remaining uint32) error {
+	if segNo := pg.WALSegmentNumber(w.pos / segmentSize); segNo != w.segNo {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		w.segNo = segNo
+		w.buf = make([]byte, segmentSize)
+	}
+
+	hdr := w.buf[w.pos%segmentSize:]
+	binary.LittleEndian.PutUint16(hdr[0:], w.magic)
+	binary.LittleEndian.PutUint16(hdr[2:], w.pageInfo(remaining))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(w.opts.Timeline))
+	binary.LittleEndian.PutUint64(hdr[8:], w.pos)
+	binary.LittleEndian.PutUint32(hdr[16:], remaining)
+	if w.pos%segmentSize == 0 {
+		binary.LittleEndian.PutUint64(hdr[24:], w.opts.SystemID)
+		binary.LittleEndian.PutUint32(hdr[32:], uint32(segmentSize))
+		binary.LittleEndian.PutUint32(hdr[36:], uint32(pageSize))
+	}
+	w.pos += pageHeaderSize(w.pos)
+
+	return nil
+}
+
+// flush writes out the current segment.
+func (w *segmentWriter) flush() error {
+	path := filepath.Join(w.opts.Dir, segmentFilename(w.opts.Timeline, w.segNo))
+	if err := ioutil.WriteFile(path, w.buf, 0600); err != nil {
+		return errors.Wrap(err, "unable to write WAL segment")
+	}
+	w.files = append(w.files, path)
+
+	return nil
+}
+
+// encodeRecord returns r encoded as an XLogRecord following the record at
+// prev.
+func encodeRecord(r Record, prev uint64) []byte {
+	var rmid, info uint8
+	var main []byte
+	le := binary.LittleEndian
+
+	switch r.Kind {
+	case HeapInsert:
+		// xl_heap_insert
+		rmid, info = rmHeap, xlogHeapInsert
+		main = make([]byte, 3)
+		le.PutUint16(main[0:], r.Offset)
+	case HeapDelete:
+		// xl_heap_delete
+		rmid, info = rmHeap, xlogHeapDelete
+		main = make([]byte, 8)
+		le.PutUint32(main[0:], r.XID)
+		le.PutUint16(main[4:], r.Offset)
+	case HeapUpdate:
+		// xl_heap_update.  The old tuple's block is only referenced if it
+		// differs from the new tuple's.
+		rmid, info = rmHeap, xlogHeapUpdate
+		main = make([]byte, 14)
+		le.PutUint32(main[0:], r.XID)
+		le.PutUint16(main[4:], r.Offset)
+		le.PutUint16(main[12:], r.Offset)
+		if r.Blocks[0] == r.Blocks[1] {
+			r.Blocks = r.Blocks[:1]
+		}
+	case BtreeInsert:
+		// xl_btree_insert
+		rmid, info = rmBtree, xlogBtreeInsertLeaf
+		main = make([]byte, 2)
+		le.PutUint16(main[0:], r.Offset)
+	case Commit:
+		// xl_xact_commit
+		rmid, info = rmXact, xlogXactCommit
+		main = make([]byte, 8)
+		le.PutUint64(main[0:], uint64(timestampTz(r.Time)))
+	}
+
+	rec := make([]byte, recordHeaderSize, 128)
+	for i, b := range r.Blocks {
+		var forkFlags uint8
+		if i > 0 && b.Tablespace == r.Blocks[i-1].Tablespace &&
+			b.Database == r.Blocks[i-1].Database && b.Relation == r.Blocks[i-1].Relation {
+			forkFlags |= bkpBlockSameRel
+		}
+
+		// XLogRecordBlockHeader, sans data
+		rec = append(rec, uint8(i), forkFlags, 0, 0)
+		if forkFlags&bkpBlockSameRel == 0 {
+			rec = appendUint32(rec, uint32(b.Tablespace))
+			rec = appendUint32(rec, uint32(b.Database))
+			rec = appendUint32(rec, uint32(b.Relation))
+		}
+		rec = appendUint32(rec, uint32(b.Block))
+	}
+	rec = append(rec, blockIDDataShort, uint8(len(main)))
+	rec = append(rec, main...)
+
+	// XLogRecord
+	le.PutUint32(rec[0:], uint32(len(rec)))
+	le.PutUint32(rec[4:], r.XID)
+	le.PutUint64(rec[8:], prev)
+	rec[16] = info
+	rec[17] = rmid
+	le.PutUint32(rec[20:], recordCRC(rec))
+
+	return rec
+}
+
+// appendUint32 appends v to b in little-endian byte order.
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// recordCRC returns the CRC-32C of rec, which covers the record's data and
+// then its header up to xl_crc.
+func recordCRC(rec []byte) uint32 {
+	crc := crc32.Checksum(rec[recordHeaderSize:], castagnoli)
+	return crc32.Update(crc, castagnoli, rec[:20])
+}
+
+// timestampTz returns t as a PostgreSQL TimestampTz: microseconds since
+// 2000-01-01 00:00:00 UTC.
+func timestampTz(t time.Time) int64 {
+	return t.Sub(time.Unix(postgresEpochSeconds, 0)).Microseconds()
+}
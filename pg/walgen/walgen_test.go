@@ -0,0 +1,254 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walgen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+var testWorkload = Workload{
+	Seed:          42,
+	Mix:           DefaultMix,
+	Tablespace:    1663,
+	Database:      16384,
+	FirstRelation: 16385,
+	Relations:     50,
+	Blocks:        1000,
+	Skew:          1.2,
+}
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Mix
+		err bool
+	}{
+		{ // 0
+			in:  "heap-insert=60,btree-insert=60,commit=10",
+			out: Mix{HeapInsert: 60, BtreeInsert: 60, Commit: 10},
+		},
+		{ // 1
+			in:  DefaultMix.String(),
+			out: DefaultMix,
+		},
+		{ // 2
+			in:  "heap-truncate=1",
+			err: true,
+		},
+		{ // 3
+			in:  "commit",
+			err: true,
+		},
+	}
+
+	for n, test := range tests {
+		mix, err := ParseMix(test.in)
+		if (err != nil) != test.err {
+			t.Fatalf("%d: error %v, want %t", n, err, test.err)
+		}
+		if diff := pretty.Compare(test.out, mix); diff != "" {
+			t.Fatalf("%d: mix diff: (-want +got)\n%s", n, diff)
+		}
+	}
+}
+
+func TestWriteDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewGenerator(testWorkload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Write(g, Options{Dir: dir, StartSegment: 2, Segments: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 2 || !strings.HasSuffix(res.Files[0], "000000010000000000000002") {
+		t.Fatalf("wrote %q", res.Files)
+	}
+
+	// Decoding runs off the end of the last segment's records
+	var out bytes.Buffer
+	err = Dump(&out, res.Files[0], "")
+	wantErr := fmt.Sprintf("invalid record length at %s: wanted 24, got 0", formatLSN(uint64(res.End)))
+	if err == nil || !strings.HasSuffix(err.Error(), wantErr) {
+		t.Fatalf("dump error %v, want %q", err, wantErr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if uint64(len(lines)) != res.Records {
+		t.Fatalf("dumped %d records, wrote %d", len(lines), res.Records)
+	}
+
+	// The same seed generates the same records
+	g, _ = NewGenerator(testWorkload)
+	for n, line := range lines {
+		r := g.Next()
+		for i, b := range r.Blocks {
+			if r.Kind == HeapUpdate && i == 1 && b == r.Blocks[0] {
+				continue
+			}
+
+			ref := fmt.Sprintf("blkref #%d: rel %d/%d/%d blk %d", i, b.Tablespace, b.Database, b.Relation, b.Block)
+			if !strings.Contains(line, ref) {
+				t.Fatalf("record %d: %q doesn't reference %q", n, line, ref)
+			}
+		}
+		if r.Kind == Commit && !strings.Contains(line, "desc: COMMIT 2019-01-01 ") {
+			t.Fatalf("record %d: %q isn't a commit", n, line)
+		}
+	}
+
+	// Decoding the second segment alone skips the record continued from the
+	// first, and stops at the end segment without an error when it's given.
+	out.Reset()
+	if err := Dump(&out, res.Files[1], res.Files[0]); err == nil {
+		t.Fatalf("dumped a range ending before it started")
+	}
+	err = Dump(&out, res.Files[1], res.Files[1])
+	if err == nil || !strings.HasSuffix(err.Error(), wantErr) {
+		t.Fatalf("dump error %v, want %q", err, wantErr)
+	}
+	if n := strings.Count(out.String(), "\n"); n == 0 || n >= len(lines) {
+		t.Fatalf("dumped %d records from the second segment", n)
+	}
+	if !strings.Contains(out.String(), "lsn: 0/03000") {
+		t.Fatalf("second segment doesn't start at 0/3000000:\n%s", out.String()[:200])
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewGenerator(testWorkload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Write(g, Options{Dir: dir, StartSegment: 1, Segments: 1, Version: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(res.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[longPageHeaderSize+recordHeaderSize+8] ^= 0xFF
+	if err := ioutil.WriteFile(res.Files[0], buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Dump(ioutil.Discard, res.Files[0], "")
+	if err == nil || !strings.Contains(err.Error(), "incorrect resource manager data checksum in record at 0/01000028") {
+		t.Fatalf("dump error %v, want a checksum failure", err)
+	}
+}
+
+func TestDumpVersions(t *testing.T) {
+	tests := []struct {
+		version uint
+		descs   []string
+		wantErr string
+	}{
+		{ // 0
+			version: 12,
+			descs:   []string{"desc: INSERT off ", "desc: UPDATE off ", "desc: DELETE off ", "desc: INSERT_LEAF off "},
+			wantErr: "wanted 24, got 0",
+		},
+		{ // 1
+			version: 16,
+			descs: []string{
+				"desc: INSERT off: ", "desc: UPDATE old_xmax: ", "desc: DELETE xmax: ", "infobits: [], flags: 0x00",
+				"desc: INSERT_LEAF off: ",
+			},
+			wantErr: "expected at least 24, got 0",
+		},
+	}
+
+	for n, test := range tests {
+		dir, err := ioutil.TempDir("", "walgen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		g, _ := NewGenerator(testWorkload)
+		res, err := Write(g, Options{Dir: dir, StartSegment: 1, Segments: 1, Version: test.version})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		err = Dump(&out, res.Files[0], "")
+		if err == nil || !strings.HasSuffix(err.Error(), test.wantErr) {
+			t.Fatalf("%d: dump error %v, want %q", n, err, test.wantErr)
+		}
+		for _, desc := range test.descs {
+			if !strings.Contains(out.String(), desc) {
+				t.Fatalf("%d: no record described as %q", n, desc)
+			}
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	dir, err := ioutil.TempDir("", "walgen")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b.SetBytes(int64(segmentSize))
+	for i := 0; i < b.N; i++ {
+		g, _ := NewGenerator(testWorkload)
+		if _, err := Write(g, Options{Dir: dir, StartSegment: 1, Segments: 1}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDump(b *testing.B) {
+	dir, err := ioutil.TempDir("", "walgen")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, _ := NewGenerator(testWorkload)
+	res, err := Write(g, Options{Dir: dir, StartSegment: 1, Segments: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(segmentSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Dump(ioutil.Discard, res.Files[0], res.Files[0])
+	}
+}
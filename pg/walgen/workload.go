@@ -0,0 +1,292 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package walgen synthesizes WAL segments for benchmarks and integration tests
+// that can't depend on a live PostgreSQL.  Records are drawn from a
+// configurable mix of heap, B-tree, and commit records against a set of
+// relations chosen with a configurable skew.
+//
+// The segments are valid enough to be decoded: pages carry headers, records
+// span pages and segments, and every record carries a CRC.  Only the main data
+// that pg_waldump(1) describes is written, i.e. records carry no tuple data or
+// full page images.  Dump decodes the segments in the format of pg_waldump(1)
+// so that the agent's decoder can be exercised where pg_waldump(1) isn't
+// installed.
+package walgen
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// Kind is a kind of WAL record.
+type Kind int
+
+const (
+	HeapInsert Kind = iota
+	HeapUpdate
+	HeapDelete
+	BtreeInsert
+	Commit
+)
+
+var kindNames = map[Kind]string{
+	HeapInsert:  "heap-insert",
+	HeapUpdate:  "heap-update",
+	HeapDelete:  "heap-delete",
+	BtreeInsert: "btree-insert",
+	Commit:      "commit",
+}
+
+// String returns the name of the kind as used by ParseMix.
+func (k Kind) String() string {
+	if name, found := kindNames[k]; found {
+		return name
+	}
+
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// Mix is the relative frequency of each kind of record.
+type Mix map[Kind]uint
+
+// DefaultMix approximates an OLTP workload with one index per table.
+var DefaultMix = Mix{
+	HeapInsert:  40,
+	HeapUpdate:  30,
+	HeapDelete:  5,
+	BtreeInsert: 45,
+	Commit:      20,
+}
+
+// ParseMix parses a comma separated list of kind=weight pairs, e.g.
+// "heap-insert=60,btree-insert=60,commit=10".
+func ParseMix(s string) (Mix, error) {
+	mix := make(Mix)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid record mix %q: expected kind=weight", pair)
+		}
+
+		kind, found := Kind(-1), false
+		for k, name := range kindNames {
+			if name == kv[0] {
+				kind, found = k, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid record kind %q", kv[0])
+		}
+
+		weight, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid weight for %s", kind)
+		}
+		mix[kind] = uint(weight)
+	}
+
+	return mix, nil
+}
+
+// String returns the mix in the format accepted by ParseMix.
+func (mix Mix) String() string {
+	kinds := make([]Kind, 0, len(mix))
+	for kind := range mix {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	pairs := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", kind, mix[kind]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// Workload describes the records to generate.
+type Workload struct {
+	// Seed makes the generated records reproducible.
+	Seed int64
+
+	Mix Mix
+
+	// Relations heap relations, numbered from FirstRelation, are written to.
+	// Each heap has one B-tree index, numbered from FirstRelation+Relations.
+	Tablespace    pg.OID
+	Database      pg.OID
+	FirstRelation pg.OID
+	Relations     uint
+
+	// Blocks is the initial size of each relation.  Updates, deletes, and
+	// index insertions are spread uniformly across a relation while heap
+	// insertions fill the relation's last block.
+	Blocks pg.HeapBlockNumber
+
+	// Skew is the exponent of the Zipf distribution relations are chosen with
+	// and must be greater than 1.  Zero chooses relations uniformly.
+	Skew float64
+}
+
+// BlockRef is a block referenced by a record.
+type BlockRef struct {
+	Tablespace pg.OID
+	Database   pg.OID
+	Relation   pg.OID
+	Block      pg.HeapBlockNumber
+}
+
+// Record is a generated WAL record.
+type Record struct {
+	Kind Kind
+	XID  uint32
+
+	// Offset is the line pointer of the tuple inserted, updated, or deleted.
+	Offset uint16
+
+	// Blocks are the blocks modified by the record.  For updates the new
+	// tuple's block comes first.
+	Blocks []BlockRef
+
+	// Time is the commit timestamp of commit records.
+	Time time.Time
+}
+
+// tuplesPerPage is the number of heap insertions after which a relation grows
+// by a block.
+const tuplesPerPage = 40
+
+// Generator generates the records of a workload.
+type Generator struct {
+	w     Workload
+	rand  *rand.Rand
+	zipf  *rand.Zipf
+	kinds []Kind
+	xid   uint32
+	clock time.Time
+
+	// sizes and inserted track each heap's size and the number of tuples
+	// inserted into its last block.
+	sizes    []pg.HeapBlockNumber
+	inserted []uint16
+}
+
+// NewGenerator returns a Generator of w's records.
+func NewGenerator(w Workload) (*Generator, error) {
+	switch {
+	case w.Relations == 0:
+		return nil, errors.New("a workload requires at least one relation")
+	case w.Blocks == 0:
+		return nil, errors.New("a workload requires relations of at least one block")
+	case w.Skew != 0 && w.Skew <= 1:
+		return nil, fmt.Errorf("skew must be greater than 1 (%g)", w.Skew)
+	}
+
+	g := &Generator{
+		w:        w,
+		rand:     rand.New(rand.NewSource(w.Seed)),
+		xid:      firstNormalXID,
+		clock:    time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		sizes:    make([]pg.HeapBlockNumber, w.Relations),
+		inserted: make([]uint16, w.Relations),
+	}
+	if w.Skew != 0 {
+		g.zipf = rand.NewZipf(g.rand, w.Skew, 1, uint64(w.Relations-1))
+	}
+	for i := range g.sizes {
+		g.sizes[i] = w.Blocks
+	}
+
+	// Expand the mix so that a kind is chosen with a single random number
+	for kind := HeapInsert; kind <= Commit; kind++ {
+		for i := uint(0); i < w.Mix[kind]; i++ {
+			g.kinds = append(g.kinds, kind)
+		}
+	}
+	if len(g.kinds) == 0 {
+		return nil, errors.New("the record mix is empty")
+	}
+
+	return g, nil
+}
+
+// relation chooses a heap relation.
+func (g *Generator) relation() int {
+	if g.zipf != nil {
+		return int(g.zipf.Uint64())
+	}
+
+	return g.rand.Intn(int(g.w.Relations))
+}
+
+// ref returns a reference to block of the i'th heap, or its index.
+func (g *Generator) ref(i int, index bool, block pg.HeapBlockNumber) BlockRef {
+	rel := g.w.FirstRelation + pg.OID(i)
+	if index {
+		rel += pg.OID(g.w.Relations)
+	}
+
+	return BlockRef{
+		Tablespace: g.w.Tablespace,
+		Database:   g.w.Database,
+		Relation:   rel,
+		Block:      block,
+	}
+}
+
+// Next returns the next record.
+func (g *Generator) Next() Record {
+	r := Record{
+		Kind: g.kinds[g.rand.Intn(len(g.kinds))],
+		XID:  g.xid,
+	}
+
+	i := g.relation()
+	switch r.Kind {
+	case HeapInsert:
+		if g.inserted[i] == tuplesPerPage {
+			g.sizes[i]++
+			g.inserted[i] = 0
+		}
+		g.inserted[i]++
+		r.Offset = g.inserted[i]
+		r.Blocks = []BlockRef{g.ref(i, false, g.sizes[i]-1)}
+	case HeapUpdate:
+		r.Offset = uint16(g.rand.Intn(tuplesPerPage) + 1)
+		r.Blocks = []BlockRef{
+			g.ref(i, false, pg.HeapBlockNumber(g.rand.Int63n(int64(g.sizes[i])))),
+			g.ref(i, false, pg.HeapBlockNumber(g.rand.Int63n(int64(g.sizes[i])))),
+		}
+	case HeapDelete:
+		r.Offset = uint16(g.rand.Intn(tuplesPerPage) + 1)
+		r.Blocks = []BlockRef{g.ref(i, false, pg.HeapBlockNumber(g.rand.Int63n(int64(g.sizes[i]))))}
+	case BtreeInsert:
+		// Block 0 is the metapage
+		r.Offset = uint16(g.rand.Intn(tuplesPerPage) + 1)
+		r.Blocks = []BlockRef{g.ref(i, true, 1+pg.HeapBlockNumber(g.rand.Int63n(int64(g.w.Blocks))))}
+	case Commit:
+		g.clock = g.clock.Add(time.Duration(g.rand.Intn(1000)) * time.Microsecond)
+		r.Time = g.clock
+		g.xid++
+	}
+
+	return r
+}
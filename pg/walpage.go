@@ -0,0 +1,72 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// WALPageHeaderSize is the size of the header at the start of every WAL page
+// (XLogPageHeaderData).  The first page of a segment has a longer header, but
+// the fields read here are common to both.
+const WALPageHeaderSize = 24
+
+// ValidWALPage returns true if hdr, the header of the WAL page at pageAddr, was
+// written for that position in the WAL.  A page beyond the end of the WAL
+// written so far is either zeroed, because the segment was preallocated, or
+// left over from the segment's previous use, because the segment was
+// recycled.  Neither has its own address in xlp_pageaddr.  Page headers are
+// read in little-endian byte order.
+func ValidWALPage(hdr []byte, pageAddr LSN) bool {
+	if len(hdr) < WALPageHeaderSize {
+		return false
+	}
+
+	magic := binary.LittleEndian.Uint16(hdr[0:])
+	addr := binary.LittleEndian.Uint64(hdr[8:])
+
+	return magic != 0 && LSN(addr) == pageAddr
+}
+
+// ValidWALEnd returns the end of the WAL written to the segment r, which
+// starts at segStart, so far: the end of the last page, searching from the page
+// containing from, with a valid header.  The WAL in the last valid page is
+// usually only partially written.  ValidWALEnd returns the start of the page
+// containing from if that page isn't valid.  A from outside of the segment,
+// e.g. InvalidLSN, searches the whole segment.
+func ValidWALEnd(r io.ReaderAt, segStart, from LSN) (LSN, error) {
+	segEnd := segStart.AddBytes(WALSegmentSize)
+	if from < segStart || from >= segEnd {
+		from = segStart
+	}
+
+	hdr := make([]byte, WALPageHeaderSize)
+	page := from - LSN(uint64(from-segStart)%uint64(WALPageSize))
+	for ; page < segEnd; page = page.AddBytes(WALPageSize) {
+		_, err := r.ReadAt(hdr, int64(page-segStart))
+		switch {
+		case err == io.EOF:
+			return page, nil
+		case err != nil:
+			return InvalidLSN, errors.Wrapf(err, "unable to read the WAL page at %s", page)
+		case !ValidWALPage(hdr, page):
+			return page, nil
+		}
+	}
+
+	return segEnd, nil
+}
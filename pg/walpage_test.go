@@ -0,0 +1,100 @@
+// Copyright © 2017 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestValidWALEnd(t *testing.T) {
+	const segStart = pg.LSN(3 * pg.WALSegmentSize)
+	const page = pg.WALPageSize
+
+	// segment returns a segment whose first valid pages are valid, followed by
+	// recycled pages written for the segment at recycledFrom, if any.
+	segment := func(valid int, recycledFrom pg.LSN) []byte {
+		buf := make([]byte, pg.WALSegmentSize)
+		for off := 0; off < len(buf); off += int(page) {
+			var addr pg.LSN
+			switch {
+			case off < valid*int(page):
+				addr = segStart.AddBytes(units.Base2Bytes(off))
+			case recycledFrom != pg.InvalidLSN:
+				addr = recycledFrom.AddBytes(units.Base2Bytes(off))
+			default:
+				continue
+			}
+			binary.LittleEndian.PutUint16(buf[off:], 0xD101)
+			binary.LittleEndian.PutUint64(buf[off+8:], uint64(addr))
+		}
+		return buf
+	}
+
+	tests := []struct {
+		buf  []byte
+		from pg.LSN
+		end  pg.LSN
+	}{
+		{ // 0: preallocated remainder
+			buf:  segment(3, pg.InvalidLSN),
+			from: segStart,
+			end:  segStart.AddBytes(3 * page),
+		},
+		{ // 1: recycled remainder
+			buf:  segment(3, pg.LSN(1*pg.WALSegmentSize)),
+			from: segStart,
+			end:  segStart.AddBytes(3 * page),
+		},
+		{ // 2: searching from the middle of a valid page
+			buf:  segment(3, pg.InvalidLSN),
+			from: segStart.AddBytes(page + 100),
+			end:  segStart.AddBytes(3 * page),
+		},
+		{ // 3: a recycled segment that hasn't been written to yet
+			buf:  segment(0, pg.LSN(1*pg.WALSegmentSize)),
+			from: pg.InvalidLSN,
+			end:  segStart,
+		},
+		{ // 4: a complete segment
+			buf:  segment(int(pg.WALSegmentSize/page), pg.InvalidLSN),
+			from: segStart.AddBytes(page),
+			end:  segStart.AddBytes(pg.WALSegmentSize),
+		},
+		{ // 5: a short file
+			buf:  segment(5, pg.InvalidLSN)[:2*page+10],
+			from: segStart,
+			end:  segStart.AddBytes(2 * page),
+		},
+		{ // 6: searching from past the end
+			buf:  segment(2, pg.InvalidLSN),
+			from: segStart.AddBytes(4*page + 100),
+			end:  segStart.AddBytes(4 * page),
+		},
+	}
+
+	for n, test := range tests {
+		end, err := pg.ValidWALEnd(bytes.NewReader(test.buf), segStart, test.from)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if end != test.end {
+			t.Errorf("%d: end %s, want %s", n, end, test.end)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/alecthomas/units"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// WALReceiverState is a follower's WAL receiver position as reported by
+// pg_stat_wal_receiver along with its replay position.
+type WALReceiverState struct {
+	// Status is the WAL receiver's status (e.g. "streaming").
+	Status string
+
+	// WrittenLSN is the LSN up to which WAL has been written to disk, and
+	// FlushedLSN the LSN up to which WAL has been flushed.  Prior to PostgreSQL
+	// 13 only the flushed position (received_lsn) is reported and WrittenLSN
+	// equals FlushedLSN.
+	WrittenLSN LSN
+	FlushedLSN LSN
+
+	// ReplayLSN is the LSN of the last record replayed.
+	ReplayLSN LSN
+}
+
+// ReceivedLSN returns the end of the WAL received.  WAL that has been written
+// but not flushed is readable by pg_waldump(1) and is counted.
+func (s WALReceiverState) ReceivedLSN() LSN {
+	if s.WrittenLSN > s.FlushedLSN {
+		return s.WrittenLSN
+	}
+
+	return s.FlushedLSN
+}
+
+// VisibilityLag returns the amount of WAL received but not yet replayed.
+func (s WALReceiverState) VisibilityLag() units.Base2Bytes {
+	received := s.ReceivedLSN()
+	if received <= s.ReplayLSN {
+		return 0
+	}
+
+	return units.Base2Bytes(received - s.ReplayLSN)
+}
+
+// QueryWALReceiver queries a follower for its WAL receiver's position.  found
+// is false when the follower has no WAL receiver (e.g. it is restoring from the
+// archive), the WAL receiver hasn't received any WAL, the database predates
+// pg_stat_wal_receiver, or the connected role isn't permitted to see the WAL
+// receiver's position.
+func QueryWALReceiver(ctx context.Context, pool *pgx.ConnPool, walTranslations *WALTranslations) (state WALReceiverState, found bool, err error) {
+	if walTranslations.Queries.WALReceiver == "" {
+		return WALReceiverState{}, false, nil
+	}
+
+	var status, written, flushed, replay *string
+	switch err := pool.QueryRowEx(ctx, walTranslations.Queries.WALReceiver, nil).Scan(&status, &written, &flushed, &replay); {
+	case err == pgx.ErrNoRows:
+		return WALReceiverState{}, false, nil
+	case err != nil:
+		return WALReceiverState{}, false, errors.Wrap(err, "unable to query pg_stat_wal_receiver")
+	case status == nil || written == nil || flushed == nil || replay == nil:
+		return WALReceiverState{}, false, nil
+	}
+
+	state.Status = *status
+	for _, lsn := range []struct {
+		in  string
+		out *LSN
+	}{
+		{*written, &state.WrittenLSN},
+		{*flushed, &state.FlushedLSN},
+		{*replay, &state.ReplayLSN},
+	} {
+		if *lsn.out, err = ParseLSN(lsn.in); err != nil {
+			return WALReceiverState{}, false, errors.Wrap(err, "unable to parse WAL receiver LSN")
+		}
+	}
+
+	return state, true, nil
+}
@@ -0,0 +1,104 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestWALReceiverStateVisibilityLag(t *testing.T) {
+	tests := []struct {
+		written string
+		flushed string
+		replay  string
+		lag     units.Base2Bytes
+	}{
+		{ // 0: caught up
+			written: "0/3000060",
+			flushed: "0/3000060",
+			replay:  "0/3000060",
+			lag:     0,
+		},
+		{ // 1
+			written: "0/3000060",
+			flushed: "0/3000060",
+			replay:  "0/3000000",
+			lag:     0x60,
+		},
+		{ // 2: written but not yet flushed WAL counts
+			written: "0/4000000",
+			flushed: "0/3000060",
+			replay:  "0/3000000",
+			lag:     0x1000000,
+		},
+		{ // 3: across a log boundary
+			written: "1/00000010",
+			flushed: "1/00000010",
+			replay:  "0/FFFFFFF0",
+			lag:     0x20,
+		},
+		{ // 4: replay ahead of the WAL receiver (e.g. WAL restored from the archive)
+			written: "0/3000000",
+			flushed: "0/3000000",
+			replay:  "0/5000000",
+			lag:     0,
+		},
+	}
+
+	for n, test := range tests {
+		state := pg.WALReceiverState{
+			Status:     "streaming",
+			WrittenLSN: pg.MustParseLSN(test.written),
+			FlushedLSN: pg.MustParseLSN(test.flushed),
+			ReplayLSN:  pg.MustParseLSN(test.replay),
+		}
+
+		if lag := state.VisibilityLag(); lag != test.lag {
+			t.Fatalf("%d: lag %d, want %d", n, lag, test.lag)
+		}
+	}
+}
+
+func TestTranslateWALReceiver(t *testing.T) {
+	tests := []struct {
+		major   uint64
+		columns []string
+	}{
+		{major: 90600},
+		{major: 100000, columns: []string{"received_lsn"}},
+		{major: 120000, columns: []string{"received_lsn"}},
+		{major: 130000, columns: []string{"written_lsn", "flushed_lsn"}},
+		{major: 160000, columns: []string{"written_lsn", "flushed_lsn"}},
+	}
+
+	for n, test := range tests {
+		sql := pg.Translate(test.major).Queries.WALReceiver
+		if len(test.columns) == 0 {
+			if sql != "" {
+				t.Fatalf("%d: unexpected WAL receiver query: %q", n, sql)
+			}
+			continue
+		}
+
+		for _, column := range test.columns {
+			if !strings.Contains(sql, column) {
+				t.Fatalf("%d: WAL receiver query %q does not contain %s", n, sql, column)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/alecthomas/units"
+)
+
+type (
+	// TransactionID is a 32 bit transaction ID (xid).
+	TransactionID uint32
+
+	// SLRU identifies one of PostgreSQL's SLRU-managed directories.  SLRUNone
+	// identifies a relation.
+	SLRU uint8
+)
+
+const (
+	SLRUNone SLRU = iota
+	SLRUXact
+	SLRUMultiXactOffsets
+	SLRUMultiXactMembers
+	SLRUCommitTs
+)
+
+const (
+	// SLRUPagesPerSegment is the number of pages in an SLRU segment file.
+	SLRUPagesPerSegment = 32
+
+	// XactDirectory and ClogDirectory are the names of the commit log
+	// directory in PGDATA as of PostgreSQL 10 and prior to PostgreSQL 10,
+	// respectively.
+	XactDirectory = "pg_xact"
+	ClogDirectory = "pg_clog"
+
+	// CommitTsDirectory is the name of the commit timestamp directory in
+	// PGDATA.
+	CommitTsDirectory = "pg_commit_ts"
+
+	// xactsPerByte is the number of transaction statuses stored in a byte of
+	// the commit log (two bits per transaction).
+	xactsPerByte = 4
+
+	// commitTsEntrySize is the size of a commit timestamp entry: a timestamp
+	// and a replication origin ID.
+	commitTsEntrySize = 8 + 2
+)
+
+func (s SLRU) String() string {
+	switch s {
+	case SLRUNone:
+		return "none"
+	case SLRUXact:
+		return "xact"
+	case SLRUMultiXactOffsets:
+		return "multixact-offsets"
+	case SLRUMultiXactMembers:
+		return "multixact-members"
+	case SLRUCommitTs:
+		return "commit-ts"
+	default:
+		panic(fmt.Sprintf("unknown SLRU: %d", s))
+	}
+}
+
+// Directory returns the directory containing the SLRU's segments relative to
+// pgdata.
+func (s SLRU) Directory(pgdata string) string {
+	switch s {
+	case SLRUXact:
+		// Fall back to pg_xact and let the open(2) report the missing directory.
+		dir, err := FindXactDirectory(pgdata)
+		if err != nil {
+			return XactDirectory
+		}
+		return dir
+	case SLRUMultiXactOffsets:
+		return MultiXactOffsetsDirectory
+	case SLRUMultiXactMembers:
+		return MultiXactMembersDirectory
+	case SLRUCommitTs:
+		return CommitTsDirectory
+	default:
+		panic(fmt.Sprintf("no directory for SLRU: %s", s))
+	}
+}
+
+// XactPage returns the commit log page containing the status of xid.
+func XactPage(xid TransactionID, blockSize units.Base2Bytes) HeapBlockNumber {
+	return HeapBlockNumber(uint64(xid) / (uint64(blockSize) * xactsPerByte))
+}
+
+// CommitTsPage returns the commit timestamp page containing the entry for xid.
+func CommitTsPage(xid TransactionID, blockSize units.Base2Bytes) HeapBlockNumber {
+	return HeapBlockNumber(uint64(xid) / (uint64(blockSize) / commitTsEntrySize))
+}
+
+// SLRUSegmentFilename returns the name of the SLRU segment file containing
+// page.
+func SLRUSegmentFilename(page HeapBlockNumber) string {
+	return fmt.Sprintf("%04X", uint64(page)/SLRUPagesPerSegment)
+}
+
+// FindXactDirectory probes pgdata for the commit log directory and returns its
+// name relative to pgdata.
+func FindXactDirectory(pgdata string) (string, error) {
+	for _, dir := range []string{XactDirectory, ClogDirectory} {
+		fi, err := os.Stat(path.Join(pgdata, dir))
+		switch {
+		case err == nil && fi.IsDir():
+			return dir, nil
+		case err == nil, os.IsNotExist(err):
+			continue
+		default:
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("neither %s nor %s found in %q", XactDirectory, ClogDirectory, pgdata)
+}
@@ -0,0 +1,64 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+func TestXactPage(t *testing.T) {
+	tests := []struct {
+		xid      pg.TransactionID
+		page     pg.HeapBlockNumber
+		filename string
+	}{
+		{xid: 0, page: 0, filename: "0000"},
+		{xid: 32767, page: 0, filename: "0000"},
+		{xid: 32768, page: 1, filename: "0000"},
+		{xid: 32 * 32768, page: 32, filename: "0001"},
+		{xid: math.MaxUint32, page: 131071, filename: "0FFF"},
+	}
+
+	for n, test := range tests {
+		page := pg.XactPage(test.xid, pg.HeapPageSize)
+		if page != test.page {
+			t.Fatalf("%d: page: got %d, want %d", n, page, test.page)
+		}
+
+		if filename := pg.SLRUSegmentFilename(page); filename != test.filename {
+			t.Fatalf("%d: filename: got %q, want %q", n, filename, test.filename)
+		}
+	}
+}
+
+func TestCommitTsPage(t *testing.T) {
+	tests := []struct {
+		xid  pg.TransactionID
+		page pg.HeapBlockNumber
+	}{
+		{xid: 0, page: 0},
+		{xid: 818, page: 0},
+		{xid: 819, page: 1},
+		{xid: math.MaxUint32, page: 5244160},
+	}
+
+	for n, test := range tests {
+		if page := pg.CommitTsPage(test.xid, pg.HeapPageSize); page != test.page {
+			t.Fatalf("%d: page: got %d, want %d", n, page, test.page)
+		}
+	}
+}